@@ -0,0 +1,279 @@
+/*
+Reed-Solomon纠删码（GF(2^8)，本原多项式0x11d）。
+
+文件被切分为data个数据碎片，再生成total-data个校验碎片，任意data个碎片都可以拼回原始数据。
+编码矩阵是系统码：前data个碎片就是原始数据的切片。
+*/
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+const MAX_SHARDS = 256
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+func pow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])*n%255]
+}
+
+type Coder struct {
+	data   int
+	total  int
+	matrix [][]byte //total*data的编码矩阵
+}
+
+/*
+	创建编码器
+
+	参数：
+		data: 拼回原始数据需要的碎片数
+		total: 碎片总数，不超过MAX_SHARDS
+*/
+func New(data, total int) (c *Coder, e error) {
+	if data <= 0 || total < data || total > MAX_SHARDS {
+		return nil, fmt.Errorf("invalid shards: data %d, total %d", data, total)
+	}
+	//范德蒙矩阵乘以其前data行的逆矩阵，任意data行仍然可逆
+	vm := make([][]byte, total)
+	for i := range vm {
+		vm[i] = make([]byte, data)
+		for j := range vm[i] {
+			vm[i][j] = pow(byte(i), j)
+		}
+	}
+	top, e := invert(vm[:data])
+	if e != nil {
+		return
+	}
+	return &Coder{data, total, multiply(vm, top)}, nil
+}
+
+func (c *Coder) DataShards() int {
+	return c.data
+}
+
+func (c *Coder) TotalShards() int {
+	return c.total
+}
+
+//长度为size的数据每个碎片的大小
+func (c *Coder) ShardSize(size int) int {
+	return (size + c.data - 1) / c.data
+}
+
+//生成全部碎片
+func (c *Coder) Encode(b []byte) (shards [][]byte) {
+	shards = make([][]byte, c.total)
+	for i := range shards {
+		shards[i] = c.EncodeShard(b, i)
+	}
+	return
+}
+
+//只生成第idx个碎片
+func (c *Coder) EncodeShard(b []byte, idx int) (shard []byte) {
+	size := c.ShardSize(len(b))
+	shard = make([]byte, size)
+	for j := 0; j < c.data; j++ {
+		begin := j * size
+		if begin >= len(b) {
+			break
+		}
+		end := begin + size
+		if end > len(b) {
+			end = len(b)
+		}
+		mulAdd(shard, b[begin:end], c.matrix[idx][j])
+	}
+	return
+}
+
+/*
+	用任意data个碎片拼回原始数据
+
+	参数：
+		shards: 碎片序号 -> 碎片内容，多于data个时只使用其中的data个
+		size: 原始数据长度
+*/
+func (c *Coder) Decode(shards map[int][]byte, size int) (b []byte, e error) {
+	shardSize := c.ShardSize(size)
+	idxs, dec, e := c.decoder(shards, shardSize)
+	if e != nil {
+		return
+	}
+	b = make([]byte, c.data*shardSize)
+	for j := 0; j < c.data; j++ {
+		out := b[j*shardSize : (j+1)*shardSize]
+		for i, idx := range idxs {
+			mulAdd(out, shards[idx], dec[j][i])
+		}
+	}
+	return b[:size], nil
+}
+
+/*
+	用任意data个碎片同一位置的一段拼回第j个数据碎片在该位置的一段，用于只读取原始数据的一部分
+
+	参数：
+		shards: 碎片序号 -> 碎片中同一范围的内容，长度都相同
+		j: 数据碎片的序号，小于data
+*/
+func (c *Coder) DecodeShard(shards map[int][]byte, j int) (b []byte, e error) {
+	if j < 0 || j >= c.data {
+		return nil, fmt.Errorf("invalid data shard %d", j)
+	}
+	size := -1
+	for _, shard := range shards {
+		size = len(shard)
+		break
+	}
+	if shard, ok := shards[j]; ok {
+		return append([]byte(nil), shard...), nil
+	}
+	idxs, dec, e := c.decoder(shards, size)
+	if e != nil {
+		return
+	}
+	b = make([]byte, size)
+	for i, idx := range idxs {
+		mulAdd(b, shards[idx], dec[j][i])
+	}
+	return
+}
+
+//选出data个碎片，返回它们的序号和解码矩阵
+func (c *Coder) decoder(shards map[int][]byte, shardSize int) (idxs []int, dec [][]byte, e error) {
+	idxs = make([]int, 0, c.data)
+	for i := 0; i < c.total && len(idxs) < c.data; i++ {
+		shard, ok := shards[i]
+		if !ok {
+			continue
+		}
+		if len(shard) != shardSize {
+			return nil, nil, fmt.Errorf("shard %d: size %d, expected %d", i, len(shard), shardSize)
+		}
+		idxs = append(idxs, i)
+	}
+	if len(idxs) < c.data {
+		return nil, nil, fmt.Errorf("need %d shards, got %d", c.data, len(idxs))
+	}
+	sub := make([][]byte, c.data)
+	for i, idx := range idxs {
+		sub[i] = c.matrix[idx]
+	}
+	dec, e = invert(sub)
+	return
+}
+
+//dst ^= src * k
+func mulAdd(dst, src []byte, k byte) {
+	if k == 0 {
+		return
+	}
+	if k == 1 {
+		for i, v := range src {
+			dst[i] ^= v
+		}
+		return
+	}
+	lk := int(logTable[k])
+	for i, v := range src {
+		if v != 0 {
+			dst[i] ^= expTable[int(logTable[v])+lk]
+		}
+	}
+}
+
+func multiply(a, b [][]byte) (m [][]byte) {
+	m = make([][]byte, len(a))
+	for i := range a {
+		m[i] = make([]byte, len(b[0]))
+		for j := range m[i] {
+			var v byte
+			for k := range b {
+				v ^= mul(a[i][k], b[k][j])
+			}
+			m[i][j] = v
+		}
+	}
+	return
+}
+
+//高斯-约当消元求逆矩阵
+func invert(a [][]byte) (inv [][]byte, e error) {
+	n := len(a)
+	work := make([][]byte, n)
+	inv = make([][]byte, n)
+	for i := range a {
+		work[i] = append([]byte(nil), a[i]...)
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		if k := work[col][col]; k != 1 {
+			for j := 0; j < n; j++ {
+				work[col][j] = div(work[col][j], k)
+				inv[col][j] = div(inv[col][j], k)
+			}
+		}
+		for row := 0; row < n; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			k := work[row][col]
+			for j := 0; j < n; j++ {
+				work[row][j] ^= mul(k, work[col][j])
+				inv[row][j] ^= mul(k, inv[col][j])
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,79 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, c := range []struct{ data, total, size int }{{1, 1, 10}, {2, 3, 0}, {4, 8, 1}, {4, 8, 1001}, {32, 64, 5000}, {128, 208, 3000}} {
+		coder, e := New(c.data, c.total)
+		if e != nil {
+			t.Fatal(e)
+		}
+		b := make([]byte, c.size)
+		r.Read(b)
+		shards := coder.Encode(b)
+		//任意data个碎片都能拼回
+		for round := 0; round < 5; round++ {
+			m := make(map[int][]byte)
+			for _, idx := range r.Perm(c.total)[:c.data] {
+				m[idx] = shards[idx]
+			}
+			got, e := coder.Decode(m, c.size)
+			if e != nil {
+				t.Fatalf("%+v: %v", c, e)
+			}
+			if !bytes.Equal(got, b) {
+				t.Fatalf("%+v: decoded data differs", c)
+			}
+		}
+		if c.data > 1 {
+			if _, e = coder.Decode(map[int][]byte{1: shards[1]}, c.size); e == nil {
+				t.Errorf("%+v: decode with too few shards succeeded", c)
+			}
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, c := range [][2]int{{0, 1}, {3, 2}, {1, MAX_SHARDS + 1}} {
+		if _, e := New(c[0], c[1]); e == nil {
+			t.Errorf("New(%d, %d) succeeded", c[0], c[1])
+		}
+	}
+}
+
+//任意data个碎片的同一段拼回数据碎片的同一段
+func TestDecodeShard(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	coder, _ := New(4, 8)
+	b := make([]byte, 1001)
+	r.Read(b)
+	shards := coder.Encode(b)
+	size := coder.ShardSize(len(b))
+	for round := 0; round < 20; round++ {
+		j := r.Intn(4)
+		begin := r.Intn(size)
+		end := begin + 1 + r.Intn(size-begin)
+		m := make(map[int][]byte)
+		for _, idx := range r.Perm(8)[:4] {
+			m[idx] = shards[idx][begin:end]
+		}
+		got, e := coder.DecodeShard(m, j)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if !bytes.Equal(got, shards[j][begin:end]) {
+			t.Fatalf("shard %d [%d, %d): decoded data differs", j, begin, end)
+		}
+	}
+	if _, e := coder.DecodeShard(map[int][]byte{5: shards[5], 6: shards[6]}, 0); e == nil {
+		t.Error("decode with too few shards succeeded")
+	}
+	if _, e := coder.DecodeShard(map[int][]byte{0: shards[0]}, 4); e == nil {
+		t.Error("decode parity shard succeeded")
+	}
+}
@@ -0,0 +1,43 @@
+package aes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+//aes加密，GCM模式，key的长度可以为16、24或32字节，返回随机nonce和密文（含认证标签）的拼接
+//additionalData不加密，但参与认证，解密时必须相同
+func AesGCMEncrypt(origData, key, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(origData)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, origData, additionalData), nil
+}
+
+//aes解密，GCM模式，crypted为AesGCMEncrypt的返回值，数据被篡改时返回错误
+func AesGCMDecrypt(crypted, key, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(crypted) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("crypted data too short")
+	}
+	nonce := crypted[:aead.NonceSize()]
+	return aead.Open(nil, nonce, crypted[aead.NonceSize():], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,523 @@
+package net
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	NAT类型检测（类似STUN）。Reflector在两个IP、两个端口上监听UDP，节点通过DetectNAT向它发送探测包：
+		测试1: 发到主地址，从主地址回复，得到映射地址
+		测试2: 发到主地址，从另一个IP和端口回复，能收到说明是完全锥形（或没有NAT）
+		测试3: 发到主地址，从同IP的另一个端口回复，能收到说明是IP受限锥形
+		测试4: 发到另一个IP，映射地址与测试1不同说明是对称型
+	每个回复带一个随机的token，节点最后把收到的token报告给Reflector，由Reflector根据自己看到的映射地址和
+	节点收到了哪些回复判断NAT类型，节点不能伪造没有收到的回复。报告用节点的Ed25519私钥签名，Reflector用节点登记的
+	公钥校验，其他人不能冒充节点报告。报告中带TCP端口时Reflector反向连接映射IP的该端口，检查节点的服务端口是否
+	可以从外部访问，端口必须是节点登记的服务端口，Reflector不能被用来连接任意端口。
+
+	TCP监听在主地址上，连接后返回连接的来源地址，用于UDP被阻断时获取映射的IP。
+*/
+const (
+	NAT_UNKNOWN         int8 = 0
+	NAT_OPEN            int8 = 1 //没有NAT，公网地址
+	NAT_FULL_CONE       int8 = 2 //完全锥形
+	NAT_RESTRICTED      int8 = 3 //IP受限锥形
+	NAT_PORT_RESTRICTED int8 = 4 //端口受限锥形
+	NAT_SYMMETRIC       int8 = 5 //对称型
+	NAT_BLOCKED         int8 = 6 //UDP不通
+)
+
+var NAT_TYPE_NAMES = []string{"unknown", "open", "full_cone", "restricted", "port_restricted", "symmetric", "blocked"}
+
+const (
+	NAT_TEST_BASIC       = 1
+	NAT_TEST_CHANGE_ALL  = 2
+	NAT_TEST_CHANGE_PORT = 3
+	NAT_TEST_ALT_ADDR    = 4
+)
+
+const (
+	NAT_SESSION_TIMEOUT  = 60 * time.Second //探测会话的有效期
+	NAT_DIAL_TIMEOUT     = 3 * time.Second  //反向连接的默认超时
+	NAT_PROBE_RETRY      = 3                //每个测试的发送次数
+	NAT_MAX_PACKET       = 2048
+	NAT_TOKEN_BYTES      = 8
+	NAT_DEFAULT_DEADLINE = 3 * time.Second
+
+	NAT_MAX_SESSIONS       = 4096 //同时存在的探测会话上限，超过时丢弃新会话的探测
+	NAT_MAX_SESSION_TOKENS = 16   //每个会话最多记录的token数，每个测试最多发送NAT_PROBE_RETRY次
+	NAT_MAX_REPORTS        = 64   //同时处理的报告上限，超过时丢弃，节点会重发
+)
+
+//检测结果
+type NATResult struct {
+	Node      string `json:"node"`
+	Type      int8   `json:"type"`
+	Mapped    string `json:"mapped"`    //UDP映射后的地址
+	Port      int    `json:"port"`      //反向连接的TCP端口，0表示没有检查
+	Reachable bool   `json:"reachable"` //反向连接节点的TCP端口是否成功
+	Tm        int64  `json:"tm"`
+}
+
+func NATTypeName(t int8) string {
+	if t >= 0 && int(t) < len(NAT_TYPE_NAMES) {
+		return NAT_TYPE_NAMES[t]
+	}
+	return "unknown(" + strconv.Itoa(int(t)) + ")"
+}
+
+//探测包和回复
+type natPacket struct {
+	Op         string     `json:"op"` //probe或report
+	Node       string     `json:"node"`
+	Session    string     `json:"session"`
+	Test       int        `json:"test,omitempty"`
+	ChangeIP   bool       `json:"change_ip,omitempty"`
+	ChangePort bool       `json:"change_port,omitempty"`
+	Tokens     []string   `json:"tokens,omitempty"`   //报告：收到的token
+	Local      string     `json:"local,omitempty"`    //报告：节点的本地地址
+	TCPPort    int        `json:"tcp_port,omitempty"` //报告：需要反向连接的TCP端口
+	Mapped     string     `json:"mapped,omitempty"`   //回复：看到的来源地址
+	Token      string     `json:"token,omitempty"`    //回复：随机token
+	Alt        string     `json:"alt,omitempty"`      //回复：测试4使用的地址
+	Result     *NATResult `json:"result,omitempty"`   //回复：检测结果
+	Error      string     `json:"error,omitempty"`
+	Sig        []byte     `json:"sig,omitempty"` //报告：节点私钥对Sig为空的报告的签名
+}
+
+type ReflectorConfig struct {
+	IP      string //主IP
+	AltIP   string //另一个IP，不能与IP相同
+	Port    int    //主端口，同时用于TCP
+	AltPort int    //另一个端口，不能与Port相同
+
+	//反向连接的超时，默认NAT_DIAL_TIMEOUT
+	DialTimeout time.Duration
+	//查找节点登记的公钥和服务端口，用于校验报告的签名和反向连接的端口，节点没有登记公钥时key为nil。不能为nil
+	LookupNode func(node string) (key ed25519.PublicKey, port int, e error)
+	//得到检测结果时调用，一般用于把结果记录到协调服务
+	OnResult func(r *NATResult)
+}
+
+type natSession struct {
+	node   string
+	mapped string         //测试1-3看到的来源地址
+	alt    string         //测试4看到的来源地址
+	tokens map[string]int //token -> 测试
+	tm     time.Time
+}
+
+type Reflector struct {
+	conf     ReflectorConfig
+	conns    [2][2]*net.UDPConn //[IP][端口]
+	tcp      *net.TCPListener
+	lock     sync.Mutex
+	sessions map[string]*natSession
+	reports  chan bool //正在处理的报告
+	wg       sync.WaitGroup
+}
+
+func NewReflector(conf ReflectorConfig) (r *Reflector, e error) {
+	if conf.IP == "" || conf.AltIP == "" || conf.IP == conf.AltIP || conf.Port == 0 || conf.AltPort == 0 || conf.Port == conf.AltPort {
+		return nil, errors.New("reflector needs two different IPs and two different ports")
+	}
+	if conf.LookupNode == nil {
+		return nil, errors.New("reflector needs LookupNode to verify reports")
+	}
+	if conf.DialTimeout <= 0 {
+		conf.DialTimeout = NAT_DIAL_TIMEOUT
+	}
+	r = &Reflector{conf: conf, sessions: make(map[string]*natSession), reports: make(chan bool, NAT_MAX_REPORTS)}
+	for i, ip := range []string{conf.IP, conf.AltIP} {
+		for j, port := range []int{conf.Port, conf.AltPort} {
+			if r.conns[i][j], e = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip), Port: port}); e != nil {
+				r.Close()
+				return nil, e
+			}
+		}
+	}
+	if r.tcp, e = net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(conf.IP), Port: conf.Port}); e != nil {
+		r.Close()
+		return nil, e
+	}
+	for i := range r.conns {
+		for j := range r.conns[i] {
+			r.wg.Add(1)
+			go r.serveUDP(r.conns[i][j])
+		}
+	}
+	r.wg.Add(1)
+	go r.serveTCP()
+	return
+}
+
+//主地址
+func (r *Reflector) Addr() string {
+	return net.JoinHostPort(r.conf.IP, strconv.Itoa(r.conf.Port))
+}
+
+func (r *Reflector) Close() {
+	for i := range r.conns {
+		for _, c := range r.conns[i] {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+	if r.tcp != nil {
+		r.tcp.Close()
+	}
+	r.wg.Wait()
+}
+
+func (r *Reflector) serveTCP() {
+	defer r.wg.Done()
+	for {
+		c, e := r.tcp.Accept()
+		if e != nil {
+			return
+		}
+		c.SetWriteDeadline(time.Now().Add(r.conf.DialTimeout))
+		c.Write([]byte(c.RemoteAddr().String() + "\n"))
+		c.Close()
+	}
+}
+
+func (r *Reflector) serveUDP(conn *net.UDPConn) {
+	defer r.wg.Done()
+	buf := make([]byte, NAT_MAX_PACKET)
+	for {
+		n, from, e := conn.ReadFromUDP(buf)
+		if e != nil {
+			return
+		}
+		var p natPacket
+		if json.Unmarshal(buf[:n], &p) != nil || p.Session == "" {
+			continue
+		}
+		switch p.Op {
+		case "probe":
+			r.probe(conn, from, &p)
+		case "report":
+			//反向连接可能比较慢，不阻塞其他探测
+			select {
+			case r.reports <- true:
+			default:
+				continue
+			}
+			r.wg.Add(1)
+			go func() {
+				defer r.wg.Done()
+				defer func() { <-r.reports }()
+				r.report(conn, from, &p)
+			}()
+		}
+	}
+}
+
+//新会话时清理过期的会话，会话数达到NAT_MAX_SESSIONS时返回nil
+func (r *Reflector) session(p *natPacket) *natSession {
+	if s, ok := r.sessions[p.Session]; ok {
+		return s
+	}
+	now := time.Now()
+	for id, s := range r.sessions {
+		if now.Sub(s.tm) > NAT_SESSION_TIMEOUT {
+			delete(r.sessions, id)
+		}
+	}
+	if len(r.sessions) >= NAT_MAX_SESSIONS {
+		return nil
+	}
+	s := &natSession{node: p.Node, tokens: make(map[string]int), tm: now}
+	r.sessions[p.Session] = s
+	return s
+}
+
+func (r *Reflector) probe(conn *net.UDPConn, from *net.UDPAddr, p *natPacket) {
+	token, e := randomHex(NAT_TOKEN_BYTES)
+	if e != nil {
+		return
+	}
+	r.lock.Lock()
+	s := r.session(p)
+	if s == nil || s.node != p.Node || len(s.tokens) >= NAT_MAX_SESSION_TOKENS {
+		r.lock.Unlock()
+		return
+	}
+	if p.Test == NAT_TEST_ALT_ADDR {
+		s.alt = from.String()
+	} else {
+		s.mapped = from.String()
+	}
+	s.tokens[token] = p.Test
+	r.lock.Unlock()
+
+	out := conn
+	switch {
+	case p.ChangeIP && p.ChangePort:
+		out = r.conns[1][1]
+	case p.ChangePort:
+		out = r.conns[0][1]
+	case p.ChangeIP:
+		out = r.conns[1][0]
+	}
+	resp := natPacket{Op: p.Op, Node: p.Node, Session: p.Session, Test: p.Test, Mapped: from.String(), Token: token,
+		Alt: net.JoinHostPort(r.conf.AltIP, strconv.Itoa(r.conf.Port))}
+	b, _ := json.Marshal(&resp)
+	out.WriteToUDP(b, from)
+}
+
+/*
+	根据会话中看到的映射地址和节点报告收到的token判断NAT类型。签名不正确的报告不删除会话，
+	避免其他人用伪造的报告让节点的检测失败
+*/
+func (r *Reflector) report(conn *net.UDPConn, from *net.UDPAddr, p *natPacket) {
+	resp := natPacket{Op: p.Op, Node: p.Node, Session: p.Session}
+	r.lock.Lock()
+	s, ok := r.sessions[p.Session]
+	r.lock.Unlock()
+	if !ok || s.node != p.Node {
+		resp.Error = "session not found"
+	} else if e := r.verifyReport(p); e != nil {
+		resp.Error = e.Error()
+	} else {
+		//同一会话的报告只处理一次
+		r.lock.Lock()
+		if _, ok = r.sessions[p.Session]; ok {
+			delete(r.sessions, p.Session)
+		} else {
+			resp.Error = "session not found"
+		}
+		r.lock.Unlock()
+	}
+	if resp.Error == "" {
+		received := make(map[int]bool)
+		for _, t := range p.Tokens {
+			if test, ok := s.tokens[t]; ok {
+				received[test] = true
+			}
+		}
+		res := &NATResult{Node: s.node, Mapped: s.mapped, Tm: time.Now().Unix()}
+		switch {
+		case !received[NAT_TEST_BASIC]:
+			res.Type = NAT_BLOCKED
+		case s.alt != "" && s.alt != s.mapped:
+			res.Type = NAT_SYMMETRIC
+		case received[NAT_TEST_CHANGE_ALL] && p.Local == s.mapped:
+			res.Type = NAT_OPEN
+		case received[NAT_TEST_CHANGE_ALL]:
+			res.Type = NAT_FULL_CONE
+		case received[NAT_TEST_CHANGE_PORT]:
+			res.Type = NAT_RESTRICTED
+		default:
+			res.Type = NAT_PORT_RESTRICTED
+		}
+		if p.TCPPort > 0 && res.Type != NAT_BLOCKED {
+			res.Port = p.TCPPort
+			res.Reachable = dialBack(s.mapped, p.TCPPort, r.conf.DialTimeout)
+		}
+		if r.conf.OnResult != nil {
+			r.conf.OnResult(res)
+		}
+		resp.Result = res
+	}
+	b, _ := json.Marshal(&resp)
+	conn.WriteToUDP(b, from)
+}
+
+//校验报告的签名，反向连接的端口必须是节点登记的服务端口
+func (r *Reflector) verifyReport(p *natPacket) (e error) {
+	key, port, e := r.conf.LookupNode(p.Node)
+	if e != nil {
+		return
+	}
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, natReportMessage(p), p.Sig) {
+		return errors.New("invalid sign of node " + p.Node)
+	}
+	if p.TCPPort > 0 && p.TCPPort != port {
+		return errors.New("tcp port " + strconv.Itoa(p.TCPPort) + " is not registered")
+	}
+	return
+}
+
+//签名的内容是Sig为空时报告的JSON
+func natReportMessage(p *natPacket) []byte {
+	c := *p
+	c.Sig = nil
+	b, _ := json.Marshal(&c)
+	return b
+}
+
+//反向连接映射IP的TCP端口
+func dialBack(mapped string, port int, timeout time.Duration) bool {
+	host, _, e := net.SplitHostPort(mapped)
+	if e != nil {
+		return false
+	}
+	c, e := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if e != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+func randomHex(n int) (s string, e error) {
+	b := make([]byte, n)
+	if _, e = rand.Read(b); e != nil {
+		return
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//节点端的一次检测
+type natProbe struct {
+	conn    net.PacketConn
+	node    string
+	key     ed25519.PrivateKey
+	session string
+	timeout time.Duration
+	tokens  []string
+	alt     string
+}
+
+/*
+	检测节点的NAT类型
+
+	参数：
+		conn: 用于探测的UDP连接，需要与节点实际使用的连接一致才能得到正确的映射，本地地址为具体IP时才能检测出NAT_OPEN
+		server: Reflector的主地址
+		node: 节点ID
+		key: 节点的Ed25519私钥，用于签名报告，对应的公钥需要在协调服务登记
+		tcpPort: 需要Reflector反向连接检查的TCP端口，必须是节点登记的服务端口，0表示不检查
+		timeout: 每个测试等待回复的时间，0表示NAT_DEFAULT_DEADLINE
+	返回值：
+		r: Reflector判断的结果，测试1没有回复时为NAT_BLOCKED
+*/
+func DetectNAT(conn net.PacketConn, server, node string, key ed25519.PrivateKey, tcpPort int, timeout time.Duration) (r *NATResult, e error) {
+	addr, e := net.ResolveUDPAddr("udp", server)
+	if e != nil {
+		return
+	}
+	if timeout <= 0 {
+		timeout = NAT_DEFAULT_DEADLINE
+	}
+	session, e := randomHex(NAT_TOKEN_BYTES)
+	if e != nil {
+		return
+	}
+	p := &natProbe{conn: conn, node: node, key: key, session: session, timeout: timeout}
+	resp, e := p.exchange(addr, &natPacket{Op: "probe", Test: NAT_TEST_BASIC})
+	if e != nil {
+		return
+	}
+	if resp == nil {
+		return &NATResult{Node: node, Type: NAT_BLOCKED, Tm: time.Now().Unix()}, nil
+	}
+	for _, req := range []*natPacket{
+		{Op: "probe", Test: NAT_TEST_CHANGE_ALL, ChangeIP: true, ChangePort: true},
+		{Op: "probe", Test: NAT_TEST_CHANGE_PORT, ChangePort: true},
+	} {
+		if _, e = p.exchange(addr, req); e != nil {
+			return
+		}
+	}
+	if alt, err := net.ResolveUDPAddr("udp", p.alt); err == nil {
+		if _, e = p.exchange(alt, &natPacket{Op: "probe", Test: NAT_TEST_ALT_ADDR}); e != nil {
+			return
+		}
+	}
+	report := &natPacket{Op: "report", Tokens: p.tokens, Local: conn.LocalAddr().String(), TCPPort: tcpPort}
+	if resp, e = p.exchange(addr, report); e != nil {
+		return
+	}
+	if resp == nil {
+		return nil, errors.New("no report from reflector " + server)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
+
+/*
+	发送请求并等待对应的回复，期间收到的其他回复的token也会记录下来
+
+	返回值：
+		resp: 超时没有回复时为nil
+*/
+func (p *natProbe) exchange(to net.Addr, req *natPacket) (resp *natPacket, e error) {
+	req.Node, req.Session = p.node, p.session
+	if req.Op == "report" && p.key != nil {
+		req.Sig = ed25519.Sign(p.key, natReportMessage(req))
+	}
+	b, e := json.Marshal(req)
+	if e != nil {
+		return
+	}
+	buf := make([]byte, NAT_MAX_PACKET)
+	for i := 0; i < NAT_PROBE_RETRY && resp == nil; i++ {
+		if _, e = p.conn.WriteTo(b, to); e != nil {
+			return
+		}
+		p.conn.SetReadDeadline(time.Now().Add(p.timeout / NAT_PROBE_RETRY))
+		for resp == nil {
+			n, _, err := p.conn.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			var got natPacket
+			if json.Unmarshal(buf[:n], &got) != nil || got.Session != p.session {
+				continue
+			}
+			if got.Token != "" && !containsToken(p.tokens, got.Token) {
+				p.tokens = append(p.tokens, got.Token)
+			}
+			if got.Alt != "" {
+				p.alt = got.Alt
+			}
+			if got.Op == req.Op && got.Test == req.Test {
+				resp = &got
+			}
+		}
+	}
+	p.conn.SetReadDeadline(time.Time{})
+	return
+}
+
+func containsToken(tokens []string, t string) bool {
+	for _, v := range tokens {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+//通过Reflector的TCP端口获取本机连接外部时的映射地址
+func TCPMappedAddr(server string, timeout time.Duration) (addr string, e error) {
+	c, e := net.DialTimeout("tcp", server, timeout)
+	if e != nil {
+		return
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(timeout))
+	line, e := bufio.NewReader(c).ReadString('\n')
+	if e != nil {
+		return
+	}
+	return line[:len(line)-1], nil
+}
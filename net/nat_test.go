@@ -0,0 +1,270 @@
+package net
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//模拟NAT：内部地址固定，外部用127.0.0.1上的UDP连接，按类型决定映射和过滤规则
+type simNAT struct {
+	typ      int8
+	inside   *net.UDPAddr
+	lock     sync.Mutex
+	outside  map[string]*net.UDPConn //锥形只有一个，对称型每个目标地址一个
+	sent     map[string]bool         //发送过的目标，key为IP或IP:端口
+	in       chan simPacket
+	deadline time.Time
+	closed   chan struct{}
+}
+
+type simPacket struct {
+	data []byte
+	from net.Addr
+}
+
+func newSimNAT(typ int8) *simNAT {
+	return &simNAT{
+		typ:     typ,
+		inside:  &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5000},
+		outside: make(map[string]*net.UDPConn),
+		sent:    make(map[string]bool),
+		in:      make(chan simPacket, 64),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (s *simNAT) outConn(to *net.UDPAddr) (c *net.UDPConn, e error) {
+	key := ""
+	if s.typ == NAT_SYMMETRIC {
+		key = to.String()
+	}
+	if c = s.outside[key]; c != nil {
+		return
+	}
+	if c, e = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}); e != nil {
+		return
+	}
+	s.outside[key] = c
+	go s.recv(c)
+	return
+}
+
+func (s *simNAT) recv(c *net.UDPConn) {
+	buf := make([]byte, NAT_MAX_PACKET)
+	for {
+		n, from, e := c.ReadFromUDP(buf)
+		if e != nil {
+			return
+		}
+		s.lock.Lock()
+		accept := true
+		switch s.typ {
+		case NAT_RESTRICTED:
+			accept = s.sent[from.IP.String()]
+		case NAT_PORT_RESTRICTED, NAT_SYMMETRIC:
+			accept = s.sent[from.String()]
+		}
+		s.lock.Unlock()
+		if accept {
+			s.in <- simPacket{append([]byte(nil), buf[:n]...), from}
+		}
+	}
+}
+
+func (s *simNAT) WriteTo(b []byte, addr net.Addr) (n int, e error) {
+	to := addr.(*net.UDPAddr)
+	s.lock.Lock()
+	c, e := s.outConn(to)
+	s.sent[to.IP.String()] = true
+	s.sent[to.String()] = true
+	s.lock.Unlock()
+	if e != nil {
+		return
+	}
+	return c.WriteToUDP(b, to)
+}
+
+func (s *simNAT) ReadFrom(b []byte) (n int, addr net.Addr, e error) {
+	s.lock.Lock()
+	d := s.deadline
+	s.lock.Unlock()
+	var timeout <-chan time.Time
+	if !d.IsZero() {
+		t := time.NewTimer(time.Until(d))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p := <-s.in:
+		return copy(b, p.data), p.from, nil
+	case <-timeout:
+		return 0, nil, simTimeout{}
+	case <-s.closed:
+		return 0, nil, errors.New("closed")
+	}
+}
+
+func (s *simNAT) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range s.outside {
+		c.Close()
+	}
+	close(s.closed)
+	return nil
+}
+
+func (s *simNAT) LocalAddr() net.Addr { return s.inside }
+
+func (s *simNAT) SetDeadline(t time.Time) error { return s.SetReadDeadline(t) }
+
+func (s *simNAT) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.deadline = t
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *simNAT) SetWriteDeadline(t time.Time) error { return nil }
+
+type simTimeout struct{}
+
+func (simTimeout) Error() string   { return "i/o timeout" }
+func (simTimeout) Timeout() bool   { return true }
+func (simTimeout) Temporary() bool { return true }
+
+func freePort(t *testing.T) int {
+	c, e := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestDetectNAT(t *testing.T) {
+	var lock sync.Mutex
+	results := make(map[string]*NATResult)
+	_, key, e := ed25519.GenerateKey(nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	tcp, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer tcp.Close()
+	tcpPort := tcp.Addr().(*net.TCPAddr).Port
+	//所有节点使用同一个密钥，服务端口都是tcpPort
+	lookup := func(node string) (ed25519.PublicKey, int, error) {
+		return key.Public().(ed25519.PublicKey), tcpPort, nil
+	}
+	var r *Reflector
+	//端口可能被占用，重试几次
+	for i := 0; i < 5; i++ {
+		r, e = NewReflector(ReflectorConfig{IP: "127.0.0.1", AltIP: "127.0.0.2", Port: freePort(t), AltPort: freePort(t),
+			DialTimeout: time.Second, LookupNode: lookup,
+			OnResult: func(res *NATResult) {
+				lock.Lock()
+				results[res.Node] = res
+				lock.Unlock()
+			}})
+		if e == nil {
+			break
+		}
+	}
+	if e != nil {
+		t.Skip("reflector needs 127.0.0.2:", e)
+	}
+	defer r.Close()
+
+	//公网节点
+	open, e := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer open.Close()
+	res, e := DetectNAT(open, r.Addr(), "open", key, 0, time.Second)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if res.Type != NAT_OPEN || res.Mapped != open.LocalAddr().String() || res.Reachable {
+		t.Fatal("open:", res)
+	}
+
+	for _, typ := range []int8{NAT_FULL_CONE, NAT_RESTRICTED, NAT_PORT_RESTRICTED, NAT_SYMMETRIC} {
+		sim := newSimNAT(typ)
+		node := NATTypeName(typ)
+		res, e := DetectNAT(sim, r.Addr(), node, key, tcpPort, 600*time.Millisecond)
+		sim.Close()
+		if e != nil {
+			t.Fatal(node, e)
+		}
+		if res.Type != typ || !res.Reachable || res.Node != node {
+			t.Fatal(node, "got", NATTypeName(res.Type), res)
+		}
+		lock.Lock()
+		got := results[node]
+		lock.Unlock()
+		if got == nil || got.Type != typ {
+			t.Fatal(node, "OnResult", got)
+		}
+	}
+
+	//没有reflector时为NAT_BLOCKED
+	sim := newSimNAT(NAT_FULL_CONE)
+	defer sim.Close()
+	if res, e = DetectNAT(sim, "127.0.0.1:1", "blocked", key, 0, 300*time.Millisecond); e != nil || res.Type != NAT_BLOCKED {
+		t.Fatal("blocked:", res, e)
+	}
+
+	//没有签名或者用其他密钥签名的报告不被接受，不记录结果
+	_, other, _ := ed25519.GenerateKey(nil)
+	for _, k := range []ed25519.PrivateKey{nil, other} {
+		if res, e = DetectNAT(open, r.Addr(), "spoofed", k, 0, time.Second); e == nil {
+			t.Fatal("spoofed report:", res)
+		}
+	}
+	//只反向连接登记的端口
+	if res, e = DetectNAT(open, r.Addr(), "port", key, tcpPort+1, time.Second); e == nil {
+		t.Fatal("unregistered port:", res)
+	}
+	lock.Lock()
+	if results["spoofed"] != nil || results["port"] != nil {
+		t.Fatal("OnResult of rejected report", results["spoofed"], results["port"])
+	}
+	lock.Unlock()
+
+	addr, e := TCPMappedAddr(r.Addr(), time.Second)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if host, _, _ := net.SplitHostPort(addr); host != "127.0.0.1" {
+		t.Fatal("tcp mapped", addr)
+	}
+}
+
+//会话数达到上限后丢弃新会话的探测，过期的会话被清理
+func TestReflectorSessions(t *testing.T) {
+	r := &Reflector{sessions: make(map[string]*natSession)}
+	for i := 0; i < NAT_MAX_SESSIONS; i++ {
+		if r.session(&natPacket{Node: "n1", Session: strconv.Itoa(i)}) == nil {
+			t.Fatal("session", i)
+		}
+	}
+	if r.session(&natPacket{Node: "n1", Session: "full"}) != nil {
+		t.Fatal("session over limit")
+	}
+	if r.session(&natPacket{Node: "n1", Session: "0"}) == nil {
+		t.Fatal("existing session")
+	}
+	r.sessions["0"].tm = time.Now().Add(-NAT_SESSION_TIMEOUT - time.Second)
+	if r.session(&natPacket{Node: "n1", Session: "full"}) == nil || len(r.sessions) != NAT_MAX_SESSIONS {
+		t.Fatal("expired session not removed", len(r.sessions))
+	}
+}
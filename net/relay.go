@@ -0,0 +1,411 @@
+package net
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	代理节点的转发服务。不能直接连接的两端都连接到代理节点，各自先发送一个令牌，RelayConfig.Authorize校验令牌后
+	得到会话和角色，同一会话的提供端和获取端都到达后，代理回复成功并开始双向转发，之后的数据由两端自己约定。
+
+	握手帧为4字节大端长度加内容，客户端发送令牌，代理回复json（RelayResp），Error为空表示成功。
+	一端关闭写方向时代理也关闭另一端的写方向，两个方向都结束后会话结束，调用OnSession汇报转发的字节数。
+	每个会话在有效期内只能使用一次，双向的数据共用RelayTicket.Rate的带宽限制。
+*/
+const (
+	RELAY_ROLE_SRC int8 = 1 //提供数据的一端
+	RELAY_ROLE_DST int8 = 2 //获取数据的一端
+)
+
+const (
+	RELAY_MAX_FRAME    = 4096      //握手帧的最大长度
+	RELAY_BUFFER_SIZE  = 32 * 1024 //转发的缓冲区大小
+	RELAY_PAIR_TIMEOUT = 30        //等待另一端的默认时间（秒）
+	RELAY_IDLE_TIMEOUT = 60        //转发时没有数据的默认超时（秒）
+	RELAY_MIN_BURST    = 4 * 1024  //带宽限制的最小突发字节数
+)
+
+//Authorize校验令牌的结果
+type RelayTicket struct {
+	Session string
+	Role    int8
+	Rate    int64 //会话的带宽限制（字节/秒），0表示不限制
+	Expire  int64 //令牌的过期时间（秒），会话ID记录到这个时间，防止重复使用
+}
+
+//会话结束时的统计
+type RelayStat struct {
+	Session  string
+	Token    string //获取端的令牌，用于向协调服务证明会话
+	Bytes    int64  //双向转发的字节数
+	Start    time.Time
+	Duration time.Duration
+}
+
+type RelayResp struct {
+	Error string `json:"error"`
+}
+
+type RelayConfig struct {
+	IP   string
+	Port int
+
+	//校验令牌，必须设置
+	Authorize func(token string) (t *RelayTicket, e error)
+	//会话结束时调用，可以为nil
+	OnSession func(s *RelayStat)
+	//等待另一端的时间（秒），默认RELAY_PAIR_TIMEOUT
+	PairTimeout uint
+	//转发时没有数据的超时（秒），默认RELAY_IDLE_TIMEOUT
+	IdleTimeout uint
+}
+
+type relayEnd struct {
+	conn   *TCPConn
+	ticket *RelayTicket
+	token  string
+	done   chan struct{} //先到达的一端等待会话结束
+}
+
+type RelayServer struct {
+	conf    RelayConfig
+	ln      *TCPListener
+	lock    sync.Mutex
+	waiting map[string]*relayEnd
+	used    map[string]int64 //已经使用的会话 -> 过期时间
+	conns   map[*TCPConn]bool
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func NewRelayServer(conf RelayConfig) (s *RelayServer, e error) {
+	if conf.Authorize == nil {
+		return nil, errors.New("relay authorize not set")
+	}
+	if conf.PairTimeout == 0 {
+		conf.PairTimeout = RELAY_PAIR_TIMEOUT
+	}
+	if conf.IdleTimeout == 0 {
+		conf.IdleTimeout = RELAY_IDLE_TIMEOUT
+	}
+	s = &RelayServer{conf: conf, waiting: make(map[string]*relayEnd), used: make(map[string]int64), conns: make(map[*TCPConn]bool)}
+	if s.ln, e = Listen(conf.IP, conf.Port); e != nil {
+		return nil, e
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return
+}
+
+//监听地址
+func (s *RelayServer) Addr() string {
+	return s.ln.Addr()
+}
+
+//停止服务并断开所有连接
+func (s *RelayServer) Close() {
+	s.lock.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.lock.Unlock()
+	s.ln.Close()
+	s.wg.Wait()
+}
+
+func (s *RelayServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, e := s.ln.Accept()
+		if e != nil {
+			return
+		}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *RelayServer) release(conn *TCPConn) {
+	conn.Close()
+	s.lock.Lock()
+	delete(s.conns, conn)
+	s.lock.Unlock()
+}
+
+func (s *RelayServer) handle(conn *TCPConn) {
+	conn.SetTimeout(s.conf.PairTimeout)
+	token, e := readFrame(conn)
+	if e != nil {
+		s.release(conn)
+		return
+	}
+	t, e := s.conf.Authorize(string(token))
+	if e == nil && t.Role != RELAY_ROLE_SRC && t.Role != RELAY_ROLE_DST {
+		e = errors.New("invalid relay role " + strconv.Itoa(int(t.Role)))
+	}
+	if e != nil {
+		writeRelayResp(conn, e)
+		s.release(conn)
+		return
+	}
+	me := &relayEnd{conn: conn, ticket: t, token: string(token), done: make(chan struct{})}
+
+	s.lock.Lock()
+	now := time.Now().Unix()
+	for id, expire := range s.used {
+		if expire < now {
+			delete(s.used, id)
+		}
+	}
+	if _, ok := s.used[t.Session]; ok {
+		s.lock.Unlock()
+		writeRelayResp(conn, errors.New("relay session "+t.Session+" already used"))
+		s.release(conn)
+		return
+	}
+	other, ok := s.waiting[t.Session]
+	if ok && other.ticket.Role == t.Role {
+		s.lock.Unlock()
+		writeRelayResp(conn, errors.New("relay session "+t.Session+" already has this end"))
+		s.release(conn)
+		return
+	}
+	if !ok {
+		s.waiting[t.Session] = me
+		s.lock.Unlock()
+		timer := time.NewTimer(time.Duration(s.conf.PairTimeout) * time.Second)
+		defer timer.Stop()
+		select {
+		case <-me.done:
+			return
+		case <-timer.C:
+		}
+		s.lock.Lock()
+		if s.waiting[t.Session] != me {
+			//超时的同时另一端到达
+			s.lock.Unlock()
+			<-me.done
+			return
+		}
+		delete(s.waiting, t.Session)
+		s.lock.Unlock()
+		writeRelayResp(conn, errors.New("relay peer of session "+t.Session+" not arrived"))
+		s.release(conn)
+		return
+	}
+	delete(s.waiting, t.Session)
+	s.used[t.Session] = t.Expire
+	s.lock.Unlock()
+
+	src, dst := other, me
+	if me.ticket.Role == RELAY_ROLE_SRC {
+		src, dst = me, other
+	}
+	s.splice(src, dst)
+	close(other.done)
+}
+
+//两端都到达后回复成功并双向转发，直到两个方向都结束
+func (s *RelayServer) splice(src, dst *relayEnd) {
+	defer s.release(src.conn)
+	defer s.release(dst.conn)
+	for _, end := range []*relayEnd{src, dst} {
+		if writeRelayResp(end.conn, nil) != nil {
+			return
+		}
+		end.conn.SetTimeout(0)
+		end.conn.SetReadTimeout(s.conf.IdleTimeout)
+		end.conn.SetWriteTimeout(s.conf.IdleTimeout)
+	}
+	rate := src.ticket.Rate
+	if r := dst.ticket.Rate; r > 0 && (rate == 0 || r < rate) {
+		rate = r
+	}
+	limiter := newRateLimiter(rate)
+	stat := &RelayStat{Session: dst.ticket.Session, Token: dst.token, Start: time.Now()}
+	var wg sync.WaitGroup
+	var bytes [2]int64
+	active := time.Now().UnixNano()
+	idle := time.Duration(s.conf.IdleTimeout) * time.Second
+	copyEnd := func(i int, from, to *relayEnd) {
+		defer wg.Done()
+		bytes[i] = relayCopy(to.conn, from.conn, limiter, &active, idle)
+		//另一端读到EOF，出错时直接断开两端
+		if to.conn.CloseWrite() != nil {
+			from.conn.Close()
+		}
+	}
+	wg.Add(2)
+	go copyEnd(0, src, dst)
+	go copyEnd(1, dst, src)
+	wg.Wait()
+	stat.Bytes = bytes[0] + bytes[1]
+	stat.Duration = time.Since(stat.Start)
+	if s.conf.OnSession != nil {
+		s.conf.OnSession(stat)
+	}
+}
+
+/*
+	单向转发，返回转发的字节数
+
+	参数：
+		active: 两个方向最后一次转发数据的时间（纳秒），一个方向读超时时，另一个方向在idle内有数据则继续等待
+*/
+func relayCopy(to, from *TCPConn, limiter *rateLimiter, active *int64, idle time.Duration) (n int64) {
+	buf := make([]byte, RELAY_BUFFER_SIZE)
+	for {
+		l, e := from.Read(buf)
+		if l > 0 {
+			limiter.wait(l)
+			if to.WriteSafe(buf[:l]) != nil {
+				from.Close()
+				return
+			}
+			n += int64(l)
+			atomic.StoreInt64(active, time.Now().UnixNano())
+		}
+		if ne, ok := e.(net.Error); ok && ne.Timeout() && time.Since(time.Unix(0, atomic.LoadInt64(active))) < idle {
+			continue
+		}
+		if e != nil {
+			if e != io.EOF {
+				to.Close()
+			}
+			return
+		}
+	}
+}
+
+//令牌桶，双向共用
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate) / 4
+	if burst < RELAY_MIN_BURST {
+		burst = RELAY_MIN_BURST
+	}
+	return &rateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+	time.Sleep(d)
+}
+
+func readFrame(conn *TCPConn) (data []byte, e error) {
+	var head [4]byte
+	if e = conn.ReadSafe(head[:]); e != nil {
+		return
+	}
+	l := binary.BigEndian.Uint32(head[:])
+	if l > RELAY_MAX_FRAME {
+		return nil, errors.New("relay frame too large")
+	}
+	data = make([]byte, l)
+	e = conn.ReadSafe(data)
+	return
+}
+
+func writeFrame(conn *TCPConn, data []byte) (e error) {
+	if len(data) > RELAY_MAX_FRAME {
+		return errors.New("relay frame too large")
+	}
+	b := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], data)
+	return conn.WriteSafe(b)
+}
+
+func writeRelayResp(conn *TCPConn, err error) (e error) {
+	var resp RelayResp
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	b, _ := json.Marshal(&resp)
+	return writeFrame(conn, b)
+}
+
+/*
+	连接代理节点并发送令牌，等待另一端到达
+
+	参数：
+		addr: 代理节点的转发服务地址，ip:port
+		token: 协调服务签发的令牌
+		timeout: 等待的时间（秒），应该不小于代理的PairTimeout
+	返回值：
+		conn: 成功时可以直接与另一端通信
+*/
+func DialRelay(addr, token string, timeout uint) (conn *TCPConn, e error) {
+	host, port, e := net.SplitHostPort(addr)
+	if e != nil {
+		return
+	}
+	p, e := strconv.Atoi(port)
+	if e != nil {
+		return
+	}
+	if conn, e = Connect(host, p); e != nil {
+		return
+	}
+	conn.SetTimeout(timeout)
+	if e = writeFrame(conn, []byte(token)); e == nil {
+		var b []byte
+		if b, e = readFrame(conn); e == nil {
+			var resp RelayResp
+			if e = json.Unmarshal(b, &resp); e == nil && resp.Error != "" {
+				e = errors.New(resp.Error)
+			}
+		}
+	}
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	conn.SetTimeout(0)
+	return
+}
@@ -0,0 +1,111 @@
+package net
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//测试用的令牌：会话:角色:带宽
+func testAuthorize(token string) (t *RelayTicket, e error) {
+	f := strings.Split(token, ":")
+	if len(f) != 3 {
+		return nil, errors.New("bad token")
+	}
+	role, _ := strconv.Atoi(f[1])
+	rate, _ := strconv.ParseInt(f[2], 10, 64)
+	return &RelayTicket{Session: f[0], Role: int8(role), Rate: rate, Expire: time.Now().Unix() + 60}, nil
+}
+
+/*
+	通过代理传输：提供端发送data后关闭写方向，获取端读完后回复ack
+
+	返回值：
+		got: 获取端收到的数据
+		ack: 提供端收到的回复
+*/
+func relayTransfer(t *testing.T, addr, session string, rate int64, data []byte) (got, ack []byte) {
+	type result struct {
+		data []byte
+		e    error
+	}
+	srcDone := make(chan result, 1)
+	go func() {
+		conn, e := DialRelay(addr, session+":1:"+strconv.FormatInt(rate, 10), 5)
+		if e != nil {
+			srcDone <- result{nil, e}
+			return
+		}
+		defer conn.Close()
+		if e = conn.WriteSafe(data); e == nil {
+			e = conn.CloseWrite()
+		}
+		b, err := ioutil.ReadAll(conn)
+		if e == nil {
+			e = err
+		}
+		srcDone <- result{b, e}
+	}()
+	conn, e := DialRelay(addr, session+":2:"+strconv.FormatInt(rate, 10), 5)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	if got, e = ioutil.ReadAll(conn); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = conn.Write([]byte("ack")); e != nil {
+		t.Fatal(e)
+	}
+	conn.CloseWrite()
+	r := <-srcDone
+	if r.e != nil {
+		t.Fatal(r.e)
+	}
+	return got, r.data
+}
+
+func TestRelay(t *testing.T) {
+	stats := make(chan *RelayStat, 10)
+	s, e := NewRelayServer(RelayConfig{IP: "127.0.0.1", Authorize: testAuthorize, PairTimeout: 1,
+		OnSession: func(st *RelayStat) { stats <- st }})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8*1024)
+	got, ack := relayTransfer(t, s.Addr(), "s1", 0, data)
+	if !bytes.Equal(got, data) || string(ack) != "ack" {
+		t.Fatalf("relay got %d bytes, ack %q", len(got), ack)
+	}
+	if st := <-stats; st.Session != "s1" || st.Bytes != int64(len(data)+3) || st.Token != "s1:2:0" {
+		t.Errorf("stat: %+v", st)
+	}
+
+	//会话只能使用一次
+	if _, e = DialRelay(s.Addr(), "s1:1:0", 5); e == nil || !strings.Contains(e.Error(), "already used") {
+		t.Errorf("reuse session: %v", e)
+	}
+	if _, e = DialRelay(s.Addr(), "bad", 5); e == nil || !strings.Contains(e.Error(), "bad token") {
+		t.Errorf("bad token: %v", e)
+	}
+	//另一端没有到达
+	start := time.Now()
+	if _, e = DialRelay(s.Addr(), "s2:1:0", 5); e == nil || time.Since(start) < 900*time.Millisecond {
+		t.Errorf("pair timeout: %v %v", e, time.Since(start))
+	}
+
+	//带宽限制：突发rate/4后按rate传输
+	rate := int64(200 * 1024)
+	start = time.Now()
+	got, _ = relayTransfer(t, s.Addr(), "s3", rate, data[:100*1024])
+	if d := time.Since(start); len(got) != 100*1024 || d < 250*time.Millisecond {
+		t.Errorf("rate limit: %d bytes in %v", len(got), d)
+	}
+	<-stats
+}
@@ -50,6 +50,15 @@ func (l *TCPListener) Accept() (conn *TCPConn, err error) {
 	return
 }
 
+func (l *TCPListener) Close() (err error) {
+	return (*net.TCPListener)(l).Close()
+}
+
+//监听地址，ip:port
+func (l *TCPListener) Addr() string {
+	return (*net.TCPListener)(l).Addr().String()
+}
+
 func (conn *TCPConn) SetTimeout(to uint) {
 	conn.readTimeout = to
 	conn.writeTimeout = to
@@ -105,6 +114,26 @@ func (conn *TCPConn) ReadSafe(data []byte) (err error) {
 	return
 }
 
+//读取已经到达的数据，可以少于len(data)，与ReadSafe使用相同的读超时
+func (conn *TCPConn) Read(data []byte) (n int, err error) {
+	if conn.readTimeout > 0 {
+		conn.conn.SetReadDeadline(tm.Now.Add(time.Duration(conn.readTimeout) * time.Second))
+	}
+	return conn.conn.Read(data)
+}
+
+func (conn *TCPConn) Write(data []byte) (n int, err error) {
+	if err = conn.WriteSafe(data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+//关闭写方向，对方读到EOF
+func (conn *TCPConn) CloseWrite() (err error) {
+	return conn.conn.CloseWrite()
+}
+
 func (conn *TCPConn) Close() (err error) {
 	err = conn.conn.Close()
 	return
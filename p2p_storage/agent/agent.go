@@ -0,0 +1,409 @@
+/*
+p2p存储节点的Go实现，与cpp_sdk中的节点实现相同的协议。
+
+节点定期调用UpdateNode2汇报状态、各分组的同步版本号和正在执行的扩散任务，然后：
+	1. 按ListUpdatedFiles的增量更新分组版本号：已经有碎片或已删除的文件才推进版本号，删除已删除文件的碎片
+	2. 执行分配给本节点的扩散任务（ExpandNode）：用源文件或从其他节点拼回的文件生成碎片，推送给缺少碎片的节点，
+	   然后调用ExpandFinished（新增文件调用P2PExpandFinished）
+	3. 执行危险文件任务（UnSafeExpandNode）：保证本节点有一个碎片，然后调用UnSafeExpandFinished
+
+碎片用algorithm/erasure编码，分组的MinPieces个碎片可以拼回原始文件，碎片总数为PerfectPieces。
+同一文件在一个分组中的每个节点保存一个碎片，扩散时尽量分配其他节点还没有的序号。
+
+协调服务通过Coordinator接口调用，Local在同一进程中直接调用p2p_storage，可以在本机回环地址上端到端地运行整个系统：
+	p2p_storage.Init(ds, logger, false)
+	a, e := agent.New(agent.Config{ID: "n1", Dir: dir}, agent.Local{}, logger)
+	a.Start()
+	defer a.Close()
+*/
+package agent
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"yh_pkg/encrypt/md5"
+	"yh_pkg/log"
+	ynet "yh_pkg/net"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/oss"
+)
+
+const (
+	DEFAULT_ADDR        = "127.0.0.1:0"
+	DEFAULT_INTERVAL    = 60 * time.Second
+	LIST_FILE_NUM       = 1000 //每次获取的更新文件数
+	MAX_UNSAFE_TASK_NUM = 10   //每次心跳获取的危险文件任务数
+)
+
+type Config struct {
+	ID         string        //节点ID
+	Dir        string        //本地存储目录
+	Addr       string        //碎片服务监听地址，默认DEFAULT_ADDR
+	TotalSpace uint64        //汇报的总存储空间
+	Interval   time.Duration //心跳间隔，默认DEFAULT_INTERVAL
+
+	//冷存储，与协调服务的p2p_storage.SetColdStore相同，为nil时只在节点之间传输
+	Cold p2p_storage.IObjectStore
+	//上传到冷存储的分块大小，默认p2p_storage.DEFAULT_OSS_SPLIT_SIZE
+	ColdSplitSize int64
+	//新添加的文件是否使用sha256的文件ID，需要协调服务支持文件ID（协议版本8）
+	SHA256 bool
+	//代理转发服务的监听地址，为空时不提供转发，需要协调服务支持转发（协议版本9）
+	RelayAddr string
+	//节点私钥，与node_api.Client.Key相同，用于签名NAT检测的报告，为nil时Reflector不接受检测结果
+	Key ed25519.PrivateKey
+}
+
+//节点所在的分组
+type localGroup struct {
+	p2p_storage.Group
+	Ver uint64 //已同步的版本号
+}
+
+type Agent struct {
+	conf     Config
+	c        Coordinator
+	logger   *log.MLogger
+	store    *store
+	listener net.Listener
+	server   *http.Server
+	peer     p2p_storage.Peer
+	relay    *ynet.RelayServer
+
+	lock      sync.Mutex
+	groups    map[string]*localGroup
+	expanding map[uint64]bool //正在执行的扩散任务，心跳时汇报
+	unsafe    map[uint64]bool //正在执行的危险文件任务
+	tasks     sync.WaitGroup
+	stop      chan bool
+	stopped   chan bool
+
+	relayPub   ed25519.PublicKey       //协调服务的转发公钥
+	relayStats []p2p_storage.RelayStat //还没有汇报的转发统计
+}
+
+/*
+	创建节点并启动碎片服务，之后需要调用Start或者定期调用Step
+
+	参数：
+		conf: 节点配置
+		c: 协调服务
+		lg: 日志
+*/
+func New(conf Config, c Coordinator, lg *log.MLogger) (a *Agent, e error) {
+	if conf.ID == "" || conf.Dir == "" {
+		return nil, errors.New("node id and dir are required")
+	}
+	if conf.Addr == "" {
+		conf.Addr = DEFAULT_ADDR
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = DEFAULT_INTERVAL
+	}
+	if conf.ColdSplitSize <= 0 {
+		conf.ColdSplitSize = p2p_storage.DEFAULT_OSS_SPLIT_SIZE
+	}
+	a = &Agent{
+		conf:      conf,
+		c:         c,
+		logger:    lg,
+		groups:    make(map[string]*localGroup),
+		expanding: make(map[uint64]bool),
+		unsafe:    make(map[uint64]bool),
+	}
+	if a.store, e = newStore(conf.Dir); e != nil {
+		return nil, e
+	}
+	vers, e := a.store.LoadVersions()
+	if e != nil {
+		return nil, e
+	}
+	for gid, ver := range vers {
+		a.groups[gid] = &localGroup{Group: p2p_storage.Group{ID: gid}, Ver: ver}
+	}
+
+	if a.listener, e = net.Listen("tcp", conf.Addr); e != nil {
+		return nil, e
+	}
+	host, port, _ := net.SplitHostPort(a.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	a.peer = p2p_storage.Peer{ID: conf.ID, IP: host, Port: int32(p)}
+	if conf.RelayAddr != "" {
+		if e = a.startRelay(); e != nil {
+			a.listener.Close()
+			return nil, e
+		}
+	}
+	a.server = &http.Server{Handler: a}
+	go a.server.Serve(a.listener)
+	return a, nil
+}
+
+//节点地址
+func (a *Agent) Peer() p2p_storage.Peer {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.peer
+}
+
+//向协调服务注册节点，节点已存在时不做任何修改
+func (a *Agent) Register() (e error) {
+	return a.c.AddNode(a.conf.ID)
+}
+
+/*
+	向Reflector检测本节点的NAT类型，Reflector同时反向连接碎片服务的端口，检测结果由Reflector记录到协调服务。
+	检测的类型在之后的心跳中作为节点上报的NATType。
+
+	参数：
+		server: Reflector的主地址
+		timeout: 每个测试等待回复的时间，0表示默认值
+*/
+func (a *Agent) DetectNAT(server string, timeout time.Duration) (r *ynet.NATResult, e error) {
+	peer := a.Peer()
+	conn, e := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(peer.IP)})
+	if e != nil {
+		return
+	}
+	defer conn.Close()
+	if r, e = ynet.DetectNAT(conn, server, a.conf.ID, a.conf.Key, int(peer.Port), timeout); e != nil {
+		return
+	}
+	a.lock.Lock()
+	a.peer.NATType = r.Type
+	a.lock.Unlock()
+	return
+}
+
+//各分组的同步版本号
+func (a *Agent) Versions() (vers map[string]uint64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	vers = make(map[string]uint64, len(a.groups))
+	for gid, g := range a.groups {
+		vers[gid] = g.Ver
+	}
+	return
+}
+
+//定期执行Step，直到Close
+func (a *Agent) Start() {
+	a.stop = make(chan bool)
+	a.stopped = make(chan bool)
+	go func() {
+		defer close(a.stopped)
+		ticker := time.NewTicker(a.conf.Interval)
+		defer ticker.Stop()
+		for {
+			if e := a.Step(); e != nil {
+				a.logger.AppendObj(e, "agent step failed", a.conf.ID)
+			}
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+//等待已经开始的任务执行完
+func (a *Agent) Wait() {
+	a.tasks.Wait()
+}
+
+//停止心跳和碎片服务
+func (a *Agent) Close() (e error) {
+	if a.stop != nil {
+		close(a.stop)
+		<-a.stopped
+		a.stop = nil
+	}
+	a.Wait()
+	if a.relay != nil {
+		a.relay.Close()
+	}
+	return a.server.Close()
+}
+
+/*
+	执行一次心跳：汇报状态，同步分组版本号，开始执行新分配的任务。
+	任务在后台执行，执行中的扩散任务在之后的心跳中汇报，Wait等待任务执行完。
+*/
+func (a *Agent) Step() (e error) {
+	a.lock.Lock()
+	vers := make(map[string]uint64, len(a.groups))
+	for gid, g := range a.groups {
+		vers[gid] = g.Ver
+	}
+	tasks := make([]uint64, 0, len(a.expanding))
+	for id := range a.expanding {
+		tasks = append(tasks, id)
+	}
+	peer := a.peer
+	a.lock.Unlock()
+
+	node := &p2p_storage.Node{
+		Peer:       peer,
+		TotalSpace: a.conf.TotalSpace,
+		LeftSpace:  int64(a.conf.TotalSpace) - a.store.Used(),
+		State:      p2p_storage.YES,
+	}
+	groups, exNodes, deleteGids, e := a.c.UpdateNode2(node, vers, tasks, p2p_storage.YES)
+	if e != nil {
+		return
+	}
+	for _, gid := range deleteGids {
+		if e = a.store.DeleteGroup(gid); e != nil {
+			return
+		}
+		a.lock.Lock()
+		delete(a.groups, gid)
+		a.lock.Unlock()
+	}
+	for i := range groups {
+		if e = a.syncGroup(&groups[i]); e != nil {
+			return
+		}
+	}
+	if e = a.store.SaveVersions(a.Versions()); e != nil {
+		return
+	}
+
+	for _, t := range exNodes {
+		a.run(a.expanding, t.ID, a.expand)
+	}
+	unsafeNodes, e := a.c.GetUnSafeExpandTasks(a.conf.ID, p2p_storage.UNSAFE_EXPAND_STATE_INIT, MAX_UNSAFE_TASK_NUM)
+	if e != nil {
+		return
+	}
+	for _, t := range unsafeNodes {
+		a.run(a.unsafe, t.ID, a.unsafeExpand)
+	}
+	if err := a.reportRelay(); err != nil {
+		a.logger.AppendObj(err, "report relay failed", a.conf.ID)
+	}
+	return
+}
+
+//在后台执行任务，同一个任务不会同时执行两次
+func (a *Agent) run(running map[uint64]bool, id uint64, task func(id uint64) error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if running[id] {
+		return
+	}
+	running[id] = true
+	a.tasks.Add(1)
+	go func() {
+		defer a.tasks.Done()
+		if e := task(id); e != nil {
+			a.logger.AppendObj(e, "agent task failed", a.conf.ID, id)
+		}
+		a.lock.Lock()
+		delete(running, id)
+		a.lock.Unlock()
+	}()
+}
+
+/*
+	按文件版本号顺序推进分组的同步版本号，遇到还没有碎片的文件就停止
+*/
+func (a *Agent) syncGroup(detail *p2p_storage.NodeGroupDetail) (e error) {
+	a.lock.Lock()
+	g, ok := a.groups[detail.ID]
+	if !ok {
+		g = &localGroup{}
+		a.groups[detail.ID] = g
+	}
+	g.Group = detail.Group
+	ver := g.Ver
+	a.lock.Unlock()
+
+	defer func() {
+		a.lock.Lock()
+		g.Ver = ver
+		a.lock.Unlock()
+	}()
+	for ver < detail.FileVer {
+		files, e := a.c.ListUpdatedFiles(detail.ID, ver, LIST_FILE_NUM, p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST)
+		if e != nil {
+			return e
+		}
+		for _, f := range files {
+			if f.State == p2p_storage.DELETED {
+				if e = a.store.DeletePiece(detail.ID, f.MD5); e != nil {
+					return e
+				}
+			} else if !a.store.HasPiece(detail.ID, f.MD5) {
+				return nil
+			}
+			ver = f.Ver
+		}
+		if len(files) < LIST_FILE_NUM {
+			break
+		}
+	}
+	return
+}
+
+/*
+	添加本节点上的文件到p2p系统，并执行返回的扩散任务。设置了冷存储时先上传到冷存储。
+	文件进入协调服务的延迟添加队列时同样返回成功并返回排队号，分组就绪后的扩散任务通过心跳得到，
+	调用方用排队号查询（GetIngest）文件最终是否添加成功，超过ingest_max_hours失败时引用该文件的对象被删除。
+	p2p系统没有空间、协调服务要求转存到冷存储时（ColdRedirectError），设置了冷存储则上传到指定的对象名后返回成功，
+	文件只在冷存储和本节点中；没有设置冷存储时返回该错误。
+	Config.SHA256为true时用sha256的文件ID添加，同时登记文件的md5，md5已经对应其他文件时不登记。
+
+	返回值：
+		md5: 文件的md5，Config.SHA256为true时为文件ID
+		ticket: 进入延迟添加队列时的排队号，否则为0
+*/
+func (a *Agent) AddFile(data []byte) (md5sum string, ticket uint64, e error) {
+	md5sum = md5.MD5Sum(string(data))
+	legacy := md5sum
+	if a.conf.SHA256 {
+		md5sum = p2p_storage.SHA256FileID(data)
+	}
+	if e = a.store.PutFile(md5sum, data); e != nil {
+		return
+	}
+	if a.conf.Cold != nil {
+		if e = oss.PutFile(a.conf.Cold, p2p_storage.ColdKey(md5sum), data, a.conf.ColdSplitSize); e != nil {
+			return
+		}
+	}
+	var taskID int64
+	if a.conf.SHA256 {
+		taskID, e = a.c.AddP2PFileWithID(md5sum, legacy, a.conf.ID, uint64(len(data)), 0, false)
+	} else {
+		taskID, e = a.c.AddP2PFile(md5sum, a.conf.ID, uint64(len(data)), 0, false)
+	}
+	if t, queued := p2p_storage.IngestTicket(e); queued {
+		//分组就绪后协调服务生成扩散任务，通过心跳分配给本节点
+		a.logger.AppendObj(nil, "AddP2PFile queued", md5sum, t)
+		return md5sum, t, nil
+	}
+	if key, redirect := p2p_storage.RedirectColdKey(e); redirect && a.conf.Cold != nil {
+		if key != p2p_storage.ColdKey(md5sum) {
+			if e = oss.PutFile(a.conf.Cold, key, data, a.conf.ColdSplitSize); e != nil {
+				return
+			}
+		}
+		a.logger.AppendObj(nil, "AddP2PFile redirected to cold store", md5sum, key)
+		return md5sum, 0, nil
+	}
+	if e != nil {
+		return
+	}
+	if taskID <= 0 {
+		return
+	}
+	e = a.expand(uint64(taskID))
+	return
+}
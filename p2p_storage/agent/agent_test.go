@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+	"yh_pkg/p2p_storage"
+)
+
+func TestAgent(t *testing.T) {
+	c := newCluster(t)
+	defer c.close()
+	c.step()
+
+	data := make([]byte, 100*1024+3)
+	rand.New(rand.NewSource(1)).Read(data)
+	md5, _, e := c.agents[0].AddFile(data)
+	if e != nil {
+		t.Fatal(e)
+	}
+	file, e := c.ds.GetGroupFile(GID, md5)
+	if e != nil || file == nil || file.IsNewAdd() || file.Ver == 0 {
+		t.Fatalf("file not expanded: %+v %v", file, e)
+	}
+	c.step()
+	c.step()
+	c.checkVersions(file.Ver)
+
+	//节点磁盘损坏：重新生成碎片
+	lost := c.agents[1]
+	lost.Close()
+	os.RemoveAll(lost.conf.Dir)
+	c.agents[1] = c.newAgent(1)
+	c.step()
+	c.step()
+	if e = p2p_storage.GenPiece(GID, lost.conf.ID, md5); e != nil {
+		t.Fatal(e)
+	}
+	c.step()
+	c.step()
+	c.checkVersions(file.Ver)
+
+	//危险文件任务：补回本节点的碎片
+	c.agents[2].store.DeletePiece(GID, md5)
+	if e = p2p_storage.AddOrUpdateUnSafeExpandNode(GID, md5, []p2p_storage.GroupNode{{Node: c.agents[2].conf.ID}}); e != nil {
+		t.Fatal(e)
+	}
+	c.step()
+	if !c.agents[2].store.HasPiece(GID, md5) {
+		t.Error("unsafe task not executed")
+	}
+	if nids, e := p2p_storage.GetHasUnSafeFileNode(GID, md5, 1, nil); e != nil || len(nids) != 1 {
+		t.Errorf("GetHasUnSafeFileNode = %v %v", nids, e)
+	}
+
+	//每个节点的碎片序号都不同，一半节点停止后仍然可以下载
+	indexes := make(map[int]bool)
+	for _, a := range c.agents {
+		if p, e := a.store.GetPiece(GID, md5); e != nil || p == nil {
+			t.Fatalf("%s: piece %v %v", a.conf.ID, p, e)
+		} else {
+			indexes[p.Index] = true
+		}
+	}
+	if len(indexes) != NODE_NUM {
+		t.Errorf("piece indexes: %v", indexes)
+	}
+	for _, a := range c.agents[NODE_NUM/2:] {
+		a.server.Close()
+	}
+	got, e := Fetch(Local{}, md5)
+	if e != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Fetch: %v", e)
+	}
+
+	//删除文件后节点删除碎片
+	if e = p2p_storage.DeleteFile(md5); e != nil {
+		t.Fatal(e)
+	}
+	for _, a := range c.agents[:NODE_NUM/2] {
+		if e = a.Step(); e != nil {
+			t.Fatal(e)
+		}
+		if a.store.HasPiece(GID, md5) {
+			t.Errorf("%s: piece of deleted file not removed", a.conf.ID)
+		}
+	}
+}
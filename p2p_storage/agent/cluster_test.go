@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"yh_pkg/log"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/mem_source"
+)
+
+const (
+	GID      = "g1"
+	NODE_NUM = 8
+)
+
+type cluster struct {
+	t      *testing.T
+	dir    string
+	logger *log.MLogger
+	ds     *mem_source.MemSource
+	key    ed25519.PrivateKey //转发密钥，也用来签发推送碎片的令牌
+	agents []*Agent
+}
+
+//一个MinPieces为4、PerfectPieces为8的分组，每个节点一个agent
+func newCluster(t *testing.T) (c *cluster) {
+	dir, e := ioutil.TempDir("", "agent")
+	if e != nil {
+		t.Fatal(e)
+	}
+	logger, e := log.NewMLogger("", 1000, "error")
+	if e != nil {
+		t.Fatal(e)
+	}
+	c = &cluster{t: t, dir: dir, logger: logger, ds: mem_source.New()}
+	if e = p2p_storage.Init(c.ds, logger, false); e != nil {
+		t.Fatal(e)
+	}
+	if _, c.key, e = ed25519.GenerateKey(nil); e != nil {
+		t.Fatal(e)
+	}
+	p2p_storage.SetRelayKey(c.key)
+	c.ds.AddGroup(&p2p_storage.Group{ID: GID, PieceSize: 1024, MinPieces: 4, SafePieces: 6, PerfectPieces: NODE_NUM})
+	now := time.Now()
+	for i := 0; i < NODE_NUM; i++ {
+		a := c.newAgent(i)
+		n := &p2p_storage.NodeDetail{
+			Peer:        a.Peer(),
+			RegTm:       now.Unix() - 30*86400,
+			OnlineCount: 200,
+			Percent:     p2p_storage.NODE_OCCUPY_PERCENT,
+		}
+		if e = c.ds.AddNode(n); e != nil {
+			t.Fatal(e)
+		}
+		if e = c.ds.AddNodeToGroup(GID, &p2p_storage.GroupNode{Node: n.ID, State: p2p_storage.ONLINE}); e != nil {
+			t.Fatal(e)
+		}
+		c.agents = append(c.agents, a)
+	}
+	return
+}
+
+func (c *cluster) newAgent(i int) *Agent {
+	id := fmt.Sprintf("n%02d", i)
+	_, key, e := ed25519.GenerateKey(nil)
+	if e != nil {
+		c.t.Fatal(e)
+	}
+	conf := Config{ID: id, Dir: filepath.Join(c.dir, id), TotalSpace: 100 * p2p_storage.GROUP_NODE_CAPACITY, Key: key}
+	a, e := New(conf, Local{}, c.logger)
+	if e != nil {
+		c.t.Fatal(e)
+	}
+	return a
+}
+
+func (c *cluster) close() {
+	for _, a := range c.agents {
+		a.Close()
+	}
+	p2p_storage.Stop()
+	p2p_storage.SetRelayKey(nil)
+	os.RemoveAll(c.dir)
+}
+
+//所有节点心跳一次并等待任务执行完
+func (c *cluster) step() {
+	for _, a := range c.agents {
+		if e := a.Step(); e != nil {
+			c.t.Fatal(e)
+		}
+	}
+	for _, a := range c.agents {
+		a.Wait()
+	}
+}
+
+func (c *cluster) checkVersions(ver uint64) {
+	for _, a := range c.agents {
+		if got := a.Versions()[GID]; got != ver {
+			c.t.Errorf("%s: version %d, want %d", a.conf.ID, got, ver)
+		}
+	}
+}
+
+//由a添加随机内容的文件，等待所有节点同步版本号
+func (c *cluster) addFile(a *Agent, seed int64, size int) (md5 string, data []byte) {
+	data = make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	md5, _, e := a.AddFile(data)
+	if e != nil {
+		c.t.Fatal(e)
+	}
+	c.step()
+	c.step()
+	return
+}
@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/oss"
+)
+
+//添加文件时上传到冷存储，其他节点都不可用时只有冷存储可以拼回文件。传输方式的选择见p2p_storage的TestGetTransType
+func TestColdStore(t *testing.T) {
+	c := newCluster(t)
+	defer c.close()
+	cold, e := oss.NewLocalStore(filepath.Join(c.dir, "cold"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	p2p_storage.SetColdStore(cold)
+	defer p2p_storage.SetColdStore(nil)
+	for _, a := range c.agents {
+		a.conf.Cold, a.conf.ColdSplitSize = cold, 10*1024
+	}
+	c.step()
+	md5, data := c.addFile(c.agents[0], 2, 100*1024+3)
+	if info, e := cold.Head(p2p_storage.ColdKey(md5)); e != nil || info == nil || info.Size != int64(len(data)) {
+		t.Fatalf("file not uploaded to cold store: %+v %v", info, e)
+	}
+
+	a := c.agents[1]
+	for _, other := range c.agents {
+		if other != a {
+			other.server.Close()
+		}
+	}
+	for _, tc := range []struct {
+		tp int8
+		ok bool
+	}{
+		{p2p_storage.EXPAND_TRANS_TYPE_NODE, false},
+		{p2p_storage.EXPAND_TRANS_TYPE_OSS, true},
+		{p2p_storage.EXPAND_TRANS_TYPE_BOTH, true},
+	} {
+		got, e := a.fetch(md5, tc.tp)
+		if ok := e == nil && bytes.Equal(got, data); ok != tc.ok {
+			t.Errorf("fetch with trans type %d: %v, want ok %v", tc.tp, e, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"yh_pkg/p2p_storage"
+)
+
+//节点使用的协调服务接口，与p2p_storage中的同名函数一致
+type Coordinator interface {
+	AddNode(id string) (e error)
+	UpdateNode2(node *p2p_storage.Node, groupVersions map[string]uint64, tasks []uint64, is_super int) (groups []p2p_storage.NodeGroupDetail, exNodes []p2p_storage.ExpandNode, deleteGids []string, e error)
+	ListUpdatedFiles(gid string, ver uint64, num int, tp int) (files []p2p_storage.GroupFile, e error)
+	AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file bool) (task_id int64, e error)
+	AddP2PFileWithID(id, md5, src_node string, size uint64, times int, add_no_source_file bool) (task_id int64, e error)
+	GetExpandTaskById(id uint64) (nodes []string, file *p2p_storage.GroupFile, group *p2p_storage.Group, exNode *p2p_storage.ExpandNode, e error)
+	ExpandFinished(id uint64, state int8) (e error)
+	P2PExpandFinished(id uint64, state int8) (e error)
+	GetUnSafeExpandTasks(nid string, state int8, num int) (exNodes []p2p_storage.UnSafeExpandNode, e error)
+	GetUnSafeExpandTaskById(id uint64) (exNode *p2p_storage.UnSafeExpandNode, file *p2p_storage.GroupFile, group *p2p_storage.Group, e error)
+	UnSafeExpandFinished(id uint64, state int) (e error)
+	GetOnlineNodesByIds(ids []string, min_update_tm int64) (peers []p2p_storage.Peer, e error)
+	Download(md5 string) (nodes []p2p_storage.Peer, group *p2p_storage.Group, sources []p2p_storage.Peer, e error)
+	PlanRange(md5 string, offset, length uint64, exclude []string) (plan *p2p_storage.RangePlan, e error)
+	InvalidFile(nid, gid, md5 string) (e error)
+	GetFileIDBinding(id string) (b *p2p_storage.FileIDBinding, e error)
+	IssueRelayTokens(delegate, src, dst, md5 string) (srcToken, dstToken string, e error)
+	IssuePieceTokens(nid string, id uint64, pieces map[string]int) (tokens map[string]string, e error)
+	RelayKey() (key ed25519.PublicKey, e error)
+	ReportRelay(nid string, stats []p2p_storage.RelayStat) (n int, e error)
+}
+
+//同一进程中直接调用p2p_storage的协调服务，需要先调用p2p_storage.Init
+type Local struct{}
+
+func (Local) AddNode(id string) (e error) {
+	return p2p_storage.AddNode(id)
+}
+
+func (Local) UpdateNode2(node *p2p_storage.Node, groupVersions map[string]uint64, tasks []uint64, is_super int) (groups []p2p_storage.NodeGroupDetail, exNodes []p2p_storage.ExpandNode, deleteGids []string, e error) {
+	return p2p_storage.UpdateNode2(node, groupVersions, tasks, is_super)
+}
+
+func (Local) ListUpdatedFiles(gid string, ver uint64, num int, tp int) (files []p2p_storage.GroupFile, e error) {
+	return p2p_storage.ListUpdatedFiles(gid, ver, num, tp)
+}
+
+func (Local) AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file bool) (task_id int64, e error) {
+	return p2p_storage.AddP2PFile(md5, src_node, size, times, add_no_source_file)
+}
+
+func (Local) AddP2PFileWithID(id, md5, src_node string, size uint64, times int, add_no_source_file bool) (task_id int64, e error) {
+	return p2p_storage.AddP2PFileWithID(id, md5, src_node, size, times, add_no_source_file)
+}
+
+func (Local) GetExpandTaskById(id uint64) (nodes []string, file *p2p_storage.GroupFile, group *p2p_storage.Group, exNode *p2p_storage.ExpandNode, e error) {
+	return p2p_storage.GetExpandTaskById(id)
+}
+
+func (Local) ExpandFinished(id uint64, state int8) (e error) {
+	return p2p_storage.ExpandFinished(id, state)
+}
+
+func (Local) P2PExpandFinished(id uint64, state int8) (e error) {
+	return p2p_storage.P2PExpandFinished(id, state)
+}
+
+func (Local) GetUnSafeExpandTasks(nid string, state int8, num int) (exNodes []p2p_storage.UnSafeExpandNode, e error) {
+	return p2p_storage.GetUnSafeExpandTasks(nid, state, num)
+}
+
+func (Local) GetUnSafeExpandTaskById(id uint64) (exNode *p2p_storage.UnSafeExpandNode, file *p2p_storage.GroupFile, group *p2p_storage.Group, e error) {
+	return p2p_storage.GetUnSafeExpandTaskById(id)
+}
+
+func (Local) UnSafeExpandFinished(id uint64, state int) (e error) {
+	return p2p_storage.UnSafeExpandFinished(id, state)
+}
+
+func (Local) GetOnlineNodesByIds(ids []string, min_update_tm int64) (peers []p2p_storage.Peer, e error) {
+	return p2p_storage.GetOnlineNodesByIds(ids, min_update_tm)
+}
+
+func (Local) Download(md5 string) (nodes []p2p_storage.Peer, group *p2p_storage.Group, sources []p2p_storage.Peer, e error) {
+	return p2p_storage.Download(md5)
+}
+
+func (Local) PlanRange(md5 string, offset, length uint64, exclude []string) (plan *p2p_storage.RangePlan, e error) {
+	return p2p_storage.PlanRange(md5, offset, length, exclude)
+}
+
+func (Local) InvalidFile(nid, gid, md5 string) (e error) {
+	return p2p_storage.InvalidFile(nid, gid, md5)
+}
+
+func (Local) GetFileIDBinding(id string) (b *p2p_storage.FileIDBinding, e error) {
+	return p2p_storage.GetFileIDBinding(id)
+}
+
+func (Local) IssueRelayTokens(delegate, src, dst, md5 string) (srcToken, dstToken string, e error) {
+	return p2p_storage.IssueRelayTokens(delegate, src, dst, md5)
+}
+
+func (Local) IssuePieceTokens(nid string, id uint64, pieces map[string]int) (tokens map[string]string, e error) {
+	return p2p_storage.IssuePieceTokens(nid, id, pieces)
+}
+
+func (Local) RelayKey() (key ed25519.PublicKey, e error) {
+	if key = p2p_storage.RelayPublicKey(); key == nil {
+		e = errors.New("relay key not set")
+	}
+	return
+}
+
+func (Local) ReportRelay(nid string, stats []p2p_storage.RelayStat) (n int, e error) {
+	return p2p_storage.ReportRelay(nid, stats)
+}
+
+var _ Coordinator = Local{}
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+	"yh_pkg/p2p_storage"
+)
+
+//用sha256的文件ID添加文件，两种标识都可以获取；没有登记的文件ID获取不到md5添加的文件。对应关系的登记见p2p_storage的TestFileIDBinding
+func TestFileID(t *testing.T) {
+	c := newCluster(t)
+	defer c.close()
+	c.step()
+	c.agents[0].conf.SHA256 = true
+	id, data := c.addFile(c.agents[0], 3, 20*1024+1)
+	b, e := p2p_storage.GetFileIDBinding(id)
+	if !p2p_storage.IsSHA256FileID(id) || e != nil || b == nil || b.Key != id || !p2p_storage.VerifyFileID(b.MD5, data) {
+		t.Fatalf("binding of %s: %+v %v", id, b, e)
+	}
+	md5, old := c.addFile(c.agents[1], 4, 10*1024)
+	for _, tc := range []struct {
+		key  string
+		data []byte
+	}{
+		{id, data},
+		{b.MD5, data},
+		{"d510" + b.MD5, data},
+		{md5, old},
+		{p2p_storage.SHA256FileID(old), nil},
+	} {
+		got, e := Fetch(Local{}, tc.key)
+		if tc.data == nil && e == nil {
+			t.Errorf("Fetch(%s) of unbound id", tc.key)
+		} else if tc.data != nil && (e != nil || !bytes.Equal(got, tc.data)) {
+			t.Errorf("Fetch(%s): %v", tc.key, e)
+		}
+	}
+}
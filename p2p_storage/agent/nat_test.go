@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"math/rand"
+	"testing"
+	"time"
+	ynet "yh_pkg/net"
+	"yh_pkg/p2p_storage"
+)
+
+//在127.0.0.1和127.0.0.2上启动Reflector，检测结果记录到协调服务
+func newReflector(t *testing.T) (r *ynet.Reflector, e error) {
+	for i := 0; i < 5; i++ {
+		port := 20000 + rand.Intn(20000)
+		r, e = ynet.NewReflector(ynet.ReflectorConfig{IP: "127.0.0.1", AltIP: "127.0.0.2", Port: port, AltPort: port + 1,
+			LookupNode: p2p_storage.LookupNATNode,
+			OnResult: func(res *ynet.NATResult) {
+				n := &p2p_storage.NodeNAT{Node: res.Node, Type: res.Type, Mapped: res.Mapped, Port: int32(res.Port), Reachable: res.Reachable, Tm: res.Tm}
+				if e := p2p_storage.RecordNodeNAT(n); e != nil {
+					t.Error(e)
+				}
+			}})
+		if e == nil {
+			return
+		}
+	}
+	return
+}
+
+//节点通过Reflector检测NAT类型，检测结果记录到协调服务，检测过的节点作为代理节点。检测结果的使用见p2p_storage的TestRecordNodeNAT
+func TestNAT(t *testing.T) {
+	c := newCluster(t)
+	defer c.close()
+	c.step()
+	r, e := newReflector(t)
+	if e != nil {
+		t.Skip("reflector needs 127.0.0.2:", e)
+	}
+	defer r.Close()
+	//没有登记公钥的节点的报告不被接受
+	if res, e := c.agents[0].DetectNAT(r.Addr(), time.Second); e == nil {
+		t.Fatalf("detect without key: %+v", res)
+	}
+	if n, e := p2p_storage.GetNodeNAT("n00"); n != nil || e != nil {
+		t.Fatalf("nat without key: %+v %v", n, e)
+	}
+	if e = p2p_storage.ReEnrollNode("n00", c.agents[0].conf.Key.Public().(ed25519.PublicKey)); e != nil {
+		t.Fatal(e)
+	}
+	res, e := c.agents[0].DetectNAT(r.Addr(), time.Second)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if res.Type != p2p_storage.NAT_OPEN || !res.Reachable || c.agents[0].Peer().NATType != p2p_storage.NAT_OPEN {
+		t.Fatalf("detect: %+v", res)
+	}
+	if n, e := p2p_storage.GetNodeNAT("n00"); e != nil || n == nil || n.Type != p2p_storage.NAT_OPEN || n.Port != c.agents[0].Peer().Port {
+		t.Fatalf("recorded nat: %+v %v", n, e)
+	}
+	c.step()
+	ds, e := p2p_storage.GetDelegates(NODE_NUM)
+	if e != nil || len(ds) != 1 || ds[0].ID != "n00" || ds[0].UPNPIP != "127.0.0.1" || ds[0].UPNPPort != c.agents[0].Peer().Port {
+		t.Errorf("delegates: %+v %v", ds, e)
+	}
+}
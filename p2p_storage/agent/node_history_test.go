@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/history"
+)
+
+//agent的心跳和执行的扩散任务记录到节点历史。记录和查询的规则见p2p_storage的TestNodeHistory和TestNodeHistoryTasks
+func TestNodeHistory(t *testing.T) {
+	p2p_storage.SetNodeHistoryStore(history.NewMemStore())
+	defer p2p_storage.SetNodeHistoryStore(nil)
+	c := newCluster(t)
+	defer c.close()
+	c.step()
+	c.addFile(c.agents[0], 6, 10*1024)
+
+	now := time.Now().Unix()
+	//n00执行了新增文件的扩散任务
+	h, e := p2p_storage.GetNodeHistory("n00", now-3600, now+3600)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var count, finished int32
+	for _, s := range h.Samples {
+		count += s.Count
+		finished += s.Finished
+	}
+	if count != 3 || finished != 1 || len(h.Periods) != 1 || h.Samples[len(h.Samples)-1].LeftSpace == 0 {
+		t.Errorf("history: %+v", h)
+	}
+}
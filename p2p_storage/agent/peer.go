@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"yh_pkg/algorithm/erasure"
+	"yh_pkg/p2p_storage"
+)
+
+const (
+	PIECE_PATH           = "/piece"
+	HEADER_PIECE_INDEX   = "X-Piece-Index"
+	HEADER_FILE_SIZE     = "X-File-Size"
+	HEADER_PIECE_TOKEN   = "X-Piece-Token" //推送碎片的令牌，见p2p_storage.IssuePieceTokens
+	PEER_REQUEST_TIMEOUT = 30 * time.Second
+)
+
+var peerClient = http.Client{Timeout: PEER_REQUEST_TIMEOUT}
+
+/*
+	节点之间的碎片服务：
+		GET/HEAD /piece?gid=&md5=: 获取碎片，序号和原始文件大小在响应头中，没有碎片时返回404。
+			支持Range头只获取碎片的一段（206）
+		PUT /piece?gid=&md5=&idx=&size=: 扩散时推送碎片，需要在HEADER_PIECE_TOKEN中带协调服务签发的令牌，
+			碎片序号、文件大小和碎片的字节数必须与令牌一致
+*/
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != PIECE_PATH {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	gid, md5 := q.Get("gid"), q.Get("md5")
+	if checkName(gid, md5) != nil {
+		http.Error(w, "invalid gid or md5", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		p, data, e := a.store.OpenPiece(gid, md5)
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusInternalServerError)
+			return
+		}
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer data.Close()
+		w.Header().Set(HEADER_PIECE_INDEX, strconv.Itoa(p.Index))
+		w.Header().Set(HEADER_FILE_SIZE, strconv.FormatUint(p.Size, 10))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, data)
+	case http.MethodPut:
+		idx, e1 := strconv.Atoi(q.Get("idx"))
+		size, e2 := strconv.ParseUint(q.Get("size"), 10, 64)
+		if e1 != nil || e2 != nil {
+			http.Error(w, "invalid idx or size", http.StatusBadRequest)
+			return
+		}
+		g, e := a.authorizePiece(r.Header.Get(HEADER_PIECE_TOKEN), gid, md5, idx)
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusForbidden)
+			return
+		}
+		if idx < 0 || idx >= g.Pieces || idx >= a.maxPieces(gid) || size != g.Size {
+			http.Error(w, "invalid idx or size", http.StatusBadRequest)
+			return
+		}
+		data, e := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, g.Bytes))
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if int64(len(data)) != g.Bytes {
+			http.Error(w, fmt.Sprintf("piece has %d bytes, expected %d", len(data), g.Bytes), http.StatusBadRequest)
+			return
+		}
+		if e = a.store.PutPiece(gid, md5, &Piece{idx, size, data}); e != nil {
+			http.Error(w, e.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//用协调服务的公钥校验推送碎片的令牌
+func (a *Agent) authorizePiece(token, gid, md5 string, idx int) (g *p2p_storage.PieceGrant, e error) {
+	if token == "" {
+		return nil, errors.New("piece token required")
+	}
+	key, e := a.relayKey()
+	if e != nil {
+		return
+	}
+	return p2p_storage.VerifyPieceToken(key, token, a.conf.ID, gid, md5, idx)
+}
+
+//已知分组时按分组的碎片总数检查序号
+func (a *Agent) maxPieces(gid string) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if g, ok := a.groups[gid]; ok && g.PerfectPieces > 0 {
+		return int(g.PerfectPieces)
+	}
+	return erasure.MAX_SHARDS
+}
+
+func pieceURL(peer *p2p_storage.Peer, params url.Values) string {
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(peer.IP, strconv.Itoa(int(peer.Port))), Path: PIECE_PATH, RawQuery: params.Encode()}
+	return u.String()
+}
+
+/*
+	从其他节点获取碎片
+
+	参数：
+		head: 只获取碎片序号和原始文件大小
+	返回值：
+		p: 节点没有该碎片时返回nil,nil
+*/
+func getPiece(peer *p2p_storage.Peer, gid, md5 string, head bool) (p *Piece, e error) {
+	method := http.MethodGet
+	if head {
+		method = http.MethodHead
+	}
+	req, e := http.NewRequest(method, pieceURL(peer, url.Values{"gid": {gid}, "md5": {md5}}), nil)
+	if e != nil {
+		return
+	}
+	resp, e := peerClient.Do(req)
+	if e != nil {
+		return
+	}
+	defer resp.Body.Close()
+	return readPiece(resp, peer, head)
+}
+
+/*
+	获取其他节点碎片中的[offset, offset+length)
+
+	返回值：
+		p: p.Data为碎片的这一段，节点没有该碎片时返回nil,nil
+*/
+func getPieceRange(peer *p2p_storage.Peer, gid, md5 string, offset, length uint64) (p *Piece, e error) {
+	req, e := http.NewRequest(http.MethodGet, pieceURL(peer, url.Values{"gid": {gid}, "md5": {md5}}), nil)
+	if e != nil {
+		return
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, e := peerClient.Do(req)
+	if e != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if p, e = readPiece(resp, peer, false); e != nil || p == nil {
+		return
+	}
+	//不支持Range的旧节点返回整个碎片
+	if resp.StatusCode == http.StatusOK && uint64(len(p.Data)) >= offset+length {
+		p.Data = p.Data[offset : offset+length]
+	}
+	if uint64(len(p.Data)) != length {
+		return nil, fmt.Errorf("get piece range from %s: %d bytes, expected %d", peer.ID, len(p.Data), length)
+	}
+	return
+}
+
+func readPiece(resp *http.Response, peer *p2p_storage.Peer, head bool) (p *Piece, e error) {
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("get piece from %s: %s", peer.ID, resp.Status)
+	}
+	p = &Piece{}
+	if p.Index, e = strconv.Atoi(resp.Header.Get(HEADER_PIECE_INDEX)); e != nil {
+		return nil, e
+	}
+	if p.Size, e = strconv.ParseUint(resp.Header.Get(HEADER_FILE_SIZE), 10, 64); e != nil {
+		return nil, e
+	}
+	if !head {
+		p.Data, e = ioutil.ReadAll(resp.Body)
+	}
+	return
+}
+
+//向其他节点推送碎片，token为协调服务签发给该节点的令牌
+func putPiece(peer *p2p_storage.Peer, gid, md5 string, p *Piece, token string) (e error) {
+	params := url.Values{"gid": {gid}, "md5": {md5}, "idx": {strconv.Itoa(p.Index)}, "size": {strconv.FormatUint(p.Size, 10)}}
+	req, e := http.NewRequest(http.MethodPut, pieceURL(peer, params), bytes.NewReader(p.Data))
+	if e != nil {
+		return
+	}
+	req.Header.Set(HEADER_PIECE_TOKEN, token)
+	resp, e := peerClient.Do(req)
+	if e != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("put piece to %s: %s %s", peer.ID, resp.Status, bytes.TrimSpace(body))
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+//按p2p_storage的格式签发类型为typ的令牌
+func grantToken(t *testing.T, key ed25519.PrivateKey, typ string, g interface{}) string {
+	b, e := json.Marshal(g)
+	if e != nil {
+		t.Fatal(e)
+	}
+	sig := ed25519.Sign(key, append([]byte(typ+"\n"), b...))
+	return base64.RawURLEncoding.EncodeToString(b) + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+//推送碎片必须带协调服务签发的这个碎片的令牌，碎片的字节数不能超过令牌中的值
+func TestPieceToken(t *testing.T) {
+	c := newCluster(t)
+	defer c.close()
+	c.step()
+
+	const md5 = "0123456789abcdef0123456789abcdef"
+	dst := c.agents[1]
+	peer := dst.Peer()
+	p := &Piece{3, 4096, make([]byte, 1024)}
+	g := &p2p_storage.PieceGrant{Group: GID, MD5: md5, Src: "n00", Dst: dst.conf.ID, Size: p.Size, Pieces: NODE_NUM,
+		Index: p.Index, Bytes: int64(len(p.Data)), Expire: time.Now().Unix() + 60}
+	pieceToken := func(key ed25519.PrivateKey, g *p2p_storage.PieceGrant) string {
+		return grantToken(t, key, p2p_storage.GRANT_TYPE_PIECE, g)
+	}
+
+	if e := putPiece(&peer, GID, md5, p, ""); e == nil {
+		t.Error("put piece without token")
+	}
+	_, other, _ := ed25519.GenerateKey(nil)
+	if e := putPiece(&peer, GID, md5, p, pieceToken(other, g)); e == nil {
+		t.Error("put piece with token of another key")
+	}
+	wrong := *g
+	wrong.Dst = "n02"
+	if e := putPiece(&peer, GID, md5, p, pieceToken(c.key, &wrong)); e == nil {
+		t.Error("put piece with token of another node")
+	}
+	otherIdx := *g
+	otherIdx.Index = p.Index + 1
+	if e := putPiece(&peer, GID, md5, p, pieceToken(c.key, &otherIdx)); e == nil {
+		t.Error("put piece with token of another index")
+	}
+	//同样的内容签名为转发令牌
+	if e := putPiece(&peer, GID, md5, p, grantToken(t, c.key, p2p_storage.GRANT_TYPE_RELAY, g)); e == nil {
+		t.Error("put piece with relay token")
+	}
+	expired := *g
+	expired.Expire = time.Now().Unix() - 1
+	if e := putPiece(&peer, GID, md5, p, pieceToken(c.key, &expired)); e == nil {
+		t.Error("put piece with expired token")
+	}
+	big := &Piece{p.Index, p.Size, make([]byte, len(p.Data)+1)}
+	if e := putPiece(&peer, GID, md5, big, pieceToken(c.key, g)); e == nil {
+		t.Error("put piece larger than token")
+	}
+	if got, _ := dst.store.GetPiece(GID, md5); got != nil {
+		t.Fatal("rejected piece stored")
+	}
+	if e := putPiece(&peer, GID, md5, p, pieceToken(c.key, g)); e != nil {
+		t.Fatal(e)
+	}
+	if got, e := dst.store.GetPiece(GID, md5); e != nil || got == nil || got.Index != p.Index {
+		t.Errorf("piece not stored: %+v %v", got, e)
+	}
+}
@@ -0,0 +1,211 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"yh_pkg/algorithm/erasure"
+	"yh_pkg/p2p_storage"
+)
+
+//RangeReader的节点都读取失败后重新规划的最大次数，每次读取重新计数
+const RANGE_MAX_REPLANS = 3
+
+/*
+	按需从碎片拼回文件任意一段的io.ReaderAt，用于播放时拖动进度，不需要下载整个文件。
+	每段数据优先从有对应数据碎片的节点直接读取，没有时从MinPieces个节点读取同一位置拼回。
+	计划中的节点不够拼回数据时，去掉读取失败的节点向协调服务重新规划，长时间播放时节点陆续下线也可以继续读取。
+	可以同时调用ReadAt，配合io.NewSectionReader可以得到io.ReadSeeker，例如用http.ServeContent输出：
+		r, e := agent.NewRangeReader(c, md5)
+		http.ServeContent(w, req, "", time.Time{}, io.NewSectionReader(r, 0, r.Size()))
+*/
+type RangeReader struct {
+	c    Coordinator
+	md5  string
+	size uint64
+
+	lock   sync.Mutex
+	group  *p2p_storage.Group
+	coder  *erasure.Coder
+	peers  []p2p_storage.Peer
+	probed bool
+	index  map[string]int  //节点ID -> 碎片序号，没有碎片或者读取失败的节点不在其中
+	failed map[string]bool //读取失败的节点，重新规划时排除
+}
+
+/*
+	参数：
+		c: 协调服务
+		md5: 文件的md5或文件ID
+*/
+func NewRangeReader(c Coordinator, md5 string) (r *RangeReader, e error) {
+	md5 = fileKey(c, md5)
+	plan, e := c.PlanRange(md5, 0, 1, nil)
+	if e != nil {
+		return
+	}
+	r = &RangeReader{c: c, md5: plan.MD5, size: plan.Size, failed: make(map[string]bool)}
+	if e = r.setPlan(plan); e != nil {
+		return nil, e
+	}
+	return
+}
+
+//换用新的计划，分组变化时同时换用新分组的编码
+func (r *RangeReader) setPlan(plan *p2p_storage.RangePlan) (e error) {
+	if plan.Size != r.size {
+		return fmt.Errorf("size of %s changed: %d != %d", r.md5, plan.Size, r.size)
+	}
+	coder := r.coder
+	if r.group == nil || r.group.ID != plan.Group.ID {
+		if coder, e = erasure.New(int(plan.Group.MinPieces), int(plan.Group.PerfectPieces)); e != nil {
+			return
+		}
+	}
+	r.group, r.coder, r.peers = plan.Group, coder, plan.Peers
+	r.probed, r.index = false, make(map[string]int)
+	return
+}
+
+//排除读取失败的节点重新规划
+func (r *RangeReader) replan() (e error) {
+	r.lock.Lock()
+	exclude := make([]string, 0, len(r.failed))
+	for nid := range r.failed {
+		exclude = append(exclude, nid)
+	}
+	r.lock.Unlock()
+	plan, e := r.c.PlanRange(r.md5, 0, 1, exclude)
+	if e != nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.setPlan(plan)
+}
+
+//原始文件大小
+func (r *RangeReader) Size() int64 {
+	return int64(r.size)
+}
+
+func (r *RangeReader) ReadAt(b []byte, off int64) (n int, e error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if uint64(off) >= r.size {
+		return 0, io.EOF
+	}
+	length := uint64(len(b))
+	if length > r.size-uint64(off) {
+		length = r.size - uint64(off)
+		e = io.EOF
+	}
+	pos, end := uint64(off), uint64(off)+length
+	for replans := 0; pos < end; replans++ {
+		group, coder := r.layout()
+		var err error
+		//与协调服务PlanRange的切分一致，分组变化后切分也会变化
+		for _, s := range p2p_storage.SplitRange(group, r.size, pos, end-pos) {
+			var data []byte
+			if data, err = r.readStripe(group, coder, &s); err != nil {
+				break
+			}
+			n += copy(b[s.Offset-uint64(off):], data)
+			pos += s.Length
+		}
+		if err == nil {
+			break
+		}
+		if replans >= RANGE_MAX_REPLANS || r.replan() != nil {
+			return n, err
+		}
+	}
+	return
+}
+
+func (r *RangeReader) layout() (group *p2p_storage.Group, coder *erasure.Coder) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.group, r.coder
+}
+
+//获取各节点的碎片序号，每次规划后第一次读取时获取
+func (r *RangeReader) probe() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.probed {
+		return
+	}
+	r.probed = true
+	for i := range r.peers {
+		p, e := getPiece(&r.peers[i], r.group.ID, r.md5, true)
+		if e == nil && p != nil && p.Index < r.coder.TotalShards() && p.Size == r.size {
+			r.index[r.peers[i].ID] = p.Index
+		} else {
+			r.failed[r.peers[i].ID] = true
+		}
+	}
+}
+
+//按节点的顺序返回分组中有碎片的节点和碎片序号
+func (r *RangeReader) holders(gid string) (peers []p2p_storage.Peer, index []int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.group.ID != gid {
+		return
+	}
+	for _, peer := range r.peers {
+		if idx, ok := r.index[peer.ID]; ok {
+			peers = append(peers, peer)
+			index = append(index, idx)
+		}
+	}
+	return
+}
+
+//读取失败的节点之后不再使用
+func (r *RangeReader) fail(nid string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.index, nid)
+	r.failed[nid] = true
+}
+
+func (r *RangeReader) readStripe(group *p2p_storage.Group, coder *erasure.Coder, s *p2p_storage.RangeStripe) (data []byte, e error) {
+	r.probe()
+	peers, index := r.holders(group.ID)
+	read := func(i int) []byte {
+		p, err := getPieceRange(&peers[i], group.ID, r.md5, s.ShardOffset, s.Length)
+		if err != nil || p == nil || p.Index != index[i] {
+			r.fail(peers[i].ID)
+			return nil
+		}
+		return p.Data
+	}
+	//数据碎片就是原始文件的一段
+	for i, idx := range index {
+		if idx == s.Shard {
+			if data = read(i); data != nil {
+				return
+			}
+		}
+	}
+	shards := make(map[int][]byte, group.MinPieces)
+	for i, idx := range index {
+		if len(shards) >= int(group.MinPieces) {
+			break
+		}
+		if _, ok := shards[idx]; ok || idx == s.Shard {
+			continue
+		}
+		if b := read(i); b != nil {
+			shards[idx] = b
+		}
+	}
+	if data, e = coder.DecodeShard(shards, s.Shard); e != nil {
+		return nil, fmt.Errorf("read %s at %d: %v", r.md5, s.Offset, e)
+	}
+	return
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+//按范围读取文件，部分节点不可用时用其他碎片拼回。读取范围的规划见p2p_storage的TestPlanRange
+func TestRangeReader(t *testing.T) {
+	c := newCluster(t)
+	defer c.close()
+	c.step()
+	md5, data := c.addFile(c.agents[0], 7, 10*1024+7)
+
+	check := func(t *testing.T) {
+		r, e := NewRangeReader(Local{}, md5)
+		if e != nil {
+			t.Fatal(e)
+		}
+		rnd := rand.New(rand.NewSource(8))
+		for i := 0; i < 20; i++ {
+			off := rnd.Intn(len(data))
+			b := make([]byte, rnd.Intn(4096)+1)
+			n, e := r.ReadAt(b, int64(off))
+			end := off + len(b)
+			if end > len(data) {
+				end = len(data)
+				if e != io.EOF {
+					t.Errorf("ReadAt at end: %v", e)
+				}
+			} else if e != nil {
+				t.Fatal(e)
+			}
+			if !bytes.Equal(b[:n], data[off:end]) {
+				t.Fatalf("ReadAt(%d, %d): data differs", off, len(b))
+			}
+		}
+		got, e := ioutil.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+		if e != nil || !bytes.Equal(got, data) {
+			t.Fatalf("read all: %v", e)
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		close func(p *Piece) bool //停止有这个碎片的节点
+	}{
+		{"all peers", func(*Piece) bool { return false }},
+		//前两个数据碎片的节点不可用时，从其他碎片拼回
+		{"data shards gone", func(p *Piece) bool { return p.Index < 2 }},
+	} {
+		for _, a := range c.agents {
+			if p, _ := a.store.GetPiece(GID, md5); p != nil && tc.close(p) {
+				a.server.Close()
+			}
+		}
+		t.Run(tc.name, check)
+	}
+
+	//读取过程中计划的节点陆续不可用，重新规划后用计划外的节点继续读取
+	r, e := NewRangeReader(Local{}, md5)
+	if e != nil {
+		t.Fatal(e)
+	}
+	b := make([]byte, 100)
+	if _, e = r.ReadAt(b, 0); e != nil {
+		t.Fatal(e)
+	}
+	planned := make(map[string]bool)
+	for _, p := range r.peers {
+		planned[p.ID] = true
+	}
+	closed := 0
+	for _, a := range c.agents {
+		if p, _ := a.store.GetPiece(GID, md5); p != nil && p.Index >= 2 && planned[a.conf.ID] && closed < 2 {
+			a.server.Close()
+			closed++
+		}
+	}
+	if closed != 2 {
+		t.Fatalf("closed %d planned peers", closed)
+	}
+	n, e := r.ReadAt(b, int64(len(data)-len(b)))
+	if e != nil || !bytes.Equal(b[:n], data[len(data)-len(b):]) {
+		t.Errorf("read after peers gone: %v", e)
+	}
+}
+
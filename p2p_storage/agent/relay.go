@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	ynet "yh_pkg/net"
+	"yh_pkg/p2p_storage"
+)
+
+/*
+	代理转发：Config.RelayAddr不为空时节点作为代理提供转发服务，令牌用协调服务的转发公钥校验，
+	会话统计在心跳时用ReportRelay汇报。
+
+	不能直接连接的节点之间获取碎片时，获取端用IssueRelayTokens得到一对令牌，把提供端的令牌交给提供端后：
+		提供端: ServeRelay连接代理，把转发的连接交给本节点的碎片服务
+		获取端: GetPieceViaRelay连接代理，在转发的连接上发送碎片请求
+*/
+const RELAY_DIAL_TIMEOUT = ynet.RELAY_PAIR_TIMEOUT //连接代理并等待另一端的时间（秒）
+
+//启动转发服务
+func (a *Agent) startRelay() (e error) {
+	host, p, e := net.SplitHostPort(a.conf.RelayAddr)
+	if e != nil {
+		return
+	}
+	port, e := strconv.Atoi(p)
+	if e != nil {
+		return
+	}
+	a.relay, e = ynet.NewRelayServer(ynet.RelayConfig{IP: host, Port: port, Authorize: a.authorizeRelay, OnSession: a.relayFinished})
+	return
+}
+
+//转发服务的地址，没有启动时为空
+func (a *Agent) RelayAddr() string {
+	if a.relay == nil {
+		return ""
+	}
+	return a.relay.Addr()
+}
+
+func (a *Agent) relayKey() (key ed25519.PublicKey, e error) {
+	a.lock.Lock()
+	key = a.relayPub
+	a.lock.Unlock()
+	if key != nil {
+		return
+	}
+	if key, e = a.c.RelayKey(); e != nil {
+		return
+	}
+	a.lock.Lock()
+	a.relayPub = key
+	a.lock.Unlock()
+	return
+}
+
+func (a *Agent) authorizeRelay(token string) (t *ynet.RelayTicket, e error) {
+	key, e := a.relayKey()
+	if e != nil {
+		return
+	}
+	g, e := p2p_storage.VerifyRelayToken(key, token, a.conf.ID)
+	if e != nil {
+		return
+	}
+	return &ynet.RelayTicket{Session: g.Session, Role: g.Role, Rate: g.Rate, Expire: g.Expire}, nil
+}
+
+func (a *Agent) relayFinished(s *ynet.RelayStat) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	//协调服务长时间不可用时丢弃最早的统计
+	if len(a.relayStats) >= p2p_storage.RELAY_MAX_REPORT_STATS {
+		a.relayStats = a.relayStats[1:]
+	}
+	a.relayStats = append(a.relayStats, p2p_storage.RelayStat{Token: s.Token, Bytes: s.Bytes, Ms: int64(s.Duration / time.Millisecond)})
+}
+
+//汇报转发统计，失败时下次心跳重新汇报
+func (a *Agent) reportRelay() (e error) {
+	a.lock.Lock()
+	stats := a.relayStats
+	a.relayStats = nil
+	a.lock.Unlock()
+	if len(stats) == 0 {
+		return
+	}
+	if _, e = a.c.ReportRelay(a.conf.ID, stats); e != nil {
+		a.lock.Lock()
+		a.relayStats = append(stats, a.relayStats...)
+		a.lock.Unlock()
+	}
+	return
+}
+
+/*
+	作为提供端连接代理，把转发的连接交给本节点的碎片服务，获取端的请求处理完后返回
+
+	参数：
+		relay: 代理节点的转发服务地址
+		token: 提供端的令牌
+*/
+func (a *Agent) ServeRelay(relay, token string) (e error) {
+	conn, e := ynet.DialRelay(relay, token, RELAY_DIAL_TIMEOUT)
+	if e != nil {
+		return
+	}
+	defer conn.Close()
+	local, e := net.DialTimeout("tcp", a.listener.Addr().String(), PEER_REQUEST_TIMEOUT)
+	if e != nil {
+		return
+	}
+	defer local.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(local, conn)
+		local.(*net.TCPConn).CloseWrite()
+		done <- err
+	}()
+	if _, e = io.Copy(conn, local); e == nil {
+		e = conn.CloseWrite()
+	}
+	if err := <-done; e == nil {
+		e = err
+	}
+	return
+}
+
+/*
+	作为获取端通过代理从peer获取碎片
+
+	参数：
+		relay: 代理节点的转发服务地址
+		token: 获取端的令牌
+	返回值：
+		p: 节点没有该碎片时返回nil,nil
+*/
+func GetPieceViaRelay(relay, token string, peer *p2p_storage.Peer, gid, md5 string) (p *Piece, e error) {
+	conn, e := ynet.DialRelay(relay, token, RELAY_DIAL_TIMEOUT)
+	if e != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetTimeout(uint(PEER_REQUEST_TIMEOUT / time.Second))
+	req, e := http.NewRequest(http.MethodGet, pieceURL(peer, url.Values{"gid": {gid}, "md5": {md5}}), nil)
+	if e != nil {
+		return
+	}
+	//提供端的碎片服务响应后关闭连接，转发会话随之结束
+	req.Close = true
+	if e = req.Write(conn); e != nil {
+		return
+	}
+	resp, e := http.ReadResponse(bufio.NewReader(conn), req)
+	if e != nil {
+		return
+	}
+	defer resp.Body.Close()
+	return readPiece(resp, peer, false)
+}
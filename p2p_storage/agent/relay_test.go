@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+//代理节点转发碎片，会话统计在心跳时汇报到节点详情。令牌的签发和统计的校验见p2p_storage的TestIssueRelayTokens和TestReportRelay
+func TestRelay(t *testing.T) {
+	c := newCluster(t)
+	defer c.close()
+
+	conf := Config{ID: "r1", Dir: filepath.Join(c.dir, "r1"), RelayAddr: "127.0.0.1:0"}
+	relay, e := New(conf, Local{}, c.logger)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer relay.Close()
+	relay.peer.NATType = p2p_storage.NAT_OPEN
+	c.ds.AddNode(&p2p_storage.NodeDetail{Peer: relay.Peer(), RegTm: time.Now().Unix(), Percent: p2p_storage.NODE_OCCUPY_PERCENT})
+	if e = relay.Step(); e != nil {
+		t.Fatal(e)
+	}
+	c.step()
+	md5, _ := c.addFile(c.agents[2], 6, 10*1024)
+	want, e := c.agents[1].store.GetPiece(GID, md5)
+	if e != nil || want == nil {
+		t.Fatal("no piece on n01", e)
+	}
+
+	srcToken, dstToken, e := p2p_storage.IssueRelayTokens("r1", "n01", "client", md5)
+	if e != nil {
+		t.Fatal(e)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- c.agents[1].ServeRelay(relay.RelayAddr(), srcToken)
+	}()
+	peer := c.agents[1].Peer()
+	p, e := GetPieceViaRelay(relay.RelayAddr(), dstToken, &peer, GID, md5)
+	if e != nil || p == nil || p.Index != want.Index || !bytes.Equal(p.Data, want.Data) {
+		t.Fatalf("piece via relay: %+v %v", p, e)
+	}
+	if e = <-served; e != nil {
+		t.Fatal(e)
+	}
+	//令牌只能使用一次
+	if _, e = GetPieceViaRelay(relay.RelayAddr(), dstToken, &peer, GID, md5); e == nil {
+		t.Error("reuse relay token")
+	}
+
+	var detail p2p_storage.NodeDetail
+	for i := 0; i < 100 && detail.RelayCount == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if e = relay.Step(); e != nil {
+			t.Fatal(e)
+		}
+		details, e := p2p_storage.GetNodesByIds([]string{"r1"})
+		if e != nil || len(details) != 1 {
+			t.Fatal(details, e)
+		}
+		detail = details[0]
+	}
+	if detail.RelayCount != 1 || detail.RelayBytes <= int64(len(want.Data)) {
+		t.Errorf("relay stats: count %d, bytes %d", detail.RelayCount, detail.RelayBytes)
+	}
+}
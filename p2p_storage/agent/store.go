@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	PIECE_DIR   = "pieces"
+	FILE_DIR    = "files"
+	STATE_FILE  = "groups.json"
+	HEADER_SIZE = 10 //碎片文件头：2字节序号+8字节原始文件大小
+)
+
+//文件在分组中的一个碎片
+type Piece struct {
+	Index int    //碎片序号
+	Size  uint64 //原始文件大小
+	Data  []byte
+}
+
+/*
+	本地磁盘存储，目录结构：
+		pieces/<gid>/<md5>: 碎片
+		files/<md5>: 本节点添加的源文件
+		groups.json: 各分组的同步版本号
+*/
+type store struct {
+	dir string
+}
+
+func newStore(dir string) (s *store, e error) {
+	for _, sub := range []string{PIECE_DIR, FILE_DIR} {
+		if e = os.MkdirAll(filepath.Join(dir, sub), 0755); e != nil {
+			return
+		}
+	}
+	return &store{dir}, nil
+}
+
+//分组ID和md5会拼到路径中，不能包含路径分隔符
+func checkName(names ...string) (e error) {
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return errors.New("invalid name: " + name)
+		}
+	}
+	return
+}
+
+func (s *store) pieceFile(gid, md5 string) string {
+	return filepath.Join(s.dir, PIECE_DIR, gid, md5)
+}
+
+//写临时文件再改名，避免读到写了一半的碎片。临时文件名不重复，同时写同一个文件时互不影响
+func writeFile(name string, data []byte) (e error) {
+	if e = os.MkdirAll(filepath.Dir(name), 0755); e != nil {
+		return
+	}
+	f, e := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if e != nil {
+		return
+	}
+	_, e = f.Write(data)
+	if err := f.Close(); e == nil {
+		e = err
+	}
+	if e == nil {
+		e = os.Chmod(f.Name(), 0644)
+	}
+	if e == nil {
+		e = os.Rename(f.Name(), name)
+	}
+	if e != nil {
+		os.Remove(f.Name())
+	}
+	return
+}
+
+//碎片不存在时返回nil,nil
+func (s *store) GetPiece(gid, md5 string) (p *Piece, e error) {
+	if e = checkName(gid, md5); e != nil {
+		return
+	}
+	b, e := ioutil.ReadFile(s.pieceFile(gid, md5))
+	if os.IsNotExist(e) {
+		return nil, nil
+	}
+	if e != nil {
+		return
+	}
+	if len(b) < HEADER_SIZE {
+		return nil, errors.New("invalid piece file of " + gid + "/" + md5)
+	}
+	return &Piece{int(binary.BigEndian.Uint16(b)), binary.BigEndian.Uint64(b[2:]), b[HEADER_SIZE:]}, nil
+}
+
+//碎片文件中的数据，用于读取碎片的一段
+type pieceReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (r *pieceReader) Close() error {
+	return r.f.Close()
+}
+
+//只读取碎片文件头，数据用r按需读取，用完后需要关闭r。碎片不存在时返回nil,nil,nil
+func (s *store) OpenPiece(gid, md5 string) (p *Piece, r *pieceReader, e error) {
+	if e = checkName(gid, md5); e != nil {
+		return
+	}
+	f, e := os.Open(s.pieceFile(gid, md5))
+	if os.IsNotExist(e) {
+		return nil, nil, nil
+	}
+	if e != nil {
+		return
+	}
+	fi, e := f.Stat()
+	if e != nil {
+		f.Close()
+		return nil, nil, e
+	}
+	var header [HEADER_SIZE]byte
+	if fi.Size() < HEADER_SIZE {
+		e = errors.New("invalid piece file of " + gid + "/" + md5)
+	} else {
+		_, e = io.ReadFull(f, header[:])
+	}
+	if e != nil {
+		f.Close()
+		return nil, nil, e
+	}
+	p = &Piece{Index: int(binary.BigEndian.Uint16(header[:])), Size: binary.BigEndian.Uint64(header[2:])}
+	return p, &pieceReader{io.NewSectionReader(f, HEADER_SIZE, fi.Size()-HEADER_SIZE), f}, nil
+}
+
+func (s *store) PutPiece(gid, md5 string, p *Piece) (e error) {
+	if e = checkName(gid, md5); e != nil {
+		return
+	}
+	b := make([]byte, HEADER_SIZE+len(p.Data))
+	binary.BigEndian.PutUint16(b, uint16(p.Index))
+	binary.BigEndian.PutUint64(b[2:], p.Size)
+	copy(b[HEADER_SIZE:], p.Data)
+	return writeFile(s.pieceFile(gid, md5), b)
+}
+
+func (s *store) HasPiece(gid, md5 string) bool {
+	if checkName(gid, md5) != nil {
+		return false
+	}
+	_, e := os.Stat(s.pieceFile(gid, md5))
+	return e == nil
+}
+
+func (s *store) DeletePiece(gid, md5 string) (e error) {
+	if e = checkName(gid, md5); e != nil {
+		return
+	}
+	if e = os.Remove(s.pieceFile(gid, md5)); os.IsNotExist(e) {
+		e = nil
+	}
+	return
+}
+
+func (s *store) DeleteGroup(gid string) (e error) {
+	if e = checkName(gid); e != nil {
+		return
+	}
+	return os.RemoveAll(filepath.Join(s.dir, PIECE_DIR, gid))
+}
+
+//源文件不存在时返回nil,nil
+func (s *store) GetFile(md5 string) (data []byte, e error) {
+	if e = checkName(md5); e != nil {
+		return
+	}
+	data, e = ioutil.ReadFile(filepath.Join(s.dir, FILE_DIR, md5))
+	if os.IsNotExist(e) {
+		return nil, nil
+	}
+	return
+}
+
+func (s *store) PutFile(md5 string, data []byte) (e error) {
+	if e = checkName(md5); e != nil {
+		return
+	}
+	return writeFile(filepath.Join(s.dir, FILE_DIR, md5), data)
+}
+
+//已占用的空间
+func (s *store) Used() (size int64) {
+	filepath.Walk(s.dir, func(path string, info os.FileInfo, e error) error {
+		if e == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+func (s *store) LoadVersions() (vers map[string]uint64, e error) {
+	vers = make(map[string]uint64)
+	b, e := ioutil.ReadFile(filepath.Join(s.dir, STATE_FILE))
+	if os.IsNotExist(e) {
+		return vers, nil
+	}
+	if e != nil {
+		return
+	}
+	e = json.Unmarshal(b, &vers)
+	return
+}
+
+func (s *store) SaveVersions(vers map[string]uint64) (e error) {
+	b, e := json.Marshal(vers)
+	if e != nil {
+		return
+	}
+	return writeFile(filepath.Join(s.dir, STATE_FILE), b)
+}
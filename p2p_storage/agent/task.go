@@ -0,0 +1,278 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"yh_pkg/algorithm/erasure"
+	"yh_pkg/p2p_storage"
+)
+
+/*
+	从文件所在分组的节点获取碎片并拼回文件
+
+	参数：
+		c: 协调服务
+		md5: 文件的md5或文件ID
+	返回值：
+		data: 文件内容，已经按md5或文件ID校验过
+*/
+func Fetch(c Coordinator, md5 string) (data []byte, e error) {
+	md5 = fileKey(c, md5)
+	nodes, group, _, e := c.Download(md5)
+	if e != nil {
+		return
+	}
+	if group == nil {
+		return nil, errors.New("file " + md5 + " not found")
+	}
+	return fetchFromPeers(nodes, group, md5)
+}
+
+//碎片按存储中的标识保存，用另一种标识获取时先查找对应关系。协调服务不支持文件ID（版本8之前）时按原标识获取
+func fileKey(c Coordinator, id string) string {
+	b, e := c.GetFileIDBinding(id)
+	if e != nil || b == nil {
+		if key, _, err := p2p_storage.NormalizeFileID(id); err == nil {
+			return key
+		}
+		return id
+	}
+	return b.Key
+}
+
+//从冷存储获取文件，同时按md5或文件ID校验
+func FetchCold(s p2p_storage.IObjectStore, md5sum string) (data []byte, e error) {
+	if data, e = s.Get(p2p_storage.ColdKey(md5sum)); e != nil {
+		return
+	}
+	if !p2p_storage.VerifyFileID(md5sum, data) {
+		return nil, errors.New("fetch " + md5sum + " from cold store: hash mismatch")
+	}
+	return
+}
+
+func fetchFromPeers(peers []p2p_storage.Peer, group *p2p_storage.Group, md5sum string) (data []byte, e error) {
+	coder, e := erasure.New(int(group.MinPieces), int(group.PerfectPieces))
+	if e != nil {
+		return
+	}
+	shards := make(map[int][]byte, group.MinPieces)
+	var size uint64
+	for i := 0; i < len(peers) && len(shards) < int(group.MinPieces); i++ {
+		p, e := getPiece(&peers[i], group.ID, md5sum, false)
+		if e != nil || p == nil || p.Index >= coder.TotalShards() {
+			continue
+		}
+		if _, ok := shards[p.Index]; !ok {
+			shards[p.Index] = p.Data
+			size = p.Size
+		}
+	}
+	if data, e = coder.Decode(shards, int(size)); e != nil {
+		return nil, fmt.Errorf("fetch %s: %v", md5sum, e)
+	}
+	if !p2p_storage.VerifyFileID(md5sum, data) {
+		return nil, errors.New("fetch " + md5sum + ": hash mismatch")
+	}
+	return
+}
+
+func result(e error) int8 {
+	if e != nil {
+		return int8(p2p_storage.NO)
+	}
+	return int8(p2p_storage.YES)
+}
+
+//执行扩散任务
+func (a *Agent) expand(id uint64) (e error) {
+	nodes, file, group, exNode, e := a.c.GetExpandTaskById(id)
+	if e != nil {
+		return
+	}
+	e = a.spread(group, file, nodes, exNode.TransType, func(pieces map[string]int) (map[string]string, error) {
+		return a.c.IssuePieceTokens(a.conf.ID, id, pieces)
+	})
+	finish := a.c.ExpandFinished
+	if file.IsNewAdd() {
+		finish = a.c.P2PExpandFinished
+	}
+	if err := finish(id, result(e)); err != nil && e == nil {
+		e = err
+	}
+	return
+}
+
+//执行危险文件任务：保证本节点有该文件的碎片
+func (a *Agent) unsafeExpand(id uint64) (e error) {
+	exNode, file, group, e := a.c.GetUnSafeExpandTaskById(id)
+	if e != nil || exNode == nil {
+		return
+	}
+	if file == nil || group == nil || file.State == p2p_storage.DELETED {
+		return a.c.UnSafeExpandFinished(id, p2p_storage.YES)
+	}
+	if !a.store.HasPiece(group.ID, file.MD5) {
+		e = a.spread(group, file, []string{a.conf.ID}, p2p_storage.EXPAND_TRANS_TYPE_BOTH, nil)
+	}
+	if err := a.c.UnSafeExpandFinished(id, int(result(e))); err != nil && e == nil {
+		e = err
+	}
+	return
+}
+
+/*
+	获取文件内容：优先使用本地的源文件，否则按传输方式从冷存储获取或从其他节点拼回。
+	本地源文件损坏时汇报无效文件。
+
+	参数：
+		tp: 传输方式，EXPAND_TRANS_TYPE_OSS优先使用冷存储，EXPAND_TRANS_TYPE_BOTH从其他节点拼回失败时使用冷存储
+*/
+func (a *Agent) source(file *p2p_storage.GroupFile, tp int8) (data []byte, e error) {
+	data, e = a.store.GetFile(file.MD5)
+	if e != nil {
+		return
+	}
+	if data == nil {
+		return a.fetch(file.MD5, tp)
+	}
+	if !p2p_storage.VerifyFileID(file.MD5, data) || uint64(len(data)) != file.Size {
+		if err := a.c.InvalidFile(a.conf.ID, file.Group, file.MD5); err != nil {
+			a.logger.AppendObj(err, "InvalidFile failed", file.Group, file.MD5)
+		}
+		return nil, errors.New("source file " + file.MD5 + " is broken")
+	}
+	return
+}
+
+func (a *Agent) fetch(md5sum string, tp int8) (data []byte, e error) {
+	cold := a.conf.Cold
+	if cold == nil || tp == p2p_storage.EXPAND_TRANS_TYPE_NODE {
+		return Fetch(a.c, md5sum)
+	}
+	if tp == p2p_storage.EXPAND_TRANS_TYPE_OSS {
+		if data, e = FetchCold(cold, md5sum); e == nil {
+			return
+		}
+		a.logger.AppendObj(e, "fetch from cold store failed", md5sum)
+		return Fetch(a.c, md5sum)
+	}
+	if data, e = Fetch(a.c, md5sum); e == nil {
+		return
+	}
+	a.logger.AppendObj(e, "fetch from peers failed", md5sum)
+	return FetchCold(cold, md5sum)
+}
+
+/*
+	生成碎片并分发给nodes中的节点（可以包含本节点），nodes中不在线的节点跳过。
+	已经有碎片的节点不再分发，新碎片优先使用分组中还没有的序号。
+
+	参数：
+		issue: 按接收端ID -> 碎片序号获取推送碎片的令牌（接收端ID -> 令牌），只在需要推送给其他节点时调用，只给本节点时可以为nil
+*/
+func (a *Agent) spread(group *p2p_storage.Group, file *p2p_storage.GroupFile, nodes []string, tp int8, issue func(map[string]int) (map[string]string, error)) (e error) {
+	if len(nodes) == 0 {
+		return
+	}
+	coder, e := erasure.New(int(group.MinPieces), int(group.PerfectPieces))
+	if e != nil {
+		return
+	}
+	targets := make([]p2p_storage.Peer, 0, len(nodes))
+	others := make([]string, 0, len(nodes))
+	for _, nid := range nodes {
+		if nid == a.conf.ID {
+			targets = append(targets, a.Peer())
+		} else {
+			others = append(others, nid)
+		}
+	}
+	online, e := a.c.GetOnlineNodesByIds(others, time.Now().Unix()-p2p_storage.NODE_VALID_TIME)
+	if e != nil {
+		return
+	}
+	targets = append(targets, online...)
+	if len(targets) == 0 {
+		return errors.New("no online node to expand")
+	}
+
+	//已有碎片的序号
+	used := make(map[int]bool)
+	if p, _ := a.store.GetPiece(group.ID, file.MD5); p != nil {
+		used[p.Index] = true
+	}
+	holders, _, _, _ := a.c.Download(file.MD5)
+	has := map[string]bool{a.conf.ID: len(used) > 0}
+	checked := map[string]bool{a.conf.ID: true}
+	for _, peer := range append(holders, targets...) {
+		if checked[peer.ID] {
+			continue
+		}
+		checked[peer.ID] = true
+		if p, err := getPiece(&peer, group.ID, file.MD5, true); err == nil && p != nil {
+			used[p.Index] = true
+			has[peer.ID] = true
+		}
+	}
+	need := make([]p2p_storage.Peer, 0, len(targets))
+	for _, peer := range targets {
+		if !has[peer.ID] {
+			need = append(need, peer)
+		}
+	}
+	if len(need) == 0 {
+		return
+	}
+	free := make([]int, 0, coder.TotalShards())
+	for i := 0; i < coder.TotalShards(); i++ {
+		if !used[i] {
+			free = append(free, i)
+		}
+	}
+
+	//每个节点分到的碎片序号，序号用完后只能重复
+	idxs := make([]int, len(need))
+	pieces := make(map[string]int, len(need))
+	for i, peer := range need {
+		idxs[i] = i % coder.TotalShards()
+		if i < len(free) {
+			idxs[i] = free[i]
+		}
+		if peer.ID != a.conf.ID {
+			pieces[peer.ID] = idxs[i]
+		}
+	}
+	var tokens map[string]string
+	if len(pieces) > 0 {
+		if issue == nil {
+			return fmt.Errorf("no piece token to push to %d nodes", len(pieces))
+		}
+		if tokens, e = issue(pieces); e != nil {
+			return
+		}
+	}
+	data, e := a.source(file, tp)
+	if e != nil {
+		return
+	}
+	failed := 0
+	for i, peer := range need {
+		p := &Piece{idxs[i], uint64(len(data)), coder.EncodeShard(data, idxs[i])}
+		var err error
+		if peer.ID == a.conf.ID {
+			err = a.store.PutPiece(group.ID, file.MD5, p)
+		} else {
+			err = putPiece(&peer, group.ID, file.MD5, p, tokens[peer.ID])
+		}
+		if err != nil {
+			a.logger.AppendObj(err, "spread piece failed", group.ID, file.MD5, peer.ID)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("spread %s: %d of %d nodes failed", file.MD5, failed, len(need))
+	}
+	return
+}
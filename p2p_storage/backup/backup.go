@@ -0,0 +1,283 @@
+/*
+p2p_storage元数据的备份与恢复。
+
+Export从任意IDataSource导出节点、分组、分组节点（含版本号）、分组文件、扩散任务、危险任务、配置、
+自增版本号，以及数据源实现的可选存储接口中的数据（节点公钥、NAT检测结果、租户的用量配额、存储桶和对象、
+文件引用计数、生命周期策略、文件ID、文件密钥、等待中的延迟添加和扩散失败记录），Write/Read以gzip压缩的json格式读写备份文件，Restore把备份恢复到任意IDataSource，
+恢复前会先做引用完整性检查。可用于容灾以及在不同后端之间迁移数据。
+
+备份不包含：任务节点关系表（没有读取接口，扩散任务恢复后会重新生成）、问题文件记录、
+节点原始文件表、节点在线小时统计、节点历史（INodeHistoryStore）、扩散任务的状态转换记录、
+已经结束的延迟添加记录、签名使用过的nonce，以及从来没有用量和配额的租户（INamespaceStore.GetTenants中没有）的空存储桶。
+*/
+package backup
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+const (
+	FORMAT  = "p2p_storage_backup"
+	VERSION = 2 //版本2增加了可选存储接口中的数据
+
+	//分页读取的数量
+	PAGE_SIZE = 1000
+)
+
+//备份文件内容
+type Snapshot struct {
+	Format      string                         `json:"format"`
+	Version     int                            `json:"version"`
+	CreateTm    int64                          `json:"create_tm"` //备份时间，秒数
+	Nodes       []p2p_storage.NodeDetail       `json:"nodes"`
+	Groups      []GroupSnapshot                `json:"groups"`
+	ExpandNodes []p2p_storage.ExpandNode       `json:"expand_nodes"`
+	UnSafeNodes []p2p_storage.UnSafeExpandNode `json:"unsafe_nodes"`
+	Checksums   map[string]string              `json:"checksums"` //md5 -> checksum
+	Config      map[string]interface{}         `json:"config"`
+
+	//以下为可选存储接口（见stores.go）中的数据，数据源没有实现对应接口时为空，版本2
+	FileKeys       []p2p_storage.FileKey       `json:"file_keys,omitempty"` //包装后的数据密钥
+	NodeKeys       map[string][]byte           `json:"node_keys,omitempty"` //节点ID -> 公钥
+	NATs           []p2p_storage.NodeNAT       `json:"nats,omitempty"`
+	Tenants        []TenantSnapshot            `json:"tenants,omitempty"`
+	FileRefs       map[string]int64            `json:"file_refs,omitempty"` //md5 -> 对象的引用计数
+	Policies       []p2p_storage.FilePolicy    `json:"policies,omitempty"`
+	FileIDs        []p2p_storage.FileIDBinding `json:"file_ids,omitempty"`
+	Ingests        []p2p_storage.PendingIngest `json:"ingests,omitempty"` //等待中的延迟添加
+	ExpandAttempts []p2p_storage.ExpandAttempt `json:"expand_attempts,omitempty"`
+}
+
+//分组及其节点、文件
+type GroupSnapshot struct {
+	p2p_storage.Group `json:"group"`
+	FileVer           uint64                  `json:"file_ver"` //分组文件版本号（自增ID）
+	AddVer            uint64                  `json:"add_ver"`  //分组新增文件版本号（自增ID）
+	Nodes             []p2p_storage.GroupNode `json:"nodes"`
+	Files             []p2p_storage.GroupFile `json:"files"`
+}
+
+//与p2p_storage中新增文件版本的自增key保持一致
+func addVerKey(gid string) string {
+	return "add_" + gid
+}
+
+/*
+	从数据源导出全部元数据。导出过程中数据源不加锁，需要一致的备份时应先停止写入
+*/
+func Export(ds p2p_storage.IDataSource) (s *Snapshot, e error) {
+	s = &Snapshot{
+		Format:    FORMAT,
+		Version:   VERSION,
+		CreateTm:  time.Now().Unix(),
+		Checksums: make(map[string]string),
+		Config:    make(map[string]interface{}),
+	}
+	if s.Nodes, e = exportNodes(ds); e != nil {
+		return nil, e
+	}
+	if s.Groups, e = exportGroups(ds); e != nil {
+		return nil, e
+	}
+	if s.ExpandNodes, e = exportExpandNodes(ds); e != nil {
+		return nil, e
+	}
+	if s.UnSafeNodes, e = ds.GetUnSafeFileExpandNode(); e != nil {
+		return nil, e
+	}
+	for _, g := range s.Groups {
+		for _, f := range g.Files {
+			if _, ok := s.Checksums[f.MD5]; ok {
+				continue
+			}
+			checksum, e := ds.GetChecksum(f.MD5)
+			if e != nil {
+				return nil, e
+			}
+			if checksum != "" {
+				s.Checksums[f.MD5] = checksum
+			}
+		}
+	}
+	config := make(map[interface{}]interface{})
+	if e = ds.GetMapFromConfig(config); e != nil {
+		return nil, e
+	}
+	for k, v := range config {
+		s.Config[fmt.Sprint(k)] = v
+	}
+	if e = exportStores(ds, s); e != nil {
+		return nil, e
+	}
+	return
+}
+
+func exportNodes(ds p2p_storage.IDataSource) (nodes []p2p_storage.NodeDetail, e error) {
+	nodes = make([]p2p_storage.NodeDetail, 0)
+	begin := ""
+	for {
+		ids, e := ds.GetAllNode(begin)
+		if e != nil {
+			return nil, e
+		}
+		if len(ids) == 0 {
+			break
+		}
+		details, e := ds.GetNodesByIds(ids)
+		if e != nil {
+			return nil, e
+		}
+		nodes = append(nodes, details...)
+		begin = ids[len(ids)-1]
+	}
+	return
+}
+
+func exportGroups(ds p2p_storage.IDataSource) (groups []GroupSnapshot, e error) {
+	all, e := ds.GetAllGroup()
+	if e != nil {
+		return
+	}
+	groups = make([]GroupSnapshot, 0, len(all))
+	for _, g := range all {
+		gs := GroupSnapshot{Group: g}
+		if gs.FileVer, e = ds.GetIncrID(g.ID); e != nil {
+			return nil, e
+		}
+		if gs.AddVer, e = ds.GetIncrID(addVerKey(g.ID)); e != nil {
+			return nil, e
+		}
+		if gs.Nodes, e = ds.GetGroupNodes(g.ID); e != nil {
+			return nil, e
+		}
+		if gs.Files, e = exportGroupFiles(ds, g.ID, p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST); e != nil {
+			return nil, e
+		}
+		files, e := exportGroupFiles(ds, g.ID, p2p_storage.GROUPFILE_TYPE_NEW_ADD)
+		if e != nil {
+			return nil, e
+		}
+		gs.Files = append(gs.Files, files...)
+		groups = append(groups, gs)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return
+}
+
+/*
+	按版本号分页导出分组中某种类型的文件（包括已删除的），结果按(版本号, md5)排序
+
+	ListUpdatedFiles只能从某个版本号之后开始读，一页的最后一个版本号的文件可能被截断，
+	所以整页时丢弃最后一个版本号的文件，下一页从它之前的版本号开始；整页都是同一个版本号时扩大分页。
+*/
+func exportGroupFiles(ds p2p_storage.IDataSource, gid string, tp int) (files []p2p_storage.GroupFile, e error) {
+	files = make([]p2p_storage.GroupFile, 0)
+	fileVer := func(f *p2p_storage.GroupFile) uint64 {
+		if tp == p2p_storage.GROUPFILE_TYPE_NEW_ADD {
+			return f.AddVer
+		}
+		return f.Ver
+	}
+	var ver uint64
+	num := PAGE_SIZE
+	for {
+		page, e := ds.ListUpdatedFiles(gid, ver, num, tp)
+		if e != nil {
+			return nil, e
+		}
+		if len(page) < num {
+			files = append(files, page...)
+			break
+		}
+		last := fileVer(&page[len(page)-1])
+		n := len(page)
+		for n > 0 && fileVer(&page[n-1]) == last {
+			n--
+		}
+		if n == 0 {
+			num *= 2
+			continue
+		}
+		files = append(files, page[:n]...)
+		ver, num = fileVer(&page[n-1]), PAGE_SIZE
+	}
+	sort.Slice(files, func(i, j int) bool {
+		vi, vj := fileVer(&files[i]), fileVer(&files[j])
+		if vi == vj {
+			return files[i].MD5 < files[j].MD5
+		}
+		return vi < vj
+	})
+	return
+}
+
+/*
+	按(Timeout, ID)分页导出全部扩散任务
+*/
+func exportExpandNodes(ds p2p_storage.IDataSource) (exNodes []p2p_storage.ExpandNode, e error) {
+	exNodes = make([]p2p_storage.ExpandNode, 0)
+	var from, lastId int64 = math.MinInt64, 0
+	for {
+		page, e := ds.GetTimeoutExpandTask(from, math.MaxInt64, lastId, PAGE_SIZE)
+		if e != nil {
+			return nil, e
+		}
+		exNodes = append(exNodes, page...)
+		if len(page) < PAGE_SIZE {
+			break
+		}
+		last := page[len(page)-1]
+		from, lastId = last.Timeout, int64(last.ID)
+	}
+	return
+}
+
+/*
+	以gzip压缩的json格式写入备份
+*/
+func Write(w io.Writer, s *Snapshot) (e error) {
+	zw := gzip.NewWriter(w)
+	if e = json.NewEncoder(zw).Encode(s); e != nil {
+		zw.Close()
+		return
+	}
+	return zw.Close()
+}
+
+/*
+	读取Write写入的备份，格式或版本不支持时返回错误
+*/
+func Read(r io.Reader) (s *Snapshot, e error) {
+	zr, e := gzip.NewReader(r)
+	if e != nil {
+		return
+	}
+	defer zr.Close()
+	s = new(Snapshot)
+	d := json.NewDecoder(zr)
+	d.UseNumber()
+	if e = d.Decode(s); e != nil {
+		return nil, e
+	}
+	if s.Format != FORMAT {
+		return nil, errors.New("not a p2p_storage backup: format=" + s.Format)
+	}
+	if s.Version <= 0 || s.Version > VERSION {
+		return nil, fmt.Errorf("unsupported backup version %d", s.Version)
+	}
+	//数字配置项转换为字符串，utils.ToFloat64等不支持json.Number
+	for k, v := range s.Config {
+		if n, ok := v.(json.Number); ok {
+			s.Config[k] = n.String()
+		}
+	}
+	return
+}
@@ -0,0 +1,295 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/mem_source"
+)
+
+func newSource(t *testing.T) *mem_source.MemSource {
+	ds := mem_source.New()
+	tm := time.Now()
+	for _, id := range []string{"n1", "n2", "n3"} {
+		n := &p2p_storage.NodeDetail{Peer: p2p_storage.Peer{ID: id, IP: "10.0.0.1"}, UpdateTm: tm.UnixNano(), RegTm: tm.Unix(), Weight: 1.5}
+		if e := ds.AddNode(n); e != nil {
+			t.Fatal(e)
+		}
+	}
+	g := &p2p_storage.Group{ID: "g1", Size: 30, FileSize: 1024, PieceSize: 1024, MinPieces: 2, SafePieces: 3, PerfectPieces: 4, FirstFinishVer: 1}
+	ds.AddGroup(g)
+	ds.SetIncrID("g1", 2)
+	ds.SetIncrID("add_g1", 1)
+	ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n1", Ver: 2, State: p2p_storage.ONLINE})
+	ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n2", Ver: 1, State: p2p_storage.OFFLINE})
+	ds.AddFileToGroup("g1", &p2p_storage.GroupFile{File: p2p_storage.File{MD5: "m1", Size: 10}, Ver: 1, State: p2p_storage.NORMAL})
+	ds.AddFileToGroup("g1", &p2p_storage.GroupFile{File: p2p_storage.File{MD5: "m2", Size: 20}, Ver: 2, State: p2p_storage.DELETED})
+	ds.AddFileToGroup("g1", &p2p_storage.GroupFile{File: p2p_storage.File{MD5: "m3", Size: 5}, State: p2p_storage.NORMAL, Type: p2p_storage.GROUPFILE_TYPE_NEW_ADD, AddVer: 1})
+	ds.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: "n3", MD5: "m1", State: p2p_storage.EXPAND_STATE_INIT, Tm: tm.Unix(), Timeout: tm.Unix() + 60, FailedTimes: 2})
+	ds.AddOrUpdateUnSafeFile("g1", "m3")
+	ds.AddOrUpdateUnSafeExpandNodes([]p2p_storage.UnSafeExpandNode{{Group: "g1", Node: "n1", MD5: "m3", Tm: tm.Unix()}})
+	ds.UpdateChecksum("m1", "sum1")
+	ds.SetConfig(p2p_storage.OSS_SPLIT_SIZE_CONFIG_KEY, 4096)
+	ds.SetFileKey(&p2p_storage.FileKey{MD5: "m1", Tenant: "t1", KeyVer: 1, Wrapped: []byte("wrapped1")}, 0)
+
+	//可选存储中的数据
+	ds.AddNodeKey("n1", make([]byte, 32))
+	ds.SetNodeNAT(&p2p_storage.NodeNAT{Node: "n2", Type: p2p_storage.NAT_OPEN, Mapped: "1.2.3.4:5", Reachable: true, Tm: tm.Unix()})
+	ds.CreateBucket("t1", "photos")
+	ds.CreateBucket("t2", "empty")
+	ds.SetQuota("t2", p2p_storage.Quota{MaxFiles: 1})
+	ds.PutObject(&p2p_storage.Object{Tenant: "t1", Bucket: "photos", Key: "a.jpg", MD5: "m1", Size: 10, Tm: tm.Unix()})
+	ds.IncrFileRef("m1", 1)
+	ds.IncrUsage("t1", 10, 1)
+	ds.SetQuota("t1", p2p_storage.Quota{MaxBytes: 100, MaxFiles: 5})
+	ds.SetBucketPolicy("t1", "photos", &p2p_storage.Policy{TTL: 3600})
+	ds.SetFilePolicy(&p2p_storage.FilePolicy{MD5: "m1", ExpireTm: tm.Unix() + 3600})
+	ds.SetFileIDBinding(&p2p_storage.FileIDBinding{ID: "1220aa", MD5: "m1", Key: "m1"})
+	ds.AddIngest(&p2p_storage.PendingIngest{MD5: "m4", SrcNode: "n1", Size: 7, State: p2p_storage.INGEST_PENDING, AddTm: tm.Unix()})
+	ds.SetExpandAttempt(&p2p_storage.ExpandAttempt{Group: "g1", MD5: "m1", Attempts: 2, FailedNodes: []string{"n3"}})
+	return ds
+}
+
+func TestExportRestore(t *testing.T) {
+	s, e := Export(newSource(t))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if problems := s.Check(); len(problems) > 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	if len(s.Nodes) != 3 || len(s.Groups) != 1 || len(s.Groups[0].Files) != 3 || len(s.ExpandNodes) != 1 || len(s.UnSafeNodes) != 1 {
+		t.Fatalf("incomplete snapshot: %+v", s)
+	}
+
+	var buf bytes.Buffer
+	if e = Write(&buf, s); e != nil {
+		t.Fatal(e)
+	}
+	read, e := Read(&buf)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	ds := mem_source.New()
+	if e = Restore(ds, read); e != nil {
+		t.Fatal(e)
+	}
+	restored, e := Export(ds)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !reflect.DeepEqual(s.Nodes, restored.Nodes) {
+		t.Errorf("nodes differ:\n%+v\n%+v", s.Nodes, restored.Nodes)
+	}
+	if !reflect.DeepEqual(s.Groups, restored.Groups) {
+		t.Errorf("groups differ:\n%+v\n%+v", s.Groups, restored.Groups)
+	}
+	if !reflect.DeepEqual(s.Checksums, restored.Checksums) {
+		t.Errorf("checksums differ: %v %v", s.Checksums, restored.Checksums)
+	}
+	if task := restored.ExpandNodes[0]; task.Node != "n3" || task.FailedTimes != 2 || task.ID != s.ExpandNodes[0].ID {
+		t.Errorf("expand task not restored: %+v", task)
+	}
+	if task := restored.UnSafeNodes[0]; task.ID != s.UnSafeNodes[0].ID {
+		t.Errorf("unsafe task id %d, want %d", task.ID, s.UnSafeNodes[0].ID)
+	}
+	//新任务的ID不与恢复的任务重复
+	id, e := ds.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: "n1", MD5: "m1"})
+	if e != nil || uint64(id) <= s.ExpandNodes[0].ID {
+		t.Errorf("new task id %d after restore, %v", id, e)
+	}
+	for name, v := range map[string][2]interface{}{
+		"file keys":       {s.FileKeys, restored.FileKeys},
+		"node keys":       {s.NodeKeys, restored.NodeKeys},
+		"nats":            {s.NATs, restored.NATs},
+		"tenants":         {s.Tenants, restored.Tenants},
+		"file refs":       {s.FileRefs, restored.FileRefs},
+		"policies":        {s.Policies, restored.Policies},
+		"file ids":        {s.FileIDs, restored.FileIDs},
+		"ingests":         {s.Ingests, restored.Ingests},
+		"expand attempts": {s.ExpandAttempts, restored.ExpandAttempts},
+	} {
+		if reflect.ValueOf(v[0]).Len() == 0 || !reflect.DeepEqual(v[0], v[1]) {
+			t.Errorf("%s differ:\n%+v\n%+v", name, v[0], v[1])
+		}
+	}
+	if len(s.Tenants) != 2 || s.Tenants[0].Usage.Quota.MaxFiles != 5 || s.Tenants[0].Buckets[0].Policy == nil || len(s.Tenants[1].Buckets) != 1 {
+		t.Errorf("tenants = %+v", s.Tenants)
+	}
+	//新的排队号不与恢复的重复
+	if ticket, _ := ds.AddIngest(&p2p_storage.PendingIngest{MD5: "m5"}); ticket <= s.Ingests[0].Ticket {
+		t.Errorf("new ingest ticket %d after restore", ticket)
+	}
+	if v := restored.Config[p2p_storage.OSS_SPLIT_SIZE_CONFIG_KEY]; v != "4096" {
+		t.Errorf("config = %v", restored.Config)
+	}
+
+	//目标数据源不为空时拒绝恢复
+	if e = Restore(ds, read); e == nil {
+		t.Error("Restore into non-empty data source succeeded")
+	}
+}
+
+func TestRestoreKeepsTaskIds(t *testing.T) {
+	ds := newSource(t)
+	//删除第一个任务，使剩下的任务ID不从1开始
+	ds.DeleteExpandNodeById(1)
+	ds.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: "n2", MD5: "m1", Timeout: 1})
+	s, e := Export(ds)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(s.ExpandNodes) != 1 || s.ExpandNodes[0].ID != 2 {
+		t.Fatalf("expand tasks %+v", s.ExpandNodes)
+	}
+	restored := mem_source.New()
+	if e = Restore(restored, s); e != nil {
+		t.Fatal(e)
+	}
+	if task, _ := restored.GetExpandNodeById(2); task == nil || task.Node != "n2" {
+		t.Errorf("GetExpandNodeById(2) = %+v", task)
+	}
+}
+
+//数据源不能按原ID写入任务时重新分配ID，没有结束的扩散任务改为初始状态
+func TestRestoreTasksWithoutIds(t *testing.T) {
+	ds := newSource(t)
+	now := time.Now().Unix()
+	ds.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: "n2", MD5: "m1", State: p2p_storage.EXPAND_STATE_STARTED, Tm: now, Timeout: now + 600})
+	ds.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: "n1", MD5: "m1", State: p2p_storage.EXPAND_STATE_FAILED, Tm: now, Timeout: now + 600})
+	all, e := Export(ds)
+	if e != nil {
+		t.Fatal(e)
+	}
+	//只恢复IDataSource中的数据
+	s := &Snapshot{Format: all.Format, Version: all.Version, Nodes: all.Nodes, Groups: all.Groups,
+		ExpandNodes: all.ExpandNodes, UnSafeNodes: all.UnSafeNodes, Checksums: all.Checksums}
+	//第一个任务之前占用一个ID，恢复后的ID与备份中不同
+	restored := mem_source.New()
+	restored.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g0", Node: "n0", MD5: "m0"})
+	restored.DeleteExpandNode("g0", "n0", "m0")
+	if e = Restore(struct{ p2p_storage.IDataSource }{restored}, s); e != nil {
+		t.Fatal(e)
+	}
+	got, e := Export(restored)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(got.ExpandNodes) != 3 || len(got.UnSafeNodes) != 1 || got.UnSafeNodes[0].Node != "n1" {
+		t.Fatalf("tasks %+v %+v", got.ExpandNodes, got.UnSafeNodes)
+	}
+	want := map[string]int8{
+		"n3": p2p_storage.EXPAND_STATE_INIT,
+		"n2": p2p_storage.EXPAND_STATE_INIT,
+		"n1": p2p_storage.EXPAND_STATE_FAILED,
+	}
+	for _, task := range got.ExpandNodes {
+		if task.State != want[task.Node] || task.Timeout <= now {
+			t.Errorf("task of %s: %+v", task.Node, task)
+		}
+		if task.Node == "n3" && (task.ID != 2 || task.FailedTimes != 2) {
+			t.Errorf("task of n3: %+v", task)
+		}
+	}
+}
+
+func TestExportSameVersion(t *testing.T) {
+	ds := mem_source.New()
+	ds.AddGroup(&p2p_storage.Group{ID: "g1", FileSize: 1024, MinPieces: 2})
+	ds.SetIncrID("g1", 3)
+	//分页边界上的文件版本号相同，整页都是同一个版本号时扩大分页
+	n := 0
+	for _, cnt := range []int{PAGE_SIZE - 1, PAGE_SIZE + 5, 3} {
+		n++
+		for i := 0; i < cnt; i++ {
+			md5 := fmt.Sprintf("v%d-%05d", n, i)
+			ds.AddFileToGroup("g1", &p2p_storage.GroupFile{File: p2p_storage.File{MD5: md5, Size: 1}, Ver: uint64(n), State: p2p_storage.NORMAL})
+		}
+	}
+	files, e := exportGroupFiles(ds, "g1", p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(files) != 2*PAGE_SIZE+7 {
+		t.Fatalf("exported %d files, want %d", len(files), 2*PAGE_SIZE+7)
+	}
+	seen := make(map[string]bool, len(files))
+	for i, f := range files {
+		if seen[f.MD5] {
+			t.Fatalf("file %s exported twice", f.MD5)
+		}
+		seen[f.MD5] = true
+		if i > 0 && (files[i-1].Ver > f.Ver || files[i-1].Ver == f.Ver && files[i-1].MD5 > f.MD5) {
+			t.Fatalf("files not sorted at %d", i)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s, e := Export(newSource(t))
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.Nodes = s.Nodes[1:] //删除n1
+	s.Groups[0].Files[0].Ver = 100
+	problems := s.Check()
+	want := []string{"unknown node n1", "ver 100 > file_ver 2", "unsafe task 1: unknown node n1"}
+	for _, w := range want {
+		found := false
+		for _, p := range problems {
+			if strings.Contains(p, w) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("problem %q not reported in %v", w, problems)
+		}
+	}
+	ds := mem_source.New()
+	if e = Restore(ds, s); e == nil {
+		t.Fatal("Restore of invalid backup succeeded")
+	}
+	if groups, _ := ds.GetAllGroup(); len(groups) != 0 {
+		t.Error("Restore wrote data after check failed")
+	}
+}
+
+//备份中有可选存储的数据时，不支持对应接口的数据源拒绝恢复，且不写入任何数据
+func TestRestoreStoresUnsupported(t *testing.T) {
+	s, e := Export(newSource(t))
+	if e != nil {
+		t.Fatal(e)
+	}
+	ms := mem_source.New()
+	ds := &plainSource{ms, ms}
+	if e = Restore(ds, s); e == nil || !strings.Contains(e.Error(), "can not restore") {
+		t.Fatalf("Restore = %v", e)
+	}
+	if groups, _ := ds.GetAllGroup(); len(groups) != 0 {
+		t.Error("Restore wrote data to unsupported data source")
+	}
+}
+
+//只实现IDataSource和TaskRestorer的数据源
+type plainSource struct {
+	p2p_storage.IDataSource
+	TaskRestorer
+}
+
+func TestReadInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	if e := Write(&buf, &Snapshot{Format: FORMAT, Version: VERSION + 1}); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := Read(&buf); e == nil {
+		t.Error("Read accepted unsupported version")
+	}
+	if _, e := Read(strings.NewReader("not gzip")); e == nil {
+		t.Error("Read accepted invalid data")
+	}
+}
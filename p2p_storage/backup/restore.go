@@ -0,0 +1,300 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"yh_pkg/p2p_storage"
+)
+
+//可以直接设置自增ID的数据源，如mem_source.MemSource
+type IncrIDSetter interface {
+	SetIncrID(key string, id uint64) error
+}
+
+//可以写入配置的数据源，如mem_source.MemSource
+type ConfigSetter interface {
+	SetConfig(key string, value interface{}) error
+}
+
+//可以按原ID写入任务的数据源，如mem_source.MemSource。节点按任务ID上报进度，恢复后ID不变时已经下发的任务仍然有效
+type TaskRestorer interface {
+	RestoreExpandNode(exNode *p2p_storage.ExpandNode) error
+	RestoreUnSafeExpandNode(exNode *p2p_storage.UnSafeExpandNode) error
+}
+
+//错误信息中最多列出的问题数量
+const MAX_REPORT_PROBLEMS = 10
+
+/*
+	检查备份的引用完整性，返回发现的问题，没有问题时返回空列表
+*/
+func (s *Snapshot) Check() (problems []string) {
+	problems = make([]string, 0)
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	nodes := make(map[string]bool, len(s.Nodes))
+	for _, n := range s.Nodes {
+		if n.ID == "" {
+			add("node with empty id")
+		} else if nodes[n.ID] {
+			add("duplicated node %s", n.ID)
+		}
+		nodes[n.ID] = true
+	}
+
+	groups := make(map[string]bool, len(s.Groups))
+	files := make(map[string]bool) //gid + md5
+	for _, g := range s.Groups {
+		if g.ID == "" {
+			add("group with empty id")
+		} else if groups[g.ID] {
+			add("duplicated group %s", g.ID)
+		}
+		groups[g.ID] = true
+		if g.FirstFinishVer > g.FileVer {
+			add("group %s: first_finish_ver %d > file_ver %d", g.ID, g.FirstFinishVer, g.FileVer)
+		}
+		members := make(map[string]bool, len(g.Nodes))
+		for _, n := range g.Nodes {
+			if !nodes[n.Node] {
+				add("group %s: unknown node %s", g.ID, n.Node)
+			}
+			if members[n.Node] {
+				add("group %s: duplicated node %s", g.ID, n.Node)
+			}
+			members[n.Node] = true
+			if n.Ver > g.FileVer {
+				add("group %s: node %s ver %d > file_ver %d", g.ID, n.Node, n.Ver, g.FileVer)
+			}
+		}
+		for _, f := range g.Files {
+			if f.Group != g.ID {
+				add("group %s: file %s belongs to group %s", g.ID, f.MD5, f.Group)
+			}
+			if files[g.ID+"/"+f.MD5] {
+				add("group %s: duplicated file %s", g.ID, f.MD5)
+			}
+			files[g.ID+"/"+f.MD5] = true
+			if f.Ver > g.FileVer {
+				add("group %s: file %s ver %d > file_ver %d", g.ID, f.MD5, f.Ver, g.FileVer)
+			}
+			if f.Type == p2p_storage.GROUPFILE_TYPE_NEW_ADD && f.AddVer > g.AddVer {
+				add("group %s: file %s add_ver %d > add_ver %d", g.ID, f.MD5, f.AddVer, g.AddVer)
+			}
+		}
+	}
+
+	tasks := make(map[string]bool, len(s.ExpandNodes))
+	ids := make(map[uint64]bool, len(s.ExpandNodes))
+	for _, t := range s.ExpandNodes {
+		key := t.Group + "/" + t.Node + "/" + t.MD5
+		if tasks[key] {
+			add("duplicated expand task %s", key)
+		}
+		tasks[key] = true
+		if t.ID == 0 {
+			add("expand task %s without id", key)
+		} else if ids[t.ID] {
+			add("duplicated expand task id %d", t.ID)
+		}
+		ids[t.ID] = true
+		if !groups[t.Group] {
+			add("expand task %d: unknown group %s", t.ID, t.Group)
+		} else if !files[t.Group+"/"+t.MD5] {
+			add("expand task %d: file %s not in group %s", t.ID, t.MD5, t.Group)
+		}
+		if !nodes[t.Node] {
+			add("expand task %d: unknown node %s", t.ID, t.Node)
+		}
+	}
+
+	tasks = make(map[string]bool, len(s.UnSafeNodes))
+	ids = make(map[uint64]bool, len(s.UnSafeNodes))
+	for _, t := range s.UnSafeNodes {
+		key := t.Group + "/" + t.Node + "/" + t.MD5
+		if tasks[key] {
+			add("duplicated unsafe task %s", key)
+		}
+		tasks[key] = true
+		if t.ID == 0 {
+			add("unsafe task %s without id", key)
+		} else if ids[t.ID] {
+			add("duplicated unsafe task id %d", t.ID)
+		}
+		ids[t.ID] = true
+		if !groups[t.Group] {
+			add("unsafe task %d: unknown group %s", t.ID, t.Group)
+		} else if !files[t.Group+"/"+t.MD5] {
+			add("unsafe task %d: file %s not in group %s", t.ID, t.MD5, t.Group)
+		}
+		if !nodes[t.Node] {
+			add("unsafe task %d: unknown node %s", t.ID, t.Node)
+		}
+	}
+	s.checkStores(nodes, files, add)
+	return
+}
+
+/*
+	把备份恢复到数据源中
+
+	恢复前先做引用完整性检查，有问题时不写入任何数据；目标数据源必须没有节点和分组。
+	数据源实现TaskRestorer时扩散任务和危险任务保留原ID；否则通过IDataSource重新分配ID，节点手中的任务ID失效，
+	没有结束的扩散任务改为初始状态重新下发（见restoreExpandNode）。备份中有可选存储的数据时
+	数据源必须实现对应的接口，延迟添加还需要实现IngestRestorer。数据源没有实现IncrIDSetter时通过
+	AtomicIncrID递增到备份中的版本号；没有实现ConfigSetter时不恢复配置。
+
+	参数：
+		ds: 目标数据源
+		s: 备份
+	返回值：
+*/
+func Restore(ds p2p_storage.IDataSource, s *Snapshot) (e error) {
+	if problems := s.Check(); len(problems) > 0 {
+		if len(problems) > MAX_REPORT_PROBLEMS {
+			problems = append(problems[:MAX_REPORT_PROBLEMS], fmt.Sprintf("and %d more", len(problems)-MAX_REPORT_PROBLEMS))
+		}
+		return errors.New("backup check failed: " + strings.Join(problems, "; "))
+	}
+	if e = checkEmpty(ds); e != nil {
+		return
+	}
+	restorer, _ := ds.(TaskRestorer)
+	if e = s.checkStoreSupport(ds); e != nil {
+		return
+	}
+
+	for i := range s.Nodes {
+		if e = ds.AddNode(&s.Nodes[i]); e != nil {
+			return
+		}
+	}
+	for i := range s.Groups {
+		if e = restoreGroup(ds, &s.Groups[i]); e != nil {
+			return
+		}
+	}
+	for i := range s.ExpandNodes {
+		if e = restoreExpandNode(ds, restorer, &s.ExpandNodes[i]); e != nil {
+			return
+		}
+	}
+	unsafeFiles := make(map[string]bool)
+	for i, t := range s.UnSafeNodes {
+		if !unsafeFiles[t.Group+"/"+t.MD5] {
+			unsafeFiles[t.Group+"/"+t.MD5] = true
+			if e = ds.AddOrUpdateUnSafeFile(t.Group, t.MD5); e != nil {
+				return
+			}
+		}
+		if e = restoreUnSafeExpandNode(ds, restorer, &s.UnSafeNodes[i]); e != nil {
+			return
+		}
+	}
+	for md5, checksum := range s.Checksums {
+		if e = ds.UpdateChecksum(md5, checksum); e != nil {
+			return
+		}
+	}
+	if e = restoreStores(ds, s); e != nil {
+		return
+	}
+	if setter, ok := ds.(ConfigSetter); ok {
+		for k, v := range s.Config {
+			if e = setter.SetConfig(k, v); e != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/*
+	恢复扩散任务。restorer为nil时按(gid, nid, md5)添加，重新分配ID，已经下发的任务不能再按旧ID上报，
+	所以没有结束的任务改为初始状态，等源节点下次心跳时按新ID下发
+*/
+func restoreExpandNode(ds p2p_storage.IDataSource, restorer TaskRestorer, exNode *p2p_storage.ExpandNode) (e error) {
+	if restorer != nil {
+		return restorer.RestoreExpandNode(exNode)
+	}
+	n := *exNode
+	n.ID = 0
+	if !n.IsFinished() {
+		n.State, n.Timeout = p2p_storage.EXPAND_STATE_INIT, p2p_storage.CalculateExpandNodeTimeout(p2p_storage.EXPAND_STATE_INIT)
+	}
+	_, e = ds.AddOrUpdateExpandNode(&n)
+	return
+}
+
+//恢复危险任务，restorer为nil时重新分配ID
+func restoreUnSafeExpandNode(ds p2p_storage.IDataSource, restorer TaskRestorer, exNode *p2p_storage.UnSafeExpandNode) (e error) {
+	if restorer != nil {
+		return restorer.RestoreUnSafeExpandNode(exNode)
+	}
+	n := *exNode
+	n.ID = 0
+	return ds.AddOrUpdateUnSafeExpandNodes([]p2p_storage.UnSafeExpandNode{n})
+}
+
+func checkEmpty(ds p2p_storage.IDataSource) (e error) {
+	groups, e := ds.GetAllGroup()
+	if e != nil {
+		return
+	}
+	if len(groups) > 0 {
+		return fmt.Errorf("data source is not empty: %d groups", len(groups))
+	}
+	nodes, e := ds.GetAllNode("")
+	if e != nil {
+		return
+	}
+	if len(nodes) > 0 {
+		return errors.New("data source is not empty: has nodes")
+	}
+	return
+}
+
+func restoreGroup(ds p2p_storage.IDataSource, g *GroupSnapshot) (e error) {
+	if e = setIncrID(ds, g.ID, g.FileVer); e != nil {
+		return
+	}
+	if e = setIncrID(ds, addVerKey(g.ID), g.AddVer); e != nil {
+		return
+	}
+	if e = ds.AddGroup(&g.Group); e != nil {
+		return
+	}
+	for i := range g.Nodes {
+		if e = ds.AddNodeToGroup(g.ID, &g.Nodes[i]); e != nil {
+			return
+		}
+	}
+	for i := range g.Files {
+		if e = ds.AddFileToGroup(g.ID, &g.Files[i]); e != nil {
+			return
+		}
+	}
+	return
+}
+
+func setIncrID(ds p2p_storage.IDataSource, key string, id uint64) (e error) {
+	if setter, ok := ds.(IncrIDSetter); ok {
+		return setter.SetIncrID(key, id)
+	}
+	cur, e := ds.GetIncrID(key)
+	if e != nil {
+		return
+	}
+	if cur > id {
+		return fmt.Errorf("incr id %s is %d, larger than %d in backup", key, cur, id)
+	}
+	for ; cur < id; cur++ {
+		if _, e = ds.AtomicIncrID(key); e != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,449 @@
+package backup
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sort"
+	"yh_pkg/p2p_storage"
+)
+
+/*
+	可选存储接口中的数据。数据源通过p2p_storage.SupportsStore判断是否支持某个接口，包装其他数据源的
+	（如migrate.DualWrite）只有被包装的数据源支持时才导出。按文件的数据（引用计数、策略、文件ID、扩散失败记录）
+	按分组文件、对象和延迟添加中出现的文件读取。
+*/
+
+//可以按原排队号写入延迟添加的数据源，如mem_source.MemSource。客户端按排队号查询结果，恢复后排队号必须不变
+type IngestRestorer interface {
+	RestoreIngest(p *p2p_storage.PendingIngest) error
+}
+
+//租户的用量、配额和存储桶
+type TenantSnapshot struct {
+	Usage   p2p_storage.Usage `json:"usage"`
+	Buckets []BucketSnapshot  `json:"buckets"`
+}
+
+type BucketSnapshot struct {
+	Name    string               `json:"name"`
+	Policy  *p2p_storage.Policy  `json:"policy,omitempty"` //存储桶的默认策略
+	Objects []p2p_storage.Object `json:"objects"`
+}
+
+func exportStores(ds p2p_storage.IDataSource, s *Snapshot) (e error) {
+	has := func(store interface{}) bool { return p2p_storage.SupportsStore(ds, store) }
+	md5s := make(map[string]bool)
+	for _, g := range s.Groups {
+		for _, f := range g.Files {
+			md5s[f.MD5] = true
+		}
+	}
+
+	if has((*p2p_storage.INodeKeyStore)(nil)) {
+		s.NodeKeys = make(map[string][]byte)
+		for _, n := range s.Nodes {
+			key, e := ds.(p2p_storage.INodeKeyStore).GetNodeKey(n.ID)
+			if e != nil {
+				return e
+			}
+			if key != nil {
+				s.NodeKeys[n.ID] = key
+			}
+		}
+	}
+	if has((*p2p_storage.INATStore)(nil)) {
+		s.NATs = make([]p2p_storage.NodeNAT, 0)
+		for i := 0; i < len(s.Nodes); i += PAGE_SIZE {
+			ids := make([]string, 0, PAGE_SIZE)
+			for j := i; j < len(s.Nodes) && j < i+PAGE_SIZE; j++ {
+				ids = append(ids, s.Nodes[j].ID)
+			}
+			nats, e := ds.(p2p_storage.INATStore).GetNodeNATs(ids)
+			if e != nil {
+				return e
+			}
+			for _, id := range ids {
+				if n, ok := nats[id]; ok && n != nil {
+					s.NATs = append(s.NATs, *n)
+				}
+			}
+		}
+	}
+	if has((*p2p_storage.INamespaceStore)(nil)) {
+		if s.Tenants, e = exportTenants(ds, has((*p2p_storage.IPolicyStore)(nil))); e != nil {
+			return
+		}
+		for _, t := range s.Tenants {
+			for _, b := range t.Buckets {
+				for _, obj := range b.Objects {
+					md5s[obj.MD5] = true
+				}
+			}
+		}
+	}
+	if has((*p2p_storage.IIngestStore)(nil)) {
+		s.Ingests = make([]p2p_storage.PendingIngest, 0)
+		var after uint64
+		for {
+			page, e := ds.(p2p_storage.IIngestStore).GetPendingIngests(after, PAGE_SIZE)
+			if e != nil {
+				return e
+			}
+			for _, p := range page {
+				md5s[p.MD5] = true
+			}
+			s.Ingests = append(s.Ingests, page...)
+			if len(page) < PAGE_SIZE {
+				break
+			}
+			after = page[len(page)-1].Ticket
+		}
+	}
+
+	keys := make([]string, 0, len(md5s))
+	for md5 := range md5s {
+		keys = append(keys, md5)
+	}
+	sort.Strings(keys)
+	if has((*p2p_storage.INamespaceStore)(nil)) {
+		s.FileRefs = make(map[string]int64)
+		for _, md5 := range keys {
+			refs, e := ds.(p2p_storage.INamespaceStore).GetFileRef(md5)
+			if e != nil {
+				return e
+			}
+			if refs > 0 {
+				s.FileRefs[md5] = refs
+			}
+		}
+	}
+	if has((*p2p_storage.IPolicyStore)(nil)) {
+		s.Policies = make([]p2p_storage.FilePolicy, 0)
+		for _, md5 := range keys {
+			p, e := ds.(p2p_storage.IPolicyStore).GetFilePolicy(md5)
+			if e != nil {
+				return e
+			}
+			if p != nil {
+				s.Policies = append(s.Policies, *p)
+			}
+		}
+	}
+	if has((*p2p_storage.IFileIDStore)(nil)) {
+		if s.FileIDs, e = exportFileIDs(ds.(p2p_storage.IFileIDStore), keys); e != nil {
+			return
+		}
+	}
+	if has((*p2p_storage.IExpandStateStore)(nil)) {
+		s.ExpandAttempts = make([]p2p_storage.ExpandAttempt, 0)
+		for _, g := range s.Groups {
+			for _, f := range g.Files {
+				a, e := ds.(p2p_storage.IExpandStateStore).GetExpandAttempt(g.ID, f.MD5)
+				if e != nil {
+					return e
+				}
+				if a != nil {
+					s.ExpandAttempts = append(s.ExpandAttempts, *a)
+				}
+			}
+		}
+	}
+	if has((*p2p_storage.IFileKeyStore)(nil)) {
+		if s.FileKeys, e = exportFileKeys(ds.(p2p_storage.IFileKeyStore), s.Tenants, keys); e != nil {
+			return
+		}
+	}
+	return
+}
+
+//INamespaceStore.GetTenants中的租户，按租户、存储桶排序
+func exportTenants(ds p2p_storage.IDataSource, policy bool) (tenants []TenantSnapshot, e error) {
+	ns := ds.(p2p_storage.INamespaceStore)
+	names, e := ns.GetTenants()
+	if e != nil {
+		return
+	}
+	sort.Strings(names)
+	tenants = make([]TenantSnapshot, 0, len(names))
+	for _, name := range names {
+		t := TenantSnapshot{Buckets: make([]BucketSnapshot, 0)}
+		if t.Usage, e = ns.GetUsage(name); e != nil {
+			return nil, e
+		}
+		t.Usage.Tenant = name
+		buckets, e := ns.GetBuckets(name)
+		if e != nil {
+			return nil, e
+		}
+		sort.Strings(buckets)
+		for _, bucket := range buckets {
+			b := BucketSnapshot{Name: bucket, Objects: make([]p2p_storage.Object, 0)}
+			if policy {
+				if b.Policy, e = ds.(p2p_storage.IPolicyStore).GetBucketPolicy(name, bucket); e != nil {
+					return nil, e
+				}
+			}
+			from := ""
+			for {
+				page, e := ns.GetObjects(name, bucket, from, PAGE_SIZE)
+				if e != nil {
+					return nil, e
+				}
+				b.Objects = append(b.Objects, page...)
+				if len(page) < PAGE_SIZE {
+					break
+				}
+				from = page[len(page)-1].Key
+			}
+			t.Buckets = append(t.Buckets, b)
+		}
+		tenants = append(tenants, t)
+	}
+	return
+}
+
+//文件的标识可能是md5也可能是文件ID，两种方式都查找，按文件ID去重
+func exportFileIDs(store p2p_storage.IFileIDStore, md5s []string) (bindings []p2p_storage.FileIDBinding, e error) {
+	bindings = make([]p2p_storage.FileIDBinding, 0)
+	ids := make(map[string]bool)
+	for _, md5 := range md5s {
+		for _, get := range []func(string) (*p2p_storage.FileIDBinding, error){store.GetFileIDBinding, store.GetFileIDByMD5} {
+			b, e := get(md5)
+			if e != nil {
+				return nil, e
+			}
+			if b != nil && !ids[b.ID] {
+				ids[b.ID] = true
+				bindings = append(bindings, *b)
+			}
+		}
+	}
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].ID < bindings[j].ID })
+	return
+}
+
+/*
+	按租户分页导出文件密钥，结果按(租户, md5)排序。租户来自tenants，以及文件已有密钥的租户
+*/
+func exportFileKeys(ks p2p_storage.IFileKeyStore, tenants []TenantSnapshot, md5s []string) (keys []p2p_storage.FileKey, e error) {
+	names := make(map[string]bool)
+	for _, t := range tenants {
+		names[t.Usage.Tenant] = true
+	}
+	for _, md5 := range md5s {
+		key, e := ks.GetFileKey(md5)
+		if e != nil {
+			return nil, e
+		}
+		if key != nil {
+			names[key.Tenant] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for t := range names {
+		sorted = append(sorted, t)
+	}
+	sort.Strings(sorted)
+	keys = make([]p2p_storage.FileKey, 0)
+	for _, t := range sorted {
+		from := ""
+		for {
+			page, e := ks.GetFileKeys(t, from, PAGE_SIZE)
+			if e != nil {
+				return nil, e
+			}
+			keys = append(keys, page...)
+			if len(page) < PAGE_SIZE {
+				break
+			}
+			from = page[len(page)-1].MD5
+		}
+	}
+	return
+}
+
+//检查可选存储中的数据，nodes为备份中的节点，files为备份中的分组文件（gid + "/" + md5）
+func (s *Snapshot) checkStores(nodes, files map[string]bool, add func(format string, args ...interface{})) {
+	for nid, key := range s.NodeKeys {
+		if !nodes[nid] {
+			add("node key of unknown node %s", nid)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			add("node key of %s has %d bytes", nid, len(key))
+		}
+	}
+	for _, n := range s.NATs {
+		if !nodes[n.Node] {
+			add("nat of unknown node %s", n.Node)
+		}
+	}
+	tenants := make(map[string]bool, len(s.Tenants))
+	for _, t := range s.Tenants {
+		if t.Usage.Tenant == "" || tenants[t.Usage.Tenant] {
+			add("empty or duplicated tenant %q", t.Usage.Tenant)
+		}
+		tenants[t.Usage.Tenant] = true
+		buckets := make(map[string]bool, len(t.Buckets))
+		for _, b := range t.Buckets {
+			if buckets[b.Name] {
+				add("tenant %s: duplicated bucket %s", t.Usage.Tenant, b.Name)
+			}
+			buckets[b.Name] = true
+			for _, obj := range b.Objects {
+				if obj.Tenant != t.Usage.Tenant || obj.Bucket != b.Name {
+					add("object %s/%s/%s in bucket %s/%s", obj.Tenant, obj.Bucket, obj.Key, t.Usage.Tenant, b.Name)
+				}
+				if obj.MD5 == "" {
+					add("object %s/%s/%s without md5", obj.Tenant, obj.Bucket, obj.Key)
+				}
+			}
+		}
+	}
+	for md5, refs := range s.FileRefs {
+		if refs <= 0 {
+			add("file %s: refs %d", md5, refs)
+		}
+	}
+	for _, b := range s.FileIDs {
+		if b.ID == "" || b.MD5 == "" || b.Key == "" {
+			add("invalid file id binding %+v", b)
+		}
+	}
+	keys := make(map[string]bool, len(s.FileKeys))
+	for _, k := range s.FileKeys {
+		if k.MD5 == "" || k.Tenant == "" || k.KeyVer == 0 || len(k.Wrapped) == 0 {
+			add("invalid file key of %s", k.MD5)
+		} else if keys[k.MD5] {
+			add("duplicated file key %s", k.MD5)
+		}
+		keys[k.MD5] = true
+	}
+	tickets := make(map[uint64]bool, len(s.Ingests))
+	for _, p := range s.Ingests {
+		if p.Ticket == 0 || tickets[p.Ticket] {
+			add("ingest of %s: zero or duplicated ticket %d", p.MD5, p.Ticket)
+		}
+		tickets[p.Ticket] = true
+	}
+	for _, a := range s.ExpandAttempts {
+		if !files[a.Group+"/"+a.MD5] {
+			add("expand attempt: file %s not in group %s", a.MD5, a.Group)
+		}
+	}
+}
+
+//备份中有数据的可选存储，目标数据源必须都支持，在写入任何数据之前检查
+func (s *Snapshot) checkStoreSupport(ds p2p_storage.IDataSource) (e error) {
+	buckets := 0
+	for _, t := range s.Tenants {
+		buckets += len(t.Buckets)
+		for _, b := range t.Buckets {
+			if b.Policy != nil && !p2p_storage.SupportsStore(ds, (*p2p_storage.IPolicyStore)(nil)) {
+				return errors.New("data source can not restore bucket policies")
+			}
+		}
+	}
+	for _, c := range []struct {
+		name  string
+		num   int
+		store interface{}
+	}{
+		{"node keys", len(s.NodeKeys), (*p2p_storage.INodeKeyStore)(nil)},
+		{"nats", len(s.NATs), (*p2p_storage.INATStore)(nil)},
+		{"tenants", len(s.Tenants), (*p2p_storage.INamespaceStore)(nil)},
+		{"file refs", len(s.FileRefs), (*p2p_storage.INamespaceStore)(nil)},
+		{"policies", len(s.Policies), (*p2p_storage.IPolicyStore)(nil)},
+		{"file ids", len(s.FileIDs), (*p2p_storage.IFileIDStore)(nil)},
+		{"file keys", len(s.FileKeys), (*p2p_storage.IFileKeyStore)(nil)},
+		{"ingests", len(s.Ingests), (*p2p_storage.IIngestStore)(nil)},
+		{"ingests", len(s.Ingests), (*IngestRestorer)(nil)},
+		{"expand attempts", len(s.ExpandAttempts), (*p2p_storage.IExpandStateStore)(nil)},
+	} {
+		if c.num > 0 && !p2p_storage.SupportsStore(ds, c.store) {
+			return fmt.Errorf("data source can not restore %d %s", c.num, c.name)
+		}
+	}
+	return
+}
+
+func restoreStores(ds p2p_storage.IDataSource, s *Snapshot) (e error) {
+	for nid, key := range s.NodeKeys {
+		ok, e := ds.(p2p_storage.INodeKeyStore).AddNodeKey(nid, key)
+		if e != nil {
+			return e
+		}
+		if !ok {
+			return errors.New("node key of " + nid + " already exists")
+		}
+	}
+	for i := range s.NATs {
+		if e = ds.(p2p_storage.INATStore).SetNodeNAT(&s.NATs[i]); e != nil {
+			return
+		}
+	}
+	for _, t := range s.Tenants {
+		ns := ds.(p2p_storage.INamespaceStore)
+		u := t.Usage
+		if e = ns.IncrUsage(u.Tenant, int64(u.Bytes), int64(u.Files)); e != nil {
+			return
+		}
+		if e = ns.SetQuota(u.Tenant, u.Quota); e != nil {
+			return
+		}
+		for _, b := range t.Buckets {
+			if _, e = ns.CreateBucket(u.Tenant, b.Name); e != nil {
+				return
+			}
+			if b.Policy != nil {
+				if e = ds.(p2p_storage.IPolicyStore).SetBucketPolicy(u.Tenant, b.Name, b.Policy); e != nil {
+					return
+				}
+			}
+			for i := range b.Objects {
+				if e = ns.PutObject(&b.Objects[i]); e != nil {
+					return
+				}
+			}
+		}
+	}
+	for md5, refs := range s.FileRefs {
+		if _, e = ds.(p2p_storage.INamespaceStore).IncrFileRef(md5, refs); e != nil {
+			return
+		}
+	}
+	for i := range s.Policies {
+		if e = ds.(p2p_storage.IPolicyStore).SetFilePolicy(&s.Policies[i]); e != nil {
+			return
+		}
+	}
+	for i := range s.FileIDs {
+		ok, e := ds.(p2p_storage.IFileIDStore).SetFileIDBinding(&s.FileIDs[i])
+		if e != nil {
+			return e
+		}
+		if !ok {
+			return errors.New("file id " + s.FileIDs[i].ID + " already bound")
+		}
+	}
+	for i := range s.FileKeys {
+		ok, e := ds.(p2p_storage.IFileKeyStore).SetFileKey(&s.FileKeys[i], 0)
+		if e != nil {
+			return e
+		}
+		if !ok {
+			return errors.New("file key of " + s.FileKeys[i].MD5 + " already exists")
+		}
+	}
+	for i := range s.Ingests {
+		if e = ds.(IngestRestorer).RestoreIngest(&s.Ingests[i]); e != nil {
+			return
+		}
+	}
+	for i := range s.ExpandAttempts {
+		if e = ds.(p2p_storage.IExpandStateStore).SetExpandAttempt(&s.ExpandAttempts[i]); e != nil {
+			return
+		}
+	}
+	return
+}
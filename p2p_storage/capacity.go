@@ -0,0 +1,243 @@
+package p2p_storage
+
+import (
+	"fmt"
+	"strings"
+	"yh_pkg/log"
+	"yh_pkg/service"
+	"yh_pkg/time"
+	"yh_pkg/trace"
+)
+
+/*
+	容量预测和准入控制。
+	检测服务定期汇总在线节点的LeftP2pSpace，作为节点CAPACITY_HISTORY_NODE的样本保存到节点历史记录中，
+	按最近capacity_forecast_hours小时的样本线性拟合剩余空间的变化，估计用完的时间。
+	AddP2PFile找不到有空闲GROUP_NODE_CAPACITY的节点时，按admission_mode配置决定拒绝、让调用方稍后重试或者转存到冷存储。
+*/
+const (
+	ADMISSION_REJECT   = 0 //拒绝，返回ERR_P2P_NO_CAPACITY
+	ADMISSION_QUEUE    = 1 //设置了延迟添加队列时进入队列，否则返回ERR_P2P_CAPACITY_RETRY，调用方等待创建分组后重试
+	ADMISSION_REDIRECT = 2 //设置了冷存储时返回ColdRedirectError，调用方把文件上传到冷存储的Key，否则同ADMISSION_REJECT
+)
+
+//集群容量样本在节点历史记录中使用的节点ID
+const CAPACITY_HISTORY_NODE = "#cluster"
+
+//ADMISSION_QUEUE时建议调用方重试的间隔（秒），与createNewGroups的检测间隔一致
+const ADMISSION_RETRY_SECONDS = 60
+
+type CapacityStatus struct {
+	Tm             int64  `json:"tm"`
+	Nodes          int    `json:"nodes"`              //在线节点数
+	AvailableNodes int    `json:"available_nodes"`    //剩余空间不少于GROUP_NODE_CAPACITY的在线节点数
+	TotalSpace     int64  `json:"total_space"`        //在线节点用于p2p的空间之和
+	LeftSpace      int64  `json:"left_space"`         //在线节点的LeftP2pSpace之和
+	LeftPercent    int64  `json:"left_percent"`       //LeftSpace占TotalSpace的百分比
+	FileSize       uint32 `json:"file_size"`          //分组剩余空间最少的文件尺寸范围
+	GroupLeftSpace uint64 `json:"group_left_space"`   //该尺寸范围分组的剩余空间，见groupLeftSpace
+	NeedNewGroup   bool   `json:"need_new_group"`     //GroupLeftSpace低于CREATE_NEWGROUP_BALANCE_RATIO，createNewGroups会创建分组
+	Rate           int64  `json:"rate"`               //LeftSpace每小时的变化，负数表示在减少
+	ExhaustHours   int64  `json:"exhaust_hours"`      //按Rate估计LeftSpace用完的小时数，-1表示不减少或样本不足
+	Warning        string `json:"warning,omitempty"`
+}
+
+/*
+	可用分组中剩余空间最少的文件尺寸范围及其剩余空间，与createNewGroups的判断一致
+
+	参数：
+		groupCapacity: 分组的容量（字节）
+	返回值：
+		left: GetActiveGroupsLeftSpace中该尺寸范围的值，没有可用分组时为0
+*/
+func (ds *DataSource) groupLeftSpace(groupCapacity uint64) (file_size uint32, left uint64, e error) {
+	spaces, e := ds.Raw.GetActiveGroupsLeftSpace(groupCapacity)
+	if e != nil {
+		return
+	}
+	file_size = MinFileSize(spaces)
+	left = spaces[file_size]
+	return
+}
+
+//createNewGroups中剩余空间低于CREATE_NEWGROUP_BALANCE_RATIO时创建新分组
+func needNewGroup(left uint64) bool {
+	return left < uint64(CREATE_NEWGROUP_BALANCE_RATIO)
+}
+
+//在线节点的空间汇总
+func (ds *DataSource) sumNodeSpace(s *CapacityStatus) (e error) {
+	updateTm := time.Now.Unix() - NODE_VALID_TIME
+	for begin := ""; ; {
+		ids, e := ds.Raw.GetAllNode(begin)
+		if e != nil {
+			return e
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		begin = ids[len(ids)-1]
+		nodes, e := ds.Raw.GetNodesByIds(ids)
+		if e != nil {
+			return e
+		}
+		for _, n := range nodes {
+			if n.UpdateTm/1e9 < updateTm {
+				continue
+			}
+			s.Nodes++
+			s.TotalSpace += int64(n.TotalSpace * uint64(n.Percent) / 100)
+			s.LeftSpace += n.LeftP2pSpace
+			if n.LeftP2pSpace >= int64(GROUP_NODE_CAPACITY) {
+				s.AvailableNodes++
+			}
+		}
+	}
+}
+
+/*
+	线性拟合剩余空间的变化
+
+	参数：
+		samples: 按时间排序的样本
+		left: 当前剩余空间
+	返回值：
+		rate: 每小时的变化
+		hours: 按rate估计left用完的小时数，rate不小于0或者样本不足两个时间点时为-1
+*/
+func forecastCapacity(samples []NodeSample, left int64) (rate int64, hours int64) {
+	hours = -1
+	n := float64(len(samples))
+	if n < 2 || samples[0].Tm == samples[len(samples)-1].Tm {
+		return
+	}
+	//以第一个样本为原点，避免平方和溢出精度
+	var sx, sy, sxx, sxy float64
+	for _, s := range samples {
+		x := float64(s.Tm-samples[0].Tm) / 3600
+		y := float64(s.LeftSpace)
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	slope := (n*sxy - sx*sy) / (n*sxx - sx*sx)
+	rate = int64(slope)
+	if rate < 0 {
+		hours = left / -rate
+	}
+	return
+}
+
+//空间不足时的告警，没有时为空
+func capacityWarning(s *CapacityStatus) string {
+	warns := make([]string, 0)
+	if percent := getConfigInt64(CAPACITY_WARN_PERCENT_KEY, DEFAULT_CAPACITY_WARN_PERCENT); s.TotalSpace > 0 && s.LeftPercent < percent {
+		warns = append(warns, fmt.Sprintf("free space %d%% is under %d%%", s.LeftPercent, percent))
+	}
+	if hours := getConfigInt64(CAPACITY_WARN_HOURS_KEY, DEFAULT_CAPACITY_WARN_HOURS); s.ExhaustHours >= 0 && s.ExhaustHours < hours {
+		warns = append(warns, fmt.Sprintf("free space will run out in %d hours", s.ExhaustHours))
+	}
+	if s.NeedNewGroup && s.AvailableNodes == 0 {
+		warns = append(warns, fmt.Sprintf("groups of file_size %d have %d left and no node can create a new group", s.FileSize, s.GroupLeftSpace))
+	}
+	return strings.Join(warns, "; ")
+}
+
+/*
+	集群当前的容量、预测和告警。没有设置节点历史记录的存储时不预测，ExhaustHours为-1
+*/
+func GetCapacityStatus() (s *CapacityStatus, e error) {
+	return WithSpan(nil).GetCapacityStatus()
+}
+
+func (c Caller) GetCapacityStatus() (s *CapacityStatus, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.GetCapacityStatus")
+	defer span.End(&e)
+	s = &CapacityStatus{Tm: time.Now.Unix(), ExhaustHours: -1}
+	if e = source.sumNodeSpace(s); e != nil {
+		return nil, e
+	}
+	if s.TotalSpace > 0 {
+		s.LeftPercent = s.LeftSpace * 100 / s.TotalSpace
+	}
+	g := GROUP_CONFIG[2]
+	if s.FileSize, s.GroupLeftSpace, e = source.groupLeftSpace(uint64(g.MinPieces) * GROUP_NODE_CAPACITY); e != nil {
+		return nil, e
+	}
+	s.NeedNewGroup = needNewGroup(s.GroupLeftSpace)
+	if historyStore != nil {
+		hours := getConfigInt64(CAPACITY_FORECAST_HOURS_KEY, DEFAULT_CAPACITY_FORECAST_HOURS)
+		samples, e := historyStore.GetNodeSamples(CAPACITY_HISTORY_NODE, s.Tm-hours*3600, s.Tm+1)
+		if e != nil {
+			return nil, e
+		}
+		s.Rate, s.ExhaustHours = forecastCapacity(samples, s.LeftSpace)
+	}
+	s.Warning = capacityWarning(s)
+	return
+}
+
+//记录集群容量样本，有告警时写日志
+func CheckCapacity() (s *CapacityStatus, e error) {
+	span := trace.Begin("p2p_storage.CheckCapacity")
+	defer span.End(&e)
+	if s, e = WithSpan(span).GetCapacityStatus(); e != nil {
+		return
+	}
+	if historyStore != nil {
+		sample := &NodeSample{Node: CAPACITY_HISTORY_NODE, Tm: nodeHistoryBucket(s.Tm), Span: NODE_HISTORY_RESOLUTION, Count: 1, LeftSpace: s.LeftSpace}
+		if e = historyStore.AddNodeSample(sample); e != nil {
+			return
+		}
+	}
+	if s.Warning != "" {
+		logger.Append("-CheckCapacity- "+s.Warning, log.WARN)
+	}
+	return
+}
+
+/*
+	ADMISSION_REDIRECT时添加文件返回的错误，错误码为ERR_P2P_REDIRECT_COLD。
+	文件没有加入p2p系统，调用方把文件上传到冷存储的Key后可以从冷存储下载
+*/
+type ColdRedirectError struct {
+	Err service.Error
+	Key string //冷存储中的对象名，见ColdKey
+}
+
+func (e *ColdRedirectError) Error() string {
+	return e.Err.Error()
+}
+
+/*
+	从添加文件返回的错误中取出冷存储的对象名
+
+	返回值：
+		ok: e为ColdRedirectError时为true
+*/
+func RedirectColdKey(e error) (key string, ok bool) {
+	r, ok := e.(*ColdRedirectError)
+	if !ok {
+		return "", false
+	}
+	return r.Key, true
+}
+
+/*
+	找不到有空闲GROUP_NODE_CAPACITY的节点时，按admission_mode返回的错误
+
+	参数：
+		md5: 文件md5
+*/
+func admissionError(md5 string) (e error) {
+	mode := getConfigInt64(ADMISSION_MODE_KEY, DEFAULT_ADMISSION_MODE)
+	logger.AppendObj(nil, "-AddP2PFile-no available node, admission_mode:", mode, md5)
+	switch {
+	case mode == ADMISSION_QUEUE:
+		return service.NewError(service.ERR_P2P_CAPACITY_RETRY, fmt.Sprintf("not available node can use, retry after %d seconds", ADMISSION_RETRY_SECONDS))
+	case mode == ADMISSION_REDIRECT && coldStore != nil:
+		return &ColdRedirectError{service.NewError(service.ERR_P2P_REDIRECT_COLD, "not available node can use, upload file to cold store"), ColdKey(md5)}
+	}
+	return service.NewSimpleError(service.ERR_P2P_NO_CAPACITY, "not available node can use")
+}
@@ -0,0 +1,102 @@
+package p2p_storage_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/history"
+	"yh_pkg/p2p_storage/oss"
+	"yh_pkg/service"
+)
+
+//只有n00在线，剩余2个分组容量，最近两小时每小时减少1个分组容量
+func TestCapacity(t *testing.T) {
+	f := newFixture(t)
+	f.setSpace("n00", 10*p2p_storage.GROUP_NODE_CAPACITY, 2*p2p_storage.GROUP_NODE_CAPACITY)
+	store := history.NewMemStore()
+	p2p_storage.SetNodeHistoryStore(store)
+	defer p2p_storage.SetNodeHistoryStore(nil)
+	now := time.Now().Unix()
+	for i := int64(1); i <= 2; i++ {
+		s := &p2p_storage.NodeSample{Node: p2p_storage.CAPACITY_HISTORY_NODE, Tm: now - i*3600, Span: p2p_storage.NODE_HISTORY_RESOLUTION, Count: 1, LeftSpace: int64(uint64(2+i) * p2p_storage.GROUP_NODE_CAPACITY)}
+		store.AddNodeSample(s)
+	}
+
+	s, e := p2p_storage.CheckCapacity()
+	if e != nil || s.Nodes != 1 || s.AvailableNodes != 1 || s.LeftPercent != 20 || s.ExhaustHours != 2 || !strings.Contains(s.Warning, "run out") {
+		t.Errorf("CheckCapacity: %+v %v", s, e)
+	}
+	if samples, _ := store.GetNodeSamples(p2p_storage.CAPACITY_HISTORY_NODE, now-3*3600, now+1); len(samples) != 3 {
+		t.Errorf("samples: %+v", samples)
+	}
+
+	//与createNewGroups相同，按剩余空间最少的文件尺寸范围判断是否需要创建分组，没有分组的尺寸范围剩余空间为0
+	if s.FileSize != 1 || s.GroupLeftSpace != 0 || !s.NeedNewGroup {
+		t.Errorf("no group of file_size 1: %+v", s)
+	}
+	capacity := uint64(p2p_storage.GROUP_CONFIG[2].MinPieces) * p2p_storage.GROUP_NODE_CAPACITY
+	for i := uint32(1); i <= 4; i++ {
+		f.ds.AddGroup(&p2p_storage.Group{ID: fmt.Sprintf("fs%d", i), FileSize: i, PieceSize: 1024, MinPieces: 4, SafePieces: 6, PerfectPieces: NODE_NUM})
+	}
+	if s, e = p2p_storage.GetCapacityStatus(); e != nil || s.GroupLeftSpace != capacity || s.NeedNewGroup {
+		t.Errorf("empty groups: %+v %v", s, e)
+	}
+	g, _ := f.ds.GetGroup("fs3")
+	f.ds.UpdateGroupSize(g, int64(capacity)-10)
+	if s, e = p2p_storage.GetCapacityStatus(); e != nil || s.FileSize != 3 || s.GroupLeftSpace != 10 || !s.NeedNewGroup {
+		t.Errorf("full group: %+v %v", s, e)
+	}
+}
+
+//没有可以添加文件的节点时按admission_mode处理
+func TestAdmission(t *testing.T) {
+	newFixture(t)
+	defer p2p_storage.ConfigMap.ConfigValue.Set(p2p_storage.ADMISSION_MODE_KEY, p2p_storage.DEFAULT_ADMISSION_MODE)
+	add := func(mode int64, md5 string) error {
+		p2p_storage.ConfigMap.ConfigValue.Set(p2p_storage.ADMISSION_MODE_KEY, mode)
+		_, e := p2p_storage.AddP2PFile(md5, "n01", 10, 0, false)
+		return e
+	}
+	for _, c := range []struct {
+		mode int64
+		md5  string
+		code uint
+	}{
+		{p2p_storage.ADMISSION_REJECT, "00000000000000000000000000000001", service.ERR_P2P_NO_CAPACITY},
+		{p2p_storage.ADMISSION_QUEUE, "00000000000000000000000000000002", service.ERR_P2P_INGEST_QUEUED}, //mem数据源实现了延迟添加队列
+		{p2p_storage.ADMISSION_REDIRECT, "00000000000000000000000000000003", service.ERR_P2P_NO_CAPACITY}, //没有设置冷存储
+	} {
+		if e := add(c.mode, c.md5); errCode(e) != c.code {
+			t.Errorf("admission_mode %d: %v", c.mode, e)
+		}
+	}
+
+	dir, e := ioutil.TempDir("", "p2p_storage")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	cold, e := oss.NewLocalStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	p2p_storage.SetColdStore(cold)
+	defer p2p_storage.SetColdStore(nil)
+	const md5 = "00000000000000000000000000000004"
+	e = add(p2p_storage.ADMISSION_REDIRECT, md5)
+	if key, ok := p2p_storage.RedirectColdKey(e); !ok || key != p2p_storage.ColdKey(md5) {
+		t.Errorf("admission_mode redirect with cold store: %q %v", key, e)
+	}
+	if ok, _ := p2p_storage.IsExists(md5); ok {
+		t.Error("redirected file added")
+	}
+
+	p2p_storage.SetIngestStore(nil)
+	if e = add(p2p_storage.ADMISSION_QUEUE, "00000000000000000000000000000005"); errCode(e) != service.ERR_P2P_CAPACITY_RETRY {
+		t.Errorf("admission_mode queue without ingest store: %v", e)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+IDataSource的故障注入包装，用于验证AddP2PFile、GenPiece、ExpandFinished等多次写入、没有事务保护的流程
+在部分失败后系统不变量仍然成立。
+
+可以按方法配置三种故障：调用前的延时、不执行调用直接返回错误、执行调用后仍返回错误（模拟写入成功但响应丢失）。
+概率由带种子的随机数决定，配合Skip和Times可以精确地在第N次调用时注入故障。
+
+	c := chaos.New(ds, 1)
+	c.SetFault("UpdateGroupSize", chaos.Fault{AppliedRate: 1, Times: 1})
+	p2p_storage.Init(c, logger, false)
+	...
+	c.ClearFaults()
+	if problems := chaos.NewInvariants(ds).Check(); len(problems) > 0 {
+		...
+	}
+*/
+package chaos
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+//对所有没有单独配置的方法生效的故障
+const ALL_METHODS = "*"
+
+//注入的错误
+type Error struct {
+	Method  string
+	Applied bool //调用是否已经执行
+}
+
+func (e *Error) Error() string {
+	if e.Applied {
+		return fmt.Sprintf("chaos: %s applied but error injected", e.Method)
+	}
+	return fmt.Sprintf("chaos: %s error injected", e.Method)
+}
+
+//是否是注入的错误
+func IsInjected(e error) bool {
+	_, ok := e.(*Error)
+	return ok
+}
+
+type Fault struct {
+	Latency     time.Duration //每次调用前的延时
+	ErrorRate   float64       //不执行调用直接返回错误的概率，0-1
+	AppliedRate float64       //执行调用后仍返回错误的概率，0-1
+	Skip        int           //前Skip次调用不注入错误
+	Times       int           //最多注入错误的次数，0表示不限
+}
+
+type rule struct {
+	Fault
+	calls    int
+	injected int
+}
+
+type Chaos struct {
+	ds p2p_storage.IDataSource
+
+	lock  sync.Mutex
+	rand  *rand.Rand
+	rules map[string]*rule
+}
+
+/*
+	创建故障注入数据源，初始不注入任何故障
+
+	参数：
+		ds: 被包装的数据源
+		seed: 随机数种子，相同的种子和调用顺序注入的故障相同
+*/
+func New(ds p2p_storage.IDataSource, seed int64) *Chaos {
+	return &Chaos{ds: ds, rand: rand.New(rand.NewSource(seed)), rules: make(map[string]*rule)}
+}
+
+/*
+	设置方法的故障，会重置该方法的调用计数
+
+	参数：
+		method: IDataSource的方法名，ALL_METHODS表示所有没有单独配置的方法
+		f: 故障配置
+*/
+func (c *Chaos) SetFault(method string, f Fault) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rules[method] = &rule{Fault: f}
+}
+
+//清除所有故障
+func (c *Chaos) ClearFaults() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rules = make(map[string]*rule)
+}
+
+/*
+	获取方法已经注入错误的次数，method为ALL_METHODS时返回通用配置注入的次数
+*/
+func (c *Chaos) Injected(method string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if r, ok := c.rules[method]; ok {
+		return r.injected
+	}
+	return 0
+}
+
+//决定本次调用注入的故障
+func (c *Chaos) roll(method string) (latency time.Duration, before, after bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	r, ok := c.rules[method]
+	if !ok {
+		if r, ok = c.rules[ALL_METHODS]; !ok {
+			return
+		}
+	}
+	r.calls++
+	latency = r.Latency
+	if r.calls <= r.Skip || (r.Times > 0 && r.injected >= r.Times) {
+		return
+	}
+	if r.ErrorRate > 0 && c.rand.Float64() < r.ErrorRate {
+		before = true
+	} else if r.AppliedRate > 0 && c.rand.Float64() < r.AppliedRate {
+		after = true
+	}
+	if before || after {
+		r.injected++
+	}
+	return
+}
+
+func (c *Chaos) call(method string, op func() error) (e error) {
+	latency, before, after := c.roll(method)
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if before {
+		return &Error{Method: method}
+	}
+	if e = op(); e != nil {
+		return
+	}
+	if after {
+		return &Error{Method: method, Applied: true}
+	}
+	return
+}
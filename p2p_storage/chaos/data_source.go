@@ -0,0 +1,714 @@
+package chaos
+
+import (
+	"errors"
+	"yh_pkg/p2p_storage"
+)
+
+/*
+	获取锁失败也作为错误处理：注入执行前的错误时不获取锁，注入执行后的错误时已经获取了锁但返回false，
+	锁只能等到过期后释放
+*/
+func (c *Chaos) GetLock(db int, key string, expireSec int64, timeout int64) (getLock bool) {
+	e := c.call("GetLock", func() (e error) {
+		if getLock = c.ds.GetLock(db, key, expireSec, timeout); !getLock {
+			e = errors.New("get lock failed")
+		}
+		return
+	})
+	return e == nil
+}
+
+func (c *Chaos) AtomicIncrID(key string) (id uint64, e error) {
+	e = c.call("AtomicIncrID", func() (e error) {
+		id, e = c.ds.AtomicIncrID(key)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetIncrID(key string) (id uint64, e error) {
+	e = c.call("GetIncrID", func() (e error) {
+		id, e = c.ds.GetIncrID(key)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetTimeoutNodeCheckedTime() (tm int64, e error) {
+	e = c.call("GetTimeoutNodeCheckedTime", func() (e error) {
+		tm, e = c.ds.GetTimeoutNodeCheckedTime()
+		return
+	})
+	return
+}
+
+func (c *Chaos) UpdateTimeoutNodeCheckedTime(tm int64) (e error) {
+	return c.call("UpdateTimeoutNodeCheckedTime", func() error { return c.ds.UpdateTimeoutNodeCheckedTime(tm) })
+}
+
+func (c *Chaos) GetFileGroups(md5 string, state int) (files map[string]p2p_storage.GroupFile, e error) {
+	e = c.call("GetFileGroups", func() (e error) {
+		files, e = c.ds.GetFileGroups(md5, state)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetNewAddTimeOutGroupFile(tm int64, num int) (files []p2p_storage.GroupFile, e error) {
+	e = c.call("GetNewAddTimeOutGroupFile", func() (e error) {
+		files, e = c.ds.GetNewAddTimeOutGroupFile(tm, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetSourceFileNodes(md5 string, num int) (ids []string, e error) {
+	e = c.call("GetSourceFileNodes", func() (e error) {
+		ids, e = c.ds.GetSourceFileNodes(md5, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) IsNodeHasFile(nid string, md5 string) (yes bool, e error) {
+	e = c.call("IsNodeHasFile", func() (e error) {
+		yes, e = c.ds.IsNodeHasFile(nid, md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetSourceFileCount(md5 string) (count int, e error) {
+	e = c.call("GetSourceFileCount", func() (e error) {
+		count, e = c.ds.GetSourceFileCount(md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetOnlinePeers(ids []string, timeout int64) (peers []p2p_storage.Peer, e error) {
+	e = c.call("GetOnlinePeers", func() (e error) {
+		peers, e = c.ds.GetOnlinePeers(ids, timeout)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetFileByMd5AndState(md5 string, state int) (files []p2p_storage.GroupFile, e error) {
+	e = c.call("GetFileByMd5AndState", func() (e error) {
+		files, e = c.ds.GetFileByMd5AndState(md5, state)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetGroupFile(gid, md5 string) (file *p2p_storage.GroupFile, e error) {
+	e = c.call("GetGroupFile", func() (e error) {
+		file, e = c.ds.GetGroupFile(gid, md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) ListUpdatedFiles(gid string, ver uint64, num int, tp int) (files []p2p_storage.GroupFile, e error) {
+	e = c.call("ListUpdatedFiles", func() (e error) {
+		files, e = c.ds.ListUpdatedFiles(gid, ver, num, tp)
+		return
+	})
+	return
+}
+
+func (c *Chaos) CalculateGroupSize(gid string) (e error) {
+	return c.call("CalculateGroupSize", func() error { return c.ds.CalculateGroupSize(gid) })
+}
+
+func (c *Chaos) GetFileGroupsCount(md5 string) (count int, e error) {
+	e = c.call("GetFileGroupsCount", func() (e error) {
+		count, e = c.ds.GetFileGroupsCount(md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetMoreFileGroupsCount(md5s []string) (m map[string]bool, e error) {
+	e = c.call("GetMoreFileGroupsCount", func() (e error) {
+		m, e = c.ds.GetMoreFileGroupsCount(md5s)
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddFileToGroup(gid string, file *p2p_storage.GroupFile) (e error) {
+	return c.call("AddFileToGroup", func() error { return c.ds.AddFileToGroup(gid, file) })
+}
+
+func (c *Chaos) UpdateGroupFile(gid string, file *p2p_storage.GroupFile) (e error) {
+	return c.call("UpdateGroupFile", func() error { return c.ds.UpdateGroupFile(gid, file) })
+}
+
+func (c *Chaos) UpdateGroupFileTpAndVer(gid, md5 string, ver uint64) (e error) {
+	return c.call("UpdateGroupFileTpAndVer", func() error { return c.ds.UpdateGroupFileTpAndVer(gid, md5, ver) })
+}
+
+func (c *Chaos) DeleteGroupFile(gid string, md5 string) (e error) {
+	return c.call("DeleteGroupFile", func() error { return c.ds.DeleteGroupFile(gid, md5) })
+}
+
+func (c *Chaos) IncrFileVer(gid string, md5 string, ver uint64) (e error) {
+	return c.call("IncrFileVer", func() error { return c.ds.IncrFileVer(gid, md5, ver) })
+}
+
+func (c *Chaos) GetTimeoutNodes(from int64, to int64, num int) (nodes []p2p_storage.NodeDetail, e error) {
+	e = c.call("GetTimeoutNodes", func() (e error) {
+		nodes, e = c.ds.GetTimeoutNodes(from, to, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddNode(node *p2p_storage.NodeDetail) (e error) {
+	return c.call("AddNode", func() error { return c.ds.AddNode(node) })
+}
+
+func (c *Chaos) DeleteNode(id string) (e error) {
+	return c.call("DeleteNode", func() error { return c.ds.DeleteNode(id) })
+}
+
+func (c *Chaos) IsNodeExist(nid string) (exist bool, e error) {
+	e = c.call("IsNodeExist", func() (e error) {
+		exist, e = c.ds.IsNodeExist(nid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) UpdateNode(node *p2p_storage.NodeDetail) (e error) {
+	return c.call("UpdateNode", func() error { return c.ds.UpdateNode(node) })
+}
+
+func (c *Chaos) UpdateNodeWeight(nid string, weight float64) (e error) {
+	return c.call("UpdateNodeWeight", func() error { return c.ds.UpdateNodeWeight(nid, weight) })
+}
+
+func (c *Chaos) GetAvailableNodes(groupCapacity uint64, updateTm, regTm int64, offset, num uint32, active_groups int8, online_cnt int) (nodes []string, e error) {
+	e = c.call("GetAvailableNodes", func() (e error) {
+		nodes, e = c.ds.GetAvailableNodes(groupCapacity, updateTm, regTm, offset, num, active_groups, online_cnt)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetAvailableNodesCount(groupCapacity uint64, updateTm, regTm int64, activ_groups int8, online_cnt int) (num uint32, e error) {
+	e = c.call("GetAvailableNodesCount", func() (e error) {
+		num, e = c.ds.GetAvailableNodesCount(groupCapacity, updateTm, regTm, activ_groups, online_cnt)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetAvailableNode(groupCapacity uint64, updateTm, regTm int64, online_cnt, num int) (nodes []string, e error) {
+	e = c.call("GetAvailableNode", func() (e error) {
+		nodes, e = c.ds.GetAvailableNode(groupCapacity, updateTm, regTm, online_cnt, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetAvailableGroup(fileSize uint32) (group *p2p_storage.Group, e error) {
+	e = c.call("GetAvailableGroup", func() (e error) {
+		group, e = c.ds.GetAvailableGroup(fileSize)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetGroup(gid string) (group *p2p_storage.Group, e error) {
+	e = c.call("GetGroup", func() (e error) {
+		group, e = c.ds.GetGroup(gid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetAllGroup() (groups map[string]p2p_storage.Group, e error) {
+	e = c.call("GetAllGroup", func() (e error) {
+		groups, e = c.ds.GetAllGroup()
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddGroup(group *p2p_storage.Group) (e error) {
+	return c.call("AddGroup", func() error { return c.ds.AddGroup(group) })
+}
+
+func (c *Chaos) UpdateGroupSize(group *p2p_storage.Group, filesize int64) (e error) {
+	return c.call("UpdateGroupSize", func() error { return c.ds.UpdateGroupSize(group, filesize) })
+}
+
+func (c *Chaos) GetActiveGroupsCount(groupCapacity uint64) (groups map[uint32]uint32, e error) {
+	e = c.call("GetActiveGroupsCount", func() (e error) {
+		groups, e = c.ds.GetActiveGroupsCount(groupCapacity)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetActiveGroupsLeftSpace(groupCapacity uint64) (groups map[uint32]uint64, e error) {
+	e = c.call("GetActiveGroupsLeftSpace", func() (e error) {
+		groups, e = c.ds.GetActiveGroupsLeftSpace(groupCapacity)
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddNodeToGroup(gid string, node *p2p_storage.GroupNode) (e error) {
+	return c.call("AddNodeToGroup", func() error { return c.ds.AddNodeToGroup(gid, node) })
+}
+
+func (c *Chaos) UpdateGroupNode(gid string, node *p2p_storage.GroupNode, isVerChange bool) (e error) {
+	return c.call("UpdateGroupNode", func() error { return c.ds.UpdateGroupNode(gid, node, isVerChange) })
+}
+
+func (c *Chaos) DeleteGroupNode(gid, nid string) (e error) {
+	return c.call("DeleteGroupNode", func() error { return c.ds.DeleteGroupNode(gid, nid) })
+}
+
+func (c *Chaos) GetFileNodes(gid string, ver uint64) (nodes []p2p_storage.Peer, e error) {
+	e = c.call("GetFileNodes", func() (e error) {
+		nodes, e = c.ds.GetFileNodes(gid, ver)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetNoFileNodes(gid string, ver uint64) (nodes []string, e error) {
+	e = c.call("GetNoFileNodes", func() (e error) {
+		nodes, e = c.ds.GetNoFileNodes(gid, ver)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetAllFileNodes(gid string) (nodes []string, e error) {
+	e = c.call("GetAllFileNodes", func() (e error) {
+		nodes, e = c.ds.GetAllFileNodes(gid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetGroupNodes(gid string) (nodes []p2p_storage.GroupNode, e error) {
+	e = c.call("GetGroupNodes", func() (e error) {
+		nodes, e = c.ds.GetGroupNodes(gid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetRandomGroupNode(gid string) (node *p2p_storage.GroupNode, e error) {
+	e = c.call("GetRandomGroupNode", func() (e error) {
+		node, e = c.ds.GetRandomGroupNode(gid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetNodeDetail(nid string) (detail *p2p_storage.NodeDetail, e error) {
+	e = c.call("GetNodeDetail", func() (e error) {
+		detail, e = c.ds.GetNodeDetail(nid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetNodeGroups(nid string) (groups []p2p_storage.Group, e error) {
+	e = c.call("GetNodeGroups", func() (e error) {
+		groups, e = c.ds.GetNodeGroups(nid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetRandomNodeGroup(nid string) (group p2p_storage.Group, e error) {
+	e = c.call("GetRandomNodeGroup", func() (e error) {
+		group, e = c.ds.GetRandomNodeGroup(nid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetNodeGroupCount(nid string) (num uint32, e error) {
+	e = c.call("GetNodeGroupCount", func() (e error) {
+		num, e = c.ds.GetNodeGroupCount(nid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetNodeGroupDetail(nid string) (groups []p2p_storage.NodeGroupDetail, e error) {
+	e = c.call("GetNodeGroupDetail", func() (e error) {
+		groups, e = c.ds.GetNodeGroupDetail(nid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetNodeGroupState(nid string) (groups map[string]p2p_storage.GroupNode, e error) {
+	e = c.call("GetNodeGroupState", func() (e error) {
+		groups, e = c.ds.GetNodeGroupState(nid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetGroupOnlineNodesCount(gid string) (num uint32, e error) {
+	e = c.call("GetGroupOnlineNodesCount", func() (e error) {
+		num, e = c.ds.GetGroupOnlineNodesCount(gid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetUPNPAvailableNodes(num int, updateTm int64) (nodes []p2p_storage.Peer, e error) {
+	e = c.call("GetUPNPAvailableNodes", func() (e error) {
+		nodes, e = c.ds.GetUPNPAvailableNodes(num, updateTm)
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddToInvalidFile(nid, gid, md5 string, tm int64) (e error) {
+	return c.call("AddToInvalidFile", func() error { return c.ds.AddToInvalidFile(nid, gid, md5, tm) })
+}
+
+func (c *Chaos) UpdateChecksum(md5, checksum string) (e error) {
+	return c.call("UpdateChecksum", func() error { return c.ds.UpdateChecksum(md5, checksum) })
+}
+
+func (c *Chaos) GetChecksum(md5 string) (checksum string, e error) {
+	e = c.call("GetChecksum", func() (e error) {
+		checksum, e = c.ds.GetChecksum(md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) IncrementActiveGroups(nid string) (e error) {
+	return c.call("IncrementActiveGroups", func() error { return c.ds.IncrementActiveGroups(nid) })
+}
+
+func (c *Chaos) GetValidExpandNodes(gid, md5 string) (exNodes []p2p_storage.ExpandNode, e error) {
+	e = c.call("GetValidExpandNodes", func() (e error) {
+		exNodes, e = c.ds.GetValidExpandNodes(gid, md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetExpandNode(gid, nid, md5 string) (exNode *p2p_storage.ExpandNode, e error) {
+	e = c.call("GetExpandNode", func() (e error) {
+		exNode, e = c.ds.GetExpandNode(gid, nid, md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetExpandNodeById(id uint64) (exNode *p2p_storage.ExpandNode, e error) {
+	e = c.call("GetExpandNodeById", func() (e error) {
+		exNode, e = c.ds.GetExpandNodeById(id)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetExpandTasks(nid string, state int8, num int) (exNodes []p2p_storage.ExpandNode, e error) {
+	e = c.call("GetExpandTasks", func() (e error) {
+		exNodes, e = c.ds.GetExpandTasks(nid, state, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddOrUpdateExpandNode(exNode *p2p_storage.ExpandNode) (task_id int64, e error) {
+	e = c.call("AddOrUpdateExpandNode", func() (e error) {
+		task_id, e = c.ds.AddOrUpdateExpandNode(exNode)
+		return
+	})
+	return
+}
+
+func (c *Chaos) UpdateExpandNodeState(gid, nid, md5 string, state int8, timouet int64, increment_failed_times bool) (e error) {
+	return c.call("UpdateExpandNodeState", func() error { return c.ds.UpdateExpandNodeState(gid, nid, md5, state, timouet, increment_failed_times) })
+}
+
+func (c *Chaos) UpdateExpandNodesState(nid string, state int8, timouet int64) (e error) {
+	return c.call("UpdateExpandNodesState", func() error { return c.ds.UpdateExpandNodesState(nid, state, timouet) })
+}
+
+func (c *Chaos) UpdateExpandNodeTimeout(id uint64, timouet int64) (e error) {
+	return c.call("UpdateExpandNodeTimeout", func() error { return c.ds.UpdateExpandNodeTimeout(id, timouet) })
+}
+
+func (c *Chaos) DeleteExpandNode(gid, nid, md5 string) (e error) {
+	return c.call("DeleteExpandNode", func() error { return c.ds.DeleteExpandNode(gid, nid, md5) })
+}
+
+func (c *Chaos) GetExpandTaskTotalFailedTimes(gid, md5 string) (times uint32, e error) {
+	e = c.call("GetExpandTaskTotalFailedTimes", func() (e error) {
+		times, e = c.ds.GetExpandTaskTotalFailedTimes(gid, md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetExpandTaskCount(node string) (cnt uint32, e error) {
+	e = c.call("GetExpandTaskCount", func() (e error) {
+		cnt, e = c.ds.GetExpandTaskCount(node)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetTimeoutExpandTaskCheckedTime() (tm, id int64, e error) {
+	e = c.call("GetTimeoutExpandTaskCheckedTime", func() (e error) {
+		tm, id, e = c.ds.GetTimeoutExpandTaskCheckedTime()
+		return
+	})
+	return
+}
+
+func (c *Chaos) UpdateTimeoutExpandTaskCheckedTime(tm, id int64) (e error) {
+	return c.call("UpdateTimeoutExpandTaskCheckedTime", func() error { return c.ds.UpdateTimeoutExpandTaskCheckedTime(tm, id) })
+}
+
+func (c *Chaos) GetTimeoutExpandTask(from int64, to int64, lastId int64, num int) (nodes []p2p_storage.ExpandNode, e error) {
+	e = c.call("GetTimeoutExpandTask", func() (e error) {
+		nodes, e = c.ds.GetTimeoutExpandTask(from, to, lastId, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetNodesByIds(ids []string) (nodes []p2p_storage.NodeDetail, e error) {
+	e = c.call("GetNodesByIds", func() (e error) {
+		nodes, e = c.ds.GetNodesByIds(ids)
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddTaskNode(task_id uint64, nids []string) (e error) {
+	return c.call("AddTaskNode", func() error { return c.ds.AddTaskNode(task_id, nids) })
+}
+
+func (c *Chaos) DeleteTaskNodeByTask(id uint64) (e error) {
+	return c.call("DeleteTaskNodeByTask", func() error { return c.ds.DeleteTaskNodeByTask(id) })
+}
+
+func (c *Chaos) DeleteExpandNodeById(id uint64) (e error) {
+	return c.call("DeleteExpandNodeById", func() error { return c.ds.DeleteExpandNodeById(id) })
+}
+
+func (c *Chaos) DeleteExpandNodeByMd5(md5 string) (e error) {
+	return c.call("DeleteExpandNodeByMd5", func() error { return c.ds.DeleteExpandNodeByMd5(md5) })
+}
+
+func (c *Chaos) DeleteExpandNodeByTimeOut(tm uint64) (e error) {
+	return c.call("DeleteExpandNodeByTimeOut", func() error { return c.ds.DeleteExpandNodeByTimeOut(tm) })
+}
+
+func (c *Chaos) GetGroupFileVer(gid, nid string) (ver uint64, e error) {
+	e = c.call("GetGroupFileVer", func() (e error) {
+		ver, e = c.ds.GetGroupFileVer(gid, nid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetGroupFileByVer(gid, nid string, ver uint64, num int) (files []p2p_storage.GroupFile, e error) {
+	e = c.call("GetGroupFileByVer", func() (e error) {
+		files, e = c.ds.GetGroupFileByVer(gid, nid, ver, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetFileNodesCountByVer(gid string, ver uint64) (cnt uint32, e error) {
+	e = c.call("GetFileNodesCountByVer", func() (e error) {
+		cnt, e = c.ds.GetFileNodesCountByVer(gid, ver)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetCanDelTimeoutNodes(tm uint64, num int) (nodes []string, e error) {
+	e = c.call("GetCanDelTimeoutNodes", func() (e error) {
+		nodes, e = c.ds.GetCanDelTimeoutNodes(tm, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) CheckIsFinishFirstExpand(gid string, ver uint64) (finish bool, e error) {
+	e = c.call("CheckIsFinishFirstExpand", func() (e error) {
+		finish, e = c.ds.CheckIsFinishFirstExpand(gid, ver)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetNodeCountByVerAndState(gid string, ver uint64, state int) (num uint32, e error) {
+	e = c.call("GetNodeCountByVerAndState", func() (e error) {
+		num, e = c.ds.GetNodeCountByVerAndState(gid, ver, state)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetAtomicLastCheckerTm(key string) (tm int64, e error) {
+	e = c.call("GetAtomicLastCheckerTm", func() (e error) {
+		tm, e = c.ds.GetAtomicLastCheckerTm(key)
+		return
+	})
+	return
+}
+
+func (c *Chaos) SetAtomicGetLastCheckerTm(key string, tm int64, expire_second int) (e error) {
+	return c.call("SetAtomicGetLastCheckerTm", func() error { return c.ds.SetAtomicGetLastCheckerTm(key, tm, expire_second) })
+}
+
+func (c *Chaos) UpdateGroupFirstFinishVer(gid string, ver uint64) (e error) {
+	return c.call("UpdateGroupFirstFinishVer", func() error { return c.ds.UpdateGroupFirstFinishVer(gid, ver) })
+}
+
+func (c *Chaos) GetGroupFirstFinishExpandVer(gid string) (finish_ver uint64, e error) {
+	e = c.call("GetGroupFirstFinishExpandVer", func() (e error) {
+		finish_ver, e = c.ds.GetGroupFirstFinishExpandVer(gid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetNodeOnlineTm(nids []string) (node_online_map map[string]int, e error) {
+	e = c.call("GetNodeOnlineTm", func() (e error) {
+		node_online_map, e = c.ds.GetNodeOnlineTm(nids)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetAllNode(begin string) (nodes []string, e error) {
+	e = c.call("GetAllNode", func() (e error) {
+		nodes, e = c.ds.GetAllNode(begin)
+		return
+	})
+	return
+}
+
+func (c *Chaos) UpdateNodeOnlineCnt(nodeMap map[string]int) (e error) {
+	return c.call("UpdateNodeOnlineCnt", func() error { return c.ds.UpdateNodeOnlineCnt(nodeMap) })
+}
+
+func (c *Chaos) GetUnSafeExpandTasks(nid string, state int8, num int) (exNodes []p2p_storage.UnSafeExpandNode, e error) {
+	e = c.call("GetUnSafeExpandTasks", func() (e error) {
+		exNodes, e = c.ds.GetUnSafeExpandTasks(nid, state, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) UpdateUnSafeExpandNodeState(id uint64, state int) (e error) {
+	return c.call("UpdateUnSafeExpandNodeState", func() error { return c.ds.UpdateUnSafeExpandNodeState(id, state) })
+}
+
+func (c *Chaos) GetUnSafeExpandNodeById(id uint64) (exNode *p2p_storage.UnSafeExpandNode, e error) {
+	e = c.call("GetUnSafeExpandNodeById", func() (e error) {
+		exNode, e = c.ds.GetUnSafeExpandNodeById(id)
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddOrUpdateUnSafeFile(gid, md5 string) (e error) {
+	return c.call("AddOrUpdateUnSafeFile", func() error { return c.ds.AddOrUpdateUnSafeFile(gid, md5) })
+}
+
+func (c *Chaos) AddOrUpdateUnSafeExpandNodes(exNodes []p2p_storage.UnSafeExpandNode) (e error) {
+	return c.call("AddOrUpdateUnSafeExpandNodes", func() error { return c.ds.AddOrUpdateUnSafeExpandNodes(exNodes) })
+}
+
+func (c *Chaos) DeleteUnSafeFile(gid, md5 string) (e error) {
+	return c.call("DeleteUnSafeFile", func() error { return c.ds.DeleteUnSafeFile(gid, md5) })
+}
+
+func (c *Chaos) DeleteUnSafeFileExpandNode(gid, node, md5 string) (e error) {
+	return c.call("DeleteUnSafeFileExpandNode", func() error { return c.ds.DeleteUnSafeFileExpandNode(gid, node, md5) })
+}
+
+func (c *Chaos) GetUnSafeFileExpandNode() (exNodes []p2p_storage.UnSafeExpandNode, e error) {
+	e = c.call("GetUnSafeFileExpandNode", func() (e error) {
+		exNodes, e = c.ds.GetUnSafeFileExpandNode()
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetHasUnSafeFileNode(gid, md5 string, num uint32, ex_nids []string) (nids []string, e error) {
+	e = c.call("GetHasUnSafeFileNode", func() (e error) {
+		nids, e = c.ds.GetHasUnSafeFileNode(gid, md5, num, ex_nids)
+		return
+	})
+	return
+}
+
+func (c *Chaos) UpdateGroupFileStateAndAddVer(gid string, md5 string, state int, add_ver uint64) (e error) {
+	return c.call("UpdateGroupFileStateAndAddVer", func() error { return c.ds.UpdateGroupFileStateAndAddVer(gid, md5, state, add_ver) })
+}
+
+func (c *Chaos) GetGroupNodeCountByState(state int) (countMap map[string]int, e error) {
+	e = c.call("GetGroupNodeCountByState", func() (e error) {
+		countMap, e = c.ds.GetGroupNodeCountByState(state)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetMapFromConfig(configMap map[interface{}]interface{}) (e error) {
+	return c.call("GetMapFromConfig", func() error { return c.ds.GetMapFromConfig(configMap) })
+}
+
+func (c *Chaos) GetNodesAGZero(groupCapacity uint64, updateTm, regTm int64, active_groups int8, online_cnt int) (nodes map[string]bool, e error) {
+	e = c.call("GetNodesAGZero", func() (e error) {
+		nodes, e = c.ds.GetNodesAGZero(groupCapacity, updateTm, regTm, active_groups, online_cnt)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetNewNodes(groupCapacity uint64, updateTm, regTm int64, online_cnt int) (nodes map[string]bool, e error) {
+	e = c.call("GetNewNodes", func() (e error) {
+		nodes, e = c.ds.GetNewNodes(groupCapacity, updateTm, regTm, online_cnt)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetGroupNodesTaskProcessSlow(nowTm int64) (groupNodesMap map[string]p2p_storage.GroupNode, e error) {
+	e = c.call("GetGroupNodesTaskProcessSlow", func() (e error) {
+		groupNodesMap, e = c.ds.GetGroupNodesTaskProcessSlow(nowTm)
+		return
+	})
+	return
+}
+
+func (c *Chaos) SetExpandNodeStateFailed(node string) (e error) {
+	return c.call("SetExpandNodeStateFailed", func() error { return c.ds.SetExpandNodeStateFailed(node) })
+}
+
+func (c *Chaos) UnLock(db int, key string) (e error) {
+	return c.call("UnLock", func() error { return c.ds.UnLock(db, key) })
+}
+
+var _ p2p_storage.IDataSource = (*Chaos)(nil)
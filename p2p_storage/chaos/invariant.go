@@ -0,0 +1,95 @@
+package chaos
+
+import (
+	"fmt"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/backup"
+)
+
+/*
+	系统不变量检查：
+		1. 分组Size等于分组中正常文件大小之和（与CalculateGroupSize的结果一致）
+		2. 扩散任务和危险任务引用的分组、分组文件、节点都存在
+		3. 分组版本号、新增版本号、首次扩散完成版本号、文件版本号不回退
+
+	版本号是否回退需要与上一次Check的结果比较，同一个Invariants应在故障注入的过程中多次调用Check。
+	需要传入没有故障注入的数据源。
+*/
+type Invariants struct {
+	IgnoreSize bool //不检查分组大小，多个故障叠加时（修复分组大小也失败）分组大小只能之后重新计算修复
+
+	ds   p2p_storage.IDataSource
+	vers map[string]uint64 //上次检查时的版本号
+}
+
+func NewInvariants(ds p2p_storage.IDataSource) *Invariants {
+	return &Invariants{ds: ds, vers: make(map[string]uint64)}
+}
+
+/*
+	检查不变量
+
+	返回值：
+		problems: 不成立的不变量，都成立时返回空列表
+*/
+func (inv *Invariants) Check() (problems []string, e error) {
+	s, e := backup.Export(inv.ds)
+	if e != nil {
+		return
+	}
+	problems = make([]string, 0)
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	nodes := make(map[string]bool, len(s.Nodes))
+	for _, n := range s.Nodes {
+		nodes[n.ID] = true
+	}
+	groups := make(map[string]bool, len(s.Groups))
+	files := make(map[string]bool) //gid + md5
+	vers := make(map[string]uint64)
+	for _, g := range s.Groups {
+		groups[g.ID] = true
+		var size uint64
+		for _, f := range g.Files {
+			files[g.ID+"/"+f.MD5] = true
+			if f.State == p2p_storage.NORMAL {
+				size += f.Size
+			}
+			//ListUpdatedFiles中首次扩散文件按Ver排序，新增文件按AddVer排序
+			if f.Type == p2p_storage.GROUPFILE_TYPE_NEW_ADD {
+				vers["file add_ver "+g.ID+"/"+f.MD5] = f.AddVer
+			} else {
+				vers["file ver "+g.ID+"/"+f.MD5] = f.Ver
+			}
+		}
+		if !inv.IgnoreSize && g.Size != size {
+			add("group %s: size %d, calculated %d", g.ID, g.Size, size)
+		}
+		vers["group file_ver "+g.ID] = g.FileVer
+		vers["group add_ver "+g.ID] = g.AddVer
+		vers["group first_finish_ver "+g.ID] = g.FirstFinishVer
+	}
+
+	for _, t := range s.ExpandNodes {
+		if !groups[t.Group] || !files[t.Group+"/"+t.MD5] || !nodes[t.Node] {
+			add("orphan expand task %d: %s/%s/%s", t.ID, t.Group, t.Node, t.MD5)
+		}
+	}
+	for _, t := range s.UnSafeNodes {
+		if !groups[t.Group] || !files[t.Group+"/"+t.MD5] || !nodes[t.Node] {
+			add("orphan unsafe task %d: %s/%s/%s", t.ID, t.Group, t.Node, t.MD5)
+		}
+	}
+
+	for k, v := range vers {
+		if old, ok := inv.vers[k]; ok && v < old {
+			add("%s decreased from %d to %d", k, old, v)
+		}
+		if v > inv.vers[k] {
+			inv.vers[k] = v
+		}
+	}
+	return
+}
@@ -0,0 +1,375 @@
+package chaos
+
+import (
+	"reflect"
+	"yh_pkg/p2p_storage"
+)
+
+/*
+	可选的存储接口同样注入故障，被包装的数据源不支持的接口Supports返回false，p2p_storage.Init不会使用
+*/
+var (
+	_ p2p_storage.IStoreForwarder   = (*Chaos)(nil)
+	_ p2p_storage.INodeKeyStore     = (*Chaos)(nil)
+	_ p2p_storage.IFileKeyStore     = (*Chaos)(nil)
+	_ p2p_storage.INamespaceStore   = (*Chaos)(nil)
+	_ p2p_storage.IPolicyStore      = (*Chaos)(nil)
+	_ p2p_storage.IPriorityIndex    = (*Chaos)(nil)
+	_ p2p_storage.IExpandStateStore = (*Chaos)(nil)
+	_ p2p_storage.IFileIDStore      = (*Chaos)(nil)
+	_ p2p_storage.INATStore         = (*Chaos)(nil)
+	_ p2p_storage.IIngestStore      = (*Chaos)(nil)
+	_ p2p_storage.INodeHistoryStore = (*Chaos)(nil)
+)
+
+func (c *Chaos) Supports(store interface{}) bool {
+	return reflect.TypeOf(c).Implements(reflect.TypeOf(store).Elem()) && p2p_storage.SupportsStore(c.ds, store)
+}
+
+func (c *Chaos) GetNodeKey(nid string) (key []byte, e error) {
+	e = c.call("GetNodeKey", func() (e error) {
+		key, e = c.ds.(p2p_storage.INodeKeyStore).GetNodeKey(nid)
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddNodeKey(nid string, key []byte) (ok bool, e error) {
+	e = c.call("AddNodeKey", func() (e error) {
+		ok, e = c.ds.(p2p_storage.INodeKeyStore).AddNodeKey(nid, key)
+		return
+	})
+	return
+}
+
+func (c *Chaos) DeleteNodeKey(nid string) (e error) {
+	return c.call("DeleteNodeKey", func() error { return c.ds.(p2p_storage.INodeKeyStore).DeleteNodeKey(nid) })
+}
+
+func (c *Chaos) UseNonce(nid string, nonce string, expire int64) (ok bool, e error) {
+	e = c.call("UseNonce", func() (e error) {
+		ok, e = c.ds.(p2p_storage.INodeKeyStore).UseNonce(nid, nonce, expire)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetFileKey(md5 string) (key *p2p_storage.FileKey, e error) {
+	e = c.call("GetFileKey", func() (e error) {
+		key, e = c.ds.(p2p_storage.IFileKeyStore).GetFileKey(md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) SetFileKey(key *p2p_storage.FileKey, oldVer uint32) (ok bool, e error) {
+	e = c.call("SetFileKey", func() (e error) {
+		ok, e = c.ds.(p2p_storage.IFileKeyStore).SetFileKey(key, oldVer)
+		return
+	})
+	return
+}
+
+func (c *Chaos) DeleteFileKey(md5 string) (e error) {
+	return c.call("DeleteFileKey", func() error { return c.ds.(p2p_storage.IFileKeyStore).DeleteFileKey(md5) })
+}
+
+func (c *Chaos) GetFileKeys(tenant string, from string, num int) (keys []p2p_storage.FileKey, e error) {
+	e = c.call("GetFileKeys", func() (e error) {
+		keys, e = c.ds.(p2p_storage.IFileKeyStore).GetFileKeys(tenant, from, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) CreateBucket(tenant, bucket string) (ok bool, e error) {
+	e = c.call("CreateBucket", func() (e error) {
+		ok, e = c.ds.(p2p_storage.INamespaceStore).CreateBucket(tenant, bucket)
+		return
+	})
+	return
+}
+
+func (c *Chaos) DeleteBucket(tenant, bucket string) (ok bool, e error) {
+	e = c.call("DeleteBucket", func() (e error) {
+		ok, e = c.ds.(p2p_storage.INamespaceStore).DeleteBucket(tenant, bucket)
+		return
+	})
+	return
+}
+
+func (c *Chaos) IsBucketExist(tenant, bucket string) (exist bool, e error) {
+	e = c.call("IsBucketExist", func() (e error) {
+		exist, e = c.ds.(p2p_storage.INamespaceStore).IsBucketExist(tenant, bucket)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetBuckets(tenant string) (buckets []string, e error) {
+	e = c.call("GetBuckets", func() (e error) {
+		buckets, e = c.ds.(p2p_storage.INamespaceStore).GetBuckets(tenant)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetObject(tenant, bucket, key string) (obj *p2p_storage.Object, e error) {
+	e = c.call("GetObject", func() (e error) {
+		obj, e = c.ds.(p2p_storage.INamespaceStore).GetObject(tenant, bucket, key)
+		return
+	})
+	return
+}
+
+func (c *Chaos) PutObject(obj *p2p_storage.Object) (e error) {
+	return c.call("PutObject", func() error { return c.ds.(p2p_storage.INamespaceStore).PutObject(obj) })
+}
+
+func (c *Chaos) DeleteObject(tenant, bucket, key string) (e error) {
+	return c.call("DeleteObject", func() error { return c.ds.(p2p_storage.INamespaceStore).DeleteObject(tenant, bucket, key) })
+}
+
+func (c *Chaos) GetObjects(tenant, bucket, from string, num int) (objs []p2p_storage.Object, e error) {
+	e = c.call("GetObjects", func() (e error) {
+		objs, e = c.ds.(p2p_storage.INamespaceStore).GetObjects(tenant, bucket, from, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetExpiredObjects(before int64, num int) (objs []p2p_storage.Object, e error) {
+	e = c.call("GetExpiredObjects", func() (e error) {
+		objs, e = c.ds.(p2p_storage.INamespaceStore).GetExpiredObjects(before, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) IncrFileRef(md5 string, delta int64) (refs int64, e error) {
+	e = c.call("IncrFileRef", func() (e error) {
+		refs, e = c.ds.(p2p_storage.INamespaceStore).IncrFileRef(md5, delta)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetFileRef(md5 string) (refs int64, e error) {
+	e = c.call("GetFileRef", func() (e error) {
+		refs, e = c.ds.(p2p_storage.INamespaceStore).GetFileRef(md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) IncrUsage(tenant string, bytes, files int64) (e error) {
+	return c.call("IncrUsage", func() error { return c.ds.(p2p_storage.INamespaceStore).IncrUsage(tenant, bytes, files) })
+}
+
+func (c *Chaos) GetUsage(tenant string) (usage p2p_storage.Usage, e error) {
+	e = c.call("GetUsage", func() (e error) {
+		usage, e = c.ds.(p2p_storage.INamespaceStore).GetUsage(tenant)
+		return
+	})
+	return
+}
+
+func (c *Chaos) SetQuota(tenant string, quota p2p_storage.Quota) (e error) {
+	return c.call("SetQuota", func() error { return c.ds.(p2p_storage.INamespaceStore).SetQuota(tenant, quota) })
+}
+
+func (c *Chaos) GetTenants() (tenants []string, e error) {
+	e = c.call("GetTenants", func() (e error) {
+		tenants, e = c.ds.(p2p_storage.INamespaceStore).GetTenants()
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetFilePolicy(md5 string) (p *p2p_storage.FilePolicy, e error) {
+	e = c.call("GetFilePolicy", func() (e error) {
+		p, e = c.ds.(p2p_storage.IPolicyStore).GetFilePolicy(md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) SetFilePolicy(p *p2p_storage.FilePolicy) (e error) {
+	return c.call("SetFilePolicy", func() error { return c.ds.(p2p_storage.IPolicyStore).SetFilePolicy(p) })
+}
+
+func (c *Chaos) DeleteFilePolicy(md5 string) (e error) {
+	return c.call("DeleteFilePolicy", func() error { return c.ds.(p2p_storage.IPolicyStore).DeleteFilePolicy(md5) })
+}
+
+func (c *Chaos) GetExpiredFiles(before int64, num int) (policies []p2p_storage.FilePolicy, e error) {
+	e = c.call("GetExpiredFiles", func() (e error) {
+		policies, e = c.ds.(p2p_storage.IPolicyStore).GetExpiredFiles(before, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetBucketPolicy(tenant, bucket string) (p *p2p_storage.Policy, e error) {
+	e = c.call("GetBucketPolicy", func() (e error) {
+		p, e = c.ds.(p2p_storage.IPolicyStore).GetBucketPolicy(tenant, bucket)
+		return
+	})
+	return
+}
+
+func (c *Chaos) SetBucketPolicy(tenant, bucket string, p *p2p_storage.Policy) (e error) {
+	return c.call("SetBucketPolicy", func() error { return c.ds.(p2p_storage.IPolicyStore).SetBucketPolicy(tenant, bucket, p) })
+}
+
+func (c *Chaos) GetFilesByPriority(priority int, after string, num int) (policies []p2p_storage.FilePolicy, e error) {
+	e = c.call("GetFilesByPriority", func() (e error) {
+		policies, e = c.ds.(p2p_storage.IPriorityIndex).GetFilesByPriority(priority, after, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddExpandTransition(t *p2p_storage.ExpandTransition) (e error) {
+	return c.call("AddExpandTransition", func() error { return c.ds.(p2p_storage.IExpandStateStore).AddExpandTransition(t) })
+}
+
+func (c *Chaos) GetExpandTransitions(task uint64) (ts []p2p_storage.ExpandTransition, e error) {
+	e = c.call("GetExpandTransitions", func() (e error) {
+		ts, e = c.ds.(p2p_storage.IExpandStateStore).GetExpandTransitions(task)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetExpandAttempt(gid, md5 string) (a *p2p_storage.ExpandAttempt, e error) {
+	e = c.call("GetExpandAttempt", func() (e error) {
+		a, e = c.ds.(p2p_storage.IExpandStateStore).GetExpandAttempt(gid, md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) SetExpandAttempt(a *p2p_storage.ExpandAttempt) (e error) {
+	return c.call("SetExpandAttempt", func() error { return c.ds.(p2p_storage.IExpandStateStore).SetExpandAttempt(a) })
+}
+
+func (c *Chaos) DeleteExpandAttempt(gid, md5 string) (e error) {
+	return c.call("DeleteExpandAttempt", func() error { return c.ds.(p2p_storage.IExpandStateStore).DeleteExpandAttempt(gid, md5) })
+}
+
+func (c *Chaos) GetFileIDBinding(id string) (b *p2p_storage.FileIDBinding, e error) {
+	e = c.call("GetFileIDBinding", func() (e error) {
+		b, e = c.ds.(p2p_storage.IFileIDStore).GetFileIDBinding(id)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetFileIDByMD5(md5 string) (b *p2p_storage.FileIDBinding, e error) {
+	e = c.call("GetFileIDByMD5", func() (e error) {
+		b, e = c.ds.(p2p_storage.IFileIDStore).GetFileIDByMD5(md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) SetFileIDBinding(b *p2p_storage.FileIDBinding) (ok bool, e error) {
+	e = c.call("SetFileIDBinding", func() (e error) {
+		ok, e = c.ds.(p2p_storage.IFileIDStore).SetFileIDBinding(b)
+		return
+	})
+	return
+}
+
+func (c *Chaos) DeleteFileIDBinding(id string) (e error) {
+	return c.call("DeleteFileIDBinding", func() error { return c.ds.(p2p_storage.IFileIDStore).DeleteFileIDBinding(id) })
+}
+
+func (c *Chaos) GetNodeNATs(ids []string) (nats map[string]*p2p_storage.NodeNAT, e error) {
+	e = c.call("GetNodeNATs", func() (e error) {
+		nats, e = c.ds.(p2p_storage.INATStore).GetNodeNATs(ids)
+		return
+	})
+	return
+}
+
+func (c *Chaos) SetNodeNAT(n *p2p_storage.NodeNAT) (e error) {
+	return c.call("SetNodeNAT", func() error { return c.ds.(p2p_storage.INATStore).SetNodeNAT(n) })
+}
+
+func (c *Chaos) AddIngest(p *p2p_storage.PendingIngest) (ticket uint64, e error) {
+	e = c.call("AddIngest", func() (e error) {
+		ticket, e = c.ds.(p2p_storage.IIngestStore).AddIngest(p)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetIngest(ticket uint64) (p *p2p_storage.PendingIngest, e error) {
+	e = c.call("GetIngest", func() (e error) {
+		p, e = c.ds.(p2p_storage.IIngestStore).GetIngest(ticket)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetPendingIngest(md5 string) (p *p2p_storage.PendingIngest, e error) {
+	e = c.call("GetPendingIngest", func() (e error) {
+		p, e = c.ds.(p2p_storage.IIngestStore).GetPendingIngest(md5)
+		return
+	})
+	return
+}
+
+func (c *Chaos) GetPendingIngests(after uint64, num int) (ps []p2p_storage.PendingIngest, e error) {
+	e = c.call("GetPendingIngests", func() (e error) {
+		ps, e = c.ds.(p2p_storage.IIngestStore).GetPendingIngests(after, num)
+		return
+	})
+	return
+}
+
+func (c *Chaos) UpdateIngest(p *p2p_storage.PendingIngest) (e error) {
+	return c.call("UpdateIngest", func() error { return c.ds.(p2p_storage.IIngestStore).UpdateIngest(p) })
+}
+
+func (c *Chaos) DeleteIngests(before int64) (e error) {
+	return c.call("DeleteIngests", func() error { return c.ds.(p2p_storage.IIngestStore).DeleteIngests(before) })
+}
+
+func (c *Chaos) GetIngestStats() (stats p2p_storage.IngestStats, e error) {
+	e = c.call("GetIngestStats", func() (e error) {
+		stats, e = c.ds.(p2p_storage.IIngestStore).GetIngestStats()
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddNodeSample(s *p2p_storage.NodeSample) (e error) {
+	return c.call("AddNodeSample", func() error { return c.ds.(p2p_storage.INodeHistoryStore).AddNodeSample(s) })
+}
+
+func (c *Chaos) GetNodeSamples(nid string, from, to int64) (samples []p2p_storage.NodeSample, e error) {
+	e = c.call("GetNodeSamples", func() (e error) {
+		samples, e = c.ds.(p2p_storage.INodeHistoryStore).GetNodeSamples(nid, from, to)
+		return
+	})
+	return
+}
+
+func (c *Chaos) AddNodeOnline(nid string, tm, gap int64) (e error) {
+	return c.call("AddNodeOnline", func() error { return c.ds.(p2p_storage.INodeHistoryStore).AddNodeOnline(nid, tm, gap) })
+}
+
+func (c *Chaos) GetNodeOnline(nid string, from, to int64) (periods []p2p_storage.OnlineInterval, e error) {
+	e = c.call("GetNodeOnline", func() (e error) {
+		periods, e = c.ds.(p2p_storage.INodeHistoryStore).GetNodeOnline(nid, from, to)
+		return
+	})
+	return
+}
+
+func (c *Chaos) CompactNodeHistory(before, span, expire int64) (e error) {
+	return c.call("CompactNodeHistory", func() error { return c.ds.(p2p_storage.INodeHistoryStore).CompactNodeHistory(before, span, expire) })
+}
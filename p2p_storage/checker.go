@@ -2,14 +2,39 @@ package p2p_storage
 
 import (
 	"strings"
+	"sync"
 	"time"
 	"yh_pkg/log"
 	tm "yh_pkg/time"
 )
 
+var (
+	stopped    = make(chan struct{}) //Stop时关闭
+	background sync.WaitGroup        //Init启动的检查和接口启动的后台任务
+)
+
+//在后台执行f，Stop等待它结束
+func goBackground(f func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+}
+
+//检查的间隔，Stop之后立即返回false
+func sleep(d time.Duration) (ok bool) {
+	select {
+	case <-stopped:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
 //检测当前是否可以启动检测服务
-func checkCanRunService(key string) (can bool) {
-	last_tm, e := dataSource.Raw.GetAtomicLastCheckerTm(key)
+func (ds *DataSource) checkCanRunService(key string) (can bool) {
+	last_tm, e := ds.Raw.GetAtomicLastCheckerTm(key)
 	if e != nil {
 		logger.AppendObj(e, "checkCanRunService-is error--", key)
 		return
@@ -40,18 +65,30 @@ func getCheckExpireTm(key string) (expire_second int) {
 		expire_second = 300
 	} else if key == CHECKER_ONLINE_NODE {
 		expire_second = 300
+	} else if key == CHECKER_EXPIRED_FILE {
+		expire_second = CHECKER_EXPIRED_FILE_MIN * 60
+	} else if key == CHECKER_NODE_HISTORY {
+		expire_second = CHECKER_NODE_HISTORY_MIN * 60
+	} else if key == CHECKER_CAPACITY {
+		expire_second = CHECKER_CAPACITY_MIN * 60
+	} else if key == CHECKER_INGEST {
+		expire_second = CHECKER_INGEST_MIN * 60
 	}
 	return
 
 }
 
 func checkTimeoutNodes() {
-	time.Sleep(time.Second * time.Duration(NODE_VALID_TIME))
+	if !sleep(time.Second * time.Duration(NODE_VALID_TIME)) {
+		return
+	}
 	for {
-		time.Sleep(time.Minute * 1)
+		if !sleep(time.Minute * 1) {
+			return
+		}
 
 		//获取检测时间，并判断是否需要执行检测,间隔时间去检测
-		if !checkCanRunService(CHECKER_TIMEOUT_LAST_TM) {
+		if !dataSource.checkCanRunService(CHECKER_TIMEOUT_LAST_TM) {
 			continue
 		}
 		if e := dataSource.Raw.SetAtomicGetLastCheckerTm(CHECKER_TIMEOUT_LAST_TM, tm.Now.Unix(), getCheckExpireTm(CHECKER_TIMEOUT_LAST_TM)); e != nil {
@@ -96,13 +133,14 @@ func checkTimeoutNodes() {
 						success = false
 						break
 					}
-					if e = group.ExpandNodesToPerfectSize(NODE_MAX_ACTIVE_GROUPS, ""); e != nil {
+					if e = group.ExpandNodesToPerfectSize(dataSource, NODE_MAX_ACTIVE_GROUPS, ""); e != nil {
 						logger.Append("ExpandNodesToPerfectSiz error: "+e.Error(), log.ERROR)
 						success = false
 						break
 					}
 				}
 			}
+			dataSource.recordNodeExpandInterrupted(node.ID, "node offline")
 			if e = dataSource.Raw.UpdateExpandNodesState(node.ID, EXPAND_STATE_FAILED, CalculateExpandNodeTimeout(EXPAND_STATE_FAILED)); e != nil {
 				logger.Append("UpdateExpandNodeStat error: "+e.Error(), log.ERROR)
 			}
@@ -121,15 +159,19 @@ func checkTimeoutNodes() {
 }
 
 func createNewGroups() {
-	time.Sleep(time.Second * time.Duration(NODE_VALID_TIME))
+	if !sleep(time.Second * time.Duration(NODE_VALID_TIME)) {
+		return
+	}
 
 	idx := 2
 	g := GROUP_CONFIG[idx]
 	groupCapacity := uint64(g.MinPieces) * GROUP_NODE_CAPACITY
 	for {
-		time.Sleep(time.Minute * 1)
+		if !sleep(time.Minute * 1) {
+			return
+		}
 		//获取检测时间，并判断是否需要执行检测,间隔时间去检测周期的1.5倍，所以设置为90秒
-		if !checkCanRunService(CHECKER_CREATEGROUP_LAST_TM) {
+		if !dataSource.checkCanRunService(CHECKER_CREATEGROUP_LAST_TM) {
 			continue
 		}
 		if e := dataSource.Raw.SetAtomicGetLastCheckerTm(CHECKER_CREATEGROUP_LAST_TM, tm.Now.Unix(), getCheckExpireTm(CHECKER_CREATEGROUP_LAST_TM)); e != nil {
@@ -154,7 +196,7 @@ func createNewGroups() {
 		}
 		logger.AppendObj(e, "-createNewGroups-:", spaces, file_size, "bal_ratio:", ratio)
 
-		group, e = createGroup(idx, file_size, "")
+		group, e = dataSource.createGroup(idx, file_size, "")
 		if e == nil {
 			logger.Append("-createNewGroups- create group "+group.ID, log.DEBUG)
 		} else {
@@ -168,11 +210,15 @@ func createNewGroups() {
 检测扩散任务超时，修改任务对应节点的任务记录, 成功和失败的情况下，在ExpandFinish接口中已经处理过了，现在需要在处理已经获取任务任务或者失败的情况的超时
 */
 func checkExpandTaskTimeout() {
-	time.Sleep(time.Second * time.Duration(NODE_VALID_TIME))
+	if !sleep(time.Second * time.Duration(NODE_VALID_TIME)) {
+		return
+	}
 	for {
-		time.Sleep(time.Second * 10)
+		if !sleep(time.Second * 10) {
+			return
+		}
 		//获取检测时间，并判断是否需要执行检测,间隔时间去检测周期的1.5倍，所以设置为90秒
-		if !checkCanRunService(CHECKER_EXPAND_TASK_TIME) {
+		if !dataSource.checkCanRunService(CHECKER_EXPAND_TASK_TIME) {
 			continue
 		}
 		if e := dataSource.Raw.SetAtomicGetLastCheckerTm(CHECKER_EXPAND_TASK_TIME, tm.Now.Unix(), getCheckExpireTm(CHECKER_EXPAND_TASK_TIME)); e != nil {
@@ -210,7 +256,8 @@ func checkExpandTaskTimeout() {
 				}
 			} else {
 				//如果任务失败，则需要将group_file的版本添加
-				go IncrGroupFileVer(t.Group, t.MD5)
+				gid, md5 := t.Group, t.MD5
+				goBackground(func() { IncrGroupFileVer(gid, md5) })
 			}
 
 			if !success {
@@ -229,10 +276,14 @@ func checkExpandTaskTimeout() {
 
 //检测并将长时间不在线的node
 func checkDelLongTimeOutNode() {
-	time.Sleep(time.Second * 2 * time.Duration(NODE_VALID_TIME))
+	if !sleep(time.Second * 2 * time.Duration(NODE_VALID_TIME)) {
+		return
+	}
 	for {
 		for {
-			time.Sleep(time.Minute * 1)
+			if !sleep(time.Minute * 1) {
+				return
+			}
 			//纳秒
 			tm := (time.Now().Unix() - NODE_DELETE_TIMEOUT*24*3600) * 1000000000
 			if tm < 0 {
@@ -256,9 +307,12 @@ func checkDelLongTimeOutNode() {
 			}
 		}
 		//删除超过7天的任务
-		go dataSource.Raw.DeleteExpandNodeByTimeOut(uint64(tm.Now.Unix() - EXPAND_TASK_DELETE_TIME))
+		timeout := uint64(tm.Now.Unix() - EXPAND_TASK_DELETE_TIME)
+		goBackground(func() { dataSource.Raw.DeleteExpandNodeByTimeOut(timeout) })
 		// 间隔12小时执行一次
-		time.Sleep(time.Hour * time.Duration(NODE_CHECKDELETE_TM))
+		if !sleep(time.Hour * time.Duration(NODE_CHECKDELETE_TM)) {
+			return
+		}
 	}
 }
 
@@ -267,10 +321,12 @@ func updateNodeOnlineTime() {
 	var i int
 	for {
 		if i > 0 {
-			time.Sleep(time.Hour * time.Duration(NODE_ONLINETM_INTERVAL_TM))
+			if !sleep(time.Hour * time.Duration(NODE_ONLINETM_INTERVAL_TM)) {
+				return
+			}
 		}
 		i++
-		if !checkCanRunService(CHECKER_NODE_ONLINETM_CHECKER) {
+		if !dataSource.checkCanRunService(CHECKER_NODE_ONLINETM_CHECKER) {
 			logger.AppendObj(nil, "UpdateNodeOnlineTime contine", i)
 			continue
 		}
@@ -328,10 +384,12 @@ func clearNewAddGroupFileTimeOut() {
 	var i int64
 	for {
 		if i > 0 {
-			time.Sleep(time.Minute * time.Duration(GROUP_FILE_NEW_ADD_DIFF_TIME))
+			if !sleep(time.Minute * time.Duration(GROUP_FILE_NEW_ADD_DIFF_TIME)) {
+				return
+			}
 		}
 		i++
-		if !checkCanRunService(CHECKER_GROUP_FILE_NEW_ADD_TIMEOUT) {
+		if !dataSource.checkCanRunService(CHECKER_GROUP_FILE_NEW_ADD_TIMEOUT) {
 			logger.AppendObj(nil, "clearNewAddGroupFileTimeOut contine")
 			continue
 		}
@@ -349,7 +407,9 @@ func clearNewAddGroupFileTimeOut() {
 			}
 
 			if len(files) <= 0 {
-				time.Sleep(time.Minute * time.Duration(GROUP_FILE_NEW_ADD_DIFF_TIME))
+				if !sleep(time.Minute * time.Duration(GROUP_FILE_NEW_ADD_DIFF_TIME)) {
+					return
+				}
 				logger.AppendObj(e, "clearNewAddGroupFileTimeOut not files continue:")
 				break
 			}
@@ -403,9 +463,11 @@ func clearNewAddGroupFileTimeOut() {
 func checkExpandGroup() {
 	var i int
 	for {
-		time.Sleep(time.Minute * time.Duration(CHECK_GROUP_EXPAND_TIME))
+		if !sleep(time.Minute * time.Duration(CHECK_GROUP_EXPAND_TIME)) {
+			return
+		}
 		i++
-		if !checkCanRunService(CHECKER_GROUP_EXPAND) {
+		if !dataSource.checkCanRunService(CHECKER_GROUP_EXPAND) {
 			logger.AppendObj(nil, "checkExpandGroup contine", i)
 			continue
 		}
@@ -445,7 +507,7 @@ func checkExpandGroup() {
 					continue
 				}
 
-				e = group.ExpandNodesToPerfectSize(NODE_MAX_ACTIVE_GROUPS, "")
+				e = group.ExpandNodesToPerfectSize(dataSource, NODE_MAX_ACTIVE_GROUPS, "")
 				if e != nil {
 					logger.Append("clearNewAddGroupFileTimeOut ExpandNodesToPerfectSize group: "+groupMd5, log.ERROR)
 					continue
@@ -468,7 +530,84 @@ func updateConfigMap() {
 			}
 		}
 
-		time.Sleep(time.Second * time.Duration(UPDATE_CONFIG_MAP_TIME))
+		if !sleep(time.Second * time.Duration(UPDATE_CONFIG_MAP_TIME)) {
+			return
+		}
 	}
 
 }
+
+//定时删除过期的文件和对象，并在分组空间不足时淘汰低优先级文件
+func checkExpiredFiles() {
+	for {
+		if !sleep(time.Minute * CHECKER_EXPIRED_FILE_MIN) {
+			return
+		}
+		if !dataSource.checkCanRunService(CHECKER_EXPIRED_FILE) {
+			continue
+		}
+		if e := dataSource.Raw.SetAtomicGetLastCheckerTm(CHECKER_EXPIRED_FILE, tm.Now.Unix(), getCheckExpireTm(CHECKER_EXPIRED_FILE)); e != nil {
+			logger.AppendObj(e, "checkExpiredFiles setTm error: ")
+			continue
+		}
+		n, e := ExpireFiles(EXPIRE_PAGE_SIZE)
+		logger.AppendObj(e, "checkExpiredFiles deleted:", n)
+		n, e = EvictFiles(EXPIRE_PAGE_SIZE)
+		logger.AppendObj(e, "checkExpiredFiles evicted:", n)
+	}
+}
+
+//节点历史记录降采样，没有设置存储时跳过
+func checkNodeHistory() {
+	for {
+		if !sleep(time.Minute * CHECKER_NODE_HISTORY_MIN) {
+			return
+		}
+		if historyStore == nil || !dataSource.checkCanRunService(CHECKER_NODE_HISTORY) {
+			continue
+		}
+		if e := dataSource.Raw.SetAtomicGetLastCheckerTm(CHECKER_NODE_HISTORY, tm.Now.Unix(), getCheckExpireTm(CHECKER_NODE_HISTORY)); e != nil {
+			logger.AppendObj(e, "checkNodeHistory setTm error: ")
+			continue
+		}
+		e := CompactNodeHistory()
+		logger.AppendObj(e, "checkNodeHistory compacted")
+	}
+}
+
+//记录集群容量样本，空间不足时告警
+func checkCapacity() {
+	for {
+		if !sleep(time.Minute * CHECKER_CAPACITY_MIN) {
+			return
+		}
+		if !dataSource.checkCanRunService(CHECKER_CAPACITY) {
+			continue
+		}
+		if e := dataSource.Raw.SetAtomicGetLastCheckerTm(CHECKER_CAPACITY, tm.Now.Unix(), getCheckExpireTm(CHECKER_CAPACITY)); e != nil {
+			logger.AppendObj(e, "checkCapacity setTm error: ")
+			continue
+		}
+		s, e := CheckCapacity()
+		logger.AppendObj(e, "checkCapacity", s)
+	}
+}
+
+//重试延迟添加队列中的文件，没有设置存储时跳过
+func checkPendingIngests() {
+	for {
+		if !sleep(time.Minute * CHECKER_INGEST_MIN) {
+			return
+		}
+		if ingestStore == nil || !dataSource.checkCanRunService(CHECKER_INGEST) {
+			continue
+		}
+		if e := dataSource.Raw.SetAtomicGetLastCheckerTm(CHECKER_INGEST, tm.Now.Unix(), getCheckExpireTm(CHECKER_INGEST)); e != nil {
+			logger.AppendObj(e, "checkPendingIngests setTm error: ")
+			continue
+		}
+		n, e := PromoteIngests()
+		stats, err := GetIngestStats()
+		logger.AppendObj(e, "checkPendingIngests promoted", n, stats, err)
+	}
+}
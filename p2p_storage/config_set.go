@@ -32,6 +32,19 @@ func (cs *ConfigSet) InitConfigValue() {
 	cs.ConfigValue.Set(P2P_UPSPEED_LIMIT_KEY, DEFAULT_P2P_UPSPEED_LIMIT)
 	cs.ConfigValue.Set(P2P_MERGE_PIECE, 0)
 	cs.ConfigValue.Set(P2P_DOWNLOAD_CACHE, 0)
+	cs.ConfigValue.Set(EXPAND_MAX_FAIL_TIMES_KEY, DEFAULT_EXPAND_MAX_FAIL_TIMES)
+	cs.ConfigValue.Set(SCHED_BANDWIDTH_PERCENT_KEY, DEFAULT_SCHED_BANDWIDTH_PERCENT)
+	cs.ConfigValue.Set(SCHED_ROUTINE_PERCENT_KEY, DEFAULT_SCHED_ROUTINE_PERCENT)
+	cs.ConfigValue.Set(SCHED_GROUP_HOUR_BYTES_KEY, DEFAULT_SCHED_GROUP_HOUR_BYTES)
+	cs.ConfigValue.Set(NODE_LOSS_HOURS_KEY, DEFAULT_NODE_LOSS_HOURS)
+	cs.ConfigValue.Set(REPAIR_HOURS_KEY, DEFAULT_REPAIR_HOURS)
+	cs.ConfigValue.Set(NODE_HISTORY_DAYS_KEY, DEFAULT_NODE_HISTORY_DAYS)
+	cs.ConfigValue.Set(EVICT_USAGE_PERCENT_KEY, DEFAULT_EVICT_USAGE_PERCENT)
+	cs.ConfigValue.Set(ADMISSION_MODE_KEY, DEFAULT_ADMISSION_MODE)
+	cs.ConfigValue.Set(CAPACITY_WARN_PERCENT_KEY, DEFAULT_CAPACITY_WARN_PERCENT)
+	cs.ConfigValue.Set(CAPACITY_WARN_HOURS_KEY, DEFAULT_CAPACITY_WARN_HOURS)
+	cs.ConfigValue.Set(CAPACITY_FORECAST_HOURS_KEY, DEFAULT_CAPACITY_FORECAST_HOURS)
+	cs.ConfigValue.Set(INGEST_MAX_HOURS_KEY, DEFAULT_INGEST_MAX_HOURS)
 }
 
 func (cs *ConfigSet) FlushConfigValue() (err error) {
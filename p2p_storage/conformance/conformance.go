@@ -0,0 +1,242 @@
+/*
+IDataSource一致性测试套件。
+
+idata_source.go中很多语义只在注释里约定（例如未找到时返回nil,nil、ListUpdatedFiles按版本号升序、
+GetNoFileNodes包含离线节点等），新的存储后端很容易写错。本包把这些约定写成测试，任何后端都可以复用：
+
+	func TestConformance(t *testing.T) {
+		conformance.RunSuite(t, func() p2p_storage.IDataSource {
+			return mem_source.New()
+		})
+	}
+
+newDS每次调用都必须返回一个空的数据源（redis、mysql后端可以在这里清库）。
+*/
+package conformance
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+//测试锁使用的db，与p2p_storage中的redis_db.CACHE_THUNDER_REQUEST_POOL无关
+const LOCK_DB = 0
+
+type testCase struct {
+	name string
+	run  func(t *testing.T, ds p2p_storage.IDataSource)
+}
+
+var cases = []testCase{
+	{"IncrID", testIncrID},
+	{"AtomicIncrIDConcurrent", testAtomicIncrIDConcurrent},
+	{"Lock", testLock},
+	{"LockMutualExclusion", testLockMutualExclusion},
+	{"CheckedTime", testCheckedTime},
+	{"Checksum", testChecksum},
+	{"Node", testNode},
+	{"AllNode", testAllNode},
+	{"TimeoutNodes", testTimeoutNodes},
+	{"Group", testGroup},
+	{"GroupNode", testGroupNode},
+	{"GroupFile", testGroupFile},
+	{"ListUpdatedFiles", testListUpdatedFiles},
+	{"ExpandNode", testExpandNode},
+	{"TimeoutExpandTask", testTimeoutExpandTask},
+	{"UnSafeExpandNode", testUnSafeExpandNode},
+	{"AvailableNodes", testAvailableNodes},
+	{"NodeOnline", testNodeOnline},
+	{"UPNPAvailableNodes", testUPNPAvailableNodes},
+	{"CanDelTimeoutNodes", testCanDelTimeoutNodes},
+	{"SourceFile", testSourceFile},
+	{"Config", testConfig},
+	{"AvailableGroup", testAvailableGroup},
+	{"NodeGroupDetail", testNodeGroupDetail},
+	{"FirstFinishExpand", testFirstFinishExpand},
+	{"TaskProcessSlow", testTaskProcessSlow},
+	{"GroupFileUpdate", testGroupFileUpdate},
+	{"NewAddTimeOutGroupFile", testNewAddTimeOutGroupFile},
+	{"ExpandNodeUpdate", testExpandNodeUpdate},
+	{"TaskNode", testTaskNode},
+}
+
+/*
+	IDataSource中只有读取没有写入的数据（例如源文件、配置、任务节点）由其他系统或者非接口方法写入，
+	后端实现了下面的接口时才检查读到的内容，否则只检查空数据时的约定
+*/
+type Seeder interface {
+	AddSourceFile(nid, md5 string) error
+	SetConfig(key string, value interface{}) error
+}
+
+type TaskNodeReader interface {
+	GetTaskNodes(task_id uint64) []p2p_storage.TaskNode
+}
+
+/*
+	对newDS返回的数据源执行全部一致性测试，每个用例使用一个新的数据源
+*/
+func RunSuite(t *testing.T, newDS func() p2p_storage.IDataSource) {
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			c.run(t, newDS())
+		})
+	}
+}
+
+func check(t *testing.T, e error, what string) {
+	t.Helper()
+	if e != nil {
+		t.Fatalf("%s error: %v", what, e)
+	}
+}
+
+func testIncrID(t *testing.T, ds p2p_storage.IDataSource) {
+	id, e := ds.GetIncrID("conformance")
+	check(t, e, "GetIncrID")
+	if id != 0 {
+		t.Errorf("GetIncrID of missing key = %d, want 0", id)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		id, e = ds.AtomicIncrID("conformance")
+		check(t, e, "AtomicIncrID")
+		if id != i {
+			t.Errorf("AtomicIncrID = %d, want %d", id, i)
+		}
+	}
+	if id, _ = ds.GetIncrID("conformance"); id != 3 {
+		t.Errorf("GetIncrID = %d, want 3", id)
+	}
+	if id, _ = ds.GetIncrID("other"); id != 0 {
+		t.Errorf("keys are not independent, GetIncrID(other) = %d", id)
+	}
+}
+
+func testAtomicIncrIDConcurrent(t *testing.T, ds p2p_storage.IDataSource) {
+	const workers, times = 20, 50
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	seen := make(map[uint64]bool, workers*times)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < times; j++ {
+				id, e := ds.AtomicIncrID("concurrent")
+				if e != nil {
+					t.Errorf("AtomicIncrID error: %v", e)
+					return
+				}
+				lock.Lock()
+				if seen[id] {
+					t.Errorf("AtomicIncrID returned duplicated id %d", id)
+				}
+				seen[id] = true
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for i := uint64(1); i <= workers*times; i++ {
+		if !seen[i] {
+			t.Fatalf("AtomicIncrID skipped id %d", i)
+		}
+	}
+}
+
+func testLock(t *testing.T, ds p2p_storage.IDataSource) {
+	if !ds.GetLock(LOCK_DB, "conformance", 10, 1) {
+		t.Fatal("GetLock on free key failed")
+	}
+	start := time.Now()
+	if ds.GetLock(LOCK_DB, "conformance", 10, 1) {
+		t.Fatal("GetLock on held key succeeded")
+	}
+	if time.Since(start) < 500*time.Millisecond {
+		t.Error("GetLock returned before timeout")
+	}
+	if !ds.GetLock(LOCK_DB, "another", 10, 1) {
+		t.Error("GetLock on another key failed")
+	}
+	check(t, ds.UnLock(LOCK_DB, "conformance"), "UnLock")
+	if !ds.GetLock(LOCK_DB, "conformance", 10, 1) {
+		t.Error("GetLock after UnLock failed")
+	}
+	ds.UnLock(LOCK_DB, "conformance")
+	ds.UnLock(LOCK_DB, "another")
+
+	//过期的锁可以被重新获取
+	if !ds.GetLock(LOCK_DB, "expire", 1, 1) {
+		t.Fatal("GetLock on free key failed")
+	}
+	if !ds.GetLock(LOCK_DB, "expire", 1, 3) {
+		t.Error("GetLock after expiration failed")
+	}
+	ds.UnLock(LOCK_DB, "expire")
+}
+
+func testLockMutualExclusion(t *testing.T, ds p2p_storage.IDataSource) {
+	const workers = 10
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	holders, max := 0, 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !ds.GetLock(LOCK_DB, "mutex", 10, 10) {
+				t.Error("GetLock timeout")
+				return
+			}
+			lock.Lock()
+			holders++
+			if holders > max {
+				max = holders
+			}
+			lock.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			lock.Lock()
+			holders--
+			lock.Unlock()
+			if e := ds.UnLock(LOCK_DB, "mutex"); e != nil {
+				t.Errorf("UnLock error: %v", e)
+			}
+		}()
+	}
+	wg.Wait()
+	if max != 1 {
+		t.Errorf("%d goroutines held the lock at the same time", max)
+	}
+}
+
+func testCheckedTime(t *testing.T, ds p2p_storage.IDataSource) {
+	check(t, ds.UpdateTimeoutNodeCheckedTime(100), "UpdateTimeoutNodeCheckedTime")
+	if tm, e := ds.GetTimeoutNodeCheckedTime(); e != nil || tm != 100 {
+		t.Errorf("GetTimeoutNodeCheckedTime = %d, %v, want 100", tm, e)
+	}
+	check(t, ds.UpdateTimeoutExpandTaskCheckedTime(200, 7), "UpdateTimeoutExpandTaskCheckedTime")
+	if tm, id, e := ds.GetTimeoutExpandTaskCheckedTime(); e != nil || tm != 200 || id != 7 {
+		t.Errorf("GetTimeoutExpandTaskCheckedTime = %d, %d, %v, want 200, 7", tm, id, e)
+	}
+	check(t, ds.SetAtomicGetLastCheckerTm("checker", 300, 60), "SetAtomicGetLastCheckerTm")
+	if tm, e := ds.GetAtomicLastCheckerTm("checker"); e != nil || tm != 300 {
+		t.Errorf("GetAtomicLastCheckerTm = %d, %v, want 300", tm, e)
+	}
+	if tm, e := ds.GetAtomicLastCheckerTm("missing"); e != nil || tm != 0 {
+		t.Errorf("GetAtomicLastCheckerTm of missing key = %d, %v, want 0", tm, e)
+	}
+}
+
+func testChecksum(t *testing.T, ds p2p_storage.IDataSource) {
+	if sum, e := ds.GetChecksum("md5"); e != nil || sum != "" {
+		t.Errorf("GetChecksum of missing md5 = %q, %v, want empty", sum, e)
+	}
+	check(t, ds.UpdateChecksum("md5", "sum1"), "UpdateChecksum")
+	check(t, ds.UpdateChecksum("md5", "sum2"), "UpdateChecksum")
+	if sum, _ := ds.GetChecksum("md5"); sum != "sum2" {
+		t.Errorf("GetChecksum = %q, want sum2", sum)
+	}
+}
@@ -0,0 +1,223 @@
+package conformance
+
+import (
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+func newExpandNode(gid, nid, md5 string, state int8, timeout int64) *p2p_storage.ExpandNode {
+	return &p2p_storage.ExpandNode{Group: gid, Node: nid, MD5: md5, State: state, Tm: time.Now().Unix(), Timeout: timeout, Size: 10}
+}
+
+func testExpandNode(t *testing.T, ds p2p_storage.IDataSource) {
+	future := time.Now().Unix() + 3600
+	exNode, e := ds.GetExpandNode("g1", "n1", "m1")
+	check(t, e, "GetExpandNode")
+	if exNode != nil {
+		t.Fatal("GetExpandNode of missing task should return nil, nil")
+	}
+	if exNode, _ = ds.GetExpandNodeById(12345); exNode != nil {
+		t.Fatal("GetExpandNodeById of missing task should return nil, nil")
+	}
+
+	id1, e := ds.AddOrUpdateExpandNode(newExpandNode("g1", "n1", "m1", p2p_storage.EXPAND_STATE_INIT, future))
+	check(t, e, "AddOrUpdateExpandNode")
+	id2, e := ds.AddOrUpdateExpandNode(newExpandNode("g1", "n2", "m1", p2p_storage.EXPAND_STATE_INIT, future))
+	check(t, e, "AddOrUpdateExpandNode")
+	if id1 <= 0 || id1 == id2 {
+		t.Fatalf("AddOrUpdateExpandNode returned ids %d, %d", id1, id2)
+	}
+	//同一个(gid, nid, md5)更新而不是新增
+	id, e := ds.AddOrUpdateExpandNode(newExpandNode("g1", "n1", "m1", p2p_storage.EXPAND_STATE_NOTIFIED, future))
+	check(t, e, "AddOrUpdateExpandNode")
+	if id != id1 {
+		t.Errorf("AddOrUpdateExpandNode on existing task returned id %d, want %d", id, id1)
+	}
+	exNode, e = ds.GetExpandNodeById(uint64(id1))
+	check(t, e, "GetExpandNodeById")
+	if exNode == nil || exNode.Node != "n1" || exNode.State != p2p_storage.EXPAND_STATE_NOTIFIED {
+		t.Fatalf("GetExpandNodeById = %+v", exNode)
+	}
+
+	tasks, e := ds.GetExpandTasks("n2", p2p_storage.EXPAND_STATE_INIT, 10)
+	check(t, e, "GetExpandTasks")
+	if len(tasks) != 1 || tasks[0].ID != uint64(id2) {
+		t.Errorf("GetExpandTasks = %v", tasks)
+	}
+	if cnt, _ := ds.GetExpandTaskCount("n1"); cnt != 1 {
+		t.Errorf("GetExpandTaskCount = %d, want 1", cnt)
+	}
+
+	check(t, ds.UpdateExpandNodeState("g1", "n1", "m1", p2p_storage.EXPAND_STATE_FAILED, time.Now().Unix(), true), "UpdateExpandNodeState")
+	exNode, _ = ds.GetExpandNode("g1", "n1", "m1")
+	if exNode.State != p2p_storage.EXPAND_STATE_FAILED || exNode.FailedTimes != 1 {
+		t.Errorf("UpdateExpandNodeState: %+v", exNode)
+	}
+	if times, _ := ds.GetExpandTaskTotalFailedTimes("g1", "m1"); times != 1 {
+		t.Errorf("GetExpandTaskTotalFailedTimes = %d, want 1", times)
+	}
+	//失败的任务不再是有效任务
+	valid, e := ds.GetValidExpandNodes("g1", "m1")
+	check(t, e, "GetValidExpandNodes")
+	if len(valid) != 1 || valid[0].Node != "n2" {
+		t.Errorf("GetValidExpandNodes = %v", valid)
+	}
+
+	check(t, ds.SetExpandNodeStateFailed("n2"), "SetExpandNodeStateFailed")
+	if valid, _ = ds.GetValidExpandNodes("g1", "m1"); len(valid) != 0 {
+		t.Errorf("GetValidExpandNodes after SetExpandNodeStateFailed = %v", valid)
+	}
+
+	check(t, ds.DeleteExpandNodeById(uint64(id2)), "DeleteExpandNodeById")
+	if exNode, _ = ds.GetExpandNodeById(uint64(id2)); exNode != nil {
+		t.Error("GetExpandNodeById returned deleted task")
+	}
+	check(t, ds.DeleteExpandNodeByMd5("m1"), "DeleteExpandNodeByMd5")
+	if exNode, _ = ds.GetExpandNode("g1", "n1", "m1"); exNode != nil {
+		t.Error("GetExpandNode returned task deleted by md5")
+	}
+}
+
+func testTimeoutExpandTask(t *testing.T, ds p2p_storage.IDataSource) {
+	//n1、n2的超时时间相同
+	timeouts := []int64{1000, 1000, 1010, 1020}
+	ids := make([]int64, 0, len(timeouts))
+	for i, nid := range []string{"n1", "n2", "n3", "n4"} {
+		id, e := ds.AddOrUpdateExpandNode(newExpandNode("g1", nid, "m1", p2p_storage.EXPAND_STATE_STARTED, timeouts[i]))
+		check(t, e, "AddOrUpdateExpandNode")
+		ids = append(ids, id)
+	}
+	tasks, e := ds.GetTimeoutExpandTask(0, 1010, 0, 10)
+	check(t, e, "GetTimeoutExpandTask")
+	if len(tasks) != 3 || tasks[0].Timeout > tasks[1].Timeout || tasks[1].Timeout > tasks[2].Timeout {
+		t.Fatalf("GetTimeoutExpandTask = %v", tasks)
+	}
+	//从(1000, n1)继续分页
+	if tasks, _ = ds.GetTimeoutExpandTask(1000, 1020, ids[0], 1); len(tasks) != 1 || tasks[0].ID != uint64(ids[1]) {
+		t.Errorf("GetTimeoutExpandTask page = %v, want task %d", tasks, ids[1])
+	}
+	if tasks, _ = ds.GetTimeoutExpandTask(1000, 1020, ids[1], 10); len(tasks) != 2 {
+		t.Errorf("GetTimeoutExpandTask after last id = %v", tasks)
+	}
+}
+
+func testUnSafeExpandNode(t *testing.T, ds p2p_storage.IDataSource) {
+	if exNode, e := ds.GetUnSafeExpandNodeById(12345); e != nil || exNode != nil {
+		t.Fatalf("GetUnSafeExpandNodeById of missing task = %+v, %v", exNode, e)
+	}
+	check(t, ds.AddOrUpdateUnSafeFile("g1", "m1"), "AddOrUpdateUnSafeFile")
+	exNodes := []p2p_storage.UnSafeExpandNode{
+		{Group: "g1", Node: "n1", MD5: "m1", State: p2p_storage.UNSAFE_EXPAND_STATE_INIT, Tm: time.Now().Unix()},
+		{Group: "g1", Node: "n2", MD5: "m1", State: p2p_storage.UNSAFE_EXPAND_STATE_INIT, Tm: time.Now().Unix()},
+	}
+	check(t, ds.AddOrUpdateUnSafeExpandNodes(exNodes), "AddOrUpdateUnSafeExpandNodes")
+	check(t, ds.AddOrUpdateUnSafeExpandNodes(exNodes[:1]), "AddOrUpdateUnSafeExpandNodes")
+	all, e := ds.GetUnSafeFileExpandNode()
+	check(t, e, "GetUnSafeFileExpandNode")
+	if len(all) != 2 {
+		t.Fatalf("GetUnSafeFileExpandNode returned %d tasks, want 2", len(all))
+	}
+	tasks, e := ds.GetUnSafeExpandTasks("n1", p2p_storage.UNSAFE_EXPAND_STATE_INIT, 10)
+	check(t, e, "GetUnSafeExpandTasks")
+	if len(tasks) != 1 {
+		t.Fatalf("GetUnSafeExpandTasks = %v", tasks)
+	}
+	check(t, ds.UpdateUnSafeExpandNodeState(tasks[0].ID, p2p_storage.UNSAFE_EXPAND_STATE_FINISHED), "UpdateUnSafeExpandNodeState")
+	if exNode, _ := ds.GetUnSafeExpandNodeById(tasks[0].ID); exNode == nil || exNode.State != p2p_storage.UNSAFE_EXPAND_STATE_FINISHED {
+		t.Errorf("GetUnSafeExpandNodeById = %+v", exNode)
+	}
+	nids, e := ds.GetHasUnSafeFileNode("g1", "m1", 10, []string{"n2"})
+	check(t, e, "GetHasUnSafeFileNode")
+	for _, nid := range nids {
+		if nid == "n2" {
+			t.Error("GetHasUnSafeFileNode returned excluded node")
+		}
+	}
+	check(t, ds.DeleteUnSafeFileExpandNode("g1", "n2", "m1"), "DeleteUnSafeFileExpandNode")
+	if all, _ = ds.GetUnSafeFileExpandNode(); len(all) != 1 {
+		t.Errorf("GetUnSafeFileExpandNode after delete = %v", all)
+	}
+	check(t, ds.DeleteUnSafeFile("g1", "m1"), "DeleteUnSafeFile")
+}
+
+func testExpandNodeUpdate(t *testing.T, ds p2p_storage.IDataSource) {
+	now := time.Now().Unix()
+	future := now + 3600
+	add := func(nid, md5 string, state int8, tm int64) uint64 {
+		exNode := newExpandNode("g1", nid, md5, state, future)
+		exNode.Tm = tm
+		id, e := ds.AddOrUpdateExpandNode(exNode)
+		check(t, e, "AddOrUpdateExpandNode")
+		return uint64(id)
+	}
+	id1 := add("n1", "m1", p2p_storage.EXPAND_STATE_INIT, now)
+	id2 := add("n1", "m2", p2p_storage.EXPAND_STATE_STARTED, now-100)
+	id3 := add("n1", "m3", p2p_storage.EXPAND_STATE_FINISHED, now)
+	id4 := add("n2", "m1", p2p_storage.EXPAND_STATE_INIT, now)
+
+	//只更新节点未结束的任务
+	check(t, ds.UpdateExpandNodesState("n1", p2p_storage.EXPAND_STATE_NOTIFIED, future+100), "UpdateExpandNodesState")
+	for _, id := range []uint64{id1, id2} {
+		if exNode, _ := ds.GetExpandNodeById(id); exNode == nil || exNode.State != p2p_storage.EXPAND_STATE_NOTIFIED || exNode.Timeout != future+100 {
+			t.Errorf("UpdateExpandNodesState: %+v", exNode)
+		}
+	}
+	if exNode, _ := ds.GetExpandNodeById(id3); exNode == nil || exNode.State != p2p_storage.EXPAND_STATE_FINISHED {
+		t.Errorf("UpdateExpandNodesState changed finished task: %+v", exNode)
+	}
+	if exNode, _ := ds.GetExpandNodeById(id4); exNode == nil || exNode.State != p2p_storage.EXPAND_STATE_INIT {
+		t.Errorf("UpdateExpandNodesState changed task of another node: %+v", exNode)
+	}
+
+	check(t, ds.UpdateExpandNodeTimeout(id4, future+200), "UpdateExpandNodeTimeout")
+	if exNode, _ := ds.GetExpandNodeById(id4); exNode == nil || exNode.Timeout != future+200 {
+		t.Errorf("UpdateExpandNodeTimeout: %+v", exNode)
+	}
+
+	check(t, ds.DeleteExpandNode("g1", "n1", "m1"), "DeleteExpandNode")
+	if exNode, _ := ds.GetExpandNode("g1", "n1", "m1"); exNode != nil {
+		t.Error("GetExpandNode returned deleted task")
+	}
+	if exNode, _ := ds.GetExpandNode("g1", "n2", "m1"); exNode == nil {
+		t.Error("DeleteExpandNode deleted task of another node")
+	}
+
+	//删除创建时间早于tm的任务
+	check(t, ds.DeleteExpandNodeByTimeOut(uint64(now-50)), "DeleteExpandNodeByTimeOut")
+	if exNode, _ := ds.GetExpandNodeById(id2); exNode != nil {
+		t.Error("DeleteExpandNodeByTimeOut kept old task")
+	}
+	if exNode, _ := ds.GetExpandNodeById(id4); exNode == nil {
+		t.Error("DeleteExpandNodeByTimeOut deleted new task")
+	}
+
+	check(t, ds.AddToInvalidFile("n1", "g1", "m1", now), "AddToInvalidFile")
+}
+
+func testTaskNode(t *testing.T, ds p2p_storage.IDataSource) {
+	id, e := ds.AddOrUpdateExpandNode(newExpandNode("g1", "n1", "m1", p2p_storage.EXPAND_STATE_INIT, time.Now().Unix()+3600))
+	check(t, e, "AddOrUpdateExpandNode")
+	check(t, ds.DeleteTaskNodeByTask(uint64(id)), "DeleteTaskNodeByTask")
+	check(t, ds.AddTaskNode(uint64(id), []string{"n2", "n3"}), "AddTaskNode")
+	reader, ok := ds.(TaskNodeReader)
+	if !ok {
+		check(t, ds.DeleteTaskNodeByTask(uint64(id)), "DeleteTaskNodeByTask")
+		t.Skip("data source does not implement TaskNodeReader")
+	}
+	nodes := reader.GetTaskNodes(uint64(id))
+	nids := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		if n.ID != uint64(id) {
+			t.Errorf("task node %+v of task %d", n, id)
+		}
+		nids = append(nids, n.Node)
+	}
+	if !sameSet(nids, "n2", "n3") {
+		t.Errorf("GetTaskNodes = %v, want n2, n3", nids)
+	}
+	check(t, ds.DeleteTaskNodeByTask(uint64(id)), "DeleteTaskNodeByTask")
+	if nodes = reader.GetTaskNodes(uint64(id)); len(nodes) != 0 {
+		t.Errorf("GetTaskNodes after DeleteTaskNodeByTask = %v", nodes)
+	}
+}
@@ -0,0 +1,435 @@
+package conformance
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+func newGroup(id string) *p2p_storage.Group {
+	return &p2p_storage.Group{ID: id, FileSize: 1024, PieceSize: 1024, MinPieces: 4, SafePieces: 6, PerfectPieces: 8}
+}
+
+func newGroupFile(md5 string, size, ver uint64, tp int, addVer uint64) *p2p_storage.GroupFile {
+	return &p2p_storage.GroupFile{File: p2p_storage.File{MD5: md5, Size: size}, Ver: ver, State: p2p_storage.NORMAL, Type: tp, AddVer: addVer}
+}
+
+func testGroup(t *testing.T, ds p2p_storage.IDataSource) {
+	group, e := ds.GetGroup("g1")
+	check(t, e, "GetGroup")
+	if group != nil {
+		t.Fatal("GetGroup of missing group should return nil, nil")
+	}
+	check(t, ds.AddGroup(newGroup("g1")), "AddGroup")
+	check(t, ds.AddGroup(newGroup("g2")), "AddGroup")
+	group, e = ds.GetGroup("g1")
+	check(t, e, "GetGroup")
+	if group == nil || group.ID != "g1" || group.MinPieces != 4 || group.SafePieces != 6 {
+		t.Fatalf("GetGroup = %+v", group)
+	}
+	check(t, ds.UpdateGroupSize(group, 100), "UpdateGroupSize")
+	check(t, ds.UpdateGroupSize(group, -30), "UpdateGroupSize")
+	if group, _ = ds.GetGroup("g1"); group.Size != 70 {
+		t.Errorf("group size = %d, want 70", group.Size)
+	}
+	check(t, ds.UpdateGroupFirstFinishVer("g1", 9), "UpdateGroupFirstFinishVer")
+	if group, _ = ds.GetGroup("g1"); group.FirstFinishVer != 9 {
+		t.Errorf("FirstFinishVer = %d, want 9", group.FirstFinishVer)
+	}
+	groups, e := ds.GetAllGroup()
+	check(t, e, "GetAllGroup")
+	if len(groups) != 2 || groups["g2"].ID != "g2" {
+		t.Errorf("GetAllGroup = %v", groups)
+	}
+}
+
+func testGroupNode(t *testing.T, ds p2p_storage.IDataSource) {
+	check(t, ds.AddGroup(newGroup("g1")), "AddGroup")
+	for _, id := range []string{"n1", "n2", "n3"} {
+		check(t, ds.AddNode(newNode(id, time.Now().UnixNano())), "AddNode")
+	}
+	check(t, ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n1", Ver: 5, State: p2p_storage.ONLINE}), "AddNodeToGroup")
+	check(t, ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n2", Ver: 3, State: p2p_storage.ONLINE}), "AddNodeToGroup")
+	check(t, ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n3", Ver: 1, State: p2p_storage.OFFLINE}), "AddNodeToGroup")
+
+	//版本号>=ver的在线节点
+	peers, e := ds.GetFileNodes("g1", 3)
+	check(t, e, "GetFileNodes")
+	if len(peers) != 2 {
+		t.Errorf("GetFileNodes(3) returned %d peers, want 2", len(peers))
+	}
+	if peers, _ = ds.GetFileNodes("g1", 1); len(peers) != 2 {
+		t.Errorf("GetFileNodes should skip offline nodes, got %v", peers)
+	}
+	//版本号<ver的节点，包括离线的
+	nids, e := ds.GetNoFileNodes("g1", 5)
+	check(t, e, "GetNoFileNodes")
+	if !sameSet(nids, "n2", "n3") {
+		t.Errorf("GetNoFileNodes(5) = %v, want n2, n3", nids)
+	}
+	if nids, _ = ds.GetAllFileNodes("g1"); !sameSet(nids, "n1", "n2", "n3") {
+		t.Errorf("GetAllFileNodes = %v", nids)
+	}
+	if num, _ := ds.GetGroupOnlineNodesCount("g1"); num != 2 {
+		t.Errorf("GetGroupOnlineNodesCount = %d, want 2", num)
+	}
+	if cnt, _ := ds.GetFileNodesCountByVer("g1", 3); cnt != 2 {
+		t.Errorf("GetFileNodesCountByVer(3) = %d, want 2", cnt)
+	}
+	if num, _ := ds.GetNodeCountByVerAndState("g1", 1, p2p_storage.OFFLINE); num != 1 {
+		t.Errorf("GetNodeCountByVerAndState(OFFLINE) = %d, want 1", num)
+	}
+	if ver, _ := ds.GetGroupFileVer("g1", "n1"); ver != 5 {
+		t.Errorf("GetGroupFileVer = %d, want 5", ver)
+	}
+	if num, _ := ds.GetNodeGroupCount("n1"); num != 1 {
+		t.Errorf("GetNodeGroupCount = %d, want 1", num)
+	}
+	if node, _ := ds.GetRandomGroupNode("g1"); node == nil || node.State != p2p_storage.ONLINE {
+		t.Errorf("GetRandomGroupNode = %+v, want an online node", node)
+	}
+
+	check(t, ds.UpdateGroupNode("g1", &p2p_storage.GroupNode{Node: "n2", Ver: 6, State: p2p_storage.OFFLINE}, true), "UpdateGroupNode")
+	states, e := ds.GetNodeGroupState("n2")
+	check(t, e, "GetNodeGroupState")
+	if n := states["g1"]; n.Ver != 6 || n.State != p2p_storage.OFFLINE {
+		t.Errorf("GetNodeGroupState = %+v", states)
+	}
+	groups, e := ds.GetNodeGroups("n2")
+	check(t, e, "GetNodeGroups")
+	if len(groups) != 1 || groups[0].ID != "g1" {
+		t.Errorf("GetNodeGroups = %v", groups)
+	}
+
+	check(t, ds.DeleteGroupNode("g1", "n3"), "DeleteGroupNode")
+	if nids, _ = ds.GetAllFileNodes("g1"); !sameSet(nids, "n1", "n2") {
+		t.Errorf("GetAllFileNodes after delete = %v", nids)
+	}
+	if num, _ := ds.GetNodeGroupCount("n3"); num != 0 {
+		t.Errorf("GetNodeGroupCount after delete = %d, want 0", num)
+	}
+}
+
+func testGroupFile(t *testing.T, ds p2p_storage.IDataSource) {
+	check(t, ds.AddGroup(newGroup("g1")), "AddGroup")
+	check(t, ds.AddGroup(newGroup("g2")), "AddGroup")
+	file, e := ds.GetGroupFile("g1", "m1")
+	check(t, e, "GetGroupFile")
+	if file != nil {
+		t.Fatal("GetGroupFile of missing file should return nil, nil")
+	}
+	check(t, ds.AddFileToGroup("g1", newGroupFile("m1", 100, 1, p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST, 0)), "AddFileToGroup")
+	check(t, ds.AddFileToGroup("g1", newGroupFile("m2", 50, 2, p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST, 0)), "AddFileToGroup")
+	check(t, ds.AddFileToGroup("g2", newGroupFile("m1", 100, 1, p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST, 0)), "AddFileToGroup")
+	file, e = ds.GetGroupFile("g1", "m1")
+	check(t, e, "GetGroupFile")
+	if file == nil || file.Size != 100 || file.Ver != 1 || file.Group != "g1" || file.State != p2p_storage.NORMAL {
+		t.Fatalf("GetGroupFile = %+v", file)
+	}
+
+	check(t, ds.CalculateGroupSize("g1"), "CalculateGroupSize")
+	if g, _ := ds.GetGroup("g1"); g.Size != 150 {
+		t.Errorf("CalculateGroupSize = %d, want 150", g.Size)
+	}
+	if cnt, _ := ds.GetFileGroupsCount("m1"); cnt != 2 {
+		t.Errorf("GetFileGroupsCount = %d, want 2", cnt)
+	}
+
+	//删除的文件不计入分组大小和分组数量
+	file.State = p2p_storage.DELETED
+	check(t, ds.UpdateGroupFile("g1", file), "UpdateGroupFile")
+	check(t, ds.CalculateGroupSize("g1"), "CalculateGroupSize")
+	if g, _ := ds.GetGroup("g1"); g.Size != 50 {
+		t.Errorf("CalculateGroupSize after delete = %d, want 50", g.Size)
+	}
+	if cnt, _ := ds.GetFileGroupsCount("m1"); cnt != 1 {
+		t.Errorf("GetFileGroupsCount after delete = %d, want 1", cnt)
+	}
+	if files, _ := ds.GetFileGroups("m1", p2p_storage.ALL); len(files) != 2 {
+		t.Errorf("GetFileGroups(ALL) = %v", files)
+	}
+	if files, _ := ds.GetFileGroups("m1", p2p_storage.NORMAL); len(files) != 1 || files["g2"].Group != "g2" {
+		t.Errorf("GetFileGroups(NORMAL) = %v", files)
+	}
+	if files, _ := ds.GetFileByMd5AndState("m1", p2p_storage.DELETED); len(files) != 1 || files[0].Group != "g1" {
+		t.Errorf("GetFileByMd5AndState(DELETED) = %v", files)
+	}
+	m, e := ds.GetMoreFileGroupsCount([]string{"m1", "m2", "m3"})
+	check(t, e, "GetMoreFileGroupsCount")
+	if !m["m1"] || !m["m2"] || m["m3"] {
+		t.Errorf("GetMoreFileGroupsCount = %v", m)
+	}
+
+	check(t, ds.IncrFileVer("g1", "m2", 8), "IncrFileVer")
+	if file, _ = ds.GetGroupFile("g1", "m2"); file.Ver != 8 {
+		t.Errorf("IncrFileVer: ver = %d, want 8", file.Ver)
+	}
+	check(t, ds.DeleteGroupFile("g1", "m2"), "DeleteGroupFile")
+	if file, _ = ds.GetGroupFile("g1", "m2"); file != nil {
+		t.Error("GetGroupFile returned deleted file")
+	}
+}
+
+func testListUpdatedFiles(t *testing.T, ds p2p_storage.IDataSource) {
+	check(t, ds.AddGroup(newGroup("g1")), "AddGroup")
+	//乱序插入，返回时必须按版本号升序
+	for _, v := range []uint64{3, 1, 5, 2, 4} {
+		md5 := string(rune('a' + v))
+		check(t, ds.AddFileToGroup("g1", newGroupFile(md5, 10, v, p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST, 0)), "AddFileToGroup")
+	}
+	for _, v := range []uint64{2, 1} {
+		md5 := string(rune('x' + v))
+		check(t, ds.AddFileToGroup("g1", newGroupFile(md5, 10, 0, p2p_storage.GROUPFILE_TYPE_NEW_ADD, v)), "AddFileToGroup")
+	}
+	files, e := ds.ListUpdatedFiles("g1", 1, 3, p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST)
+	check(t, e, "ListUpdatedFiles")
+	if len(files) != 3 {
+		t.Fatalf("ListUpdatedFiles returned %d files, want 3", len(files))
+	}
+	for i, f := range files {
+		if f.Ver != uint64(i+2) {
+			t.Errorf("ListUpdatedFiles[%d].Ver = %d, want %d", i, f.Ver, i+2)
+		}
+		if f.Type != p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST {
+			t.Errorf("ListUpdatedFiles returned file of type %d", f.Type)
+		}
+	}
+	files, e = ds.ListUpdatedFiles("g1", 0, 10, p2p_storage.GROUPFILE_TYPE_NEW_ADD)
+	check(t, e, "ListUpdatedFiles")
+	if len(files) != 2 || files[0].AddVer != 1 || files[1].AddVer != 2 {
+		t.Errorf("ListUpdatedFiles(NEW_ADD) = %v", files)
+	}
+	if files, _ = ds.ListUpdatedFiles("g1", 5, 10, p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST); len(files) != 0 {
+		t.Errorf("ListUpdatedFiles after last version = %v", files)
+	}
+}
+
+func testAvailableGroup(t *testing.T, ds p2p_storage.IDataSource) {
+	group, e := ds.GetAvailableGroup(1024)
+	check(t, e, "GetAvailableGroup")
+	if group != nil {
+		t.Fatalf("GetAvailableGroup without groups = %+v, want nil", group)
+	}
+	capacity := 4 * p2p_storage.GROUP_NODE_CAPACITY
+	sizes := map[string]uint64{"g1": 100, "g2": 50, "g3": 10, "g4": capacity}
+	for _, gid := range []string{"g1", "g2", "g3", "g4"} {
+		g := newGroup(gid)
+		if gid == "g3" {
+			g.FileSize = 2048
+		}
+		check(t, ds.AddGroup(g), "AddGroup")
+		check(t, ds.UpdateGroupSize(g, int64(sizes[gid])), "UpdateGroupSize")
+	}
+	//同一个文件大小范围中未满的最小分组
+	group, e = ds.GetAvailableGroup(1024)
+	check(t, e, "GetAvailableGroup")
+	if group == nil || group.ID != "g2" {
+		t.Errorf("GetAvailableGroup = %+v, want g2", group)
+	}
+	if group, _ = ds.GetAvailableGroup(4096); group != nil {
+		t.Errorf("GetAvailableGroup of another file size = %+v, want nil", group)
+	}
+
+	counts, e := ds.GetActiveGroupsCount(capacity)
+	check(t, e, "GetActiveGroupsCount")
+	if len(counts) != 2 || counts[1024] != 2 || counts[2048] != 1 {
+		t.Errorf("GetActiveGroupsCount = %v", counts)
+	}
+	left, e := ds.GetActiveGroupsLeftSpace(capacity)
+	check(t, e, "GetActiveGroupsLeftSpace")
+	if left[1024] != 2*capacity-150 || left[2048] != capacity-10 {
+		t.Errorf("GetActiveGroupsLeftSpace = %v", left)
+	}
+}
+
+func testNodeGroupDetail(t *testing.T, ds p2p_storage.IDataSource) {
+	if g, e := ds.GetRandomNodeGroup("n1"); e != nil || g.ID != "" {
+		t.Errorf("GetRandomNodeGroup of node without groups = %+v, %v", g, e)
+	}
+	full := newGroup("g2")
+	for _, g := range []*p2p_storage.Group{newGroup("g1"), full} {
+		check(t, ds.AddGroup(g), "AddGroup")
+	}
+	check(t, ds.UpdateGroupSize(full, int64(4*p2p_storage.GROUP_NODE_CAPACITY)), "UpdateGroupSize")
+	check(t, ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n2", Ver: 1, State: p2p_storage.OFFLINE}), "AddNodeToGroup")
+	check(t, ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n1", Ver: 3, State: p2p_storage.ONLINE, MaxVer: 5}), "AddNodeToGroup")
+	check(t, ds.AddNodeToGroup("g2", &p2p_storage.GroupNode{Node: "n1", Ver: 2, State: p2p_storage.ONLINE}), "AddNodeToGroup")
+	for i := 0; i < 4; i++ {
+		ds.AtomicIncrID("g1")
+	}
+	ds.AtomicIncrID("add_g1")
+
+	//按节点ID排序
+	nodes, e := ds.GetGroupNodes("g1")
+	check(t, e, "GetGroupNodes")
+	if len(nodes) != 2 || nodes[0].Node != "n1" || nodes[1].Node != "n2" || nodes[0].Ver != 3 {
+		t.Errorf("GetGroupNodes = %v", nodes)
+	}
+	//g2已满
+	for i := 0; i < 5; i++ {
+		if g, _ := ds.GetRandomNodeGroup("n1"); g.ID != "g1" {
+			t.Fatalf("GetRandomNodeGroup = %+v, want g1", g)
+		}
+	}
+
+	details, e := ds.GetNodeGroupDetail("n1")
+	check(t, e, "GetNodeGroupDetail")
+	if len(details) != 2 {
+		t.Fatalf("GetNodeGroupDetail returned %d groups, want 2", len(details))
+	}
+	for _, d := range details {
+		if d.ID == "g1" && (d.FileVer != 4 || d.NodeVer != 3 || d.State != p2p_storage.ONLINE || d.MaxVer != 5 || d.AddVer != 1) {
+			t.Errorf("GetNodeGroupDetail g1 = %+v", d)
+		}
+		if d.ID == "g2" && (d.FileVer != 0 || d.NodeVer != 2) {
+			t.Errorf("GetNodeGroupDetail g2 = %+v", d)
+		}
+	}
+
+	online, e := ds.GetGroupNodeCountByState(p2p_storage.ONLINE)
+	check(t, e, "GetGroupNodeCountByState")
+	if online["g1"] != 1 || online["g2"] != 1 {
+		t.Errorf("GetGroupNodeCountByState(ONLINE) = %v", online)
+	}
+	if offline, _ := ds.GetGroupNodeCountByState(p2p_storage.OFFLINE); offline["g1"] != 1 || offline["g2"] != 0 {
+		t.Errorf("GetGroupNodeCountByState(OFFLINE) = %v", offline)
+	}
+}
+
+func testFirstFinishExpand(t *testing.T, ds p2p_storage.IDataSource) {
+	check(t, ds.AddGroup(newGroup("g1")), "AddGroup")
+	//一个节点版本号落后
+	for i := 0; i < p2p_storage.FIRST_EXPAND_FINISH_NUM; i++ {
+		ver := uint64(5)
+		if i == 0 {
+			ver = 1
+		}
+		check(t, ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: fmt.Sprintf("n%03d", i), Ver: ver, State: p2p_storage.ONLINE}), "AddNodeToGroup")
+	}
+	if finish, e := ds.CheckIsFinishFirstExpand("g1", 1); e != nil || !finish {
+		t.Errorf("CheckIsFinishFirstExpand(1) = %v, %v, want true", finish, e)
+	}
+	if finish, _ := ds.CheckIsFinishFirstExpand("g1", 5); finish {
+		t.Error("CheckIsFinishFirstExpand(5) = true with too few nodes")
+	}
+
+	//需要SafePieces+SafePieces/EXPAND_TASK_FINISH_COUNT_PART个在线节点，返回其中最低的版本号
+	g := newGroup("g2")
+	need := int(g.SafePieces + g.SafePieces/p2p_storage.EXPAND_TASK_FINISH_COUNT_PART)
+	check(t, ds.AddGroup(g), "AddGroup")
+	check(t, ds.AddNodeToGroup("g2", &p2p_storage.GroupNode{Node: "offline", Ver: 100, State: p2p_storage.OFFLINE}), "AddNodeToGroup")
+	for i := 0; i < need-1; i++ {
+		check(t, ds.AddNodeToGroup("g2", &p2p_storage.GroupNode{Node: fmt.Sprintf("n%d", i), Ver: uint64(10 + i), State: p2p_storage.ONLINE}), "AddNodeToGroup")
+	}
+	if ver, e := ds.GetGroupFirstFinishExpandVer("g2"); e != nil || ver != 0 {
+		t.Errorf("GetGroupFirstFinishExpandVer with too few nodes = %d, %v, want 0", ver, e)
+	}
+	check(t, ds.AddNodeToGroup("g2", &p2p_storage.GroupNode{Node: "last", Ver: 3, State: p2p_storage.ONLINE}), "AddNodeToGroup")
+	check(t, ds.AddNodeToGroup("g2", &p2p_storage.GroupNode{Node: "more", Ver: 2, State: p2p_storage.ONLINE}), "AddNodeToGroup")
+	if ver, e := ds.GetGroupFirstFinishExpandVer("g2"); e != nil || ver != 3 {
+		t.Errorf("GetGroupFirstFinishExpandVer = %d, %v, want 3", ver, e)
+	}
+}
+
+func testTaskProcessSlow(t *testing.T, ds p2p_storage.IDataSource) {
+	check(t, ds.AddGroup(newGroup("g1")), "AddGroup")
+	for i := 0; i < 5; i++ {
+		ds.AtomicIncrID("g1")
+	}
+	check(t, ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n1", Ver: 5, State: p2p_storage.ONLINE}), "AddNodeToGroup")
+	check(t, ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n2", Ver: 2, State: p2p_storage.ONLINE}), "AddNodeToGroup")
+	check(t, ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n3", Ver: 3, State: p2p_storage.ONLINE}), "AddNodeToGroup")
+	check(t, ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n4", Ver: 1, State: p2p_storage.OFFLINE}), "AddNodeToGroup")
+
+	now := time.Now().Unix()
+	slow, e := ds.GetGroupNodesTaskProcessSlow(now)
+	check(t, e, "GetGroupNodesTaskProcessSlow")
+	if len(slow) != 0 {
+		t.Errorf("GetGroupNodesTaskProcessSlow right after update = %v", slow)
+	}
+	//超过TASK_PROCESS_SLOW_TM没有更新版本号的在线节点中最落后的
+	slow, e = ds.GetGroupNodesTaskProcessSlow(now + p2p_storage.TASK_PROCESS_SLOW_TM + 10)
+	check(t, e, "GetGroupNodesTaskProcessSlow")
+	if n, ok := slow["g1"]; len(slow) != 1 || !ok || n.Node != "n2" {
+		t.Errorf("GetGroupNodesTaskProcessSlow = %v, want g1: n2", slow)
+	}
+}
+
+func testGroupFileUpdate(t *testing.T, ds p2p_storage.IDataSource) {
+	check(t, ds.AddGroup(newGroup("g1")), "AddGroup")
+	check(t, ds.AddFileToGroup("g1", newGroupFile("m1", 10, 0, p2p_storage.GROUPFILE_TYPE_NEW_ADD, 1)), "AddFileToGroup")
+	for v := uint64(2); v <= 5; v++ {
+		md5 := fmt.Sprintf("m%d", v)
+		check(t, ds.AddFileToGroup("g1", newGroupFile(md5, 10, v, p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST, 0)), "AddFileToGroup")
+	}
+	check(t, ds.AddFileToGroup("g1", newGroupFile("m6", 10, 0, p2p_storage.GROUPFILE_TYPE_NEW_ADD, 2)), "AddFileToGroup")
+
+	//新增文件转为首次扩散类型
+	check(t, ds.UpdateGroupFileTpAndVer("g1", "m1", 7), "UpdateGroupFileTpAndVer")
+	if f, _ := ds.GetGroupFile("g1", "m1"); f == nil || f.Type != p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST || f.Ver != 7 {
+		t.Errorf("UpdateGroupFileTpAndVer: %+v", f)
+	}
+	files, e := ds.GetGroupFileByVer("g1", "n1", 2, 10)
+	check(t, e, "GetGroupFileByVer")
+	if len(files) != 4 || files[0].Ver != 3 || files[3].MD5 != "m1" {
+		t.Errorf("GetGroupFileByVer = %v, want versions 3, 4, 5, 7", files)
+	}
+
+	check(t, ds.UpdateGroupFileStateAndAddVer("g1", "m1", p2p_storage.DELETED, 9), "UpdateGroupFileStateAndAddVer")
+	if f, _ := ds.GetGroupFile("g1", "m1"); f == nil || f.State != p2p_storage.DELETED || f.AddVer != 9 {
+		t.Errorf("UpdateGroupFileStateAndAddVer: %+v", f)
+	}
+	//删除的文件不再返回
+	if files, _ = ds.GetGroupFileByVer("g1", "n1", 2, 2); len(files) != 2 || files[0].Ver != 3 || files[1].Ver != 4 {
+		t.Errorf("GetGroupFileByVer with num = 2 returned %v", files)
+	}
+	if files, _ = ds.GetGroupFileByVer("g1", "n1", 5, 10); len(files) != 0 {
+		t.Errorf("GetGroupFileByVer after last version = %v", files)
+	}
+}
+
+func testNewAddTimeOutGroupFile(t *testing.T, ds p2p_storage.IDataSource) {
+	check(t, ds.AddGroup(newGroup("g1")), "AddGroup")
+	check(t, ds.AddGroup(newGroup("g2")), "AddGroup")
+	add := func(gid, md5 string, tp int, lastAddTm uint64, state int) {
+		f := newGroupFile(md5, 10, 0, tp, 1)
+		f.LastAddTm, f.State = lastAddTm, state
+		check(t, ds.AddFileToGroup(gid, f), "AddFileToGroup")
+	}
+	add("g1", "a", p2p_storage.GROUPFILE_TYPE_NEW_ADD, 100, p2p_storage.NORMAL)
+	add("g1", "b", p2p_storage.GROUPFILE_TYPE_NEW_ADD, 50, p2p_storage.NORMAL)
+	add("g1", "c", p2p_storage.GROUPFILE_TYPE_NEW_ADD, 300, p2p_storage.NORMAL)
+	add("g1", "d", p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST, 10, p2p_storage.NORMAL)
+	add("g1", "e", p2p_storage.GROUPFILE_TYPE_NEW_ADD, 20, p2p_storage.DELETED)
+	add("g2", "f", p2p_storage.GROUPFILE_TYPE_NEW_ADD, 80, p2p_storage.NORMAL)
+
+	//所有分组中LastAddTm<tm的正常新增文件，按LastAddTm从早到晚
+	files, e := ds.GetNewAddTimeOutGroupFile(200, 10)
+	check(t, e, "GetNewAddTimeOutGroupFile")
+	if len(files) != 3 || files[0].MD5 != "b" || files[1].MD5 != "f" || files[2].MD5 != "a" {
+		t.Errorf("GetNewAddTimeOutGroupFile = %v, want b, f, a", files)
+	}
+	if files[1].Group != "g2" {
+		t.Errorf("GetNewAddTimeOutGroupFile returned group %q for f", files[1].Group)
+	}
+	if files, _ = ds.GetNewAddTimeOutGroupFile(200, 2); len(files) != 2 || files[1].MD5 != "f" {
+		t.Errorf("GetNewAddTimeOutGroupFile with num = 2 returned %v", files)
+	}
+}
+
+func sameSet(ids []string, want ...string) bool {
+	if len(ids) != len(want) {
+		return false
+	}
+	m := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		m[id] = true
+	}
+	for _, id := range want {
+		if !m[id] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,288 @@
+package conformance
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+func newNode(id string, updateTm int64) *p2p_storage.NodeDetail {
+	return &p2p_storage.NodeDetail{
+		Peer:         p2p_storage.Peer{ID: id, IP: "10.0.0.1", Port: 9000},
+		TotalSpace:   100 * p2p_storage.GROUP_NODE_CAPACITY,
+		LeftP2pSpace: int64(50 * p2p_storage.GROUP_NODE_CAPACITY),
+		Percent:      50,
+		UpdateTm:     updateTm,
+		RegTm:        time.Now().Unix() - 30*86400,
+	}
+}
+
+func testNode(t *testing.T, ds p2p_storage.IDataSource) {
+	detail, e := ds.GetNodeDetail("n1")
+	check(t, e, "GetNodeDetail")
+	if detail != nil {
+		t.Fatal("GetNodeDetail of missing node should return nil, nil")
+	}
+	if exist, e := ds.IsNodeExist("n1"); e != nil || exist {
+		t.Errorf("IsNodeExist of missing node = %v, %v", exist, e)
+	}
+
+	node := newNode("n1", time.Now().UnixNano())
+	check(t, ds.AddNode(node), "AddNode")
+	if exist, _ := ds.IsNodeExist("n1"); !exist {
+		t.Error("IsNodeExist = false after AddNode")
+	}
+	detail, e = ds.GetNodeDetail("n1")
+	check(t, e, "GetNodeDetail")
+	if detail == nil || detail.ID != "n1" || detail.IP != node.IP || detail.LeftP2pSpace != node.LeftP2pSpace {
+		t.Fatalf("GetNodeDetail = %+v, want %+v", detail, node)
+	}
+
+	node.IP = "10.0.0.2"
+	node.Drained = true
+	check(t, ds.UpdateNode(node), "UpdateNode")
+	check(t, ds.UpdateNodeWeight("n1", 2.5), "UpdateNodeWeight")
+	check(t, ds.IncrementActiveGroups("n1"), "IncrementActiveGroups")
+	detail, _ = ds.GetNodeDetail("n1")
+	if detail.IP != "10.0.0.2" || !detail.Drained || detail.Weight != 2.5 || detail.ActiveGroups != 1 {
+		t.Errorf("node not updated: %+v", detail)
+	}
+
+	check(t, ds.AddNode(newNode("n2", time.Now().UnixNano())), "AddNode")
+	nodes, e := ds.GetNodesByIds([]string{"n1", "n2", "n3"})
+	check(t, e, "GetNodesByIds")
+	if len(nodes) != 2 {
+		t.Errorf("GetNodesByIds returned %d nodes, want 2", len(nodes))
+	}
+	peers, e := ds.GetOnlinePeers([]string{"n1", "n2", "n3"}, time.Now().Unix()-60)
+	check(t, e, "GetOnlinePeers")
+	if len(peers) != 2 {
+		t.Errorf("GetOnlinePeers returned %d peers, want 2", len(peers))
+	}
+	if peers, _ = ds.GetOnlinePeers([]string{"n1"}, time.Now().Unix()+60); len(peers) != 0 {
+		t.Error("GetOnlinePeers returned node updated before timeout")
+	}
+
+	check(t, ds.DeleteNode("n1"), "DeleteNode")
+	if detail, _ = ds.GetNodeDetail("n1"); detail != nil {
+		t.Error("GetNodeDetail returned deleted node")
+	}
+}
+
+func testAllNode(t *testing.T, ds p2p_storage.IDataSource) {
+	for i := 0; i < 5; i++ {
+		check(t, ds.AddNode(newNode(fmt.Sprintf("n%d", i), time.Now().UnixNano())), "AddNode")
+	}
+	nodes, e := ds.GetAllNode("")
+	check(t, e, "GetAllNode")
+	if len(nodes) != 5 {
+		t.Fatalf("GetAllNode returned %d nodes, want 5", len(nodes))
+	}
+	for i := 1; i < len(nodes); i++ {
+		if nodes[i-1] >= nodes[i] {
+			t.Fatalf("GetAllNode not sorted: %v", nodes)
+		}
+	}
+	if nodes, _ = ds.GetAllNode("n2"); len(nodes) != 2 || nodes[0] != "n3" {
+		t.Errorf("GetAllNode(n2) = %v, want [n3 n4]", nodes)
+	}
+}
+
+func testTimeoutNodes(t *testing.T, ds p2p_storage.IDataSource) {
+	base := time.Now().UnixNano()
+	for i := int64(1); i <= 4; i++ {
+		check(t, ds.AddNode(newNode(fmt.Sprintf("n%d", i), base+i)), "AddNode")
+	}
+	//(from, to]区间
+	nodes, e := ds.GetTimeoutNodes(base+1, base+3, 10)
+	check(t, e, "GetTimeoutNodes")
+	if len(nodes) != 2 || nodes[0].ID != "n2" || nodes[1].ID != "n3" {
+		t.Errorf("GetTimeoutNodes = %v, want n2, n3", nodes)
+	}
+	if nodes, _ = ds.GetTimeoutNodes(base, base+4, 1); len(nodes) != 1 || nodes[0].ID != "n1" {
+		t.Errorf("GetTimeoutNodes with num = 1 returned %v", nodes)
+	}
+}
+
+func testAvailableNodes(t *testing.T, ds p2p_storage.IDataSource) {
+	now := time.Now().Unix()
+	for i, w := range []float64{1, 3, 2, 5} {
+		nid := fmt.Sprintf("n%d", i+1)
+		check(t, ds.AddNode(newNode(nid, time.Now().UnixNano())), "AddNode")
+		check(t, ds.UpdateNodeWeight(nid, w), "UpdateNodeWeight")
+	}
+	//n3空间不足，n4已经在两个活跃分组中
+	n3, _ := ds.GetNodeDetail("n3")
+	n3.LeftP2pSpace = 0
+	check(t, ds.UpdateNode(n3), "UpdateNode")
+	check(t, ds.IncrementActiveGroups("n4"), "IncrementActiveGroups")
+	check(t, ds.IncrementActiveGroups("n4"), "IncrementActiveGroups")
+	capacity := p2p_storage.GROUP_NODE_CAPACITY
+
+	//按权重从大到小
+	nodes, e := ds.GetAvailableNodes(capacity, now-60, now, 0, 10, 1, 0)
+	check(t, e, "GetAvailableNodes")
+	if len(nodes) != 2 || nodes[0] != "n2" || nodes[1] != "n1" {
+		t.Errorf("GetAvailableNodes = %v, want [n2 n1]", nodes)
+	}
+	if nodes, _ = ds.GetAvailableNodes(capacity, now-60, now, 1, 1, 1, 0); len(nodes) != 1 || nodes[0] != "n1" {
+		t.Errorf("GetAvailableNodes with offset = %v, want [n1]", nodes)
+	}
+	if num, e := ds.GetAvailableNodesCount(capacity, now-60, now, 1, 0); e != nil || num != 2 {
+		t.Errorf("GetAvailableNodesCount = %d, %v, want 2", num, e)
+	}
+	if num, _ := ds.GetAvailableNodesCount(capacity, now-60, now, 3, 0); num != 3 {
+		t.Errorf("GetAvailableNodesCount(active_groups = 3) = %d, want 3", num)
+	}
+	//GetAvailableNode不限制活跃分组数
+	nodes, e = ds.GetAvailableNode(capacity, now-60, now, 0, 2)
+	check(t, e, "GetAvailableNode")
+	if len(nodes) != 2 || nodes[0] != "n4" || nodes[1] != "n2" {
+		t.Errorf("GetAvailableNode = %v, want [n4 n2]", nodes)
+	}
+	if nodes, _ = ds.GetAvailableNode(capacity, now+60, now, 0, 10); len(nodes) != 0 {
+		t.Errorf("GetAvailableNode returned offline nodes %v", nodes)
+	}
+	if nodes, _ = ds.GetAvailableNode(capacity, now-60, now-60*86400, 0, 10); len(nodes) != 0 {
+		t.Errorf("GetAvailableNode returned nodes registered after regTm %v", nodes)
+	}
+	if nodes, _ = ds.GetAvailableNode(capacity, now-60, now, 1, 10); len(nodes) != 0 {
+		t.Errorf("GetAvailableNode returned nodes below online_cnt %v", nodes)
+	}
+
+	zero, e := ds.GetNodesAGZero(capacity, now-60, now, 1, 0)
+	check(t, e, "GetNodesAGZero")
+	if len(zero) != 2 || !zero["n1"] || !zero["n2"] {
+		t.Errorf("GetNodesAGZero = %v, want n1, n2", zero)
+	}
+	//加入分组后不再是新节点
+	check(t, ds.AddGroup(newGroup("g1")), "AddGroup")
+	check(t, ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n1", State: p2p_storage.ONLINE}), "AddNodeToGroup")
+	fresh, e := ds.GetNewNodes(capacity, now-60, now, 0)
+	check(t, e, "GetNewNodes")
+	if len(fresh) != 2 || !fresh["n2"] || !fresh["n4"] {
+		t.Errorf("GetNewNodes = %v, want n2, n4", fresh)
+	}
+}
+
+func testNodeOnline(t *testing.T, ds p2p_storage.IDataSource) {
+	node := newNode("n1", time.Now().UnixNano())
+	check(t, ds.AddNode(node), "AddNode")
+	check(t, ds.AddNode(newNode("n2", time.Now().UnixNano())), "AddNode")
+	//UpdateNode记录在线时间
+	check(t, ds.UpdateNode(node), "UpdateNode")
+	tms, e := ds.GetNodeOnlineTm([]string{"n1", "n3"})
+	check(t, e, "GetNodeOnlineTm")
+	if tms["n1"] < 1 || tms["n3"] != 0 {
+		t.Errorf("GetNodeOnlineTm = %v, want n1 >= 1, n3 = 0", tms)
+	}
+
+	check(t, ds.UpdateNodeOnlineCnt(map[string]int{"n1": 200, "n3": 10}), "UpdateNodeOnlineCnt")
+	if detail, _ := ds.GetNodeDetail("n1"); detail == nil || detail.OnlineCount != 200 {
+		t.Errorf("OnlineCount after UpdateNodeOnlineCnt = %+v", detail)
+	}
+	now := time.Now().Unix()
+	if nodes, _ := ds.GetAvailableNode(p2p_storage.GROUP_NODE_CAPACITY, now-60, now, 100, 10); len(nodes) != 1 || nodes[0] != "n1" {
+		t.Errorf("GetAvailableNode(online_cnt = 100) = %v, want [n1]", nodes)
+	}
+	if exist, _ := ds.IsNodeExist("n3"); exist {
+		t.Error("UpdateNodeOnlineCnt created a missing node")
+	}
+}
+
+func testUPNPAvailableNodes(t *testing.T, ds p2p_storage.IDataSource) {
+	now := time.Now().Unix()
+	add := func(id string, upnp bool, updateTm int64) {
+		node := newNode(id, updateTm*int64(time.Second))
+		if upnp {
+			node.UPNPAvailable = int8(p2p_storage.YES)
+		} else {
+			node.UPNPAvailable = int8(p2p_storage.NO)
+		}
+		check(t, ds.AddNode(node), "AddNode")
+	}
+	add("n1", true, now)
+	add("n2", true, now-10)
+	add("n3", false, now)
+	add("n4", true, now-3600)
+
+	//在线的节点按更新时间从早到晚
+	peers, e := ds.GetUPNPAvailableNodes(10, now-60)
+	check(t, e, "GetUPNPAvailableNodes")
+	if len(peers) != 2 || peers[0].ID != "n2" || peers[1].ID != "n1" {
+		t.Errorf("GetUPNPAvailableNodes = %v, want n2, n1", peers)
+	}
+	if peers, _ = ds.GetUPNPAvailableNodes(1, now-60); len(peers) != 1 || peers[0].ID != "n2" {
+		t.Errorf("GetUPNPAvailableNodes with num = 1 returned %v", peers)
+	}
+}
+
+func testCanDelTimeoutNodes(t *testing.T, ds p2p_storage.IDataSource) {
+	now := time.Now().Unix()
+	for i, tm := range []int64{now - 7200, now - 3600, now} {
+		check(t, ds.AddNode(newNode(fmt.Sprintf("n%d", i+1), tm*int64(time.Second))), "AddNode")
+	}
+	nodes, e := ds.GetCanDelTimeoutNodes(uint64(now-60), 10)
+	check(t, e, "GetCanDelTimeoutNodes")
+	if !sameSet(nodes, "n1", "n2") {
+		t.Errorf("GetCanDelTimeoutNodes = %v, want n1, n2", nodes)
+	}
+	if nodes, _ = ds.GetCanDelTimeoutNodes(uint64(now-60), 1); len(nodes) != 1 {
+		t.Errorf("GetCanDelTimeoutNodes with num = 1 returned %v", nodes)
+	}
+	if nodes, _ = ds.GetCanDelTimeoutNodes(uint64(now-86400), 10); len(nodes) != 0 {
+		t.Errorf("GetCanDelTimeoutNodes before all updates = %v", nodes)
+	}
+}
+
+func testSourceFile(t *testing.T, ds p2p_storage.IDataSource) {
+	ids, e := ds.GetSourceFileNodes("m1", 10)
+	check(t, e, "GetSourceFileNodes")
+	if len(ids) != 0 {
+		t.Errorf("GetSourceFileNodes of missing file = %v", ids)
+	}
+	if yes, e := ds.IsNodeHasFile("n1", "m1"); e != nil || yes {
+		t.Errorf("IsNodeHasFile of missing file = %v, %v", yes, e)
+	}
+	if cnt, e := ds.GetSourceFileCount("m1"); e != nil || cnt != 0 {
+		t.Errorf("GetSourceFileCount of missing file = %d, %v", cnt, e)
+	}
+
+	seeder, ok := ds.(Seeder)
+	if !ok {
+		t.Skip("data source does not implement Seeder")
+	}
+	check(t, seeder.AddSourceFile("n1", "m1"), "AddSourceFile")
+	check(t, seeder.AddSourceFile("n2", "m1"), "AddSourceFile")
+	check(t, seeder.AddSourceFile("n1", "m2"), "AddSourceFile")
+	if ids, _ = ds.GetSourceFileNodes("m1", 10); !sameSet(ids, "n1", "n2") {
+		t.Errorf("GetSourceFileNodes = %v, want n1, n2", ids)
+	}
+	if ids, _ = ds.GetSourceFileNodes("m1", 1); len(ids) != 1 {
+		t.Errorf("GetSourceFileNodes with num = 1 returned %v", ids)
+	}
+	if yes, _ := ds.IsNodeHasFile("n1", "m2"); !yes {
+		t.Error("IsNodeHasFile(n1, m2) = false")
+	}
+	if yes, _ := ds.IsNodeHasFile("n2", "m2"); yes {
+		t.Error("IsNodeHasFile(n2, m2) = true")
+	}
+	if cnt, _ := ds.GetSourceFileCount("m1"); cnt != 2 {
+		t.Errorf("GetSourceFileCount = %d, want 2", cnt)
+	}
+}
+
+func testConfig(t *testing.T, ds p2p_storage.IDataSource) {
+	configMap := make(map[interface{}]interface{})
+	check(t, ds.GetMapFromConfig(configMap), "GetMapFromConfig")
+	seeder, ok := ds.(Seeder)
+	if !ok {
+		t.Skip("data source does not implement Seeder")
+	}
+	check(t, seeder.SetConfig("conformance", "v1"), "SetConfig")
+	check(t, ds.GetMapFromConfig(configMap), "GetMapFromConfig")
+	if configMap["conformance"] != "v1" {
+		t.Errorf("GetMapFromConfig = %v", configMap)
+	}
+}
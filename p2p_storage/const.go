@@ -46,7 +46,7 @@ const MAX_EXPAND_NODE_NUM uint8 = 1
 //节点最大的分配任务数
 const MAX_NODE_EXPANDTASK_CNT uint32 = 100
 
-//扩散任务最大失败次数
+//扩散任务最大失败次数，expand_max_fail_times配置的默认值
 const MAX_EXPAND_TAKS_FAIL_NUMS uint8 = 3
 
 const PIECE_SIZE uint32 = 1024
@@ -84,9 +84,9 @@ const NODE_TAKS_MAX_NUM int8 = 100
 //扩散任务删除时间
 const EXPAND_TASK_DELETE_TIME int64 = 5 * 24 * 3600
 
-//扩散传输文件方式
-const EXPAND_TRANS_TYPE_OSS int8 = 0
-const EXPAND_TRANS_TYPE_NODE int8 = 1
+//扩散传输文件方式，零值为只在节点之间传输，没有设置传输方式的任务不会使用冷存储
+const EXPAND_TRANS_TYPE_NODE int8 = 0
+const EXPAND_TRANS_TYPE_OSS int8 = 1
 const EXPAND_TRANS_TYPE_BOTH int8 = 2
 
 //p2p自启动检测服务执行时间戳
@@ -111,6 +111,22 @@ const GROUP_FILE_NEW_ADD_DIFF_TIME int = 10
 const CHECKER_ONLINE_NODE = "checker_node_online"
 const CHECKER_ONLINE_NODE_MIN = 5
 
+//删除过期文件
+const CHECKER_EXPIRED_FILE = "checker_expired_file"
+const CHECKER_EXPIRED_FILE_MIN = 10
+
+//节点历史记录降采样
+const CHECKER_NODE_HISTORY = "checker_node_history"
+const CHECKER_NODE_HISTORY_MIN = 60
+
+//记录集群容量样本并检查空间告警
+const CHECKER_CAPACITY = "checker_capacity"
+const CHECKER_CAPACITY_MIN = 5
+
+//重试延迟添加队列中的文件
+const CHECKER_INGEST = "checker_ingest"
+const CHECKER_INGEST_MIN = 1
+
 //检测卡住任务间隔(分钟)
 const CHECKER_TASK_PROCESS_SLOW_MIN = 10
 
@@ -174,6 +190,45 @@ const P2P_UPSPEED_LIMIT_KEY = "p2p_upspeed_limit"
 //p2p节点开启小文件合并
 const P2P_MERGE_PIECE = "merge_piece"
 
+//文件在分组中扩散失败多少次后不再重试key值，0表示不限制
+const EXPAND_MAX_FAIL_TIMES_KEY = "expand_max_fail_times"
+
+//调度时节点可用上行带宽中用于扩散的百分比key值
+const SCHED_BANDWIDTH_PERCENT_KEY = "sched_bandwidth_percent"
+
+//调度时普通扩散任务最多使用节点预算的百分比key值，其余留给危险文件修复
+const SCHED_ROUTINE_PERCENT_KEY = "sched_routine_percent"
+
+//调度时每个分组每小时分配的任务字节数key值，0表示不限制
+const SCHED_GROUP_HOUR_BYTES_KEY = "sched_group_hour_bytes"
+
+//估计耐久度时节点的平均丢失时间（小时）key值
+const NODE_LOSS_HOURS_KEY = "node_loss_hours"
+
+//估计耐久度时丢失碎片的平均修复时间（小时）key值
+const REPAIR_HOURS_KEY = "repair_hours"
+
+//节点历史记录保留天数key值
+const NODE_HISTORY_DAYS_KEY = "node_history_days"
+
+//分组已用空间超过该百分比时淘汰低优先级文件key值
+const EVICT_USAGE_PERCENT_KEY = "evict_usage_percent"
+
+//没有可用节点时AddP2PFile的处理方式key值，见ADMISSION_REJECT等
+const ADMISSION_MODE_KEY = "admission_mode"
+
+//在线节点剩余空间百分比低于该值时告警key值
+const CAPACITY_WARN_PERCENT_KEY = "capacity_warn_percent"
+
+//预测剩余空间在该小时数内用完时告警key值
+const CAPACITY_WARN_HOURS_KEY = "capacity_warn_hours"
+
+//预测剩余空间使用最近多少小时的样本key值
+const CAPACITY_FORECAST_HOURS_KEY = "capacity_forecast_hours"
+
+//延迟添加队列中的文件超过该小时数仍未添加时放弃key值
+const INGEST_MAX_HOURS_KEY = "ingest_max_hours"
+
 //p2p节点开启下载piece缓存
 const P2P_DOWNLOAD_CACHE = "download_cache"
 
@@ -201,6 +256,45 @@ const DEFAULT_GEN_PIECE_LEVEL int64 = 0
 //p2p系统节点上行速度限制
 const DEFAULT_P2P_UPSPEED_LIMIT int64 = 1048576
 
+//扩散失败次数上限默认值
+const DEFAULT_EXPAND_MAX_FAIL_TIMES int64 = int64(MAX_EXPAND_TAKS_FAIL_NUMS)
+
+//调度带宽百分比默认值
+const DEFAULT_SCHED_BANDWIDTH_PERCENT int64 = 50
+
+//普通扩散任务预算百分比默认值
+const DEFAULT_SCHED_ROUTINE_PERCENT int64 = 70
+
+//分组每小时任务字节数默认值
+const DEFAULT_SCHED_GROUP_HOUR_BYTES int64 = 20 * 1024 * 1024 * 1024
+
+//节点平均丢失时间默认值（小时）
+const DEFAULT_NODE_LOSS_HOURS int64 = 24 * 365
+
+//碎片平均修复时间默认值（小时）
+const DEFAULT_REPAIR_HOURS int64 = 24
+
+//节点历史记录保留天数默认值
+const DEFAULT_NODE_HISTORY_DAYS int64 = 30
+
+//淘汰低优先级文件的分组已用空间百分比默认值
+const DEFAULT_EVICT_USAGE_PERCENT int64 = 95
+
+//没有可用节点时的处理方式默认值
+const DEFAULT_ADMISSION_MODE int64 = ADMISSION_REJECT
+
+//剩余空间告警百分比默认值
+const DEFAULT_CAPACITY_WARN_PERCENT int64 = 10
+
+//剩余空间用完告警小时数默认值
+const DEFAULT_CAPACITY_WARN_HOURS int64 = 7 * 24
+
+//预测剩余空间的样本小时数默认值
+const DEFAULT_CAPACITY_FORECAST_HOURS int64 = 72
+
+//延迟添加队列等待小时数默认值
+const DEFAULT_INGEST_MAX_HOURS int64 = 24
+
 //定义任务卡住的超时用时
 const TASK_PROCESS_SLOW_TM = 3600
 
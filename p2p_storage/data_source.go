@@ -25,22 +25,31 @@ func (ds *DataSource) AddFileToGroup(gid string, g *Group, file *GroupFile, file
 	if f != nil {
 		if f.State == DELETED {
 			if e := ds.Raw.UpdateGroupFile(gid, file); e != nil {
+				ds.RepairGroupSize(gid, e)
 				return e
 			}
 			if fileVer >= g.FirstFinishVer {
 				logger.AppendObj(nil, "AddFileToGroup-FillEmptyGroupFile--gid:", gid, "fileVer:", fileVer, "groupFirstFinishVer:", g.FirstFinishVer)
 				if e := ds.FillEmptyGroupFile(gid); e != nil {
+					ds.RepairGroupSize(gid, e)
 					return e
 				}
 			}
-			return ds.UpdateGroupSize(true, g, file.Size)
+			if e = ds.UpdateGroupSize(true, g, file.Size); e != nil {
+				ds.RepairGroupSize(gid, e)
+			}
+			return
 		}
 		return
 	} else {
 		if e = ds.Raw.AddFileToGroup(gid, file); e != nil {
+			ds.RepairGroupSize(gid, e)
 			return
 		}
-		return ds.UpdateGroupSize(true, g, file.Size)
+		if e = ds.UpdateGroupSize(true, g, file.Size); e != nil {
+			ds.RepairGroupSize(gid, e)
+		}
+		return
 	}
 	return
 }
@@ -85,7 +94,7 @@ func (ds *DataSource) UpdateGroupSize(isAdd bool, group *Group, size uint64) (e
 	var filesize int64
 	m := size % 10
 	if m == 0 || m == 1 || m == 2 {
-		e = dataSource.Raw.CalculateGroupSize(group.ID)
+		e = ds.Raw.CalculateGroupSize(group.ID)
 		return
 	} else {
 		if isAdd {
@@ -98,6 +107,20 @@ func (ds *DataSource) UpdateGroupSize(isAdd bool, group *Group, size uint64) (e
 	return ds.Raw.UpdateGroupSize(group, filesize)
 }
 
+/*
+	文件记录写入后没能更新分组大小时（写入返回错误时也可能已经写入），重新计算分组大小。
+	重试时文件已经存在，不会再更新分组大小，所以需要在出错时修复
+
+	参数：
+		gid: 分组的ID
+		cause: 导致修复的错误，只用于记录日志
+*/
+func (ds *DataSource) RepairGroupSize(gid string, cause error) {
+	if e := ds.Raw.CalculateGroupSize(gid); e != nil {
+		logger.AppendObj(e, "RepairGroupSize-CalculateGroupSize is error", gid, cause)
+	}
+}
+
 /*
 	   随机获取源文件所在的节点列表
 
@@ -151,7 +174,7 @@ func (ds *DataSource) GetNoFileNodes(gid, md5 string) (nodes []string, e error)
 }
 
 /*
-   取出还未通知节点的任务列表
+   取出还未通知节点的任务列表，按优先级和节点带宽预算选择，超出预算的任务留到以后再分配
 
    参数：
    		nid: 节点ID
@@ -160,13 +183,24 @@ func (ds *DataSource) GetNoFileNodes(gid, md5 string) (nodes []string, e error)
    		exNodes: 任务列表
 */
 func (ds *DataSource) FetchExpandTasks(nid string, num int) (exnodes []ExpandNode, e error) {
-	exNodes, e := ds.Raw.GetExpandTasks(nid, EXPAND_STATE_INIT, num)
+	exNodes, e := ds.Raw.GetExpandTasks(nid, EXPAND_STATE_INIT, num*SCHED_CANDIDATE_FACTOR)
+	if e != nil {
+		return nil, e
+	}
+	detail, e := ds.Raw.GetNodeDetail(nid)
 	if e != nil {
 		return nil, e
 	}
-	exnodes = make([]ExpandNode, 0, len(exNodes))
+	sortExpandTasks(exNodes)
+	exnodes = make([]ExpandNode, 0, num)
 	for _, exNode := range exNodes {
-		if e = ds.UpdateExpandNodeState(exNode.Group, nid, exNode.MD5, EXPAND_STATE_NOTIFIED); e != nil {
+		if len(exnodes) >= num {
+			break
+		}
+		if detail != nil && !scheduler.admit(detail, schedKey{exNode.ID, false}, exNode.Group, exNode.Size, CalculateExpandNodeTimeout(EXPAND_STATE_NOTIFIED), exNode.Level >= SCHED_REPAIR_LEVEL) {
+			continue
+		}
+		if e = ds.transitExpandNode(&exNode, EXPAND_STATE_NOTIFIED, "notified"); e != nil {
 			logger.Append("UpdateExpandNodeStat error: "+e.Error(), log.ERROR)
 		}
 
@@ -204,7 +238,7 @@ func (ds *DataSource) UpdateExpandNodeState(gid, nid, md5 string, state int8) (e
 			return e
 		}
 	}
-	return dataSource.Raw.UpdateExpandNodeState(gid, nid, md5, state, CalculateExpandNodeTimeout(state), increment)
+	return ds.Raw.UpdateExpandNodeState(gid, nid, md5, state, CalculateExpandNodeTimeout(state), increment)
 }
 
 /*
@@ -218,7 +252,7 @@ func (ds *DataSource) UpdateExpandNodeState(gid, nid, md5 string, state int8) (e
    		exNodes: 任务列表
 */
 func (ds *DataSource) UpdateExpandNodeTimeout(id uint64) (e error) {
-	return dataSource.Raw.UpdateExpandNodeTimeout(id, CalculateExpandNodeTimeout(EXPAND_STATE_STARTED))
+	return ds.Raw.UpdateExpandNodeTimeout(id, CalculateExpandNodeTimeout(EXPAND_STATE_STARTED))
 }
 
 /*
@@ -230,7 +264,7 @@ func (ds *DataSource) UpdateExpandNodeTimeout(id uint64) (e error) {
    		exNodes: 节点列表
 */
 func (ds *DataSource) GetNodesByIds(ids []string) (nodes []NodeDetail, e error) {
-	return dataSource.Raw.GetNodesByIds(ids)
+	return ds.Raw.GetNodesByIds(ids)
 }
 
 /*
@@ -265,22 +299,22 @@ func (ds *DataSource) FillEmptyGroupFile(gid string) (e error) {
 	}*/
 
 	//获取锁
-	if !dataSource.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, gid, P2pLockExpireSec, P2pGetLockTimeOut) {
+	if !ds.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, gid, P2pLockExpireSec, P2pGetLockTimeOut) {
 		e = service.NewSimpleError(service.ERR_PERMISSION_DENIED, "get lock is errror")
 		logger.AppendObj(e, "P2pLock-FillEmptyGroupFile has no lock", gid)
 		return
 	}
-	e = doFillEmptyGroupFile(ds, gid, f, emptyFile)
+	e = ds.doFillEmptyGroupFile(gid, f, emptyFile)
 
-	if err := dataSource.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, gid); err != nil {
+	if err := ds.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, gid); err != nil {
 		logger.AppendObj(err, "P2pLock-FillEmptyGroupFile unlock is error", gid)
 	}
 
 	return
 }
 
-func doFillEmptyGroupFile(ds *DataSource, gid string, f *GroupFile, emptyFile string) (e error) {
-	ver, e := dataSource.Raw.AtomicIncrID(gid)
+func (ds *DataSource) doFillEmptyGroupFile(gid string, f *GroupFile, emptyFile string) (e error) {
+	ver, e := ds.Raw.AtomicIncrID(gid)
 	if e != nil {
 		return errors.New("redis error : " + e.Error())
 	}
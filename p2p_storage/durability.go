@@ -0,0 +1,373 @@
+package p2p_storage
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"yh_pkg/time"
+)
+
+//节点在线小时数的统计窗口，GetNodeOnlineTm统计最近这么多小时内的在线小时数
+const NODE_ONLINE_STAT_HOURS int64 = 7 * 24
+
+const (
+	DURABILITY_MIN_AVAILABILITY = 0.01  //可用率低于该值时按该值计算节点丢失率
+	DURABILITY_MTTDL_MAX        = 1e100 //MTTDL（小时）的上限，超过时按上限返回
+	HOURS_PER_YEAR              = 24 * 365
+)
+
+//GenPiece和按优先级选择分组时使用的分组耐久度缓存的时间，节点在线状态每CHECKER_ONLINE_NODE_MIN分钟检测一次
+const DURABILITY_CACHE_SEC int64 = CHECKER_ONLINE_NODE_MIN * 60
+
+//缓存的分组耐久度数量，超过时清空
+const DURABILITY_CACHE_SIZE = 10000
+
+/*
+	风险等级对应的耐久度（年丢失概率的负对数）下限，依次对应扩散任务优先级1-5，低于最后一个值时为6。
+	按默认的node_loss_hours、repair_hours，MinPieces为32，节点可用率为NODE_EXPAND_MIN_ONLINE_CNT/NODE_ONLINE_STAT_HOURS时，
+	与原来按在线节点数（160/152/144/136/128）划分的优先级一致。
+*/
+var DURABILITY_LEVEL_NINES = []float64{68.5, 66, 63.5, 60.5, 57.5}
+
+//分组或文件的耐久度估计
+type Durability struct {
+	Group          string  `json:"group"`
+	MD5            string  `json:"md5,omitempty"` //按文件计算时为文件md5
+	MinPieces      uint32  `json:"min_pieces"`
+	Nodes          int     `json:"nodes"`          //保存碎片的在线节点数
+	Online         float64 `json:"online"`         //这些节点的平均可用率
+	Unavailability float64 `json:"unavailability"` //当前同时在线的节点少于MinPieces的概率
+	MTTDL          float64 `json:"mttdl"`          //平均数据丢失时间（小时）
+	LossProb       float64 `json:"loss_prob"`      //一年内丢失数据的概率
+	Nines          float64 `json:"nines"`          //-log10(LossProb)，数值越小风险越高
+	Level          int8    `json:"level"`          //对应的扩散任务优先级
+}
+
+/*
+	节点的可用率：设置了节点历史记录的存储时，按历史记录计算统计窗口内的在线率（见historyAvailability）；
+	否则按统计窗口内在线的小时数占比计算，注册时间不足一个窗口时按注册以来的小时数计算。
+	还没有在线统计的节点按加入分组要求的最低在线时长估计。
+*/
+func NodeAvailability(detail *NodeDetail) float64 {
+	if detail == nil {
+		return 0
+	}
+	if a, ok := historyAvailability(detail); ok {
+		return a
+	}
+	if detail.OnlineCount <= 0 {
+		return float64(NODE_EXPAND_MIN_ONLINE_CNT) / float64(NODE_ONLINE_STAT_HOURS)
+	}
+	hours := NODE_ONLINE_STAT_HOURS
+	if detail.RegTm > 0 {
+		if age := (time.Now.Unix() - detail.RegTm) / 3600; age < hours {
+			hours = age
+		}
+	}
+	if hours < 1 {
+		hours = 1
+	}
+	a := float64(detail.OnlineCount) / float64(hours)
+	if a > 1 {
+		a = 1
+	}
+	return a
+}
+
+/*
+	用节点历史记录计算统计窗口内的在线率（NodeOnlineRatio）。窗口从节点注册开始；开始时还没有节点的历史记录时
+	（历史记录的存储是后来设置的），从节点的第一个样本开始。覆盖的时间不足一小时时不使用历史记录。
+
+	返回值：
+		ok: 是否使用了历史记录
+*/
+func historyAvailability(detail *NodeDetail) (a float64, ok bool) {
+	if historyStore == nil {
+		return
+	}
+	to := time.Now.Unix()
+	from := to - NODE_ONLINE_STAT_HOURS*3600
+	if detail.RegTm > from {
+		from = detail.RegTm
+	}
+	samples, e := historyStore.GetNodeSamples(detail.ID, from-NODE_HISTORY_COARSE_SPAN, to)
+	if e != nil {
+		logger.AppendObj(e, "historyAvailability-GetNodeSamples error", detail.ID)
+		return
+	}
+	if len(samples) == 0 {
+		return
+	}
+	if samples[0].Tm > from {
+		from = samples[0].Tm
+	}
+	if to-from < 3600 {
+		return
+	}
+	if a, e = NodeOnlineRatio(detail.ID, from, to); e != nil {
+		logger.AppendObj(e, "historyAvailability-NodeOnlineRatio error", detail.ID)
+		return
+	}
+	return a, true
+}
+
+//同时在线的节点少于k个的概率，每个节点按各自的可用率独立在线
+func unavailability(avail []float64, k int) float64 {
+	//p[j]: 前i个节点中恰好j个在线的概率
+	p := make([]float64, len(avail)+1)
+	p[0] = 1
+	for i, a := range avail {
+		for j := i + 1; j > 0; j-- {
+			p[j] = p[j]*(1-a) + p[j-1]*a
+		}
+		p[0] *= 1 - a
+	}
+	var u float64
+	for j := 0; j < k && j < len(p); j++ {
+		u += p[j]
+	}
+	if u > 1 {
+		u = 1
+	}
+	return u
+}
+
+/*
+	按可用率估计耐久度。节点丢失率为1/node_loss_hours除以节点可用率，修复率为1/repair_hours，
+	n个节点中丢失n-k+1个之前没有修复时数据丢失：
+		MTTDL = μ^(n-k) / (λ^(n-k+1) * n*(n-1)*...*k)
+	在对数空间中计算，避免溢出。
+
+	参数：
+		avail: 保存碎片的节点的可用率
+		k: 恢复数据需要的最少碎片数
+*/
+func EstimateDurability(avail []float64, k int) (d Durability) {
+	n := len(avail)
+	d.Nodes = n
+	d.MinPieces = uint32(k)
+	var lambda float64
+	base := 1 / float64(getConfigInt64(NODE_LOSS_HOURS_KEY, DEFAULT_NODE_LOSS_HOURS))
+	for _, a := range avail {
+		d.Online += a
+		lambda += base / math.Max(a, DURABILITY_MIN_AVAILABILITY)
+	}
+	if n > 0 {
+		d.Online /= float64(n)
+		lambda /= float64(n)
+	}
+	d.Unavailability = unavailability(avail, k)
+	m := n - k
+	if m < 0 || n == 0 {
+		d.LossProb = 1
+		d.Level = levelByNines(0)
+		return
+	}
+	mu := 1 / float64(getConfigInt64(REPAIR_HOURS_KEY, DEFAULT_REPAIR_HOURS))
+	logMTTDL := float64(m)*math.Log10(mu) - float64(m+1)*math.Log10(lambda)
+	for i := 0; i <= m; i++ {
+		logMTTDL -= math.Log10(float64(n - i))
+	}
+	d.MTTDL = math.Min(math.Pow(10, logMTTDL), DURABILITY_MTTDL_MAX)
+	d.LossProb = -math.Expm1(-HOURS_PER_YEAR / math.Pow(10, logMTTDL))
+	if d.LossProb > 0 {
+		d.Nines = -math.Log10(d.LossProb)
+	} else {
+		//丢失概率太小，按LossProb约等于HOURS_PER_YEAR/MTTDL计算
+		d.Nines = logMTTDL - math.Log10(HOURS_PER_YEAR)
+	}
+	d.Level = levelByNines(d.Nines)
+	return
+}
+
+func levelByNines(nines float64) int8 {
+	for i, v := range DURABILITY_LEVEL_NINES {
+		if nines >= v {
+			return int8(i + 1)
+		}
+	}
+	return int8(len(DURABILITY_LEVEL_NINES) + 1)
+}
+
+/*
+	计算分组中版本不低于ver的在线节点的耐久度
+
+	参数：
+		cache: 节点可用率的缓存，可以为nil，批量计算多个分组时避免重复查询
+*/
+func (ds *DataSource) groupDurability(g *Group, ver uint64, cache map[string]float64) (d Durability, e error) {
+	gns, e := ds.Raw.GetGroupNodes(g.ID)
+	if e != nil {
+		return
+	}
+	ids := make([]string, 0, len(gns))
+	for _, gn := range gns {
+		if gn.State == ONLINE && gn.Ver >= ver {
+			ids = append(ids, gn.Node)
+		}
+	}
+	if cache == nil {
+		cache = make(map[string]float64)
+	}
+	query := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := cache[id]; !ok {
+			query = append(query, id)
+		}
+	}
+	if len(query) > 0 {
+		details, e := ds.Raw.GetNodesByIds(query)
+		if e != nil {
+			return d, e
+		}
+		for i := range details {
+			cache[details[i].ID] = NodeAvailability(&details[i])
+		}
+	}
+	avail := make([]float64, 0, len(ids))
+	for _, id := range ids {
+		//没有节点详情的节点可用率为0
+		avail = append(avail, cache[id])
+	}
+	d = EstimateDurability(avail, int(g.MinPieces))
+	d.Group = g.ID
+	return
+}
+
+type durabilityKey struct {
+	group string
+	ver   uint64
+}
+
+type durabilityEntry struct {
+	d        Durability
+	expireTm int64
+}
+
+var durabilityCache = struct {
+	sync.Mutex
+	m map[durabilityKey]durabilityEntry
+}{m: make(map[durabilityKey]durabilityEntry)}
+
+func resetDurabilityCache() {
+	durabilityCache.Lock()
+	defer durabilityCache.Unlock()
+	durabilityCache.m = make(map[durabilityKey]durabilityEntry)
+}
+
+/*
+	带缓存的groupDurability，同一个分组和版本DURABILITY_CACHE_SEC内只计算一次，
+	用于每次GenPiece、添加文件时都要计算的地方，查询耐久度的接口不使用缓存
+*/
+func (ds *DataSource) cachedGroupDurability(g *Group, ver uint64, cache map[string]float64) (d Durability, e error) {
+	key := durabilityKey{g.ID, ver}
+	now := time.Now.Unix()
+	durabilityCache.Lock()
+	entry, ok := durabilityCache.m[key]
+	durabilityCache.Unlock()
+	if ok && entry.expireTm > now {
+		return entry.d, nil
+	}
+	if d, e = ds.groupDurability(g, ver, cache); e != nil {
+		return
+	}
+	durabilityCache.Lock()
+	defer durabilityCache.Unlock()
+	if len(durabilityCache.m) >= DURABILITY_CACHE_SIZE {
+		durabilityCache.m = make(map[durabilityKey]durabilityEntry)
+	}
+	durabilityCache.m[key] = durabilityEntry{d, now + DURABILITY_CACHE_SEC}
+	return
+}
+
+//分组的耐久度，按同步到首次扩散完成版本的在线节点计算
+func GetGroupDurability(gid string) (d *Durability, e error) {
+	return WithSpan(nil).GetGroupDurability(gid)
+}
+
+func (c Caller) GetGroupDurability(gid string) (d *Durability, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.GetGroupDurability")
+	defer span.SetAttr("gid", gid).End(&e)
+	g, e := source.Raw.GetGroup(gid)
+	if e != nil || g == nil {
+		return
+	}
+	gd, e := source.groupDurability(g, g.FirstFinishVer, nil)
+	if e != nil {
+		return
+	}
+	return &gd, nil
+}
+
+//文件在所在的每个分组中的耐久度，按同步到文件版本的在线节点计算
+func GetFileDurability(md5 string) (ds []Durability, e error) {
+	return WithSpan(nil).GetFileDurability(md5)
+}
+
+func (c Caller) GetFileDurability(md5 string) (ds []Durability, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.GetFileDurability")
+	defer span.SetAttr("md5", md5).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	files, e := source.Raw.GetFileByMd5AndState(md5, NORMAL)
+	if e != nil {
+		return
+	}
+	cache := make(map[string]float64)
+	ds = make([]Durability, 0, len(files))
+	for _, f := range files {
+		g, e := source.Raw.GetGroup(f.Group)
+		if e != nil {
+			return nil, e
+		}
+		if g == nil {
+			continue
+		}
+		d, e := source.groupDurability(g, f.Ver, cache)
+		if e != nil {
+			return nil, e
+		}
+		d.MD5 = md5
+		ds = append(ds, d)
+	}
+	return
+}
+
+/*
+	耐久度报告：所有分组按风险从高到低排序
+
+	参数：
+		num: 最多返回的分组数，0表示全部
+*/
+func DurabilityReport(num int) (ds []Durability, e error) {
+	return WithSpan(nil).DurabilityReport(num)
+}
+
+func (c Caller) DurabilityReport(num int) (ds []Durability, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.DurabilityReport")
+	defer span.End(&e)
+	groups, e := source.Raw.GetAllGroup()
+	if e != nil {
+		return
+	}
+	cache := make(map[string]float64)
+	ds = make([]Durability, 0, len(groups))
+	for _, g := range groups {
+		d, e := source.groupDurability(&g, g.FirstFinishVer, cache)
+		if e != nil {
+			return nil, e
+		}
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool {
+		if ds[i].Nines != ds[j].Nines {
+			return ds[i].Nines < ds[j].Nines
+		}
+		return ds[i].Group < ds[j].Group
+	})
+	if num > 0 && len(ds) > num {
+		ds = ds[:num]
+	}
+	return
+}
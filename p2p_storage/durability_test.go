@@ -0,0 +1,140 @@
+package p2p_storage_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/history"
+)
+
+//按文件、分组查询耐久度，报告按风险从高到低排列分组
+func TestDurability(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	const md5 = "0123456789abcdef0123456789abcdef"
+	f.addFile(md5, nil)
+	ds, e := p2p_storage.GetFileDurability(md5)
+	if e != nil || len(ds) != 1 || ds[0].Group != GID || ds[0].MD5 != md5 || ds[0].Nodes != NODE_NUM || ds[0].Online != 1 {
+		t.Fatalf("GetFileDurability: %+v %v", ds, e)
+	}
+	if ds[0].Unavailability != 0 || ds[0].LossProb <= 0 || ds[0].LossProb >= 1 {
+		t.Errorf("durability of fully available group: %+v", ds[0])
+	}
+
+	//g2的节点少且有两个节点经常离线，g3的节点数小于MinPieces
+	f.ds.AddGroup(&p2p_storage.Group{ID: "g2", PieceSize: 1024, MinPieces: 4, SafePieces: 5, PerfectPieces: 6})
+	for i := 0; i < 5; i++ {
+		f.ds.AddNodeToGroup("g2", &p2p_storage.GroupNode{Node: fmt.Sprintf("n%02d", i), State: p2p_storage.ONLINE})
+	}
+	f.ds.AddGroup(&p2p_storage.Group{ID: "g3", PieceSize: 1024, MinPieces: 4, SafePieces: 5, PerfectPieces: 6})
+	for i := 5; i < 8; i++ {
+		f.ds.AddNodeToGroup("g3", &p2p_storage.GroupNode{Node: fmt.Sprintf("n%02d", i), State: p2p_storage.ONLINE})
+	}
+	for _, id := range []string{"n03", "n04"} {
+		n, _ := f.ds.GetNodeDetail(id)
+		n.OnlineCount = 16
+		f.ds.UpdateNode(n)
+	}
+
+	ds, e = p2p_storage.DurabilityReport(0)
+	if e != nil || len(ds) != 3 || ds[0].Group != "g3" || ds[1].Group != "g2" || ds[2].Group != GID {
+		t.Fatalf("DurabilityReport: %+v %v", ds, e)
+	}
+	if ds[0].LossProb != 1 || ds[0].Unavailability != 1 || ds[0].Level != 6 {
+		t.Errorf("group with too few nodes: %+v", ds[0])
+	}
+	if ds[1].Online >= 1 || ds[1].Unavailability <= 0 || ds[1].Nines >= ds[2].Nines {
+		t.Errorf("group with unstable node: %+v", ds[1])
+	}
+	if ds, _ = p2p_storage.DurabilityReport(1); len(ds) != 1 || ds[0].Group != "g3" {
+		t.Errorf("DurabilityReport(1): %+v", ds)
+	}
+	if d, e := p2p_storage.GetGroupDurability("none"); e != nil || d != nil {
+		t.Errorf("GetGroupDurability of missing group: %+v %v", d, e)
+	}
+}
+
+//按风险划分优先级，与原来按在线节点数划分一致
+func TestDurabilityLevel(t *testing.T) {
+	a := float64(p2p_storage.NODE_EXPAND_MIN_ONLINE_CNT) / float64(p2p_storage.NODE_ONLINE_STAT_HOURS)
+	for _, c := range []struct {
+		nodes int
+		level int8
+	}{{170, 1}, {160, 1}, {159, 2}, {152, 2}, {144, 3}, {136, 4}, {128, 5}, {127, 6}, {40, 6}} {
+		avail := make([]float64, c.nodes)
+		for i := range avail {
+			avail[i] = a
+		}
+		if d := p2p_storage.EstimateDurability(avail, 32); d.Level != c.level {
+			t.Errorf("%d nodes: level %d, want %d", c.nodes, d.Level, c.level)
+		}
+	}
+}
+
+//GenPiece使用的任务优先级按缓存的分组耐久度计算，查询接口不使用缓存
+func TestDurabilityCache(t *testing.T) {
+	offline := func(f *fixture) {
+		for i := 1; i < NODE_NUM-2; i++ {
+			f.ds.UpdateGroupNode(GID, &p2p_storage.GroupNode{Node: fmt.Sprintf("n%02d", i), State: p2p_storage.OFFLINE}, false)
+		}
+	}
+	f := newFixture(t)
+	before, e := p2p_storage.GetGroupDurability(GID)
+	if e != nil {
+		t.Fatal(e)
+	}
+	offline(f)
+	after, e := p2p_storage.GetGroupDurability(GID)
+	if e != nil || after.Nodes != 3 || after.Nines >= before.Nines {
+		t.Fatalf("GetGroupDurability = %+v %v, before %+v", after, e, before)
+	}
+	//两种情况分别为风险等级1和2
+	defer func(nines []float64) { p2p_storage.DURABILITY_LEVEL_NINES = nines }(p2p_storage.DURABILITY_LEVEL_NINES)
+	p2p_storage.DURABILITY_LEVEL_NINES = []float64{(before.Nines + after.Nines) / 2}
+
+	f = newFixture(t)
+	if level, e := p2p_storage.GetExpandTaskLevel(GID, 0); e != nil || level != 1 {
+		t.Fatalf("level = %d %v", level, e)
+	}
+	offline(f)
+	if level, e := p2p_storage.GetExpandTaskLevel(GID, 0); e != nil || level != 1 {
+		t.Errorf("cached level = %d %v", level, e)
+	}
+	offline(newFixture(t))
+	if level, e := p2p_storage.GetExpandTaskLevel(GID, 0); e != nil || level != 2 {
+		t.Errorf("level after nodes offline = %d %v", level, e)
+	}
+}
+
+//设置了历史记录的存储时，可用率按历史记录中的在线率计算，历史记录不足一小时时按OnlineCount计算
+func TestNodeAvailabilityHistory(t *testing.T) {
+	newFixture(t)
+	store := history.NewMemStore()
+	p2p_storage.SetNodeHistoryStore(store)
+	defer p2p_storage.SetNodeHistoryStore(nil)
+	now := time.Now().Unix()
+	week := p2p_storage.NODE_ONLINE_STAT_HOURS * 3600
+	//h1整个窗口都有心跳，后一半时间在线；h2从两天前开始记录，一直在线；h3只有半小时的记录
+	record := func(nid string, from, onlineFrom int64) {
+		for tm := from; tm <= now; tm += p2p_storage.NODE_HISTORY_RESOLUTION {
+			store.AddNodeSample(&p2p_storage.NodeSample{Node: nid, Tm: tm - tm%p2p_storage.NODE_HISTORY_RESOLUTION, Span: p2p_storage.NODE_HISTORY_RESOLUTION, Count: 1})
+			if tm >= onlineFrom {
+				store.AddNodeOnline(nid, tm, p2p_storage.NODE_VALID_TIME)
+			}
+		}
+	}
+	record("h1", now-week-3600, now-week/2)
+	record("h2", now-2*86400, now-2*86400)
+	record("h3", now-1800, now-1800)
+	for _, c := range []struct {
+		nid  string
+		want float64
+	}{{"h1", 0.5}, {"h2", 1}, {"h3", 0.5}} {
+		detail := &p2p_storage.NodeDetail{Peer: p2p_storage.Peer{ID: c.nid}, RegTm: now - 30*86400, OnlineCount: int(p2p_storage.NODE_ONLINE_STAT_HOURS / 2)}
+		if a := p2p_storage.NodeAvailability(detail); math.Abs(a-c.want) > 0.01 {
+			t.Errorf("%s availability = %f, want %f", c.nid, a, c.want)
+		}
+	}
+}
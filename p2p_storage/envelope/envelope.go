@@ -0,0 +1,118 @@
+/*
+p2p存储的客户端加密信封。
+
+碎片保存在不受信任的家庭设备上，文件在进入p2p存储（纠删码编码）之前先在客户端加密：
+	1. 每个文件生成随机的数据密钥，用AES-256-GCM加密文件内容，得到信封，p2p存储中的md5是信封的md5
+	2. 数据密钥用租户主密钥（AES-256-GCM）包装，包装结果作为p2p_storage.FileKey登记到协调服务
+	3. 下载时协调服务把包装后的数据密钥交给有权限的客户端，客户端用主密钥解开后解密信封
+更换主密钥时只需要重新包装数据密钥（Rotate），信封和碎片都不变，不需要重新扩散。
+
+信封格式：
+	MAGIC(3字节) | VERSION(1字节) | nonce(12字节) | 密文和认证标签
+头部4个字节作为附加认证数据，包装数据密钥时租户和md5作为附加认证数据，包装结果不能挪用到其他文件。
+
+示例：
+	ring := envelope.NewKeyring("t1")
+	ring.AddMasterKey(1, masterKey)
+	sealed, key, e := envelope.Encrypt(ring, data)
+	_, _, e = agent.AddFile(sealed)
+	e = client.SetFileKey(key) //或者在协调服务中调用p2p_storage.AddFileKey
+	...
+	_, _, _, key, e = client.DownloadWithKey(md5)
+	data, e = envelope.Decrypt(ring, key, sealed)
+*/
+package envelope
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"yh_pkg/encrypt/aes"
+	"yh_pkg/p2p_storage"
+)
+
+const (
+	MAGIC         = "YHE"
+	VERSION       = 1
+	HEADER_SIZE   = len(MAGIC) + 1
+	DATA_KEY_SIZE = 32 //AES-256
+)
+
+//是否是信封格式的数据
+func IsSealed(b []byte) bool {
+	return len(b) >= HEADER_SIZE && string(b[:len(MAGIC)]) == MAGIC
+}
+
+func header() []byte {
+	return append([]byte(MAGIC), VERSION)
+}
+
+//生成随机的数据密钥
+func NewDataKey() (key []byte, e error) {
+	key = make([]byte, DATA_KEY_SIZE)
+	if _, e = rand.Read(key); e != nil {
+		return nil, e
+	}
+	return
+}
+
+//用数据密钥加密，返回信封
+func Seal(data, dataKey []byte) (sealed []byte, e error) {
+	if len(dataKey) != DATA_KEY_SIZE {
+		return nil, fmt.Errorf("invalid data key size %d", len(dataKey))
+	}
+	h := header()
+	crypted, e := aes.AesGCMEncrypt(data, dataKey, h)
+	if e != nil {
+		return
+	}
+	return append(h, crypted...), nil
+}
+
+//用数据密钥解开信封，数据被篡改或密钥错误时返回错误
+func Open(sealed, dataKey []byte) (data []byte, e error) {
+	if !IsSealed(sealed) {
+		return nil, errors.New("not sealed data")
+	}
+	if sealed[len(MAGIC)] != VERSION {
+		return nil, fmt.Errorf("unsupported envelope version %d", sealed[len(MAGIC)])
+	}
+	return aes.AesGCMDecrypt(sealed[HEADER_SIZE:], dataKey, sealed[:HEADER_SIZE])
+}
+
+/*
+	加密文件并用租户当前的主密钥包装数据密钥
+
+	返回值：
+		sealed: 信封，作为文件内容添加到p2p存储
+		key: 需要登记到协调服务的文件密钥，MD5为信封的md5
+*/
+func Encrypt(ring *Keyring, data []byte) (sealed []byte, key *p2p_storage.FileKey, e error) {
+	dataKey, e := NewDataKey()
+	if e != nil {
+		return
+	}
+	if sealed, e = Seal(data, dataKey); e != nil {
+		return
+	}
+	sum := md5.Sum(sealed)
+	if key, e = ring.Wrap(hex.EncodeToString(sum[:]), dataKey); e != nil {
+		return nil, nil, e
+	}
+	return
+}
+
+//用文件密钥解密信封，同时校验信封的md5
+func Decrypt(ring *Keyring, key *p2p_storage.FileKey, sealed []byte) (data []byte, e error) {
+	sum := md5.Sum(sealed)
+	if hex.EncodeToString(sum[:]) != key.MD5 {
+		return nil, errors.New("md5 of sealed data mismatch, want " + key.MD5)
+	}
+	dataKey, e := ring.Unwrap(key)
+	if e != nil {
+		return
+	}
+	return Open(sealed, dataKey)
+}
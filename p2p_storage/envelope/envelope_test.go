@@ -0,0 +1,104 @@
+package envelope
+
+import (
+	"bytes"
+	"testing"
+	"yh_pkg/log"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/mem_source"
+)
+
+func masterKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, DATA_KEY_SIZE)
+}
+
+func TestEnvelope(t *testing.T) {
+	ring := NewKeyring("t1")
+	if e := ring.AddMasterKey(1, masterKey(1)); e != nil {
+		t.Fatal(e)
+	}
+	for _, size := range []int{0, 1, 1000} {
+		data := bytes.Repeat([]byte{'a'}, size)
+		sealed, key, e := Encrypt(ring, data)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if !IsSealed(sealed) || size > 100 && bytes.Contains(sealed, data[:100]) {
+			t.Errorf("size %d: not sealed", size)
+		}
+		got, e := Decrypt(ring, key, sealed)
+		if e != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d: Decrypt %v", size, e)
+		}
+		sealed[len(sealed)-1] ^= 1
+		dataKey, _ := ring.Unwrap(key)
+		if _, e = Open(sealed, dataKey); e == nil {
+			t.Errorf("size %d: tampered data opened", size)
+		}
+	}
+
+	//包装的密钥不能用于其他文件和其他租户
+	_, key, _ := Encrypt(ring, []byte("x"))
+	moved := *key
+	moved.MD5 = "0123456789abcdef0123456789abcdef"
+	if _, e := ring.Unwrap(&moved); e == nil {
+		t.Error("key moved to another file unwrapped")
+	}
+	other := NewKeyring("t2")
+	other.AddMasterKey(1, masterKey(1))
+	if _, e := other.Unwrap(key); e == nil {
+		t.Error("key of another tenant unwrapped")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	logger, e := log.NewMLogger("", 1000, "error")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = p2p_storage.Init(mem_source.New(), logger, false); e != nil {
+		t.Fatal(e)
+	}
+	defer p2p_storage.Stop()
+	ring := NewKeyring("t1")
+	ring.AddMasterKey(1, masterKey(1))
+	sealed := make([][]byte, 5)
+	for i := range sealed {
+		var key *p2p_storage.FileKey
+		if sealed[i], key, e = Encrypt(ring, []byte{byte(i)}); e != nil {
+			t.Fatal(e)
+		}
+		if e = p2p_storage.AddFileKey(key); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	ring.AddMasterKey(2, masterKey(2))
+	if n, e := Rotate(ring); e != nil || n != len(sealed) {
+		t.Fatalf("Rotate: %d %v", n, e)
+	}
+	if n, e := Rotate(ring); e != nil || n != 0 {
+		t.Errorf("Rotate again: %d %v", n, e)
+	}
+	//旧主密钥删除后，信封不变仍然可以解密
+	ring.RemoveMasterKey(1)
+	keys, _ := p2p_storage.GetTenantFileKeys("t1", "", 100)
+	if len(keys) != len(sealed) {
+		t.Fatalf("%d keys", len(keys))
+	}
+	for i := range sealed {
+		var found bool
+		for j := range keys {
+			if keys[j].KeyVer != 2 {
+				t.Errorf("key ver %d", keys[j].KeyVer)
+			}
+			if data, e := Decrypt(ring, &keys[j], sealed[i]); e == nil {
+				found = bytes.Equal(data, []byte{byte(i)})
+				break
+			}
+		}
+		if !found {
+			t.Errorf("file %d can not be decrypted", i)
+		}
+	}
+}
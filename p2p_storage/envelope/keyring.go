@@ -0,0 +1,156 @@
+package envelope
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"yh_pkg/encrypt/aes"
+	"yh_pkg/p2p_storage"
+)
+
+//Rotate每次获取的文件密钥数量
+const ROTATE_PAGE_SIZE = 1000
+
+//租户的主密钥，保存在租户自己的客户端或密钥管理服务中，不交给协调服务
+type Keyring struct {
+	Tenant string
+
+	lock sync.RWMutex
+	keys map[uint32][]byte //版本 -> 主密钥
+	cur  uint32
+}
+
+func NewKeyring(tenant string) *Keyring {
+	return &Keyring{Tenant: tenant, keys: make(map[uint32][]byte)}
+}
+
+/*
+	添加主密钥，版本最大的主密钥用于包装新的数据密钥，旧版本保留用于解开还没有更换的数据密钥
+
+	参数：
+		ver: 主密钥版本，从1开始
+		key: 32字节的主密钥
+*/
+func (r *Keyring) AddMasterKey(ver uint32, key []byte) (e error) {
+	if ver == 0 {
+		return errors.New("master key version must be positive")
+	}
+	if len(key) != DATA_KEY_SIZE {
+		return fmt.Errorf("invalid master key size %d", len(key))
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.keys[ver] = append([]byte(nil), key...)
+	if ver > r.cur {
+		r.cur = ver
+	}
+	return
+}
+
+//删除旧的主密钥，所有数据密钥都更换之后调用
+func (r *Keyring) RemoveMasterKey(ver uint32) (e error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if ver == r.cur {
+		return errors.New("can not remove current master key")
+	}
+	delete(r.keys, ver)
+	return
+}
+
+//当前主密钥的版本
+func (r *Keyring) Current() uint32 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cur
+}
+
+func (r *Keyring) masterKey(ver uint32) (key []byte, e error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	key, ok := r.keys[ver]
+	if !ok {
+		return nil, fmt.Errorf("master key %d of tenant %s not found", ver, r.Tenant)
+	}
+	return
+}
+
+//包装时的附加认证数据，包装结果只能用于该租户的该文件
+func (r *Keyring) aad(md5 string) []byte {
+	return []byte(r.Tenant + "/" + md5)
+}
+
+//用当前主密钥包装数据密钥
+func (r *Keyring) Wrap(md5 string, dataKey []byte) (key *p2p_storage.FileKey, e error) {
+	ver := r.Current()
+	master, e := r.masterKey(ver)
+	if e != nil {
+		return
+	}
+	wrapped, e := aes.AesGCMEncrypt(dataKey, master, r.aad(md5))
+	if e != nil {
+		return
+	}
+	return &p2p_storage.FileKey{MD5: md5, Tenant: r.Tenant, KeyVer: ver, Wrapped: wrapped}, nil
+}
+
+//解开数据密钥
+func (r *Keyring) Unwrap(key *p2p_storage.FileKey) (dataKey []byte, e error) {
+	if key.Tenant != r.Tenant {
+		return nil, fmt.Errorf("file %s belongs to tenant %s, not %s", key.MD5, key.Tenant, r.Tenant)
+	}
+	master, e := r.masterKey(key.KeyVer)
+	if e != nil {
+		return
+	}
+	if dataKey, e = aes.AesGCMDecrypt(key.Wrapped, master, r.aad(key.MD5)); e != nil {
+		return nil, fmt.Errorf("unwrap key of file %s error: %v", key.MD5, e)
+	}
+	return
+}
+
+//用当前主密钥重新包装，已经是当前主密钥时返回原来的密钥
+func (r *Keyring) Rewrap(key *p2p_storage.FileKey) (newKey *p2p_storage.FileKey, e error) {
+	if key.KeyVer == r.Current() {
+		return key, nil
+	}
+	dataKey, e := r.Unwrap(key)
+	if e != nil {
+		return
+	}
+	return r.Wrap(key.MD5, dataKey)
+}
+
+/*
+	把租户所有文件的数据密钥更换为当前主密钥包装，需要先调用p2p_storage.Init。
+	只修改协调服务中的FileKey，信封和碎片不变。中途失败时可以重新调用，已经更换的密钥会跳过。
+
+	返回值：
+		n: 更换的密钥数量
+*/
+func Rotate(ring *Keyring) (n int, e error) {
+	from := ""
+	for {
+		keys, e := p2p_storage.GetTenantFileKeys(ring.Tenant, from, ROTATE_PAGE_SIZE)
+		if e != nil {
+			return n, e
+		}
+		for i := range keys {
+			newKey, e := ring.Rewrap(&keys[i])
+			if e != nil {
+				return n, e
+			}
+			if newKey == &keys[i] {
+				continue
+			}
+			if e = p2p_storage.RewrapFileKey(newKey, keys[i].KeyVer); e != nil {
+				return n, e
+			}
+			n++
+		}
+		if len(keys) < ROTATE_PAGE_SIZE {
+			return n, nil
+		}
+		from = keys[len(keys)-1].MD5
+	}
+}
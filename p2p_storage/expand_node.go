@@ -14,14 +14,15 @@ type ExpandNode struct {
 	Size        uint64 `json:"size"`         //文件大小
 	Level       int8   `json:"level"`        //任务优先级
 	Ver         uint64 `json:"ver"`          //文件在组中的版本
+	TransType   int8   `json:"trans_type"`   //传输方式，EXPAND_TRANS_TYPE_*，零值为EXPAND_TRANS_TYPE_NODE
 }
 
 func createExpandNode(gid, nid, md5 string, size uint64, level int8) (exNode *ExpandNode) {
-	return &ExpandNode{0, gid, nid, md5, EXPAND_STATE_INIT, time.Now.Unix(), CalculateExpandNodeTimeout(EXPAND_STATE_INIT), 0, size, level, 0}
+	return &ExpandNode{0, gid, nid, md5, EXPAND_STATE_INIT, time.Now.Unix(), CalculateExpandNodeTimeout(EXPAND_STATE_INIT), 0, size, level, 0, EXPAND_TRANS_TYPE_NODE}
 }
 
 func createP2PExpandNode(gid, nid, md5 string, size uint64, level int8) (exNode *ExpandNode) {
-	return &ExpandNode{0, gid, nid, md5, EXPAND_STATE_NOTIFIED, time.Now.Unix(), CalculateExpandNodeTimeout(EXPAND_STATE_NOTIFIED), 0, size, level, 0}
+	return &ExpandNode{0, gid, nid, md5, EXPAND_STATE_NOTIFIED, time.Now.Unix(), CalculateExpandNodeTimeout(EXPAND_STATE_NOTIFIED), 0, size, level, 0, EXPAND_TRANS_TYPE_NODE}
 }
 
 func (en *ExpandNode) IsFinished() bool {
@@ -0,0 +1,329 @@
+package p2p_storage
+
+import (
+	"fmt"
+	"yh_pkg/log"
+	"yh_pkg/service"
+	"yh_pkg/time"
+	"yh_pkg/trace"
+)
+
+//失败重试的退避时间：第n次失败后等待EXPAND_RETRY_BACKOFF_BASE*2^(n-1)秒，不超过EXPAND_RETRY_BACKOFF_MAX
+const (
+	EXPAND_RETRY_BACKOFF_BASE int64 = 60
+	EXPAND_RETRY_BACKOFF_MAX  int64 = 3600
+)
+
+//最后一次失败后这么多秒没有再失败时重试记录清零，超过失败次数上限的文件也会再次尝试
+const EXPAND_ATTEMPT_RESET_SEC int64 = 86400
+
+//重试时最多从这么多个源节点中选择没有失败过的节点
+const EXPAND_RETRY_SOURCE_NUM = 10
+
+//每个任务最多保留的状态转换记录数
+const EXPAND_HISTORY_MAX = 50
+
+var EXPAND_STATE_NAMES = []string{"init", "notified", "started", "finished", "failed"}
+
+/*
+	扩散任务状态的合法转换：
+		INIT -> NOTIFIED: 任务分配给节点（FetchExpandTasks）
+		NOTIFIED -> STARTED: 节点获取任务详情开始执行（GetExpandTaskById）
+		NOTIFIED、STARTED -> FINISHED: 执行成功（ExpandFinished、P2PExpandFinished）
+		INIT、NOTIFIED、STARTED -> FAILED: 执行失败、超时、节点离线或重启，节点离线或重启不计入重试的失败次数
+		FAILED -> INIT: 退避时间过后重试
+		FINISHED -> INIT: 文件有新版本需要再次扩散
+	INIT、NOTIFIED、STARTED超时后按FAILED处理。
+*/
+var EXPAND_TRANSITIONS = map[int8][]int8{
+	EXPAND_STATE_INIT:     {EXPAND_STATE_NOTIFIED, EXPAND_STATE_FAILED},
+	EXPAND_STATE_NOTIFIED: {EXPAND_STATE_STARTED, EXPAND_STATE_FINISHED, EXPAND_STATE_FAILED},
+	EXPAND_STATE_STARTED:  {EXPAND_STATE_FINISHED, EXPAND_STATE_FAILED},
+	EXPAND_STATE_FINISHED: {EXPAND_STATE_INIT},
+	EXPAND_STATE_FAILED:   {EXPAND_STATE_INIT},
+}
+
+//一次状态转换
+type ExpandTransition struct {
+	Task   uint64 `json:"task"`
+	Node   string `json:"node"`
+	From   int8   `json:"from"`
+	To     int8   `json:"to"`
+	Tm     int64  `json:"tm"`
+	Reason string `json:"reason"`
+}
+
+//分组中一个文件的扩散重试记录，成功后删除
+type ExpandAttempt struct {
+	Group       string   `json:"group"`
+	MD5         string   `json:"md5"`
+	Attempts    uint32   `json:"attempts"`     //失败次数
+	LastTm      int64    `json:"last_tm"`      //最后一次失败的时间
+	NextTm      int64    `json:"next_tm"`      //退避结束时间，之前不再创建任务
+	FailedNodes []string `json:"failed_nodes"` //失败过的源节点，重试时优先选择其他节点
+}
+
+/*
+	扩散任务状态转换记录和重试记录的存储，IDataSource同时实现该接口时Init会自动使用。
+	没有设置时只检查状态转换是否合法，不记录历史，重试只受任务自身失败次数的限制。
+*/
+type IExpandStateStore interface {
+	//超过EXPAND_HISTORY_MAX条时可以删除最早的记录
+	AddExpandTransition(t *ExpandTransition) (e error)
+	//按时间顺序返回
+	GetExpandTransitions(task uint64) (ts []ExpandTransition, e error)
+	//不存在时返回nil,nil
+	GetExpandAttempt(gid, md5 string) (a *ExpandAttempt, e error)
+	SetExpandAttempt(a *ExpandAttempt) (e error)
+	DeleteExpandAttempt(gid, md5 string) (e error)
+}
+
+var expandStateStore IExpandStateStore
+
+//设置扩散任务状态存储，覆盖Init时自动检测的结果
+func SetExpandStateStore(s IExpandStateStore) {
+	expandStateStore = s
+}
+
+func expandStateName(state int8) string {
+	if state >= 0 && int(state) < len(EXPAND_STATE_NAMES) {
+		return EXPAND_STATE_NAMES[state]
+	}
+	return fmt.Sprintf("unknown(%d)", state)
+}
+
+//状态转换是否合法
+func CanTransitExpandState(from, to int8) bool {
+	for _, s := range EXPAND_TRANSITIONS[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+//检查状态转换，不合法时返回ERR_P2P_EXPAND_STATE_INVALID
+func checkExpandTransition(exNode *ExpandNode, to int8) (e error) {
+	if !CanTransitExpandState(exNode.State, to) {
+		return service.NewError(service.ERR_P2P_EXPAND_STATE_INVALID, fmt.Sprintf("expand task %d: invalid transition %s -> %s",
+			exNode.ID, expandStateName(exNode.State), expandStateName(to)))
+	}
+	return
+}
+
+//任务是否还没有结束但已经超时
+func isExpandTimeout(exNode *ExpandNode) bool {
+	return exNode.State != EXPAND_STATE_FINISHED && exNode.State != EXPAND_STATE_FAILED && exNode.Timeout <= time.Now.Unix()
+}
+
+//第attempts次失败后的退避时间
+func expandBackoff(attempts uint32) (sec int64) {
+	sec = EXPAND_RETRY_BACKOFF_BASE
+	for i := uint32(1); i < attempts && sec < EXPAND_RETRY_BACKOFF_MAX; i++ {
+		sec *= 2
+	}
+	if sec > EXPAND_RETRY_BACKOFF_MAX {
+		sec = EXPAND_RETRY_BACKOFF_MAX
+	}
+	return
+}
+
+/*
+	记录状态转换，失败时增加重试记录的失败次数，成功时删除重试记录。记录失败只写日志，不影响任务本身。
+*/
+func recordExpandTransition(exNode *ExpandNode, to int8, reason string) {
+	recordNodeTask(exNode.Node, to)
+	if expandStateStore == nil {
+		return
+	}
+	addExpandTransition(exNode, to, reason)
+	switch to {
+	case EXPAND_STATE_FINISHED:
+		deleteExpandAttempt(exNode.Group, exNode.MD5)
+	case EXPAND_STATE_FAILED:
+		a, e := expandStateStore.GetExpandAttempt(exNode.Group, exNode.MD5)
+		if e != nil {
+			logger.AppendObj(e, "GetExpandAttempt error", exNode.Group, exNode.MD5)
+			return
+		}
+		now := time.Now.Unix()
+		if a == nil || isExpandAttemptExpired(a, now) {
+			a = &ExpandAttempt{Group: exNode.Group, MD5: exNode.MD5}
+		}
+		a.Attempts++
+		a.LastTm = now
+		a.NextTm = now + expandBackoff(a.Attempts)
+		if !containsString(a.FailedNodes, exNode.Node) {
+			a.FailedNodes = append(a.FailedNodes, exNode.Node)
+		}
+		if e = expandStateStore.SetExpandAttempt(a); e != nil {
+			logger.AppendObj(e, "SetExpandAttempt error", a)
+		}
+	}
+}
+
+func addExpandTransition(exNode *ExpandNode, to int8, reason string) {
+	t := &ExpandTransition{exNode.ID, exNode.Node, exNode.State, to, time.Now.Unix(), reason}
+	if e := expandStateStore.AddExpandTransition(t); e != nil {
+		logger.AppendObj(e, "AddExpandTransition error", t)
+	}
+}
+
+//重试记录是否已经过了EXPAND_ATTEMPT_RESET_SEC，没有LastTm的旧记录按退避结束时间计算
+func isExpandAttemptExpired(a *ExpandAttempt, now int64) bool {
+	last := a.LastTm
+	if last == 0 {
+		last = a.NextTm
+	}
+	return last+EXPAND_ATTEMPT_RESET_SEC <= now
+}
+
+/*
+	按状态机修改任务状态
+
+	参数：
+		reason: 记录在转换历史中的原因
+	返回值：
+		e: 转换不合法时为ERR_P2P_EXPAND_STATE_INVALID
+*/
+func (ds *DataSource) transitExpandNode(exNode *ExpandNode, to int8, reason string) (e error) {
+	if e = checkExpandTransition(exNode, to); e != nil {
+		return
+	}
+	if e = ds.UpdateExpandNodeState(exNode.Group, exNode.Node, exNode.MD5, to); e != nil {
+		return
+	}
+	recordExpandTransition(exNode, to, reason)
+	exNode.State = to
+	return
+}
+
+/*
+	节点离线或重启时记录节点还没有结束的任务被中断，需要在批量修改状态之前调用。
+	这不是文件本身的问题，不计入重试的失败次数，也不进入退避
+*/
+func (ds *DataSource) recordNodeExpandInterrupted(nid, reason string) {
+	if expandStateStore == nil {
+		return
+	}
+	for _, state := range []int8{EXPAND_STATE_INIT, EXPAND_STATE_NOTIFIED, EXPAND_STATE_STARTED} {
+		exNodes, e := ds.Raw.GetExpandTasks(nid, state, int(MAX_NODE_EXPANDTASK_CNT))
+		if e != nil {
+			logger.Append("GetExpandTasks error: "+e.Error(), log.ERROR)
+			continue
+		}
+		for i := range exNodes {
+			addExpandTransition(&exNodes[i], EXPAND_STATE_FAILED, reason)
+		}
+	}
+}
+
+//任务的状态转换历史
+func GetExpandTransitions(id uint64) (ts []ExpandTransition, e error) {
+	defer trace.Begin("p2p_storage.GetExpandTransitions").SetAttr("id", id).End(&e)
+	if expandStateStore == nil {
+		return
+	}
+	return expandStateStore.GetExpandTransitions(id)
+}
+
+//文件在分组中的重试记录，没有失败过时返回nil
+func GetExpandAttempt(gid, md5 string) (a *ExpandAttempt, e error) {
+	span := trace.Begin("p2p_storage.GetExpandAttempt")
+	defer span.SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	if expandStateStore == nil {
+		return
+	}
+	return expandStateStore.GetExpandAttempt(gid, md5)
+}
+
+//管理操作：清除文件在分组中的重试记录，超过失败次数上限的文件可以马上再次尝试
+func ResetExpandAttempt(gid, md5 string) (e error) {
+	span := trace.Begin("p2p_storage.ResetExpandAttempt")
+	defer span.SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	if expandStateStore == nil {
+		return
+	}
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	return expandStateStore.DeleteExpandAttempt(gid, md5)
+}
+
+func deleteExpandAttempt(gid, md5 string) {
+	if expandStateStore == nil {
+		return
+	}
+	if e := expandStateStore.DeleteExpandAttempt(gid, md5); e != nil {
+		logger.AppendObj(e, "DeleteExpandAttempt error", gid, md5)
+	}
+}
+
+/*
+	创建重试任务前检查失败次数上限和退避时间，任务的节点失败过时换一个没有失败过的源节点。
+	最后一次失败超过EXPAND_ATTEMPT_RESET_SEC时清除重试记录
+
+	返回值：
+		ok: 为false时还在退避时间内，暂不创建任务
+		e: 超过expand_max_fail_times时为ERR_P2P_EXPAND_RETRY_EXCEEDED
+*/
+func (ds *DataSource) prepareExpandRetry(exNode *ExpandNode) (ok bool, e error) {
+	maxFail := getConfigInt64(EXPAND_MAX_FAIL_TIMES_KEY, DEFAULT_EXPAND_MAX_FAIL_TIMES)
+	if expandStateStore == nil {
+		//没有重试记录时按该节点上任务的失败次数限制
+		ex, e := ds.Raw.GetExpandNode(exNode.Group, exNode.Node, exNode.MD5)
+		if e != nil {
+			return false, e
+		}
+		if ex != nil && maxFail > 0 && int64(ex.FailedTimes) >= maxFail {
+			return false, retryExceededError(exNode, ex.FailedTimes)
+		}
+		return true, nil
+	}
+	a, e := expandStateStore.GetExpandAttempt(exNode.Group, exNode.MD5)
+	if e != nil || a == nil {
+		return e == nil, e
+	}
+	if isExpandAttemptExpired(a, time.Now.Unix()) {
+		deleteExpandAttempt(exNode.Group, exNode.MD5)
+		return true, nil
+	}
+	if maxFail > 0 && int64(a.Attempts) >= maxFail {
+		return false, retryExceededError(exNode, a.Attempts)
+	}
+	if a.NextTm > time.Now.Unix() {
+		return false, nil
+	}
+	if !containsString(a.FailedNodes, exNode.Node) {
+		return true, nil
+	}
+	peers, e := ds.GetOnlineSourceFileNodes(exNode.MD5, EXPAND_RETRY_SOURCE_NUM)
+	if e != nil {
+		return false, e
+	}
+	for _, peer := range peers {
+		if !containsString(a.FailedNodes, peer.ID) {
+			logger.AppendObj(nil, "prepareExpandRetry change node", exNode.Group, exNode.MD5, exNode.Node, "->", peer.ID)
+			exNode.Node = peer.ID
+			return true, nil
+		}
+	}
+	//所有源节点都失败过，仍然使用原来的节点
+	return true, nil
+}
+
+func retryExceededError(exNode *ExpandNode, attempts uint32) error {
+	return service.NewError(service.ERR_P2P_EXPAND_RETRY_EXCEEDED, fmt.Sprintf("expand of %s in group %s failed %d times", exNode.MD5, exNode.Group, attempts))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
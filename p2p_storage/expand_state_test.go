@@ -0,0 +1,135 @@
+package p2p_storage_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+)
+
+func TestCanTransitExpandState(t *testing.T) {
+	cases := []struct {
+		from, to int8
+		ok       bool
+	}{
+		{p2p_storage.EXPAND_STATE_INIT, p2p_storage.EXPAND_STATE_NOTIFIED, true},
+		{p2p_storage.EXPAND_STATE_INIT, p2p_storage.EXPAND_STATE_FINISHED, false},
+		{p2p_storage.EXPAND_STATE_NOTIFIED, p2p_storage.EXPAND_STATE_FINISHED, true},
+		{p2p_storage.EXPAND_STATE_STARTED, p2p_storage.EXPAND_STATE_FAILED, true},
+		{p2p_storage.EXPAND_STATE_STARTED, p2p_storage.EXPAND_STATE_NOTIFIED, false},
+		{p2p_storage.EXPAND_STATE_FAILED, p2p_storage.EXPAND_STATE_FAILED, false},
+		{p2p_storage.EXPAND_STATE_FAILED, p2p_storage.EXPAND_STATE_INIT, true},
+		{p2p_storage.EXPAND_STATE_FINISHED, p2p_storage.EXPAND_STATE_INIT, true},
+	}
+	for _, c := range cases {
+		if ok := p2p_storage.CanTransitExpandState(c.from, c.to); ok != c.ok {
+			t.Errorf("%d -> %d: %v, want %v", c.from, c.to, ok, c.ok)
+		}
+	}
+}
+
+//扩散任务失败后退避，重试时换一个没有失败过的源节点，超过失败次数上限后不再重试
+func TestExpandRetry(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	const md5 = "0123456789abcdef0123456789abcdef"
+	f.addFile(md5, nil)
+	f.sync(md5)
+
+	//没有碎片的新节点，GenPiece为它创建扩散任务
+	f.addNode("new", GID)
+	genPiece := func() (task *p2p_storage.ExpandNode, e error) {
+		f.ds.SetAtomicGetLastCheckerTm(p2p_storage.CHECKER_GEN_PIECETM_PRIFIX+GID+md5, 0, -1)
+		if e = p2p_storage.GenPiece(GID, "new", md5); e != nil {
+			return
+		}
+		if tasks, _ := f.ds.GetValidExpandNodes(GID, md5); len(tasks) > 0 {
+			task = &tasks[0]
+		}
+		return
+	}
+	task, e := genPiece()
+	if e != nil || task == nil {
+		t.Fatalf("GenPiece = %v %v", task, e)
+	}
+	if e = p2p_storage.ExpandFinished(task.ID, int8(p2p_storage.YES)); errCode(e) != service.ERR_P2P_EXPAND_STATE_INVALID {
+		t.Errorf("finish init task: %v", e)
+	}
+	//源节点心跳时取到任务
+	node := &p2p_storage.Node{Peer: p2p_storage.Peer{ID: task.Node}, TotalSpace: 100 * p2p_storage.GROUP_NODE_CAPACITY}
+	if _, _, _, e = p2p_storage.UpdateNode2(node, nil, nil, p2p_storage.YES); e != nil {
+		t.Fatal(e)
+	}
+	if _, _, _, _, e = p2p_storage.GetExpandTaskById(task.ID); e != nil {
+		t.Fatal(e)
+	}
+	if e = p2p_storage.ExpandFinished(task.ID, int8(p2p_storage.NO)); e != nil {
+		t.Fatal(e)
+	}
+	if e = p2p_storage.ExpandFinished(task.ID, int8(p2p_storage.NO)); errCode(e) != service.ERR_P2P_EXPAND_STATE_INVALID {
+		t.Errorf("finish failed task: %v", e)
+	}
+	ts, e := p2p_storage.GetExpandTransitions(task.ID)
+	if e != nil || len(ts) != 3 || ts[0].To != p2p_storage.EXPAND_STATE_NOTIFIED || ts[1].To != p2p_storage.EXPAND_STATE_STARTED || ts[2].To != p2p_storage.EXPAND_STATE_FAILED {
+		t.Errorf("transitions = %+v %v", ts, e)
+	}
+	attempt, e := p2p_storage.GetExpandAttempt(GID, md5)
+	if e != nil || attempt == nil || attempt.Attempts != 1 || attempt.NextTm <= time.Now().Unix() || fmt.Sprint(attempt.FailedNodes) != "["+task.Node+"]" {
+		t.Fatalf("attempt = %+v %v", attempt, e)
+	}
+
+	//退避时间内不重试
+	if retry, e := genPiece(); e != nil || retry != nil {
+		t.Errorf("retry during backoff = %+v %v", retry, e)
+	}
+
+	//除了n05都失败过，n05有源文件，重试任务一定分配给n05
+	attempt.NextTm, attempt.FailedNodes = 0, []string{"new"}
+	for i := 0; i < NODE_NUM; i++ {
+		if nid := fmt.Sprintf("n%02d", i); nid != "n05" {
+			attempt.FailedNodes = append(attempt.FailedNodes, nid)
+		}
+	}
+	f.ds.SetExpandAttempt(attempt)
+	f.ds.AddSourceFile("n05", md5)
+	retry, e := genPiece()
+	if e != nil || retry == nil || retry.Node != "n05" {
+		t.Fatalf("retry = %+v %v", retry, e)
+	}
+
+	//超过失败次数上限
+	f.ds.DeleteExpandNode(retry.Group, retry.Node, retry.MD5)
+	attempt.Attempts = uint32(p2p_storage.DEFAULT_EXPAND_MAX_FAIL_TIMES)
+	f.ds.SetExpandAttempt(attempt)
+	if _, e = genPiece(); errCode(e) != service.ERR_P2P_EXPAND_RETRY_EXCEEDED {
+		t.Errorf("retry after max failures: %v", e)
+	}
+
+	//管理员清除重试记录后马上重试
+	if e = p2p_storage.ResetExpandAttempt(GID, md5); e != nil {
+		t.Fatal(e)
+	}
+	if retry, e = genPiece(); e != nil || retry == nil {
+		t.Fatalf("retry after reset = %+v %v", retry, e)
+	}
+
+	//节点重启中断的任务不计入失败次数
+	if e = p2p_storage.RestartInitExpandNodeState(retry.Node); e != nil {
+		t.Fatal(e)
+	}
+	if a, e := p2p_storage.GetExpandAttempt(GID, md5); e != nil || a != nil {
+		t.Errorf("attempt after node restart = %+v %v", a, e)
+	}
+
+	//最后一次失败超过EXPAND_ATTEMPT_RESET_SEC后重试记录清零
+	f.ds.DeleteExpandNode(retry.Group, retry.Node, retry.MD5)
+	attempt.LastTm = time.Now().Unix() - p2p_storage.EXPAND_ATTEMPT_RESET_SEC
+	f.ds.SetExpandAttempt(attempt)
+	if retry, e = genPiece(); e != nil || retry == nil {
+		t.Fatalf("retry after attempts expired = %+v %v", retry, e)
+	}
+	if a, e := p2p_storage.GetExpandAttempt(GID, md5); e != nil || a != nil {
+		t.Errorf("expired attempt = %+v %v", a, e)
+	}
+}
@@ -0,0 +1,298 @@
+package p2p_storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"yh_pkg/service"
+)
+
+/*
+	文件ID：十六进制编码的multihash，即哈希算法编码、摘要长度、摘要，sha256的文件ID为"1220"加64位十六进制摘要。
+	32位十六进制的md5是旧的文件标识，仍然可以使用，md5的multihash形式（"d510"开头）按md5处理。
+
+	md5可以构造碰撞，恶意上传者可以抢先添加与正常文件md5相同的文件。新文件使用sha256的文件ID作为存储中的标识
+	（GroupFile.MD5等字段），与md5相同的旧文件互不影响。对应关系只在AddP2PFileWithID添加文件时登记，两个摘要由
+	添加文件的节点用文件内容计算；md5已经对应其他文件（登记过或者是已有的md5文件）时不登记，md5仍然查到原来的文件。
+	登记的对应关系不能修改，文件删除时一起删除。
+*/
+const (
+	MULTIHASH_SHA2_256 byte = 0x12
+	MULTIHASH_MD5      byte = 0xd5
+)
+
+//旧的md5标识的长度
+const FILE_MD5_LEN = 32
+
+var multihashSizes = map[byte]int{
+	MULTIHASH_SHA2_256: sha256.Size,
+	MULTIHASH_MD5:      md5.Size,
+}
+
+//sha256的文件ID和旧的md5标识的对应关系
+type FileIDBinding struct {
+	ID  string `json:"id"`  //sha256的文件ID
+	MD5 string `json:"md5"` //旧的md5标识
+	Key string `json:"key"` //存储中使用的标识，AddP2PFileWithID登记的为ID，旧版本登记已有文件时为MD5
+}
+
+/*
+	文件ID对应关系的存储，实现可以与IDataSource使用同一个数据库，IDataSource同时实现该接口时Init会自动使用。
+	没有设置时只能使用文件添加时的标识，不能用另一种标识查找。
+*/
+type IFileIDStore interface {
+	//不存在时返回nil,nil
+	GetFileIDBinding(id string) (b *FileIDBinding, e error)
+	//不存在时返回nil,nil
+	GetFileIDByMD5(md5 string) (b *FileIDBinding, e error)
+	//ID或MD5已经登记过时不保存，返回false
+	SetFileIDBinding(b *FileIDBinding) (ok bool, e error)
+	DeleteFileIDBinding(id string) (e error)
+}
+
+var fileIDStore IFileIDStore
+
+//设置文件ID对应关系的存储，覆盖Init时自动检测的结果
+func SetFileIDStore(s IFileIDStore) {
+	fileIDStore = s
+}
+
+//按multihash格式编码文件ID
+func NewFileID(code byte, digest []byte) string {
+	return hex.EncodeToString(append([]byte{code, byte(len(digest))}, digest...))
+}
+
+//文件内容的sha256文件ID
+func SHA256FileID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return NewFileID(MULTIHASH_SHA2_256, sum[:])
+}
+
+/*
+	解析文件ID
+
+	参数：
+		id: 32位的md5或者multihash形式的文件ID
+	返回值：
+		code: 哈希算法，MULTIHASH_SHA2_256或MULTIHASH_MD5
+		digest: 摘要
+*/
+func ParseFileID(id string) (code byte, digest []byte, e error) {
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return 0, nil, service.NewError(service.ERR_INVALID_PARAM, "file id "+id+" is invalid")
+	}
+	if len(id) == FILE_MD5_LEN {
+		return MULTIHASH_MD5, b, nil
+	}
+	if len(b) < 2 || multihashSizes[b[0]] == 0 || int(b[1]) != multihashSizes[b[0]] || len(b) != 2+int(b[1]) {
+		return 0, nil, service.NewError(service.ERR_INVALID_PARAM, "file id "+id+" is invalid")
+	}
+	return b[0], b[2:], nil
+}
+
+//是否是sha256的文件ID
+func IsSHA256FileID(id string) bool {
+	code, _, e := ParseFileID(id)
+	return e == nil && code == MULTIHASH_SHA2_256
+}
+
+//检查文件ID，md5的multihash形式转换为32位的md5
+func NormalizeFileID(id string) (nid string, code byte, e error) {
+	if code, _, e = ParseFileID(id); e != nil {
+		return
+	}
+	if code == MULTIHASH_MD5 && len(id) != FILE_MD5_LEN {
+		return id[4:], code, nil
+	}
+	return id, code, nil
+}
+
+//文件内容与文件ID是否一致
+func VerifyFileID(id string, data []byte) bool {
+	code, digest, e := ParseFileID(id)
+	if e != nil {
+		return false
+	}
+	switch code {
+	case MULTIHASH_SHA2_256:
+		sum := sha256.Sum256(data)
+		return bytes.Equal(sum[:], digest)
+	case MULTIHASH_MD5:
+		sum := md5.Sum(data)
+		return bytes.Equal(sum[:], digest)
+	}
+	return false
+}
+
+//文件ID中的摘要部分（十六进制），用于按前缀分散存储
+func fileIDDigest(id string) string {
+	if len(id) > FILE_MD5_LEN {
+		if _, _, e := ParseFileID(id); e == nil {
+			return id[4:]
+		}
+	}
+	return id
+}
+
+/*
+	把API中的文件标识转换为存储中使用的标识：登记过对应关系时返回登记的Key，否则原样返回
+
+	参数：
+		id: md5或文件ID
+	返回值：
+		e: 格式不正确时为ERR_INVALID_PARAM
+*/
+func ResolveFileKey(id string) (key string, e error) {
+	return WithSpan(nil).ResolveFileKey(id)
+}
+
+func (c Caller) ResolveFileKey(id string) (key string, e error) {
+	defer c.parent.Child("p2p_storage.ResolveFileKey").SetAttr("id", id).End(&e)
+	key, code, e := NormalizeFileID(id)
+	if e != nil || fileIDStore == nil {
+		return
+	}
+	var b *FileIDBinding
+	if code == MULTIHASH_SHA2_256 {
+		b, e = fileIDStore.GetFileIDBinding(key)
+	} else {
+		b, e = fileIDStore.GetFileIDByMD5(key)
+	}
+	if e != nil || b == nil {
+		return
+	}
+	return b.Key, nil
+}
+
+//批量转换，返回存储中的标识到原标识的对应关系，多个原标识可能对应同一个文件
+func resolveFileKeys(ids []string) (keys []string, origin map[string][]string, e error) {
+	keys = make([]string, 0, len(ids))
+	origin = make(map[string][]string, len(ids))
+	for _, id := range ids {
+		key, e := ResolveFileKey(id)
+		if e != nil {
+			return nil, nil, e
+		}
+		if _, ok := origin[key]; !ok {
+			keys = append(keys, key)
+		}
+		origin[key] = append(origin[key], id)
+	}
+	return
+}
+
+/*
+	用sha256的文件ID添加文件，同时登记文件ID和md5的对应关系，之后两种标识都可以查到这个文件。
+	文件总是以文件ID保存；文件ID或md5已经登记过、md5是已有的文件时不登记，只添加文件，不会改变md5对应的文件。
+
+	参数：
+		id: sha256的文件ID
+		md5: 同一文件内容的md5，调用方需要用文件内容校验过两个摘要
+		其他参数和返回值与AddP2PFile相同
+*/
+func AddP2PFileWithID(id, md5, src_node string, size uint64, times int, add_no_source_file bool) (task_id int64, e error) {
+	return WithSpan(nil).AddP2PFileWithID(id, md5, src_node, size, times, add_no_source_file)
+}
+
+func (c Caller) AddP2PFileWithID(id, md5, src_node string, size uint64, times int, add_no_source_file bool) (task_id int64, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.AddP2PFileWithID")
+	defer span.SetAttr("md5", md5).SetAttr("id", id).SetAttr("src_node", src_node).End(&e)
+	if !IsSHA256FileID(id) {
+		return 0, service.NewError(service.ERR_INVALID_PARAM, "file id "+id+" is not sha256")
+	}
+	md5, code, e := NormalizeFileID(md5)
+	if e != nil {
+		return
+	}
+	if code != MULTIHASH_MD5 {
+		return 0, service.NewError(service.ERR_INVALID_PARAM, "md5 "+md5+" is invalid")
+	}
+	task_id, e = WithSpan(span).AddP2PFile(id, src_node, size, times, add_no_source_file)
+	if fileIDStore == nil || e != nil && !isFileAdded(e) {
+		return
+	}
+	if err := source.bindFileID(id, md5); err != nil {
+		logger.AppendObj(err, "AddP2PFileWithID-bindFileID error", id, md5)
+	}
+	return
+}
+
+//登记新添加的文件的对应关系，md5已经对应其他文件时返回ERR_P2P_FILE_ID_CONFLICT
+func (ds *DataSource) bindFileID(id, md5 string) (e error) {
+	b, e := fileIDStore.GetFileIDBinding(id)
+	if e != nil {
+		return
+	}
+	if b != nil {
+		if b.MD5 == md5 {
+			return
+		}
+		return fileIDConflictError(b)
+	}
+	if b, e = fileIDStore.GetFileIDByMD5(md5); e != nil {
+		return
+	}
+	if b != nil {
+		return fileIDConflictError(b)
+	}
+	exist, e := ds.IsFileExists(md5)
+	if e != nil {
+		return
+	}
+	if exist {
+		return service.NewError(service.ERR_P2P_FILE_ID_CONFLICT, "md5 "+md5+" is an existing file")
+	}
+	ok, e := fileIDStore.SetFileIDBinding(&FileIDBinding{ID: id, MD5: md5, Key: id})
+	if e != nil {
+		return
+	}
+	if !ok {
+		return service.NewError(service.ERR_P2P_FILE_ID_CONFLICT, fmt.Sprintf("file id %s or md5 %s already bound", id, md5))
+	}
+	return
+}
+
+func fileIDConflictError(b *FileIDBinding) error {
+	return service.NewError(service.ERR_P2P_FILE_ID_CONFLICT, fmt.Sprintf("file id %s already bound to md5 %s", b.ID, b.MD5))
+}
+
+/*
+	查找文件ID的对应关系
+
+	参数：
+		id: md5或sha256的文件ID
+	返回值：
+		b: 没有登记时为nil
+*/
+func GetFileIDBinding(id string) (b *FileIDBinding, e error) {
+	return WithSpan(nil).GetFileIDBinding(id)
+}
+
+func (c Caller) GetFileIDBinding(id string) (b *FileIDBinding, e error) {
+	defer c.parent.Child("p2p_storage.GetFileIDBinding").SetAttr("id", id).End(&e)
+	id, code, e := NormalizeFileID(id)
+	if e != nil || fileIDStore == nil {
+		return
+	}
+	if code == MULTIHASH_SHA2_256 {
+		return fileIDStore.GetFileIDBinding(id)
+	}
+	return fileIDStore.GetFileIDByMD5(id)
+}
+
+//文件从p2p系统删除后删除对应关系，key为存储中的标识
+func deleteFileIDBinding(key string) {
+	if fileIDStore == nil {
+		return
+	}
+	b, e := GetFileIDBinding(key)
+	if e == nil && b != nil && b.Key == key {
+		e = fileIDStore.DeleteFileIDBinding(b.ID)
+	}
+	if e != nil {
+		logger.AppendObj(e, "deleteFileIDBinding error", key)
+	}
+}
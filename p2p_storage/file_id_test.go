@@ -0,0 +1,158 @@
+package p2p_storage_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+)
+
+func TestNormalizeFileID(t *testing.T) {
+	const m = "0123456789abcdef0123456789abcdef"
+	id := p2p_storage.SHA256FileID([]byte("data"))
+	cases := []struct {
+		id, want string
+		code     byte
+		ok       bool
+	}{
+		{m, m, p2p_storage.MULTIHASH_MD5, true},
+		{"d510" + m, m, p2p_storage.MULTIHASH_MD5, true},
+		{id, id, p2p_storage.MULTIHASH_SHA2_256, true},
+		{"1220" + m, "", 0, false}, //摘要长度与算法不一致
+		{"d520" + m + m, "", 0, false},
+		{"12", "", 0, false},
+		{"not hex", "", 0, false},
+	}
+	for _, c := range cases {
+		nid, code, e := p2p_storage.NormalizeFileID(c.id)
+		if ok := e == nil; ok != c.ok || nid != c.want || code != c.code {
+			t.Errorf("NormalizeFileID(%s) = %s %d %v", c.id, nid, code, e)
+		}
+		if !c.ok && errCode(e) != service.ERR_INVALID_PARAM {
+			t.Errorf("NormalizeFileID(%s): %v", c.id, e)
+		}
+		if is := p2p_storage.IsSHA256FileID(c.id); is != (c.ok && c.code == p2p_storage.MULTIHASH_SHA2_256) {
+			t.Errorf("IsSHA256FileID(%s) = %v", c.id, is)
+		}
+	}
+}
+
+func TestVerifyFileID(t *testing.T) {
+	data := []byte("data")
+	sum := md5.Sum(data)
+	m := hex.EncodeToString(sum[:])
+	for _, c := range []struct {
+		id   string
+		data []byte
+		ok   bool
+	}{
+		{p2p_storage.SHA256FileID(data), data, true},
+		{m, data, true},
+		{"d510" + m, data, true},
+		{p2p_storage.SHA256FileID(data), []byte("other"), false},
+		{m, []byte("other"), false},
+		{"invalid", data, false},
+	} {
+		if ok := p2p_storage.VerifyFileID(c.id, c.data); ok != c.ok {
+			t.Errorf("VerifyFileID(%s, %q) = %v", c.id, c.data, ok)
+		}
+	}
+}
+
+//AddP2PFileWithID登记的对应关系：两种标识都可以查找，md5已经对应其他文件时不登记，文件删除后一起删除
+func TestFileIDBinding(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	fileID := func(data string) (id, m string) {
+		sum := md5.Sum([]byte(data))
+		return p2p_storage.SHA256FileID([]byte(data)), hex.EncodeToString(sum[:])
+	}
+	add := func(id, m string) {
+		if _, e := p2p_storage.AddP2PFileWithID(id, m, "n01", 4096, 0, false); !isAdded(e) {
+			t.Fatalf("add %s: %v", id, e)
+		}
+	}
+	id, m := fileID("file")
+	add(id, m)
+	b, e := p2p_storage.GetFileIDBinding(id)
+	if e != nil || b == nil || b.ID != id || b.MD5 != m || b.Key != id {
+		t.Fatalf("binding of %s: %+v %v", id, b, e)
+	}
+	for _, key := range []string{id, m, "d510" + m} {
+		if got, e := p2p_storage.ResolveFileKey(key); e != nil || got != id {
+			t.Errorf("ResolveFileKey(%s) = %s %v", key, got, e)
+		}
+		if ok, e := p2p_storage.IsExists(key); !ok || e != nil {
+			t.Errorf("IsExists(%s): %v %v", key, ok, e)
+		}
+	}
+	if exists, e := p2p_storage.IsExistsMore([]string{m, id}); e != nil || !exists[m] || !exists[id] {
+		t.Errorf("IsExistsMore: %v %v", exists, e)
+	}
+	if e = p2p_storage.UpdateChecksum(m, "sum1"); e != nil {
+		t.Fatal(e)
+	}
+	if sum, e := p2p_storage.GetChecksum(id); e != nil || sum != "sum1" {
+		t.Errorf("GetChecksum by id: %s %v", sum, e)
+	}
+
+	//md5相同的其他文件（构造的碰撞）以自己的文件ID保存，不登记，md5仍然对应原来的文件
+	otherID, _ := fileID("other")
+	add(otherID, m)
+	if ob, e := p2p_storage.GetFileIDBinding(otherID); ob != nil || e != nil {
+		t.Errorf("binding of colliding file: %+v %v", ob, e)
+	}
+	if mb, e := p2p_storage.GetFileIDBinding(m); mb == nil || mb.ID != id || e != nil {
+		t.Errorf("binding of md5 after collision: %+v %v", mb, e)
+	}
+	if len(f.groups(otherID)) == 0 {
+		t.Error("colliding file not added")
+	}
+
+	//已有的md5文件用文件ID重新添加时作为新文件保存，md5不改为对应新文件
+	oldID, oldMD5 := fileID("old")
+	f.addFile(oldMD5, nil)
+	add(oldID, oldMD5)
+	if ob, e := p2p_storage.GetFileIDBinding(oldMD5); ob != nil || e != nil {
+		t.Errorf("binding of existing md5: %+v %v", ob, e)
+	}
+	for _, key := range []string{oldMD5, oldID} {
+		if len(f.groups(key)) == 0 {
+			t.Errorf("file %s not added", key)
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		add  func() error
+	}{
+		{"AddP2PFile of invalid id", func() (e error) {
+			_, e = p2p_storage.AddP2PFile("1220"+m, "n01", 4096, 0, false)
+			return
+		}},
+		{"AddP2PFileWithID of md5", func() (e error) {
+			_, e = p2p_storage.AddP2PFileWithID(m, m, "n01", 4096, 0, false)
+			return
+		}},
+		{"AddP2PFileWithID with sha256 as md5", func() (e error) {
+			_, e = p2p_storage.AddP2PFileWithID(id, id, "n01", 4096, 0, false)
+			return
+		}},
+	} {
+		if e = c.add(); errCode(e) != service.ERR_INVALID_PARAM {
+			t.Errorf("%s: %v", c.name, e)
+		}
+	}
+
+	//删除文件后对应关系也删除
+	if e = p2p_storage.DeleteFile(m); e != nil {
+		t.Fatal(e)
+	}
+	if b, e = p2p_storage.GetFileIDBinding(id); b != nil || e != nil {
+		t.Errorf("binding after delete: %+v %v", b, e)
+	}
+	if len(f.groups(id)) > 0 {
+		t.Error("file not deleted by md5")
+	}
+}
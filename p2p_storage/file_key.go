@@ -0,0 +1,152 @@
+package p2p_storage
+
+import (
+	"errors"
+	"fmt"
+	"yh_pkg/service"
+	"yh_pkg/trace"
+)
+
+/*
+	加密文件的密钥引用。文件在客户端加密后才进入p2p存储，md5是密文的md5，
+	协调服务只保存被租户主密钥包装过的数据密钥，不接触明文和主密钥，格式见envelope包。
+*/
+type FileKey struct {
+	MD5     string `json:"md5"`
+	Tenant  string `json:"tenant"`  //租户
+	KeyVer  uint32 `json:"key_ver"` //包装数据密钥的主密钥版本
+	Wrapped []byte `json:"wrapped"` //包装后的数据密钥
+}
+
+/*
+	文件密钥存储，实现可以与IDataSource使用同一个数据库，IDataSource同时实现该接口时Init会自动使用。
+*/
+type IFileKeyStore interface {
+	//不存在时返回nil,nil
+	GetFileKey(md5 string) (key *FileKey, e error)
+	/*
+		保存文件密钥
+
+		参数：
+			key: 文件密钥
+			oldVer: 只有当前密钥的KeyVer为oldVer时才保存，为0时只有没有密钥才保存
+		返回值：
+			ok: 条件不满足时返回false
+	*/
+	SetFileKey(key *FileKey, oldVer uint32) (ok bool, e error)
+	DeleteFileKey(md5 string) (e error)
+	/*
+		按md5升序分页获取租户的文件密钥
+
+		参数：
+			from: 只返回md5大于from的密钥，第一页为空
+			num: 最多返回的数量
+	*/
+	GetFileKeys(tenant string, from string, num int) (keys []FileKey, e error)
+}
+
+var fileKeyStore IFileKeyStore
+
+//设置文件密钥存储，为nil时不能添加加密文件的密钥
+func SetFileKeyStore(ks IFileKeyStore) {
+	fileKeyStore = ks
+}
+
+func checkFileKey(key *FileKey) (e error) {
+	if fileKeyStore == nil {
+		return service.NewError(service.ERR_INTERNAL, "file key store not set")
+	}
+	if key == nil || key.Tenant == "" || key.KeyVer == 0 || len(key.Wrapped) == 0 {
+		return service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("invalid file key %+v", key))
+	}
+	if key.MD5, e = ResolveFileKey(key.MD5); e != nil {
+		return
+	}
+	return
+}
+
+//登记加密文件的密钥，文件已有密钥时返回ERR_P2P_FILE_ALREADY_EXIST，不能用这个方法覆盖
+func AddFileKey(key *FileKey) (e error) {
+	return WithSpan(nil).AddFileKey(key)
+}
+
+func (c Caller) AddFileKey(key *FileKey) (e error) {
+	defer c.parent.Child("p2p_storage.AddFileKey").End(&e)
+	if e = checkFileKey(key); e != nil {
+		return
+	}
+	ok, e := fileKeyStore.SetFileKey(key, 0)
+	if e != nil {
+		return
+	}
+	if !ok {
+		return service.NewError(service.ERR_P2P_FILE_ALREADY_EXIST, "key of file "+key.MD5+" already exists")
+	}
+	return
+}
+
+//获取文件密钥，文件没有加密或者不是加密存储时返回nil,nil
+func GetFileKey(md5 string) (key *FileKey, e error) {
+	return WithSpan(nil).GetFileKey(md5)
+}
+
+func (c Caller) GetFileKey(md5 string) (key *FileKey, e error) {
+	span := c.parent.Child("p2p_storage.GetFileKey")
+	defer span.SetAttr("md5", md5).End(&e)
+	if fileKeyStore == nil {
+		return
+	}
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	return fileKeyStore.GetFileKey(md5)
+}
+
+/*
+	更换包装数据密钥的主密钥，数据密钥和文件内容不变，不需要重新扩散
+
+	参数：
+		key: 新主密钥包装的密钥，租户不能改变
+		oldVer: 原来的主密钥版本，期间被其他人更换过时返回错误
+*/
+func RewrapFileKey(key *FileKey, oldVer uint32) (e error) {
+	defer trace.Begin("p2p_storage.RewrapFileKey").End(&e)
+	if e = checkFileKey(key); e != nil {
+		return
+	}
+	old, e := fileKeyStore.GetFileKey(key.MD5)
+	if e != nil {
+		return
+	}
+	if old == nil {
+		return service.NewError(service.ERR_P2P_FILE_NOT_FOUND, "key of file "+key.MD5+" not found")
+	}
+	if old.Tenant != key.Tenant {
+		return service.NewError(service.ERR_INVALID_PARAM, "tenant of file key can not be changed")
+	}
+	ok, e := fileKeyStore.SetFileKey(key, oldVer)
+	if e != nil {
+		return
+	}
+	if !ok {
+		return errors.New(fmt.Sprintf("key of file %s changed, key_ver is not %d", key.MD5, oldVer))
+	}
+	return
+}
+
+//按md5升序分页获取租户的文件密钥，用于更换主密钥
+func GetTenantFileKeys(tenant string, from string, num int) (keys []FileKey, e error) {
+	defer trace.Begin("p2p_storage.GetTenantFileKeys").SetAttr("tenant", tenant).End(&e)
+	if fileKeyStore == nil {
+		return
+	}
+	return fileKeyStore.GetFileKeys(tenant, from, num)
+}
+
+//删除文件密钥，删除后即使碎片还没有清理，文件也无法解密
+func deleteFileKey(md5 string) (e error) {
+	if fileKeyStore == nil {
+		return
+	}
+	return fileKeyStore.DeleteFileKey(md5)
+}
@@ -0,0 +1,141 @@
+package p2p_storage_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"yh_pkg/log"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/mem_source"
+	"yh_pkg/service"
+)
+
+const (
+	GID      = "g1"
+	NODE_NUM = 8
+)
+
+//p2p_storage包的测试共用的协调服务：内存数据源，一个MinPieces为4、PerfectPieces为NODE_NUM的分组，分组中的节点都在线
+type fixture struct {
+	t  *testing.T
+	ds *mem_source.MemSource
+}
+
+func newFixture(t *testing.T) (f *fixture) {
+	logger, e := log.NewMLogger("", 1000, "error")
+	if e != nil {
+		t.Fatal(e)
+	}
+	f = &fixture{t: t, ds: mem_source.New()}
+	if e = p2p_storage.Init(f.ds, logger, false); e != nil {
+		t.Fatal(e)
+	}
+	//下一个测试Init之前等待这个测试启动的后台任务结束
+	t.Cleanup(p2p_storage.Stop)
+	f.ds.AddGroup(&p2p_storage.Group{ID: GID, PieceSize: 1024, MinPieces: 4, SafePieces: 6, PerfectPieces: NODE_NUM})
+	for i := 0; i < NODE_NUM; i++ {
+		f.addNode(fmt.Sprintf("n%02d", i), GID)
+	}
+	return
+}
+
+//添加在线的节点，gid不为空时加入分组
+func (f *fixture) addNode(nid, gid string) {
+	n := &p2p_storage.NodeDetail{
+		Peer:        p2p_storage.Peer{ID: nid},
+		RegTm:       time.Now().Unix() - 30*86400,
+		OnlineCount: 200,
+		Percent:     p2p_storage.NODE_OCCUPY_PERCENT,
+	}
+	if e := f.ds.AddNode(n); e != nil {
+		f.t.Fatal(e)
+	}
+	if gid == "" {
+		return
+	}
+	if e := f.ds.AddNodeToGroup(gid, &p2p_storage.GroupNode{Node: nid, State: p2p_storage.ONLINE}); e != nil {
+		f.t.Fatal(e)
+	}
+}
+
+//设置节点的空间并更新心跳时间，left不少于GROUP_NODE_CAPACITY时节点可以添加文件
+func (f *fixture) setSpace(nid string, total, left uint64) {
+	n, e := f.ds.GetNodeDetail(nid)
+	if e != nil || n == nil {
+		f.t.Fatalf("node %s: %v", nid, e)
+	}
+	n.TotalSpace, n.Percent, n.LeftP2pSpace, n.UpdateTm = total, 100, int64(left), time.Now().UnixNano()
+	if e = f.ds.UpdateNode(n); e != nil {
+		f.t.Fatal(e)
+	}
+}
+
+//分组中的节点都有空闲空间，AddP2PFile可以把文件加入GID
+func (f *fixture) setAvailable() {
+	for i := 0; i < NODE_NUM; i++ {
+		f.setSpace(fmt.Sprintf("n%02d", i), 10*p2p_storage.GROUP_NODE_CAPACITY, 10*p2p_storage.GROUP_NODE_CAPACITY)
+	}
+}
+
+//由n01添加4096字节的文件，policy为nil时直接添加，文件已经存在或正在添加时不算错误
+func (f *fixture) addFile(md5 string, policy *p2p_storage.Policy) {
+	var e error
+	if policy == nil {
+		_, e = p2p_storage.AddP2PFile(md5, "n01", 4096, 0, false)
+	} else {
+		_, e = p2p_storage.AddP2PFileWithPolicy(md5, "n01", 4096, 0, false, policy)
+	}
+	if !isAdded(e) {
+		f.t.Fatalf("add %s: %v", md5, e)
+	}
+}
+
+//由n01添加对象，文件已经存在或正在添加时对象同样添加成功
+func (f *fixture) addObject(obj *p2p_storage.Object) {
+	if _, e := p2p_storage.AddP2PObject(obj, "n01", 0, false); !isAdded(e) {
+		f.t.Fatalf("add object %s/%s/%s: %v", obj.Tenant, obj.Bucket, obj.Key, e)
+	}
+}
+
+func isAdded(e error) bool {
+	code := errCode(e)
+	return e == nil || code == service.ERR_P2P_FILE_ALREADY_EXIST || code == service.ERR_P2P_TASK_OTHER_NODE_DOING
+}
+
+//模拟文件在GID中扩散完成：删除添加文件的任务，文件版本为1，分组中的节点都同步到这个版本，文件可以下载
+func (f *fixture) sync(md5 string) {
+	file, e := f.ds.GetGroupFile(GID, md5)
+	if e != nil || file == nil {
+		f.t.Fatalf("file %s not in group: %v", md5, e)
+	}
+	if e = f.ds.DeleteExpandNodeByMd5(md5); e != nil {
+		f.t.Fatal(e)
+	}
+	file.Type, file.Ver = p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST, 1
+	if e = f.ds.UpdateGroupFile(GID, file); e != nil {
+		f.t.Fatal(e)
+	}
+	nodes, e := f.ds.GetGroupNodes(GID)
+	if e != nil {
+		f.t.Fatal(e)
+	}
+	for i := range nodes {
+		nodes[i].Ver = file.Ver
+		if e = f.ds.UpdateGroupNode(GID, &nodes[i], true); e != nil {
+			f.t.Fatal(e)
+		}
+	}
+}
+
+//文件所在的分组
+func (f *fixture) groups(md5 string) map[string]p2p_storage.GroupFile {
+	files, _ := f.ds.GetFileGroups(md5, p2p_storage.NORMAL)
+	return files
+}
+
+func errCode(e error) uint {
+	if se, ok := e.(service.Error); ok {
+		return se.Code
+	}
+	return 0
+}
@@ -0,0 +1,197 @@
+/*
+p2p_storage元数据的一致性检查（fsck）。
+
+检查以下不变量：
+	1. 分组Size等于分组中正常文件大小之和
+	2. 分组FirstFinishVer不超过分组中文件的最大版本号
+	3. 扩散任务和危险任务引用的分组、分组文件、节点都存在
+	4. 分组中每个节点存储的数据（Size/MinPieces）不超过GROUP_NODE_CAPACITY
+	5. NodeDetail.ActiveGroups等于节点所在的未满分组数
+
+CheckSnapshot离线检查备份（backup.Read的结果），修复时直接修改备份，之后可以用backup.Restore恢复。
+Check在线检查数据源，先导出再检查，导出过程中数据仍在变化，所以在线修复时会重新读取当前数据确认，
+分组相关的修复和FillEmptyGroupFile一样需要获取分组锁。节点容量超限需要迁移数据，只报告不修复。
+*/
+package fsck
+
+import (
+	"fmt"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/backup"
+)
+
+const (
+	KIND_GROUP_SIZE       = "group_size"
+	KIND_FIRST_FINISH_VER = "first_finish_ver"
+	KIND_ORPHAN_EXPAND    = "orphan_expand_task"
+	KIND_ORPHAN_UNSAFE    = "orphan_unsafe_task"
+	KIND_NODE_CAPACITY    = "node_capacity"
+	KIND_ACTIVE_GROUPS    = "active_groups"
+)
+
+//一条不变量的违反
+type Violation struct {
+	Kind        string `json:"kind"`
+	Group       string `json:"group,omitempty"`
+	Node        string `json:"node,omitempty"`
+	MD5         string `json:"md5,omitempty"`
+	TaskID      uint64 `json:"task_id,omitempty"`
+	Value       int64  `json:"value"`    //当前值
+	Expected    int64  `json:"expected"` //期望值，孤立任务没有意义
+	Repaired    bool   `json:"repaired"`
+	RepairError string `json:"repair_error,omitempty"`
+}
+
+func (v *Violation) String() (s string) {
+	switch v.Kind {
+	case KIND_GROUP_SIZE:
+		s = fmt.Sprintf("group %s: size %d, expected %d", v.Group, v.Value, v.Expected)
+	case KIND_FIRST_FINISH_VER:
+		s = fmt.Sprintf("group %s: first_finish_ver %d > max file ver %d", v.Group, v.Value, v.Expected)
+	case KIND_ORPHAN_EXPAND:
+		s = fmt.Sprintf("orphan expand task %d: %s/%s/%s", v.TaskID, v.Group, v.Node, v.MD5)
+	case KIND_ORPHAN_UNSAFE:
+		s = fmt.Sprintf("orphan unsafe task %d: %s/%s/%s", v.TaskID, v.Group, v.Node, v.MD5)
+	case KIND_NODE_CAPACITY:
+		s = fmt.Sprintf("group %s: %d bytes per node, capacity %d", v.Group, v.Value, v.Expected)
+	case KIND_ACTIVE_GROUPS:
+		s = fmt.Sprintf("node %s: active_groups %d, expected %d", v.Node, v.Value, v.Expected)
+	default:
+		s = v.Kind
+	}
+	if v.Repaired {
+		s += " (repaired)"
+	} else if v.RepairError != "" {
+		s += " (repair failed: " + v.RepairError + ")"
+	}
+	return
+}
+
+//检查结果
+type Result struct {
+	Groups      int         `json:"groups"` //检查的分组数
+	Nodes       int         `json:"nodes"`
+	ExpandTasks int         `json:"expand_tasks"`
+	UnSafeTasks int         `json:"unsafe_tasks"`
+	Violations  []Violation `json:"violations"`
+}
+
+//修复后仍然存在的违反数量
+func (r *Result) Unrepaired() (n int) {
+	for _, v := range r.Violations {
+		if !v.Repaired {
+			n++
+		}
+	}
+	return
+}
+
+/*
+	离线检查备份
+
+	参数：
+		s: 备份
+		repair: 是否修复，修复时直接修改s
+*/
+func CheckSnapshot(s *backup.Snapshot, repair bool) (r *Result) {
+	r = check(s)
+	if repair {
+		repairSnapshot(s, r)
+	}
+	return
+}
+
+/*
+	在线检查数据源
+
+	参数：
+		ds: 数据源
+		repair: 是否修复
+	返回值：
+		r: 检查结果，e只表示读取数据失败，单条修复失败记录在Violation.RepairError中
+*/
+func Check(ds p2p_storage.IDataSource, repair bool) (r *Result, e error) {
+	s, e := backup.Export(ds)
+	if e != nil {
+		return
+	}
+	r = check(s)
+	if repair {
+		repairSource(ds, r)
+	}
+	return
+}
+
+//分组中每个节点的容量
+func groupCapacity(g *p2p_storage.Group) uint64 {
+	return uint64(g.MinPieces) * p2p_storage.GROUP_NODE_CAPACITY
+}
+
+func check(s *backup.Snapshot) (r *Result) {
+	r = &Result{
+		Groups:      len(s.Groups),
+		Nodes:       len(s.Nodes),
+		ExpandTasks: len(s.ExpandNodes),
+		UnSafeTasks: len(s.UnSafeNodes),
+		Violations:  make([]Violation, 0),
+	}
+	add := func(v Violation) {
+		r.Violations = append(r.Violations, v)
+	}
+
+	nodes := make(map[string]bool, len(s.Nodes))
+	for _, n := range s.Nodes {
+		nodes[n.ID] = true
+	}
+	files := make(map[string]bool) //gid + md5
+	activeGroups := make(map[string]int64)
+	for _, g := range s.Groups {
+		var size, maxVer uint64
+		for _, f := range g.Files {
+			files[g.ID+"/"+f.MD5] = true
+			if f.State == p2p_storage.NORMAL {
+				size += f.Size
+			}
+			if f.Ver > maxVer {
+				maxVer = f.Ver
+			}
+		}
+		if g.Size != size {
+			add(Violation{Kind: KIND_GROUP_SIZE, Group: g.ID, Value: int64(g.Size), Expected: int64(size)})
+		}
+		if g.FirstFinishVer > maxVer {
+			add(Violation{Kind: KIND_FIRST_FINISH_VER, Group: g.ID, Value: int64(g.FirstFinishVer), Expected: int64(maxVer)})
+		}
+		//按修正后的大小判断容量和未满分组
+		if g.MinPieces > 0 && size > groupCapacity(&g.Group) {
+			add(Violation{Kind: KIND_NODE_CAPACITY, Group: g.ID, Value: int64(size / uint64(g.MinPieces)), Expected: int64(p2p_storage.GROUP_NODE_CAPACITY)})
+		}
+		if size < groupCapacity(&g.Group) {
+			for _, n := range g.Nodes {
+				activeGroups[n.Node]++
+			}
+		}
+	}
+
+	groups := make(map[string]bool, len(s.Groups))
+	for _, g := range s.Groups {
+		groups[g.ID] = true
+	}
+	for _, t := range s.ExpandNodes {
+		if !groups[t.Group] || !files[t.Group+"/"+t.MD5] || !nodes[t.Node] {
+			add(Violation{Kind: KIND_ORPHAN_EXPAND, Group: t.Group, Node: t.Node, MD5: t.MD5, TaskID: t.ID})
+		}
+	}
+	for _, t := range s.UnSafeNodes {
+		if !groups[t.Group] || !files[t.Group+"/"+t.MD5] || !nodes[t.Node] {
+			add(Violation{Kind: KIND_ORPHAN_UNSAFE, Group: t.Group, Node: t.Node, MD5: t.MD5, TaskID: t.ID})
+		}
+	}
+
+	for _, n := range s.Nodes {
+		if int64(n.ActiveGroups) != activeGroups[n.ID] {
+			add(Violation{Kind: KIND_ACTIVE_GROUPS, Node: n.ID, Value: int64(n.ActiveGroups), Expected: activeGroups[n.ID]})
+		}
+	}
+	return
+}
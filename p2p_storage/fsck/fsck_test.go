@@ -0,0 +1,122 @@
+package fsck
+
+import (
+	"testing"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/backup"
+	"yh_pkg/p2p_storage/mem_source"
+)
+
+//构造每种违反各一条的数据源
+func newSource(t *testing.T) *mem_source.MemSource {
+	ds := mem_source.New()
+	for _, id := range []string{"n1", "n2"} {
+		if e := ds.AddNode(&p2p_storage.NodeDetail{Peer: p2p_storage.Peer{ID: id}, ActiveGroups: 1}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	//g1: 大小错误，首次扩散完成版本号过大
+	ds.AddGroup(&p2p_storage.Group{ID: "g1", Size: 100, MinPieces: 2, FirstFinishVer: 5})
+	ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n1", State: p2p_storage.ONLINE})
+	ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n2", State: p2p_storage.ONLINE})
+	ds.AddFileToGroup("g1", &p2p_storage.GroupFile{File: p2p_storage.File{MD5: "m1", Size: 10}, Ver: 1, State: p2p_storage.NORMAL})
+	ds.AddFileToGroup("g1", &p2p_storage.GroupFile{File: p2p_storage.File{MD5: "m2", Size: 20}, Ver: 3, State: p2p_storage.DELETED})
+	//g2: 超过容量，n1的未满分组数应为1
+	size := 3 * p2p_storage.GROUP_NODE_CAPACITY
+	ds.AddGroup(&p2p_storage.Group{ID: "g2", Size: size, MinPieces: 2})
+	ds.AddNodeToGroup("g2", &p2p_storage.GroupNode{Node: "n1", State: p2p_storage.ONLINE})
+	ds.AddFileToGroup("g2", &p2p_storage.GroupFile{File: p2p_storage.File{MD5: "m3", Size: size}, Ver: 1, State: p2p_storage.NORMAL})
+	ds.SetIncrID("g1", 3)
+	ds.SetIncrID("g2", 1)
+	ds.UpdateNode(&p2p_storage.NodeDetail{Peer: p2p_storage.Peer{ID: "n1"}, ActiveGroups: 2})
+
+	ds.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: "n2", MD5: "m1"})
+	ds.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: "n2", MD5: "missing"})
+	ds.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: "n3", MD5: "m1"})
+	ds.AddOrUpdateUnSafeFile("g1", "m1")
+	ds.AddOrUpdateUnSafeExpandNodes([]p2p_storage.UnSafeExpandNode{{Group: "g1", Node: "n1", MD5: "m1"}, {Group: "g3", Node: "n1", MD5: "m1"}})
+	return ds
+}
+
+func kinds(r *Result) map[string]int {
+	m := make(map[string]int)
+	for _, v := range r.Violations {
+		m[v.Kind]++
+	}
+	return m
+}
+
+func checkKinds(t *testing.T, r *Result) {
+	want := map[string]int{
+		KIND_GROUP_SIZE:       1,
+		KIND_FIRST_FINISH_VER: 1,
+		KIND_ORPHAN_EXPAND:    2,
+		KIND_ORPHAN_UNSAFE:    1,
+		KIND_NODE_CAPACITY:    1,
+		KIND_ACTIVE_GROUPS:    1,
+	}
+	got := kinds(r)
+	for k, n := range want {
+		if got[k] != n {
+			t.Errorf("%s: %d violations, want %d: %v", k, got[k], n, r.Violations)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ds := newSource(t)
+	r, e := Check(ds, false)
+	if e != nil {
+		t.Fatal(e)
+	}
+	checkKinds(t, r)
+	if r.Groups != 2 || r.Nodes != 2 || r.ExpandTasks != 3 || r.UnSafeTasks != 2 {
+		t.Errorf("scanned %+v", r)
+	}
+
+	if r, e = Check(ds, true); e != nil {
+		t.Fatal(e)
+	}
+	for _, v := range r.Violations {
+		if v.Repaired == (v.Kind == KIND_NODE_CAPACITY) {
+			t.Errorf("unexpected repair result: %s", v.String())
+		}
+	}
+	if r.Unrepaired() != 1 {
+		t.Errorf("Unrepaired = %d", r.Unrepaired())
+	}
+
+	//修复后只剩下不能修复的容量超限
+	if r, e = Check(ds, false); e != nil {
+		t.Fatal(e)
+	}
+	if len(r.Violations) != 1 || r.Violations[0].Kind != KIND_NODE_CAPACITY {
+		t.Errorf("violations after repair: %v", r.Violations)
+	}
+	if g, _ := ds.GetGroup("g1"); g.Size != 10 || g.FirstFinishVer != 3 {
+		t.Errorf("group not repaired: %+v", g)
+	}
+	if task, _ := ds.GetExpandNode("g1", "n2", "m1"); task == nil {
+		t.Error("valid expand task deleted")
+	}
+}
+
+func TestCheckSnapshot(t *testing.T) {
+	s, e := backup.Export(newSource(t))
+	if e != nil {
+		t.Fatal(e)
+	}
+	checkKinds(t, CheckSnapshot(s, true))
+	if len(s.ExpandNodes) != 1 || len(s.UnSafeNodes) != 1 {
+		t.Errorf("orphan tasks not removed: %+v %+v", s.ExpandNodes, s.UnSafeNodes)
+	}
+	r := CheckSnapshot(s, false)
+	if len(r.Violations) != 1 || r.Violations[0].Kind != KIND_NODE_CAPACITY {
+		t.Errorf("violations after repair: %v", r.Violations)
+	}
+
+	//修复后的备份可以恢复
+	if e = backup.Restore(mem_source.New(), s); e != nil {
+		t.Fatal(e)
+	}
+}
@@ -0,0 +1,176 @@
+package fsck
+
+import (
+	"errors"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/backup"
+	"yunhui/redis_db"
+)
+
+func repairSnapshot(s *backup.Snapshot, r *Result) {
+	groups := make(map[string]*backup.GroupSnapshot, len(s.Groups))
+	for i := range s.Groups {
+		groups[s.Groups[i].ID] = &s.Groups[i]
+	}
+	nodes := make(map[string]*p2p_storage.NodeDetail, len(s.Nodes))
+	for i := range s.Nodes {
+		nodes[s.Nodes[i].ID] = &s.Nodes[i]
+	}
+	orphans := make(map[string]bool) //kind + gid + nid + md5
+	for i := range r.Violations {
+		v := &r.Violations[i]
+		switch v.Kind {
+		case KIND_GROUP_SIZE:
+			groups[v.Group].Size = uint64(v.Expected)
+		case KIND_FIRST_FINISH_VER:
+			groups[v.Group].FirstFinishVer = uint64(v.Expected)
+		case KIND_ACTIVE_GROUPS:
+			nodes[v.Node].ActiveGroups = int(v.Expected)
+		case KIND_ORPHAN_EXPAND, KIND_ORPHAN_UNSAFE:
+			orphans[v.Kind+"/"+v.Group+"/"+v.Node+"/"+v.MD5] = true
+		default:
+			continue
+		}
+		v.Repaired = true
+	}
+	if len(orphans) == 0 {
+		return
+	}
+	exNodes := s.ExpandNodes[:0]
+	for _, t := range s.ExpandNodes {
+		if !orphans[KIND_ORPHAN_EXPAND+"/"+t.Group+"/"+t.Node+"/"+t.MD5] {
+			exNodes = append(exNodes, t)
+		}
+	}
+	s.ExpandNodes = exNodes
+	unsafeNodes := s.UnSafeNodes[:0]
+	for _, t := range s.UnSafeNodes {
+		if !orphans[KIND_ORPHAN_UNSAFE+"/"+t.Group+"/"+t.Node+"/"+t.MD5] {
+			unsafeNodes = append(unsafeNodes, t)
+		}
+	}
+	s.UnSafeNodes = unsafeNodes
+}
+
+/*
+	在线修复，每条违反都重新读取当前数据确认，已经不存在的违反也算作修复
+*/
+func repairSource(ds p2p_storage.IDataSource, r *Result) {
+	for i := range r.Violations {
+		v := &r.Violations[i]
+		var e error
+		switch v.Kind {
+		case KIND_GROUP_SIZE:
+			e = withGroupLock(ds, v.Group, func() error { return ds.CalculateGroupSize(v.Group) })
+		case KIND_FIRST_FINISH_VER:
+			e = withGroupLock(ds, v.Group, func() error { return repairFirstFinishVer(ds, v.Group, uint64(v.Expected)) })
+		case KIND_ORPHAN_EXPAND:
+			e = repairOrphanExpand(ds, v.TaskID)
+		case KIND_ORPHAN_UNSAFE:
+			e = repairOrphanUnSafe(ds, v.Group, v.Node, v.MD5)
+		case KIND_ACTIVE_GROUPS:
+			e = repairActiveGroups(ds, v.Node)
+		default:
+			continue
+		}
+		if e != nil {
+			v.RepairError = e.Error()
+		} else {
+			v.Repaired = true
+		}
+	}
+}
+
+//与p2p_storage中修改分组时使用同一个锁
+func withGroupLock(ds p2p_storage.IDataSource, gid string, op func() error) (e error) {
+	if !ds.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, gid, p2p_storage.P2pLockExpireSec, p2p_storage.P2pGetLockTimeOut) {
+		return errors.New("get lock of group " + gid + " failed")
+	}
+	e = op()
+	if err := ds.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, gid); err != nil && e == nil {
+		e = err
+	}
+	return
+}
+
+/*
+	检查之后可能有新的文件加入，从检查时的最大版本号继续查找当前的最大版本号
+*/
+func repairFirstFinishVer(ds p2p_storage.IDataSource, gid string, maxVer uint64) (e error) {
+	for {
+		files, e := ds.ListUpdatedFiles(gid, maxVer, backup.PAGE_SIZE, p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST)
+		if e != nil {
+			return e
+		}
+		if len(files) == 0 {
+			break
+		}
+		maxVer = files[len(files)-1].Ver
+		if len(files) < backup.PAGE_SIZE {
+			break
+		}
+	}
+	g, e := ds.GetGroup(gid)
+	if e != nil || g == nil || g.FirstFinishVer <= maxVer {
+		return
+	}
+	return ds.UpdateGroupFirstFinishVer(gid, maxVer)
+}
+
+//任务引用的分组、文件、节点是否都存在
+func isReferenced(ds p2p_storage.IDataSource, gid, nid, md5 string) (yes bool, e error) {
+	f, e := ds.GetGroupFile(gid, md5)
+	if e != nil || f == nil {
+		return
+	}
+	g, e := ds.GetGroup(gid)
+	if e != nil || g == nil {
+		return
+	}
+	return ds.IsNodeExist(nid)
+}
+
+func repairOrphanExpand(ds p2p_storage.IDataSource, id uint64) (e error) {
+	t, e := ds.GetExpandNodeById(id)
+	if e != nil || t == nil {
+		return
+	}
+	referenced, e := isReferenced(ds, t.Group, t.Node, t.MD5)
+	if e != nil || referenced {
+		return
+	}
+	if e = ds.DeleteExpandNodeById(id); e != nil {
+		return
+	}
+	return ds.DeleteTaskNodeByTask(id)
+}
+
+func repairOrphanUnSafe(ds p2p_storage.IDataSource, gid, nid, md5 string) (e error) {
+	referenced, e := isReferenced(ds, gid, nid, md5)
+	if e != nil || referenced {
+		return
+	}
+	return ds.DeleteUnSafeFileExpandNode(gid, nid, md5)
+}
+
+/*
+	和节点汇报时一样按节点所在分组的当前大小重新计算
+*/
+func repairActiveGroups(ds p2p_storage.IDataSource, nid string) (e error) {
+	groups, e := ds.GetNodeGroupDetail(nid)
+	if e != nil {
+		return
+	}
+	active := 0
+	for i := range groups {
+		if groups[i].Size < groupCapacity(&groups[i].Group) {
+			active++
+		}
+	}
+	detail, e := ds.GetNodeDetail(nid)
+	if e != nil || detail == nil || detail.ActiveGroups == active {
+		return
+	}
+	detail.ActiveGroups = active
+	return ds.UpdateNode(detail)
+}
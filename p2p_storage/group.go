@@ -46,10 +46,10 @@ type NodeGroupDetail struct {
 /*
 	创建一个可以用的分组
 */
-func createGroup(idx int, file_size uint32, node string) (group *Group, e error) {
+func (ds *DataSource) createGroup(idx int, file_size uint32, node string) (group *Group, e error) {
 	logger.AppendObj(nil, "createGroup--1", idx, file_size, node)
 	file_size = 0
-	nodes, e := dataSource.Raw.GetAvailableNodesCount(GROUP_NODE_CAPACITY, time.Now.Unix()-NODE_VALID_TIME, time.Now.Unix()-NODE_VALID_AFTER_REGTM, NODE_MIN_ACTIVE_GROUPS, NODE_EXPAND_MIN_ONLINE_CNT)
+	nodes, e := ds.Raw.GetAvailableNodesCount(GROUP_NODE_CAPACITY, time.Now.Unix()-NODE_VALID_TIME, time.Now.Unix()-NODE_VALID_AFTER_REGTM, NODE_MIN_ACTIVE_GROUPS, NODE_EXPAND_MIN_ONLINE_CNT)
 	if e != nil {
 		return
 	}
@@ -67,16 +67,16 @@ func createGroup(idx int, file_size uint32, node string) (group *Group, e error)
 		return nil, errors.New(fmt.Sprintf("no enough online nodes for create group(%v < %v)", nodes, g.PerfectPieces))
 	}
 	group = &Group{random.RandomAlphanumeric(GID_LEN), 0, file_size, g.PieceSize, g.MinPieces, g.SafePieces, g.PerfectPieces, 0, 0}
-	if e = dataSource.Raw.AddGroup(group); e != nil {
+	if e = ds.Raw.AddGroup(group); e != nil {
 		return
 	}
-	return group, group.ExpandNodesToPerfectSize(NODE_MIN_ACTIVE_GROUPS, node)
+	return group, group.ExpandNodesToPerfectSize(ds, NODE_MIN_ACTIVE_GROUPS, node)
 }
 
 /*
 	使用一些节点创建一个分组
 */
-func createGroupByNodes(idx int, file_size uint32, nodes map[string]bool) (group *Group, e error) {
+func (ds *DataSource) createGroupByNodes(idx int, file_size uint32, nodes map[string]bool) (group *Group, e error) {
 	file_size = 0
 	if idx == -1 {
 		if len(nodes) > int(GROUP_CONFIG[1].PerfectPieces) {
@@ -94,15 +94,15 @@ func createGroupByNodes(idx int, file_size uint32, nodes map[string]bool) (group
 	g := GROUP_CONFIG[idx]
 
 	group = &Group{random.RandomAlphanumeric(GID_LEN), 0, file_size, g.PieceSize, g.MinPieces, g.SafePieces, g.PerfectPieces, 0, 0}
-	if e = dataSource.Raw.AddGroup(group); e != nil {
+	if e = ds.Raw.AddGroup(group); e != nil {
 		logger.AppendObj(e, "createGroupByNodes addGroup error")
 		return
 	}
-	if e = group.ExpandNodesToGroup(nodes); e != nil {
+	if e = group.ExpandNodesToGroup(ds, nodes); e != nil {
 		return
 	}
 	if len(nodes) < int(group.PerfectPieces) {
-		return group, group.ExpandNodesToPerfectSize(NODE_MAX_ACTIVE_GROUPS, "")
+		return group, group.ExpandNodesToPerfectSize(ds, NODE_MAX_ACTIVE_GROUPS, "")
 	}
 	return group, nil
 }
@@ -114,28 +114,28 @@ func createGroupByNodes(idx int, file_size uint32, nodes map[string]bool) (group
 		md5: 文件md5
 		size: 文件大小
 */
-func (group *Group) AddFile(md5 string, src_node string, size uint64) (e error) {
+func (group *Group) AddFile(ds *DataSource, md5 string, src_node string, size uint64) (e error) {
 
-	/*ver, e := dataSource.Raw.AtomicIncrID(group.ID)
+	/*ver, e := ds.Raw.AtomicIncrID(group.ID)
 	if e != nil {
 		return errors.New("redis error : " + e.Error())
 	}
-	if e = dataSource.AddFileToGroup(group.ID, group, newGroupFile(md5, size, ver, GROUPFILE_TYPE_SPRAND_FIRST, 0, 0, src_node), ver); e != nil {
+	if e = ds.AddFileToGroup(group.ID, group, newGroupFile(md5, size, ver, GROUPFILE_TYPE_SPRAND_FIRST, 0, 0, src_node), ver); e != nil {
 		return
 	}
 	*/
 
 	//获取锁
-	if !dataSource.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, group.ID, P2pLockExpireSec, P2pGetLockTimeOut) {
+	if !ds.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, group.ID, P2pLockExpireSec, P2pGetLockTimeOut) {
 		e = service.NewSimpleError(service.ERR_PERMISSION_DENIED, "get lock is errror")
 		logger.AppendObj(e, "P2pLock-AddFile has no lock", group.ID, md5)
 		return
 	}
 
-	e = doAddFileToGroup(group, md5, size, src_node)
+	e = ds.doAddFileToGroup(group, md5, size, src_node)
 
 	//释放锁
-	if err := dataSource.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, group.ID); err != nil {
+	if err := ds.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, group.ID); err != nil {
 		logger.AppendObj(err, "P2pLock-AddFile unlock is error", group.ID, md5)
 	}
 
@@ -144,11 +144,11 @@ func (group *Group) AddFile(md5 string, src_node string, size uint64) (e error)
 		return
 	}
 
-	if err := group.ExpandNodesToPerfectSize(NODE_MAX_ACTIVE_GROUPS, ""); err != nil {
+	if err := group.ExpandNodesToPerfectSize(ds, NODE_MAX_ACTIVE_GROUPS, ""); err != nil {
 		logger.Append("ExpandNodesToPerfectSize error: "+err.Error(), log.ERROR)
 	}
 
-	go GenPiece(group.ID, "", md5)
+	goBackground(func() { GenPiece(group.ID, "", md5) })
 	return
 }
 
@@ -156,12 +156,12 @@ func getAtomicIncrKey(gid string) (key string) {
 	return "add_" + gid
 }
 
-func doAddFileToGroup(group *Group, md5 string, size uint64, srcNode string) (e error) {
-	ver, e := dataSource.Raw.AtomicIncrID(group.ID)
+func (ds *DataSource) doAddFileToGroup(group *Group, md5 string, size uint64, srcNode string) (e error) {
+	ver, e := ds.Raw.AtomicIncrID(group.ID)
 	if e != nil {
 		return errors.New("redis error : " + e.Error())
 	}
-	if e = dataSource.AddFileToGroup(group.ID, group, newGroupFile(md5, size, ver, GROUPFILE_TYPE_SPRAND_FIRST, 0, 0, srcNode), ver); e != nil {
+	if e = ds.AddFileToGroup(group.ID, group, newGroupFile(md5, size, ver, GROUPFILE_TYPE_SPRAND_FIRST, 0, 0, srcNode), ver); e != nil {
 		return
 	}
 	return
@@ -174,38 +174,38 @@ func doAddFileToGroup(group *Group, md5 string, size uint64, srcNode string) (e
 		md5: 文件md5
 		size: 文件大小
 */
-func (group *Group) AddP2PFile(md5 string, size uint64, src_node string, fileVer uint64) (e error) {
+func (group *Group) AddP2PFile(ds *DataSource, md5 string, size uint64, src_node string, fileVer uint64) (e error) {
 
-	/*ver, e := dataSource.Raw.AtomicIncrID(getAtomicIncrKey(group.ID))
+	/*ver, e := ds.Raw.AtomicIncrID(getAtomicIncrKey(group.ID))
 	if e != nil {
 		return errors.New("redis error : " + e.Error())
 	}
-	if e = dataSource.AddFileToGroup(group.ID, group, newGroupFile(md5, size, 0, GROUPFILE_TYPE_NEW_ADD, ver, uint64(time.Now.Unix()), src_node), fileVer); e != nil {
+	if e = ds.AddFileToGroup(group.ID, group, newGroupFile(md5, size, 0, GROUPFILE_TYPE_NEW_ADD, ver, uint64(time.Now.Unix()), src_node), fileVer); e != nil {
 		return
 	}*/
 
 	//获取锁
-	if !dataSource.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, getAtomicIncrKey(group.ID), P2pLockExpireSec, P2pGetLockTimeOut) {
+	if !ds.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, getAtomicIncrKey(group.ID), P2pLockExpireSec, P2pGetLockTimeOut) {
 		e = service.NewSimpleError(service.ERR_PERMISSION_DENIED, "get lock is errror")
 		logger.AppendObj(e, "P2pLock-AddP2PFile has no lock", group.ID, md5)
 		return
 	}
 
-	e = doAddP2pFileToGroup(group, md5, size, src_node, fileVer)
+	e = ds.doAddP2pFileToGroup(group, md5, size, src_node, fileVer)
 	//释放锁
-	if err := dataSource.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, getAtomicIncrKey(group.ID)); err != nil {
+	if err := ds.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, getAtomicIncrKey(group.ID)); err != nil {
 		logger.AppendObj(err, "P2pLock-AddP2PFile unlock is error", group.ID, md5)
 	}
 
 	return
 }
 
-func doAddP2pFileToGroup(group *Group, md5 string, size uint64, src_node string, fileVer uint64) (e error) {
-	ver, e := dataSource.Raw.AtomicIncrID(getAtomicIncrKey(group.ID))
+func (ds *DataSource) doAddP2pFileToGroup(group *Group, md5 string, size uint64, src_node string, fileVer uint64) (e error) {
+	ver, e := ds.Raw.AtomicIncrID(getAtomicIncrKey(group.ID))
 	if e != nil {
 		return errors.New("redis error : " + e.Error())
 	}
-	if e = dataSource.AddFileToGroup(group.ID, group, newGroupFile(md5, size, 0, GROUPFILE_TYPE_NEW_ADD, ver, uint64(time.Now.Unix()), src_node), fileVer); e != nil {
+	if e = ds.AddFileToGroup(group.ID, group, newGroupFile(md5, size, 0, GROUPFILE_TYPE_NEW_ADD, ver, uint64(time.Now.Unix()), src_node), fileVer); e != nil {
 		return
 	}
 	return
@@ -217,36 +217,40 @@ func doAddP2pFileToGroup(group *Group, md5 string, size uint64, src_node string,
 	参数：
 		md5: 文件md5
 */
-func (group *Group) DeleteFile(file *GroupFile) (e error) {
+func (group *Group) DeleteFile(ds *DataSource, file *GroupFile) (e error) {
 
 	//获取锁
-	if !dataSource.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, group.ID, P2pLockExpireSec, P2pGetLockTimeOut) {
+	if !ds.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, group.ID, P2pLockExpireSec, P2pGetLockTimeOut) {
 		e = service.NewSimpleError(service.ERR_PERMISSION_DENIED, "get lock is errror")
 		logger.AppendObj(e, "P2pLock-DeleteFile has no lock", group.ID, file.MD5)
 		return
 	}
 
-	e = doUpdateGroupFile(group.ID, file)
+	e = ds.doUpdateGroupFile(group.ID, file)
 
 	//释放锁
-	if err := dataSource.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, group.ID); err != nil {
+	if err := ds.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, group.ID); err != nil {
 		logger.AppendObj(err, "P2pLock-DeleteFile unlock is error", group.ID, file.MD5)
 	}
 
 	if e != nil {
+		ds.RepairGroupSize(group.ID, e)
 		return
 	}
 
-	return dataSource.UpdateGroupSize(false, group, file.Size)
+	if e = ds.UpdateGroupSize(false, group, file.Size); e != nil {
+		ds.RepairGroupSize(group.ID, e)
+	}
+	return
 }
 
-func doUpdateGroupFile(gid string, file *GroupFile) (e error) {
-	ver, e := dataSource.Raw.AtomicIncrID(gid)
+func (ds *DataSource) doUpdateGroupFile(gid string, file *GroupFile) (e error) {
+	ver, e := ds.Raw.AtomicIncrID(gid)
 	if e != nil {
 		return
 	}
 	file.Ver, file.State = ver, DELETED
-	if e = dataSource.Raw.UpdateGroupFile(gid, file); e != nil {
+	if e = ds.Raw.UpdateGroupFile(gid, file); e != nil {
 		logger.AppendObj(e, "deleteFile doUpdateGroupFile is error", gid, file.MD5, ver)
 		return
 	}
@@ -258,12 +262,12 @@ func doUpdateGroupFile(gid string, file *GroupFile) (e error) {
 
 	参数：
 */
-func (group *Group) ExpandNodesToPerfectSize(active_groups int8, nid string) (e error) {
+func (group *Group) ExpandNodesToPerfectSize(ds *DataSource, active_groups int8, nid string) (e error) {
 	//获取检测时间，并判断是否需要执行检测,间隔时间去检测
-	if !checkCanRunService(CHECKER_EXPAND_NODE_PREFIX + group.ID) {
+	if !ds.checkCanRunService(CHECKER_EXPAND_NODE_PREFIX + group.ID) {
 		return
 	}
-	if e = dataSource.Raw.SetAtomicGetLastCheckerTm(CHECKER_EXPAND_NODE_PREFIX+group.ID, time.Now.Unix(), getCheckExpireTm(CHECKER_EXPAND_NODE_PREFIX+group.ID)); e != nil {
+	if e = ds.Raw.SetAtomicGetLastCheckerTm(CHECKER_EXPAND_NODE_PREFIX+group.ID, time.Now.Unix(), getCheckExpireTm(CHECKER_EXPAND_NODE_PREFIX+group.ID)); e != nil {
 		logger.Append("GetNodeCheckedTime setTm error: "+e.Error(), log.ERROR)
 		return
 	}
@@ -271,17 +275,17 @@ func (group *Group) ExpandNodesToPerfectSize(active_groups int8, nid string) (e
 	//检测活跃节点占比小于45时则不再执行文件扩散了
 	//获取活跃节点占比
 
-	onlineNodes, e := dataSource.Raw.GetGroupOnlineNodesCount(group.ID)
+	onlineNodes, e := ds.Raw.GetGroupOnlineNodesCount(group.ID)
 	if e != nil {
 		return e
 	}
 	logger.AppendObj(nil, fmt.Sprintf("createGroup-2-%v\t ExpandNodesToPerfectSize group=%v, online=%v PerfectPieces=%v,nid=%v\n", time.Now.Format(time.TIME_LAYOUT_1), group.ID, onlineNodes, group.PerfectPieces, nid))
 	if onlineNodes < group.SafePieces+(group.MinPieces/EXPAND_GROUP_ADDRATIO) {
 		logger.AppendObj(e, fmt.Sprintf("ExpandNodesToPerfectSize group=%v, expand=%v\n", group.ID, group.PerfectPieces-onlineNodes))
-		if e := group.ExpandNodes(group.PerfectPieces-onlineNodes, active_groups, nid); e != nil {
+		if e := group.ExpandNodes(ds, group.PerfectPieces-onlineNodes, active_groups, nid); e != nil {
 			return e
 		}
-		onlineNodes, e = dataSource.Raw.GetGroupOnlineNodesCount(group.ID)
+		onlineNodes, e = ds.Raw.GetGroupOnlineNodesCount(group.ID)
 		if e != nil {
 			return e
 		}
@@ -298,17 +302,17 @@ func (group *Group) ExpandNodesToPerfectSize(active_groups int8, nid string) (e
 	参数：
 		nodes: 要扩充至分组的节点(须保证不与组内现有节点重复)
 */
-func (group *Group) ExpandNodesToGroup(nodes map[string]bool) (e error) {
+func (group *Group) ExpandNodesToGroup(ds *DataSource, nodes map[string]bool) (e error) {
 	add_nids := make([]string, 0, len(nodes))
 	for id, ok := range nodes {
 		if ok {
-			if e = group.addNodeToGroup(id); e != nil {
+			if e = group.addNodeToGroup(ds, id); e != nil {
 				return
 			}
 			add_nids = append(add_nids, id)
 		}
 	}
-	go UpdateNodeWeight(add_nids)
+	goBackground(func() { UpdateNodeWeight(add_nids) })
 	return
 }
 
@@ -318,8 +322,8 @@ func (group *Group) ExpandNodesToGroup(nodes map[string]bool) (e error) {
 	参数：
 		num: 要扩充的节点数量
 */
-func (group *Group) ExpandNodes(num uint32, active_groups int8, nid string) (e error) {
-	nodes, e := dataSource.Raw.GetGroupNodes(group.ID)
+func (group *Group) ExpandNodes(ds *DataSource, num uint32, active_groups int8, nid string) (e error) {
+	nodes, e := ds.Raw.GetGroupNodes(group.ID)
 	if e != nil {
 		return
 	}
@@ -334,7 +338,7 @@ func (group *Group) ExpandNodes(num uint32, active_groups int8, nid string) (e e
 	}
 
 	//获取原有节点IP
-	if e = getDetailsByIds(ids, detailSet); e != nil {
+	if e = ds.getDetailsByIds(ids, detailSet); e != nil {
 		return
 	}
 	for _, v := range detailSet {
@@ -345,7 +349,7 @@ func (group *Group) ExpandNodes(num uint32, active_groups int8, nid string) (e e
 
 	var offset, added, expandTime, tryNum, queryRatio uint32 = 0, 0, 0, 0, 10
 	for added < num {
-		new_nodes, e := dataSource.Raw.GetAvailableNodes(GROUP_NODE_CAPACITY, time.Now.Unix()-NODE_EXPAND_GROUP_VALID_TIME, time.Now.Unix()-NODE_VALID_AFTER_REGTM, offset, num*queryRatio, active_groups, NODE_EXPAND_MIN_ONLINE_CNT)
+		new_nodes, e := ds.Raw.GetAvailableNodes(GROUP_NODE_CAPACITY, time.Now.Unix()-NODE_EXPAND_GROUP_VALID_TIME, time.Now.Unix()-NODE_VALID_AFTER_REGTM, offset, num*queryRatio, active_groups, NODE_EXPAND_MIN_ONLINE_CNT)
 		if e != nil {
 			return e
 		}
@@ -365,7 +369,7 @@ func (group *Group) ExpandNodes(num uint32, active_groups int8, nid string) (e e
 		} else {
 			newNodes = new_nodes
 		}
-		if e = getDetailsByIds(newNodes, detailSet); e != nil {
+		if e = ds.getDetailsByIds(newNodes, detailSet); e != nil {
 			return e
 		}
 
@@ -382,6 +386,10 @@ func (group *Group) ExpandNodes(num uint32, active_groups int8, nid string) (e e
 				logger.AppendObj(nil, "ExpandNodes no detail node", id)
 				continue
 			}
+			if detail.Drained {
+				//已排空的节点不再加入分组
+				continue
+			}
 
 			var ip string
 			if ip, e = getIpv4First2Part(detail.IP); e != nil {
@@ -395,7 +403,7 @@ func (group *Group) ExpandNodes(num uint32, active_groups int8, nid string) (e e
 			}
 			add_nids = append(add_nids, id)
 
-			if e := group.addNodeToGroup(id); e != nil {
+			if e := group.addNodeToGroup(ds, id); e != nil {
 				continue
 			}
 
@@ -410,42 +418,44 @@ func (group *Group) ExpandNodes(num uint32, active_groups int8, nid string) (e e
 		expandTime += 1
 		logger.AppendObj(nil, "ExpandNodes UpdateNodeWeight count:", len(add_nids), offset, "group:", group.ID, "expandTime:", expandTime)
 		//添加完分组后，需要刷新节点的权重
-		go UpdateNodeWeight(add_nids)
+		goBackground(func() { UpdateNodeWeight(add_nids) })
 		offset = offset + num*queryRatio
 	}
 	return
 }
 
 //将节点添加到组内
-func (group *Group) addNodeToGroup(id string) (e error) {
-	if e = dataSource.Raw.AddNodeToGroup(group.ID, newGroupNode(id, ONLINE)); e != nil {
+func (group *Group) addNodeToGroup(ds *DataSource, id string) (e error) {
+	if e = ds.Raw.AddNodeToGroup(group.ID, newGroupNode(id, ONLINE)); e != nil {
 		logger.Append("AddNodeToGroup error: "+e.Error(), log.ERROR)
 		return
 	}
-	if e = dataSource.Raw.IncrementActiveGroups(id); e != nil {
+	if e = ds.Raw.IncrementActiveGroups(id); e != nil {
 		logger.Append("IncrementActiveGroups error: "+e.Error(), log.ERROR)
 		return
 	}
 
 	//往分组中添加了新节点后需要及时的为该节点所需要的文件生成扩散任务
-	go genNewNodeExpandTask(group.ID, id)
+	goBackground(func() { ds.genNewNodeExpandTask(group.ID, id) })
 	return
 }
 
 //创建分组或者扩容后需要修改节点权重
 func UpdateNodeWeight(nids []string) (e error) {
+	source, span := beginSpan(nil, "p2p_storage.UpdateNodeWeight")
+	defer span.End(&e)
 	if len(nids) <= 0 {
 		return
 	}
 	//执行更新节点权重
-	nodes, e := dataSource.Raw.GetNodesByIds(nids)
+	nodes, e := source.Raw.GetNodesByIds(nids)
 	if e != nil {
 		return
 	}
 	for _, n := range nodes {
 		weight := n.GetWeight()
 		logger.AppendObj(e, "AddNodeToGroup-- UpdateNodeWeight--do old_w", n.ID, n.Weight, " old_actives", n.ActiveGroups, n.OnlineCount, "new: ", weight)
-		if e = dataSource.Raw.UpdateNodeWeight(n.ID, weight); e != nil {
+		if e = source.Raw.UpdateNodeWeight(n.ID, weight); e != nil {
 			logger.AppendObj(e, "AddNodeToGroup-- UpdateNodeWeight--is error", n.ID)
 		}
 	}
@@ -491,15 +501,20 @@ func MinFileSize(nums map[uint32]uint64) (file_size uint32) {
 		md5: 文件md5
 */
 func IncrGroupFileVer(gid, md5 string) (e error) {
+	source, span := beginSpan(nil, "p2p_storage.IncrGroupFileVer")
+	defer span.SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
 	//获取文件版本
-	gf, e := dataSource.Raw.GetGroupFile(gid, md5)
+	gf, e := source.Raw.GetGroupFile(gid, md5)
 	if e != nil || gf == nil {
 		logger.AppendObj(nil, "group file node has more minPieces,do not IncrFileVer", gid, md5)
 		return errors.New("IncrGroupFileVer is error")
 	}
 
 	//2018-11-05:修改加版本号逻辑，判断只要ver>first_finish_ver则可添加版本号
-	g, e := dataSource.Raw.GetGroup(gid)
+	g, e := source.Raw.GetGroup(gid)
 	if e != nil {
 		return
 	}
@@ -522,16 +537,16 @@ func IncrGroupFileVer(gid, md5 string) (e error) {
 	*/
 
 	//获取锁
-	if !dataSource.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, gid, P2pLockExpireSec, P2pGetLockTimeOut) {
+	if !source.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, gid, P2pLockExpireSec, P2pGetLockTimeOut) {
 		e = service.NewSimpleError(service.ERR_PERMISSION_DENIED, "get lock is errror")
 		logger.AppendObj(e, "P2pLock-IncrGroupFileVer has no lock", gid)
 		return
 	}
 
-	e = doIncrFileVer(gid, md5, gf.Ver)
+	e = source.doIncrFileVer(gid, md5, gf.Ver)
 
 	//释放锁
-	if err := dataSource.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, gid); err != nil {
+	if err := source.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, gid); err != nil {
 		logger.AppendObj(err, "P2pLock-IncrGroupFileVer unlock is error", gid, md5)
 	}
 
@@ -543,13 +558,13 @@ func IncrGroupFileVer(gid, md5 string) (e error) {
 	return
 }
 
-func doIncrFileVer(gid, md5 string, oldVer uint64) (e error) {
-	ver, e := dataSource.Raw.AtomicIncrID(gid)
+func (ds *DataSource) doIncrFileVer(gid, md5 string, oldVer uint64) (e error) {
+	ver, e := ds.Raw.AtomicIncrID(gid)
 	if e != nil {
 		logger.AppendObj(e, "group file node has more minPieces,AtomicIncrID is error", gid, md5)
 		return
 	}
-	if e = dataSource.Raw.IncrFileVer(gid, md5, ver); e != nil {
+	if e = ds.Raw.IncrFileVer(gid, md5, ver); e != nil {
 		logger.AppendObj(e, "group file node has more minPieces,do not IncrFileVer ", gid, md5)
 		return
 	}
@@ -563,13 +578,13 @@ func doIncrFileVer(gid, md5 string, oldVer uint64) (e error) {
 	参数：
 		md5: 文件md5
 */
-func genNewNodeExpandTask(gid, nid string) (e error) {
-	ver, e := dataSource.Raw.GetGroupFileVer(gid, nid)
+func (ds *DataSource) genNewNodeExpandTask(gid, nid string) (e error) {
+	ver, e := ds.Raw.GetGroupFileVer(gid, nid)
 	if e != nil {
 		return
 	}
 	//获取需要扩散文件件
-	files, e := dataSource.Raw.GetGroupFileByVer(gid, nid, ver, 500)
+	files, e := ds.Raw.GetGroupFileByVer(gid, nid, ver, 500)
 	if e != nil {
 		return
 	}
@@ -601,8 +616,8 @@ func getIpv4First2Part(ip string) (string, error) {
 	参数：
 		ids：node的id
 */
-func getDetailsByIds(ids []string, detailSet map[string]NodeDetail) (e error) {
-	nodeDetails, e := dataSource.Raw.GetNodesByIds(ids)
+func (ds *DataSource) getDetailsByIds(ids []string, detailSet map[string]NodeDetail) (e error) {
+	nodeDetails, e := ds.Raw.GetNodesByIds(ids)
 	if e != nil {
 		return
 	}
@@ -0,0 +1,203 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"yh_pkg/p2p_storage"
+)
+
+/*
+	基于文件的节点历史记录存储，实现p2p_storage.INodeHistoryStore，重启后从文件恢复。
+
+	数据保存在内存中（MemStore），每次修改追加一行JSON到文件，打开时按顺序重放；CompactNodeHistory后
+	把当前的全部记录写到临时文件再替换，文件大小与保留的记录数成正比。只能由一个协调服务使用。
+
+	示例：
+		s, e := history.OpenFileStore("/data/p2p/node_history.log")
+		p2p_storage.SetNodeHistoryStore(s)
+*/
+type FileStore struct {
+	*MemStore
+	path string
+	lock sync.Mutex //保护file，与MemStore的锁一起保证文件中的顺序与内存中的修改顺序一致
+	file *os.File
+	w    *bufio.Writer
+}
+
+var _ p2p_storage.INodeHistoryStore = (*FileStore)(nil)
+
+//文件中的一行，只有一个字段不为空
+type fileRecord struct {
+	Sample *p2p_storage.NodeSample `json:"s,omitempty"` //AddNodeSample
+	Online *fileOnline             `json:"o,omitempty"` //AddNodeOnline
+	Period *filePeriod             `json:"p,omitempty"` //压缩后的在线区间
+}
+
+type fileOnline struct {
+	Node string `json:"node"`
+	Tm   int64  `json:"tm"`
+	Gap  int64  `json:"gap"`
+}
+
+type filePeriod struct {
+	Node string `json:"node"`
+	p2p_storage.OnlineInterval
+}
+
+/*
+	打开或创建存储文件，恢复文件中的记录。最后一行不完整时（写入时进程退出）忽略该行。
+
+	参数：
+		path: 文件路径，所在目录需要存在
+*/
+func OpenFileStore(path string) (s *FileStore, e error) {
+	s = &FileStore{MemStore: NewMemStore(), path: path}
+	f, e := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if e != nil {
+		return nil, e
+	}
+	valid, e := s.replay(f)
+	if e == nil {
+		//截掉不完整的最后一行，之后从这里追加
+		if e = f.Truncate(valid); e == nil {
+			_, e = f.Seek(valid, io.SeekStart)
+		}
+	}
+	if e != nil {
+		f.Close()
+		return nil, e
+	}
+	s.file, s.w = f, bufio.NewWriter(f)
+	return
+}
+
+//重放文件中的记录，返回完整的记录结束的位置
+func (s *FileStore) replay(f *os.File) (valid int64, e error) {
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err != nil {
+			return valid, err
+		}
+		var rec fileRecord
+		if json.Unmarshal(line, &rec) != nil {
+			return valid, nil
+		}
+		s.apply(&rec)
+		valid += int64(len(line))
+	}
+}
+
+func (s *FileStore) apply(rec *fileRecord) {
+	switch {
+	case rec.Sample != nil:
+		s.MemStore.AddNodeSample(rec.Sample)
+	case rec.Online != nil:
+		s.MemStore.AddNodeOnline(rec.Online.Node, rec.Online.Tm, rec.Online.Gap)
+	case rec.Period != nil:
+		s.MemStore.lock.Lock()
+		s.online[rec.Period.Node] = append(s.online[rec.Period.Node], rec.Period.OnlineInterval)
+		s.MemStore.lock.Unlock()
+	}
+}
+
+func (s *FileStore) append(rec *fileRecord) (e error) {
+	b, e := json.Marshal(rec)
+	if e != nil {
+		return
+	}
+	if _, e = s.w.Write(append(b, '\n')); e != nil {
+		return
+	}
+	return s.w.Flush()
+}
+
+func (s *FileStore) AddNodeSample(sample *p2p_storage.NodeSample) (e error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e = s.append(&fileRecord{Sample: sample}); e != nil {
+		return
+	}
+	return s.MemStore.AddNodeSample(sample)
+}
+
+func (s *FileStore) AddNodeOnline(nid string, tm, gap int64) (e error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e = s.append(&fileRecord{Online: &fileOnline{nid, tm, gap}}); e != nil {
+		return
+	}
+	return s.MemStore.AddNodeOnline(nid, tm, gap)
+}
+
+//压缩内存中的记录后重写文件
+func (s *FileStore) CompactNodeHistory(before, span, expire int64) (e error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e = s.MemStore.CompactNodeHistory(before, span, expire); e != nil {
+		return
+	}
+	tmp, e := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if e != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	s.MemStore.lock.RLock()
+	for _, samples := range s.samples {
+		for i := range samples {
+			if e = enc.Encode(&fileRecord{Sample: &samples[i]}); e != nil {
+				break
+			}
+		}
+	}
+	for nid, periods := range s.online {
+		for _, p := range periods {
+			if e = enc.Encode(&fileRecord{Period: &filePeriod{nid, p}}); e != nil {
+				break
+			}
+		}
+	}
+	s.MemStore.lock.RUnlock()
+	if e == nil {
+		e = w.Flush()
+	}
+	if e == nil {
+		e = tmp.Sync()
+	}
+	if err := tmp.Close(); e == nil {
+		e = err
+	}
+	if e != nil {
+		return
+	}
+	if e = os.Rename(tmp.Name(), s.path); e != nil {
+		return
+	}
+	f, e := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if e != nil {
+		return
+	}
+	s.file.Close()
+	s.file, s.w = f, bufio.NewWriter(f)
+	return
+}
+
+func (s *FileStore) Close() (e error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e = s.w.Flush(); e != nil {
+		s.file.Close()
+		return
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,126 @@
+/*
+基于内存的节点历史记录存储，实现p2p_storage.INodeHistoryStore。
+
+重启即丢失，用于测试；需要保留历史记录时使用FileStore。
+
+示例：
+	p2p_storage.Init(ds, logger, true)
+	p2p_storage.SetNodeHistoryStore(history.NewMemStore())
+*/
+package history
+
+import (
+	"sort"
+	"sync"
+	"yh_pkg/p2p_storage"
+)
+
+type MemStore struct {
+	lock    sync.RWMutex
+	samples map[string][]p2p_storage.NodeSample     //nid -> 按时间排序的样本
+	online  map[string][]p2p_storage.OnlineInterval //nid -> 按时间排序的在线区间
+}
+
+var _ p2p_storage.INodeHistoryStore = (*MemStore)(nil)
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		samples: make(map[string][]p2p_storage.NodeSample),
+		online:  make(map[string][]p2p_storage.OnlineInterval),
+	}
+}
+
+func (m *MemStore) AddNodeSample(s *p2p_storage.NodeSample) (e error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	samples := m.samples[s.Node]
+	//新样本一般在最后
+	i := len(samples)
+	for i > 0 && samples[i-1].Tm > s.Tm {
+		i--
+	}
+	if i > 0 && samples[i-1].Tm == s.Tm && samples[i-1].Span == s.Span {
+		samples[i-1].Merge(s)
+		return
+	}
+	samples = append(samples, p2p_storage.NodeSample{})
+	copy(samples[i+1:], samples[i:])
+	samples[i] = *s
+	m.samples[s.Node] = samples
+	return
+}
+
+func (m *MemStore) GetNodeSamples(nid string, from, to int64) (samples []p2p_storage.NodeSample, e error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	samples = make([]p2p_storage.NodeSample, 0)
+	for _, s := range m.samples[nid] {
+		if s.Tm < to && s.Tm+s.Span > from {
+			samples = append(samples, s)
+		}
+	}
+	return
+}
+
+func (m *MemStore) AddNodeOnline(nid string, tm, gap int64) (e error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	periods := m.online[nid]
+	if n := len(periods); n > 0 && tm <= periods[n-1].End+gap {
+		//乱序的心跳只会落在最后一个区间内
+		if tm > periods[n-1].End {
+			periods[n-1].End = tm
+		}
+		return
+	}
+	m.online[nid] = append(periods, p2p_storage.OnlineInterval{Start: tm, End: tm})
+	return
+}
+
+func (m *MemStore) GetNodeOnline(nid string, from, to int64) (periods []p2p_storage.OnlineInterval, e error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	periods = make([]p2p_storage.OnlineInterval, 0)
+	for _, p := range m.online[nid] {
+		if p.Start < to && p.End >= from {
+			periods = append(periods, p)
+		}
+	}
+	return
+}
+
+func (m *MemStore) CompactNodeHistory(before, span, expire int64) (e error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for nid, samples := range m.samples {
+		//保留的样本中，before之前结束的部分降采样
+		i := sort.Search(len(samples), func(i int) bool { return samples[i].Tm+samples[i].Span > expire })
+		j := i
+		for j < len(samples) && samples[j].Tm+samples[j].Span <= before {
+			j++
+		}
+		kept := p2p_storage.DownsampleNodeSamples(samples[i:j], span)
+		//降采样后的时间段可能与之后的样本重叠，重叠时合并
+		for _, s := range samples[j:] {
+			if n := len(kept); n > 0 && kept[n-1].Tm+kept[n-1].Span > s.Tm {
+				kept[n-1].Merge(&s)
+				continue
+			}
+			kept = append(kept, s)
+		}
+		if len(kept) == 0 {
+			delete(m.samples, nid)
+		} else {
+			m.samples[nid] = kept
+		}
+	}
+	for nid, periods := range m.online {
+		i := sort.Search(len(periods), func(i int) bool { return periods[i].End >= expire })
+		if i == len(periods) {
+			delete(m.online, nid)
+		} else if i > 0 {
+			m.online[nid] = append([]p2p_storage.OnlineInterval(nil), periods[i:]...)
+		}
+	}
+	return
+}
@@ -0,0 +1,120 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"yh_pkg/p2p_storage"
+)
+
+func TestMemStore(t *testing.T) {
+	m := NewMemStore()
+	const day = 86400
+	//两天内每5分钟一次心跳，第二天12点开始离线1小时
+	for tm := int64(0); tm < 2*day; tm += p2p_storage.NODE_HISTORY_RESOLUTION {
+		if tm >= day+12*3600 && tm < day+13*3600 {
+			continue
+		}
+		s := &p2p_storage.NodeSample{Node: "n1", Tm: tm, Span: p2p_storage.NODE_HISTORY_RESOLUTION, Count: 1, Upload: 1000, LeftSpace: tm}
+		if e := m.AddNodeSample(s); e != nil {
+			t.Fatal(e)
+		}
+		if e := m.AddNodeOnline("n1", tm, p2p_storage.NODE_VALID_TIME); e != nil {
+			t.Fatal(e)
+		}
+	}
+	//同一时间段的任务结果合并到心跳的样本
+	m.AddNodeSample(&p2p_storage.NodeSample{Node: "n1", Tm: 300, Span: p2p_storage.NODE_HISTORY_RESOLUTION, Failed: 1})
+	samples, _ := m.GetNodeSamples("n1", 300, 600)
+	if len(samples) != 1 || samples[0].Count != 1 || samples[0].Failed != 1 || samples[0].Upload != 1000 {
+		t.Fatalf("samples: %+v", samples)
+	}
+
+	periods, _ := m.GetNodeOnline("n1", 0, 2*day)
+	if len(periods) != 2 || periods[0].End != day+12*3600-300 || periods[1].Start != day+13*3600 {
+		t.Fatalf("periods: %+v", periods)
+	}
+
+	//第一天的样本降采样为小时，删除第一天12点之前的记录
+	if e := m.CompactNodeHistory(day, 3600, 12*3600); e != nil {
+		t.Fatal(e)
+	}
+	samples, _ = m.GetNodeSamples("n1", 0, day)
+	if len(samples) != 12 {
+		t.Fatalf("%d samples", len(samples))
+	}
+	if s := samples[0]; s.Tm != 12*3600 || s.Span != 3600 || s.Count != 12 || s.Upload != 1000 || s.LeftSpace != 13*3600-300 {
+		t.Errorf("downsampled: %+v", s)
+	}
+	if samples, _ = m.GetNodeSamples("n1", day, day+3600); len(samples) != 12 || samples[0].Span != p2p_storage.NODE_HISTORY_RESOLUTION {
+		t.Errorf("raw samples: %d", len(samples))
+	}
+	if periods, _ = m.GetNodeOnline("n1", 0, 2*day); len(periods) != 2 {
+		t.Errorf("periods after compact: %+v", periods)
+	}
+	//全部过期
+	m.CompactNodeHistory(2*day, 3600, 3*day)
+	if samples, _ = m.GetNodeSamples("n1", 0, 3*day); len(samples) != 0 || len(m.samples) != 0 || len(m.online) != 0 {
+		t.Errorf("expired: %d samples", len(samples))
+	}
+}
+
+//重新打开后记录不变，压缩后的文件也可以恢复，不完整的最后一行被忽略
+func TestFileStore(t *testing.T) {
+	dir, e := ioutil.TempDir("", "history")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.log")
+	s, e := OpenFileStore(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	const day = 86400
+	for tm := int64(0); tm < 2*day; tm += p2p_storage.NODE_HISTORY_RESOLUTION {
+		s.AddNodeSample(&p2p_storage.NodeSample{Node: "n1", Tm: tm, Span: p2p_storage.NODE_HISTORY_RESOLUTION, Count: 1, Upload: tm})
+		if tm < day || tm >= day+3600 {
+			s.AddNodeOnline("n1", tm, p2p_storage.NODE_VALID_TIME)
+		}
+	}
+	check := func(s *FileStore, step string) {
+		want, _ := s.GetNodeSamples("n1", 0, 3*day)
+		wantPeriods, _ := s.GetNodeOnline("n1", 0, 2*day)
+		s.Close()
+		r, e := OpenFileStore(path)
+		if e != nil {
+			t.Fatal(step, e)
+		}
+		got, _ := r.GetNodeSamples("n1", 0, 3*day)
+		periods, _ := r.GetNodeOnline("n1", 0, 2*day)
+		if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(periods, wantPeriods) || len(periods) != 2 {
+			t.Errorf("%s: %d samples %v, want %d samples %v", step, len(got), periods, len(want), wantPeriods)
+		}
+		r.Close()
+	}
+	check(s, "reopen")
+
+	if s, e = OpenFileStore(path); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.CompactNodeHistory(day, 3600, 0); e != nil {
+		t.Fatal(e)
+	}
+	s.AddNodeOnline("n1", 2*day, p2p_storage.NODE_VALID_TIME)
+	check(s, "compacted")
+
+	f, e := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if e != nil {
+		t.Fatal(e)
+	}
+	f.WriteString(`{"s":{"node":"n1","tm":`)
+	f.Close()
+	if s, e = OpenFileStore(path); e != nil {
+		t.Fatal(e)
+	}
+	s.AddNodeSample(&p2p_storage.NodeSample{Node: "n1", Tm: 2 * day, Span: p2p_storage.NODE_HISTORY_RESOLUTION, Count: 1})
+	check(s, "partial line")
+}
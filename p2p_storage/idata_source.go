@@ -1,5 +1,9 @@
 package p2p_storage
 
+import (
+	"reflect"
+)
+
 type IDataSource interface {
 	/*
 		自增ID
@@ -693,3 +697,23 @@ type IDataSource interface {
 	*/
 	UnLock(db int, key string) (e error)
 }
+
+/*
+	包装其他数据源的IDataSource（如migrate.DualWrite、chaos.Chaos）为了转发可选的存储接口（INodeKeyStore、IFileKeyStore等）
+	需要实现所有这些接口，Init用Supports判断被包装的数据源是否真正支持某个接口，不支持时按没有该存储处理。
+*/
+type IStoreForwarder interface {
+	/*
+		参数：
+			store: 可选接口的nil指针，如(*INodeKeyStore)(nil)
+	*/
+	Supports(store interface{}) bool
+}
+
+//数据源是否支持可选接口store（接口的nil指针），包装的数据源由Supports决定
+func SupportsStore(ds interface{}, store interface{}) bool {
+	if f, ok := ds.(IStoreForwarder); ok {
+		return f.Supports(store)
+	}
+	return ds != nil && reflect.TypeOf(ds).Implements(reflect.TypeOf(store).Elem())
+}
@@ -0,0 +1,359 @@
+package p2p_storage
+
+import (
+	"fmt"
+	"yh_pkg/service"
+	"yh_pkg/time"
+	"yh_pkg/trace"
+)
+
+/*
+	延迟添加队列。AddP2PFile遇到分组在线节点不足，或者admission_mode为ADMISSION_QUEUE时没有可用节点，
+	设置了存储时把文件连同源节点保存到队列中，返回带排队号的ERR_P2P_INGEST_QUEUED（见IngestTicket），
+	文件视为已接受：对象和生命周期策略照常保存，对象同时记录在队列中。检测服务定期重试队列中的文件，分组就绪后生成扩散任务，
+	调用方可以用GetIngest按排队号查询结果。超过ingest_max_hours失败时删除记录的对象，
+	文件没有其他引用时同时删除生命周期策略、文件ID等记录（见rollbackIngest）。
+*/
+const (
+	INGEST_PENDING  int8 = 0 //等待分组就绪
+	INGEST_PROMOTED int8 = 1 //已经生成扩散任务，或者文件已经被其他节点添加
+	INGEST_FAILED   int8 = 2 //超过ingest_max_hours仍未添加成功
+)
+
+var INGEST_STATE_NAMES = []string{"pending", "promoted", "failed"}
+
+const (
+	INGEST_RETRY_BASE    int64 = 60        //第n次重试失败后等待INGEST_RETRY_BASE*2^(n-1)秒
+	INGEST_RETRY_MAX     int64 = 1800      //重试间隔上限（秒）
+	INGEST_KEEP_TIME     int64 = 7 * 86400 //结束的记录保留的时间（秒），之后不能再查询
+	INGEST_PAGE_SIZE           = 100
+	INGEST_TICKET_FORMAT       = "ingest ticket %d" //ERR_P2P_INGEST_QUEUED的错误描述
+)
+
+//队列中的文件，参数与addP2PFile相同
+type PendingIngest struct {
+	Ticket   uint64 `json:"ticket"`
+	MD5      string `json:"md5"`
+	SrcNode  string `json:"src_node"`
+	Size     uint64 `json:"size"`
+	Times    int    `json:"times"`
+	NoSource bool   `json:"no_source"`
+	Tier     int    `json:"tier"`
+	Priority int    `json:"priority"`
+	State    int8   `json:"state"`
+	Reason   string `json:"reason"` //进入队列的原因
+	AddTm    int64  `json:"add_tm"`
+	UpdateTm int64  `json:"update_tm"`
+	Tries    uint32 `json:"tries"`   //重试次数
+	NextTm   int64  `json:"next_tm"` //下次重试时间
+	TaskID   int64  `json:"task_id"` //INGEST_PROMOTED时生成的扩散任务，文件已经被其他节点添加时为0
+	Error    string `json:"error"`   //最后一次重试的错误
+
+	Objects []IngestObject `json:"objects,omitempty"` //进入队列后引用该文件的对象，失败时删除
+}
+
+//引用队列中文件的对象
+type IngestObject struct {
+	Tenant string `json:"tenant"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+//队列的深度和等待时间
+type IngestStats struct {
+	Pending  int   `json:"pending"`   //等待中的文件数
+	OldestTm int64 `json:"oldest_tm"` //最早进入队列的等待中文件的时间，没有时为0
+}
+
+/*
+	延迟添加队列的存储，IDataSource同时实现该接口时Init会自动使用。没有设置时不排队，与原来一样返回错误。
+*/
+type IIngestStore interface {
+	//分配排队号并保存
+	AddIngest(p *PendingIngest) (ticket uint64, e error)
+	//不存在时返回nil,nil
+	GetIngest(ticket uint64) (p *PendingIngest, e error)
+	//同一文件等待中的记录，不存在时返回nil,nil
+	GetPendingIngest(md5 string) (p *PendingIngest, e error)
+	//排队号大于after的等待中记录，按排队号升序
+	GetPendingIngests(after uint64, num int) (ps []PendingIngest, e error)
+	UpdateIngest(p *PendingIngest) (e error)
+	//删除UpdateTm在before之前的已结束记录
+	DeleteIngests(before int64) (e error)
+	GetIngestStats() (stats IngestStats, e error)
+}
+
+var ingestStore IIngestStore
+
+//设置延迟添加队列的存储，覆盖Init时自动检测的结果
+func SetIngestStore(s IIngestStore) {
+	ingestStore = s
+}
+
+//分组在线节点不足，设置了队列时进入队列
+var errGroupNotReady = service.NewSimpleError(service.ERR_INTERNAL, "group online_num is less than safe_piece num")
+
+//可以进入队列等待的错误
+func isIngestDeferrable(e error) bool {
+	if e == errGroupNotReady {
+		return true
+	}
+	err, ok := e.(service.Error)
+	return ok && err.Code == service.ERR_P2P_CAPACITY_RETRY
+}
+
+func ingestQueuedError(ticket uint64) error {
+	return service.NewError(service.ERR_P2P_INGEST_QUEUED, fmt.Sprintf(INGEST_TICKET_FORMAT, ticket), "file is queued until a group is ready")
+}
+
+/*
+	AddP2PFile等返回的错误是否表示文件已经进入队列
+
+	返回值：
+		ticket: 排队号，用GetIngest查询
+*/
+func IngestTicket(e error) (ticket uint64, ok bool) {
+	err, ok := e.(service.Error)
+	if !ok || err.Code != service.ERR_P2P_INGEST_QUEUED {
+		return 0, false
+	}
+	_, err2 := fmt.Sscanf(err.Desc, INGEST_TICKET_FORMAT, &ticket)
+	return ticket, err2 == nil
+}
+
+//文件进入队列，同一文件已经在等待时返回原来的排队号
+func deferIngest(p *PendingIngest, reason error) (e error) {
+	old, e := ingestStore.GetPendingIngest(p.MD5)
+	if e != nil {
+		return
+	}
+	if old != nil {
+		return ingestQueuedError(old.Ticket)
+	}
+	now := time.Now.Unix()
+	p.State, p.AddTm, p.UpdateTm, p.NextTm = INGEST_PENDING, now, now, now+INGEST_RETRY_BASE
+	p.Reason = reason.Error()
+	ticket, e := ingestStore.AddIngest(p)
+	if e != nil {
+		return
+	}
+	logger.AppendObj(nil, "-AddP2PFile-deferred", p.MD5, p.SrcNode, ticket, p.Reason)
+	return ingestQueuedError(ticket)
+}
+
+/*
+	按排队号查询队列中的文件
+
+	返回值：
+		p: 不存在或者已经超过INGEST_KEEP_TIME被删除时为ERR_NOT_FOUND
+*/
+func GetIngest(ticket uint64) (p *PendingIngest, e error) {
+	return WithSpan(nil).GetIngest(ticket)
+}
+
+func (c Caller) GetIngest(ticket uint64) (p *PendingIngest, e error) {
+	defer c.parent.Child("p2p_storage.GetIngest").SetAttr("ticket", ticket).End(&e)
+	if ingestStore == nil {
+		return nil, service.NewError(service.ERR_INTERNAL, "ingest store not set")
+	}
+	if p, e = ingestStore.GetIngest(ticket); e == nil && p == nil {
+		e = service.NewError(service.ERR_NOT_FOUND, fmt.Sprintf("ingest ticket %d not found", ticket))
+	}
+	return
+}
+
+//队列的深度和等待时间，没有设置存储时为空
+func GetIngestStats() (stats IngestStats, e error) {
+	return WithSpan(nil).GetIngestStats()
+}
+
+func (c Caller) GetIngestStats() (stats IngestStats, e error) {
+	defer c.parent.Child("p2p_storage.GetIngestStats").End(&e)
+	if ingestStore == nil {
+		return
+	}
+	return ingestStore.GetIngestStats()
+}
+
+//列出等待中的文件，按排队号升序
+func ListPendingIngests(after uint64, num int) (ps []PendingIngest, e error) {
+	defer trace.Begin("p2p_storage.ListPendingIngests").End(&e)
+	if ingestStore == nil {
+		return nil, service.NewError(service.ERR_INTERNAL, "ingest store not set")
+	}
+	return ingestStore.GetPendingIngests(after, num)
+}
+
+func ingestRetryDelay(tries uint32) int64 {
+	delay := INGEST_RETRY_BASE
+	for i := uint32(1); i < tries && delay < INGEST_RETRY_MAX; i++ {
+		delay *= 2
+	}
+	if delay > INGEST_RETRY_MAX {
+		delay = INGEST_RETRY_MAX
+	}
+	return delay
+}
+
+func ingestLockKey(md5 string) string {
+	return "p2p_ingest_" + md5
+}
+
+/*
+	记录引用队列中文件的对象，文件添加失败时删除。对象已经记录或者排队已经结束时不处理
+
+	参数：
+		ticket: AddP2PFile返回的排队号
+*/
+func (ds *DataSource) addIngestObject(ticket uint64, md5 string, obj IngestObject) (e error) {
+	if e = ds.lock(ingestLockKey(md5)); e != nil {
+		return
+	}
+	defer ds.unlock(ingestLockKey(md5))
+	p, e := ingestStore.GetIngest(ticket)
+	if e != nil || p == nil || p.State != INGEST_PENDING {
+		return
+	}
+	for _, o := range p.Objects {
+		if o == obj {
+			return
+		}
+	}
+	p.Objects = append(p.Objects, obj)
+	return ingestStore.UpdateIngest(p)
+}
+
+//重试一个文件，分组就绪时生成扩散任务，失败时回滚
+func (ds *DataSource) promoteIngest(p *PendingIngest, now int64) (e error) {
+	if e = ds.retryIngest(p, now); e != nil || p.State != INGEST_FAILED {
+		return
+	}
+	//状态已经保存，之后不会再记录新的对象，不持有队列的锁，避免与AddP2PObject的租户锁顺序相反
+	return ds.rollbackIngest(p)
+}
+
+func (ds *DataSource) retryIngest(p *PendingIngest, now int64) (e error) {
+	if e = ds.lock(ingestLockKey(p.MD5)); e != nil {
+		return
+	}
+	defer ds.unlock(ingestLockKey(p.MD5))
+	//加锁后重新读取，得到最新记录的对象
+	cur, e := ingestStore.GetIngest(p.Ticket)
+	if e != nil || cur == nil || cur.State != INGEST_PENDING {
+		return
+	}
+	*p = *cur
+	task_id, err := ds.tryAddP2PFile(p.MD5, p.SrcNode, p.Size, p.Times, p.NoSource, p.Tier, p.Priority)
+	p.UpdateTm = now
+	p.Tries++
+	switch {
+	case err == nil || isFileAdded(err):
+		p.State, p.TaskID = INGEST_PROMOTED, task_id
+	case now-p.AddTm >= getConfigInt64(INGEST_MAX_HOURS_KEY, DEFAULT_INGEST_MAX_HOURS)*3600:
+		p.State = INGEST_FAILED
+	default:
+		p.NextTm = now + ingestRetryDelay(p.Tries)
+	}
+	p.Error = ""
+	if err != nil {
+		p.Error = err.Error()
+	}
+	logger.AppendObj(err, "promoteIngest", p.Ticket, p.MD5, INGEST_STATE_NAMES[p.State], p.TaskID)
+	return ingestStore.UpdateIngest(p)
+}
+
+/*
+	文件添加失败，删除进入队列后引用该文件的对象并减少引用计数，
+	文件没有其他引用时删除生命周期策略、文件ID、加密密钥等记录，与DeleteFile相同。
+	文件已经在分组中（分组节点不足时重新添加）时对象仍然有效，不处理
+*/
+func (ds *DataSource) rollbackIngest(p *PendingIngest) (e error) {
+	exist, e := ds.IsFileExists(p.MD5)
+	if e != nil || exist {
+		return
+	}
+	for _, o := range p.Objects {
+		if e = ds.deleteIngestObject(p.MD5, o); e != nil {
+			return
+		}
+	}
+	if nsStore == nil {
+		return ds.deleteFile(p.MD5)
+	}
+	if e = ds.lock(fileRefLockKey(p.MD5)); e != nil {
+		return
+	}
+	defer ds.unlock(fileRefLockKey(p.MD5))
+	refs, e := nsStore.GetFileRef(p.MD5)
+	if e != nil || refs > 0 {
+		return
+	}
+	return ds.deleteFile(p.MD5)
+}
+
+//删除引用队列中文件的对象，对象已经删除或者指向其他文件时不处理
+func (ds *DataSource) deleteIngestObject(md5 string, o IngestObject) (e error) {
+	//直接添加的对象由文件的锁保护，见addDirectFile
+	key := tenantLockKey(o.Tenant)
+	if o.Tenant == DIRECT_TENANT {
+		key = fileRefLockKey(md5)
+	}
+	if e = ds.lock(key); e != nil {
+		return
+	}
+	defer ds.unlock(key)
+	obj, e := nsStore.GetObject(o.Tenant, o.Bucket, o.Key)
+	if e != nil || obj == nil || obj.MD5 != md5 {
+		return
+	}
+	if e = nsStore.DeleteObject(o.Tenant, o.Bucket, o.Key); e != nil {
+		return
+	}
+	if e = nsStore.IncrUsage(o.Tenant, -int64(obj.Size), -1); e != nil {
+		return
+	}
+	if _, e = nsStore.IncrFileRef(md5, -1); e != nil {
+		return
+	}
+	logger.AppendObj(nil, "rollbackIngest-object deleted", md5, o)
+	return
+}
+
+/*
+	重试队列中到时间的文件，并删除超过INGEST_KEEP_TIME的已结束记录
+
+	返回值：
+		n: 生成扩散任务的文件数
+*/
+func PromoteIngests() (n int, e error) {
+	source, span := beginSpan(nil, "p2p_storage.PromoteIngests")
+	defer span.End(&e)
+	if ingestStore == nil {
+		return
+	}
+	now := time.Now.Unix()
+	for after := uint64(0); ; {
+		ps, e := ingestStore.GetPendingIngests(after, INGEST_PAGE_SIZE)
+		if e != nil {
+			return n, e
+		}
+		if len(ps) == 0 {
+			break
+		}
+		for i := range ps {
+			p := &ps[i]
+			after = p.Ticket
+			if p.NextTm > now {
+				continue
+			}
+			if err := source.promoteIngest(p, now); err != nil {
+				logger.AppendObj(err, "PromoteIngests-promoteIngest error", p.Ticket)
+				continue
+			}
+			if p.State == INGEST_PROMOTED {
+				n++
+			}
+		}
+	}
+	return n, ingestStore.DeleteIngests(now - INGEST_KEEP_TIME)
+}
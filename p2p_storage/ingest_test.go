@@ -0,0 +1,110 @@
+package p2p_storage_test
+
+import (
+	"fmt"
+	"testing"
+	"yh_pkg/p2p_storage"
+)
+
+//GID中n05～n07离线后在线节点少于添加文件需要的数量，文件进入队列，节点上线后生成扩散任务
+func TestPromoteIngests(t *testing.T) {
+	f := newFixture(t)
+	setState := func(state int) {
+		for i := 5; i < NODE_NUM; i++ {
+			f.ds.UpdateGroupNode(GID, &p2p_storage.GroupNode{Node: fmt.Sprintf("n%02d", i), State: state}, false)
+		}
+	}
+	const md5 = "0123456789abcdef0123456789abcdef"
+	f.ds.AddFileToGroup(GID, &p2p_storage.GroupFile{File: p2p_storage.File{MD5: md5, Size: 4096}, Ver: 1, State: p2p_storage.NORMAL})
+	setState(p2p_storage.OFFLINE)
+
+	_, e := p2p_storage.AddP2PFile(md5, "n01", 4096, 0, false)
+	ticket, queued := p2p_storage.IngestTicket(e)
+	if !queued {
+		t.Fatalf("not queued: %v", e)
+	}
+	//同一文件只排队一次
+	if _, e = p2p_storage.AddP2PFile(md5, "n02", 4096, 0, false); e == nil {
+		t.Fatal("queued twice")
+	} else if t2, _ := p2p_storage.IngestTicket(e); t2 != ticket {
+		t.Errorf("ticket %d, want %d", t2, ticket)
+	}
+	//还没有到重试时间
+	if n, e := p2p_storage.PromoteIngests(); e != nil || n != 0 {
+		t.Errorf("promoted before next_tm: %d %v", n, e)
+	}
+
+	setState(p2p_storage.ONLINE)
+	p, e := p2p_storage.GetIngest(ticket)
+	if e != nil {
+		t.Fatal(e)
+	}
+	p.NextTm = 0
+	f.ds.UpdateIngest(p)
+	if n, e := p2p_storage.PromoteIngests(); e != nil || n != 1 {
+		t.Errorf("PromoteIngests: %d %v", n, e)
+	}
+	if p, e = p2p_storage.GetIngest(ticket); e != nil || p.State != p2p_storage.INGEST_PROMOTED || p.TaskID <= 0 || p.SrcNode != "n01" {
+		t.Errorf("ingest after promote: %+v %v", p, e)
+	}
+	if stats, _ := p2p_storage.GetIngestStats(); stats.Pending != 0 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
+
+//超过ingest_max_hours仍未添加成功时，删除进入队列后引用文件的对象和文件的生命周期策略
+func TestIngestFailed(t *testing.T) {
+	f := newFixture(t)
+	p2p_storage.ConfigMap.ConfigValue.Set(p2p_storage.ADMISSION_MODE_KEY, p2p_storage.ADMISSION_QUEUE)
+	defer p2p_storage.ConfigMap.ConfigValue.Set(p2p_storage.ADMISSION_MODE_KEY, p2p_storage.DEFAULT_ADMISSION_MODE)
+	if e := p2p_storage.CreateBucket("t1", "photos"); e != nil {
+		t.Fatal(e)
+	}
+
+	const md5 = "0123456789abcdef0123456789abcdef"
+	_, e := p2p_storage.AddP2PObject(&p2p_storage.Object{Tenant: "t1", Bucket: "photos", Key: "a", MD5: md5, Size: 4096}, "n01", 0, false)
+	ticket, queued := p2p_storage.IngestTicket(e)
+	if !queued {
+		t.Fatalf("AddP2PObject not queued: %v", e)
+	}
+	_, e = p2p_storage.AddP2PFileWithPolicy(md5, "n01", 4096, 0, false, &p2p_storage.Policy{TTL: 3600})
+	if t2, _ := p2p_storage.IngestTicket(e); t2 != ticket {
+		t.Fatalf("AddP2PFileWithPolicy: %v", e)
+	}
+	if refs, _ := f.ds.GetFileRef(md5); refs != 2 {
+		t.Errorf("refs before failed: %d", refs)
+	}
+	p, _ := f.ds.GetIngest(ticket)
+	if len(p.Objects) != 2 {
+		t.Errorf("ingest objects: %+v", p.Objects)
+	}
+
+	//还没有超时时只推迟重试
+	p.NextTm = 0
+	f.ds.UpdateIngest(p)
+	if n, e := p2p_storage.PromoteIngests(); n != 0 || e != nil {
+		t.Errorf("PromoteIngests: %d %v", n, e)
+	}
+	if p, _ = f.ds.GetIngest(ticket); p.State != p2p_storage.INGEST_PENDING || p.NextTm == 0 {
+		t.Fatalf("ingest retried: %+v", p)
+	}
+	p.AddTm, p.NextTm = p.AddTm-p2p_storage.DEFAULT_INGEST_MAX_HOURS*3600, 0
+	f.ds.UpdateIngest(p)
+	if n, e := p2p_storage.PromoteIngests(); n != 0 || e != nil {
+		t.Errorf("PromoteIngests after max hours: %d %v", n, e)
+	}
+	if p, e = p2p_storage.GetIngest(ticket); e != nil || p.State != p2p_storage.INGEST_FAILED {
+		t.Fatalf("GetIngest: %+v %v", p, e)
+	}
+	for _, key := range [][3]string{{"t1", "photos", "a"}, {p2p_storage.DIRECT_TENANT, p2p_storage.DIRECT_BUCKET, md5}} {
+		if obj, _ := f.ds.GetObject(key[0], key[1], key[2]); obj != nil {
+			t.Errorf("object of failed file not deleted: %+v", obj)
+		}
+	}
+	refs, _ := f.ds.GetFileRef(md5)
+	usage, _ := f.ds.GetUsage("t1")
+	policy, _ := f.ds.GetFilePolicy(md5)
+	if refs != 0 || usage.Files != 0 || usage.Bytes != 0 || policy != nil {
+		t.Errorf("failed file not rolled back: refs %d usage %+v policy %+v", refs, usage, policy)
+	}
+}
@@ -0,0 +1,276 @@
+package mem_source
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"yh_pkg/p2p_storage"
+)
+
+func (ms *MemSource) findExpandNode(gid, nid, md5 string) *p2p_storage.ExpandNode {
+	for _, n := range ms.expandNodes {
+		if n.Group == gid && n.Node == nid && n.MD5 == md5 {
+			return n
+		}
+	}
+	return nil
+}
+
+//按ID排序的扩散任务
+func (ms *MemSource) sortedExpandNodes(filter func(n *p2p_storage.ExpandNode) bool) (exNodes []p2p_storage.ExpandNode) {
+	exNodes = make([]p2p_storage.ExpandNode, 0)
+	for _, n := range ms.expandNodes {
+		if filter(n) {
+			exNodes = append(exNodes, *n)
+		}
+	}
+	sort.Slice(exNodes, func(i, j int) bool { return exNodes[i].ID < exNodes[j].ID })
+	return
+}
+
+func (ms *MemSource) GetValidExpandNodes(gid, md5 string) (exNodes []p2p_storage.ExpandNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.sortedExpandNodes(func(n *p2p_storage.ExpandNode) bool {
+		return n.Group == gid && n.MD5 == md5 && !n.IsFinished()
+	}), nil
+}
+
+func (ms *MemSource) GetExpandNode(gid, nid, md5 string) (exNode *p2p_storage.ExpandNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if n := ms.findExpandNode(gid, nid, md5); n != nil {
+		c := *n
+		exNode = &c
+	}
+	return
+}
+
+func (ms *MemSource) GetExpandNodeById(id uint64) (exNode *p2p_storage.ExpandNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if n, ok := ms.expandNodes[id]; ok {
+		c := *n
+		exNode = &c
+	}
+	return
+}
+
+/*
+	获取节点未超时的某个状态的任务，按优先级从高到低排列
+*/
+func (ms *MemSource) GetExpandTasks(nid string, state int8, num int) (exNodes []p2p_storage.ExpandNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	tm := now()
+	exNodes = ms.sortedExpandNodes(func(n *p2p_storage.ExpandNode) bool {
+		return n.Node == nid && n.State == state && n.Timeout > tm
+	})
+	sort.SliceStable(exNodes, func(i, j int) bool { return exNodes[i].Level > exNodes[j].Level })
+	if len(exNodes) > num {
+		exNodes = exNodes[:num]
+	}
+	return
+}
+
+/*
+	按(gid, nid, md5)添加或更新任务，更新时保留原任务的ID和失败次数
+*/
+func (ms *MemSource) AddOrUpdateExpandNode(exNode *p2p_storage.ExpandNode) (task_id int64, e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	n := *exNode
+	if old := ms.findExpandNode(exNode.Group, exNode.Node, exNode.MD5); old != nil {
+		n.ID = old.ID
+		n.FailedTimes = old.FailedTimes
+	} else {
+		ms.expandId++
+		n.ID = ms.expandId
+	}
+	ms.expandNodes[n.ID] = &n
+	return int64(n.ID), nil
+}
+
+/*
+	按原ID写入扩散任务，不属于IDataSource接口，用于数据恢复。ID已存在时覆盖，之后新分配的ID大于它
+*/
+func (ms *MemSource) RestoreExpandNode(exNode *p2p_storage.ExpandNode) (e error) {
+	if exNode.ID == 0 {
+		return errors.New("expand task without id")
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if old := ms.findExpandNode(exNode.Group, exNode.Node, exNode.MD5); old != nil && old.ID != exNode.ID {
+		return fmt.Errorf("expand task %s/%s/%s exists with id %d", exNode.Group, exNode.Node, exNode.MD5, old.ID)
+	}
+	n := *exNode
+	ms.expandNodes[n.ID] = &n
+	if n.ID > ms.expandId {
+		ms.expandId = n.ID
+	}
+	return
+}
+
+func (ms *MemSource) UpdateExpandNodeState(gid, nid, md5 string, state int8, timouet int64, increment_failed_times bool) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if n := ms.findExpandNode(gid, nid, md5); n != nil {
+		n.State = state
+		n.Timeout = timouet
+		if increment_failed_times {
+			n.FailedTimes++
+		}
+	}
+	return
+}
+
+/*
+	将节点所有未完成的任务改为state
+*/
+func (ms *MemSource) UpdateExpandNodesState(nid string, state int8, timouet int64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, n := range ms.expandNodes {
+		if n.Node == nid && !n.IsFinished() {
+			n.State = state
+			n.Timeout = timouet
+		}
+	}
+	return
+}
+
+func (ms *MemSource) UpdateExpandNodeTimeout(id uint64, timouet int64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if n, ok := ms.expandNodes[id]; ok {
+		n.Timeout = timouet
+	}
+	return
+}
+
+func (ms *MemSource) deleteExpandNode(id uint64) {
+	delete(ms.expandNodes, id)
+	delete(ms.taskNodes, id)
+}
+
+func (ms *MemSource) DeleteExpandNode(gid, nid, md5 string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if n := ms.findExpandNode(gid, nid, md5); n != nil {
+		ms.deleteExpandNode(n.ID)
+	}
+	return
+}
+
+func (ms *MemSource) DeleteExpandNodeById(id uint64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.deleteExpandNode(id)
+	return
+}
+
+func (ms *MemSource) DeleteExpandNodeByMd5(md5 string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for id, n := range ms.expandNodes {
+		if n.MD5 == md5 {
+			ms.deleteExpandNode(id)
+		}
+	}
+	return
+}
+
+/*
+	删除创建时间早于tm的任务
+*/
+func (ms *MemSource) DeleteExpandNodeByTimeOut(tm uint64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for id, n := range ms.expandNodes {
+		if n.Tm < int64(tm) {
+			ms.deleteExpandNode(id)
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetExpandTaskTotalFailedTimes(gid, md5 string) (times uint32, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for _, n := range ms.expandNodes {
+		if n.Group == gid && n.MD5 == md5 {
+			times += n.FailedTimes
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetExpandTaskCount(node string) (cnt uint32, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for _, n := range ms.expandNodes {
+		if n.Node == node && !n.IsFinished() {
+			cnt++
+		}
+	}
+	return
+}
+
+/*
+	按(Timeout, ID)升序分页获取超时时间在(from, to]之间的任务，Timeout等于from时只返回ID大于lastId的任务
+*/
+func (ms *MemSource) GetTimeoutExpandTask(from int64, to int64, lastId int64, num int) (nodes []p2p_storage.ExpandNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	nodes = ms.sortedExpandNodes(func(n *p2p_storage.ExpandNode) bool {
+		if n.Timeout > to || n.Timeout < from {
+			return false
+		}
+		return n.Timeout > from || int64(n.ID) > lastId
+	})
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].Timeout < nodes[j].Timeout })
+	if len(nodes) > num {
+		nodes = nodes[:num]
+	}
+	return
+}
+
+func (ms *MemSource) SetExpandNodeStateFailed(node string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, n := range ms.expandNodes {
+		if n.Node == node && !n.IsFinished() {
+			n.State = p2p_storage.EXPAND_STATE_FAILED
+			n.Timeout = p2p_storage.CalculateExpandNodeTimeout(p2p_storage.EXPAND_STATE_FAILED)
+		}
+	}
+	return
+}
+
+func (ms *MemSource) AddTaskNode(task_id uint64, nids []string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	tm := now()
+	for _, nid := range nids {
+		ms.taskNodes[task_id] = append(ms.taskNodes[task_id], p2p_storage.TaskNode{ID: task_id, Node: nid, Tm: tm})
+	}
+	return
+}
+
+func (ms *MemSource) DeleteTaskNodeByTask(id uint64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.taskNodes, id)
+	return
+}
+
+/*
+	获取任务的源节点，不属于IDataSource接口
+*/
+func (ms *MemSource) GetTaskNodes(task_id uint64) (nodes []p2p_storage.TaskNode) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	nodes = make([]p2p_storage.TaskNode, len(ms.taskNodes[task_id]))
+	copy(nodes, ms.taskNodes[task_id])
+	return
+}
@@ -0,0 +1,55 @@
+package mem_source
+
+import (
+	"yh_pkg/p2p_storage"
+)
+
+var _ p2p_storage.IExpandStateStore = (*MemSource)(nil)
+
+type groupFileKey struct {
+	gid, md5 string
+}
+
+func (ms *MemSource) AddExpandTransition(t *p2p_storage.ExpandTransition) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ts := append(ms.expandHistory[t.Task], *t)
+	if len(ts) > p2p_storage.EXPAND_HISTORY_MAX {
+		ts = ts[len(ts)-p2p_storage.EXPAND_HISTORY_MAX:]
+	}
+	ms.expandHistory[t.Task] = ts
+	return
+}
+
+func (ms *MemSource) GetExpandTransitions(task uint64) (ts []p2p_storage.ExpandTransition, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return append([]p2p_storage.ExpandTransition{}, ms.expandHistory[task]...), nil
+}
+
+func (ms *MemSource) GetExpandAttempt(gid, md5 string) (a *p2p_storage.ExpandAttempt, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if v, ok := ms.expandAttempts[groupFileKey{gid, md5}]; ok {
+		c := *v
+		c.FailedNodes = append([]string{}, v.FailedNodes...)
+		a = &c
+	}
+	return
+}
+
+func (ms *MemSource) SetExpandAttempt(a *p2p_storage.ExpandAttempt) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	c := *a
+	c.FailedNodes = append([]string{}, a.FailedNodes...)
+	ms.expandAttempts[groupFileKey{a.Group, a.MD5}] = &c
+	return
+}
+
+func (ms *MemSource) DeleteExpandAttempt(gid, md5 string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.expandAttempts, groupFileKey{gid, md5})
+	return
+}
@@ -0,0 +1,251 @@
+package mem_source
+
+import (
+	"errors"
+	"sort"
+	"yh_pkg/p2p_storage"
+)
+
+func matchState(state, want int) bool {
+	return want == p2p_storage.ALL || state == want
+}
+
+func (ms *MemSource) GetFileGroups(md5 string, state int) (files map[string]p2p_storage.GroupFile, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	files = make(map[string]p2p_storage.GroupFile)
+	for gid, gfs := range ms.groupFiles {
+		if f, ok := gfs[md5]; ok && matchState(f.State, state) {
+			files[gid] = *f
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetFileByMd5AndState(md5 string, state int) (files []p2p_storage.GroupFile, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	files = make([]p2p_storage.GroupFile, 0)
+	for _, gid := range ms.sortedGroupIds() {
+		if f, ok := ms.groupFiles[gid][md5]; ok && matchState(f.State, state) {
+			files = append(files, *f)
+		}
+	}
+	return
+}
+
+func (ms *MemSource) sortedGroupIds() []string {
+	ids := make([]string, 0, len(ms.groupFiles))
+	for gid := range ms.groupFiles {
+		ids = append(ids, gid)
+	}
+	return sortStrings(ids)
+}
+
+/*
+	获取超过tm仍未完成扩散的新增文件，按最后添加时间升序
+*/
+func (ms *MemSource) GetNewAddTimeOutGroupFile(tm int64, num int) (files []p2p_storage.GroupFile, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	files = make([]p2p_storage.GroupFile, 0)
+	for _, gfs := range ms.groupFiles {
+		for _, f := range gfs {
+			if f.Type == p2p_storage.GROUPFILE_TYPE_NEW_ADD && f.State == p2p_storage.NORMAL && int64(f.LastAddTm) < tm {
+				files = append(files, *f)
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].LastAddTm == files[j].LastAddTm {
+			return files[i].Group+files[i].MD5 < files[j].Group+files[j].MD5
+		}
+		return files[i].LastAddTm < files[j].LastAddTm
+	})
+	if len(files) > num {
+		files = files[:num]
+	}
+	return
+}
+
+func (ms *MemSource) GetGroupFile(gid, md5 string) (file *p2p_storage.GroupFile, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if f, ok := ms.groupFiles[gid][md5]; ok {
+		c := *f
+		file = &c
+	}
+	return
+}
+
+/*
+	首次扩散文件按Ver升序，新增文件按AddVer升序，已删除的文件也会返回
+*/
+func (ms *MemSource) ListUpdatedFiles(gid string, ver uint64, num int, tp int) (files []p2p_storage.GroupFile, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	files = make([]p2p_storage.GroupFile, 0)
+	fileVer := func(f *p2p_storage.GroupFile) uint64 {
+		if tp == p2p_storage.GROUPFILE_TYPE_NEW_ADD {
+			return f.AddVer
+		}
+		return f.Ver
+	}
+	for _, f := range ms.groupFiles[gid] {
+		if f.Type == tp && fileVer(f) > ver {
+			files = append(files, *f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		vi, vj := fileVer(&files[i]), fileVer(&files[j])
+		if vi == vj {
+			return files[i].MD5 < files[j].MD5
+		}
+		return vi < vj
+	})
+	if len(files) > num {
+		files = files[:num]
+	}
+	return
+}
+
+func (ms *MemSource) CalculateGroupSize(gid string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	g, ok := ms.groups[gid]
+	if !ok {
+		return errors.New("group " + gid + " not found")
+	}
+	var size uint64
+	for _, f := range ms.groupFiles[gid] {
+		if f.State == p2p_storage.NORMAL {
+			size += f.Size
+		}
+	}
+	g.Size = size
+	return
+}
+
+func (ms *MemSource) fileGroupsCount(md5 string) (count int) {
+	for _, gfs := range ms.groupFiles {
+		if f, ok := gfs[md5]; ok && f.State != p2p_storage.DELETED {
+			count++
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetFileGroupsCount(md5 string) (count int, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.fileGroupsCount(md5), nil
+}
+
+func (ms *MemSource) GetMoreFileGroupsCount(md5s []string) (m map[string]bool, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	m = make(map[string]bool, len(md5s))
+	for _, md5 := range md5s {
+		if ms.fileGroupsCount(md5) > 0 {
+			m[md5] = true
+		}
+	}
+	return
+}
+
+func (ms *MemSource) AddFileToGroup(gid string, file *p2p_storage.GroupFile) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	gfs, ok := ms.groupFiles[gid]
+	if !ok {
+		return errors.New("group " + gid + " not found")
+	}
+	if _, ok = gfs[file.MD5]; ok {
+		return errors.New("file " + file.MD5 + " already exists in group " + gid)
+	}
+	f := *file
+	f.Group = gid
+	gfs[file.MD5] = &f
+	return
+}
+
+func (ms *MemSource) groupFile(gid, md5 string) (f *p2p_storage.GroupFile, e error) {
+	f, ok := ms.groupFiles[gid][md5]
+	if !ok {
+		e = errors.New("file " + md5 + " not found in group " + gid)
+	}
+	return
+}
+
+func (ms *MemSource) UpdateGroupFile(gid string, file *p2p_storage.GroupFile) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, e = ms.groupFile(gid, file.MD5); e != nil {
+		return
+	}
+	f := *file
+	f.Group = gid
+	ms.groupFiles[gid][file.MD5] = &f
+	return
+}
+
+func (ms *MemSource) UpdateGroupFileTpAndVer(gid, md5 string, ver uint64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	f, e := ms.groupFile(gid, md5)
+	if e != nil {
+		return
+	}
+	f.Type = p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST
+	f.Ver = ver
+	return
+}
+
+func (ms *MemSource) UpdateGroupFileStateAndAddVer(gid string, md5 string, state int, add_ver uint64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	f, e := ms.groupFile(gid, md5)
+	if e != nil {
+		return
+	}
+	f.State = state
+	f.AddVer = add_ver
+	return
+}
+
+func (ms *MemSource) DeleteGroupFile(gid string, md5 string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.groupFiles[gid], md5)
+	return
+}
+
+func (ms *MemSource) IncrFileVer(gid string, md5 string, ver uint64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	f, e := ms.groupFile(gid, md5)
+	if e != nil {
+		return
+	}
+	f.Ver = ver
+	return
+}
+
+/*
+	获取节点还未同步的首次扩散文件，即版本号大于ver的正常文件，按版本号升序
+*/
+func (ms *MemSource) GetGroupFileByVer(gid, nid string, ver uint64, num int) (files []p2p_storage.GroupFile, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	files = make([]p2p_storage.GroupFile, 0)
+	for _, f := range ms.groupFiles[gid] {
+		if f.Type == p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST && f.State == p2p_storage.NORMAL && f.Ver > ver {
+			files = append(files, *f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Ver < files[j].Ver })
+	if len(files) > num {
+		files = files[:num]
+	}
+	return
+}
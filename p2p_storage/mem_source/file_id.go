@@ -0,0 +1,52 @@
+package mem_source
+
+import (
+	"yh_pkg/p2p_storage"
+)
+
+var _ p2p_storage.IFileIDStore = (*MemSource)(nil)
+
+func (ms *MemSource) GetFileIDBinding(id string) (b *p2p_storage.FileIDBinding, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if v, ok := ms.fileIDs[id]; ok {
+		c := *v
+		b = &c
+	}
+	return
+}
+
+func (ms *MemSource) GetFileIDByMD5(md5 string) (b *p2p_storage.FileIDBinding, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if v, ok := ms.fileIDs[ms.md5ToIDs[md5]]; ok {
+		c := *v
+		b = &c
+	}
+	return
+}
+
+func (ms *MemSource) SetFileIDBinding(b *p2p_storage.FileIDBinding) (ok bool, e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, exist := ms.fileIDs[b.ID]; exist {
+		return
+	}
+	if _, exist := ms.md5ToIDs[b.MD5]; exist {
+		return
+	}
+	c := *b
+	ms.fileIDs[b.ID] = &c
+	ms.md5ToIDs[b.MD5] = b.ID
+	return true, nil
+}
+
+func (ms *MemSource) DeleteFileIDBinding(id string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if b, ok := ms.fileIDs[id]; ok {
+		delete(ms.md5ToIDs, b.MD5)
+		delete(ms.fileIDs, id)
+	}
+	return
+}
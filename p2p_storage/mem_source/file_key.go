@@ -0,0 +1,60 @@
+package mem_source
+
+import (
+	"sort"
+	"yh_pkg/p2p_storage"
+)
+
+var _ p2p_storage.IFileKeyStore = (*MemSource)(nil)
+
+func copyFileKey(key *p2p_storage.FileKey) *p2p_storage.FileKey {
+	k := *key
+	k.Wrapped = append([]byte(nil), key.Wrapped...)
+	return &k
+}
+
+func (ms *MemSource) GetFileKey(md5 string) (key *p2p_storage.FileKey, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if k, ok := ms.fileKeys[md5]; ok {
+		key = copyFileKey(k)
+	}
+	return
+}
+
+func (ms *MemSource) SetFileKey(key *p2p_storage.FileKey, oldVer uint32) (ok bool, e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	var curVer uint32
+	if k, exist := ms.fileKeys[key.MD5]; exist {
+		curVer = k.KeyVer
+	}
+	if curVer != oldVer {
+		return false, nil
+	}
+	ms.fileKeys[key.MD5] = copyFileKey(key)
+	return true, nil
+}
+
+func (ms *MemSource) DeleteFileKey(md5 string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.fileKeys, md5)
+	return
+}
+
+func (ms *MemSource) GetFileKeys(tenant string, from string, num int) (keys []p2p_storage.FileKey, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	keys = make([]p2p_storage.FileKey, 0)
+	for md5, k := range ms.fileKeys {
+		if k.Tenant == tenant && md5 > from {
+			keys = append(keys, *copyFileKey(k))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].MD5 < keys[j].MD5 })
+	if len(keys) > num {
+		keys = keys[:num]
+	}
+	return
+}
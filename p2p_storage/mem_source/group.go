@@ -0,0 +1,425 @@
+package mem_source
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"yh_pkg/p2p_storage"
+)
+
+func (ms *MemSource) AddGroup(group *p2p_storage.Group) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.groups[group.ID]; ok {
+		return errors.New("group " + group.ID + " already exists")
+	}
+	g := *group
+	ms.groups[group.ID] = &g
+	ms.groupNodes[group.ID] = make(map[string]*groupNode)
+	ms.groupFiles[group.ID] = make(map[string]*p2p_storage.GroupFile)
+	return
+}
+
+func (ms *MemSource) GetGroup(gid string) (group *p2p_storage.Group, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if g, ok := ms.groups[gid]; ok {
+		c := *g
+		group = &c
+	}
+	return
+}
+
+func (ms *MemSource) GetAllGroup() (groups map[string]p2p_storage.Group, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	groups = make(map[string]p2p_storage.Group, len(ms.groups))
+	for id, g := range ms.groups {
+		groups[id] = *g
+	}
+	return
+}
+
+/*
+	修改分组大小，filesize为负数时表示减少，结果小于0时置为0。传入的group也会同步修改
+*/
+func (ms *MemSource) UpdateGroupSize(group *p2p_storage.Group, filesize int64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	g, ok := ms.groups[group.ID]
+	if !ok {
+		return errors.New("group " + group.ID + " not found")
+	}
+	size := int64(g.Size) + filesize
+	if size < 0 {
+		size = 0
+	}
+	g.Size = uint64(size)
+	group.Size = g.Size
+	return
+}
+
+func (ms *MemSource) UpdateGroupFirstFinishVer(gid string, ver uint64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	g, ok := ms.groups[gid]
+	if !ok {
+		return errors.New("group " + gid + " not found")
+	}
+	g.FirstFinishVer = ver
+	return
+}
+
+func groupCapacity(g *p2p_storage.Group) uint64 {
+	return uint64(g.MinPieces) * p2p_storage.GROUP_NODE_CAPACITY
+}
+
+func (ms *MemSource) GetAvailableGroup(fileSize uint32) (group *p2p_storage.Group, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for _, g := range ms.groups {
+		if g.FileSize != fileSize || g.Size >= groupCapacity(g) {
+			continue
+		}
+		if group == nil || g.Size < group.Size || (g.Size == group.Size && g.ID < group.ID) {
+			c := *g
+			group = &c
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetActiveGroupsCount(groupCapacity uint64) (groups map[uint32]uint32, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	groups = make(map[uint32]uint32)
+	for _, g := range ms.groups {
+		if g.Size < groupCapacity {
+			groups[g.FileSize]++
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetActiveGroupsLeftSpace(groupCapacity uint64) (groups map[uint32]uint64, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	groups = make(map[uint32]uint64)
+	for _, g := range ms.groups {
+		if g.Size < groupCapacity {
+			groups[g.FileSize] += groupCapacity - g.Size
+		}
+	}
+	return
+}
+
+func (ms *MemSource) AddNodeToGroup(gid string, node *p2p_storage.GroupNode) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	nodes, ok := ms.groupNodes[gid]
+	if !ok {
+		return errors.New("group " + gid + " not found")
+	}
+	nodes[node.Node] = &groupNode{*node, now()}
+	return
+}
+
+func (ms *MemSource) UpdateGroupNode(gid string, node *p2p_storage.GroupNode, isVerChange bool) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	gn, ok := ms.groupNodes[gid][node.Node]
+	if !ok {
+		return
+	}
+	gn.GroupNode = *node
+	if isVerChange {
+		gn.UpdateTm = now()
+	}
+	return
+}
+
+func (ms *MemSource) DeleteGroupNode(gid, nid string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.groupNodes[gid], nid)
+	return
+}
+
+//按节点ID排序的分组节点
+func (ms *MemSource) sortedGroupNodes(gid string) (nodes []*groupNode) {
+	nodes = make([]*groupNode, 0, len(ms.groupNodes[gid]))
+	for _, n := range ms.groupNodes[gid] {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	return
+}
+
+func (ms *MemSource) GetFileNodes(gid string, ver uint64) (nodes []p2p_storage.Peer, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	nodes = make([]p2p_storage.Peer, 0)
+	for _, n := range ms.sortedGroupNodes(gid) {
+		if n.State != p2p_storage.ONLINE || n.Ver < ver {
+			continue
+		}
+		if detail, ok := ms.nodes[n.Node]; ok {
+			nodes = append(nodes, detail.Peer)
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetNoFileNodes(gid string, ver uint64) (nodes []string, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	nodes = make([]string, 0)
+	for _, n := range ms.sortedGroupNodes(gid) {
+		if n.Ver < ver {
+			nodes = append(nodes, n.Node)
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetAllFileNodes(gid string) (nodes []string, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	nodes = make([]string, 0)
+	for _, n := range ms.sortedGroupNodes(gid) {
+		nodes = append(nodes, n.Node)
+	}
+	return
+}
+
+func (ms *MemSource) GetGroupNodes(gid string) (nodes []p2p_storage.GroupNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	nodes = make([]p2p_storage.GroupNode, 0)
+	for _, n := range ms.sortedGroupNodes(gid) {
+		nodes = append(nodes, n.GroupNode)
+	}
+	return
+}
+
+func (ms *MemSource) GetRandomGroupNode(gid string) (node *p2p_storage.GroupNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	online := make([]*groupNode, 0)
+	for _, n := range ms.sortedGroupNodes(gid) {
+		if n.State == p2p_storage.ONLINE {
+			online = append(online, n)
+		}
+	}
+	if len(online) > 0 {
+		gn := online[rand.Intn(len(online))].GroupNode
+		node = &gn
+	}
+	return
+}
+
+func (ms *MemSource) GetGroupOnlineNodesCount(gid string) (num uint32, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for _, n := range ms.groupNodes[gid] {
+		if n.State == p2p_storage.ONLINE {
+			num++
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetGroupFileVer(gid, nid string) (ver uint64, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if n, ok := ms.groupNodes[gid][nid]; ok {
+		ver = n.Ver
+	}
+	return
+}
+
+func (ms *MemSource) GetFileNodesCountByVer(gid string, ver uint64) (cnt uint32, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for _, n := range ms.groupNodes[gid] {
+		if n.Ver >= ver {
+			cnt++
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetNodeCountByVerAndState(gid string, ver uint64, state int) (num uint32, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for _, n := range ms.groupNodes[gid] {
+		if n.Ver >= ver && n.State == state {
+			num++
+		}
+	}
+	return
+}
+
+func (ms *MemSource) CheckIsFinishFirstExpand(gid string, ver uint64) (finish bool, e error) {
+	num, e := ms.GetNodeCountByVerAndState(gid, ver, p2p_storage.ONLINE)
+	if e != nil {
+		return
+	}
+	return int(num) >= p2p_storage.FIRST_EXPAND_FINISH_NUM, nil
+}
+
+/*
+	计算分组首次扩散完成的文件版本：在线节点中同步版本号排在第
+	SafePieces+SafePieces/EXPAND_TASK_FINISH_COUNT_PART位的节点的版本号，节点不足时返回0
+*/
+func (ms *MemSource) GetGroupFirstFinishExpandVer(gid string) (finish_ver uint64, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	g, ok := ms.groups[gid]
+	if !ok {
+		return 0, errors.New("group " + gid + " not found")
+	}
+	need := int(g.SafePieces + g.SafePieces/p2p_storage.EXPAND_TASK_FINISH_COUNT_PART)
+	vers := make([]uint64, 0, len(ms.groupNodes[gid]))
+	for _, n := range ms.groupNodes[gid] {
+		if n.State == p2p_storage.ONLINE {
+			vers = append(vers, n.Ver)
+		}
+	}
+	if need <= 0 || len(vers) < need {
+		return
+	}
+	sort.Slice(vers, func(i, j int) bool { return vers[i] > vers[j] })
+	return vers[need-1], nil
+}
+
+func (ms *MemSource) GetGroupNodeCountByState(state int) (countMap map[string]int, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	countMap = make(map[string]int)
+	for gid, nodes := range ms.groupNodes {
+		for _, n := range nodes {
+			if n.State == state {
+				countMap[gid]++
+			}
+		}
+	}
+	return
+}
+
+/*
+	获取任务卡住的分组和节点：在线节点的版本号落后于分组版本号，并且超过TASK_PROCESS_SLOW_TM秒没有变化，
+	每个分组返回版本号最落后的节点
+*/
+func (ms *MemSource) GetGroupNodesTaskProcessSlow(nowTm int64) (groupNodesMap map[string]p2p_storage.GroupNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	groupNodesMap = make(map[string]p2p_storage.GroupNode)
+	for gid := range ms.groups {
+		ver := ms.incrIds[gid]
+		for _, n := range ms.sortedGroupNodes(gid) {
+			if n.State != p2p_storage.ONLINE || n.Ver >= ver || n.UpdateTm > nowTm-p2p_storage.TASK_PROCESS_SLOW_TM {
+				continue
+			}
+			if old, ok := groupNodesMap[gid]; !ok || n.Ver < old.Ver {
+				groupNodesMap[gid] = n.GroupNode
+			}
+		}
+	}
+	return
+}
+
+func (ms *MemSource) nodeGroupCount(nid string) (num uint32) {
+	for _, nodes := range ms.groupNodes {
+		if _, ok := nodes[nid]; ok {
+			num++
+		}
+	}
+	return
+}
+
+//节点所在的分组ID，按ID排序
+func (ms *MemSource) nodeGroupIds(nid string) (ids []string) {
+	ids = make([]string, 0)
+	for gid, nodes := range ms.groupNodes {
+		if _, ok := nodes[nid]; ok {
+			ids = append(ids, gid)
+		}
+	}
+	return sortStrings(ids)
+}
+
+func (ms *MemSource) GetNodeGroups(nid string) (groups []p2p_storage.Group, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	groups = make([]p2p_storage.Group, 0)
+	for _, gid := range ms.nodeGroupIds(nid) {
+		if g, ok := ms.groups[gid]; ok {
+			groups = append(groups, *g)
+		}
+	}
+	return
+}
+
+/*
+	随机获取节点所在的一个未满分组，没有时返回空的Group
+*/
+func (ms *MemSource) GetRandomNodeGroup(nid string) (group p2p_storage.Group, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	available := make([]p2p_storage.Group, 0)
+	for _, gid := range ms.nodeGroupIds(nid) {
+		if g, ok := ms.groups[gid]; ok && g.Size < groupCapacity(g) {
+			available = append(available, *g)
+		}
+	}
+	if len(available) > 0 {
+		group = available[rand.Intn(len(available))]
+	}
+	return
+}
+
+func (ms *MemSource) GetNodeGroupCount(nid string) (num uint32, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.nodeGroupCount(nid), nil
+}
+
+func (ms *MemSource) GetNodeGroupDetail(nid string) (groups []p2p_storage.NodeGroupDetail, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	groups = make([]p2p_storage.NodeGroupDetail, 0)
+	for _, gid := range ms.nodeGroupIds(nid) {
+		g, ok := ms.groups[gid]
+		if !ok {
+			continue
+		}
+		n := ms.groupNodes[gid][nid]
+		groups = append(groups, p2p_storage.NodeGroupDetail{
+			Group:   *g,
+			FileVer: ms.incrIds[gid],
+			NodeVer: n.Ver,
+			State:   n.State,
+			MaxVer:  n.MaxVer,
+			AddVer:  ms.incrIds[addVerKey(gid)],
+		})
+	}
+	return
+}
+
+func (ms *MemSource) GetNodeGroupState(nid string) (groups map[string]p2p_storage.GroupNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	groups = make(map[string]p2p_storage.GroupNode)
+	for gid, nodes := range ms.groupNodes {
+		if n, ok := nodes[nid]; ok {
+			groups[gid] = n.GroupNode
+		}
+	}
+	return
+}
+
+//与p2p_storage中新增文件版本的自增key保持一致
+func addVerKey(gid string) string {
+	return "add_" + gid
+}
@@ -0,0 +1,114 @@
+package mem_source
+
+import (
+	"fmt"
+	"sort"
+	"yh_pkg/p2p_storage"
+)
+
+var _ p2p_storage.IIngestStore = (*MemSource)(nil)
+
+func (ms *MemSource) AddIngest(p *p2p_storage.PendingIngest) (ticket uint64, e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.ingestId++
+	c := *p
+	c.Objects = append([]p2p_storage.IngestObject(nil), p.Objects...)
+	c.Ticket = ms.ingestId
+	ms.ingests[c.Ticket] = &c
+	return c.Ticket, nil
+}
+
+//按原排队号写入，用于恢复备份和双写的从库，之后分配的排队号大于它
+func (ms *MemSource) RestoreIngest(p *p2p_storage.PendingIngest) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if p.Ticket == 0 {
+		return fmt.Errorf("restore ingest of %s without ticket", p.MD5)
+	}
+	if _, exist := ms.ingests[p.Ticket]; exist {
+		return fmt.Errorf("ingest ticket %d already exists", p.Ticket)
+	}
+	c := *p
+	c.Objects = append([]p2p_storage.IngestObject(nil), p.Objects...)
+	ms.ingests[c.Ticket] = &c
+	if c.Ticket > ms.ingestId {
+		ms.ingestId = c.Ticket
+	}
+	return
+}
+
+func (ms *MemSource) GetIngest(ticket uint64) (p *p2p_storage.PendingIngest, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if v, ok := ms.ingests[ticket]; ok {
+		c := *v
+		p = &c
+	}
+	return
+}
+
+func (ms *MemSource) GetPendingIngest(md5 string) (p *p2p_storage.PendingIngest, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for _, v := range ms.ingests {
+		if v.MD5 == md5 && v.State == p2p_storage.INGEST_PENDING {
+			c := *v
+			return &c, nil
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetPendingIngests(after uint64, num int) (ps []p2p_storage.PendingIngest, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	ps = make([]p2p_storage.PendingIngest, 0)
+	for _, v := range ms.ingests {
+		if v.Ticket > after && v.State == p2p_storage.INGEST_PENDING {
+			ps = append(ps, *v)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Ticket < ps[j].Ticket })
+	if len(ps) > num {
+		ps = ps[:num]
+	}
+	return
+}
+
+func (ms *MemSource) UpdateIngest(p *p2p_storage.PendingIngest) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.ingests[p.Ticket]; ok {
+		c := *p
+		c.Objects = append([]p2p_storage.IngestObject(nil), p.Objects...)
+		ms.ingests[p.Ticket] = &c
+	}
+	return
+}
+
+func (ms *MemSource) DeleteIngests(before int64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for ticket, v := range ms.ingests {
+		if v.State != p2p_storage.INGEST_PENDING && v.UpdateTm < before {
+			delete(ms.ingests, ticket)
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetIngestStats() (stats p2p_storage.IngestStats, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for _, v := range ms.ingests {
+		if v.State != p2p_storage.INGEST_PENDING {
+			continue
+		}
+		stats.Pending++
+		if stats.OldestTm == 0 || v.AddTm < stats.OldestTm {
+			stats.OldestTm = v.AddTm
+		}
+	}
+	return
+}
@@ -0,0 +1,313 @@
+/*
+基于内存的IDataSource实现。
+
+所有数据保存在进程内存中，重启即丢失，主要用于单元测试、集成测试以及一致性测试套件，
+语义以idata_source.go中的注释为准，与redis、mysql实现保持一致。
+
+示例：
+	ds := mem_source.New()
+	p2p_storage.Init(ds, logger, false)
+*/
+package mem_source
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+type MemSource struct {
+	lock sync.RWMutex
+
+	//自增ID
+	incrIds map[string]uint64
+
+	nodes       map[string]*p2p_storage.NodeDetail
+	groups      map[string]*p2p_storage.Group
+	groupNodes  map[string]map[string]*groupNode             //gid -> nid -> 节点
+	groupFiles  map[string]map[string]*p2p_storage.GroupFile //gid -> md5 -> 文件
+	sourceFiles map[string]map[string]bool                   //nid -> md5，节点自身拥有的原始文件
+	onlineHours map[string]map[int64]bool                    //nid -> 在线的小时
+	checksums   map[string]string
+	invalids    []InvalidFile
+	nodeKeys    map[string][]byte           //nid -> 公钥
+	nonces      map[string]map[string]int64 //nid -> nonce -> 过期时间
+	fileKeys    map[string]*p2p_storage.FileKey
+	buckets     map[bucketKey]map[string]*p2p_storage.Object //存储桶 -> 对象名 -> 对象
+	fileRefs    map[string]int64                             //md5 -> 引用计数
+	usages      map[string]*p2p_storage.Usage                //租户 -> 用量和配额
+	policies    map[string]*p2p_storage.FilePolicy           //md5 -> 文件的生命周期
+	bucketPols  map[bucketKey]*p2p_storage.Policy            //存储桶 -> 策略
+
+	expandNodes map[uint64]*p2p_storage.ExpandNode
+	taskNodes   map[uint64][]p2p_storage.TaskNode
+	unsafeFiles map[string]map[string]int64 //gid -> md5 -> 添加时间
+	unsafeNodes map[uint64]*p2p_storage.UnSafeExpandNode
+	expandId    uint64
+	unsafeId    uint64
+
+	expandHistory  map[uint64][]p2p_storage.ExpandTransition    //任务ID -> 状态转换历史
+	expandAttempts map[groupFileKey]*p2p_storage.ExpandAttempt //分组中文件的重试记录
+
+	fileIDs  map[string]*p2p_storage.FileIDBinding //sha256文件ID -> 对应关系
+	md5ToIDs map[string]string                     //md5 -> sha256文件ID
+
+	nats map[string]*p2p_storage.NodeNAT //节点NAT检测结果
+
+	ingests  map[uint64]*p2p_storage.PendingIngest //排队号 -> 延迟添加的文件
+	ingestId uint64
+
+	config    map[interface{}]interface{}
+	checkerTm map[string]checkerTm
+
+	timeoutNodeCheckedTm int64
+	timeoutTaskCheckedTm int64
+	timeoutTaskCheckedId int64
+
+	//分布式锁，key-db和key的组合，value-过期时间
+	locks    map[string]time.Time
+	lockCond *sync.Cond
+}
+
+//分组中的节点，比GroupNode多记录版本变化的时间
+type groupNode struct {
+	p2p_storage.GroupNode
+	UpdateTm int64 //版本号上次改变的时间（秒）
+}
+
+//无效文件记录
+type InvalidFile struct {
+	Node  string `json:"node"`
+	Group string `json:"group"`
+	MD5   string `json:"md5"`
+	Tm    int64  `json:"tm"`
+}
+
+type checkerTm struct {
+	tm     int64
+	expire time.Time
+}
+
+//分页获取节点时每页的数量
+const ALL_NODE_PAGE_SIZE int = 1000
+
+func New() *MemSource {
+	ms := &MemSource{
+		incrIds:     make(map[string]uint64),
+		nodes:       make(map[string]*p2p_storage.NodeDetail),
+		groups:      make(map[string]*p2p_storage.Group),
+		groupNodes:  make(map[string]map[string]*groupNode),
+		groupFiles:  make(map[string]map[string]*p2p_storage.GroupFile),
+		sourceFiles: make(map[string]map[string]bool),
+		onlineHours: make(map[string]map[int64]bool),
+		checksums:   make(map[string]string),
+		invalids:    make([]InvalidFile, 0),
+		nodeKeys:    make(map[string][]byte),
+		nonces:      make(map[string]map[string]int64),
+		fileKeys:    make(map[string]*p2p_storage.FileKey),
+		buckets:     make(map[bucketKey]map[string]*p2p_storage.Object),
+		fileRefs:    make(map[string]int64),
+		usages:      make(map[string]*p2p_storage.Usage),
+		policies:    make(map[string]*p2p_storage.FilePolicy),
+		bucketPols:  make(map[bucketKey]*p2p_storage.Policy),
+		expandNodes: make(map[uint64]*p2p_storage.ExpandNode),
+		taskNodes:   make(map[uint64][]p2p_storage.TaskNode),
+		unsafeFiles: make(map[string]map[string]int64),
+		unsafeNodes: make(map[uint64]*p2p_storage.UnSafeExpandNode),
+		config:      make(map[interface{}]interface{}),
+		checkerTm:   make(map[string]checkerTm),
+		locks:       make(map[string]time.Time),
+
+		expandHistory:  make(map[uint64][]p2p_storage.ExpandTransition),
+		expandAttempts: make(map[groupFileKey]*p2p_storage.ExpandAttempt),
+
+		fileIDs:  make(map[string]*p2p_storage.FileIDBinding),
+		md5ToIDs: make(map[string]string),
+
+		nats: make(map[string]*p2p_storage.NodeNAT),
+
+		ingests: make(map[uint64]*p2p_storage.PendingIngest),
+	}
+	ms.lockCond = sync.NewCond(&sync.Mutex{})
+	return ms
+}
+
+//节点的时间戳有秒和纳秒两种，统一转换为秒进行比较
+func toSecond(tm int64) int64 {
+	if tm > 1e12 || tm < -1e12 {
+		return tm / int64(time.Second)
+	}
+	return tm
+}
+
+func now() int64 {
+	return time.Now().Unix()
+}
+
+func (ms *MemSource) AtomicIncrID(key string) (uint64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.incrIds[key]++
+	return ms.incrIds[key], nil
+}
+
+func (ms *MemSource) GetIncrID(key string) (uint64, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.incrIds[key], nil
+}
+
+/*
+	直接设置自增ID的值，不属于IDataSource接口，用于数据恢复和测试
+*/
+func (ms *MemSource) SetIncrID(key string, id uint64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.incrIds[key] = id
+	return
+}
+
+func (ms *MemSource) GetTimeoutNodeCheckedTime() (tm int64, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.timeoutNodeCheckedTm, nil
+}
+
+func (ms *MemSource) UpdateTimeoutNodeCheckedTime(tm int64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.timeoutNodeCheckedTm = tm
+	return
+}
+
+func (ms *MemSource) GetTimeoutExpandTaskCheckedTime() (tm, id int64, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.timeoutTaskCheckedTm, ms.timeoutTaskCheckedId, nil
+}
+
+func (ms *MemSource) UpdateTimeoutExpandTaskCheckedTime(tm, id int64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.timeoutTaskCheckedTm, ms.timeoutTaskCheckedId = tm, id
+	return
+}
+
+func (ms *MemSource) GetAtomicLastCheckerTm(key string) (tm int64, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if c, ok := ms.checkerTm[key]; ok && time.Now().Before(c.expire) {
+		tm = c.tm
+	}
+	return
+}
+
+func (ms *MemSource) SetAtomicGetLastCheckerTm(key string, tm int64, expire_second int) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.checkerTm[key] = checkerTm{tm, time.Now().Add(time.Duration(expire_second) * time.Second)}
+	return
+}
+
+/*
+	设置配置项，不属于IDataSource接口，相当于修改config表
+*/
+func (ms *MemSource) SetConfig(key string, value interface{}) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.config[key] = value
+	return
+}
+
+func (ms *MemSource) GetMapFromConfig(configMap map[interface{}]interface{}) (e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for k, v := range ms.config {
+		configMap[k] = v
+	}
+	return
+}
+
+func (ms *MemSource) UpdateChecksum(md5, checksum string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.checksums[md5] = checksum
+	return
+}
+
+func (ms *MemSource) GetChecksum(md5 string) (checksum string, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.checksums[md5], nil
+}
+
+func (ms *MemSource) AddToInvalidFile(nid, gid, md5 string, tm int64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.invalids = append(ms.invalids, InvalidFile{nid, gid, md5, tm})
+	return
+}
+
+/*
+	获取问题文件列表，不属于IDataSource接口
+*/
+func (ms *MemSource) GetInvalidFiles() (files []InvalidFile) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	files = make([]InvalidFile, len(ms.invalids))
+	copy(files, ms.invalids)
+	return
+}
+
+func lockKey(db int, key string) string {
+	return strconv.Itoa(db) + ":" + key
+}
+
+/*
+	分布式锁的内存实现，在timeout秒内获取不到锁则返回false，锁在expireSec秒后自动失效
+*/
+func (ms *MemSource) GetLock(db int, key string, expireSec int64, timeout int64) (getLock bool) {
+	k := lockKey(db, key)
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	ms.lockCond.L.Lock()
+	defer ms.lockCond.L.Unlock()
+	for {
+		n := time.Now()
+		if expire, ok := ms.locks[k]; !ok || !n.Before(expire) {
+			ms.locks[k] = n.Add(time.Duration(expireSec) * time.Second)
+			return true
+		}
+		if !n.Before(deadline) {
+			return false
+		}
+		//等待释放或超时，超时后重新检查
+		wait := ms.locks[k].Sub(n)
+		if d := deadline.Sub(n); d < wait {
+			wait = d
+		}
+		timer := time.AfterFunc(wait, func() {
+			ms.lockCond.L.Lock()
+			ms.lockCond.Broadcast()
+			ms.lockCond.L.Unlock()
+		})
+		ms.lockCond.Wait()
+		timer.Stop()
+	}
+}
+
+func (ms *MemSource) UnLock(db int, key string) (e error) {
+	ms.lockCond.L.Lock()
+	delete(ms.locks, lockKey(db, key))
+	ms.lockCond.L.Unlock()
+	ms.lockCond.Broadcast()
+	return
+}
+
+func sortStrings(ids []string) []string {
+	sort.Strings(ids)
+	return ids
+}
+
+var _ p2p_storage.IDataSource = New()
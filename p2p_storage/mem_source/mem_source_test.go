@@ -0,0 +1,13 @@
+package mem_source
+
+import (
+	"testing"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.RunSuite(t, func() p2p_storage.IDataSource {
+		return New()
+	})
+}
@@ -0,0 +1,188 @@
+package mem_source
+
+import (
+	"sort"
+	"yh_pkg/p2p_storage"
+)
+
+var _ p2p_storage.INamespaceStore = (*MemSource)(nil)
+
+type bucketKey struct {
+	tenant string
+	bucket string
+}
+
+func (ms *MemSource) CreateBucket(tenant, bucket string) (ok bool, e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	k := bucketKey{tenant, bucket}
+	if _, exist := ms.buckets[k]; exist {
+		return false, nil
+	}
+	ms.buckets[k] = make(map[string]*p2p_storage.Object)
+	return true, nil
+}
+
+func (ms *MemSource) DeleteBucket(tenant, bucket string) (ok bool, e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	k := bucketKey{tenant, bucket}
+	if objs, exist := ms.buckets[k]; !exist || len(objs) > 0 {
+		return false, nil
+	}
+	delete(ms.buckets, k)
+	return true, nil
+}
+
+func (ms *MemSource) IsBucketExist(tenant, bucket string) (exist bool, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	_, exist = ms.buckets[bucketKey{tenant, bucket}]
+	return
+}
+
+func (ms *MemSource) GetBuckets(tenant string) (buckets []string, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	buckets = make([]string, 0)
+	for k := range ms.buckets {
+		if k.tenant == tenant {
+			buckets = append(buckets, k.bucket)
+		}
+	}
+	return sortStrings(buckets), nil
+}
+
+func (ms *MemSource) GetObject(tenant, bucket, key string) (obj *p2p_storage.Object, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if o, ok := ms.buckets[bucketKey{tenant, bucket}][key]; ok {
+		v := *o
+		obj = &v
+	}
+	return
+}
+
+func (ms *MemSource) PutObject(obj *p2p_storage.Object) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	k := bucketKey{obj.Tenant, obj.Bucket}
+	if ms.buckets[k] == nil {
+		ms.buckets[k] = make(map[string]*p2p_storage.Object)
+	}
+	v := *obj
+	ms.buckets[k][obj.Key] = &v
+	return
+}
+
+func (ms *MemSource) DeleteObject(tenant, bucket, key string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.buckets[bucketKey{tenant, bucket}], key)
+	return
+}
+
+func (ms *MemSource) GetObjects(tenant, bucket, from string, num int) (objs []p2p_storage.Object, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	objs = make([]p2p_storage.Object, 0)
+	for key, o := range ms.buckets[bucketKey{tenant, bucket}] {
+		if key > from {
+			objs = append(objs, *o)
+		}
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key < objs[j].Key })
+	if len(objs) > num {
+		objs = objs[:num]
+	}
+	return
+}
+
+func (ms *MemSource) GetExpiredObjects(before int64, num int) (objs []p2p_storage.Object, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	objs = make([]p2p_storage.Object, 0)
+	for _, bucket := range ms.buckets {
+		for _, o := range bucket {
+			if o.ExpireTm != 0 && o.ExpireTm <= before {
+				objs = append(objs, *o)
+			}
+		}
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].ExpireTm < objs[j].ExpireTm })
+	if len(objs) > num {
+		objs = objs[:num]
+	}
+	return
+}
+
+func (ms *MemSource) IncrFileRef(md5 string, delta int64) (refs int64, e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	refs = ms.fileRefs[md5] + delta
+	if refs <= 0 {
+		refs = 0
+		delete(ms.fileRefs, md5)
+	} else {
+		ms.fileRefs[md5] = refs
+	}
+	return
+}
+
+func (ms *MemSource) GetFileRef(md5 string) (refs int64, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.fileRefs[md5], nil
+}
+
+func (ms *MemSource) usage(tenant string) *p2p_storage.Usage {
+	u, ok := ms.usages[tenant]
+	if !ok {
+		u = &p2p_storage.Usage{Tenant: tenant}
+		ms.usages[tenant] = u
+	}
+	return u
+}
+
+//用量不会小于0
+func addUint(v uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > v {
+		return 0
+	}
+	return uint64(int64(v) + delta)
+}
+
+func (ms *MemSource) IncrUsage(tenant string, bytes, files int64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	u := ms.usage(tenant)
+	u.Bytes = addUint(u.Bytes, bytes)
+	u.Files = addUint(u.Files, files)
+	return
+}
+
+func (ms *MemSource) GetUsage(tenant string) (usage p2p_storage.Usage, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if u, ok := ms.usages[tenant]; ok {
+		return *u, nil
+	}
+	return p2p_storage.Usage{Tenant: tenant}, nil
+}
+
+func (ms *MemSource) SetQuota(tenant string, quota p2p_storage.Quota) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.usage(tenant).Quota = quota
+	return
+}
+
+func (ms *MemSource) GetTenants() (tenants []string, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	tenants = make([]string, 0, len(ms.usages))
+	for tenant := range ms.usages {
+		tenants = append(tenants, tenant)
+	}
+	return sortStrings(tenants), nil
+}
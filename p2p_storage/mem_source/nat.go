@@ -0,0 +1,28 @@
+package mem_source
+
+import (
+	"yh_pkg/p2p_storage"
+)
+
+var _ p2p_storage.INATStore = (*MemSource)(nil)
+
+func (ms *MemSource) GetNodeNATs(ids []string) (nats map[string]*p2p_storage.NodeNAT, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	nats = make(map[string]*p2p_storage.NodeNAT, len(ids))
+	for _, id := range ids {
+		if n, ok := ms.nats[id]; ok {
+			c := *n
+			nats[id] = &c
+		}
+	}
+	return
+}
+
+func (ms *MemSource) SetNodeNAT(n *p2p_storage.NodeNAT) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	c := *n
+	ms.nats[n.Node] = &c
+	return
+}
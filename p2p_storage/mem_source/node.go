@@ -0,0 +1,352 @@
+package mem_source
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+//节点在线统计的天数，与p2p_storage估计节点可用率的窗口一致
+const ONLINE_STAT_DAYS int64 = p2p_storage.NODE_ONLINE_STAT_HOURS / 24
+
+//节点的时间戳统一转换为纳秒进行比较
+func toNano(tm int64) int64 {
+	if tm > 1e12 || tm < -1e12 {
+		return tm
+	}
+	return tm * int64(time.Second)
+}
+
+func (ms *MemSource) AddNode(node *p2p_storage.NodeDetail) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	n := *node
+	ms.nodes[node.ID] = &n
+	return
+}
+
+func (ms *MemSource) DeleteNode(id string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.nodes, id)
+	delete(ms.sourceFiles, id)
+	delete(ms.onlineHours, id)
+	return
+}
+
+func (ms *MemSource) IsNodeExist(nid string) (exist bool, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	_, exist = ms.nodes[nid]
+	return
+}
+
+func (ms *MemSource) UpdateNode(node *p2p_storage.NodeDetail) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	n := *node
+	ms.nodes[node.ID] = &n
+	//记录节点在线的小时数，用于统计在线时长
+	if node.UpdateTm > 0 {
+		hours, ok := ms.onlineHours[node.ID]
+		if !ok {
+			hours = make(map[int64]bool)
+			ms.onlineHours[node.ID] = hours
+		}
+		hours[toSecond(node.UpdateTm)/3600] = true
+	}
+	return
+}
+
+func (ms *MemSource) UpdateNodeWeight(nid string, weight float64) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if n, ok := ms.nodes[nid]; ok {
+		n.Weight = weight
+	}
+	return
+}
+
+func (ms *MemSource) IncrementActiveGroups(nid string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if n, ok := ms.nodes[nid]; ok {
+		n.ActiveGroups++
+	}
+	return
+}
+
+func (ms *MemSource) GetNodeDetail(nid string) (detail *p2p_storage.NodeDetail, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if n, ok := ms.nodes[nid]; ok {
+		d := *n
+		detail = &d
+	}
+	return
+}
+
+func (ms *MemSource) GetNodesByIds(ids []string) (nodes []p2p_storage.NodeDetail, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	nodes = make([]p2p_storage.NodeDetail, 0, len(ids))
+	for _, id := range ids {
+		if n, ok := ms.nodes[id]; ok {
+			nodes = append(nodes, *n)
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetAllNode(begin string) (nodes []string, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	ids := make([]string, 0, len(ms.nodes))
+	for id := range ms.nodes {
+		if id > begin {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) > ALL_NODE_PAGE_SIZE {
+		ids = ids[:ALL_NODE_PAGE_SIZE]
+	}
+	return ids, nil
+}
+
+func (ms *MemSource) GetTimeoutNodes(from int64, to int64, num int) (nodes []p2p_storage.NodeDetail, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	from, to = toNano(from), toNano(to)
+	nodes = make([]p2p_storage.NodeDetail, 0)
+	for _, n := range ms.nodes {
+		if tm := toNano(n.UpdateTm); tm > from && tm <= to {
+			nodes = append(nodes, *n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].UpdateTm == nodes[j].UpdateTm {
+			return nodes[i].ID < nodes[j].ID
+		}
+		return toNano(nodes[i].UpdateTm) < toNano(nodes[j].UpdateTm)
+	})
+	if len(nodes) > num {
+		nodes = nodes[:num]
+	}
+	return
+}
+
+func (ms *MemSource) GetCanDelTimeoutNodes(tm uint64, num int) (nodes []string, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	nodes = make([]string, 0)
+	for id, n := range ms.nodes {
+		if toNano(n.UpdateTm) < toNano(int64(tm)) {
+			nodes = append(nodes, id)
+		}
+	}
+	sortStrings(nodes)
+	if len(nodes) > num {
+		nodes = nodes[:num]
+	}
+	return
+}
+
+func (ms *MemSource) GetOnlinePeers(ids []string, timeout int64) (peers []p2p_storage.Peer, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	peers = make([]p2p_storage.Peer, 0, len(ids))
+	for _, id := range ids {
+		if n, ok := ms.nodes[id]; ok && isOnline(n, timeout) {
+			peers = append(peers, n.Peer)
+		}
+	}
+	return
+}
+
+func isOnline(n *p2p_storage.NodeDetail, updateTm int64) bool {
+	return n.UpdateTm > 0 && toSecond(n.UpdateTm) >= toSecond(updateTm)
+}
+
+func (ms *MemSource) GetUPNPAvailableNodes(num int, updateTm int64) (nodes []p2p_storage.Peer, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	details := make([]*p2p_storage.NodeDetail, 0)
+	for _, n := range ms.nodes {
+		if n.UPNPAvailable == int8(p2p_storage.YES) && isOnline(n, updateTm) {
+			details = append(details, n)
+		}
+	}
+	sort.Slice(details, func(i, j int) bool {
+		return toNano(details[i].UpdateTm) < toNano(details[j].UpdateTm)
+	})
+	nodes = make([]p2p_storage.Peer, 0, num)
+	for i := 0; i < len(details) && i < num; i++ {
+		nodes = append(nodes, details[i].Peer)
+	}
+	return
+}
+
+//节点是否可以加入新的分组
+func isAvailable(n *p2p_storage.NodeDetail, groupCapacity uint64, updateTm, regTm int64, online_cnt int) bool {
+	return n.LeftP2pSpace >= int64(groupCapacity) && isOnline(n, updateTm) && toSecond(n.RegTm) <= toSecond(regTm) && n.OnlineCount >= online_cnt
+}
+
+//按权重从大到小排序
+func sortByWeight(nodes []*p2p_storage.NodeDetail) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Weight == nodes[j].Weight {
+			return nodes[i].ID < nodes[j].ID
+		}
+		return nodes[i].Weight > nodes[j].Weight
+	})
+}
+
+func (ms *MemSource) availableNodes(groupCapacity uint64, updateTm, regTm int64, active_groups int8, online_cnt int) (nodes []*p2p_storage.NodeDetail) {
+	nodes = make([]*p2p_storage.NodeDetail, 0)
+	for _, n := range ms.nodes {
+		if isAvailable(n, groupCapacity, updateTm, regTm, online_cnt) && n.ActiveGroups < int(active_groups) {
+			nodes = append(nodes, n)
+		}
+	}
+	sortByWeight(nodes)
+	return
+}
+
+func (ms *MemSource) GetAvailableNodes(groupCapacity uint64, updateTm, regTm int64, offset, num uint32, active_groups int8, online_cnt int) (nodes []string, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	all := ms.availableNodes(groupCapacity, updateTm, regTm, active_groups, online_cnt)
+	nodes = make([]string, 0, num)
+	for i := int(offset); i < len(all) && len(nodes) < int(num); i++ {
+		nodes = append(nodes, all[i].ID)
+	}
+	return
+}
+
+func (ms *MemSource) GetAvailableNodesCount(groupCapacity uint64, updateTm, regTm int64, activ_groups int8, online_cnt int) (num uint32, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return uint32(len(ms.availableNodes(groupCapacity, updateTm, regTm, activ_groups, online_cnt))), nil
+}
+
+func (ms *MemSource) GetAvailableNode(groupCapacity uint64, updateTm, regTm int64, online_cnt, num int) (nodes []string, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	all := make([]*p2p_storage.NodeDetail, 0)
+	for _, n := range ms.nodes {
+		if isAvailable(n, groupCapacity, updateTm, regTm, online_cnt) {
+			all = append(all, n)
+		}
+	}
+	sortByWeight(all)
+	nodes = make([]string, 0, num)
+	for i := 0; i < len(all) && i < num; i++ {
+		nodes = append(nodes, all[i].ID)
+	}
+	return
+}
+
+func (ms *MemSource) GetNodesAGZero(groupCapacity uint64, updateTm, regTm int64, active_groups int8, online_cnt int) (nodes map[string]bool, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	nodes = make(map[string]bool)
+	for id, n := range ms.nodes {
+		if isAvailable(n, groupCapacity, updateTm, regTm, online_cnt) && n.ActiveGroups <= 0 {
+			nodes[id] = true
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetNewNodes(groupCapacity uint64, updateTm, regTm int64, online_cnt int) (nodes map[string]bool, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	nodes = make(map[string]bool)
+	for id, n := range ms.nodes {
+		if isAvailable(n, groupCapacity, updateTm, regTm, online_cnt) && ms.nodeGroupCount(id) == 0 {
+			nodes[id] = true
+		}
+	}
+	return
+}
+
+/*
+	统计最近ONLINE_STAT_DAYS天内节点在线的小时数
+*/
+func (ms *MemSource) GetNodeOnlineTm(nids []string) (node_online_map map[string]int, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	node_online_map = make(map[string]int, len(nids))
+	from := now()/3600 - ONLINE_STAT_DAYS*24
+	for _, id := range nids {
+		cnt := 0
+		for h := range ms.onlineHours[id] {
+			if h > from {
+				cnt++
+			}
+		}
+		node_online_map[id] = cnt
+	}
+	return
+}
+
+func (ms *MemSource) UpdateNodeOnlineCnt(nodeMap map[string]int) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for id, cnt := range nodeMap {
+		if n, ok := ms.nodes[id]; ok {
+			n.OnlineCount = cnt
+		}
+	}
+	return
+}
+
+/*
+	记录节点拥有某个原始文件，不属于IDataSource接口，相当于用户文件表
+*/
+func (ms *MemSource) AddSourceFile(nid, md5 string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	files, ok := ms.sourceFiles[nid]
+	if !ok {
+		files = make(map[string]bool)
+		ms.sourceFiles[nid] = files
+	}
+	files[md5] = true
+	return
+}
+
+func (ms *MemSource) GetSourceFileNodes(md5 string, num int) (ids []string, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	ids = make([]string, 0)
+	for nid, files := range ms.sourceFiles {
+		if files[md5] {
+			ids = append(ids, nid)
+		}
+	}
+	rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	if len(ids) > num {
+		ids = ids[:num]
+	}
+	return
+}
+
+func (ms *MemSource) IsNodeHasFile(nid string, md5 string) (yes bool, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.sourceFiles[nid][md5], nil
+}
+
+func (ms *MemSource) GetSourceFileCount(md5 string) (count int, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for _, files := range ms.sourceFiles {
+		if files[md5] {
+			count++
+		}
+	}
+	return
+}
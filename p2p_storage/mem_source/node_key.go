@@ -0,0 +1,56 @@
+package mem_source
+
+import (
+	"yh_pkg/p2p_storage"
+)
+
+var _ p2p_storage.INodeKeyStore = (*MemSource)(nil)
+
+func (ms *MemSource) GetNodeKey(nid string) (key []byte, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if k, ok := ms.nodeKeys[nid]; ok {
+		key = append([]byte(nil), k...)
+	}
+	return
+}
+
+func (ms *MemSource) AddNodeKey(nid string, key []byte) (ok bool, e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, exist := ms.nodeKeys[nid]; exist {
+		return false, nil
+	}
+	ms.nodeKeys[nid] = append([]byte(nil), key...)
+	return true, nil
+}
+
+func (ms *MemSource) DeleteNodeKey(nid string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.nodeKeys, nid)
+	delete(ms.nonces, nid)
+	return
+}
+
+func (ms *MemSource) UseNonce(nid string, nonce string, expire int64) (ok bool, e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	cur := now()
+	nonces := ms.nonces[nid]
+	if nonces == nil {
+		nonces = make(map[string]int64)
+		ms.nonces[nid] = nonces
+	}
+	if tm, exist := nonces[nonce]; exist && tm >= cur {
+		return false, nil
+	}
+	//顺便清理过期的nonce
+	for k, tm := range nonces {
+		if tm < cur {
+			delete(nonces, k)
+		}
+	}
+	nonces[nonce] = expire
+	return true, nil
+}
@@ -0,0 +1,85 @@
+package mem_source
+
+import (
+	"sort"
+	"yh_pkg/p2p_storage"
+)
+
+var _ p2p_storage.IPolicyStore = (*MemSource)(nil)
+
+func (ms *MemSource) GetFilePolicy(md5 string) (p *p2p_storage.FilePolicy, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if v, ok := ms.policies[md5]; ok {
+		c := *v
+		p = &c
+	}
+	return
+}
+
+func (ms *MemSource) SetFilePolicy(p *p2p_storage.FilePolicy) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	c := *p
+	ms.policies[p.MD5] = &c
+	return
+}
+
+func (ms *MemSource) DeleteFilePolicy(md5 string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.policies, md5)
+	return
+}
+
+func (ms *MemSource) GetExpiredFiles(before int64, num int) (policies []p2p_storage.FilePolicy, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	policies = make([]p2p_storage.FilePolicy, 0)
+	for _, p := range ms.policies {
+		if p.ExpireTm != 0 && p.ExpireTm <= before {
+			policies = append(policies, *p)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].ExpireTm < policies[j].ExpireTm })
+	if len(policies) > num {
+		policies = policies[:num]
+	}
+	return
+}
+
+func (ms *MemSource) GetBucketPolicy(tenant, bucket string) (p *p2p_storage.Policy, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if v, ok := ms.bucketPols[bucketKey{tenant, bucket}]; ok {
+		c := *v
+		p = &c
+	}
+	return
+}
+
+func (ms *MemSource) SetBucketPolicy(tenant, bucket string, p *p2p_storage.Policy) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	c := *p
+	ms.bucketPols[bucketKey{tenant, bucket}] = &c
+	return
+}
+
+var _ p2p_storage.IPriorityIndex = (*MemSource)(nil)
+
+func (ms *MemSource) GetFilesByPriority(priority int, after string, num int) (policies []p2p_storage.FilePolicy, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	policies = make([]p2p_storage.FilePolicy, 0)
+	for _, p := range ms.policies {
+		if p.Priority == priority && p.MD5 > after {
+			policies = append(policies, *p)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].MD5 < policies[j].MD5 })
+	if len(policies) > num {
+		policies = policies[:num]
+	}
+	return
+}
@@ -0,0 +1,154 @@
+package mem_source
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"yh_pkg/p2p_storage"
+)
+
+func (ms *MemSource) sortedUnSafeNodes(filter func(n *p2p_storage.UnSafeExpandNode) bool) (exNodes []p2p_storage.UnSafeExpandNode) {
+	exNodes = make([]p2p_storage.UnSafeExpandNode, 0)
+	for _, n := range ms.unsafeNodes {
+		if filter(n) {
+			exNodes = append(exNodes, *n)
+		}
+	}
+	sort.Slice(exNodes, func(i, j int) bool { return exNodes[i].ID < exNodes[j].ID })
+	return
+}
+
+func (ms *MemSource) GetUnSafeExpandTasks(nid string, state int8, num int) (exNodes []p2p_storage.UnSafeExpandNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	exNodes = ms.sortedUnSafeNodes(func(n *p2p_storage.UnSafeExpandNode) bool {
+		return n.Node == nid && n.State == state
+	})
+	if len(exNodes) > num {
+		exNodes = exNodes[:num]
+	}
+	return
+}
+
+func (ms *MemSource) UpdateUnSafeExpandNodeState(id uint64, state int) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if n, ok := ms.unsafeNodes[id]; ok {
+		n.State = int8(state)
+	}
+	return
+}
+
+func (ms *MemSource) GetUnSafeExpandNodeById(id uint64) (exNode *p2p_storage.UnSafeExpandNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if n, ok := ms.unsafeNodes[id]; ok {
+		c := *n
+		exNode = &c
+	}
+	return
+}
+
+func (ms *MemSource) AddOrUpdateUnSafeFile(gid, md5 string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	files, ok := ms.unsafeFiles[gid]
+	if !ok {
+		files = make(map[string]int64)
+		ms.unsafeFiles[gid] = files
+	}
+	files[md5] = now()
+	return
+}
+
+/*
+	按(gid, node, md5)添加或更新危险任务，更新时保留原任务的ID
+*/
+func (ms *MemSource) AddOrUpdateUnSafeExpandNodes(exNodes []p2p_storage.UnSafeExpandNode) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, exNode := range exNodes {
+		n := exNode
+		n.ID = 0
+		for id, old := range ms.unsafeNodes {
+			if old.Group == n.Group && old.Node == n.Node && old.MD5 == n.MD5 {
+				n.ID = id
+				break
+			}
+		}
+		if n.ID == 0 {
+			ms.unsafeId++
+			n.ID = ms.unsafeId
+		}
+		ms.unsafeNodes[n.ID] = &n
+	}
+	return
+}
+
+/*
+	按原ID写入危险任务，不属于IDataSource接口，用于数据恢复。ID已存在时覆盖，之后新分配的ID大于它
+*/
+func (ms *MemSource) RestoreUnSafeExpandNode(exNode *p2p_storage.UnSafeExpandNode) (e error) {
+	if exNode.ID == 0 {
+		return errors.New("unsafe task without id")
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for id, old := range ms.unsafeNodes {
+		if id != exNode.ID && old.Group == exNode.Group && old.Node == exNode.Node && old.MD5 == exNode.MD5 {
+			return fmt.Errorf("unsafe task %s/%s/%s exists with id %d", exNode.Group, exNode.Node, exNode.MD5, id)
+		}
+	}
+	n := *exNode
+	ms.unsafeNodes[n.ID] = &n
+	if n.ID > ms.unsafeId {
+		ms.unsafeId = n.ID
+	}
+	return
+}
+
+func (ms *MemSource) DeleteUnSafeFile(gid, md5 string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.unsafeFiles[gid], md5)
+	return
+}
+
+func (ms *MemSource) DeleteUnSafeFileExpandNode(gid, node, md5 string) (e error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for id, n := range ms.unsafeNodes {
+		if n.Group == gid && n.Node == node && n.MD5 == md5 {
+			delete(ms.unsafeNodes, id)
+		}
+	}
+	return
+}
+
+func (ms *MemSource) GetUnSafeFileExpandNode() (exNodes []p2p_storage.UnSafeExpandNode, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.sortedUnSafeNodes(func(n *p2p_storage.UnSafeExpandNode) bool { return true }), nil
+}
+
+/*
+	获取分组中拥有危险文件piece的节点，排除ex_nids中的节点
+*/
+func (ms *MemSource) GetHasUnSafeFileNode(gid, md5 string, num uint32, ex_nids []string) (nids []string, e error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	ex := make(map[string]bool, len(ex_nids))
+	for _, nid := range ex_nids {
+		ex[nid] = true
+	}
+	nids = make([]string, 0)
+	for _, n := range ms.sortedUnSafeNodes(func(n *p2p_storage.UnSafeExpandNode) bool {
+		return n.Group == gid && n.MD5 == md5 && !ex[n.Node]
+	}) {
+		if uint32(len(nids)) >= num {
+			break
+		}
+		nids = append(nids, n.Node)
+	}
+	return
+}
@@ -0,0 +1,504 @@
+package migrate
+
+import (
+	"errors"
+	"sync"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/backup"
+)
+
+/*
+	在后台执行Backfill，已经在执行时直接返回
+*/
+func (dw *DualWrite) StartBackfill() {
+	dw.backfillLock.Lock()
+	defer dw.backfillLock.Unlock()
+	if dw.backfillRunning {
+		return
+	}
+	dw.backfillRunning = true
+	dw.backfillErr = nil
+	go func() {
+		e := dw.Backfill()
+		dw.backfillLock.Lock()
+		dw.backfillRunning, dw.backfillErr = false, e
+		dw.backfillLock.Unlock()
+	}()
+}
+
+/*
+	后台Backfill的状态
+
+	返回值：
+		running: 是否正在执行
+		e: 上次执行的错误
+*/
+func (dw *DualWrite) BackfillStatus() (running bool, e error) {
+	dw.backfillLock.Lock()
+	defer dw.backfillLock.Unlock()
+	return dw.backfillRunning, dw.backfillErr
+}
+
+/*
+	把旧库中新库还没有的数据补到新库，新库中已有的记录不覆盖（双写已经在更新它们）
+
+	备份只用来列出要补的记录，每条记录写入前重新读取旧库的当前状态，导出之后被删除的记录不再补回。
+	两个后端都支持的可选存储（见backup/stores.go）同样补齐，延迟添加要求新库实现backup.IngestRestorer。
+	扩散任务和危险任务按旧库中的ID写入，有任务时要求新库实现backup.TaskRestorer。
+	读取旧库和写入新库期间不允许双写，保证两者之间的删除不会被覆盖
+*/
+func (dw *DualWrite) Backfill() (e error) {
+	s, e := backup.Export(dw.oldDS)
+	if e != nil {
+		return
+	}
+	if _, ok := dw.newDS.(backup.TaskRestorer); !ok && (len(s.ExpandNodes) > 0 || len(s.UnSafeNodes) > 0) {
+		return errors.New("new data source can not restore tasks with their ids")
+	}
+	bf := &backfiller{from: dw.oldDS, to: dw.newDS, lock: &dw.writeLock}
+	return bf.run(s)
+}
+
+type backfiller struct {
+	from p2p_storage.IDataSource //旧库
+	to   p2p_storage.IDataSource //新库
+	lock sync.Locker            //与双写互斥
+}
+
+//在与双写互斥的情况下执行op
+func (bf *backfiller) locked(op func() error) error {
+	bf.lock.Lock()
+	defer bf.lock.Unlock()
+	return op()
+}
+
+func (bf *backfiller) run(s *backup.Snapshot) (e error) {
+	for i := range s.Nodes {
+		nid := s.Nodes[i].ID
+		if e = bf.locked(func() error { return bf.node(nid) }); e != nil {
+			return
+		}
+	}
+	for i := range s.Groups {
+		if e = bf.group(&s.Groups[i]); e != nil {
+			return
+		}
+	}
+	for _, t := range s.ExpandNodes {
+		t := t
+		if e = bf.locked(func() error { return bf.expandNode(&t) }); e != nil {
+			return
+		}
+	}
+	if len(s.UnSafeNodes) > 0 {
+		if e = bf.locked(bf.unsafeNodes); e != nil {
+			return
+		}
+	}
+	for md5 := range s.Checksums {
+		md5 := md5
+		if e = bf.locked(func() error { return bf.checksum(md5) }); e != nil {
+			return
+		}
+	}
+	return bf.stores(s)
+}
+
+//两个后端都支持的可选存储
+func (bf *backfiller) has(store interface{}) bool {
+	return p2p_storage.SupportsStore(bf.from, store) && p2p_storage.SupportsStore(bf.to, store)
+}
+
+/*
+	补可选存储中的数据，与其他记录一样先检查新库再重新读取旧库。用量和引用计数是计数器，
+	双写期间新库只累加了增量，所以在互斥的情况下直接改为旧库当前的值
+*/
+func (bf *backfiller) stores(s *backup.Snapshot) (e error) {
+	each := func(n int, op func(i int) error) (e error) {
+		for i := 0; i < n; i++ {
+			if e = bf.locked(func() error { return op(i) }); e != nil {
+				return
+			}
+		}
+		return
+	}
+	if bf.has((*p2p_storage.INodeKeyStore)(nil)) {
+		from, to := bf.from.(p2p_storage.INodeKeyStore), bf.to.(p2p_storage.INodeKeyStore)
+		for nid := range s.NodeKeys {
+			nid := nid
+			e = bf.locked(func() (e error) {
+				if key, e := to.GetNodeKey(nid); e != nil || key != nil {
+					return e
+				}
+				key, e := from.GetNodeKey(nid)
+				if e != nil || key == nil {
+					return
+				}
+				_, e = to.AddNodeKey(nid, key)
+				return
+			})
+			if e != nil {
+				return
+			}
+		}
+	}
+	if bf.has((*p2p_storage.INATStore)(nil)) {
+		from, to := bf.from.(p2p_storage.INATStore), bf.to.(p2p_storage.INATStore)
+		e = each(len(s.NATs), func(i int) (e error) {
+			ids := []string{s.NATs[i].Node}
+			if nats, e := to.GetNodeNATs(ids); e != nil || nats[ids[0]] != nil {
+				return e
+			}
+			nats, e := from.GetNodeNATs(ids)
+			if e != nil || nats[ids[0]] == nil {
+				return
+			}
+			return to.SetNodeNAT(nats[ids[0]])
+		})
+		if e != nil {
+			return
+		}
+	}
+	if bf.has((*p2p_storage.INamespaceStore)(nil)) {
+		if e = bf.namespace(s); e != nil {
+			return
+		}
+	}
+	if bf.has((*p2p_storage.IPolicyStore)(nil)) {
+		from, to := bf.from.(p2p_storage.IPolicyStore), bf.to.(p2p_storage.IPolicyStore)
+		e = each(len(s.Policies), func(i int) (e error) {
+			md5 := s.Policies[i].MD5
+			if p, e := to.GetFilePolicy(md5); e != nil || p != nil {
+				return e
+			}
+			p, e := from.GetFilePolicy(md5)
+			if e != nil || p == nil {
+				return
+			}
+			return to.SetFilePolicy(p)
+		})
+		if e != nil {
+			return
+		}
+		for _, t := range s.Tenants {
+			for _, b := range t.Buckets {
+				tenant, bucket := t.Usage.Tenant, b.Name
+				e = bf.locked(func() (e error) {
+					if p, e := to.GetBucketPolicy(tenant, bucket); e != nil || p != nil {
+						return e
+					}
+					p, e := from.GetBucketPolicy(tenant, bucket)
+					if e != nil || p == nil {
+						return
+					}
+					return to.SetBucketPolicy(tenant, bucket, p)
+				})
+				if e != nil {
+					return
+				}
+			}
+		}
+	}
+	if bf.has((*p2p_storage.IFileIDStore)(nil)) {
+		from, to := bf.from.(p2p_storage.IFileIDStore), bf.to.(p2p_storage.IFileIDStore)
+		e = each(len(s.FileIDs), func(i int) (e error) {
+			id := s.FileIDs[i].ID
+			if b, e := to.GetFileIDBinding(id); e != nil || b != nil {
+				return e
+			}
+			b, e := from.GetFileIDBinding(id)
+			if e != nil || b == nil {
+				return
+			}
+			_, e = to.SetFileIDBinding(b)
+			return
+		})
+		if e != nil {
+			return
+		}
+	}
+	if bf.has((*p2p_storage.IFileKeyStore)(nil)) {
+		from, to := bf.from.(p2p_storage.IFileKeyStore), bf.to.(p2p_storage.IFileKeyStore)
+		e = each(len(s.FileKeys), func(i int) (e error) {
+			md5 := s.FileKeys[i].MD5
+			if k, e := to.GetFileKey(md5); e != nil || k != nil {
+				return e
+			}
+			k, e := from.GetFileKey(md5)
+			if e != nil || k == nil {
+				return
+			}
+			_, e = to.SetFileKey(k, 0)
+			return
+		})
+		if e != nil {
+			return
+		}
+	}
+	if bf.has((*p2p_storage.IIngestStore)(nil)) && len(s.Ingests) > 0 {
+		restorer, ok := bf.to.(backup.IngestRestorer)
+		if !ok {
+			return errors.New("new data source can not restore ingests with their tickets")
+		}
+		from, to := bf.from.(p2p_storage.IIngestStore), bf.to.(p2p_storage.IIngestStore)
+		e = each(len(s.Ingests), func(i int) (e error) {
+			ticket := s.Ingests[i].Ticket
+			if p, e := to.GetIngest(ticket); e != nil || p != nil {
+				return e
+			}
+			p, e := from.GetIngest(ticket)
+			if e != nil || p == nil {
+				return
+			}
+			return restorer.RestoreIngest(p)
+		})
+		if e != nil {
+			return
+		}
+	}
+	if bf.has((*p2p_storage.IExpandStateStore)(nil)) {
+		from, to := bf.from.(p2p_storage.IExpandStateStore), bf.to.(p2p_storage.IExpandStateStore)
+		e = each(len(s.ExpandAttempts), func(i int) (e error) {
+			gid, md5 := s.ExpandAttempts[i].Group, s.ExpandAttempts[i].MD5
+			if a, e := to.GetExpandAttempt(gid, md5); e != nil || a != nil {
+				return e
+			}
+			a, e := from.GetExpandAttempt(gid, md5)
+			if e != nil || a == nil {
+				return
+			}
+			return to.SetExpandAttempt(a)
+		})
+	}
+	return
+}
+
+//存储桶、对象、租户的用量配额和文件的引用计数
+func (bf *backfiller) namespace(s *backup.Snapshot) (e error) {
+	from, to := bf.from.(p2p_storage.INamespaceStore), bf.to.(p2p_storage.INamespaceStore)
+	for _, t := range s.Tenants {
+		tenant := t.Usage.Tenant
+		e = bf.locked(func() (e error) {
+			cur, e := from.GetUsage(tenant)
+			if e != nil {
+				return
+			}
+			old, e := to.GetUsage(tenant)
+			if e != nil {
+				return
+			}
+			if cur.Bytes != old.Bytes || cur.Files != old.Files {
+				if e = to.IncrUsage(tenant, int64(cur.Bytes-old.Bytes), int64(cur.Files-old.Files)); e != nil {
+					return
+				}
+			}
+			if cur.Quota != old.Quota {
+				e = to.SetQuota(tenant, cur.Quota)
+			}
+			return
+		})
+		if e != nil {
+			return
+		}
+		for _, b := range t.Buckets {
+			bucket := b.Name
+			e = bf.locked(func() (e error) {
+				if exist, e := to.IsBucketExist(tenant, bucket); e != nil || exist {
+					return e
+				}
+				exist, e := from.IsBucketExist(tenant, bucket)
+				if e != nil || !exist {
+					return
+				}
+				_, e = to.CreateBucket(tenant, bucket)
+				return
+			})
+			if e != nil {
+				return
+			}
+			for _, obj := range b.Objects {
+				key := obj.Key
+				e = bf.locked(func() (e error) {
+					if o, e := to.GetObject(tenant, bucket, key); e != nil || o != nil {
+						return e
+					}
+					o, e := from.GetObject(tenant, bucket, key)
+					if e != nil || o == nil {
+						return
+					}
+					return to.PutObject(o)
+				})
+				if e != nil {
+					return
+				}
+			}
+		}
+	}
+	for md5 := range s.FileRefs {
+		md5 := md5
+		e = bf.locked(func() (e error) {
+			cur, e := from.GetFileRef(md5)
+			if e != nil {
+				return
+			}
+			old, e := to.GetFileRef(md5)
+			if e != nil || cur == old {
+				return
+			}
+			_, e = to.IncrFileRef(md5, cur-old)
+			return
+		})
+		if e != nil {
+			return
+		}
+	}
+	return
+}
+
+func (bf *backfiller) node(nid string) (e error) {
+	exist, e := bf.to.IsNodeExist(nid)
+	if e != nil || exist {
+		return
+	}
+	n, e := bf.from.GetNodeDetail(nid)
+	if e != nil || n == nil {
+		return
+	}
+	return bf.to.AddNode(n)
+}
+
+func (bf *backfiller) group(g *backup.GroupSnapshot) (e error) {
+	if e = raiseIncrID(bf.to, g.ID, g.FileVer); e != nil {
+		return
+	}
+	if e = raiseIncrID(bf.to, "add_"+g.ID, g.AddVer); e != nil {
+		return
+	}
+	e = bf.locked(func() (e error) {
+		group, e := bf.to.GetGroup(g.ID)
+		if e != nil || group != nil {
+			return
+		}
+		if group, e = bf.from.GetGroup(g.ID); e != nil || group == nil {
+			return
+		}
+		return bf.to.AddGroup(group)
+	})
+	if e != nil {
+		return
+	}
+	e = bf.locked(func() (e error) {
+		nodes, e := bf.to.GetGroupNodes(g.ID)
+		if e != nil {
+			return
+		}
+		members := make(map[string]bool, len(nodes))
+		for _, n := range nodes {
+			members[n.Node] = true
+		}
+		//旧库中当前的分组节点
+		if nodes, e = bf.from.GetGroupNodes(g.ID); e != nil {
+			return
+		}
+		for i := range nodes {
+			if !members[nodes[i].Node] {
+				if e = bf.to.AddNodeToGroup(g.ID, &nodes[i]); e != nil {
+					return
+				}
+			}
+		}
+		return
+	})
+	if e != nil {
+		return
+	}
+	for i := range g.Files {
+		md5 := g.Files[i].MD5
+		e = bf.locked(func() (e error) {
+			f, e := bf.to.GetGroupFile(g.ID, md5)
+			if e != nil || f != nil {
+				return
+			}
+			if f, e = bf.from.GetGroupFile(g.ID, md5); e != nil || f == nil {
+				return
+			}
+			return bf.to.AddFileToGroup(g.ID, f)
+		})
+		if e != nil {
+			return
+		}
+	}
+	return
+}
+
+func (bf *backfiller) expandNode(t *p2p_storage.ExpandNode) (e error) {
+	old, e := bf.to.GetExpandNode(t.Group, t.Node, t.MD5)
+	if e != nil || old != nil {
+		return
+	}
+	cur, e := bf.from.GetExpandNode(t.Group, t.Node, t.MD5)
+	if e != nil || cur == nil {
+		return
+	}
+	return restoreExpandNode(bf.to, cur)
+}
+
+//按旧库当前的危险任务补齐，备份之后被删除的不再补回
+func (bf *backfiller) unsafeNodes() (e error) {
+	existing, e := bf.to.GetUnSafeFileExpandNode()
+	if e != nil {
+		return
+	}
+	keys := make(map[string]bool, len(existing))
+	for _, t := range existing {
+		keys[t.Group+"/"+t.Node+"/"+t.MD5] = true
+	}
+	current, e := bf.from.GetUnSafeFileExpandNode()
+	if e != nil {
+		return
+	}
+	missing := make([]p2p_storage.UnSafeExpandNode, 0)
+	for _, t := range current {
+		if !keys[t.Group+"/"+t.Node+"/"+t.MD5] {
+			if e = bf.to.AddOrUpdateUnSafeFile(t.Group, t.MD5); e != nil {
+				return
+			}
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) > 0 {
+		e = copyUnSafeExpandNodes(bf.from, bf.to, missing)
+	}
+	return
+}
+
+func (bf *backfiller) checksum(md5 string) (e error) {
+	old, e := bf.to.GetChecksum(md5)
+	if e != nil || old != "" {
+		return
+	}
+	cur, e := bf.from.GetChecksum(md5)
+	if e != nil || cur == "" {
+		return
+	}
+	return bf.to.UpdateChecksum(md5, cur)
+}
+
+/*
+	自增ID只增不减，新库的值小于id时提升到id
+*/
+func raiseIncrID(ds p2p_storage.IDataSource, key string, id uint64) (e error) {
+	cur, e := ds.GetIncrID(key)
+	if e != nil || cur >= id {
+		return
+	}
+	if setter, ok := ds.(backup.IncrIDSetter); ok {
+		return setter.SetIncrID(key, id)
+	}
+	for ; cur < id; cur++ {
+		if _, e = ds.AtomicIncrID(key); e != nil {
+			return
+		}
+	}
+	return
+}
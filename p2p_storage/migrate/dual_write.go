@@ -0,0 +1,837 @@
+/*
+在两个IDataSource后端之间在线迁移数据。
+
+DualWrite包装新旧两个后端，写操作同时写入两边，读操作只读主库（切换前是旧库，切换后是新库），
+并按采样率同时读从库比较分组、分组文件、分组节点和节点，差异记录在DiffReport中。
+Backfill把旧库中已有的数据补到新库，Compare做全量比较，确认没有差异后调用SwitchReads切换读库。
+
+	dw := migrate.NewDualWrite(oldDS, newDS, 0.01)
+	p2p_storage.Init(dw, logger, true)
+	dw.StartBackfill()
+	...
+	report, _ := migrate.Compare(oldDS, newDS)
+	if report.Count() == 0 {
+		dw.SwitchReads(true)
+	}
+
+主库写入失败时直接返回错误，从库写入失败只记录到报告中，不影响业务。节点按任务ID上报扩散进度，
+扩散任务和危险任务由主库分配ID，再按原ID写入从库（见backup.TaskRestorer），切换读库后已经下发的任务ID
+仍然有效，所以新库必须实现backup.TaskRestorer，否则Backfill返回错误。旧库不支持按ID写入时，切换后
+新建的任务在旧库中的ID不同，切回旧库前需要重新生成任务。按ID的写操作先在主库查出(gid, nid, md5)，
+再在从库中按自然键找到对应的任务。
+分布式锁需要在两个后端同时获取，保证切换前后只使用其中一个后端的进程也能互斥。
+两个后端都支持的可选存储接口（INodeKeyStore、INamespaceStore等）同样双写，见stores.go。
+*/
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/backup"
+)
+
+type DualWrite struct {
+	oldDS      p2p_storage.IDataSource
+	newDS      p2p_storage.IDataSource
+	readNew    int32   //1-从新库读
+	sampleRate float64 //读操作比较的采样率，0-1
+
+	reportLock sync.Mutex
+	report     *DiffReport
+
+	backfillLock    sync.Mutex
+	backfillRunning bool
+	backfillErr     error
+
+	writeLock sync.RWMutex //写操作持有读锁，Backfill补一条记录时持有写锁
+}
+
+/*
+	创建双写数据源，初始从旧库读
+
+	参数：
+		oldDS: 旧后端
+		newDS: 新后端
+		sampleRate: 读操作比较的采样率，0表示不比较，1表示每次都比较
+*/
+func NewDualWrite(oldDS, newDS p2p_storage.IDataSource, sampleRate float64) *DualWrite {
+	return &DualWrite{oldDS: oldDS, newDS: newDS, sampleRate: sampleRate, report: newReport()}
+}
+
+/*
+	原子地切换读库，toNew为true时从新库读。切换后仍然双写，可以随时切回
+*/
+func (dw *DualWrite) SwitchReads(toNew bool) {
+	if toNew {
+		atomic.StoreInt32(&dw.readNew, 1)
+	} else {
+		atomic.StoreInt32(&dw.readNew, 0)
+	}
+}
+
+func (dw *DualWrite) ReadsFromNew() bool {
+	return atomic.LoadInt32(&dw.readNew) == 1
+}
+
+/*
+	获取当前的差异报告（副本）
+*/
+func (dw *DualWrite) Report() DiffReport {
+	dw.reportLock.Lock()
+	defer dw.reportLock.Unlock()
+	return dw.report.copy()
+}
+
+//主库和从库
+func (dw *DualWrite) backends() (primary, secondary p2p_storage.IDataSource) {
+	if dw.ReadsFromNew() {
+		return dw.newDS, dw.oldDS
+	}
+	return dw.oldDS, dw.newDS
+}
+
+func (dw *DualWrite) primary() p2p_storage.IDataSource {
+	p, _ := dw.backends()
+	return p
+}
+
+func (dw *DualWrite) addWriteError(method string, e error) {
+	dw.reportLock.Lock()
+	dw.report.addWriteError(method, e)
+	dw.reportLock.Unlock()
+}
+
+/*
+	先写主库，成功后再写从库，从库的错误只记录
+*/
+func (dw *DualWrite) write(method string, op func(ds p2p_storage.IDataSource) error) (e error) {
+	dw.writeLock.RLock()
+	defer dw.writeLock.RUnlock()
+	p, s := dw.backends()
+	if e = op(p); e != nil {
+		return
+	}
+	if es := op(s); es != nil {
+		dw.addWriteError(method, es)
+	}
+	return
+}
+
+/*
+	按扩散任务ID写入，从库中的任务按(gid, nid, md5)查找
+*/
+func (dw *DualWrite) writeExpandById(method string, id uint64, op func(ds p2p_storage.IDataSource, id uint64) error) (e error) {
+	dw.writeLock.RLock()
+	defer dw.writeLock.RUnlock()
+	p, s := dw.backends()
+	t, e := p.GetExpandNodeById(id)
+	if e != nil {
+		return
+	}
+	if e = op(p, id); e != nil || t == nil {
+		return
+	}
+	st, es := s.GetExpandNode(t.Group, t.Node, t.MD5)
+	if es == nil && st == nil {
+		es = errors.New("expand task " + t.Group + "/" + t.Node + "/" + t.MD5 + " not found")
+	}
+	if es == nil {
+		es = op(s, st.ID)
+	}
+	if es != nil {
+		dw.addWriteError(method, es)
+	}
+	return
+}
+
+func (dw *DualWrite) sample() bool {
+	return dw.sampleRate > 0 && rand.Float64() < dw.sampleRate
+}
+
+/*
+	比较主库和从库的读结果，差异按新旧库记录
+*/
+func (dw *DualWrite) compare(kind, key string, pv interface{}, read func(ds p2p_storage.IDataSource) (interface{}, error)) {
+	_, s := dw.backends()
+	sv, e := read(s)
+	if e != nil {
+		dw.addWriteError("compare "+kind+" "+key, e)
+		return
+	}
+	oldVal, newVal := deref(pv), deref(sv)
+	if dw.ReadsFromNew() {
+		oldVal, newVal = newVal, oldVal
+	}
+	if reflect.DeepEqual(oldVal, newVal) {
+		return
+	}
+	dw.reportLock.Lock()
+	dw.report.add(kind, key, oldVal, newVal)
+	dw.reportLock.Unlock()
+}
+
+//未找到时比较nil，找到时比较值
+func deref(v interface{}) interface{} {
+	switch p := v.(type) {
+	case *p2p_storage.Group:
+		if p == nil {
+			return nil
+		}
+		return *p
+	case *p2p_storage.GroupFile:
+		if p == nil {
+			return nil
+		}
+		return *p
+	case *p2p_storage.NodeDetail:
+		if p == nil {
+			return nil
+		}
+		return *p
+	case []p2p_storage.GroupNode:
+		//不同后端返回的顺序可能不同
+		nodes := append([]p2p_storage.GroupNode(nil), p...)
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+		return nodes
+	}
+	return v
+}
+
+/*
+	新库的自增ID跟随主库：新库支持直接设置时设置为相同的值，否则递增
+*/
+func (dw *DualWrite) AtomicIncrID(key string) (id uint64, e error) {
+	p, s := dw.backends()
+	if id, e = p.AtomicIncrID(key); e != nil {
+		return
+	}
+	if setter, ok := s.(backup.IncrIDSetter); ok {
+		e = setter.SetIncrID(key, id)
+	} else {
+		var sid uint64
+		if sid, e = s.AtomicIncrID(key); e == nil && sid != id {
+			e = errors.New("incr id " + key + " diverged")
+		}
+	}
+	if e != nil {
+		dw.addWriteError("AtomicIncrID", e)
+	}
+	return id, nil
+}
+
+/*
+	依次在旧库和新库获取锁，新库获取失败时释放旧库的锁
+*/
+func (dw *DualWrite) GetLock(db int, key string, expireSec int64, timeout int64) (getLock bool) {
+	if !dw.oldDS.GetLock(db, key, expireSec, timeout) {
+		return false
+	}
+	if !dw.newDS.GetLock(db, key, expireSec, timeout) {
+		dw.oldDS.UnLock(db, key)
+		return false
+	}
+	return true
+}
+
+func (dw *DualWrite) UnLock(db int, key string) (e error) {
+	e = dw.newDS.UnLock(db, key)
+	if eo := dw.oldDS.UnLock(db, key); eo != nil {
+		e = eo
+	}
+	return
+}
+
+//////////////////////////////////////////////////////////////////////
+//需要采样比较的读操作
+
+func (dw *DualWrite) GetGroup(gid string) (group *p2p_storage.Group, e error) {
+	if group, e = dw.primary().GetGroup(gid); e == nil && dw.sample() {
+		dw.compare(KIND_GROUP, gid, group, func(ds p2p_storage.IDataSource) (interface{}, error) { return ds.GetGroup(gid) })
+	}
+	return
+}
+
+func (dw *DualWrite) GetGroupFile(gid, md5 string) (file *p2p_storage.GroupFile, e error) {
+	if file, e = dw.primary().GetGroupFile(gid, md5); e == nil && dw.sample() {
+		dw.compare(KIND_FILE, gid+"/"+md5, file, func(ds p2p_storage.IDataSource) (interface{}, error) { return ds.GetGroupFile(gid, md5) })
+	}
+	return
+}
+
+func (dw *DualWrite) GetNodeDetail(nid string) (detail *p2p_storage.NodeDetail, e error) {
+	if detail, e = dw.primary().GetNodeDetail(nid); e == nil && dw.sample() {
+		dw.compare(KIND_NODE, nid, detail, func(ds p2p_storage.IDataSource) (interface{}, error) { return ds.GetNodeDetail(nid) })
+	}
+	return
+}
+
+func (dw *DualWrite) GetGroupNodes(gid string) (nodes []p2p_storage.GroupNode, e error) {
+	if nodes, e = dw.primary().GetGroupNodes(gid); e == nil && dw.sample() {
+		dw.compare(KIND_GROUP_NODE, gid, nodes, func(ds p2p_storage.IDataSource) (interface{}, error) { return ds.GetGroupNodes(gid) })
+	}
+	return
+}
+
+//////////////////////////////////////////////////////////////////////
+//只读主库的读操作
+
+func (dw *DualWrite) GetIncrID(key string) (uint64, error) {
+	return dw.primary().GetIncrID(key)
+}
+
+func (dw *DualWrite) GetTimeoutNodeCheckedTime() (tm int64, e error) {
+	return dw.primary().GetTimeoutNodeCheckedTime()
+}
+
+func (dw *DualWrite) GetFileGroups(md5 string, state int) (files map[string]p2p_storage.GroupFile, e error) {
+	return dw.primary().GetFileGroups(md5, state)
+}
+
+func (dw *DualWrite) GetNewAddTimeOutGroupFile(tm int64, num int) (files []p2p_storage.GroupFile, e error) {
+	return dw.primary().GetNewAddTimeOutGroupFile(tm, num)
+}
+
+func (dw *DualWrite) GetSourceFileNodes(md5 string, num int) (ids []string, e error) {
+	return dw.primary().GetSourceFileNodes(md5, num)
+}
+
+func (dw *DualWrite) IsNodeHasFile(nid string, md5 string) (yes bool, e error) {
+	return dw.primary().IsNodeHasFile(nid, md5)
+}
+
+func (dw *DualWrite) GetSourceFileCount(md5 string) (count int, e error) {
+	return dw.primary().GetSourceFileCount(md5)
+}
+
+func (dw *DualWrite) GetOnlinePeers(ids []string, timeout int64) (peers []p2p_storage.Peer, e error) {
+	return dw.primary().GetOnlinePeers(ids, timeout)
+}
+
+func (dw *DualWrite) GetFileByMd5AndState(md5 string, state int) (files []p2p_storage.GroupFile, e error) {
+	return dw.primary().GetFileByMd5AndState(md5, state)
+}
+
+func (dw *DualWrite) ListUpdatedFiles(gid string, ver uint64, num int, tp int) (files []p2p_storage.GroupFile, e error) {
+	return dw.primary().ListUpdatedFiles(gid, ver, num, tp)
+}
+
+func (dw *DualWrite) GetFileGroupsCount(md5 string) (count int, e error) {
+	return dw.primary().GetFileGroupsCount(md5)
+}
+
+func (dw *DualWrite) GetMoreFileGroupsCount(md5s []string) (m map[string]bool, e error) {
+	return dw.primary().GetMoreFileGroupsCount(md5s)
+}
+
+func (dw *DualWrite) GetTimeoutNodes(from int64, to int64, num int) (nodes []p2p_storage.NodeDetail, e error) {
+	return dw.primary().GetTimeoutNodes(from, to, num)
+}
+
+func (dw *DualWrite) IsNodeExist(nid string) (exist bool, e error) {
+	return dw.primary().IsNodeExist(nid)
+}
+
+func (dw *DualWrite) GetAvailableNodes(groupCapacity uint64, updateTm, regTm int64, offset, num uint32, active_groups int8, online_cnt int) (nodes []string, e error) {
+	return dw.primary().GetAvailableNodes(groupCapacity, updateTm, regTm, offset, num, active_groups, online_cnt)
+}
+
+func (dw *DualWrite) GetAvailableNodesCount(groupCapacity uint64, updateTm, regTm int64, activ_groups int8, online_cnt int) (num uint32, e error) {
+	return dw.primary().GetAvailableNodesCount(groupCapacity, updateTm, regTm, activ_groups, online_cnt)
+}
+
+func (dw *DualWrite) GetAvailableNode(groupCapacity uint64, updateTm, regTm int64, online_cnt, num int) (nodes []string, e error) {
+	return dw.primary().GetAvailableNode(groupCapacity, updateTm, regTm, online_cnt, num)
+}
+
+func (dw *DualWrite) GetAvailableGroup(fileSize uint32) (group *p2p_storage.Group, e error) {
+	return dw.primary().GetAvailableGroup(fileSize)
+}
+
+func (dw *DualWrite) GetAllGroup() (groups map[string]p2p_storage.Group, e error) {
+	return dw.primary().GetAllGroup()
+}
+
+func (dw *DualWrite) GetActiveGroupsCount(groupCapacity uint64) (groups map[uint32]uint32, e error) {
+	return dw.primary().GetActiveGroupsCount(groupCapacity)
+}
+
+func (dw *DualWrite) GetActiveGroupsLeftSpace(groupCapacity uint64) (groups map[uint32]uint64, e error) {
+	return dw.primary().GetActiveGroupsLeftSpace(groupCapacity)
+}
+
+func (dw *DualWrite) GetFileNodes(gid string, ver uint64) (nodes []p2p_storage.Peer, e error) {
+	return dw.primary().GetFileNodes(gid, ver)
+}
+
+func (dw *DualWrite) GetNoFileNodes(gid string, ver uint64) (nodes []string, e error) {
+	return dw.primary().GetNoFileNodes(gid, ver)
+}
+
+func (dw *DualWrite) GetAllFileNodes(gid string) (nodes []string, e error) {
+	return dw.primary().GetAllFileNodes(gid)
+}
+
+func (dw *DualWrite) GetRandomGroupNode(gid string) (node *p2p_storage.GroupNode, e error) {
+	return dw.primary().GetRandomGroupNode(gid)
+}
+
+func (dw *DualWrite) GetNodeGroups(nid string) (groups []p2p_storage.Group, e error) {
+	return dw.primary().GetNodeGroups(nid)
+}
+
+func (dw *DualWrite) GetRandomNodeGroup(nid string) (group p2p_storage.Group, e error) {
+	return dw.primary().GetRandomNodeGroup(nid)
+}
+
+func (dw *DualWrite) GetNodeGroupCount(nid string) (num uint32, e error) {
+	return dw.primary().GetNodeGroupCount(nid)
+}
+
+func (dw *DualWrite) GetNodeGroupDetail(nid string) (groups []p2p_storage.NodeGroupDetail, e error) {
+	return dw.primary().GetNodeGroupDetail(nid)
+}
+
+func (dw *DualWrite) GetNodeGroupState(nid string) (groups map[string]p2p_storage.GroupNode, e error) {
+	return dw.primary().GetNodeGroupState(nid)
+}
+
+func (dw *DualWrite) GetGroupOnlineNodesCount(gid string) (num uint32, e error) {
+	return dw.primary().GetGroupOnlineNodesCount(gid)
+}
+
+func (dw *DualWrite) GetUPNPAvailableNodes(num int, updateTm int64) (nodes []p2p_storage.Peer, e error) {
+	return dw.primary().GetUPNPAvailableNodes(num, updateTm)
+}
+
+func (dw *DualWrite) GetChecksum(md5 string) (checksum string, e error) {
+	return dw.primary().GetChecksum(md5)
+}
+
+func (dw *DualWrite) GetValidExpandNodes(gid, md5 string) (exNodes []p2p_storage.ExpandNode, e error) {
+	return dw.primary().GetValidExpandNodes(gid, md5)
+}
+
+func (dw *DualWrite) GetExpandNode(gid, nid, md5 string) (exNode *p2p_storage.ExpandNode, e error) {
+	return dw.primary().GetExpandNode(gid, nid, md5)
+}
+
+func (dw *DualWrite) GetExpandNodeById(id uint64) (exNode *p2p_storage.ExpandNode, e error) {
+	return dw.primary().GetExpandNodeById(id)
+}
+
+func (dw *DualWrite) GetExpandTasks(nid string, state int8, num int) (exNodes []p2p_storage.ExpandNode, e error) {
+	return dw.primary().GetExpandTasks(nid, state, num)
+}
+
+func (dw *DualWrite) GetExpandTaskTotalFailedTimes(gid, md5 string) (times uint32, e error) {
+	return dw.primary().GetExpandTaskTotalFailedTimes(gid, md5)
+}
+
+func (dw *DualWrite) GetExpandTaskCount(node string) (cnt uint32, e error) {
+	return dw.primary().GetExpandTaskCount(node)
+}
+
+func (dw *DualWrite) GetTimeoutExpandTaskCheckedTime() (tm, id int64, e error) {
+	return dw.primary().GetTimeoutExpandTaskCheckedTime()
+}
+
+func (dw *DualWrite) GetTimeoutExpandTask(from int64, to int64, lastId int64, num int) (nodes []p2p_storage.ExpandNode, e error) {
+	return dw.primary().GetTimeoutExpandTask(from, to, lastId, num)
+}
+
+func (dw *DualWrite) GetNodesByIds(ids []string) (nodes []p2p_storage.NodeDetail, e error) {
+	return dw.primary().GetNodesByIds(ids)
+}
+
+func (dw *DualWrite) GetGroupFileVer(gid, nid string) (ver uint64, e error) {
+	return dw.primary().GetGroupFileVer(gid, nid)
+}
+
+func (dw *DualWrite) GetGroupFileByVer(gid, nid string, ver uint64, num int) (files []p2p_storage.GroupFile, e error) {
+	return dw.primary().GetGroupFileByVer(gid, nid, ver, num)
+}
+
+func (dw *DualWrite) GetFileNodesCountByVer(gid string, ver uint64) (cnt uint32, e error) {
+	return dw.primary().GetFileNodesCountByVer(gid, ver)
+}
+
+func (dw *DualWrite) GetCanDelTimeoutNodes(tm uint64, num int) (nodes []string, e error) {
+	return dw.primary().GetCanDelTimeoutNodes(tm, num)
+}
+
+func (dw *DualWrite) CheckIsFinishFirstExpand(gid string, ver uint64) (finish bool, e error) {
+	return dw.primary().CheckIsFinishFirstExpand(gid, ver)
+}
+
+func (dw *DualWrite) GetNodeCountByVerAndState(gid string, ver uint64, state int) (num uint32, e error) {
+	return dw.primary().GetNodeCountByVerAndState(gid, ver, state)
+}
+
+func (dw *DualWrite) GetAtomicLastCheckerTm(key string) (tm int64, e error) {
+	return dw.primary().GetAtomicLastCheckerTm(key)
+}
+
+func (dw *DualWrite) GetGroupFirstFinishExpandVer(gid string) (finish_ver uint64, e error) {
+	return dw.primary().GetGroupFirstFinishExpandVer(gid)
+}
+
+func (dw *DualWrite) GetNodeOnlineTm(nids []string) (node_online_map map[string]int, e error) {
+	return dw.primary().GetNodeOnlineTm(nids)
+}
+
+func (dw *DualWrite) GetAllNode(begin string) (nodes []string, e error) {
+	return dw.primary().GetAllNode(begin)
+}
+
+func (dw *DualWrite) GetUnSafeExpandTasks(nid string, state int8, num int) (exNodes []p2p_storage.UnSafeExpandNode, e error) {
+	return dw.primary().GetUnSafeExpandTasks(nid, state, num)
+}
+
+func (dw *DualWrite) GetUnSafeExpandNodeById(id uint64) (exNode *p2p_storage.UnSafeExpandNode, e error) {
+	return dw.primary().GetUnSafeExpandNodeById(id)
+}
+
+func (dw *DualWrite) GetUnSafeFileExpandNode() (exNodes []p2p_storage.UnSafeExpandNode, e error) {
+	return dw.primary().GetUnSafeFileExpandNode()
+}
+
+func (dw *DualWrite) GetHasUnSafeFileNode(gid, md5 string, num uint32, ex_nids []string) (nids []string, e error) {
+	return dw.primary().GetHasUnSafeFileNode(gid, md5, num, ex_nids)
+}
+
+func (dw *DualWrite) GetGroupNodeCountByState(state int) (countMap map[string]int, e error) {
+	return dw.primary().GetGroupNodeCountByState(state)
+}
+
+func (dw *DualWrite) GetMapFromConfig(configMap map[interface{}]interface{}) (e error) {
+	return dw.primary().GetMapFromConfig(configMap)
+}
+
+func (dw *DualWrite) GetNodesAGZero(groupCapacity uint64, updateTm, regTm int64, active_groups int8, online_cnt int) (nodes map[string]bool, e error) {
+	return dw.primary().GetNodesAGZero(groupCapacity, updateTm, regTm, active_groups, online_cnt)
+}
+
+func (dw *DualWrite) GetNewNodes(groupCapacity uint64, updateTm, regTm int64, online_cnt int) (nodes map[string]bool, e error) {
+	return dw.primary().GetNewNodes(groupCapacity, updateTm, regTm, online_cnt)
+}
+
+func (dw *DualWrite) GetGroupNodesTaskProcessSlow(nowTm int64) (groupNodesMap map[string]p2p_storage.GroupNode, e error) {
+	return dw.primary().GetGroupNodesTaskProcessSlow(nowTm)
+}
+
+//////////////////////////////////////////////////////////////////////
+//写操作，指针参数传给从库时使用副本，避免从库修改调用方拿到的值
+
+func (dw *DualWrite) UpdateTimeoutNodeCheckedTime(tm int64) (e error) {
+	return dw.write("UpdateTimeoutNodeCheckedTime", func(ds p2p_storage.IDataSource) error { return ds.UpdateTimeoutNodeCheckedTime(tm) })
+}
+
+func (dw *DualWrite) CalculateGroupSize(gid string) (e error) {
+	return dw.write("CalculateGroupSize", func(ds p2p_storage.IDataSource) error { return ds.CalculateGroupSize(gid) })
+}
+
+func (dw *DualWrite) AddFileToGroup(gid string, file *p2p_storage.GroupFile) (e error) {
+	return dw.write("AddFileToGroup", func(ds p2p_storage.IDataSource) error {
+		f := *file
+		return ds.AddFileToGroup(gid, &f)
+	})
+}
+
+func (dw *DualWrite) UpdateGroupFile(gid string, file *p2p_storage.GroupFile) (e error) {
+	return dw.write("UpdateGroupFile", func(ds p2p_storage.IDataSource) error {
+		f := *file
+		return ds.UpdateGroupFile(gid, &f)
+	})
+}
+
+func (dw *DualWrite) UpdateGroupFileTpAndVer(gid, md5 string, ver uint64) (e error) {
+	return dw.write("UpdateGroupFileTpAndVer", func(ds p2p_storage.IDataSource) error { return ds.UpdateGroupFileTpAndVer(gid, md5, ver) })
+}
+
+func (dw *DualWrite) DeleteGroupFile(gid string, md5 string) (e error) {
+	return dw.write("DeleteGroupFile", func(ds p2p_storage.IDataSource) error { return ds.DeleteGroupFile(gid, md5) })
+}
+
+func (dw *DualWrite) IncrFileVer(gid string, md5 string, ver uint64) (e error) {
+	return dw.write("IncrFileVer", func(ds p2p_storage.IDataSource) error { return ds.IncrFileVer(gid, md5, ver) })
+}
+
+func (dw *DualWrite) AddNode(node *p2p_storage.NodeDetail) (e error) {
+	return dw.write("AddNode", func(ds p2p_storage.IDataSource) error {
+		n := *node
+		return ds.AddNode(&n)
+	})
+}
+
+func (dw *DualWrite) DeleteNode(id string) (e error) {
+	return dw.write("DeleteNode", func(ds p2p_storage.IDataSource) error { return ds.DeleteNode(id) })
+}
+
+func (dw *DualWrite) UpdateNode(node *p2p_storage.NodeDetail) (e error) {
+	return dw.write("UpdateNode", func(ds p2p_storage.IDataSource) error {
+		n := *node
+		return ds.UpdateNode(&n)
+	})
+}
+
+func (dw *DualWrite) UpdateNodeWeight(nid string, weight float64) (e error) {
+	return dw.write("UpdateNodeWeight", func(ds p2p_storage.IDataSource) error { return ds.UpdateNodeWeight(nid, weight) })
+}
+
+func (dw *DualWrite) AddGroup(group *p2p_storage.Group) (e error) {
+	return dw.write("AddGroup", func(ds p2p_storage.IDataSource) error {
+		g := *group
+		return ds.AddGroup(&g)
+	})
+}
+
+/*
+	主库修改group.Size，从库使用副本
+*/
+func (dw *DualWrite) UpdateGroupSize(group *p2p_storage.Group, filesize int64) (e error) {
+	dw.writeLock.RLock()
+	defer dw.writeLock.RUnlock()
+	p, s := dw.backends()
+	g := *group
+	if e = p.UpdateGroupSize(group, filesize); e != nil {
+		return
+	}
+	if es := s.UpdateGroupSize(&g, filesize); es != nil {
+		dw.addWriteError("UpdateGroupSize", es)
+	}
+	return
+}
+
+func (dw *DualWrite) AddNodeToGroup(gid string, node *p2p_storage.GroupNode) (e error) {
+	return dw.write("AddNodeToGroup", func(ds p2p_storage.IDataSource) error {
+		n := *node
+		return ds.AddNodeToGroup(gid, &n)
+	})
+}
+
+func (dw *DualWrite) UpdateGroupNode(gid string, node *p2p_storage.GroupNode, isVerChange bool) (e error) {
+	return dw.write("UpdateGroupNode", func(ds p2p_storage.IDataSource) error {
+		n := *node
+		return ds.UpdateGroupNode(gid, &n, isVerChange)
+	})
+}
+
+func (dw *DualWrite) DeleteGroupNode(gid, nid string) (e error) {
+	return dw.write("DeleteGroupNode", func(ds p2p_storage.IDataSource) error { return ds.DeleteGroupNode(gid, nid) })
+}
+
+func (dw *DualWrite) AddToInvalidFile(nid, gid, md5 string, tm int64) (e error) {
+	return dw.write("AddToInvalidFile", func(ds p2p_storage.IDataSource) error { return ds.AddToInvalidFile(nid, gid, md5, tm) })
+}
+
+func (dw *DualWrite) UpdateChecksum(md5, checksum string) (e error) {
+	return dw.write("UpdateChecksum", func(ds p2p_storage.IDataSource) error { return ds.UpdateChecksum(md5, checksum) })
+}
+
+func (dw *DualWrite) IncrementActiveGroups(nid string) (e error) {
+	return dw.write("IncrementActiveGroups", func(ds p2p_storage.IDataSource) error { return ds.IncrementActiveGroups(nid) })
+}
+
+/*
+	返回主库中的任务ID
+*/
+func (dw *DualWrite) AddOrUpdateExpandNode(exNode *p2p_storage.ExpandNode) (task_id int64, e error) {
+	dw.writeLock.RLock()
+	defer dw.writeLock.RUnlock()
+	p, s := dw.backends()
+	if task_id, e = p.AddOrUpdateExpandNode(exNode); e != nil {
+		return
+	}
+	//从主库读出完整的任务（更新时主库保留了原ID和失败次数），按同一个ID写入从库
+	t, es := p.GetExpandNodeById(uint64(task_id))
+	if es == nil && t == nil {
+		es = fmt.Errorf("expand task %d not found", task_id)
+	}
+	if es == nil {
+		es = restoreExpandNode(s, t)
+	}
+	if es != nil {
+		dw.addWriteError("AddOrUpdateExpandNode", es)
+	}
+	return
+}
+
+func (dw *DualWrite) UpdateExpandNodeState(gid, nid, md5 string, state int8, timouet int64, increment_failed_times bool) (e error) {
+	return dw.write("UpdateExpandNodeState", func(ds p2p_storage.IDataSource) error {
+		return ds.UpdateExpandNodeState(gid, nid, md5, state, timouet, increment_failed_times)
+	})
+}
+
+func (dw *DualWrite) UpdateExpandNodesState(nid string, state int8, timouet int64) (e error) {
+	return dw.write("UpdateExpandNodesState", func(ds p2p_storage.IDataSource) error { return ds.UpdateExpandNodesState(nid, state, timouet) })
+}
+
+func (dw *DualWrite) UpdateExpandNodeTimeout(id uint64, timouet int64) (e error) {
+	return dw.writeExpandById("UpdateExpandNodeTimeout", id, func(ds p2p_storage.IDataSource, id uint64) error { return ds.UpdateExpandNodeTimeout(id, timouet) })
+}
+
+func (dw *DualWrite) DeleteExpandNode(gid, nid, md5 string) (e error) {
+	return dw.write("DeleteExpandNode", func(ds p2p_storage.IDataSource) error { return ds.DeleteExpandNode(gid, nid, md5) })
+}
+
+func (dw *DualWrite) UpdateTimeoutExpandTaskCheckedTime(tm, id int64) (e error) {
+	return dw.write("UpdateTimeoutExpandTaskCheckedTime", func(ds p2p_storage.IDataSource) error { return ds.UpdateTimeoutExpandTaskCheckedTime(tm, id) })
+}
+
+func (dw *DualWrite) AddTaskNode(task_id uint64, nids []string) (e error) {
+	return dw.writeExpandById("AddTaskNode", task_id, func(ds p2p_storage.IDataSource, id uint64) error { return ds.AddTaskNode(id, nids) })
+}
+
+func (dw *DualWrite) DeleteTaskNodeByTask(id uint64) (e error) {
+	return dw.writeExpandById("DeleteTaskNodeByTask", id, func(ds p2p_storage.IDataSource, id uint64) error { return ds.DeleteTaskNodeByTask(id) })
+}
+
+func (dw *DualWrite) DeleteExpandNodeById(id uint64) (e error) {
+	return dw.writeExpandById("DeleteExpandNodeById", id, func(ds p2p_storage.IDataSource, id uint64) error { return ds.DeleteExpandNodeById(id) })
+}
+
+func (dw *DualWrite) DeleteExpandNodeByMd5(md5 string) (e error) {
+	return dw.write("DeleteExpandNodeByMd5", func(ds p2p_storage.IDataSource) error { return ds.DeleteExpandNodeByMd5(md5) })
+}
+
+func (dw *DualWrite) DeleteExpandNodeByTimeOut(tm uint64) (e error) {
+	return dw.write("DeleteExpandNodeByTimeOut", func(ds p2p_storage.IDataSource) error { return ds.DeleteExpandNodeByTimeOut(tm) })
+}
+
+func (dw *DualWrite) SetAtomicGetLastCheckerTm(key string, tm int64, expire_second int) (e error) {
+	return dw.write("SetAtomicGetLastCheckerTm", func(ds p2p_storage.IDataSource) error { return ds.SetAtomicGetLastCheckerTm(key, tm, expire_second) })
+}
+
+func (dw *DualWrite) UpdateGroupFirstFinishVer(gid string, ver uint64) (e error) {
+	return dw.write("UpdateGroupFirstFinishVer", func(ds p2p_storage.IDataSource) error { return ds.UpdateGroupFirstFinishVer(gid, ver) })
+}
+
+func (dw *DualWrite) UpdateNodeOnlineCnt(nodeMap map[string]int) (e error) {
+	return dw.write("UpdateNodeOnlineCnt", func(ds p2p_storage.IDataSource) error { return ds.UpdateNodeOnlineCnt(nodeMap) })
+}
+
+/*
+	危险任务在从库中按(gid, nid, md5)查找
+*/
+func (dw *DualWrite) UpdateUnSafeExpandNodeState(id uint64, state int) (e error) {
+	dw.writeLock.RLock()
+	defer dw.writeLock.RUnlock()
+	p, s := dw.backends()
+	t, e := p.GetUnSafeExpandNodeById(id)
+	if e != nil {
+		return
+	}
+	if e = p.UpdateUnSafeExpandNodeState(id, state); e != nil || t == nil {
+		return
+	}
+	all, es := s.GetUnSafeFileExpandNode()
+	if es == nil {
+		es = errors.New("unsafe task " + t.Group + "/" + t.Node + "/" + t.MD5 + " not found")
+		for _, st := range all {
+			if st.Group == t.Group && st.Node == t.Node && st.MD5 == t.MD5 {
+				es = s.UpdateUnSafeExpandNodeState(st.ID, state)
+				break
+			}
+		}
+	}
+	if es != nil {
+		dw.addWriteError("UpdateUnSafeExpandNodeState", es)
+	}
+	return
+}
+
+func (dw *DualWrite) AddOrUpdateUnSafeFile(gid, md5 string) (e error) {
+	return dw.write("AddOrUpdateUnSafeFile", func(ds p2p_storage.IDataSource) error { return ds.AddOrUpdateUnSafeFile(gid, md5) })
+}
+
+/*
+	危险任务的ID同样由主库分配，写入主库后按自然键读出主库中的任务，再按原ID写入从库
+*/
+func (dw *DualWrite) AddOrUpdateUnSafeExpandNodes(exNodes []p2p_storage.UnSafeExpandNode) (e error) {
+	dw.writeLock.RLock()
+	defer dw.writeLock.RUnlock()
+	p, s := dw.backends()
+	if e = p.AddOrUpdateUnSafeExpandNodes(append([]p2p_storage.UnSafeExpandNode(nil), exNodes...)); e != nil {
+		return
+	}
+	if es := copyUnSafeExpandNodes(p, s, exNodes); es != nil {
+		dw.addWriteError("AddOrUpdateUnSafeExpandNodes", es)
+	}
+	return
+}
+
+/*
+	按原ID写入扩散任务，ds不支持按ID写入时由ds分配ID
+*/
+func restoreExpandNode(ds p2p_storage.IDataSource, t *p2p_storage.ExpandNode) (e error) {
+	if r, ok := ds.(backup.TaskRestorer); ok {
+		return r.RestoreExpandNode(t)
+	}
+	n := *t
+	n.ID = 0
+	_, e = ds.AddOrUpdateExpandNode(&n)
+	return
+}
+
+/*
+	把from中与exNodes自然键相同的危险任务按原ID写入to，to不支持按ID写入时由to分配ID
+
+	参数：
+		from: 已经写入exNodes的数据源
+		to: 要写入的数据源
+		exNodes: 要复制的任务，只使用其中的(gid, node, md5)
+*/
+func copyUnSafeExpandNodes(from, to p2p_storage.IDataSource, exNodes []p2p_storage.UnSafeExpandNode) (e error) {
+	r, ok := to.(backup.TaskRestorer)
+	if !ok {
+		nodes := make([]p2p_storage.UnSafeExpandNode, 0, len(exNodes))
+		for _, t := range exNodes {
+			t.ID = 0
+			nodes = append(nodes, t)
+		}
+		return to.AddOrUpdateUnSafeExpandNodes(nodes)
+	}
+	current, e := from.GetUnSafeFileExpandNode()
+	if e != nil {
+		return
+	}
+	byKey := make(map[string]*p2p_storage.UnSafeExpandNode, len(current))
+	for i, t := range current {
+		byKey[t.Group+"/"+t.Node+"/"+t.MD5] = &current[i]
+	}
+	for _, t := range exNodes {
+		key := t.Group + "/" + t.Node + "/" + t.MD5
+		cur := byKey[key]
+		if cur == nil {
+			return errors.New("unsafe task " + key + " not found")
+		}
+		if e = r.RestoreUnSafeExpandNode(cur); e != nil {
+			return
+		}
+	}
+	return
+}
+
+func (dw *DualWrite) DeleteUnSafeFile(gid, md5 string) (e error) {
+	return dw.write("DeleteUnSafeFile", func(ds p2p_storage.IDataSource) error { return ds.DeleteUnSafeFile(gid, md5) })
+}
+
+func (dw *DualWrite) DeleteUnSafeFileExpandNode(gid, node, md5 string) (e error) {
+	return dw.write("DeleteUnSafeFileExpandNode", func(ds p2p_storage.IDataSource) error { return ds.DeleteUnSafeFileExpandNode(gid, node, md5) })
+}
+
+func (dw *DualWrite) UpdateGroupFileStateAndAddVer(gid string, md5 string, state int, add_ver uint64) (e error) {
+	return dw.write("UpdateGroupFileStateAndAddVer", func(ds p2p_storage.IDataSource) error {
+		return ds.UpdateGroupFileStateAndAddVer(gid, md5, state, add_ver)
+	})
+}
+
+func (dw *DualWrite) SetExpandNodeStateFailed(node string) (e error) {
+	return dw.write("SetExpandNodeStateFailed", func(ds p2p_storage.IDataSource) error { return ds.SetExpandNodeStateFailed(node) })
+}
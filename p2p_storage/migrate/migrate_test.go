@@ -0,0 +1,312 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/backup"
+	"yh_pkg/p2p_storage/mem_source"
+)
+
+func newOldSource(t *testing.T) *mem_source.MemSource {
+	ds := mem_source.New()
+	for _, id := range []string{"n1", "n2"} {
+		if e := ds.AddNode(&p2p_storage.NodeDetail{Peer: p2p_storage.Peer{ID: id}, UpdateTm: time.Now().UnixNano()}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	ds.AddGroup(&p2p_storage.Group{ID: "g1", FileSize: 1024, MinPieces: 2, SafePieces: 3, PerfectPieces: 4})
+	ds.AtomicIncrID("g1")
+	ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n1", Ver: 1, State: p2p_storage.ONLINE})
+	ds.AddFileToGroup("g1", &p2p_storage.GroupFile{File: p2p_storage.File{MD5: "m1", Size: 10}, Ver: 1, State: p2p_storage.NORMAL})
+	ds.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: "n2", MD5: "m1", Timeout: time.Now().Unix() + 60})
+	return ds
+}
+
+func TestDualWrite(t *testing.T) {
+	oldDS, newDS := newOldSource(t), mem_source.New()
+	dw := NewDualWrite(oldDS, newDS, 1)
+	var _ p2p_storage.IDataSource = dw
+
+	//双写
+	ver, e := dw.AtomicIncrID("g1")
+	if e != nil || ver != 2 {
+		t.Fatalf("AtomicIncrID = %d, %v", ver, e)
+	}
+	if e = dw.AddNode(&p2p_storage.NodeDetail{Peer: p2p_storage.Peer{ID: "n3"}}); e != nil {
+		t.Fatal(e)
+	}
+	if exist, _ := newDS.IsNodeExist("n3"); !exist {
+		t.Error("node not written to new data source")
+	}
+
+	//补数据之前采样比较发现差异
+	if _, e = dw.GetGroup("g1"); e != nil {
+		t.Fatal(e)
+	}
+	if r := dw.Report(); len(r.Groups) != 1 || r.Groups[0].New != nil {
+		t.Errorf("sampled read diff not reported: %+v", r)
+	}
+
+	if e = dw.Backfill(); e != nil {
+		t.Fatal(e)
+	}
+	report, e := Compare(oldDS, newDS)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if report.Count() != 0 {
+		t.Fatalf("data sources differ after backfill: %s %+v", report, report)
+	}
+	if id, _ := newDS.GetIncrID("g1"); id != 2 {
+		t.Errorf("new incr id = %d, want 2", id)
+	}
+
+	//按ID的写操作在新库中按自然键找到对应任务
+	task, _ := oldDS.GetExpandNode("g1", "n2", "m1")
+	if e = dw.DeleteExpandNodeById(task.ID); e != nil {
+		t.Fatal(e)
+	}
+	if task, _ = newDS.GetExpandNode("g1", "n2", "m1"); task != nil {
+		t.Error("expand task not deleted from new data source")
+	}
+
+	//新库被单独修改后全量比较能发现
+	newDS.UpdateGroupFileStateAndAddVer("g1", "m1", p2p_storage.DELETED, 0)
+	newDS.DeleteGroupNode("g1", "n1")
+	if report, _ = Compare(oldDS, newDS); len(report.Files) != 1 || len(report.GroupNodes) != 1 || report.GroupNodes[0].Key != "g1/n1" {
+		t.Errorf("Compare report = %+v", report)
+	}
+
+	dw.SwitchReads(true)
+	if !dw.ReadsFromNew() {
+		t.Fatal("SwitchReads failed")
+	}
+	if f, _ := dw.GetGroupFile("g1", "m1"); f == nil || f.State != p2p_storage.DELETED {
+		t.Errorf("read after switch = %+v, want file from new data source", f)
+	}
+}
+
+//可选的存储接口同样双写，只有两个后端都支持时p2p_storage才使用
+func TestDualWriteStores(t *testing.T) {
+	oldDS, newDS := newOldSource(t), mem_source.New()
+	dw := NewDualWrite(oldDS, newDS, 0)
+	if !p2p_storage.SupportsStore(dw, (*p2p_storage.IFileKeyStore)(nil)) {
+		t.Fatal("file key store not supported")
+	}
+	if p2p_storage.SupportsStore(NewDualWrite(oldDS, &plainSource{newDS}, 0), (*p2p_storage.IFileKeyStore)(nil)) {
+		t.Error("file key store supported with a backend without it")
+	}
+
+	key := &p2p_storage.FileKey{MD5: "m1", Tenant: "t1", KeyVer: 1, Wrapped: []byte("k1")}
+	if ok, e := dw.SetFileKey(key, 0); !ok || e != nil {
+		t.Fatalf("SetFileKey = %v, %v", ok, e)
+	}
+	for _, ds := range []*mem_source.MemSource{oldDS, newDS} {
+		if got, _ := ds.GetFileKey("m1"); got == nil || string(got.Wrapped) != "k1" {
+			t.Errorf("file key not written: %+v", got)
+		}
+	}
+	//主库的条件不满足时不写从库
+	if ok, _ := dw.SetFileKey(&p2p_storage.FileKey{MD5: "m1", Tenant: "t1", KeyVer: 2, Wrapped: []byte("k2")}, 0); ok {
+		t.Error("SetFileKey overwrote existing key")
+	}
+	if e := dw.DeleteFileKey("m1"); e != nil {
+		t.Fatal(e)
+	}
+	if got, _ := newDS.GetFileKey("m1"); got != nil {
+		t.Error("file key not deleted from new data source")
+	}
+
+	//排队号由主库分配，从库使用同一个排队号
+	oldDS.AddIngest(&p2p_storage.PendingIngest{MD5: "m0", State: p2p_storage.INGEST_PENDING})
+	ticket, e := dw.AddIngest(&p2p_storage.PendingIngest{MD5: "m2", State: p2p_storage.INGEST_PENDING})
+	if e != nil || ticket != 2 {
+		t.Fatalf("AddIngest = %d, %v", ticket, e)
+	}
+	if p, _ := newDS.GetIngest(ticket); p == nil || p.MD5 != "m2" {
+		t.Errorf("ingest %d in new data source = %+v", ticket, p)
+	}
+	if r := dw.Report(); len(r.WriteErrors) != 0 {
+		t.Errorf("write errors: %+v", r.WriteErrors)
+	}
+}
+
+//Backfill补齐可选存储中的数据，计数器改为旧库的值，旧库中已删除的不补回
+func TestBackfillStores(t *testing.T) {
+	oldDS, newDS := newOldSource(t), mem_source.New()
+	oldDS.AddNodeKey("n1", make([]byte, 32))
+	oldDS.CreateBucket("t1", "b1")
+	oldDS.PutObject(&p2p_storage.Object{Tenant: "t1", Bucket: "b1", Key: "k1", MD5: "m1"})
+	oldDS.PutObject(&p2p_storage.Object{Tenant: "t1", Bucket: "b1", Key: "k2", MD5: "m1"})
+	oldDS.IncrFileRef("m1", 2)
+	oldDS.IncrUsage("t1", 20, 2)
+	oldDS.SetFilePolicy(&p2p_storage.FilePolicy{MD5: "m1", Priority: p2p_storage.PRIORITY_LOW})
+	oldDS.AddIngest(&p2p_storage.PendingIngest{MD5: "m9", State: p2p_storage.INGEST_PENDING})
+	dw := NewDualWrite(oldDS, newDS, 0)
+
+	//双写期间新增一个引用，新库只有增量
+	if _, e := dw.IncrFileRef("m1", 1); e != nil {
+		t.Fatal(e)
+	}
+	if e := dw.IncrUsage("t1", 10, 1); e != nil {
+		t.Fatal(e)
+	}
+	//导出之后删除的对象不补回
+	bf := &backfiller{from: oldDS, to: newDS, lock: &dw.writeLock}
+	s, e := backup.Export(oldDS)
+	if e != nil {
+		t.Fatal(e)
+	}
+	oldDS.DeleteObject("t1", "b1", "k2")
+	if e = bf.run(s); e != nil {
+		t.Fatal(e)
+	}
+	if key, _ := newDS.GetNodeKey("n1"); key == nil {
+		t.Error("node key not backfilled")
+	}
+	if obj, _ := newDS.GetObject("t1", "b1", "k1"); obj == nil {
+		t.Error("object not backfilled")
+	}
+	if obj, _ := newDS.GetObject("t1", "b1", "k2"); obj != nil {
+		t.Error("deleted object backfilled")
+	}
+	if refs, _ := newDS.GetFileRef("m1"); refs != 3 {
+		t.Errorf("refs = %d, want 3", refs)
+	}
+	if u, _ := newDS.GetUsage("t1"); u.Bytes != 30 || u.Files != 3 {
+		t.Errorf("usage = %+v", u)
+	}
+	if p, _ := newDS.GetFilePolicy("m1"); p == nil || p.Priority != p2p_storage.PRIORITY_LOW {
+		t.Errorf("policy = %+v", p)
+	}
+	if p, _ := newDS.GetIngest(1); p == nil || p.MD5 != "m9" {
+		t.Errorf("ingest = %+v", p)
+	}
+}
+
+//只实现IDataSource的数据源
+type plainSource struct {
+	p2p_storage.IDataSource
+}
+
+func TestBackfillSkipsDeleted(t *testing.T) {
+	oldDS, newDS := newOldSource(t), mem_source.New()
+	oldDS.UpdateChecksum("m1", "sum1")
+	dw := NewDualWrite(oldDS, newDS, 0)
+	s, e := backup.Export(oldDS)
+	if e != nil {
+		t.Fatal(e)
+	}
+	//导出之后通过双写删除
+	dw.DeleteGroupFile("g1", "m1")
+	dw.DeleteExpandNode("g1", "n2", "m1")
+	dw.DeleteGroupNode("g1", "n1")
+	dw.DeleteNode("n2")
+	dw.UpdateNodeWeight("n1", 3)
+
+	bf := &backfiller{from: dw.oldDS, to: dw.newDS, lock: &dw.writeLock}
+	if e = bf.run(s); e != nil {
+		t.Fatal(e)
+	}
+	if f, _ := newDS.GetGroupFile("g1", "m1"); f != nil {
+		t.Error("deleted file backfilled")
+	}
+	if task, _ := newDS.GetExpandNode("g1", "n2", "m1"); task != nil {
+		t.Error("deleted expand task backfilled")
+	}
+	if nodes, _ := newDS.GetGroupNodes("g1"); len(nodes) != 0 {
+		t.Errorf("deleted group nodes backfilled: %v", nodes)
+	}
+	if exist, _ := newDS.IsNodeExist("n2"); exist {
+		t.Error("deleted node backfilled")
+	}
+	//补入的是旧库的当前状态
+	if n, _ := newDS.GetNodeDetail("n1"); n == nil || n.Weight != 3 {
+		t.Errorf("backfilled node %+v", n)
+	}
+	if report, _ := Compare(oldDS, newDS); report.Count() != 0 {
+		t.Errorf("data sources differ after backfill: %s", report)
+	}
+}
+
+//切换读库后，切换前下发给节点的任务ID在新库中对应同一个任务
+func TestDualWriteKeepsTaskIds(t *testing.T) {
+	oldDS, newDS := newOldSource(t), mem_source.New()
+	//旧库的ID已经用到3，新库从1开始分配
+	for _, nid := range []string{"n3", "n4"} {
+		oldDS.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: nid, MD5: "m1"})
+		oldDS.DeleteExpandNode("g1", nid, "m1")
+	}
+	oldDS.AddOrUpdateUnSafeExpandNodes([]p2p_storage.UnSafeExpandNode{{Group: "g1", Node: "n1", MD5: "m0"}})
+	oldDS.DeleteUnSafeFileExpandNode("g1", "n1", "m0")
+	dw := NewDualWrite(oldDS, newDS, 0)
+
+	//双写的任务ID由旧库分配
+	id, e := dw.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: "n1", MD5: "m1"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	dw.AddOrUpdateUnSafeFile("g1", "m1")
+	if e = dw.AddOrUpdateUnSafeExpandNodes([]p2p_storage.UnSafeExpandNode{{Group: "g1", Node: "n2", MD5: "m1"}}); e != nil {
+		t.Fatal(e)
+	}
+	if e = dw.Backfill(); e != nil {
+		t.Fatal(e)
+	}
+	if r := dw.Report(); len(r.WriteErrors) != 0 {
+		t.Fatalf("write errors: %+v", r.WriteErrors)
+	}
+	backfilled, _ := oldDS.GetExpandNode("g1", "n2", "m1")
+	unsafe, _ := oldDS.GetUnSafeFileExpandNode()
+	dw.SwitchReads(true)
+
+	for _, old := range []uint64{uint64(id), backfilled.ID} {
+		task, e := dw.GetExpandNodeById(old)
+		if e != nil || task == nil {
+			t.Fatalf("task %d after switch = %+v, %v", old, task, e)
+		}
+		if want, _ := oldDS.GetExpandNodeById(old); want.Node != task.Node {
+			t.Errorf("task %d after switch = %+v, want %+v", old, task, want)
+		}
+	}
+	if got, _ := dw.GetUnSafeFileExpandNode(); len(got) != 1 || len(unsafe) != 1 || got[0].ID != unsafe[0].ID {
+		t.Errorf("unsafe tasks after switch = %+v, want %+v", got, unsafe)
+	}
+	//节点按旧ID完成任务
+	if e = dw.DeleteExpandNodeById(uint64(id)); e != nil {
+		t.Fatal(e)
+	}
+	for _, ds := range []p2p_storage.IDataSource{oldDS, newDS} {
+		if task, _ := ds.GetExpandNode("g1", "n1", "m1"); task != nil {
+			t.Errorf("finished task %+v not deleted", task)
+		}
+	}
+	//切换后新库分配的ID在旧库中相同
+	if id, e = dw.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: "g1", Node: "n3", MD5: "m1"}); e != nil {
+		t.Fatal(e)
+	}
+	if task, _ := oldDS.GetExpandNodeById(uint64(id)); task == nil || task.Node != "n3" {
+		t.Errorf("task %d in old data source = %+v", id, task)
+	}
+
+	//新库不能按ID写入任务时不能补数据
+	if e = NewDualWrite(oldDS, &plainSource{mem_source.New()}, 0).Backfill(); e == nil {
+		t.Error("backfill into a data source without TaskRestorer succeeded")
+	}
+}
+
+func TestDualWriteLock(t *testing.T) {
+	oldDS, newDS := mem_source.New(), mem_source.New()
+	dw := NewDualWrite(oldDS, newDS, 0)
+	if !newDS.GetLock(0, "k", 10, 1) {
+		t.Fatal("GetLock failed")
+	}
+	if dw.GetLock(0, "k", 10, 1) {
+		t.Fatal("GetLock succeeded while new data source is locked")
+	}
+	//旧库的锁已经释放
+	if !oldDS.GetLock(0, "k", 10, 1) {
+		t.Error("old lock not released")
+	}
+}
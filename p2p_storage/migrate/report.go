@@ -0,0 +1,169 @@
+package migrate
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/backup"
+)
+
+//每类差异最多记录的条数，超过的只计数
+const MAX_DIFFS = 1000
+
+//一条差异，Old/New为nil表示该后端中不存在
+type Diff struct {
+	Key string      `json:"key"`
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+//新旧后端的差异报告
+type DiffReport struct {
+	Groups      []Diff   `json:"groups"`       //key-分组ID
+	GroupNodes  []Diff   `json:"group_nodes"`  //key-分组ID/节点ID，采样比较时为分组ID
+	Files       []Diff   `json:"files"`        //key-分组ID/md5
+	Nodes       []Diff   `json:"nodes"`        //key-节点ID
+	WriteErrors []string `json:"write_errors"` //读写从库失败的记录
+	Dropped     int      `json:"dropped"`      //超过MAX_DIFFS未记录的条数
+}
+
+const (
+	KIND_GROUP      = "group"
+	KIND_GROUP_NODE = "group_node"
+	KIND_FILE       = "file"
+	KIND_NODE       = "node"
+)
+
+func (r *DiffReport) add(kind, key string, oldVal, newVal interface{}) {
+	var list *[]Diff
+	switch kind {
+	case KIND_GROUP:
+		list = &r.Groups
+	case KIND_GROUP_NODE:
+		list = &r.GroupNodes
+	case KIND_FILE:
+		list = &r.Files
+	default:
+		list = &r.Nodes
+	}
+	if len(*list) >= MAX_DIFFS {
+		r.Dropped++
+		return
+	}
+	*list = append(*list, Diff{key, oldVal, newVal})
+}
+
+func (r *DiffReport) addWriteError(method string, e error) {
+	if len(r.WriteErrors) >= MAX_DIFFS {
+		r.Dropped++
+		return
+	}
+	r.WriteErrors = append(r.WriteErrors, method+": "+e.Error())
+}
+
+//差异总数
+func (r *DiffReport) Count() int {
+	return len(r.Groups) + len(r.GroupNodes) + len(r.Files) + len(r.Nodes) + len(r.WriteErrors) + r.Dropped
+}
+
+func (r *DiffReport) copy() (c DiffReport) {
+	c.Groups = append([]Diff(nil), r.Groups...)
+	c.GroupNodes = append([]Diff(nil), r.GroupNodes...)
+	c.Files = append([]Diff(nil), r.Files...)
+	c.Nodes = append([]Diff(nil), r.Nodes...)
+	c.WriteErrors = append([]string(nil), r.WriteErrors...)
+	c.Dropped = r.Dropped
+	return
+}
+
+func (r *DiffReport) String() string {
+	return fmt.Sprintf("groups=%d, group_nodes=%d, files=%d, nodes=%d, write_errors=%d, dropped=%d",
+		len(r.Groups), len(r.GroupNodes), len(r.Files), len(r.Nodes), len(r.WriteErrors), r.Dropped)
+}
+
+/*
+	全量比较新旧两个后端中的分组、分组节点、分组文件和节点，按自然键对齐
+
+	参数：
+		oldDS: 旧后端
+		newDS: 新后端
+	返回值：
+		report: 差异报告
+*/
+func Compare(oldDS, newDS p2p_storage.IDataSource) (report *DiffReport, e error) {
+	so, e := backup.Export(oldDS)
+	if e != nil {
+		return
+	}
+	sn, e := backup.Export(newDS)
+	if e != nil {
+		return
+	}
+	report = newReport()
+	compareSnapshot(report, so, sn)
+	return
+}
+
+func newReport() *DiffReport {
+	return &DiffReport{
+		Groups:      make([]Diff, 0),
+		GroupNodes:  make([]Diff, 0),
+		Files:       make([]Diff, 0),
+		Nodes:       make([]Diff, 0),
+		WriteErrors: make([]string, 0),
+	}
+}
+
+func compareSnapshot(report *DiffReport, so, sn *backup.Snapshot) {
+	oldNodes := make(map[string]interface{}, len(so.Nodes))
+	for _, n := range so.Nodes {
+		oldNodes[n.ID] = n
+	}
+	newNodes := make(map[string]interface{}, len(sn.Nodes))
+	for _, n := range sn.Nodes {
+		newNodes[n.ID] = n
+	}
+	compareMap(report, KIND_NODE, oldNodes, newNodes)
+
+	oldGroups, oldGroupNodes, oldFiles := flattenGroups(so.Groups)
+	newGroups, newGroupNodes, newFiles := flattenGroups(sn.Groups)
+	compareMap(report, KIND_GROUP, oldGroups, newGroups)
+	compareMap(report, KIND_GROUP_NODE, oldGroupNodes, newGroupNodes)
+	compareMap(report, KIND_FILE, oldFiles, newFiles)
+}
+
+func flattenGroups(groups []backup.GroupSnapshot) (gs, gns, fs map[string]interface{}) {
+	gs = make(map[string]interface{})
+	gns = make(map[string]interface{})
+	fs = make(map[string]interface{})
+	for _, g := range groups {
+		gs[g.ID] = g.Group
+		for _, n := range g.Nodes {
+			gns[g.ID+"/"+n.Node] = n
+		}
+		for _, f := range g.Files {
+			fs[g.ID+"/"+f.MD5] = f
+		}
+	}
+	return
+}
+
+func compareMap(report *DiffReport, kind string, olds, news map[string]interface{}) {
+	keys := make([]string, 0, len(olds)+len(news))
+	for k := range olds {
+		keys = append(keys, k)
+	}
+	for k := range news {
+		if _, ok := olds[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o, n := olds[k], news[k]
+		if !reflect.DeepEqual(o, n) {
+			report.add(kind, k, o, n)
+		}
+	}
+}
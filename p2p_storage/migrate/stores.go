@@ -0,0 +1,326 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/backup"
+)
+
+/*
+	可选的存储接口同样双写：DualWrite实现这些接口并转发给两个后端，只有两个后端都支持时
+	Supports才返回true，p2p_storage.Init据此决定是否使用该存储。
+	延迟添加的排队号由主库分配，从库需要实现backup.IngestRestorer按同一个排队号写入。
+*/
+var (
+	_ p2p_storage.IStoreForwarder   = (*DualWrite)(nil)
+	_ p2p_storage.INodeKeyStore     = (*DualWrite)(nil)
+	_ p2p_storage.IFileKeyStore     = (*DualWrite)(nil)
+	_ p2p_storage.INamespaceStore   = (*DualWrite)(nil)
+	_ p2p_storage.IPolicyStore      = (*DualWrite)(nil)
+	_ p2p_storage.IPriorityIndex    = (*DualWrite)(nil)
+	_ p2p_storage.IExpandStateStore = (*DualWrite)(nil)
+	_ p2p_storage.IFileIDStore      = (*DualWrite)(nil)
+	_ p2p_storage.INATStore         = (*DualWrite)(nil)
+	_ p2p_storage.IIngestStore      = (*DualWrite)(nil)
+	_ p2p_storage.INodeHistoryStore = (*DualWrite)(nil)
+)
+
+//主库写入成功但从库的条件不满足，两边的数据已经不一致
+var errConditionFailed = errors.New("condition failed on secondary")
+
+func (dw *DualWrite) Supports(store interface{}) bool {
+	return reflect.TypeOf(dw).Implements(reflect.TypeOf(store).Elem()) &&
+		p2p_storage.SupportsStore(dw.oldDS, store) && p2p_storage.SupportsStore(dw.newDS, store)
+}
+
+/*
+	带条件的写操作：先写主库，条件满足（ok为true）后再写从库，从库的错误和条件不满足都只记录
+*/
+func (dw *DualWrite) writeIf(method string, op func(ds p2p_storage.IDataSource) (bool, error)) (ok bool, e error) {
+	dw.writeLock.RLock()
+	defer dw.writeLock.RUnlock()
+	p, s := dw.backends()
+	if ok, e = op(p); e != nil || !ok {
+		return
+	}
+	if sok, es := op(s); es != nil {
+		dw.addWriteError(method, es)
+	} else if !sok {
+		dw.addWriteError(method, errConditionFailed)
+	}
+	return
+}
+
+//返回主库的引用计数
+func (dw *DualWrite) IncrFileRef(md5 string, delta int64) (refs int64, e error) {
+	dw.writeLock.RLock()
+	defer dw.writeLock.RUnlock()
+	p, s := dw.backends()
+	if refs, e = p.(p2p_storage.INamespaceStore).IncrFileRef(md5, delta); e != nil {
+		return
+	}
+	if _, es := s.(p2p_storage.INamespaceStore).IncrFileRef(md5, delta); es != nil {
+		dw.addWriteError("IncrFileRef", es)
+	}
+	return
+}
+
+/*
+	返回主库分配的排队号，从库实现backup.IngestRestorer时按同一个排队号写入，否则两边的排队号不同时记录错误
+*/
+func (dw *DualWrite) AddIngest(p *p2p_storage.PendingIngest) (ticket uint64, e error) {
+	dw.writeLock.RLock()
+	defer dw.writeLock.RUnlock()
+	pr, s := dw.backends()
+	if ticket, e = pr.(p2p_storage.IIngestStore).AddIngest(p); e != nil {
+		return
+	}
+	c := *p
+	c.Ticket = ticket
+	var es error
+	if r, ok := s.(backup.IngestRestorer); ok {
+		es = r.RestoreIngest(&c)
+	} else if st, err := s.(p2p_storage.IIngestStore).AddIngest(&c); err != nil {
+		es = err
+	} else if st != ticket {
+		es = fmt.Errorf("ingest ticket %d diverged, %d in secondary", ticket, st)
+	}
+	if es != nil {
+		dw.addWriteError("AddIngest", es)
+	}
+	return
+}
+
+func (dw *DualWrite) GetNodeKey(nid string) (key []byte, e error) {
+	return dw.primary().(p2p_storage.INodeKeyStore).GetNodeKey(nid)
+}
+
+func (dw *DualWrite) AddNodeKey(nid string, key []byte) (ok bool, e error) {
+	return dw.writeIf("AddNodeKey", func(ds p2p_storage.IDataSource) (bool, error) {
+		return ds.(p2p_storage.INodeKeyStore).AddNodeKey(nid, key)
+	})
+}
+
+func (dw *DualWrite) DeleteNodeKey(nid string) (e error) {
+	return dw.write("DeleteNodeKey", func(ds p2p_storage.IDataSource) error { return ds.(p2p_storage.INodeKeyStore).DeleteNodeKey(nid) })
+}
+
+func (dw *DualWrite) UseNonce(nid string, nonce string, expire int64) (ok bool, e error) {
+	return dw.writeIf("UseNonce", func(ds p2p_storage.IDataSource) (bool, error) {
+		return ds.(p2p_storage.INodeKeyStore).UseNonce(nid, nonce, expire)
+	})
+}
+
+func (dw *DualWrite) GetFileKey(md5 string) (key *p2p_storage.FileKey, e error) {
+	return dw.primary().(p2p_storage.IFileKeyStore).GetFileKey(md5)
+}
+
+func (dw *DualWrite) SetFileKey(key *p2p_storage.FileKey, oldVer uint32) (ok bool, e error) {
+	return dw.writeIf("SetFileKey", func(ds p2p_storage.IDataSource) (bool, error) {
+		return ds.(p2p_storage.IFileKeyStore).SetFileKey(key, oldVer)
+	})
+}
+
+func (dw *DualWrite) DeleteFileKey(md5 string) (e error) {
+	return dw.write("DeleteFileKey", func(ds p2p_storage.IDataSource) error { return ds.(p2p_storage.IFileKeyStore).DeleteFileKey(md5) })
+}
+
+func (dw *DualWrite) GetFileKeys(tenant string, from string, num int) (keys []p2p_storage.FileKey, e error) {
+	return dw.primary().(p2p_storage.IFileKeyStore).GetFileKeys(tenant, from, num)
+}
+
+func (dw *DualWrite) CreateBucket(tenant, bucket string) (ok bool, e error) {
+	return dw.writeIf("CreateBucket", func(ds p2p_storage.IDataSource) (bool, error) {
+		return ds.(p2p_storage.INamespaceStore).CreateBucket(tenant, bucket)
+	})
+}
+
+func (dw *DualWrite) DeleteBucket(tenant, bucket string) (ok bool, e error) {
+	return dw.writeIf("DeleteBucket", func(ds p2p_storage.IDataSource) (bool, error) {
+		return ds.(p2p_storage.INamespaceStore).DeleteBucket(tenant, bucket)
+	})
+}
+
+func (dw *DualWrite) IsBucketExist(tenant, bucket string) (exist bool, e error) {
+	return dw.primary().(p2p_storage.INamespaceStore).IsBucketExist(tenant, bucket)
+}
+
+func (dw *DualWrite) GetBuckets(tenant string) (buckets []string, e error) {
+	return dw.primary().(p2p_storage.INamespaceStore).GetBuckets(tenant)
+}
+
+func (dw *DualWrite) GetObject(tenant, bucket, key string) (obj *p2p_storage.Object, e error) {
+	return dw.primary().(p2p_storage.INamespaceStore).GetObject(tenant, bucket, key)
+}
+
+func (dw *DualWrite) PutObject(obj *p2p_storage.Object) (e error) {
+	return dw.write("PutObject", func(ds p2p_storage.IDataSource) error { return ds.(p2p_storage.INamespaceStore).PutObject(obj) })
+}
+
+func (dw *DualWrite) DeleteObject(tenant, bucket, key string) (e error) {
+	return dw.write("DeleteObject", func(ds p2p_storage.IDataSource) error {
+		return ds.(p2p_storage.INamespaceStore).DeleteObject(tenant, bucket, key)
+	})
+}
+
+func (dw *DualWrite) GetObjects(tenant, bucket, from string, num int) (objs []p2p_storage.Object, e error) {
+	return dw.primary().(p2p_storage.INamespaceStore).GetObjects(tenant, bucket, from, num)
+}
+
+func (dw *DualWrite) GetExpiredObjects(before int64, num int) (objs []p2p_storage.Object, e error) {
+	return dw.primary().(p2p_storage.INamespaceStore).GetExpiredObjects(before, num)
+}
+
+func (dw *DualWrite) GetFileRef(md5 string) (refs int64, e error) {
+	return dw.primary().(p2p_storage.INamespaceStore).GetFileRef(md5)
+}
+
+func (dw *DualWrite) IncrUsage(tenant string, bytes, files int64) (e error) {
+	return dw.write("IncrUsage", func(ds p2p_storage.IDataSource) error {
+		return ds.(p2p_storage.INamespaceStore).IncrUsage(tenant, bytes, files)
+	})
+}
+
+func (dw *DualWrite) GetUsage(tenant string) (usage p2p_storage.Usage, e error) {
+	return dw.primary().(p2p_storage.INamespaceStore).GetUsage(tenant)
+}
+
+func (dw *DualWrite) SetQuota(tenant string, quota p2p_storage.Quota) (e error) {
+	return dw.write("SetQuota", func(ds p2p_storage.IDataSource) error {
+		return ds.(p2p_storage.INamespaceStore).SetQuota(tenant, quota)
+	})
+}
+
+func (dw *DualWrite) GetTenants() (tenants []string, e error) {
+	return dw.primary().(p2p_storage.INamespaceStore).GetTenants()
+}
+
+func (dw *DualWrite) GetFilePolicy(md5 string) (p *p2p_storage.FilePolicy, e error) {
+	return dw.primary().(p2p_storage.IPolicyStore).GetFilePolicy(md5)
+}
+
+func (dw *DualWrite) SetFilePolicy(p *p2p_storage.FilePolicy) (e error) {
+	return dw.write("SetFilePolicy", func(ds p2p_storage.IDataSource) error { return ds.(p2p_storage.IPolicyStore).SetFilePolicy(p) })
+}
+
+func (dw *DualWrite) DeleteFilePolicy(md5 string) (e error) {
+	return dw.write("DeleteFilePolicy", func(ds p2p_storage.IDataSource) error { return ds.(p2p_storage.IPolicyStore).DeleteFilePolicy(md5) })
+}
+
+func (dw *DualWrite) GetExpiredFiles(before int64, num int) (policies []p2p_storage.FilePolicy, e error) {
+	return dw.primary().(p2p_storage.IPolicyStore).GetExpiredFiles(before, num)
+}
+
+func (dw *DualWrite) GetBucketPolicy(tenant, bucket string) (p *p2p_storage.Policy, e error) {
+	return dw.primary().(p2p_storage.IPolicyStore).GetBucketPolicy(tenant, bucket)
+}
+
+func (dw *DualWrite) SetBucketPolicy(tenant, bucket string, p *p2p_storage.Policy) (e error) {
+	return dw.write("SetBucketPolicy", func(ds p2p_storage.IDataSource) error {
+		return ds.(p2p_storage.IPolicyStore).SetBucketPolicy(tenant, bucket, p)
+	})
+}
+
+func (dw *DualWrite) GetFilesByPriority(priority int, after string, num int) (policies []p2p_storage.FilePolicy, e error) {
+	return dw.primary().(p2p_storage.IPriorityIndex).GetFilesByPriority(priority, after, num)
+}
+
+func (dw *DualWrite) AddExpandTransition(t *p2p_storage.ExpandTransition) (e error) {
+	return dw.write("AddExpandTransition", func(ds p2p_storage.IDataSource) error {
+		return ds.(p2p_storage.IExpandStateStore).AddExpandTransition(t)
+	})
+}
+
+func (dw *DualWrite) GetExpandTransitions(task uint64) (ts []p2p_storage.ExpandTransition, e error) {
+	return dw.primary().(p2p_storage.IExpandStateStore).GetExpandTransitions(task)
+}
+
+func (dw *DualWrite) GetExpandAttempt(gid, md5 string) (a *p2p_storage.ExpandAttempt, e error) {
+	return dw.primary().(p2p_storage.IExpandStateStore).GetExpandAttempt(gid, md5)
+}
+
+func (dw *DualWrite) SetExpandAttempt(a *p2p_storage.ExpandAttempt) (e error) {
+	return dw.write("SetExpandAttempt", func(ds p2p_storage.IDataSource) error { return ds.(p2p_storage.IExpandStateStore).SetExpandAttempt(a) })
+}
+
+func (dw *DualWrite) DeleteExpandAttempt(gid, md5 string) (e error) {
+	return dw.write("DeleteExpandAttempt", func(ds p2p_storage.IDataSource) error {
+		return ds.(p2p_storage.IExpandStateStore).DeleteExpandAttempt(gid, md5)
+	})
+}
+
+func (dw *DualWrite) GetFileIDBinding(id string) (b *p2p_storage.FileIDBinding, e error) {
+	return dw.primary().(p2p_storage.IFileIDStore).GetFileIDBinding(id)
+}
+
+func (dw *DualWrite) GetFileIDByMD5(md5 string) (b *p2p_storage.FileIDBinding, e error) {
+	return dw.primary().(p2p_storage.IFileIDStore).GetFileIDByMD5(md5)
+}
+
+func (dw *DualWrite) SetFileIDBinding(b *p2p_storage.FileIDBinding) (ok bool, e error) {
+	return dw.writeIf("SetFileIDBinding", func(ds p2p_storage.IDataSource) (bool, error) {
+		return ds.(p2p_storage.IFileIDStore).SetFileIDBinding(b)
+	})
+}
+
+func (dw *DualWrite) DeleteFileIDBinding(id string) (e error) {
+	return dw.write("DeleteFileIDBinding", func(ds p2p_storage.IDataSource) error { return ds.(p2p_storage.IFileIDStore).DeleteFileIDBinding(id) })
+}
+
+func (dw *DualWrite) GetNodeNATs(ids []string) (nats map[string]*p2p_storage.NodeNAT, e error) {
+	return dw.primary().(p2p_storage.INATStore).GetNodeNATs(ids)
+}
+
+func (dw *DualWrite) SetNodeNAT(n *p2p_storage.NodeNAT) (e error) {
+	return dw.write("SetNodeNAT", func(ds p2p_storage.IDataSource) error { return ds.(p2p_storage.INATStore).SetNodeNAT(n) })
+}
+
+func (dw *DualWrite) GetIngest(ticket uint64) (p *p2p_storage.PendingIngest, e error) {
+	return dw.primary().(p2p_storage.IIngestStore).GetIngest(ticket)
+}
+
+func (dw *DualWrite) GetPendingIngest(md5 string) (p *p2p_storage.PendingIngest, e error) {
+	return dw.primary().(p2p_storage.IIngestStore).GetPendingIngest(md5)
+}
+
+func (dw *DualWrite) GetPendingIngests(after uint64, num int) (ps []p2p_storage.PendingIngest, e error) {
+	return dw.primary().(p2p_storage.IIngestStore).GetPendingIngests(after, num)
+}
+
+func (dw *DualWrite) UpdateIngest(p *p2p_storage.PendingIngest) (e error) {
+	return dw.write("UpdateIngest", func(ds p2p_storage.IDataSource) error { return ds.(p2p_storage.IIngestStore).UpdateIngest(p) })
+}
+
+func (dw *DualWrite) DeleteIngests(before int64) (e error) {
+	return dw.write("DeleteIngests", func(ds p2p_storage.IDataSource) error { return ds.(p2p_storage.IIngestStore).DeleteIngests(before) })
+}
+
+func (dw *DualWrite) GetIngestStats() (stats p2p_storage.IngestStats, e error) {
+	return dw.primary().(p2p_storage.IIngestStore).GetIngestStats()
+}
+
+func (dw *DualWrite) AddNodeSample(s *p2p_storage.NodeSample) (e error) {
+	return dw.write("AddNodeSample", func(ds p2p_storage.IDataSource) error { return ds.(p2p_storage.INodeHistoryStore).AddNodeSample(s) })
+}
+
+func (dw *DualWrite) GetNodeSamples(nid string, from, to int64) (samples []p2p_storage.NodeSample, e error) {
+	return dw.primary().(p2p_storage.INodeHistoryStore).GetNodeSamples(nid, from, to)
+}
+
+func (dw *DualWrite) AddNodeOnline(nid string, tm, gap int64) (e error) {
+	return dw.write("AddNodeOnline", func(ds p2p_storage.IDataSource) error {
+		return ds.(p2p_storage.INodeHistoryStore).AddNodeOnline(nid, tm, gap)
+	})
+}
+
+func (dw *DualWrite) GetNodeOnline(nid string, from, to int64) (periods []p2p_storage.OnlineInterval, e error) {
+	return dw.primary().(p2p_storage.INodeHistoryStore).GetNodeOnline(nid, from, to)
+}
+
+func (dw *DualWrite) CompactNodeHistory(before, span, expire int64) (e error) {
+	return dw.write("CompactNodeHistory", func(ds p2p_storage.IDataSource) error {
+		return ds.(p2p_storage.INodeHistoryStore).CompactNodeHistory(before, span, expire)
+	})
+}
@@ -0,0 +1,548 @@
+package p2p_storage
+
+import (
+	"fmt"
+	"yh_pkg/service"
+	"yh_pkg/time"
+	"yh_pkg/trace"
+	"yunhui/redis_db"
+)
+
+//租户的存储桶中的对象，对象名指向p2p存储中的文件，多个对象可以指向同一个md5
+type Object struct {
+	Tenant string `json:"tenant"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"` //对象名
+	MD5    string `json:"md5"`
+	Size   uint64 `json:"size"`
+	Tm     int64  `json:"tm"` //写入时间，秒数
+
+	//生命周期，为空时使用存储桶的策略，见policy.go
+	Tier     int   `json:"tier,omitempty"`      //耐久等级
+	Priority int   `json:"priority,omitempty"`  //优先级，同一个文件的多个对象取修复更优先的
+	ExpireTm int64 `json:"expire_tm,omitempty"` //过期时间，秒数，0表示不过期
+	RetainTm int64 `json:"retain_tm,omitempty"` //保留截止时间，秒数
+}
+
+//租户配额，0表示不限制
+type Quota struct {
+	MaxBytes uint64 `json:"max_bytes"`
+	MaxFiles uint64 `json:"max_files"`
+}
+
+//租户用量，按对象计算，同一个md5被多个对象引用时每个对象都计入
+type Usage struct {
+	Tenant string `json:"tenant"`
+	Bytes  uint64 `json:"bytes"`
+	Files  uint64 `json:"files"`
+	Quota  Quota  `json:"quota"`
+}
+
+//直接添加（AddP2PFile、AddP2PFileWithPolicy）的文件作为这个保留租户中的对象计入引用计数、用量和配额，对象名为md5，见addDirectFile
+const (
+	DIRECT_TENANT = "_direct"
+	DIRECT_BUCKET = "files"
+)
+
+/*
+	命名空间存储，实现可以与IDataSource使用同一个数据库，IDataSource同时实现该接口时Init会自动使用。
+	对象、引用计数和用量的修改由调用方加锁保证一致。
+*/
+type INamespaceStore interface {
+	//存储桶已存在时返回false
+	CreateBucket(tenant, bucket string) (ok bool, e error)
+	//存储桶不存在或不为空时返回false
+	DeleteBucket(tenant, bucket string) (ok bool, e error)
+	IsBucketExist(tenant, bucket string) (exist bool, e error)
+	GetBuckets(tenant string) (buckets []string, e error)
+
+	//不存在时返回nil,nil
+	GetObject(tenant, bucket, key string) (obj *Object, e error)
+	//已存在时覆盖
+	PutObject(obj *Object) (e error)
+	DeleteObject(tenant, bucket, key string) (e error)
+	/*
+		按对象名升序分页获取存储桶中的对象
+
+		参数：
+			from: 只返回对象名大于from的对象，第一页为空
+			num: 最多返回的数量
+	*/
+	GetObjects(tenant, bucket, from string, num int) (objs []Object, e error)
+	//所有租户中ExpireTm不为0且不晚于before的对象，按ExpireTm升序，最多num个
+	GetExpiredObjects(before int64, num int) (objs []Object, e error)
+
+	/*
+		修改文件的引用计数
+
+		返回值：
+			refs: 修改后的引用计数
+	*/
+	IncrFileRef(md5 string, delta int64) (refs int64, e error)
+	GetFileRef(md5 string) (refs int64, e error)
+
+	//修改租户用量，bytes和files可以为负数
+	IncrUsage(tenant string, bytes, files int64) (e error)
+	//没有用量的租户返回零值
+	GetUsage(tenant string) (usage Usage, e error)
+	SetQuota(tenant string, quota Quota) (e error)
+	//有用量或配额的所有租户
+	GetTenants() (tenants []string, e error)
+}
+
+var nsStore INamespaceStore
+
+//设置命名空间存储，为nil时不能使用对象相关的函数，DeleteFile不检查引用计数
+func SetNamespaceStore(ns INamespaceStore) {
+	nsStore = ns
+}
+
+func checkNamespace() (e error) {
+	if nsStore == nil {
+		return service.NewError(service.ERR_INTERNAL, "namespace store not set")
+	}
+	return
+}
+
+func (ds *DataSource) lock(key string) (e error) {
+	if !ds.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, key, P2pLockExpireSec, P2pGetLockTimeOut) {
+		return service.NewSimpleError(service.ERR_PERMISSION_DENIED, "get lock "+key+" error")
+	}
+	return
+}
+
+func (ds *DataSource) unlock(key string) {
+	if e := ds.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, key); e != nil {
+		logger.AppendObj(e, "P2pLock-unlock is error", key)
+	}
+}
+
+//租户名不能为空，也不能是保留的DIRECT_TENANT
+func checkTenant(tenant string) (e error) {
+	if tenant == "" || tenant == DIRECT_TENANT {
+		return service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("invalid tenant %q", tenant))
+	}
+	return
+}
+
+func tenantLockKey(tenant string) string {
+	return "p2p_tenant_" + tenant
+}
+
+func fileRefLockKey(md5 string) string {
+	return "p2p_file_ref_" + md5
+}
+
+func CreateBucket(tenant, bucket string) (e error) {
+	defer trace.Begin("p2p_storage.CreateBucket").SetAttr("tenant", tenant).SetAttr("bucket", bucket).End(&e)
+	if e = checkNamespace(); e != nil {
+		return
+	}
+	if e = checkTenant(tenant); e != nil {
+		return
+	}
+	if bucket == "" {
+		return service.NewError(service.ERR_INVALID_PARAM, "empty bucket")
+	}
+	ok, e := nsStore.CreateBucket(tenant, bucket)
+	if e == nil && !ok {
+		e = service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("bucket %s/%s already exists", tenant, bucket))
+	}
+	return
+}
+
+//删除存储桶，存储桶中还有对象时返回错误
+func DeleteBucket(tenant, bucket string) (e error) {
+	defer trace.Begin("p2p_storage.DeleteBucket").SetAttr("tenant", tenant).SetAttr("bucket", bucket).End(&e)
+	if e = checkNamespace(); e != nil {
+		return
+	}
+	ok, e := nsStore.DeleteBucket(tenant, bucket)
+	if e == nil && !ok {
+		e = service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("bucket %s/%s not found or not empty", tenant, bucket))
+	}
+	return
+}
+
+func GetBuckets(tenant string) (buckets []string, e error) {
+	defer trace.Begin("p2p_storage.GetBuckets").SetAttr("tenant", tenant).End(&e)
+	if e = checkNamespace(); e != nil {
+		return
+	}
+	return nsStore.GetBuckets(tenant)
+}
+
+func SetQuota(tenant string, quota Quota) (e error) {
+	defer trace.Begin("p2p_storage.SetQuota").SetAttr("tenant", tenant).End(&e)
+	if e = checkNamespace(); e != nil {
+		return
+	}
+	return nsStore.SetQuota(tenant, quota)
+}
+
+func GetUsage(tenant string) (usage Usage, e error) {
+	defer trace.Begin("p2p_storage.GetUsage").SetAttr("tenant", tenant).End(&e)
+	if e = checkNamespace(); e != nil {
+		return
+	}
+	return nsStore.GetUsage(tenant)
+}
+
+//所有租户的用量和配额
+func GetUsageReport() (report []Usage, e error) {
+	defer trace.Begin("p2p_storage.GetUsageReport").End(&e)
+	if e = checkNamespace(); e != nil {
+		return
+	}
+	tenants, e := nsStore.GetTenants()
+	if e != nil {
+		return
+	}
+	report = make([]Usage, 0, len(tenants))
+	for _, tenant := range tenants {
+		usage, e := nsStore.GetUsage(tenant)
+		if e != nil {
+			return nil, e
+		}
+		report = append(report, usage)
+	}
+	return
+}
+
+func GetObject(tenant, bucket, key string) (obj *Object, e error) {
+	defer trace.Begin("p2p_storage.GetObject").SetAttr("tenant", tenant).SetAttr("bucket", bucket).End(&e)
+	if e = checkNamespace(); e != nil {
+		return
+	}
+	return nsStore.GetObject(tenant, bucket, key)
+}
+
+func GetObjects(tenant, bucket, from string, num int) (objs []Object, e error) {
+	defer trace.Begin("p2p_storage.GetObjects").SetAttr("tenant", tenant).SetAttr("bucket", bucket).End(&e)
+	if e = checkNamespace(); e != nil {
+		return
+	}
+	return nsStore.GetObjects(tenant, bucket, from, num)
+}
+
+/*
+	把文件作为租户存储桶中的对象添加到p2p系统，检查租户配额后调用AddP2PFile，并增加文件的引用计数。
+	对象名已存在时替换原来的对象，原来的文件没有其他引用时删除。
+
+	对象名已存在且在保留期内时返回ERR_P2P_FILE_RETAINED。
+
+	参数：
+		obj: 对象，Tm可以为空，生命周期为空时使用存储桶的策略，可以用obj.SetPolicy设置
+		其他参数与AddP2PFile相同
+	返回值：
+		与AddP2PFile相同，文件已存在或正在添加时同样返回ERR_P2P_FILE_ALREADY_EXIST或ERR_P2P_TASK_OTHER_NODE_DOING，
+		但对象已经添加
+*/
+func AddP2PObject(obj *Object, src_node string, times int, add_no_source_file bool) (task_id int64, e error) {
+	return WithSpan(nil).AddP2PObject(obj, src_node, times, add_no_source_file)
+}
+
+func (c Caller) AddP2PObject(obj *Object, src_node string, times int, add_no_source_file bool) (task_id int64, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.AddP2PObject")
+	defer span.SetAttr("src_node", src_node).End(&e)
+	if e = checkNamespace(); e != nil {
+		return
+	}
+	if e = checkTenant(obj.Tenant); e != nil {
+		return
+	}
+	exist, e := nsStore.IsBucketExist(obj.Tenant, obj.Bucket)
+	if e != nil {
+		return
+	}
+	if !exist {
+		return 0, service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("bucket %s/%s not found", obj.Tenant, obj.Bucket))
+	}
+	if obj.Key == "" {
+		return 0, service.NewError(service.ERR_INVALID_PARAM, "empty object key")
+	}
+	if obj.MD5, e = WithSpan(span).ResolveFileKey(obj.MD5); e != nil {
+		return
+	}
+	now := time.Now.Unix()
+	if e = fillObjectPolicy(obj, now); e != nil {
+		return
+	}
+	if obj.Tier < 0 || obj.Tier >= len(DURABILITY_TIERS) {
+		return 0, service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("invalid durability tier %d", obj.Tier))
+	}
+	if e = checkPriority(obj.Priority); e != nil {
+		return
+	}
+	if e = source.lock(tenantLockKey(obj.Tenant)); e != nil {
+		return
+	}
+	defer source.unlock(tenantLockKey(obj.Tenant))
+
+	old, e := nsStore.GetObject(obj.Tenant, obj.Bucket, obj.Key)
+	if e != nil {
+		return
+	}
+	if old != nil && old.RetainTm > now {
+		return 0, retainedError(fmt.Sprintf("object %s/%s/%s", obj.Tenant, obj.Bucket, obj.Key), old.RetainTm)
+	}
+	bytes, files := int64(obj.Size), int64(1)
+	if old != nil {
+		bytes, files = bytes-int64(old.Size), 0
+	}
+	if e = checkQuota(obj.Tenant, bytes, files); e != nil {
+		return
+	}
+
+	refAdded := old == nil || old.MD5 != obj.MD5
+	if refAdded {
+		task_id, e = source.addFileRef(obj, src_node, times, add_no_source_file)
+	} else {
+		//对象不变，只重新添加文件
+		task_id, e = source.addP2PFile(obj.MD5, src_node, obj.Size, times, add_no_source_file, obj.Tier, obj.Priority)
+	}
+	if e != nil && !isFileAdded(e) {
+		return
+	}
+	//对象没有记录时撤销addFileRef增加的引用计数，否则文件一直被引用，不能删除
+	undoRef := func() {
+		if refAdded {
+			source.undoFileRef(obj.MD5)
+		}
+	}
+	if err := mergeFilePriority(obj.MD5, obj.Priority, e != nil || !refAdded); err != nil {
+		undoRef()
+		return 0, err
+	}
+	if obj.Tm == 0 {
+		obj.Tm = now
+	}
+	if err := nsStore.PutObject(obj); err != nil {
+		undoRef()
+		return 0, err
+	}
+	if err := nsStore.IncrUsage(obj.Tenant, bytes, files); err != nil {
+		undoPutObject(obj, old)
+		undoRef()
+		return 0, err
+	}
+	if ticket, queued := IngestTicket(e); queued {
+		if err := source.addIngestObject(ticket, obj.MD5, IngestObject{obj.Tenant, obj.Bucket, obj.Key}); err != nil {
+			return 0, err
+		}
+	}
+	if old != nil && old.MD5 != obj.MD5 {
+		if err := source.releaseFileRef(old.MD5); err != nil {
+			return 0, err
+		}
+	}
+	return
+}
+
+//增加bytes和files后超过租户配额时返回ERR_P2P_QUOTA_EXCEEDED
+func checkQuota(tenant string, bytes, files int64) (e error) {
+	usage, e := nsStore.GetUsage(tenant)
+	if e != nil {
+		return
+	}
+	if q := usage.Quota; q.MaxBytes > 0 && bytes > 0 && usage.Bytes+uint64(bytes) > q.MaxBytes ||
+		q.MaxFiles > 0 && files > 0 && usage.Files+uint64(files) > q.MaxFiles {
+		return service.NewError(service.ERR_P2P_QUOTA_EXCEEDED, fmt.Sprintf("quota of tenant %s exceeded, usage %d bytes %d files, quota %d bytes %d files",
+			tenant, usage.Bytes, usage.Files, q.MaxBytes, q.MaxFiles))
+	}
+	return
+}
+
+/*
+	直接添加文件。设置了命名空间存储时，第一次添加的文件在DIRECT_TENANT中记为一个对象，
+	受DIRECT_TENANT的配额限制，并计入文件的引用计数，所以其他对象全部删除后文件仍然保留，DeleteFile时才删除。
+	直接添加是热路径，只加文件的锁不加租户的锁，并发添加时用量可能略微超过配额。
+	其他参数和返回值与addP2PFile相同
+*/
+func (ds *DataSource) addDirectFile(md5, src_node string, size uint64, times int, add_no_source_file bool, tier, priority int) (task_id int64, e error) {
+	if nsStore == nil {
+		return ds.addP2PFile(md5, src_node, size, times, add_no_source_file, tier, priority)
+	}
+	if md5, e = ResolveFileKey(md5); e != nil {
+		return
+	}
+	if e = ds.lock(fileRefLockKey(md5)); e != nil {
+		return
+	}
+	defer ds.unlock(fileRefLockKey(md5))
+	old, e := nsStore.GetObject(DIRECT_TENANT, DIRECT_BUCKET, md5)
+	if e != nil {
+		return
+	}
+	if old != nil {
+		return ds.addP2PFile(md5, src_node, size, times, add_no_source_file, tier, priority)
+	}
+	if e = checkQuota(DIRECT_TENANT, int64(size), 1); e != nil {
+		return
+	}
+	task_id, e = ds.addP2PFile(md5, src_node, size, times, add_no_source_file, tier, priority)
+	if e != nil && !isFileAdded(e) {
+		return
+	}
+	obj := &Object{Tenant: DIRECT_TENANT, Bucket: DIRECT_BUCKET, Key: md5, MD5: md5, Size: size, Tm: time.Now.Unix(), Tier: tier, Priority: priority}
+	if _, err := nsStore.CreateBucket(DIRECT_TENANT, DIRECT_BUCKET); err != nil {
+		return 0, err
+	}
+	//先增加引用计数，记录对象失败时减少回去，已经持有文件的锁
+	if _, err := nsStore.IncrFileRef(md5, 1); err != nil {
+		return 0, err
+	}
+	if err := nsStore.PutObject(obj); err != nil {
+		undoIncrFileRef(md5)
+		return 0, err
+	}
+	if err := nsStore.IncrUsage(DIRECT_TENANT, int64(size), 1); err != nil {
+		undoPutObject(obj, nil)
+		undoIncrFileRef(md5)
+		return 0, err
+	}
+	if ticket, queued := IngestTicket(e); queued {
+		if err := ds.addIngestObject(ticket, md5, IngestObject{DIRECT_TENANT, DIRECT_BUCKET, md5}); err != nil {
+			return 0, err
+		}
+	}
+	return
+}
+
+//DeleteFile时删除直接添加的记录和文件，还有其他对象引用时不删除并返回ERR_P2P_FILE_REFERENCED
+func (ds *DataSource) deleteDirectFile(md5 string) (e error) {
+	if e = ds.lock(fileRefLockKey(md5)); e != nil {
+		return
+	}
+	defer ds.unlock(fileRefLockKey(md5))
+	obj, e := nsStore.GetObject(DIRECT_TENANT, DIRECT_BUCKET, md5)
+	if e != nil {
+		return
+	}
+	refs, e := nsStore.GetFileRef(md5)
+	if e != nil {
+		return
+	}
+	if obj != nil {
+		refs--
+	}
+	if refs > 0 {
+		return service.NewError(service.ERR_P2P_FILE_REFERENCED, fmt.Sprintf("file %s is referenced by %d objects", md5, refs))
+	}
+	if obj != nil {
+		if e = nsStore.DeleteObject(DIRECT_TENANT, DIRECT_BUCKET, md5); e != nil {
+			return
+		}
+		if e = nsStore.IncrUsage(DIRECT_TENANT, -int64(obj.Size), -1); e != nil {
+			return
+		}
+		if _, e = nsStore.IncrFileRef(md5, -1); e != nil {
+			return
+		}
+	}
+	return ds.deleteFile(md5)
+}
+
+//删除对象，文件没有其他引用时从p2p系统删除，在保留期内时返回ERR_P2P_FILE_RETAINED
+func DeleteObject(tenant, bucket, key string) (e error) {
+	return WithSpan(nil).DeleteObject(tenant, bucket, key)
+}
+
+func (c Caller) DeleteObject(tenant, bucket, key string) (e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.DeleteObject")
+	defer span.SetAttr("tenant", tenant).SetAttr("bucket", bucket).End(&e)
+	if e = checkNamespace(); e != nil {
+		return
+	}
+	if e = checkTenant(tenant); e != nil {
+		return
+	}
+	if e = source.lock(tenantLockKey(tenant)); e != nil {
+		return
+	}
+	defer source.unlock(tenantLockKey(tenant))
+
+	obj, e := nsStore.GetObject(tenant, bucket, key)
+	if e != nil {
+		return
+	}
+	if obj == nil {
+		return service.NewError(service.ERR_P2P_FILE_NOT_FOUND, fmt.Sprintf("object %s/%s/%s not found", tenant, bucket, key))
+	}
+	if obj.RetainTm > time.Now.Unix() {
+		return retainedError(fmt.Sprintf("object %s/%s/%s", tenant, bucket, key), obj.RetainTm)
+	}
+	if e = nsStore.DeleteObject(tenant, bucket, key); e != nil {
+		return
+	}
+	if e = nsStore.IncrUsage(tenant, -int64(obj.Size), -1); e != nil {
+		return
+	}
+	return source.releaseFileRef(obj.MD5)
+}
+
+//添加文件并增加引用计数，添加失败时不增加
+func (ds *DataSource) addFileRef(obj *Object, src_node string, times int, add_no_source_file bool) (task_id int64, e error) {
+	if e = ds.lock(fileRefLockKey(obj.MD5)); e != nil {
+		return
+	}
+	defer ds.unlock(fileRefLockKey(obj.MD5))
+	task_id, e = ds.addP2PFile(obj.MD5, src_node, obj.Size, times, add_no_source_file, obj.Tier, obj.Priority)
+	if e != nil && !isFileAdded(e) {
+		return
+	}
+	if _, err := nsStore.IncrFileRef(obj.MD5, 1); err != nil {
+		return 0, err
+	}
+	return
+}
+
+//撤销addFileRef增加的引用计数，失败时只写日志
+func (ds *DataSource) undoFileRef(md5 string) {
+	if e := ds.lock(fileRefLockKey(md5)); e != nil {
+		logger.AppendObj(e, "undoFileRef-lock error", md5)
+		return
+	}
+	defer ds.unlock(fileRefLockKey(md5))
+	undoIncrFileRef(md5)
+}
+
+//减少引用计数，调用方需要持有文件的锁
+func undoIncrFileRef(md5 string) {
+	if _, e := nsStore.IncrFileRef(md5, -1); e != nil {
+		logger.AppendObj(e, "undoIncrFileRef-IncrFileRef error", md5)
+	}
+}
+
+//撤销写入的对象：old为nil时删除，否则恢复为old。失败时只写日志
+func undoPutObject(obj, old *Object) {
+	var e error
+	if old == nil {
+		e = nsStore.DeleteObject(obj.Tenant, obj.Bucket, obj.Key)
+	} else {
+		e = nsStore.PutObject(old)
+	}
+	if e != nil {
+		logger.AppendObj(e, "undoPutObject error", obj.Tenant, obj.Bucket, obj.Key)
+	}
+}
+
+//文件已经存在、正在被其他节点添加或者已经进入延迟添加队列，对象可以直接引用
+func isFileAdded(e error) bool {
+	err, ok := e.(service.Error)
+	return ok && (err.Code == service.ERR_P2P_FILE_ALREADY_EXIST || err.Code == service.ERR_P2P_TASK_OTHER_NODE_DOING || err.Code == service.ERR_P2P_INGEST_QUEUED)
+}
+
+//减少引用计数，最后一个引用删除时从p2p系统删除文件
+func (ds *DataSource) releaseFileRef(md5 string) (e error) {
+	if e = ds.lock(fileRefLockKey(md5)); e != nil {
+		return
+	}
+	defer ds.unlock(fileRefLockKey(md5))
+	refs, e := nsStore.IncrFileRef(md5, -1)
+	if e != nil || refs > 0 {
+		return
+	}
+	logger.AppendObj(nil, "releaseFileRef-last reference removed", md5)
+	return ds.deleteFile(md5)
+}
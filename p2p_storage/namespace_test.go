@@ -0,0 +1,174 @@
+package p2p_storage_test
+
+import (
+	"errors"
+	"testing"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+)
+
+//对象计入租户的用量和配额，被引用的文件不能直接删除，最后一个引用删除后文件才删除
+func TestObject(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	const m1, m2 = "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+	for _, tenant := range []string{"t1", "t2"} {
+		if e := p2p_storage.CreateBucket(tenant, "photos"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	p2p_storage.SetQuota("t1", p2p_storage.Quota{MaxFiles: 2})
+	objects := []p2p_storage.Object{
+		{Tenant: "t1", Bucket: "photos", Key: "a", MD5: m1, Size: 4096},
+		{Tenant: "t1", Bucket: "photos", Key: "b", MD5: m1, Size: 4096},
+		{Tenant: "t2", Bucket: "photos", Key: "x", MD5: m1, Size: 4096},
+		//覆盖已有的对象
+		{Tenant: "t1", Bucket: "photos", Key: "a", MD5: m2, Size: 4096},
+	}
+	for i := range objects {
+		f.addObject(&objects[i])
+	}
+	over := &p2p_storage.Object{Tenant: "t1", Bucket: "photos", Key: "c", MD5: m2, Size: 4096}
+	if _, e := p2p_storage.AddP2PObject(over, "n01", 0, false); errCode(e) != service.ERR_P2P_QUOTA_EXCEEDED {
+		t.Errorf("quota not enforced: %v", e)
+	}
+	if u, _ := p2p_storage.GetUsage("t1"); u.Files != 2 || u.Bytes != 2*4096 {
+		t.Errorf("usage of t1: %+v", u)
+	}
+	if refs, _ := f.ds.GetFileRef(m1); refs != 2 {
+		t.Errorf("refs of %s: %d, want 2", m1, refs)
+	}
+
+	if e := p2p_storage.DeleteFile(m1); errCode(e) != service.ERR_P2P_FILE_REFERENCED {
+		t.Errorf("DeleteFile referenced file: %v", e)
+	}
+	for _, obj := range objects[1:] {
+		if len(f.groups(obj.MD5)) == 0 {
+			t.Errorf("file %s deleted before %s/%s", obj.MD5, obj.Tenant, obj.Key)
+		}
+		if e := p2p_storage.DeleteObject(obj.Tenant, obj.Bucket, obj.Key); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if len(f.groups(m1)) > 0 || len(f.groups(m2)) > 0 {
+		t.Error("file not deleted after last reference removed")
+	}
+	report, e := p2p_storage.GetUsageReport()
+	if e != nil || len(report) != 2 || report[0].Tenant != "t1" || report[0].Files != 0 || report[0].Bytes != 0 || report[0].Quota.MaxFiles != 2 {
+		t.Errorf("usage report: %+v %v", report, e)
+	}
+}
+
+//直接添加的文件计入引用计数和DIRECT_TENANT的配额，对象删除后仍然保留
+func TestDirectFile(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	const m1, m2 = "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+	p2p_storage.SetQuota(p2p_storage.DIRECT_TENANT, p2p_storage.Quota{MaxFiles: 1})
+	for i := 0; i < 2; i++ {
+		f.addFile(m1, nil)
+	}
+	if _, e := p2p_storage.AddP2PFile(m2, "n01", 4096, 0, false); errCode(e) != service.ERR_P2P_QUOTA_EXCEEDED {
+		t.Errorf("quota not enforced: %v", e)
+	}
+	if u, _ := p2p_storage.GetUsage(p2p_storage.DIRECT_TENANT); u.Files != 1 || u.Bytes != 4096 {
+		t.Errorf("usage of direct files: %+v", u)
+	}
+	if e := p2p_storage.CreateBucket(p2p_storage.DIRECT_TENANT, "photos"); errCode(e) != service.ERR_INVALID_PARAM {
+		t.Errorf("CreateBucket in reserved tenant: %v", e)
+	}
+
+	p2p_storage.CreateBucket("t1", "photos")
+	f.addObject(&p2p_storage.Object{Tenant: "t1", Bucket: "photos", Key: "a", MD5: m1, Size: 4096})
+	if refs, _ := f.ds.GetFileRef(m1); refs != 2 {
+		t.Errorf("refs %d, want 2", refs)
+	}
+	if e := p2p_storage.DeleteFile(m1); errCode(e) != service.ERR_P2P_FILE_REFERENCED {
+		t.Errorf("DeleteFile referenced file: %v", e)
+	}
+	if e := p2p_storage.DeleteObject("t1", "photos", "a"); e != nil {
+		t.Fatal(e)
+	}
+	if len(f.groups(m1)) == 0 {
+		t.Error("direct file deleted with the last object")
+	}
+	if e := p2p_storage.DeleteFile(m1); e != nil {
+		t.Fatal(e)
+	}
+	if len(f.groups(m1)) > 0 {
+		t.Error("file not deleted")
+	}
+	if u, _ := p2p_storage.GetUsage(p2p_storage.DIRECT_TENANT); u.Files != 0 || u.Bytes != 0 {
+		t.Errorf("usage after DeleteFile: %+v", u)
+	}
+	if refs, _ := f.ds.GetFileRef(m1); refs != 0 {
+		t.Errorf("refs %d after DeleteFile", refs)
+	}
+}
+
+//写入失败的命名空间存储
+type failNamespace struct {
+	p2p_storage.INamespaceStore
+	fail string
+}
+
+func (ns failNamespace) PutObject(obj *p2p_storage.Object) (e error) {
+	if ns.fail == "PutObject" {
+		return errors.New("put failed")
+	}
+	return ns.INamespaceStore.PutObject(obj)
+}
+
+func (ns failNamespace) IncrUsage(tenant string, bytes, files int64) (e error) {
+	if ns.fail == "IncrUsage" {
+		return errors.New("incr failed")
+	}
+	return ns.INamespaceStore.IncrUsage(tenant, bytes, files)
+}
+
+//对象没能记录时撤销增加的引用计数和写入的对象，文件仍然可以删除
+func TestAddObjectRollback(t *testing.T) {
+	const m1, m2 = "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+	for _, fail := range []string{"PutObject", "IncrUsage"} {
+		t.Run(fail, func(t *testing.T) {
+			f := newFixture(t)
+			f.setAvailable()
+			p2p_storage.CreateBucket("t1", "photos")
+			f.addObject(&p2p_storage.Object{Tenant: "t1", Bucket: "photos", Key: "a", MD5: m1, Size: 4096})
+			p2p_storage.SetNamespaceStore(failNamespace{f.ds, fail})
+			objects := []p2p_storage.Object{
+				{Tenant: "t1", Bucket: "photos", Key: "b", MD5: m2, Size: 4096},
+				//覆盖已有的对象
+				{Tenant: "t1", Bucket: "photos", Key: "a", MD5: m2, Size: 4096},
+			}
+			for i := range objects {
+				if _, e := p2p_storage.AddP2PObject(&objects[i], "n01", 0, false); e == nil {
+					t.Errorf("add %s: no error", objects[i].Key)
+				}
+			}
+			if _, e := p2p_storage.AddP2PFile(m2, "n01", 4096, 0, false); e == nil {
+				t.Error("add direct file: no error")
+			}
+			p2p_storage.SetNamespaceStore(f.ds)
+
+			if refs, _ := f.ds.GetFileRef(m2); refs != 0 {
+				t.Errorf("refs of %s: %d, want 0", m2, refs)
+			}
+			if obj, _ := f.ds.GetObject("t1", "photos", "b"); obj != nil {
+				t.Errorf("object b left: %+v", obj)
+			}
+			if obj, _ := f.ds.GetObject("t1", "photos", "a"); obj == nil || obj.MD5 != m1 {
+				t.Errorf("object a not restored: %+v", obj)
+			}
+			if e := p2p_storage.DeleteFile(m2); e != nil {
+				t.Error(e)
+			}
+			if e := p2p_storage.DeleteObject("t1", "photos", "a"); e != nil {
+				t.Fatal(e)
+			}
+			if u, _ := p2p_storage.GetUsage("t1"); u.Files != 0 || u.Bytes != 0 {
+				t.Errorf("usage of t1: %+v", u)
+			}
+		})
+	}
+}
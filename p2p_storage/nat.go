@@ -0,0 +1,231 @@
+package p2p_storage
+
+import (
+	"crypto/ed25519"
+	"net"
+	"sort"
+	"yh_pkg/service"
+	"yh_pkg/time"
+	"yh_pkg/trace"
+)
+
+/*
+	节点NAT类型的检测结果。节点上报的NATType只是节点自己的判断，节点用yh_pkg/net中的DetectNAT向Reflector检测后，
+	由Reflector判断类型并反向连接节点的服务端口，协调服务在Reflector的OnResult中调用RecordNodeNAT记录。
+	节点的报告用登记的公钥校验，Reflector只反向连接节点当前的服务端口：
+		net.NewReflector(net.ReflectorConfig{..., LookupNode: p2p_storage.LookupNATNode, OnResult: func(r *net.NATResult) {
+			p2p_storage.RecordNodeNAT(&p2p_storage.NodeNAT{Node: r.Node, Type: r.Type, Mapped: r.Mapped, Port: int32(r.Port), Reachable: r.Reachable, Tm: r.Tm})
+		}})
+	有效期内的检测结果覆盖节点上报的NATType和UPNPAvailable，用于选择代理节点和下载节点的排序。
+*/
+//与yh_pkg/net中的NAT类型一致，1和2也是节点上报的NATType中可以直接连接的类型
+const (
+	NAT_UNKNOWN         int8 = 0
+	NAT_OPEN            int8 = 1
+	NAT_FULL_CONE       int8 = 2
+	NAT_RESTRICTED      int8 = 3
+	NAT_PORT_RESTRICTED int8 = 4
+	NAT_SYMMETRIC       int8 = 5
+	NAT_BLOCKED         int8 = 6
+)
+
+const (
+	NAT_VERIFY_VALID_TIME    int64 = 24 * 3600 //检测结果的有效期（秒）
+	DELEGATE_CANDIDATE_RATIO       = 2         //选择代理节点时多取的候选节点倍数，用于过滤检测不可连接的节点
+)
+
+type NodeNAT struct {
+	Node      string `json:"node"`
+	Type      int8   `json:"type"`
+	Mapped    string `json:"mapped"`    //Reflector看到的映射地址
+	Port      int32  `json:"port"`      //反向连接的端口，0表示没有检查
+	Reachable bool   `json:"reachable"` //反向连接是否成功
+	Tm        int64  `json:"tm"`
+}
+
+/*
+	节点NAT检测结果的存储，IDataSource同时实现该接口时Init会自动使用。没有设置时只使用节点上报的NATType。
+*/
+type INATStore interface {
+	//没有检测结果的节点不在返回结果中
+	GetNodeNATs(ids []string) (nats map[string]*NodeNAT, e error)
+	SetNodeNAT(n *NodeNAT) (e error)
+}
+
+var natStore INATStore
+
+//设置NAT检测结果的存储，覆盖Init时自动检测的结果
+func SetNATStore(s INATStore) {
+	natStore = s
+}
+
+/*
+	记录Reflector的检测结果，同时更新节点详情中的NATType和UPNPAvailable
+
+	返回值：
+		e: 没有设置存储时为ERR_INTERNAL，节点不存在时为ERR_NOT_FOUND
+*/
+func RecordNodeNAT(n *NodeNAT) (e error) {
+	source, span := beginSpan(nil, "p2p_storage.RecordNodeNAT")
+	defer span.End(&e)
+	if natStore == nil {
+		return service.NewError(service.ERR_INTERNAL, "nat store not set")
+	}
+	//与心跳、ReportRelay更新节点详情互斥
+	if e = source.lock(nodeLockKey(n.Node)); e != nil {
+		return
+	}
+	defer source.unlock(nodeLockKey(n.Node))
+	details, e := source.Raw.GetNodesByIds([]string{n.Node})
+	if e != nil {
+		return
+	}
+	if len(details) == 0 {
+		return service.NewError(service.ERR_NOT_FOUND, "node "+n.Node+" not found")
+	}
+	if n.Tm == 0 {
+		n.Tm = time.Now.Unix()
+	}
+	if e = natStore.SetNodeNAT(n); e != nil {
+		return
+	}
+	detail := &details[0]
+	if applyVerifiedNAT(&detail.Peer, n) {
+		e = source.Raw.UpdateNode(detail)
+	}
+	return
+}
+
+/*
+	Reflector校验检测报告时查找节点，用作net.ReflectorConfig.LookupNode
+
+	返回值：
+		key: 节点登记的公钥，没有登记时为nil
+		port: 节点当前的服务端口
+		e: 节点不存在时为ERR_NOT_FOUND
+*/
+func LookupNATNode(nid string) (key ed25519.PublicKey, port int, e error) {
+	source, span := beginSpan(nil, "p2p_storage.LookupNATNode")
+	defer span.SetAttr("nid", nid).End(&e)
+	if keyStore == nil {
+		return nil, 0, service.NewError(service.ERR_INTERNAL, "node key store not set")
+	}
+	details, e := source.Raw.GetNodesByIds([]string{nid})
+	if e != nil {
+		return
+	}
+	if len(details) == 0 {
+		return nil, 0, service.NewError(service.ERR_NOT_FOUND, "node "+nid+" not found")
+	}
+	k, e := keyStore.GetNodeKey(nid)
+	if e != nil || k == nil {
+		return nil, 0, e
+	}
+	return ed25519.PublicKey(k), int(details[0].Port), nil
+}
+
+//节点的检测结果，没有时返回nil
+func GetNodeNAT(nid string) (n *NodeNAT, e error) {
+	defer trace.Begin("p2p_storage.GetNodeNAT").SetAttr("nid", nid).End(&e)
+	if natStore == nil {
+		return
+	}
+	nats, e := natStore.GetNodeNATs([]string{nid})
+	if e != nil {
+		return
+	}
+	return nats[nid], nil
+}
+
+/*
+	用检测结果覆盖节点上报的信息。检测结果过期，或者检查的端口与节点当前端口不同时不使用。
+
+	返回值：
+		verified: 是否使用了检测结果
+*/
+func applyVerifiedNAT(p *Peer, n *NodeNAT) (verified bool) {
+	if n == nil || n.Tm < time.Now.Unix()-NAT_VERIFY_VALID_TIME {
+		return false
+	}
+	if n.Port == 0 {
+		//没有检查端口，按检测的类型判断
+		p.NATType = n.Type
+		p.FillUPNPAvailable()
+		return true
+	}
+	if n.Port != p.Port {
+		return false
+	}
+	p.NATType = n.Type
+	host, _, err := net.SplitHostPort(n.Mapped)
+	if n.Reachable && err == nil {
+		p.UPNPIP = host
+		p.UPNPPort = p.Port
+		p.UPNPAvailable = int8(YES)
+	} else {
+		p.UPNPAvailable = int8(NO)
+	}
+	return true
+}
+
+//批量使用检测结果，返回使用了检测结果的节点
+func applyVerifiedNATs(peers []Peer) (verified map[string]bool, e error) {
+	verified = make(map[string]bool)
+	if natStore == nil || len(peers) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(peers))
+	for i := range peers {
+		ids = append(ids, peers[i].ID)
+	}
+	nats, e := natStore.GetNodeNATs(ids)
+	if e != nil {
+		return
+	}
+	for i := range peers {
+		if applyVerifiedNAT(&peers[i], nats[peers[i].ID]) {
+			verified[peers[i].ID] = true
+		}
+	}
+	return
+}
+
+//节点更新时使用检测结果，查询失败时只使用上报的信息
+func verifyPeerNAT(p *Peer) {
+	n, e := GetNodeNAT(p.ID)
+	if e != nil {
+		logger.AppendObj(e, "GetNodeNAT error", p.ID)
+		return
+	}
+	applyVerifiedNAT(p, n)
+}
+
+//连接的难易程度，数值越小越容易连接
+func natRank(p *Peer) int {
+	if p.UPNPAvailable == int8(YES) {
+		return 0
+	}
+	switch p.NATType {
+	case NAT_OPEN, NAT_FULL_CONE:
+		return 1
+	case NAT_SYMMETRIC:
+		return 3
+	case NAT_BLOCKED:
+		return 4
+	}
+	return 2
+}
+
+//按连接的难易程度排序，同一类的节点保持原来的顺序
+func sortPeersByNAT(peers []Peer) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		return natRank(&peers[i]) < natRank(&peers[j])
+	})
+}
+
+//检测过的节点在前，同一类的节点保持原来的顺序
+func sortPeersByVerified(peers []Peer, verified map[string]bool) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		return verified[peers[i].ID] && !verified[peers[j].ID]
+	})
+}
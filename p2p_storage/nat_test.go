@@ -0,0 +1,120 @@
+package p2p_storage_test
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+)
+
+//节点在127.0.0.1:9000+i上心跳，n04和n05上报可以直接连接
+func natHeartbeat(t *testing.T) {
+	for i := 0; i < NODE_NUM; i++ {
+		p := p2p_storage.Peer{ID: fmt.Sprintf("n%02d", i), IP: "127.0.0.1", Port: int32(9000 + i)}
+		switch p.ID {
+		case "n04":
+			p.NATType = p2p_storage.NAT_OPEN
+		case "n05":
+			p.NATType = p2p_storage.NAT_FULL_CONE
+		}
+		n := &p2p_storage.Node{Peer: p, TotalSpace: 1 << 30, LeftSpace: 1 << 30, State: p2p_storage.YES}
+		if _, _, _, e := p2p_storage.UpdateNode2(n, map[string]uint64{}, nil, p2p_storage.YES); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
+
+func peerIDs(peers []p2p_storage.Peer) []string {
+	ids := make([]string, 0, len(peers))
+	for _, p := range peers {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+//Reflector只接受登记了公钥的节点的报告
+func TestLookupNATNode(t *testing.T) {
+	newFixture(t)
+	natHeartbeat(t)
+	if _, _, e := p2p_storage.LookupNATNode("none"); errCode(e) != service.ERR_NOT_FOUND {
+		t.Errorf("lookup unknown node: %v", e)
+	}
+	if key, port, e := p2p_storage.LookupNATNode("n00"); key != nil || port != 0 || e != nil {
+		t.Errorf("lookup node without key: %v %d %v", key, port, e)
+	}
+	pub, _, _ := ed25519.GenerateKey(nil)
+	if e := p2p_storage.ReEnrollNode("n00", pub); e != nil {
+		t.Fatal(e)
+	}
+	if key, port, e := p2p_storage.LookupNATNode("n00"); !key.Equal(pub) || port != 9000 || e != nil {
+		t.Errorf("lookup node: %v %d %v", key, port, e)
+	}
+}
+
+//检测结果覆盖节点上报的类型，检测的端口与当前端口不同或者结果过期时不使用
+func TestRecordNodeNAT(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	const md5 = "0123456789abcdef0123456789abcdef"
+	f.addFile(md5, nil)
+	f.sync(md5)
+	natHeartbeat(t)
+	if ds, e := p2p_storage.GetDelegates(NODE_NUM); e != nil || fmt.Sprint(peerIDs(ds)) != "[n04 n05]" {
+		t.Fatalf("delegates before detection: %v %v", peerIDs(ds), e)
+	}
+	now := time.Now().Unix()
+	cases := []struct {
+		nat     p2p_storage.NodeNAT
+		natType int8
+		upnp    int
+	}{
+		{p2p_storage.NodeNAT{Node: "n00", Type: p2p_storage.NAT_OPEN, Mapped: "127.0.0.1:9000", Port: 9000, Reachable: true}, p2p_storage.NAT_OPEN, p2p_storage.YES},
+		{p2p_storage.NodeNAT{Node: "n04", Type: p2p_storage.NAT_PORT_RESTRICTED, Mapped: "127.0.0.1:1", Port: 9004}, p2p_storage.NAT_PORT_RESTRICTED, p2p_storage.NO},
+		{p2p_storage.NodeNAT{Node: "n01", Type: p2p_storage.NAT_SYMMETRIC, Mapped: "127.0.0.1:1", Port: 9001}, p2p_storage.NAT_SYMMETRIC, p2p_storage.NO},
+		//检测的端口不是节点当前的端口
+		{p2p_storage.NodeNAT{Node: "n03", Type: p2p_storage.NAT_OPEN, Mapped: "127.0.0.1:1", Port: 1, Reachable: true}, p2p_storage.NAT_UNKNOWN, p2p_storage.NO},
+		//过期的结果
+		{p2p_storage.NodeNAT{Node: "n06", Type: p2p_storage.NAT_OPEN, Mapped: "127.0.0.1:9006", Port: 9006, Reachable: true,
+			Tm: now - p2p_storage.NAT_VERIFY_VALID_TIME - 1}, p2p_storage.NAT_UNKNOWN, p2p_storage.NO},
+	}
+	for _, c := range cases {
+		if e := p2p_storage.RecordNodeNAT(&c.nat); e != nil {
+			t.Fatal(e)
+		}
+		details, e := p2p_storage.GetNodesByIds([]string{c.nat.Node})
+		if e != nil || len(details) != 1 {
+			t.Fatal(details, e)
+		}
+		if p := details[0].Peer; p.NATType != c.natType || p.UPNPAvailable != int8(c.upnp) {
+			t.Errorf("%s: %+v", c.nat.Node, p)
+		}
+		if n, e := p2p_storage.GetNodeNAT(c.nat.Node); e != nil || n == nil || n.Type != c.nat.Type {
+			t.Errorf("GetNodeNAT(%s) = %+v %v", c.nat.Node, n, e)
+		}
+	}
+	if e := p2p_storage.RecordNodeNAT(&p2p_storage.NodeNAT{Node: "none"}); errCode(e) != service.ERR_NOT_FOUND {
+		t.Errorf("record unknown node: %v", e)
+	}
+
+	//检测过的n00在前，n04被过滤
+	ds, e := p2p_storage.GetDelegates(NODE_NUM)
+	if ids := peerIDs(ds); e != nil || fmt.Sprint(ids) != "[n00 n05]" {
+		t.Fatalf("delegates: %v %v", ids, e)
+	}
+	if ds[0].UPNPIP != "127.0.0.1" || ds[0].UPNPPort != 9000 {
+		t.Errorf("delegate address: %+v", ds[0])
+	}
+
+	//下载节点按连接的难易程度排序，对称型的n01在最后
+	nodes, _, _, e := p2p_storage.Download(md5)
+	ids := peerIDs(nodes)
+	if e != nil || len(ids) != NODE_NUM {
+		t.Fatalf("download nodes: %v %v", ids, e)
+	}
+	first := map[string]bool{ids[0]: true, ids[1]: true}
+	if !first["n00"] || !first["n05"] || ids[len(ids)-1] != "n01" {
+		t.Errorf("download order: %v", ids)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"math"
 	"math/rand"
 	"time"
+	"yh_pkg/service"
 )
 
 type Peer struct {
@@ -53,11 +54,13 @@ type NodeDetail struct {
 	UpSpeed      int64   `json:"up_speed"`       //上行带宽字节
 	Upload       int64   `json:"upload"`         //上传速度
 	Download     int64   `json:"download"`       //下载速度
-
+	RelayBytes   int64   `json:"relay_bytes"`    //作为代理转发的总字节数
+	RelayCount   int64   `json:"relay_count"`    //作为代理转发的会话数
+	Drained      bool    `json:"drained"`        //已排空，不再被选入分组
 }
 
 func newNodeDetail(id string) *NodeDetail {
-	return &NodeDetail{Peer{id, "", 0, "", 0, 0, int8(NO)}, 0, 0, NODE_OCCUPY_PERCENT, 0, time.Now().Unix(), 0, 0, 0, 0, 0, 0, 0}
+	return &NodeDetail{Peer{id, "", 0, "", 0, 0, int8(NO)}, 0, 0, NODE_OCCUPY_PERCENT, 0, time.Now().Unix(), 0, 0, 0, 0, 0, 0, 0, 0, 0, false}
 }
 
 /*
@@ -67,7 +70,7 @@ func newNodeDetail(id string) *NodeDetail {
 		node: 节点基本信息
 		groups: 节点所在的分组列表
 */
-func (detail *NodeDetail) Update(node *Node) (e error) {
+func (detail *NodeDetail) Update(ds *DataSource, node *Node) (e error) {
 	if detail.ID != node.ID {
 		return errors.New("not same node")
 	}
@@ -76,8 +79,9 @@ func (detail *NodeDetail) Update(node *Node) (e error) {
 	}
 	detail.Peer = node.Peer
 	detail.FillUPNPAvailable()
+	verifyPeerNAT(&detail.Peer)
 	detail.TotalSpace = node.TotalSpace
-	count, e := dataSource.Raw.GetNodeGroupCount(node.ID)
+	count, e := ds.Raw.GetNodeGroupCount(node.ID)
 	if e != nil {
 		return errors.New("GetNodeGroupCount error: " + e.Error())
 	}
@@ -103,7 +107,67 @@ func (detail *NodeDetail) Update(node *Node) (e error) {
 	detail.Weight = nodeWeight
 	detail.Download = node.Download
 	detail.Upload = node.Upload
-	return dataSource.Raw.UpdateNode(detail)
+	if e = ds.saveNodeDetail(detail); e != nil {
+		return
+	}
+	recordNodeHeartbeat(node)
+	return
+}
+
+func nodeLockKey(nid string) string {
+	return "p2p_node_" + nid
+}
+
+/*
+	在节点锁中保存心跳更新的节点详情。detail是心跳开始时读取的，期间ReportRelay累加的转发统计和
+	SetNodeDrained设置的排空标记以存储中的为准，避免被心跳覆盖
+*/
+func (ds *DataSource) saveNodeDetail(detail *NodeDetail) (e error) {
+	if e = ds.lock(nodeLockKey(detail.ID)); e != nil {
+		return
+	}
+	defer ds.unlock(nodeLockKey(detail.ID))
+	cur, e := ds.Raw.GetNodesByIds([]string{detail.ID})
+	if e != nil {
+		return
+	}
+	if len(cur) > 0 {
+		detail.RelayBytes, detail.RelayCount = cur[0].RelayBytes, cur[0].RelayCount
+		detail.Drained = cur[0].Drained
+	}
+	return ds.Raw.UpdateNode(detail)
+}
+
+/*
+	设置节点的排空标记。排空的节点扩充分组时不会被选中，已在的分组不受影响
+
+	参数：
+		id: 节点id
+		drained: true为排空，false为恢复调度
+*/
+func SetNodeDrained(id string, drained bool) (e error) {
+	return WithSpan(nil).SetNodeDrained(id, drained)
+}
+
+func (c Caller) SetNodeDrained(id string, drained bool) (e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.SetNodeDrained")
+	defer span.SetAttr("id", id).End(&e)
+	if e = source.lock(nodeLockKey(id)); e != nil {
+		return
+	}
+	defer source.unlock(nodeLockKey(id))
+	cur, e := source.Raw.GetNodesByIds([]string{id})
+	if e != nil {
+		return
+	}
+	if len(cur) == 0 {
+		return service.NewError(service.ERR_NOT_FOUND, "node "+id+" not found")
+	}
+	if cur[0].Drained == drained {
+		return
+	}
+	cur[0].Drained = drained
+	return source.Raw.UpdateNode(&cur[0])
 }
 
 func (detail *NodeDetail) GetWeight() (weight float64) {
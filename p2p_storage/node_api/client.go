@@ -0,0 +1,358 @@
+package node_api
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"time"
+	yh_http "yh_pkg/net/http"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+	"yh_pkg/trace"
+)
+
+//通过HTTP访问Module的客户端，方法与p2p_storage中的同名函数一致，可以作为agent.Coordinator使用
+type Client struct {
+	Host    string //协调服务地址，ip:port
+	Module  string //模块名，默认MODULE_NAME
+	Node    string //没有节点ID参数的请求中使用的节点ID
+	Version int    //发送的协议版本，默认PROTOCOL_VERSION
+
+	Key ed25519.PrivateKey //节点私钥，不为nil时注册时登记公钥，并对请求签名
+}
+
+func NewClient(host, node string) *Client {
+	return &Client{Host: host, Module: MODULE_NAME, Node: node, Version: PROTOCOL_VERSION}
+}
+
+func (c *Client) header(node string) Header {
+	if node == "" {
+		node = c.Node
+	}
+	h := Header{Version: c.Version, Node: node}
+	if c.Key != nil {
+		h.Tm = time.Now().Unix()
+		h.Nonce = newNonce()
+	}
+	return h
+}
+
+//失败时返回service.Error，保留服务端的错误码。追踪时通过trace.HEADER把span传给服务端
+func (c *Client) call(method string, req interface{}, resp interface{}) (e error) {
+	span := trace.Begin("node_api."+method).SetKind(trace.KIND_CLIENT).SetAttr("host", c.Host)
+	defer span.End(&e)
+	data, e := json.Marshal(req)
+	if e != nil {
+		return
+	}
+	path := "/" + c.Module + "/" + method
+	header := make(map[string]string)
+	if c.Key != nil {
+		header[SIGN_HEADER] = sign(c.Key, path, data)
+	}
+	if span != nil {
+		header[trace.HEADER] = span.TraceParent()
+	}
+	body, e := yh_http.Send("http", c.Host, path, nil, header, nil, data)
+	if e != nil {
+		return
+	}
+	var result struct {
+		Status string          `json:"status"`
+		Msg    string          `json:"msg"`
+		Detail string          `json:"detail"`
+		Code   uint            `json:"code"`
+		Res    json.RawMessage `json:"res"`
+	}
+	if e = json.Unmarshal(body, &result); e != nil {
+		return
+	}
+	if result.Status != service.RESULT_STATE_OK {
+		//错误响应也可能带有res，例如AddFileResp.ColdKey
+		if len(result.Res) > 0 {
+			json.Unmarshal(result.Res, resp)
+		}
+		return service.Error{Code: result.Code, Desc: result.Detail, Show: result.Msg}
+	}
+	return json.Unmarshal(result.Res, resp)
+}
+
+func (c *Client) AddNode(id string) (e error) {
+	req := &RegisterReq{Header: c.header(id)}
+	if c.Key != nil {
+		req.Key = c.Key.Public().(ed25519.PublicKey)
+	}
+	return c.call("Register", req, &EmptyResp{})
+}
+
+func (c *Client) UpdateNode2(node *p2p_storage.Node, groupVersions map[string]uint64, tasks []uint64, is_super int) (groups []p2p_storage.NodeGroupDetail, exNodes []p2p_storage.ExpandNode, deleteGids []string, e error) {
+	req := &HeartbeatReq{
+		Header:     c.header(node.ID),
+		Peer:       NewPeerInfo(&node.Peer),
+		TotalSpace: node.TotalSpace,
+		LeftSpace:  node.LeftSpace,
+		State:      node.State,
+		UpSpeed:    node.UpSpeed,
+		Upload:     node.Upload,
+		Download:   node.Download,
+		IsSuper:    is_super,
+		Groups:     groupVersions,
+		Tasks:      tasks,
+	}
+	var resp HeartbeatResp
+	if e = c.call("Heartbeat", req, &resp); e != nil {
+		return
+	}
+	groups = make([]p2p_storage.NodeGroupDetail, len(resp.Groups))
+	for i := range resp.Groups {
+		groups[i] = resp.Groups[i].NodeGroupDetail()
+	}
+	exNodes = make([]p2p_storage.ExpandNode, len(resp.Tasks))
+	for i := range resp.Tasks {
+		exNodes[i] = *resp.Tasks[i].ExpandNode()
+	}
+	return groups, exNodes, resp.DeleteGroups, nil
+}
+
+func (c *Client) ListUpdatedFiles(gid string, ver uint64, num int, tp int) (files []p2p_storage.GroupFile, e error) {
+	var resp ListFilesResp
+	if e = c.call("ListUpdatedFiles", &ListFilesReq{c.header(""), gid, ver, num, tp}, &resp); e != nil {
+		return
+	}
+	files = make([]p2p_storage.GroupFile, len(resp.Files))
+	for i := range resp.Files {
+		files[i] = *resp.Files[i].GroupFile()
+	}
+	return
+}
+
+func (c *Client) AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file bool) (task_id int64, e error) {
+	return c.addFile(&AddFileReq{Header: c.header(src_node), MD5: md5, Size: size, Times: times, NoSource: add_no_source_file})
+}
+
+//ERR_P2P_REDIRECT_COLD时与p2p_storage一样返回ColdRedirectError
+func (c *Client) addFile(req *AddFileReq) (task_id int64, e error) {
+	var resp AddFileResp
+	e = c.call("AddP2PFile", req, &resp)
+	if err, ok := e.(service.Error); ok && err.Code == service.ERR_P2P_REDIRECT_COLD && resp.ColdKey != "" {
+		e = &p2p_storage.ColdRedirectError{Err: err, Key: resp.ColdKey}
+	}
+	return resp.TaskID, e
+}
+
+//带生命周期策略添加文件，对应p2p_storage.AddP2PFileWithPolicy
+func (c *Client) AddP2PFileWithPolicy(md5, src_node string, size uint64, times int, add_no_source_file bool, policy *p2p_storage.Policy) (task_id int64, e error) {
+	return c.addFile(&AddFileReq{Header: c.header(src_node), MD5: md5, Size: size, Times: times, NoSource: add_no_source_file, Policy: NewPolicyInfo(policy)})
+}
+
+//把文件作为租户存储桶中的对象添加，对应p2p_storage.AddP2PObject
+func (c *Client) AddP2PObject(obj *p2p_storage.Object, src_node string, times int, add_no_source_file bool) (task_id int64, e error) {
+	return c.AddP2PObjectWithPolicy(obj, src_node, times, add_no_source_file, nil)
+}
+
+//policy为nil时使用存储桶的策略
+func (c *Client) AddP2PObjectWithPolicy(obj *p2p_storage.Object, src_node string, times int, add_no_source_file bool, policy *p2p_storage.Policy) (task_id int64, e error) {
+	return c.addFile(&AddFileReq{c.header(src_node), obj.MD5, obj.Size, times, add_no_source_file, obj.Tenant, obj.Bucket, obj.Key, NewPolicyInfo(policy), ""})
+}
+
+func (c *Client) SetBucketPolicy(tenant, bucket string, policy *p2p_storage.Policy) (e error) {
+	return c.call("SetBucketPolicy", &BucketPolicyReq{c.header(""), tenant, bucket, *NewPolicyInfo(policy)}, &EmptyResp{})
+}
+
+func (c *Client) DeleteObject(tenant, bucket, key string) (e error) {
+	return c.call("DeleteObject", &ObjectReq{c.header(""), tenant, bucket, key}, &EmptyResp{})
+}
+
+//对应p2p_storage.GetFileDurability
+func (c *Client) GetFileDurability(md5 string) (ds []p2p_storage.Durability, e error) {
+	return c.durability(&DurabilityReq{Header: c.header(""), MD5: md5})
+}
+
+//分组不存在时返回nil
+func (c *Client) GetGroupDurability(gid string) (d *p2p_storage.Durability, e error) {
+	ds, e := c.durability(&DurabilityReq{Header: c.header(""), Group: gid})
+	if e != nil || len(ds) == 0 {
+		return
+	}
+	return &ds[0], nil
+}
+
+//对应p2p_storage.DurabilityReport
+func (c *Client) DurabilityReport(num int) (ds []p2p_storage.Durability, e error) {
+	return c.durability(&DurabilityReq{Header: c.header(""), Num: num})
+}
+
+func (c *Client) durability(req *DurabilityReq) (ds []p2p_storage.Durability, e error) {
+	var resp DurabilityResp
+	if e = c.call("Durability", req, &resp); e != nil {
+		return
+	}
+	return Durabilities(resp.Groups), nil
+}
+
+func (c *Client) GetExpandTaskById(id uint64) (nodes []string, file *p2p_storage.GroupFile, group *p2p_storage.Group, exNode *p2p_storage.ExpandNode, e error) {
+	var resp ExpandTaskResp
+	if e = c.call("GetExpandTask", &TaskReq{Header: c.header(""), TaskID: id}, &resp); e != nil {
+		return
+	}
+	return resp.Nodes, resp.File.GroupFile(), resp.Group.Group(), resp.Task.ExpandNode(), nil
+}
+
+func (c *Client) ExpandFinished(id uint64, state int8) (e error) {
+	return c.call("ExpandFinished", &TaskReq{c.header(""), id, int(state)}, &EmptyResp{})
+}
+
+func (c *Client) P2PExpandFinished(id uint64, state int8) (e error) {
+	return c.call("P2PExpandFinished", &TaskReq{c.header(""), id, int(state)}, &EmptyResp{})
+}
+
+func (c *Client) GetUnSafeExpandTasks(nid string, state int8, num int) (exNodes []p2p_storage.UnSafeExpandNode, e error) {
+	var resp UnSafeTasksResp
+	if e = c.call("GetUnSafeTasks", &UnSafeTasksReq{c.header(nid), state, num}, &resp); e != nil {
+		return
+	}
+	exNodes = make([]p2p_storage.UnSafeExpandNode, len(resp.Tasks))
+	for i := range resp.Tasks {
+		exNodes[i] = *resp.Tasks[i].UnSafeExpandNode()
+	}
+	return
+}
+
+func (c *Client) GetUnSafeExpandTaskById(id uint64) (exNode *p2p_storage.UnSafeExpandNode, file *p2p_storage.GroupFile, group *p2p_storage.Group, e error) {
+	var resp UnSafeTaskResp
+	if e = c.call("GetUnSafeTask", &TaskReq{Header: c.header(""), TaskID: id}, &resp); e != nil {
+		return
+	}
+	return resp.Task.UnSafeExpandNode(), resp.File.GroupFile(), resp.Group.Group(), nil
+}
+
+func (c *Client) UnSafeExpandFinished(id uint64, state int) (e error) {
+	return c.call("UnSafeExpandFinished", &TaskReq{c.header(""), id, state}, &EmptyResp{})
+}
+
+func (c *Client) GetOnlineNodesByIds(ids []string, min_update_tm int64) (peers []p2p_storage.Peer, e error) {
+	var resp OnlineNodesResp
+	if e = c.call("GetOnlineNodes", &OnlineNodesReq{c.header(""), ids, min_update_tm}, &resp); e != nil {
+		return
+	}
+	return Peers(resp.Peers), nil
+}
+
+func (c *Client) Download(md5 string) (nodes []p2p_storage.Peer, group *p2p_storage.Group, sources []p2p_storage.Peer, e error) {
+	return c.download("Download", md5, nil)
+}
+
+func (c *Client) DownloadMore(md5 string, usedGroups []string) (nodes []p2p_storage.Peer, group *p2p_storage.Group, sources []p2p_storage.Peer, e error) {
+	return c.download("DownloadMore", md5, usedGroups)
+}
+
+//与Download相同，同时返回加密文件的密钥，文件没有加密或者没有权限时key为nil
+func (c *Client) DownloadWithKey(md5 string) (nodes []p2p_storage.Peer, group *p2p_storage.Group, sources []p2p_storage.Peer, key *p2p_storage.FileKey, e error) {
+	var resp DownloadResp
+	if e = c.call("Download", &DownloadReq{c.header(""), md5, nil}, &resp); e != nil {
+		return
+	}
+	return Peers(resp.Nodes), resp.Group.Group(), Peers(resp.Sources), resp.Key.FileKey(), nil
+}
+
+func (c *Client) download(method, md5 string, usedGroups []string) (nodes []p2p_storage.Peer, group *p2p_storage.Group, sources []p2p_storage.Peer, e error) {
+	var resp DownloadResp
+	if e = c.call(method, &DownloadReq{c.header(""), md5, usedGroups}, &resp); e != nil {
+		return
+	}
+	return Peers(resp.Nodes), resp.Group.Group(), Peers(resp.Sources), nil
+}
+
+//对应p2p_storage.PlanRange
+func (c *Client) PlanRange(md5 string, offset, length uint64, exclude []string) (plan *p2p_storage.RangePlan, e error) {
+	var resp PlanRangeResp
+	if e = c.call("PlanRange", &PlanRangeReq{c.header(""), md5, offset, length, exclude}, &resp); e != nil {
+		return
+	}
+	return resp.RangePlan(), nil
+}
+
+//对应p2p_storage.GetIngest
+func (c *Client) GetIngest(ticket uint64) (p *p2p_storage.PendingIngest, e error) {
+	var resp IngestResp
+	if e = c.call("GetIngest", &IngestReq{c.header(""), ticket}, &resp); e != nil {
+		return
+	}
+	return resp.Ingest.PendingIngest(), nil
+}
+
+//对应p2p_storage.GetIngestStats
+func (c *Client) GetIngestStats() (stats p2p_storage.IngestStats, e error) {
+	var resp IngestResp
+	if e = c.call("GetIngest", &IngestReq{Header: c.header("")}, &resp); e != nil {
+		return
+	}
+	return p2p_storage.IngestStats{Pending: resp.Pending, OldestTm: resp.OldestTm}, nil
+}
+
+//登记加密文件的密钥，见envelope包
+func (c *Client) SetFileKey(key *p2p_storage.FileKey) (e error) {
+	return c.call("SetFileKey", &SetFileKeyReq{c.header(""), *NewFileKeyInfo(key)}, &EmptyResp{})
+}
+
+func (c *Client) InvalidFile(nid, gid, md5 string) (e error) {
+	return c.call("InvalidFile", &InvalidFileReq{c.header(nid), gid, md5}, &EmptyResp{})
+}
+
+//对应p2p_storage.AddP2PFileWithID
+func (c *Client) AddP2PFileWithID(id, md5, src_node string, size uint64, times int, add_no_source_file bool) (task_id int64, e error) {
+	return c.addFile(&AddFileReq{Header: c.header(src_node), MD5: id, Size: size, Times: times, NoSource: add_no_source_file, LegacyMD5: md5})
+}
+
+//对应p2p_storage.GetFileIDBinding
+func (c *Client) GetFileIDBinding(id string) (b *p2p_storage.FileIDBinding, e error) {
+	var resp FileIDResp
+	if e = c.call("GetFileID", &FileIDReq{Header: c.header(""), ID: id}, &resp); e != nil {
+		return
+	}
+	return resp.Binding.FileIDBinding(), nil
+}
+
+//对应p2p_storage.IssueRelayTokens，dst为空时为c.Node
+func (c *Client) IssueRelayTokens(delegate, src, dst, md5 string) (srcToken, dstToken string, e error) {
+	var resp RelayTokenResp
+	if e = c.call("IssueRelayToken", &RelayReq{c.header(""), delegate, src, dst, md5}, &resp); e != nil {
+		return
+	}
+	return resp.SrcToken, resp.DstToken, nil
+}
+
+//对应p2p_storage.IssuePieceTokens
+func (c *Client) IssuePieceTokens(nid string, id uint64, pieces map[string]int) (tokens map[string]string, e error) {
+	var resp PieceTokenResp
+	if e = c.call("IssuePieceToken", &PieceTokenReq{c.header(nid), id, pieces}, &resp); e != nil {
+		return
+	}
+	return resp.Tokens, nil
+}
+
+//对应p2p_storage.GetNodeHistory，只能查询本节点的历史记录
+func (c *Client) GetNodeHistory(nid string, from, to int64) (h *p2p_storage.NodeHistory, e error) {
+	var resp NodeHistoryResp
+	if e = c.call("GetNodeHistory", &NodeHistoryReq{c.header(nid), from, to}, &resp); e != nil {
+		return
+	}
+	return resp.History.NodeHistory(), nil
+}
+
+//对应p2p_storage.RelayPublicKey
+func (c *Client) RelayKey() (key ed25519.PublicKey, e error) {
+	var resp RelayKeyResp
+	if e = c.call("RelayKey", &RelayReq{Header: c.header("")}, &resp); e != nil {
+		return
+	}
+	return ed25519.PublicKey(resp.Key), nil
+}
+
+//对应p2p_storage.ReportRelay
+func (c *Client) ReportRelay(nid string, stats []p2p_storage.RelayStat) (n int, e error) {
+	var resp ReportRelayResp
+	if e = c.call("ReportRelay", &ReportRelayReq{c.header(nid), NewRelayStatInfos(stats)}, &resp); e != nil {
+		return
+	}
+	return resp.Count, nil
+}
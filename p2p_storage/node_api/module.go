@@ -0,0 +1,551 @@
+package node_api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+	"yh_pkg/trace"
+)
+
+/*
+	协调服务的service.Module，需要先调用p2p_storage.Init：
+		server.AddModule(node_api.MODULE_NAME, &node_api.Module{})
+	之后节点用Client访问/p2p_node/<方法名>，请求和响应的格式见wire.go。
+
+	带签名的请求总是校验签名，签名正确时节点只能上报自己的任务。已登记公钥的节点的请求必须签名；
+	RequireSign为true时拒绝所有没有签名的节点请求，所有节点升级到版本2并登记公钥后再打开。
+*/
+type Module struct {
+	RequireSign bool
+
+	//是否允许请求为节点登记公钥并替换已有的公钥，一般根据req.Session判断是否为管理员或带有登记凭证。
+	//为nil时只有没有注册过的节点可以自行登记，已注册的节点不能登记或更换公钥
+	EnrollAuth func(req *service.HTTPRequest, nid string) bool
+
+	//是否允许请求登记或获取文件密钥，一般根据req.Session判断用户是否属于key.Tenant，为nil时不允许
+	FileKeyAuth func(req *service.HTTPRequest, key *p2p_storage.FileKey) bool
+	//是否允许请求添加或删除租户的对象，为nil时不允许
+	TenantAuth func(req *service.HTTPRequest, tenant string) bool
+
+	env *service.Env
+}
+
+const MODULE_NAME = "p2p_node"
+
+func (m *Module) Init(env *service.Env) (e error) {
+	m.env = env
+	return
+}
+
+type request interface {
+	header() *Header
+}
+
+type response interface {
+	respHeader() *RespHeader
+}
+
+//解析请求并检查协议版本
+func parse(req *service.HTTPRequest, r request) (e service.Error) {
+	if err := req.ParseObj(r); err != nil {
+		return service.NewError(service.ERR_INVALID_PARAM, "parse request error: "+err.Error())
+	}
+	h := r.header()
+	if h.Version == 0 {
+		h.Version = 1
+	}
+	if h.Version < MIN_PROTOCOL_VERSION {
+		return service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("unsupported protocol version %d, min %d", h.Version, MIN_PROTOCOL_VERSION))
+	}
+	return
+}
+
+//以service放入请求context的span为父span调用p2p_storage的接口
+func caller(req *service.HTTPRequest) p2p_storage.Caller {
+	return p2p_storage.WithSpan(trace.FromContext(req.GetRequest().Context()))
+}
+
+//p2p_storage返回的service.Error原样返回，保留错误码
+func toError(err error) (e service.Error) {
+	switch v := err.(type) {
+	case nil:
+	case service.Error:
+		e = v
+	case *p2p_storage.ColdRedirectError:
+		e = v.Err
+	default:
+		e = service.NewError(service.ERR_INTERNAL, err.Error())
+	}
+	return
+}
+
+//校验请求的节点签名，返回请求是否签名
+func (m *Module) auth(req *service.HTTPRequest, h *Header) (signed bool, e service.Error) {
+	sig := req.GetRequest().Header.Get(SIGN_HEADER)
+	if sig == "" {
+		if m.RequireSign {
+			return false, service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, "request of node "+h.Node+" not signed")
+		}
+		//节点登记公钥后不能再用没有签名的请求冒充它
+		has, err := p2p_storage.HasNodeKey(h.Node)
+		if err != nil {
+			return false, toError(err)
+		}
+		if has {
+			e = service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, "request of node "+h.Node+" not signed")
+		}
+		return
+	}
+	if h.Node == "" {
+		return false, service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, "signed request without node")
+	}
+	b, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return false, service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, "invalid sign: "+err.Error())
+	}
+	msg := signMessage(req.GetRequest().URL.Path, req.BodyRaw)
+	return true, toError(caller(req).VerifyNodeSign(h.Node, h.Tm, h.Nonce, msg, b))
+}
+
+//校验签名，请求只能操作属于自己的任务。没有签名的请求由auth保证节点没有登记公钥
+func (m *Module) authTask(req *service.HTTPRequest, h *Header, owner func(id uint64) (string, error), id uint64) (e service.Error) {
+	if _, e = m.auth(req, h); e.Code != service.ERR_NOERR {
+		return
+	}
+	nid, err := owner(id)
+	if err != nil {
+		return toError(err)
+	}
+	if nid != "" && nid != h.Node {
+		return service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, fmt.Sprintf("task %d belongs to node %s, not %s", id, nid, h.Node))
+	}
+	return
+}
+
+func reply(result *service.Result, resp response, err error) (e service.Error) {
+	if e = toError(err); e.Code != service.ERR_NOERR {
+		return
+	}
+	resp.respHeader().Version = PROTOCOL_VERSION
+	result.Res = resp
+	return
+}
+
+//注册节点，带公钥时登记公钥，请求必须用对应的私钥签名。EnrollAuth允许时替换节点已有的公钥
+func (m *Module) Register(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r RegisterReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if r.Key == nil {
+		if _, e = m.auth(req, &r.Header); e.Code != service.ERR_NOERR {
+			return
+		}
+		return reply(result, &EmptyResp{}, caller(req).AddNode(r.Node))
+	}
+	b, err := base64.StdEncoding.DecodeString(req.GetRequest().Header.Get(SIGN_HEADER))
+	if err != nil {
+		return service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, "invalid sign: "+err.Error())
+	}
+	msg := signMessage(req.GetRequest().URL.Path, req.BodyRaw)
+	if e = toError(caller(req).VerifySignWithKey(r.Node, r.Key, r.Tm, r.Nonce, msg, b)); e.Code != service.ERR_NOERR {
+		return
+	}
+	if m.EnrollAuth != nil && m.EnrollAuth(req, r.Node) {
+		return reply(result, &EmptyResp{}, caller(req).ReEnrollNode(r.Node, r.Key))
+	}
+	return reply(result, &EmptyResp{}, caller(req).EnrollNode(r.Node, r.Key))
+}
+
+//节点心跳，对应UpdateNode2
+func (m *Module) Heartbeat(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r HeartbeatReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	//先确定心跳的节点，再按这个节点校验签名，没有签名的请求不能用Peer.ID冒充登记了公钥的节点
+	if r.Node == "" {
+		r.Node = r.Peer.ID
+	} else if r.Peer.ID != "" && r.Peer.ID != r.Node {
+		return service.NewError(service.ERR_INVALID_PARAM, "peer id "+r.Peer.ID+" is not node "+r.Node)
+	}
+	if _, e = m.auth(req, &r.Header); e.Code != service.ERR_NOERR {
+		return
+	}
+	node := &p2p_storage.Node{
+		Peer:       r.Peer.Peer(),
+		TotalSpace: r.TotalSpace,
+		LeftSpace:  r.LeftSpace,
+		State:      r.State,
+		UpSpeed:    r.UpSpeed,
+		Upload:     r.Upload,
+		Download:   r.Download,
+	}
+	node.ID = r.Node
+	if r.Groups == nil {
+		r.Groups = make(map[string]uint64)
+	}
+	groups, exNodes, deleteGids, err := caller(req).UpdateNode2(node, r.Groups, r.Tasks, r.IsSuper)
+	resp := &HeartbeatResp{Groups: make([]GroupInfo, len(groups)), Tasks: make([]ExpandTask, len(exNodes)), DeleteGroups: deleteGids}
+	for i := range groups {
+		resp.Groups[i] = NewNodeGroupInfo(&groups[i])
+	}
+	for i := range exNodes {
+		resp.Tasks[i] = *NewExpandTask(&exNodes[i])
+	}
+	return reply(result, resp, err)
+}
+
+func (m *Module) ListUpdatedFiles(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r ListFilesReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	files, err := caller(req).ListUpdatedFiles(r.Group, r.Ver, r.Num, r.Type)
+	resp := &ListFilesResp{Files: make([]FileInfo, len(files))}
+	for i := range files {
+		resp.Files[i] = *NewFileInfo(&files[i])
+	}
+	return reply(result, resp, err)
+}
+
+//节点添加文件，对应AddP2PFile，源节点为请求的节点
+func (m *Module) AddP2PFile(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r AddFileReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if _, e = m.auth(req, &r.Header); e.Code != service.ERR_NOERR {
+		return
+	}
+	if r.LegacyMD5 != "" {
+		//对应关系只在直接添加文件时登记
+		if r.Bucket != "" || r.Policy != nil {
+			return service.NewError(service.ERR_INVALID_PARAM, "legacy_md5 can not be used with bucket or policy")
+		}
+		taskID, err := caller(req).AddP2PFileWithID(r.MD5, r.LegacyMD5, r.Node, r.Size, r.Times, r.NoSource)
+		return replyAddFile(result, taskID, err)
+	}
+	if r.Bucket == "" {
+		taskID, err := caller(req).AddP2PFileWithPolicy(r.MD5, r.Node, r.Size, r.Times, r.NoSource, r.Policy.Policy())
+		return replyAddFile(result, taskID, err)
+	}
+	if e = m.authTenant(req, r.Tenant); e.Code != service.ERR_NOERR {
+		return
+	}
+	obj := &p2p_storage.Object{Tenant: r.Tenant, Bucket: r.Bucket, Key: r.Key, MD5: r.MD5, Size: r.Size}
+	if r.Policy != nil {
+		obj.SetPolicy(r.Policy.Policy())
+	}
+	taskID, err := caller(req).AddP2PObject(obj, r.Node, r.Times, r.NoSource)
+	return replyAddFile(result, taskID, err)
+}
+
+//转存到冷存储时错误响应的res中带有冷存储的对象名
+func replyAddFile(result *service.Result, taskID int64, err error) (e service.Error) {
+	if key, ok := p2p_storage.RedirectColdKey(err); ok {
+		result.Res = &AddFileResp{RespHeader: RespHeader{PROTOCOL_VERSION}, ColdKey: key}
+	}
+	return reply(result, &AddFileResp{TaskID: taskID}, err)
+}
+
+func (m *Module) authTenant(req *service.HTTPRequest, tenant string) (e service.Error) {
+	if m.TenantAuth == nil || !m.TenantAuth(req, tenant) {
+		e = service.NewError(service.ERR_PERMISSION_DENIED, "no permission of tenant "+tenant)
+	}
+	return
+}
+
+//删除租户的对象，文件没有其他引用时从p2p系统删除
+func (m *Module) DeleteObject(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r ObjectReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if e = m.authTenant(req, r.Tenant); e.Code != service.ERR_NOERR {
+		return
+	}
+	return reply(result, &EmptyResp{}, caller(req).DeleteObject(r.Tenant, r.Bucket, r.Key))
+}
+
+//设置存储桶的默认生命周期策略
+func (m *Module) SetBucketPolicy(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r BucketPolicyReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if e = m.authTenant(req, r.Tenant); e.Code != service.ERR_NOERR {
+		return
+	}
+	return reply(result, &EmptyResp{}, caller(req).SetBucketPolicy(r.Tenant, r.Bucket, r.Policy.Policy()))
+}
+
+func (m *Module) GetExpandTask(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r TaskReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if e = m.authTask(req, &r.Header, p2p_storage.GetExpandTaskNode, r.TaskID); e.Code != service.ERR_NOERR {
+		return
+	}
+	nodes, file, group, exNode, err := caller(req).GetExpandTaskById(r.TaskID)
+	return reply(result, &ExpandTaskResp{Nodes: nodes, File: NewFileInfo(file), Group: NewGroupInfo(group), Task: NewExpandTask(exNode)}, err)
+}
+
+func (m *Module) ExpandFinished(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r TaskReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if e = m.authTask(req, &r.Header, p2p_storage.GetExpandTaskNode, r.TaskID); e.Code != service.ERR_NOERR {
+		return
+	}
+	return reply(result, &EmptyResp{}, caller(req).ExpandFinished(r.TaskID, int8(r.State)))
+}
+
+func (m *Module) P2PExpandFinished(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r TaskReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if e = m.authTask(req, &r.Header, p2p_storage.GetExpandTaskNode, r.TaskID); e.Code != service.ERR_NOERR {
+		return
+	}
+	return reply(result, &EmptyResp{}, caller(req).P2PExpandFinished(r.TaskID, int8(r.State)))
+}
+
+//请求节点的危险文件任务
+func (m *Module) GetUnSafeTasks(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r UnSafeTasksReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if _, e = m.auth(req, &r.Header); e.Code != service.ERR_NOERR {
+		return
+	}
+	exNodes, err := caller(req).GetUnSafeExpandTasks(r.Node, r.State, r.Num)
+	resp := &UnSafeTasksResp{Tasks: make([]UnSafeTask, len(exNodes))}
+	for i := range exNodes {
+		resp.Tasks[i] = *NewUnSafeTask(&exNodes[i])
+	}
+	return reply(result, resp, err)
+}
+
+func (m *Module) GetUnSafeTask(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r TaskReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if e = m.authTask(req, &r.Header, p2p_storage.GetUnSafeExpandTaskNode, r.TaskID); e.Code != service.ERR_NOERR {
+		return
+	}
+	exNode, file, group, err := caller(req).GetUnSafeExpandTaskById(r.TaskID)
+	return reply(result, &UnSafeTaskResp{Task: NewUnSafeTask(exNode), File: NewFileInfo(file), Group: NewGroupInfo(group)}, err)
+}
+
+func (m *Module) UnSafeExpandFinished(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r TaskReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if e = m.authTask(req, &r.Header, p2p_storage.GetUnSafeExpandTaskNode, r.TaskID); e.Code != service.ERR_NOERR {
+		return
+	}
+	return reply(result, &EmptyResp{}, caller(req).UnSafeExpandFinished(r.TaskID, r.State))
+}
+
+func (m *Module) GetOnlineNodes(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r OnlineNodesReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	peers, err := caller(req).GetOnlineNodesByIds(r.Nodes, r.MinUpdateTm)
+	return reply(result, &OnlineNodesResp{Peers: NewPeerInfos(peers)}, err)
+}
+
+//查询文件或分组的耐久度，都没有指定时返回风险最高的分组
+func (m *Module) Durability(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r DurabilityReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	var ds []p2p_storage.Durability
+	var err error
+	switch {
+	case r.MD5 != "":
+		ds, err = caller(req).GetFileDurability(r.MD5)
+	case r.Group != "":
+		var d *p2p_storage.Durability
+		if d, err = caller(req).GetGroupDurability(r.Group); d != nil {
+			ds = append(ds, *d)
+		}
+	default:
+		ds, err = caller(req).DurabilityReport(r.Num)
+	}
+	return reply(result, &DurabilityResp{Groups: NewDurabilityInfos(ds)}, err)
+}
+
+func (m *Module) Download(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r DownloadReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	nodes, group, sources, err := caller(req).Download(r.MD5)
+	return m.replyDownload(req, result, r.MD5, &DownloadResp{Nodes: NewPeerInfos(nodes), Group: NewGroupInfo(group), Sources: NewPeerInfos(sources)}, err)
+}
+
+//排除UsedGroups中的分组
+func (m *Module) DownloadMore(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r DownloadReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	nodes, group, sources, err := caller(req).DownloadMore(r.MD5, r.UsedGroups)
+	return m.replyDownload(req, result, r.MD5, &DownloadResp{Nodes: NewPeerInfos(nodes), Group: NewGroupInfo(group), Sources: NewPeerInfos(sources)}, err)
+}
+
+//规划读取文件的一段
+func (m *Module) PlanRange(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r PlanRangeReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	plan, err := caller(req).PlanRange(r.MD5, r.Offset, r.Length, r.Exclude)
+	if err != nil {
+		return toError(err)
+	}
+	return reply(result, NewPlanRangeResp(plan), nil)
+}
+
+//查询延迟添加队列中的文件和队列状态
+func (m *Module) GetIngest(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r IngestReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	stats, err := caller(req).GetIngestStats()
+	if err != nil {
+		return toError(err)
+	}
+	resp := &IngestResp{Pending: stats.Pending, OldestTm: stats.OldestTm}
+	if r.Ticket != 0 {
+		p, err := caller(req).GetIngest(r.Ticket)
+		if err != nil {
+			return toError(err)
+		}
+		resp.Ingest = NewIngestInfo(p)
+	}
+	return reply(result, resp, nil)
+}
+
+//加密文件的密钥只返回给有权限的客户端，没有权限时与未加密的文件相同
+func (m *Module) replyDownload(req *service.HTTPRequest, result *service.Result, md5 string, resp *DownloadResp, err error) (e service.Error) {
+	if err == nil {
+		var key *p2p_storage.FileKey
+		if key, err = caller(req).GetFileKey(md5); key != nil && m.FileKeyAuth != nil && m.FileKeyAuth(req, key) {
+			resp.Key = NewFileKeyInfo(key)
+		}
+	}
+	return reply(result, resp, err)
+}
+
+//登记加密文件的密钥
+func (m *Module) SetFileKey(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r SetFileKeyReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	key := r.Key.FileKey()
+	if m.FileKeyAuth == nil || !m.FileKeyAuth(req, key) {
+		return service.NewError(service.ERR_PERMISSION_DENIED, "no permission to set key of tenant "+key.Tenant)
+	}
+	return reply(result, &EmptyResp{}, caller(req).AddFileKey(key))
+}
+
+func (m *Module) GetFileID(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r FileIDReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	b, err := caller(req).GetFileIDBinding(r.ID)
+	return reply(result, &FileIDResp{Binding: NewFileIDInfo(b)}, err)
+}
+
+//签发转发令牌，获取端为请求的节点
+func (m *Module) IssueRelayToken(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r RelayReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if _, e = m.auth(req, &r.Header); e.Code != service.ERR_NOERR {
+		return
+	}
+	if r.Dst == "" {
+		r.Dst = r.Node
+	}
+	src, dst, err := caller(req).IssueRelayTokens(r.Delegate, r.Src, r.Dst, r.MD5)
+	return reply(result, &RelayTokenResp{SrcToken: src, DstToken: dst}, err)
+}
+
+//签发推送碎片的令牌，任务必须属于请求的节点
+func (m *Module) IssuePieceToken(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r PieceTokenReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if _, e = m.auth(req, &r.Header); e.Code != service.ERR_NOERR {
+		return
+	}
+	tokens, err := caller(req).IssuePieceTokens(r.Node, r.Task, r.Pieces)
+	return reply(result, &PieceTokenResp{Tokens: tokens}, err)
+}
+
+//节点查询自己的历史记录
+func (m *Module) GetNodeHistory(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r NodeHistoryReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if _, e = m.auth(req, &r.Header); e.Code != service.ERR_NOERR {
+		return
+	}
+	h, err := caller(req).GetNodeHistory(r.Node, r.From, r.To)
+	return reply(result, &NodeHistoryResp{History: NewNodeHistoryInfo(h)}, err)
+}
+
+func (m *Module) RelayKey(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r RelayReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	key := p2p_storage.RelayPublicKey()
+	if key == nil {
+		return service.NewError(service.ERR_INTERNAL, "relay key not set")
+	}
+	return reply(result, &RelayKeyResp{Key: key}, nil)
+}
+
+//代理节点汇报转发统计
+func (m *Module) ReportRelay(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r ReportRelayReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if _, e = m.auth(req, &r.Header); e.Code != service.ERR_NOERR {
+		return
+	}
+	n, err := caller(req).ReportRelay(r.Node, RelayStats(r.Stats))
+	return reply(result, &ReportRelayResp{Count: n}, err)
+}
+
+func (m *Module) InvalidFile(req *service.HTTPRequest, result *service.Result) (e service.Error) {
+	var r InvalidFileReq
+	if e = parse(req, &r); e.Code != service.ERR_NOERR {
+		return
+	}
+	if _, e = m.auth(req, &r.Header); e.Code != service.ERR_NOERR {
+		return
+	}
+	return reply(result, &EmptyResp{}, caller(req).InvalidFile(r.Node, r.Group, r.MD5))
+}
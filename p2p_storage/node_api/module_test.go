@@ -0,0 +1,668 @@
+package node_api
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"yh_pkg/log"
+	yh_http "yh_pkg/net/http"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/agent"
+	"yh_pkg/p2p_storage/envelope"
+	"yh_pkg/p2p_storage/history"
+	"yh_pkg/p2p_storage/mem_source"
+	"yh_pkg/p2p_storage/oss"
+	"yh_pkg/service"
+	"yh_pkg/trace"
+)
+
+const (
+	GID      = "g1"
+	NODE_NUM = 8
+)
+
+var _ agent.Coordinator = (*Client)(nil)
+
+//启动协调服务，返回服务地址
+func startServer(t *testing.T, dir string, m *Module) (host string) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	host = l.Addr().String()
+	l.Close()
+	conf := &service.Config{
+		IPPort:   host,
+		LogDir:   dir,
+		LogLevel: "error",
+		GetEnv:   func(module string) *service.Env { return service.NewEnv(nil) },
+	}
+	server, e := service.New(conf)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = server.AddModule(MODULE_NAME, m); e != nil {
+		t.Fatal(e)
+	}
+	go server.StartService()
+	for i := 0; i < 100; i++ {
+		if c, e := net.Dial("tcp", host); e == nil {
+			c.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server not started")
+	return
+}
+
+type cluster struct {
+	dir    string
+	host   string
+	ds     *mem_source.MemSource
+	agents []*agent.Agent
+}
+
+//启动协调服务和NODE_NUM个节点，所有节点都在分组GID中
+func newCluster(t *testing.T, m *Module, newClient func(host, id string) *Client) (c *cluster) {
+	dir, e := ioutil.TempDir("", "node_api")
+	if e != nil {
+		t.Fatal(e)
+	}
+	logger, e := log.NewMLogger("", 1000, "error")
+	if e != nil {
+		t.Fatal(e)
+	}
+	c = &cluster{dir: dir, ds: mem_source.New(), agents: make([]*agent.Agent, NODE_NUM)}
+	if e = p2p_storage.Init(c.ds, logger, false); e != nil {
+		t.Fatal(e)
+	}
+	//推送碎片的令牌用转发密钥签发
+	_, key, e := ed25519.GenerateKey(nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	p2p_storage.SetRelayKey(key)
+	c.host = startServer(t, dir, m)
+
+	c.ds.AddGroup(&p2p_storage.Group{ID: GID, PieceSize: 1024, MinPieces: 4, SafePieces: 6, PerfectPieces: NODE_NUM})
+	for i := range c.agents {
+		id := fmt.Sprintf("n%02d", i)
+		conf := agent.Config{ID: id, Dir: filepath.Join(dir, id), TotalSpace: 100 * p2p_storage.GROUP_NODE_CAPACITY}
+		if c.agents[i], e = agent.New(conf, newClient(c.host, id), logger); e != nil {
+			t.Fatal(e)
+		}
+		if e = c.agents[i].Register(); e != nil {
+			t.Fatal(e)
+		}
+		//新注册的节点不能添加文件，这里直接设置为老节点
+		n, _ := c.ds.GetNodeDetail(id)
+		n.RegTm = time.Now().Unix() - 30*86400
+		n.OnlineCount = 200
+		c.ds.UpdateNode(n)
+		c.ds.AddNodeToGroup(GID, &p2p_storage.GroupNode{Node: id, State: p2p_storage.ONLINE})
+	}
+	return
+}
+
+func (c *cluster) close() {
+	for _, a := range c.agents {
+		if a != nil {
+			a.Close()
+		}
+	}
+	p2p_storage.Stop()
+	p2p_storage.SetRelayKey(nil)
+	os.RemoveAll(c.dir)
+}
+
+func (c *cluster) step(t *testing.T) {
+	for _, a := range c.agents {
+		if e := a.Step(); e != nil {
+			t.Fatal(e)
+		}
+	}
+	for _, a := range c.agents {
+		a.Wait()
+	}
+}
+
+//由第一个节点添加文件，扩散完成后检查所有节点的版本，并从节点下载
+func (c *cluster) addFile(t *testing.T) (md5 string, data []byte) {
+	c.step(t)
+	data = make([]byte, 10*1024+7)
+	rand.New(rand.NewSource(1)).Read(data)
+	md5, _, e := c.agents[0].AddFile(data)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.step(t)
+	c.step(t)
+	file, _ := c.ds.GetGroupFile(GID, md5)
+	for _, a := range c.agents {
+		if v := a.Versions()[GID]; v != file.Ver {
+			t.Errorf("version %d, want %d", v, file.Ver)
+		}
+	}
+	got, e := agent.Fetch(NewClient(c.host, ""), md5)
+	if e != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Fetch: %v", e)
+	}
+	return
+}
+
+func TestModule(t *testing.T) {
+	m := &Module{FileKeyAuth: func(req *service.HTTPRequest, key *p2p_storage.FileKey) bool { return key.Tenant == "t1" }}
+	c := newCluster(t, m, NewClient)
+	defer c.close()
+	md5, data := c.addFile(t)
+	agents, client := c.agents, NewClient(c.host, "")
+	var e error
+
+	//错误码原样返回
+	if _, e = client.AddP2PFile(md5, "n01", uint64(len(data)), 0, false); e == nil || e.(service.Error).Code != service.ERR_P2P_FILE_ALREADY_EXIST {
+		t.Errorf("AddP2PFile existing file: %v", e)
+	}
+	client.Version = -1
+	if e = client.AddNode("n99"); e == nil || e.(service.Error).Code != service.ERR_INVALID_PARAM {
+		t.Errorf("old protocol version accepted: %v", e)
+	}
+	//没有版本号的请求按版本1处理
+	client.Version = 0
+	if _, _, _, e = client.UpdateNode2(&p2p_storage.Node{Peer: agents[0].Peer(), State: p2p_storage.YES}, nil, nil, p2p_storage.YES); e != nil {
+		t.Errorf("request without version: %v", e)
+	}
+	client.Version = PROTOCOL_VERSION
+
+	//按范围读取
+	r, e := agent.NewRangeReader(client, md5)
+	if e != nil {
+		t.Fatal(e)
+	}
+	part := make([]byte, 3000)
+	if _, e = r.ReadAt(part, 1000); e != nil || !bytes.Equal(part, data[1000:4000]) {
+		t.Errorf("ReadAt: %v", e)
+	}
+
+	//加密文件，密钥只返回给有权限的客户端
+	ring := envelope.NewKeyring("t1")
+	ring.AddMasterKey(1, bytes.Repeat([]byte{1}, envelope.DATA_KEY_SIZE))
+	sealed, key, e := envelope.Encrypt(ring, data)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, _, e = agents[1].AddFile(sealed); e != nil {
+		t.Fatal(e)
+	}
+	c.step(t)
+	c.step(t)
+	if e = client.SetFileKey(key); e != nil {
+		t.Fatal(e)
+	}
+	_, _, _, got, e := client.DownloadWithKey(key.MD5)
+	if e != nil || got == nil {
+		t.Fatalf("DownloadWithKey: %v %v", got, e)
+	}
+	fetched, e := agent.Fetch(client, key.MD5)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if plain, e := envelope.Decrypt(ring, got, fetched); e != nil || !bytes.Equal(plain, data) {
+		t.Errorf("Decrypt: %v", e)
+	}
+	other := *key
+	other.Tenant = "t2"
+	if e = client.SetFileKey(&other); e == nil || e.(service.Error).Code != service.ERR_PERMISSION_DENIED {
+		t.Errorf("SetFileKey of other tenant: %v", e)
+	}
+	if _, _, _, got, e = client.DownloadWithKey(md5); e != nil || got != nil {
+		t.Errorf("key of plain file: %v %v", got, e)
+	}
+}
+
+func signedClient(t *testing.T, dir string) func(host, id string) *Client {
+	return func(host, id string) *Client {
+		client := NewClient(host, id)
+		key, e := LoadKey(filepath.Join(dir, id+".key"))
+		if e != nil {
+			t.Fatal(e)
+		}
+		client.Key = key
+		return client
+	}
+}
+
+//转存冷存储的错误同时是ERR_P2P_REDIRECT_COLD
+func isRedirect(e error) bool {
+	err, ok := e.(*p2p_storage.ColdRedirectError)
+	return ok && err.Err.Code == service.ERR_P2P_REDIRECT_COLD
+}
+
+//请求的错误码，不是service.Error的错误为ERR_INTERNAL
+func errCode(e error) uint {
+	if e == nil {
+		return service.ERR_NOERR
+	}
+	if err, ok := e.(service.Error); ok {
+		return err.Code
+	}
+	return service.ERR_INTERNAL
+}
+
+func authFailed(e error, code uint) bool {
+	err, ok := e.(service.Error)
+	return ok && err.Code == code
+}
+
+func TestSign(t *testing.T) {
+	keyDir, e := ioutil.TempDir("", "node_key")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(keyDir)
+	newClient := signedClient(t, keyDir)
+	c := newCluster(t, &Module{RequireSign: true}, newClient)
+	defer c.close()
+	c.addFile(t)
+
+	//没有签名的节点请求被拒绝，不需要节点身份的请求不受影响
+	if e = NewClient(c.host, "n01").InvalidFile("n01", GID, "0123456789abcdef0123456789abcdef"); !authFailed(e, service.ERR_P2P_NODE_AUTH_FAILED) {
+		t.Errorf("unsigned request accepted: %v", e)
+	}
+	//用自己的私钥冒充其他节点
+	if e = newClient(c.host, "n01").InvalidFile("n02", GID, "0123456789abcdef0123456789abcdef"); !authFailed(e, service.ERR_P2P_NODE_AUTH_FAILED) {
+		t.Errorf("request on behalf of other node accepted: %v", e)
+	}
+	//其他私钥不能重新注册已有节点
+	other := signedClient(t, c.dir)(c.host, "n02")
+	if e = other.AddNode("n02"); !authFailed(e, service.ERR_P2P_NODE_KEY_EXIST) {
+		t.Errorf("register with another key: %v", e)
+	}
+	//不能上报其他节点的任务
+	taskID, e := newClient(c.host, "n03").AddP2PFile("fedcba9876543210fedcba9876543210", "n03", 4096, 0, false)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = newClient(c.host, "n04").P2PExpandFinished(uint64(taskID), int8(p2p_storage.YES)); !authFailed(e, service.ERR_P2P_NODE_AUTH_FAILED) {
+		t.Errorf("finish task of other node: %v", e)
+	}
+
+	//重放请求
+	client := newClient(c.host, "n01")
+	req := &InvalidFileReq{client.header("n01"), GID, "0123456789abcdef0123456789abcdef"}
+	data, _ := json.Marshal(req)
+	path := "/" + MODULE_NAME + "/InvalidFile"
+	header := map[string]string{SIGN_HEADER: sign(client.Key, path, data)}
+	for i, want := range []string{service.RESULT_STATE_OK, service.RESULT_STATE_FAIL} {
+		body, e := yh_http.Send("http", c.host, path, nil, header, nil, data)
+		var result struct {
+			Status string `json:"status"`
+		}
+		if e != nil || json.Unmarshal(body, &result) != nil || result.Status != want {
+			t.Errorf("request %d: %s %v, want %s", i, body, e, want)
+		}
+	}
+
+	//删除节点后公钥失效，可以用新的私钥重新注册
+	if e = p2p_storage.DeleteNode("n02"); e != nil {
+		t.Fatal(e)
+	}
+	if e = newClient(c.host, "n02").InvalidFile("n02", GID, "0123456789abcdef0123456789abcdef"); !authFailed(e, service.ERR_P2P_NODE_AUTH_FAILED) {
+		t.Errorf("revoked key accepted: %v", e)
+	}
+	if e = other.AddNode("n02"); e != nil {
+		t.Errorf("register after DeleteNode: %v", e)
+	}
+	if e = other.InvalidFile("n02", GID, "0123456789abcdef0123456789abcdef"); e != nil {
+		t.Errorf("request with new key: %v", e)
+	}
+}
+
+//没有打开RequireSign时，已登记公钥的节点也必须签名；已注册的节点登记公钥需要授权
+func TestEnroll(t *testing.T) {
+	keyDir, e := ioutil.TempDir("", "node_key")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(keyDir)
+	admin := false
+	m := &Module{EnrollAuth: func(req *service.HTTPRequest, nid string) bool { return admin }}
+	newClient := signedClient(t, keyDir)
+	c := newCluster(t, m, newClient)
+	defer c.close()
+	c.step(t)
+
+	const md5 = "0123456789abcdef0123456789abcdef"
+	if e = NewClient(c.host, "n01").InvalidFile("n01", GID, md5); !authFailed(e, service.ERR_P2P_NODE_AUTH_FAILED) {
+		t.Errorf("unsigned request of enrolled node accepted: %v", e)
+	}
+	if e = NewClient(c.host, "n01").AddNode("n01"); !authFailed(e, service.ERR_P2P_NODE_AUTH_FAILED) {
+		t.Errorf("unsigned register of enrolled node accepted: %v", e)
+	}
+	//没有签名时不能用Peer.ID冒充已登记公钥的节点心跳
+	hb := &HeartbeatReq{Header: Header{Version: PROTOCOL_VERSION}, Peer: PeerInfo{ID: "n01", IP: "10.0.0.1"}}
+	if e = NewClient(c.host, "").call("Heartbeat", hb, &HeartbeatResp{}); !authFailed(e, service.ERR_P2P_NODE_AUTH_FAILED) {
+		t.Errorf("unsigned heartbeat as enrolled node accepted: %v", e)
+	}
+	//没有签名的请求不能上报已登记公钥的节点的任务
+	taskID, e := newClient(c.host, "n03").AddP2PFile("fedcba9876543210fedcba9876543210", "n03", 4096, 0, false)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, nid := range []string{"", "n30"} {
+		if e = NewClient(c.host, nid).P2PExpandFinished(uint64(taskID), int8(p2p_storage.YES)); !authFailed(e, service.ERR_P2P_NODE_AUTH_FAILED) {
+			t.Errorf("unsigned request of %q finished task of enrolled node: %v", nid, e)
+		}
+	}
+
+	//没有公钥的老节点升级后登记公钥需要授权
+	if e = NewClient(c.host, "n20").AddNode("n20"); e != nil {
+		t.Fatal(e)
+	}
+	legacy := newClient(c.host, "n20")
+	if e = legacy.AddNode("n20"); !authFailed(e, service.ERR_P2P_NODE_AUTH_FAILED) {
+		t.Errorf("enroll registered node without authorization: %v", e)
+	}
+	admin = true
+	if e = legacy.AddNode("n20"); e != nil {
+		t.Fatal(e)
+	}
+	admin = false
+	if e = legacy.InvalidFile("n20", GID, md5); e != nil {
+		t.Errorf("request with enrolled key: %v", e)
+	}
+
+	//吊销公钥后不能用其他私钥抢先登记
+	if e = p2p_storage.RevokeNodeKey("n02"); e != nil {
+		t.Fatal(e)
+	}
+	other := signedClient(t, c.dir)(c.host, "n02")
+	if e = other.AddNode("n02"); !authFailed(e, service.ERR_P2P_NODE_AUTH_FAILED) {
+		t.Errorf("enroll revoked node without authorization: %v", e)
+	}
+	admin = true
+	if e = other.AddNode("n02"); e != nil {
+		t.Fatal(e)
+	}
+	admin = false
+	if e = newClient(c.host, "n02").InvalidFile("n02", GID, md5); !authFailed(e, service.ERR_P2P_NODE_AUTH_FAILED) {
+		t.Errorf("replaced key accepted: %v", e)
+	}
+	if e = other.InvalidFile("n02", GID, md5); e != nil {
+		t.Errorf("request with new key: %v", e)
+	}
+}
+
+//添加、删除对象和设置存储桶策略需要TenantAuth允许
+func TestTenantAuth(t *testing.T) {
+	m := &Module{TenantAuth: func(req *service.HTTPRequest, tenant string) bool { return tenant != "t3" }}
+	c := newCluster(t, m, NewClient)
+	defer c.close()
+	c.step(t)
+	client := NewClient(c.host, "n01")
+
+	for _, tc := range []struct {
+		tenant string
+		code   uint
+	}{
+		{"t1", service.ERR_NOERR},
+		{"t3", service.ERR_PERMISSION_DENIED},
+	} {
+		if e := p2p_storage.CreateBucket(tc.tenant, "photos"); e != nil {
+			t.Fatal(e)
+		}
+		obj := &p2p_storage.Object{Tenant: tc.tenant, Bucket: "photos", Key: "a", MD5: "0123456789abcdef0123456789abcdef", Size: 4096}
+		_, e := client.AddP2PObject(obj, "n01", 0, false)
+		if authFailed(e, service.ERR_P2P_TASK_OTHER_NODE_DOING) {
+			e = nil
+		}
+		policy := &p2p_storage.Policy{TTL: 7200}
+		for op, e := range map[string]error{
+			"AddP2PObject":    e,
+			"SetBucketPolicy": client.SetBucketPolicy(tc.tenant, "photos", policy),
+		} {
+			if code := errCode(e); code != tc.code {
+				t.Errorf("%s of %s: %v, want code %d", op, tc.tenant, e, tc.code)
+			}
+		}
+		if tc.code == service.ERR_NOERR {
+			if got, _ := p2p_storage.GetBucketPolicy(tc.tenant, "photos"); got == nil || got.TTL != policy.TTL {
+				t.Errorf("bucket policy of %s: %+v", tc.tenant, got)
+			}
+		}
+		if e = client.DeleteObject(tc.tenant, "photos", "a"); errCode(e) != tc.code {
+			t.Errorf("DeleteObject of %s: %v, want code %d", tc.tenant, e, tc.code)
+		}
+	}
+}
+
+//Durability按请求中的md5、分组或数量查询，结果与p2p_storage的接口一致
+func TestDurability(t *testing.T) {
+	c := newCluster(t, &Module{}, NewClient)
+	defer c.close()
+	md5, _ := c.addFile(t)
+	client := NewClient(c.host, "")
+
+	one := func(d *p2p_storage.Durability, e error) ([]p2p_storage.Durability, error) {
+		if d == nil {
+			return nil, e
+		}
+		return []p2p_storage.Durability{*d}, e
+	}
+	for _, tc := range []struct {
+		name      string
+		got, want func() ([]p2p_storage.Durability, error)
+	}{
+		{"file",
+			func() ([]p2p_storage.Durability, error) { return client.GetFileDurability(md5) },
+			func() ([]p2p_storage.Durability, error) { return p2p_storage.GetFileDurability(md5) }},
+		{"group",
+			func() ([]p2p_storage.Durability, error) { return one(client.GetGroupDurability(GID)) },
+			func() ([]p2p_storage.Durability, error) { return one(p2p_storage.GetGroupDurability(GID)) }},
+		{"missing group",
+			func() ([]p2p_storage.Durability, error) { return one(client.GetGroupDurability("none")) },
+			func() ([]p2p_storage.Durability, error) { return nil, nil }},
+		{"report",
+			func() ([]p2p_storage.Durability, error) { return client.DurabilityReport(0) },
+			func() ([]p2p_storage.Durability, error) { return p2p_storage.DurabilityReport(0) }},
+	} {
+		got, e := tc.got()
+		want, _ := tc.want()
+		if e != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %+v %v, want %+v", tc.name, got, e, want)
+		}
+	}
+}
+
+//AddP2PFile请求中的策略原样传给p2p_storage，无效的策略返回ERR_INVALID_PARAM
+func TestAddFilePolicy(t *testing.T) {
+	c := newCluster(t, &Module{}, NewClient)
+	defer c.close()
+	c.step(t)
+	client := NewClient(c.host, "n01")
+
+	const md5 = "0123456789abcdef0123456789abcdef"
+	policy := &p2p_storage.Policy{TTL: 7200, Retention: 3600, Priority: p2p_storage.PRIORITY_HIGH}
+	if _, e := client.AddP2PFileWithPolicy(md5, "n01", 4096, 0, false, policy); e != nil {
+		t.Fatal(e)
+	}
+	if p, e := p2p_storage.GetFilePolicy(md5); e != nil || p == nil || p.RetainTm == 0 || p.ExpireTm < p.RetainTm+3600 {
+		t.Errorf("file policy: %+v %v", p, e)
+	}
+	if p, e := p2p_storage.GetFilePriority(md5); e != nil || p != p2p_storage.PRIORITY_HIGH {
+		t.Errorf("file priority: %d %v", p, e)
+	}
+	_, e := client.AddP2PFileWithPolicy("fedcba9876543210fedcba9876543210", "n01", 4096, 0, false, &p2p_storage.Policy{Priority: 9})
+	if !authFailed(e, service.ERR_INVALID_PARAM) {
+		t.Errorf("invalid priority: %v", e)
+	}
+}
+
+//文件进入延迟添加队列时AddFile返回排队号，可以通过接口查询
+func TestAddFileQueued(t *testing.T) {
+	c := newCluster(t, &Module{}, NewClient)
+	defer c.close()
+	p2p_storage.ConfigMap.ConfigValue.Set(p2p_storage.ADMISSION_MODE_KEY, p2p_storage.ADMISSION_QUEUE)
+	defer p2p_storage.ConfigMap.ConfigValue.Set(p2p_storage.ADMISSION_MODE_KEY, p2p_storage.DEFAULT_ADMISSION_MODE)
+	c.step(t)
+	for _, a := range c.agents {
+		n, _ := c.ds.GetNodeDetail(a.Peer().ID)
+		n.LeftP2pSpace = 0
+		c.ds.UpdateNode(n)
+	}
+
+	data := make([]byte, 10*1024+7)
+	rand.New(rand.NewSource(4)).Read(data)
+	md5, ticket, e := c.agents[1].AddFile(data)
+	if e != nil || ticket == 0 {
+		t.Fatalf("AddFile: %d %v", ticket, e)
+	}
+	client := NewClient(c.host, "n01")
+	p, e := client.GetIngest(ticket)
+	if e != nil || p.State != p2p_storage.INGEST_PENDING || p.MD5 != md5 || p.SrcNode != "n01" {
+		t.Errorf("GetIngest: %+v %v", p, e)
+	}
+	if stats, e := client.GetIngestStats(); e != nil || stats.Pending != 1 || stats.OldestTm != p.AddTm {
+		t.Errorf("GetIngestStats: %+v %v", stats, e)
+	}
+	if _, e = client.GetIngest(ticket + 1); !authFailed(e, service.ERR_NOT_FOUND) {
+		t.Errorf("unknown ticket: %v", e)
+	}
+}
+
+//没有可用节点时按ADMISSION_REDIRECT把文件转存到冷存储，错误中带有冷存储的对象名
+func TestColdRedirect(t *testing.T) {
+	c := newCluster(t, &Module{}, NewClient)
+	defer c.close()
+	cold, e := oss.NewLocalStore(filepath.Join(c.dir, "cold"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	p2p_storage.SetColdStore(cold)
+	defer p2p_storage.SetColdStore(nil)
+	p2p_storage.ConfigMap.ConfigValue.Set(p2p_storage.ADMISSION_MODE_KEY, p2p_storage.ADMISSION_REDIRECT)
+	defer p2p_storage.ConfigMap.ConfigValue.Set(p2p_storage.ADMISSION_MODE_KEY, p2p_storage.DEFAULT_ADMISSION_MODE)
+	c.step(t)
+	for _, a := range c.agents {
+		n, _ := c.ds.GetNodeDetail(a.Peer().ID)
+		n.LeftP2pSpace = 0
+		c.ds.UpdateNode(n)
+	}
+
+	const md5 = "0123456789abcdef0123456789abcdef"
+	_, e = NewClient(c.host, "n01").AddP2PFile(md5, "n01", 4096, 0, false)
+	if key, ok := p2p_storage.RedirectColdKey(e); !ok || key != p2p_storage.ColdKey(md5) || !isRedirect(e) {
+		t.Fatalf("AddP2PFile: %q %v", key, e)
+	}
+
+	//没有设置冷存储的节点返回该错误
+	data := make([]byte, 10*1024+7)
+	rand.New(rand.NewSource(3)).Read(data)
+	if _, _, e = c.agents[1].AddFile(data); !isRedirect(e) {
+		t.Errorf("AddFile without cold store: %v", e)
+	}
+	logger, e := log.NewMLogger("", 1000, "error")
+	if e != nil {
+		t.Fatal(e)
+	}
+	conf := agent.Config{ID: "c01", Dir: filepath.Join(c.dir, "c01"), TotalSpace: p2p_storage.GROUP_NODE_CAPACITY, Cold: cold}
+	a, e := agent.New(conf, NewClient(c.host, conf.ID), logger)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer a.Close()
+	md5sum, _, e := a.AddFile(data)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if info, e := cold.Head(p2p_storage.ColdKey(md5sum)); e != nil || info == nil || info.Size != int64(len(data)) {
+		t.Errorf("file not in cold store: %+v %v", info, e)
+	}
+	if ok, e := p2p_storage.IsExists(md5sum); ok || e != nil {
+		t.Errorf("redirected file added to p2p: %v %v", ok, e)
+	}
+}
+
+//GetNodeHistory返回p2p_storage查询的历史记录，时间范围无效时返回ERR_INVALID_PARAM
+func TestNodeHistory(t *testing.T) {
+	c := newCluster(t, &Module{}, NewClient)
+	defer c.close()
+	p2p_storage.SetNodeHistoryStore(history.NewMemStore())
+	defer p2p_storage.SetNodeHistoryStore(nil)
+	c.step(t)
+
+	now := time.Now().Unix()
+	client := NewClient(c.host, "n01")
+	h, e := client.GetNodeHistory("n01", now-3600, now+3600)
+	want, _ := p2p_storage.GetNodeHistory("n01", now-3600, now+3600)
+	if e != nil || len(h.Samples) == 0 || !reflect.DeepEqual(h, want) {
+		t.Fatalf("GetNodeHistory: %+v %v, want %+v", h, e, want)
+	}
+	if _, e = client.GetNodeHistory("n01", now, now-1); !authFailed(e, service.ERR_INVALID_PARAM) {
+		t.Errorf("invalid range: %v", e)
+	}
+}
+
+//客户端、服务端的span和以服务端span为父span的p2p_storage接口、IDataSource的span属于同一个trace
+func TestTrace(t *testing.T) {
+	c := newCluster(t, &Module{}, NewClient)
+	defer c.close()
+	client := NewClient(c.host, "")
+	r := &trace.Recorder{}
+	trace.SetExporter(r)
+	defer trace.SetExporter(nil)
+
+	if d, e := client.GetGroupDurability(GID); e != nil || d == nil {
+		t.Fatalf("GetGroupDurability: %+v %v", d, e)
+	}
+	if _, e := client.GetIngest(12345); e == nil {
+		t.Fatal("GetIngest of missing ticket should fail")
+	}
+	trace.SetExporter(nil)
+
+	spans := r.Spans()
+	find := func(name, parent string) *trace.Span {
+		for _, s := range spans {
+			if s.Name == name && (parent == "" || s.ParentID == parent) {
+				return s
+			}
+		}
+		t.Fatalf("span %s with parent %s not found", name, parent)
+		return nil
+	}
+	cs := find("node_api.Durability", "")
+	if cs.Kind != trace.KIND_CLIENT || cs.ParentID != "" || cs.Error != "" {
+		t.Errorf("client span %+v", cs)
+	}
+	ss := find("service/"+MODULE_NAME+"/Durability", cs.SpanID)
+	as := find("p2p_storage.GetGroupDurability", ss.SpanID)
+	//接口内部的span见p2p_storage的TestTracedSource
+	ds := find("IDataSource.GetGroup", as.SpanID)
+	for _, s := range []*trace.Span{ss, as, ds} {
+		if s.TraceID != cs.TraceID {
+			t.Errorf("span %s trace %s, want %s", s.Name, s.TraceID, cs.TraceID)
+		}
+	}
+	if ss.Kind != trace.KIND_SERVER || as.Attrs["gid"] != GID {
+		t.Errorf("server span %+v, api span %+v", ss, as)
+	}
+
+	//错误记录在每一层
+	cs = find("node_api.GetIngest", "")
+	ss = find("service/"+MODULE_NAME+"/GetIngest", cs.SpanID)
+	as = find("p2p_storage.GetIngest", ss.SpanID)
+	for _, s := range []*trace.Span{cs, ss, as} {
+		if s.Error == "" {
+			t.Errorf("span %s has no error", s.Name)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package node_api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+//签名的内容：请求路径和请求体，tm和nonce在请求体的Header中
+func signMessage(path string, body []byte) []byte {
+	msg := make([]byte, 0, len(path)+1+len(body))
+	msg = append(msg, path...)
+	msg = append(msg, '\n')
+	return append(msg, body...)
+}
+
+func sign(key ed25519.PrivateKey, path string, body []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, signMessage(path, body)))
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/*
+	读取节点私钥，文件不存在时生成新的密钥对并保存，节点应当把私钥保存在数据目录中，重启后继续使用
+
+	参数：
+		file: 私钥文件，内容为Ed25519私钥的seed
+*/
+func LoadKey(file string) (key ed25519.PrivateKey, e error) {
+	seed, e := ioutil.ReadFile(file)
+	if e == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, errors.New("invalid key file " + file)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(e) {
+		return
+	}
+	if _, key, e = ed25519.GenerateKey(rand.Reader); e != nil {
+		return
+	}
+	if e = ioutil.WriteFile(file, key.Seed(), 0600); e != nil {
+		return nil, e
+	}
+	return
+}
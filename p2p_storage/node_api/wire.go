@@ -0,0 +1,745 @@
+/*
+节点与协调服务之间的HTTP协议。
+
+请求和响应都是json，字段名在这里显式定义，与p2p_storage中结构体的json标签无关，修改内部结构体不会影响协议。
+每个请求和响应都带有协议版本号v，兼容规则：
+	1. 只能增加字段，不能删除字段或修改字段的名称和类型
+	2. 新增字段的零值必须与旧版本的行为一致，旧节点不发送新字段时按零值处理
+	3. 双方都忽略不认识的字段
+	4. 请求中没有v时按版本1处理，版本低于MIN_PROTOCOL_VERSION的请求返回ERR_INVALID_PARAM
+
+testdata中保存了每个版本的请求和响应样例，兼容性测试保证它们仍然可以被当前版本解析，且当前版本的输出包含其中所有字段。
+
+版本2增加了节点签名：节点注册时在RegisterReq.Key中登记Ed25519公钥，之后的上报请求在Header中带上tm和nonce，
+并把对"路径\n请求体"的签名用base64编码后放在HTTP头SIGN_HEADER中。注册请求本身也要用登记的私钥签名。
+版本3增加了加密文件的密钥：SetFileKey登记包装后的数据密钥，有权限的客户端在DownloadResp.Key中得到它。
+版本4增加了租户的存储桶：AddFileReq中带bucket时文件作为对象添加，检查租户配额，DeleteObject删除对象。
+版本5增加了生命周期策略：AddFileReq.Policy设置过期、保留期和耐久等级，SetBucketPolicy设置存储桶的默认策略。
+版本6增加了扩散任务的传输方式ExpandTask.TransType，没有时按EXPAND_TRANS_TYPE_NODE（零值）处理，即只在节点之间传输。
+版本7增加了耐久度查询Durability：按文件、分组查询，或者按风险从高到低列出分组。
+版本8增加了sha256的文件ID（见p2p_storage.ParseFileID）：所有md5字段都可以是md5或文件ID，GetFileID查找文件ID和md5的对应关系。版本8之前的节点只能按md5校验文件，不能处理用文件ID添加的文件。
+版本9增加了代理转发：IssueRelayToken签发一对转发令牌，代理节点用RelayKey得到的公钥校验令牌，ReportRelay汇报转发的字节数。
+版本10增加了按范围读取：PlanRange返回覆盖文件一段的碎片段和最少的节点，节点的碎片服务支持Range头。
+版本11增加了文件的优先级PolicyInfo.Priority（见p2p_storage.PRIORITY_CLASSES），没有时为普通优先级。
+版本12增加了延迟添加队列：分组未就绪时AddP2PFile返回ERR_P2P_INGEST_QUEUED，错误描述中带排队号（见p2p_storage.IngestTicket），
+GetIngest按排队号查询结果，排队号为0时只返回队列的深度和最早的等待时间。
+版本13增加了推送碎片的令牌：执行扩散任务的节点用IssuePieceToken为每个接收端取得令牌（见p2p_storage.IssuePieceTokens），
+节点的碎片服务只接受带令牌的PUT，因此版本13的节点不接受旧节点推送的碎片。
+版本14去掉了BindFileID，文件ID和md5的对应关系只在添加文件时登记：AddFileReq.MD5为sha256的文件ID时，
+AddFileReq.LegacyMD5为节点用文件内容计算的md5（见p2p_storage.AddP2PFileWithID）。
+版本15增加了节点历史记录的查询GetNodeHistory：节点查询自己在一段时间内的在线区间和样本（见p2p_storage.GetNodeHistory）。
+版本16增加了PlanRangeReq.Exclude：读取失败后去掉失败的节点重新规划，文件所在的分组节点不足时换用其他分组。
+版本17增加了AddFileResp.ColdKey：添加文件返回ERR_P2P_REDIRECT_COLD时，错误响应的res中带有上传文件的冷存储对象名
+（见p2p_storage.ColdRedirectError），不再放在错误描述中。
+版本18的推送碎片令牌绑定碎片序号：PieceTokenReq.Pieces给出推送给每个接收端的碎片序号，只为其中的接收端签发令牌，
+因此版本18的节点不接受旧节点推送的碎片。
+*/
+package node_api
+
+import (
+	"yh_pkg/p2p_storage"
+)
+
+const (
+	PROTOCOL_VERSION     = 18 //当前协议版本
+	MIN_PROTOCOL_VERSION = 1 //服务端支持的最低协议版本
+
+	SIGN_HEADER = "X-P2P-Sign" //节点签名所在的HTTP头
+)
+
+//请求公共字段
+type Header struct {
+	Version int    `json:"v"`
+	Node    string `json:"node"`            //发起请求的节点ID，非节点的客户端可以为空
+	Tm      int64  `json:"tm,omitempty"`    //签名时间（秒），版本2
+	Nonce   string `json:"nonce,omitempty"` //签名随机串，版本2
+}
+
+func (h *Header) header() *Header {
+	return h
+}
+
+//响应公共字段
+type RespHeader struct {
+	Version int `json:"v"`
+}
+
+func (h *RespHeader) respHeader() *RespHeader {
+	return h
+}
+
+type PeerInfo struct {
+	ID            string `json:"id"`
+	IP            string `json:"ip"`
+	Port          int32  `json:"port"`
+	UPNPIP        string `json:"upnp_ip"`
+	UPNPPort      int32  `json:"upnp_port"`
+	NATType       int8   `json:"nat_type"`
+	UPNPAvailable int8   `json:"upnp_available"`
+}
+
+//分组信息，心跳返回时包含节点在分组中的状态
+type GroupInfo struct {
+	ID             string `json:"id"`
+	Size           uint64 `json:"size"`
+	FileSize       uint32 `json:"file_size"`
+	PieceSize      uint32 `json:"piece_size"`
+	MinPieces      uint32 `json:"min_pieces"`
+	SafePieces     uint32 `json:"safe_pieces"`
+	PerfectPieces  uint32 `json:"perfect_pieces"`
+	FirstFinishVer uint64 `json:"first_finish_ver"`
+	DeletedVer     uint64 `json:"deleted_ver"`
+	FileVer        uint64 `json:"file_ver,omitempty"`
+	NodeVer        uint64 `json:"node_ver,omitempty"`
+	NodeState      int    `json:"node_state,omitempty"`
+	MaxVer         uint64 `json:"max_ver,omitempty"`
+	AddVer         uint64 `json:"add_ver,omitempty"`
+}
+
+type FileInfo struct {
+	MD5       string `json:"md5"`
+	Size      uint64 `json:"size"`
+	Ver       uint64 `json:"ver"`
+	State     int    `json:"state"`
+	Group     string `json:"group"`
+	Type      int    `json:"type"`
+	AddVer    uint64 `json:"add_ver"`
+	LastAddTm uint64 `json:"last_add_tm"`
+	SrcNode   string `json:"src_node"`
+}
+
+type ExpandTask struct {
+	ID          uint64 `json:"id"`
+	Group       string `json:"group"`
+	Node        string `json:"node"`
+	MD5         string `json:"md5"`
+	State       int8   `json:"state"`
+	Tm          int64  `json:"tm"`
+	Timeout     int64  `json:"timeout"`
+	FailedTimes uint32 `json:"failed_times"`
+	Size        uint64 `json:"size"`
+	Level       int8   `json:"level"`
+	Ver         uint64 `json:"ver"`
+	TransType   *int8  `json:"trans_type,omitempty"` //传输方式，版本6
+}
+
+//加密文件的密钥，数据密钥被租户主密钥包装，格式见envelope包
+type FileKeyInfo struct {
+	MD5     string `json:"md5"`
+	Tenant  string `json:"tenant"`
+	KeyVer  uint32 `json:"key_ver"`
+	Wrapped []byte `json:"wrapped"`
+}
+
+//生命周期策略，时间都是相对添加时间的秒数，0表示没有限制
+type PolicyInfo struct {
+	TTL       int64 `json:"ttl"`
+	Retention int64 `json:"retention"`
+	Tier      int   `json:"tier"`
+	Priority  int   `json:"priority,omitempty"` //优先级，版本11
+}
+
+type UnSafeTask struct {
+	ID    uint64 `json:"id"`
+	Group string `json:"group"`
+	Node  string `json:"node"`
+	MD5   string `json:"md5"`
+	State int8   `json:"state"`
+	Tm    int64  `json:"tm"`
+}
+
+type RegisterReq struct {
+	Header
+	Key []byte `json:"key,omitempty"` //节点的Ed25519公钥，版本2
+}
+
+type HeartbeatReq struct {
+	Header
+	Peer       PeerInfo          `json:"peer"`
+	TotalSpace uint64            `json:"total_space"`
+	LeftSpace  int64             `json:"left_space"`
+	State      int               `json:"state"`
+	UpSpeed    int64             `json:"up_speed"`
+	Upload     int64             `json:"upload"`
+	Download   int64             `json:"download"`
+	IsSuper    int               `json:"is_super"`
+	Groups     map[string]uint64 `json:"groups"` //分组ID -> 同步版本号
+	Tasks      []uint64          `json:"tasks"`  //正在执行的扩散任务
+}
+
+type HeartbeatResp struct {
+	RespHeader
+	Groups       []GroupInfo  `json:"groups"`
+	Tasks        []ExpandTask `json:"tasks"`
+	DeleteGroups []string     `json:"delete_groups"`
+}
+
+type ListFilesReq struct {
+	Header
+	Group string `json:"group"`
+	Ver   uint64 `json:"ver"`
+	Num   int    `json:"num"`
+	Type  int    `json:"type"`
+}
+
+type ListFilesResp struct {
+	RespHeader
+	Files []FileInfo `json:"files"`
+}
+
+type AddFileReq struct {
+	Header
+	MD5       string      `json:"md5"`
+	Size      uint64      `json:"size"`
+	Times     int         `json:"times"`
+	NoSource  bool        `json:"no_source"`
+	Tenant    string      `json:"tenant,omitempty"`     //租户，版本4
+	Bucket    string      `json:"bucket,omitempty"`     //不为空时作为存储桶中的对象添加，版本4
+	Key       string      `json:"key,omitempty"`        //对象名，版本4
+	Policy    *PolicyInfo `json:"policy,omitempty"`     //生命周期策略，版本5
+	LegacyMD5 string      `json:"legacy_md5,omitempty"` //MD5为sha256的文件ID时同一内容的md5，登记两者的对应关系，版本14
+}
+
+type AddFileResp struct {
+	RespHeader
+	TaskID  int64  `json:"task_id"`
+	ColdKey string `json:"cold_key,omitempty"` //ERR_P2P_REDIRECT_COLD时上传文件的冷存储对象名，版本17
+}
+
+//获取任务详情和结束任务的请求
+type TaskReq struct {
+	Header
+	TaskID uint64 `json:"task_id"`
+	State  int    `json:"state"` //结束任务时：0-失败，1-成功
+}
+
+type ExpandTaskResp struct {
+	RespHeader
+	Nodes []string    `json:"nodes"` //需要碎片的节点
+	File  *FileInfo   `json:"file"`
+	Group *GroupInfo  `json:"group"`
+	Task  *ExpandTask `json:"task"`
+}
+
+type UnSafeTasksReq struct {
+	Header
+	State int8 `json:"state"`
+	Num   int  `json:"num"`
+}
+
+type UnSafeTasksResp struct {
+	RespHeader
+	Tasks []UnSafeTask `json:"tasks"`
+}
+
+type UnSafeTaskResp struct {
+	RespHeader
+	Task  *UnSafeTask `json:"task"` //任务不存在时为null
+	File  *FileInfo   `json:"file"`
+	Group *GroupInfo  `json:"group"`
+}
+
+type OnlineNodesReq struct {
+	Header
+	Nodes       []string `json:"nodes"`
+	MinUpdateTm int64    `json:"min_update_tm"`
+}
+
+type OnlineNodesResp struct {
+	RespHeader
+	Peers []PeerInfo `json:"peers"`
+}
+
+type DownloadReq struct {
+	Header
+	MD5        string   `json:"md5"`
+	UsedGroups []string `json:"used_groups"` //DownloadMore排除的分组
+}
+
+type DownloadResp struct {
+	RespHeader
+	Nodes   []PeerInfo   `json:"nodes"`
+	Group   *GroupInfo   `json:"group"`
+	Sources []PeerInfo   `json:"sources"`
+	Key     *FileKeyInfo `json:"key,omitempty"` //加密文件的密钥，只返回给有权限的客户端，版本3
+}
+
+type InvalidFileReq struct {
+	Header
+	Group string `json:"group"`
+	MD5   string `json:"md5"`
+}
+
+type SetFileKeyReq struct {
+	Header
+	Key FileKeyInfo `json:"key"`
+}
+
+type ObjectReq struct {
+	Header
+	Tenant string `json:"tenant"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+type BucketPolicyReq struct {
+	Header
+	Tenant string     `json:"tenant"`
+	Bucket string     `json:"bucket"`
+	Policy PolicyInfo `json:"policy"`
+}
+
+//MD5不为空时查询文件，否则Group不为空时查询分组，都为空时返回风险最高的Num个分组（0表示全部）
+type DurabilityReq struct {
+	Header
+	Group string `json:"group"`
+	MD5   string `json:"md5"`
+	Num   int    `json:"num"`
+}
+
+type DurabilityInfo struct {
+	Group          string  `json:"group"`
+	MD5            string  `json:"md5"`
+	MinPieces      uint32  `json:"min_pieces"`
+	Nodes          int     `json:"nodes"`
+	Online         float64 `json:"online"`
+	Unavailability float64 `json:"unavailability"`
+	MTTDL          float64 `json:"mttdl"` //小时
+	LossProb       float64 `json:"loss_prob"`
+	Nines          float64 `json:"nines"`
+	Level          int8    `json:"level"`
+}
+
+type DurabilityResp struct {
+	RespHeader
+	Groups []DurabilityInfo `json:"groups"`
+}
+
+//GetFileID时只用ID，可以是md5或文件ID；MD5只用于版本8到13的BindFileID
+type FileIDReq struct {
+	Header
+	ID  string `json:"id"`
+	MD5 string `json:"md5"`
+}
+
+type FileIDInfo struct {
+	ID  string `json:"id"`
+	MD5 string `json:"md5"`
+	Key string `json:"key"`
+}
+
+type FileIDResp struct {
+	RespHeader
+	Binding *FileIDInfo `json:"binding"` //没有登记时为null
+}
+
+//IssueRelayToken时Delegate和Src需要，RelayKey时不需要其他字段
+type RelayReq struct {
+	Header
+	Delegate string `json:"delegate"`
+	Src      string `json:"src"`
+	Dst      string `json:"dst"` //为空时为Header中的节点
+	MD5      string `json:"md5"`
+}
+
+type RelayTokenResp struct {
+	RespHeader
+	SrcToken string `json:"src_token"`
+	DstToken string `json:"dst_token"`
+}
+
+type RelayKeyResp struct {
+	RespHeader
+	Key []byte `json:"key"` //Ed25519公钥
+}
+
+type RelayStatInfo struct {
+	Token string `json:"token"`
+	Bytes int64  `json:"bytes"`
+	Ms    int64  `json:"ms"`
+}
+
+type ReportRelayReq struct {
+	Header
+	Stats []RelayStatInfo `json:"stats"`
+}
+
+type ReportRelayResp struct {
+	RespHeader
+	Count int `json:"count"` //统计的会话数
+}
+
+type PlanRangeReq struct {
+	Header
+	MD5     string   `json:"md5"`
+	Offset  uint64   `json:"offset"`
+	Length  uint64   `json:"length"`            //为0时读到文件末尾
+	Exclude []string `json:"exclude,omitempty"` //读取失败不再使用的节点，版本16
+}
+
+type RangeStripeInfo struct {
+	Shard       int    `json:"shard"`
+	ShardOffset uint64 `json:"shard_offset"`
+	Offset      uint64 `json:"offset"`
+	Length      uint64 `json:"length"`
+}
+
+type PlanRangeResp struct {
+	RespHeader
+	MD5       string            `json:"md5"`
+	Group     *GroupInfo        `json:"group"`
+	Size      uint64            `json:"size"`
+	ShardSize uint64            `json:"shard_size"`
+	Offset    uint64            `json:"offset"`
+	Length    uint64            `json:"length"`
+	Stripes   []RangeStripeInfo `json:"stripes"`
+	Peers     []PeerInfo        `json:"peers"`
+}
+
+type IngestReq struct {
+	Header
+	Ticket uint64 `json:"ticket"` //为0时只查询队列状态
+}
+
+type IngestInfo struct {
+	Ticket   uint64 `json:"ticket"`
+	MD5      string `json:"md5"`
+	SrcNode  string `json:"src_node"`
+	Size     uint64 `json:"size"`
+	State    int8   `json:"state"`
+	Reason   string `json:"reason"`
+	AddTm    int64  `json:"add_tm"`
+	UpdateTm int64  `json:"update_tm"`
+	Tries    uint32 `json:"tries"`
+	NextTm   int64  `json:"next_tm"`
+	TaskID   int64  `json:"task_id"`
+	Error    string `json:"error"`
+}
+
+type IngestResp struct {
+	RespHeader
+	Ingest   *IngestInfo `json:"ingest,omitempty"`
+	Pending  int         `json:"pending"`   //等待中的文件数
+	OldestTm int64       `json:"oldest_tm"` //最早进入队列的等待中文件的时间
+}
+
+type PieceTokenReq struct {
+	Header
+	Task   uint64         `json:"task"`   //扩散任务ID，任务属于Header中的节点
+	Pieces map[string]int `json:"pieces"` //接收端节点ID -> 推送给它的碎片序号，版本18
+}
+
+type PieceTokenResp struct {
+	RespHeader
+	Tokens map[string]string `json:"tokens"` //接收端节点ID -> 令牌
+}
+
+//查询Header中的节点的历史记录，时间范围为[From, To)（秒）
+type NodeHistoryReq struct {
+	Header
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+type OnlineIntervalInfo struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type NodeSampleInfo struct {
+	Tm        int64 `json:"tm"`
+	Span      int64 `json:"span"`
+	Count     int32 `json:"count"`
+	UpSpeed   int64 `json:"up_speed"`
+	Upload    int64 `json:"upload"`
+	Download  int64 `json:"download"`
+	LeftSpace int64 `json:"left_space"`
+	Finished  int32 `json:"finished"`
+	Failed    int32 `json:"failed"`
+}
+
+type NodeHistoryInfo struct {
+	Node    string               `json:"node"`
+	From    int64                `json:"from"`
+	To      int64                `json:"to"`
+	Online  int64                `json:"online"` //[From, To)内的在线秒数
+	Periods []OnlineIntervalInfo `json:"periods"`
+	Samples []NodeSampleInfo     `json:"samples"`
+}
+
+type NodeHistoryResp struct {
+	RespHeader
+	History *NodeHistoryInfo `json:"history"`
+}
+
+//没有返回内容的响应
+type EmptyResp struct {
+	RespHeader
+}
+
+func NewPeerInfo(p *p2p_storage.Peer) PeerInfo {
+	return PeerInfo{p.ID, p.IP, p.Port, p.UPNPIP, p.UPNPPort, p.NATType, p.UPNPAvailable}
+}
+
+func (p *PeerInfo) Peer() p2p_storage.Peer {
+	return p2p_storage.Peer{ID: p.ID, IP: p.IP, Port: p.Port, UPNPIP: p.UPNPIP, UPNPPort: p.UPNPPort, NATType: p.NATType, UPNPAvailable: p.UPNPAvailable}
+}
+
+func NewPeerInfos(peers []p2p_storage.Peer) (infos []PeerInfo) {
+	infos = make([]PeerInfo, len(peers))
+	for i := range peers {
+		infos[i] = NewPeerInfo(&peers[i])
+	}
+	return
+}
+
+func Peers(infos []PeerInfo) (peers []p2p_storage.Peer) {
+	peers = make([]p2p_storage.Peer, len(infos))
+	for i := range infos {
+		peers[i] = infos[i].Peer()
+	}
+	return
+}
+
+func NewDurabilityInfos(ds []p2p_storage.Durability) (infos []DurabilityInfo) {
+	infos = make([]DurabilityInfo, len(ds))
+	for i, d := range ds {
+		infos[i] = DurabilityInfo{d.Group, d.MD5, d.MinPieces, d.Nodes, d.Online, d.Unavailability, d.MTTDL, d.LossProb, d.Nines, d.Level}
+	}
+	return
+}
+
+func Durabilities(infos []DurabilityInfo) (ds []p2p_storage.Durability) {
+	ds = make([]p2p_storage.Durability, len(infos))
+	for i, d := range infos {
+		ds[i] = p2p_storage.Durability{Group: d.Group, MD5: d.MD5, MinPieces: d.MinPieces, Nodes: d.Nodes, Online: d.Online,
+			Unavailability: d.Unavailability, MTTDL: d.MTTDL, LossProb: d.LossProb, Nines: d.Nines, Level: d.Level}
+	}
+	return
+}
+
+func NewFileIDInfo(b *p2p_storage.FileIDBinding) *FileIDInfo {
+	if b == nil {
+		return nil
+	}
+	return &FileIDInfo{b.ID, b.MD5, b.Key}
+}
+
+func (b *FileIDInfo) FileIDBinding() *p2p_storage.FileIDBinding {
+	if b == nil {
+		return nil
+	}
+	return &p2p_storage.FileIDBinding{ID: b.ID, MD5: b.MD5, Key: b.Key}
+}
+
+func NewRelayStatInfos(stats []p2p_storage.RelayStat) (infos []RelayStatInfo) {
+	infos = make([]RelayStatInfo, len(stats))
+	for i, s := range stats {
+		infos[i] = RelayStatInfo{s.Token, s.Bytes, s.Ms}
+	}
+	return
+}
+
+func RelayStats(infos []RelayStatInfo) (stats []p2p_storage.RelayStat) {
+	stats = make([]p2p_storage.RelayStat, len(infos))
+	for i, s := range infos {
+		stats[i] = p2p_storage.RelayStat{Token: s.Token, Bytes: s.Bytes, Ms: s.Ms}
+	}
+	return
+}
+
+func NewPlanRangeResp(plan *p2p_storage.RangePlan) *PlanRangeResp {
+	resp := &PlanRangeResp{MD5: plan.MD5, Group: NewGroupInfo(plan.Group), Size: plan.Size, ShardSize: plan.ShardSize,
+		Offset: plan.Offset, Length: plan.Length, Stripes: make([]RangeStripeInfo, len(plan.Stripes)), Peers: NewPeerInfos(plan.Peers)}
+	for i, s := range plan.Stripes {
+		resp.Stripes[i] = RangeStripeInfo{s.Shard, s.ShardOffset, s.Offset, s.Length}
+	}
+	return resp
+}
+
+func (r *PlanRangeResp) RangePlan() *p2p_storage.RangePlan {
+	plan := &p2p_storage.RangePlan{MD5: r.MD5, Group: r.Group.Group(), Size: r.Size, ShardSize: r.ShardSize,
+		Offset: r.Offset, Length: r.Length, Stripes: make([]p2p_storage.RangeStripe, len(r.Stripes)), Peers: Peers(r.Peers)}
+	for i, s := range r.Stripes {
+		plan.Stripes[i] = p2p_storage.RangeStripe{Shard: s.Shard, ShardOffset: s.ShardOffset, Offset: s.Offset, Length: s.Length}
+	}
+	return plan
+}
+
+func NewGroupInfo(g *p2p_storage.Group) *GroupInfo {
+	if g == nil {
+		return nil
+	}
+	return &GroupInfo{
+		ID:             g.ID,
+		Size:           g.Size,
+		FileSize:       g.FileSize,
+		PieceSize:      g.PieceSize,
+		MinPieces:      g.MinPieces,
+		SafePieces:     g.SafePieces,
+		PerfectPieces:  g.PerfectPieces,
+		FirstFinishVer: g.FirstFinishVer,
+		DeletedVer:     g.DeletedVer,
+	}
+}
+
+func NewNodeGroupInfo(d *p2p_storage.NodeGroupDetail) (info GroupInfo) {
+	info = *NewGroupInfo(&d.Group)
+	info.FileVer = d.FileVer
+	info.NodeVer = d.NodeVer
+	info.NodeState = d.State
+	info.MaxVer = d.MaxVer
+	info.AddVer = d.AddVer
+	return
+}
+
+func (g *GroupInfo) Group() *p2p_storage.Group {
+	if g == nil {
+		return nil
+	}
+	return &p2p_storage.Group{
+		ID:             g.ID,
+		Size:           g.Size,
+		FileSize:       g.FileSize,
+		PieceSize:      g.PieceSize,
+		MinPieces:      g.MinPieces,
+		SafePieces:     g.SafePieces,
+		PerfectPieces:  g.PerfectPieces,
+		FirstFinishVer: g.FirstFinishVer,
+		DeletedVer:     g.DeletedVer,
+	}
+}
+
+func (g *GroupInfo) NodeGroupDetail() p2p_storage.NodeGroupDetail {
+	return p2p_storage.NodeGroupDetail{Group: *g.Group(), FileVer: g.FileVer, NodeVer: g.NodeVer, State: g.NodeState, MaxVer: g.MaxVer, AddVer: g.AddVer}
+}
+
+func NewFileInfo(f *p2p_storage.GroupFile) *FileInfo {
+	if f == nil {
+		return nil
+	}
+	return &FileInfo{f.MD5, f.Size, f.Ver, f.State, f.Group, f.Type, f.AddVer, f.LastAddTm, f.SrcNode}
+}
+
+func (f *FileInfo) GroupFile() *p2p_storage.GroupFile {
+	if f == nil {
+		return nil
+	}
+	return &p2p_storage.GroupFile{
+		File:      p2p_storage.File{MD5: f.MD5, Size: f.Size},
+		Ver:       f.Ver,
+		State:     f.State,
+		Group:     f.Group,
+		Type:      f.Type,
+		AddVer:    f.AddVer,
+		LastAddTm: f.LastAddTm,
+		SrcNode:   f.SrcNode,
+	}
+}
+
+func NewExpandTask(t *p2p_storage.ExpandNode) *ExpandTask {
+	if t == nil {
+		return nil
+	}
+	tp := t.TransType
+	return &ExpandTask{t.ID, t.Group, t.Node, t.MD5, t.State, t.Tm, t.Timeout, t.FailedTimes, t.Size, t.Level, t.Ver, &tp}
+}
+
+func (t *ExpandTask) ExpandNode() *p2p_storage.ExpandNode {
+	if t == nil {
+		return nil
+	}
+	tp := p2p_storage.EXPAND_TRANS_TYPE_NODE
+	if t.TransType != nil {
+		tp = *t.TransType
+	}
+	return &p2p_storage.ExpandNode{ID: t.ID, Group: t.Group, Node: t.Node, MD5: t.MD5, State: t.State, Tm: t.Tm, Timeout: t.Timeout, FailedTimes: t.FailedTimes, Size: t.Size, Level: t.Level, Ver: t.Ver, TransType: tp}
+}
+
+func NewUnSafeTask(t *p2p_storage.UnSafeExpandNode) *UnSafeTask {
+	if t == nil {
+		return nil
+	}
+	return &UnSafeTask{t.ID, t.Group, t.Node, t.MD5, t.State, t.Tm}
+}
+
+func (t *UnSafeTask) UnSafeExpandNode() *p2p_storage.UnSafeExpandNode {
+	if t == nil {
+		return nil
+	}
+	return &p2p_storage.UnSafeExpandNode{ID: t.ID, Group: t.Group, Node: t.Node, MD5: t.MD5, State: t.State, Tm: t.Tm}
+}
+
+func NewFileKeyInfo(k *p2p_storage.FileKey) *FileKeyInfo {
+	if k == nil {
+		return nil
+	}
+	return &FileKeyInfo{k.MD5, k.Tenant, k.KeyVer, k.Wrapped}
+}
+
+func (k *FileKeyInfo) FileKey() *p2p_storage.FileKey {
+	if k == nil {
+		return nil
+	}
+	return &p2p_storage.FileKey{MD5: k.MD5, Tenant: k.Tenant, KeyVer: k.KeyVer, Wrapped: k.Wrapped}
+}
+
+func NewPolicyInfo(p *p2p_storage.Policy) *PolicyInfo {
+	if p == nil {
+		return nil
+	}
+	return &PolicyInfo{p.TTL, p.Retention, p.Tier, p.Priority}
+}
+
+func (p *PolicyInfo) Policy() *p2p_storage.Policy {
+	if p == nil {
+		return nil
+	}
+	return &p2p_storage.Policy{TTL: p.TTL, Retention: p.Retention, Tier: p.Tier, Priority: p.Priority}
+}
+
+func NewIngestInfo(p *p2p_storage.PendingIngest) *IngestInfo {
+	if p == nil {
+		return nil
+	}
+	return &IngestInfo{p.Ticket, p.MD5, p.SrcNode, p.Size, p.State, p.Reason, p.AddTm, p.UpdateTm, p.Tries, p.NextTm, p.TaskID, p.Error}
+}
+
+func (i *IngestInfo) PendingIngest() *p2p_storage.PendingIngest {
+	if i == nil {
+		return nil
+	}
+	return &p2p_storage.PendingIngest{Ticket: i.Ticket, MD5: i.MD5, SrcNode: i.SrcNode, Size: i.Size, State: i.State, Reason: i.Reason,
+		AddTm: i.AddTm, UpdateTm: i.UpdateTm, Tries: i.Tries, NextTm: i.NextTm, TaskID: i.TaskID, Error: i.Error}
+}
+
+func NewNodeHistoryInfo(h *p2p_storage.NodeHistory) *NodeHistoryInfo {
+	if h == nil {
+		return nil
+	}
+	info := &NodeHistoryInfo{Node: h.Node, From: h.From, To: h.To, Online: h.Online,
+		Periods: make([]OnlineIntervalInfo, len(h.Periods)), Samples: make([]NodeSampleInfo, len(h.Samples))}
+	for i, p := range h.Periods {
+		info.Periods[i] = OnlineIntervalInfo{p.Start, p.End}
+	}
+	for i, s := range h.Samples {
+		info.Samples[i] = NodeSampleInfo{s.Tm, s.Span, s.Count, s.UpSpeed, s.Upload, s.Download, s.LeftSpace, s.Finished, s.Failed}
+	}
+	return info
+}
+
+func (info *NodeHistoryInfo) NodeHistory() *p2p_storage.NodeHistory {
+	if info == nil {
+		return nil
+	}
+	h := &p2p_storage.NodeHistory{Node: info.Node, From: info.From, To: info.To, Online: info.Online,
+		Periods: make([]p2p_storage.OnlineInterval, len(info.Periods)), Samples: make([]p2p_storage.NodeSample, len(info.Samples))}
+	for i, p := range info.Periods {
+		h.Periods[i] = p2p_storage.OnlineInterval{Start: p.Start, End: p.End}
+	}
+	for i, s := range info.Samples {
+		h.Samples[i] = p2p_storage.NodeSample{Node: info.Node, Tm: s.Tm, Span: s.Span, Count: s.Count, UpSpeed: s.UpSpeed, Upload: s.Upload,
+			Download: s.Download, LeftSpace: s.LeftSpace, Finished: s.Finished, Failed: s.Failed}
+	}
+	return h
+}
@@ -0,0 +1,136 @@
+package node_api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+//协议中的所有请求和响应，新增类型时需要在testdata中增加样例
+var messages = map[string]func() interface{}{
+	"RegisterReq":     func() interface{} { return &RegisterReq{} },
+	"HeartbeatReq":    func() interface{} { return &HeartbeatReq{} },
+	"HeartbeatResp":   func() interface{} { return &HeartbeatResp{} },
+	"ListFilesReq":    func() interface{} { return &ListFilesReq{} },
+	"ListFilesResp":   func() interface{} { return &ListFilesResp{} },
+	"AddFileReq":      func() interface{} { return &AddFileReq{} },
+	"AddFileResp":     func() interface{} { return &AddFileResp{} },
+	"TaskReq":         func() interface{} { return &TaskReq{} },
+	"ExpandTaskResp":  func() interface{} { return &ExpandTaskResp{} },
+	"UnSafeTasksReq":  func() interface{} { return &UnSafeTasksReq{} },
+	"UnSafeTasksResp": func() interface{} { return &UnSafeTasksResp{} },
+	"UnSafeTaskResp":  func() interface{} { return &UnSafeTaskResp{} },
+	"OnlineNodesReq":  func() interface{} { return &OnlineNodesReq{} },
+	"OnlineNodesResp": func() interface{} { return &OnlineNodesResp{} },
+	"DownloadReq":     func() interface{} { return &DownloadReq{} },
+	"DownloadResp":    func() interface{} { return &DownloadResp{} },
+	"InvalidFileReq":  func() interface{} { return &InvalidFileReq{} },
+	"SetFileKeyReq":   func() interface{} { return &SetFileKeyReq{} },
+	"ObjectReq":       func() interface{} { return &ObjectReq{} },
+	"BucketPolicyReq": func() interface{} { return &BucketPolicyReq{} },
+	"DurabilityReq":   func() interface{} { return &DurabilityReq{} },
+	"DurabilityResp":  func() interface{} { return &DurabilityResp{} },
+	"FileIDReq":       func() interface{} { return &FileIDReq{} },
+	"FileIDResp":      func() interface{} { return &FileIDResp{} },
+	"RelayReq":        func() interface{} { return &RelayReq{} },
+	"RelayTokenResp":  func() interface{} { return &RelayTokenResp{} },
+	"RelayKeyResp":    func() interface{} { return &RelayKeyResp{} },
+	"ReportRelayReq":  func() interface{} { return &ReportRelayReq{} },
+	"ReportRelayResp": func() interface{} { return &ReportRelayResp{} },
+	"PlanRangeReq":    func() interface{} { return &PlanRangeReq{} },
+	"PlanRangeResp":   func() interface{} { return &PlanRangeResp{} },
+	"IngestReq":       func() interface{} { return &IngestReq{} },
+	"IngestResp":      func() interface{} { return &IngestResp{} },
+	"PieceTokenReq":   func() interface{} { return &PieceTokenReq{} },
+	"PieceTokenResp":  func() interface{} { return &PieceTokenResp{} },
+	"NodeHistoryReq":  func() interface{} { return &NodeHistoryReq{} },
+	"NodeHistoryResp": func() interface{} { return &NodeHistoryResp{} },
+	"EmptyResp":       func() interface{} { return &EmptyResp{} },
+}
+
+//old中的每个字段在cur中都存在，且类型相同、值相同
+func contains(t *testing.T, path string, old, cur interface{}) {
+	switch o := old.(type) {
+	case map[string]interface{}:
+		c, ok := cur.(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: %v is not an object", path, cur)
+			return
+		}
+		for k, v := range o {
+			cv, ok := c[k]
+			if !ok {
+				t.Errorf("%s.%s: field removed", path, k)
+				continue
+			}
+			contains(t, path+"."+k, v, cv)
+		}
+	case []interface{}:
+		c, ok := cur.([]interface{})
+		if !ok || len(c) != len(o) {
+			t.Errorf("%s: %v, want %v", path, cur, old)
+			return
+		}
+		for i := range o {
+			contains(t, path, o[i], c[i])
+		}
+	default:
+		if old != cur {
+			t.Errorf("%s: %v, want %v", path, cur, old)
+		}
+	}
+}
+
+func TestCompatibility(t *testing.T) {
+	files, e := filepath.Glob("testdata/v*.json")
+	if e != nil || len(files) == 0 {
+		t.Fatalf("no samples: %v", e)
+	}
+	sampled := make(map[string]bool)
+	for _, file := range files {
+		b, e := ioutil.ReadFile(file)
+		if e != nil {
+			t.Fatal(e)
+		}
+		var samples map[string]json.RawMessage
+		if e = json.Unmarshal(b, &samples); e != nil {
+			t.Fatal(e)
+		}
+		for name, sample := range samples {
+			sampled[name] = true
+			newMsg, ok := messages[name]
+			if !ok {
+				t.Errorf("%s: message %s removed", file, name)
+				continue
+			}
+			msg := newMsg()
+			if e = json.Unmarshal(sample, msg); e != nil {
+				t.Errorf("%s %s: %v", file, name, e)
+				continue
+			}
+			out, _ := json.Marshal(msg)
+			var old, cur interface{}
+			json.Unmarshal(sample, &old)
+			json.Unmarshal(out, &cur)
+			contains(t, filepath.Base(file)+" "+name, old, cur)
+		}
+	}
+	//v1.json中有版本1的所有类型，之后新增的类型在引入它的版本中
+	for name := range messages {
+		if !sampled[name] {
+			t.Errorf("no sample of %s", name)
+		}
+	}
+}
+
+//新版本增加的字段不影响旧版本解析
+func TestUnknownFields(t *testing.T) {
+	var r HeartbeatReq
+	if e := json.Unmarshal([]byte(`{"v":2,"node":"n1","groups":{"g1":3},"new_field":{"a":1}}`), &r); e != nil {
+		t.Fatal(e)
+	}
+	if r.Version != 2 || r.Node != "n1" || r.Groups["g1"] != 3 {
+		t.Errorf("%+v", r)
+	}
+}
@@ -0,0 +1,232 @@
+package p2p_storage
+
+import (
+	"yh_pkg/service"
+	"yh_pkg/time"
+	"yh_pkg/trace"
+)
+
+/*
+	节点的历史记录。节点详情只保存最近一次心跳的信息，历史记录按时间段保存心跳汇报的速度、剩余空间和结束的扩散任务数，
+	以及根据心跳得到的在线区间，用于计算节点的在线率、排查节点某个时间是否在线。
+	存储与IDataSource无关，需要用SetNodeHistoryStore设置（yh_pkg/p2p_storage/history中的FileStore保存到文件，MemStore只用于测试），
+	没有设置时不记录。最近NODE_HISTORY_RAW_TIME内的样本按NODE_HISTORY_RESOLUTION保存，之前的降采样为
+	NODE_HISTORY_COARSE_SPAN，超过node_history_days配置的天数后删除。
+*/
+const (
+	NODE_HISTORY_RESOLUTION  int64 = 300        //原始样本的时间段长度（秒）
+	NODE_HISTORY_COARSE_SPAN int64 = 3600       //降采样后的时间段长度（秒）
+	NODE_HISTORY_RAW_TIME    int64 = 48 * 3600  //原始样本的保留时间（秒），之后降采样
+	NODE_HISTORY_MAX_RANGE   int64 = 90 * 86400 //一次查询的最大时间范围（秒）
+)
+
+//一个时间段内的汇总
+type NodeSample struct {
+	Node      string `json:"node"`
+	Tm        int64  `json:"tm"`         //时间段开始时间（秒）
+	Span      int64  `json:"span"`       //时间段长度（秒）
+	Count     int32  `json:"count"`      //心跳次数
+	UpSpeed   int64  `json:"up_speed"`   //平均上行带宽
+	Upload    int64  `json:"upload"`     //平均上传速度
+	Download  int64  `json:"download"`   //平均下载速度
+	LeftSpace int64  `json:"left_space"` //最后一次心跳汇报的剩余空间
+	Finished  int32  `json:"finished"`   //完成的扩散任务数
+	Failed    int32  `json:"failed"`     //失败的扩散任务数
+}
+
+//在线区间，相邻心跳间隔不超过NODE_VALID_TIME时属于同一区间
+type OnlineInterval struct {
+	Start int64 `json:"start"` //第一次心跳时间（秒）
+	End   int64 `json:"end"`   //最后一次心跳时间（秒）
+}
+
+type NodeHistory struct {
+	Node    string           `json:"node"`
+	From    int64            `json:"from"`
+	To      int64            `json:"to"`
+	Online  int64            `json:"online"` //[From, To)内的在线秒数
+	Periods []OnlineInterval `json:"periods"`
+	Samples []NodeSample     `json:"samples"`
+}
+
+/*
+	节点历史记录的存储
+*/
+type INodeHistoryStore interface {
+	//与已有的同一节点、同一时间段的样本合并（NodeSample.Merge），没有时新增
+	AddNodeSample(s *NodeSample) (e error)
+	//与[from, to)有重叠的样本，按时间排序
+	GetNodeSamples(nid string, from, to int64) (samples []NodeSample, e error)
+	//tm与最后一个区间的End相差不超过gap时延长该区间，否则新增区间[tm, tm]
+	AddNodeOnline(nid string, tm, gap int64) (e error)
+	//与[from, to)有重叠的区间，按时间排序
+	GetNodeOnline(nid string, from, to int64) (periods []OnlineInterval, e error)
+	//把before之前结束的样本降采样为span长度（DownsampleNodeSamples），删除expire之前结束的样本和区间
+	CompactNodeHistory(before, span, expire int64) (e error)
+}
+
+var historyStore INodeHistoryStore
+
+//设置节点历史记录的存储
+func SetNodeHistoryStore(s INodeHistoryStore) {
+	historyStore = s
+}
+
+//把同一时间段的另一个样本合并进来，速度按心跳次数加权平均
+func (s *NodeSample) Merge(o *NodeSample) {
+	if n := int64(s.Count) + int64(o.Count); n > 0 {
+		s.UpSpeed = (s.UpSpeed*int64(s.Count) + o.UpSpeed*int64(o.Count)) / n
+		s.Upload = (s.Upload*int64(s.Count) + o.Upload*int64(o.Count)) / n
+		s.Download = (s.Download*int64(s.Count) + o.Download*int64(o.Count)) / n
+	}
+	if o.Count > 0 {
+		s.LeftSpace = o.LeftSpace
+	}
+	s.Count += o.Count
+	s.Finished += o.Finished
+	s.Failed += o.Failed
+}
+
+/*
+	把同一节点按时间排序的样本合并为span长度的时间段，长度不小于span的样本不变
+
+	返回值：
+		out: 按时间排序
+*/
+func DownsampleNodeSamples(samples []NodeSample, span int64) (out []NodeSample) {
+	out = make([]NodeSample, 0, len(samples))
+	for _, s := range samples {
+		if s.Span < span {
+			s.Tm -= s.Tm % span
+			s.Span = span
+		}
+		if n := len(out); n > 0 && out[n-1].Tm == s.Tm && out[n-1].Span == s.Span {
+			out[n-1].Merge(&s)
+			continue
+		}
+		out = append(out, s)
+	}
+	return
+}
+
+func nodeHistoryBucket(tm int64) int64 {
+	return tm - tm%NODE_HISTORY_RESOLUTION
+}
+
+//记录节点心跳，节点在线时同时延长在线区间
+func recordNodeHeartbeat(node *Node) {
+	if historyStore == nil {
+		return
+	}
+	now := time.Now.Unix()
+	s := &NodeSample{Node: node.ID, Tm: nodeHistoryBucket(now), Span: NODE_HISTORY_RESOLUTION, Count: 1,
+		UpSpeed: node.UpSpeed, Upload: node.Upload, Download: node.Download, LeftSpace: node.LeftSpace}
+	if e := historyStore.AddNodeSample(s); e != nil {
+		logger.AppendObj(e, "AddNodeSample error", node.ID)
+	}
+	if node.State != YES {
+		return
+	}
+	if e := historyStore.AddNodeOnline(node.ID, now, NODE_VALID_TIME); e != nil {
+		logger.AppendObj(e, "AddNodeOnline error", node.ID)
+	}
+}
+
+//记录节点结束的扩散任务
+func recordNodeTask(nid string, to int8) {
+	if historyStore == nil || (to != EXPAND_STATE_FINISHED && to != EXPAND_STATE_FAILED) {
+		return
+	}
+	now := time.Now.Unix()
+	s := &NodeSample{Node: nid, Tm: nodeHistoryBucket(now), Span: NODE_HISTORY_RESOLUTION}
+	if to == EXPAND_STATE_FINISHED {
+		s.Finished = 1
+	} else {
+		s.Failed = 1
+	}
+	if e := historyStore.AddNodeSample(s); e != nil {
+		logger.AppendObj(e, "AddNodeSample error", nid)
+	}
+}
+
+//降采样并删除超过保留天数的记录
+func CompactNodeHistory() (e error) {
+	defer trace.Begin("p2p_storage.CompactNodeHistory").End(&e)
+	if historyStore == nil {
+		return
+	}
+	now := time.Now.Unix()
+	days := getConfigInt64(NODE_HISTORY_DAYS_KEY, DEFAULT_NODE_HISTORY_DAYS)
+	return historyStore.CompactNodeHistory(now-NODE_HISTORY_RAW_TIME, NODE_HISTORY_COARSE_SPAN, now-days*86400)
+}
+
+func checkNodeHistoryRange(from, to int64) (e error) {
+	if from >= to || to-from > NODE_HISTORY_MAX_RANGE {
+		return service.NewError(service.ERR_INVALID_PARAM, "invalid history range")
+	}
+	if historyStore == nil {
+		return service.NewError(service.ERR_INTERNAL, "node history store not set")
+	}
+	return
+}
+
+//区间与[from, to)重叠的秒数之和
+func onlineSeconds(periods []OnlineInterval, from, to int64) (online int64) {
+	for _, p := range periods {
+		start, end := p.Start, p.End
+		if start < from {
+			start = from
+		}
+		if end > to {
+			end = to
+		}
+		if end > start {
+			online += end - start
+		}
+	}
+	return
+}
+
+/*
+	节点在[from, to)内的历史记录
+
+	参数：
+		from, to: 时间范围（秒），不能超过NODE_HISTORY_MAX_RANGE
+*/
+func GetNodeHistory(nid string, from, to int64) (h *NodeHistory, e error) {
+	return WithSpan(nil).GetNodeHistory(nid, from, to)
+}
+
+func (c Caller) GetNodeHistory(nid string, from, to int64) (h *NodeHistory, e error) {
+	defer c.parent.Child("p2p_storage.GetNodeHistory").SetAttr("nid", nid).End(&e)
+	if e = checkNodeHistoryRange(from, to); e != nil {
+		return
+	}
+	h = &NodeHistory{Node: nid, From: from, To: to}
+	if h.Periods, e = historyStore.GetNodeOnline(nid, from, to); e != nil {
+		return nil, e
+	}
+	if h.Samples, e = historyStore.GetNodeSamples(nid, from, to); e != nil {
+		return nil, e
+	}
+	h.Online = onlineSeconds(h.Periods, from, to)
+	return
+}
+
+/*
+	节点在[from, to)内的在线率，可以代替按OnlineCount估计的可用率用于节点权重和耐久度估计
+
+	返回值：
+		ratio: 在线秒数/(to-from)
+*/
+func NodeOnlineRatio(nid string, from, to int64) (ratio float64, e error) {
+	defer trace.Begin("p2p_storage.NodeOnlineRatio").SetAttr("nid", nid).End(&e)
+	if e = checkNodeHistoryRange(from, to); e != nil {
+		return
+	}
+	periods, e := historyStore.GetNodeOnline(nid, from, to)
+	if e != nil {
+		return
+	}
+	return float64(onlineSeconds(periods, from, to)) / float64(to-from), nil
+}
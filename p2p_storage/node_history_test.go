@@ -0,0 +1,112 @@
+package p2p_storage_test
+
+import (
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/history"
+	"yh_pkg/service"
+)
+
+//心跳记录到节点的历史记录中，在线的心跳同时延长在线区间，按时间范围查询
+func TestNodeHistory(t *testing.T) {
+	newFixture(t)
+	p2p_storage.SetNodeHistoryStore(history.NewMemStore())
+	defer p2p_storage.SetNodeHistoryStore(nil)
+	node := &p2p_storage.Node{Peer: p2p_storage.Peer{ID: "n01", IP: "10.0.0.1", Port: 8000}, TotalSpace: 1 << 30, LeftSpace: 1 << 30, State: p2p_storage.YES}
+	//超级节点的心跳总是在线
+	for i := 0; i < 2; i++ {
+		if _, _, _, e := p2p_storage.UpdateNode2(node, map[string]uint64{}, nil, p2p_storage.YES); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	now := time.Now().Unix()
+	h, e := p2p_storage.GetNodeHistory("n01", now-3600, now+3600)
+	if e != nil || h.Node != "n01" || len(h.Periods) != 1 || len(h.Samples) == 0 || h.Samples[0].Count != 2 {
+		t.Fatalf("GetNodeHistory: %+v %v", h, e)
+	}
+	for _, r := range [][2]int64{{now, now - 1}, {now, now}, {now - p2p_storage.NODE_HISTORY_MAX_RANGE - 1, now}} {
+		if _, e = p2p_storage.GetNodeHistory("n01", r[0], r[1]); errCode(e) != service.ERR_INVALID_PARAM {
+			t.Errorf("range %v: %v", r, e)
+		}
+	}
+}
+
+//在线率为[from, to)内在线区间的秒数占比
+func TestNodeOnlineRatio(t *testing.T) {
+	newFixture(t)
+	store := history.NewMemStore()
+	p2p_storage.SetNodeHistoryStore(store)
+	defer p2p_storage.SetNodeHistoryStore(nil)
+	const base = 1000000
+	for _, tm := range []int64{base, base + 600} {
+		if e := store.AddNodeOnline("n01", tm, p2p_storage.NODE_VALID_TIME); e != nil {
+			t.Fatal(e)
+		}
+	}
+	cases := []struct {
+		nid      string
+		from, to int64
+		want     float64
+	}{
+		{"n01", base, base + 1200, 0.5},
+		{"n01", base + 300, base + 600, 1},
+		{"n01", base + 600, base + 1200, 0},
+		{"n02", base, base + 1200, 0},
+	}
+	for _, c := range cases {
+		if r, e := p2p_storage.NodeOnlineRatio(c.nid, c.from, c.to); e != nil || r != c.want {
+			t.Errorf("NodeOnlineRatio(%s, %d, %d) = %v %v, want %v", c.nid, c.from-base, c.to-base, r, e, c.want)
+		}
+	}
+	if _, e := p2p_storage.NodeOnlineRatio("n01", base, base); errCode(e) != service.ERR_INVALID_PARAM {
+		t.Errorf("empty range: %v", e)
+	}
+}
+
+//结束的扩散任务按结果记录到执行节点的历史，节点重启中断的任务不计为失败
+func TestNodeHistoryTasks(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	const md5 = "0123456789abcdef0123456789abcdef"
+	f.addFile(md5, nil)
+	f.sync(md5)
+	p2p_storage.SetNodeHistoryStore(history.NewMemStore())
+	defer p2p_storage.SetNodeHistoryStore(nil)
+	cases := []struct {
+		nid              string
+		finish           func(id uint64) error
+		finished, failed int32
+	}{
+		{"n01", func(id uint64) error { return p2p_storage.ExpandFinished(id, int8(p2p_storage.YES)) }, 1, 0},
+		{"n02", func(id uint64) error { return p2p_storage.ExpandFinished(id, int8(p2p_storage.NO)) }, 0, 1},
+		{"n03", func(uint64) error { return p2p_storage.RestartInitExpandNodeState("n03") }, 0, 0},
+	}
+	now := time.Now().Unix()
+	for _, c := range cases {
+		task := &p2p_storage.ExpandNode{Group: GID, Node: c.nid, MD5: md5, State: p2p_storage.EXPAND_STATE_NOTIFIED, Timeout: now + 3600}
+		id, e := f.ds.AddOrUpdateExpandNode(task)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if e = c.finish(uint64(id)); e != nil {
+			t.Fatal(e)
+		}
+		h, e := p2p_storage.GetNodeHistory(c.nid, now-3600, now+3600)
+		if e != nil {
+			t.Fatal(e)
+		}
+		var finished, failed int32
+		for _, s := range h.Samples {
+			finished += s.Finished
+			failed += s.Failed
+		}
+		if finished != c.finished || failed != c.failed {
+			t.Errorf("%s: finished %d, failed %d, want %d, %d", c.nid, finished, failed, c.finished, c.failed)
+		}
+	}
+	if e := p2p_storage.CompactNodeHistory(); e != nil {
+		t.Error(e)
+	}
+}
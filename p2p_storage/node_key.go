@@ -0,0 +1,248 @@
+package p2p_storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"yh_pkg/service"
+	"yh_pkg/time"
+)
+
+//节点签名的有效时间（秒），签名时间与服务器时间相差超过该值的请求被拒绝，nonce也只需要保存这么久
+const NODE_SIGN_WINDOW int64 = 300
+
+/*
+	节点公钥存储，节点使用Ed25519密钥对签名上报的请求。
+	实现可以与IDataSource使用同一个数据库，IDataSource同时实现该接口时Init会自动使用。
+*/
+type INodeKeyStore interface {
+	/*
+		获取节点公钥
+
+		返回值：
+			key: 节点公钥，不存在时返回nil,nil
+	*/
+	GetNodeKey(nid string) (key []byte, e error)
+	/*
+		保存节点公钥，节点已有公钥时不覆盖
+
+		返回值：
+			ok: 节点已有公钥时返回false
+	*/
+	AddNodeKey(nid string, key []byte) (ok bool, e error)
+	DeleteNodeKey(nid string) (e error)
+	/*
+		记录节点使用过的nonce，用于防止请求重放
+
+		参数：
+			expire: nonce记录的过期时间（秒），过期后可以删除
+		返回值：
+			ok: nonce已经使用过时返回false
+	*/
+	UseNonce(nid string, nonce string, expire int64) (ok bool, e error)
+}
+
+var keyStore INodeKeyStore
+
+//设置节点公钥存储，为nil时不能登记公钥和校验签名
+func SetNodeKeyStore(ks INodeKeyStore) {
+	keyStore = ks
+}
+
+/*
+	注册节点并登记节点公钥。节点已有公钥时，只有公钥相同才能重新注册；
+	已经注册但没有公钥的节点（版本2之前注册的或者公钥被吊销的）不能自行登记，需要经过授权后调用ReEnrollNode，
+	否则任何人都可以抢先为它登记公钥。
+
+	参数：
+		id: 节点ID
+		key: Ed25519公钥
+*/
+func EnrollNode(id string, key []byte) (e error) {
+	return WithSpan(nil).EnrollNode(id, key)
+}
+
+func (c Caller) EnrollNode(id string, key []byte) (e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.EnrollNode")
+	defer span.SetAttr("id", id).End(&e)
+	if len(key) != ed25519.PublicKeySize {
+		return service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("invalid node key size %d", len(key)))
+	}
+	if keyStore == nil {
+		return service.NewError(service.ERR_INTERNAL, "node key store not set")
+	}
+	old, e := keyStore.GetNodeKey(id)
+	if e != nil {
+		return
+	}
+	if old == nil {
+		exist, e := source.Raw.IsNodeExist(id)
+		if e != nil {
+			return e
+		}
+		if exist {
+			return service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, "node "+id+" is registered without key, enroll needs authorization")
+		}
+		ok, e := keyStore.AddNodeKey(id, key)
+		if e != nil {
+			return e
+		}
+		if !ok {
+			//并发登记，重新读取已登记的公钥
+			if old, e = keyStore.GetNodeKey(id); e != nil {
+				return e
+			}
+		}
+	}
+	if old != nil && !bytes.Equal(old, key) {
+		return service.NewError(service.ERR_P2P_NODE_KEY_EXIST, "node "+id+" already has another key")
+	}
+	return WithSpan(span).AddNode(id)
+}
+
+/*
+	经过授权后为节点登记公钥，替换节点已有的公钥，用于已注册节点的重新登记和更换密钥。
+	调用方负责确认请求有权操作该节点。
+
+	参数：
+		id: 节点ID
+		key: Ed25519公钥
+*/
+func ReEnrollNode(id string, key []byte) (e error) {
+	return WithSpan(nil).ReEnrollNode(id, key)
+}
+
+func (c Caller) ReEnrollNode(id string, key []byte) (e error) {
+	span := c.parent.Child("p2p_storage.ReEnrollNode")
+	defer span.SetAttr("id", id).End(&e)
+	if len(key) != ed25519.PublicKeySize {
+		return service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("invalid node key size %d", len(key)))
+	}
+	if keyStore == nil {
+		return service.NewError(service.ERR_INTERNAL, "node key store not set")
+	}
+	logger.AppendObj(nil, "ReEnrollNode", id)
+	if e = keyStore.DeleteNodeKey(id); e != nil {
+		return
+	}
+	ok, e := keyStore.AddNodeKey(id, key)
+	if e != nil {
+		return
+	}
+	if !ok {
+		return service.NewError(service.ERR_P2P_NODE_KEY_EXIST, "node "+id+" enrolled concurrently")
+	}
+	return WithSpan(span).AddNode(id)
+}
+
+//节点是否登记了公钥，没有设置节点公钥存储时返回false
+func HasNodeKey(nid string) (ok bool, e error) {
+	if keyStore == nil || nid == "" {
+		return
+	}
+	key, e := keyStore.GetNodeKey(nid)
+	return key != nil, e
+}
+
+//吊销节点公钥，节点需要经过授权重新登记（ReEnrollNode）才能上报
+func RevokeNodeKey(id string) (e error) {
+	return WithSpan(nil).RevokeNodeKey(id)
+}
+
+func (c Caller) RevokeNodeKey(id string) (e error) {
+	defer c.parent.Child("p2p_storage.RevokeNodeKey").SetAttr("id", id).End(&e)
+	if keyStore == nil {
+		return
+	}
+	logger.AppendObj(nil, "RevokeNodeKey", id)
+	return keyStore.DeleteNodeKey(id)
+}
+
+/*
+	校验节点签名
+
+	参数：
+		nid: 节点ID
+		tm: 签名时间（秒）
+		nonce: 随机字符串，同一节点在NODE_SIGN_WINDOW内不能重复
+		msg: 签名的内容，必须包含tm和nonce
+		sig: 签名
+*/
+func VerifyNodeSign(nid string, tm int64, nonce string, msg, sig []byte) (e error) {
+	return WithSpan(nil).VerifyNodeSign(nid, tm, nonce, msg, sig)
+}
+
+func (c Caller) VerifyNodeSign(nid string, tm int64, nonce string, msg, sig []byte) (e error) {
+	defer c.parent.Child("p2p_storage.VerifyNodeSign").SetAttr("nid", nid).End(&e)
+	if keyStore == nil {
+		return service.NewError(service.ERR_INTERNAL, "node key store not set")
+	}
+	key, e := keyStore.GetNodeKey(nid)
+	if e != nil {
+		return
+	}
+	if key == nil {
+		return service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, "node "+nid+" has no key")
+	}
+	return verifySign(nid, key, tm, nonce, msg, sig)
+}
+
+//用指定的公钥校验签名，注册时用于证明节点持有私钥
+func VerifySignWithKey(nid string, key []byte, tm int64, nonce string, msg, sig []byte) (e error) {
+	return WithSpan(nil).VerifySignWithKey(nid, key, tm, nonce, msg, sig)
+}
+
+func (c Caller) VerifySignWithKey(nid string, key []byte, tm int64, nonce string, msg, sig []byte) (e error) {
+	defer c.parent.Child("p2p_storage.VerifySignWithKey").SetAttr("nid", nid).End(&e)
+	if keyStore == nil {
+		return service.NewError(service.ERR_INTERNAL, "node key store not set")
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("invalid node key size %d", len(key)))
+	}
+	return verifySign(nid, key, tm, nonce, msg, sig)
+}
+
+func verifySign(nid string, key []byte, tm int64, nonce string, msg, sig []byte) (e error) {
+	now := time.Now.Unix()
+	if tm < now-NODE_SIGN_WINDOW || tm > now+NODE_SIGN_WINDOW {
+		return service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, fmt.Sprintf("sign time %d expired, now %d", tm, now))
+	}
+	if nonce == "" {
+		return service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, "empty nonce")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), msg, sig) {
+		return service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, "invalid sign of node "+nid)
+	}
+	//签名正确后再记录nonce，避免伪造的请求占用nonce
+	ok, e := keyStore.UseNonce(nid, nonce, tm+NODE_SIGN_WINDOW)
+	if e != nil {
+		return
+	}
+	if !ok {
+		return service.NewError(service.ERR_P2P_NODE_AUTH_FAILED, "nonce "+nonce+" replayed")
+	}
+	return
+}
+
+//获取扩散任务所属的节点，用于校验上报任务结果的节点，任务不存在时返回空
+func GetExpandTaskNode(id uint64) (nid string, e error) {
+	source, span := beginSpan(nil, "p2p_storage.GetExpandTaskNode")
+	defer span.SetAttr("id", id).End(&e)
+	exNode, e := source.Raw.GetExpandNodeById(id)
+	if e != nil || exNode == nil {
+		return
+	}
+	return exNode.Node, nil
+}
+
+//获取危险文件任务所属的节点，任务不存在时返回空
+func GetUnSafeExpandTaskNode(id uint64) (nid string, e error) {
+	source, span := beginSpan(nil, "p2p_storage.GetUnSafeExpandTaskNode")
+	defer span.SetAttr("id", id).End(&e)
+	exNode, e := source.Raw.GetUnSafeExpandNodeById(id)
+	if e != nil || exNode == nil {
+		return
+	}
+	return exNode.Node, nil
+}
@@ -0,0 +1,51 @@
+package p2p_storage_test
+
+import (
+	"testing"
+	"yh_pkg/p2p_storage"
+)
+
+//排空的节点不会被选入分组，恢复后可以再被选中
+func TestDrainNode(t *testing.T) {
+	f := newFixture(t)
+	f.ds.AddGroup(&p2p_storage.Group{ID: "g2", PieceSize: 1024, MinPieces: 1, SafePieces: 2, PerfectPieces: 2})
+	for i, nid := range []string{"d1", "d2", "d3"} {
+		f.addNode(nid, "")
+		f.setSpace(nid, 10*p2p_storage.GROUP_NODE_CAPACITY, 10*p2p_storage.GROUP_NODE_CAPACITY)
+		n, _ := f.ds.GetNodeDetail(nid)
+		n.IP = []string{"10.1.0.1", "10.2.0.1", "10.3.0.1"}[i]
+		f.ds.UpdateNode(n)
+	}
+	if _, _, e := p2p_storage.DrainNode("d1", false); e != nil {
+		t.Fatal(e)
+	}
+	if n, _ := f.ds.GetNodeDetail("d1"); !n.Drained {
+		t.Fatal("drained flag not saved")
+	}
+	if e := p2p_storage.ExpandGroupToPerfectSize("g2"); e != nil {
+		t.Fatal(e)
+	}
+	nodes, _ := f.ds.GetGroupNodes("g2")
+	if len(nodes) != 2 {
+		t.Fatalf("group nodes: %+v", nodes)
+	}
+	for _, n := range nodes {
+		if n.Node == "d1" {
+			t.Error("drained node selected")
+		}
+	}
+
+	if e := p2p_storage.SetNodeDrained("d1", false); e != nil {
+		t.Fatal(e)
+	}
+	f.ds.AddGroup(&p2p_storage.Group{ID: "g3", PieceSize: 1024, MinPieces: 1, SafePieces: 3, PerfectPieces: 3})
+	if e := p2p_storage.ExpandGroupToPerfectSize("g3"); e != nil {
+		t.Fatal(e)
+	}
+	if nodes, _ = f.ds.GetGroupNodes("g3"); len(nodes) != 3 {
+		t.Errorf("undrained node not selected: %+v", nodes)
+	}
+	if e := p2p_storage.SetNodeDrained("none", true); e == nil {
+		t.Error("drain missing node")
+	}
+}
@@ -0,0 +1,134 @@
+package p2p_storage
+
+import (
+	"yh_pkg/service"
+	"yh_pkg/trace"
+)
+
+//对象存储中对象的元信息
+type ObjectInfo struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+	Tm   int64  `json:"tm"` //最后修改时间，秒数
+}
+
+//分块上传中已经上传的块
+type Part struct {
+	Num  int    `json:"num"` //块序号，从1开始
+	ETag string `json:"etag"`
+}
+
+/*
+	对象存储（OSS）接口，作为p2p存储的冷存储层。实现见oss包：本地磁盘和S3兼容的对象存储。
+	对象不存在时Get、GetRange返回ERR_OSS_FILE_DELETE，Head返回nil,nil，Delete不返回错误。
+*/
+type IObjectStore interface {
+	Put(key string, data []byte) (e error)
+	Get(key string) (data []byte, e error)
+	/*
+		读取对象的一部分
+
+		参数：
+			offset: 开始位置
+			length: 长度，超出对象末尾时只返回到末尾
+	*/
+	GetRange(key string, offset, length int64) (data []byte, e error)
+	Head(key string) (info *ObjectInfo, e error)
+	Delete(key string) (e error)
+
+	//开始分块上传，返回上传ID
+	CreateMultipart(key string) (uploadId string, e error)
+	UploadPart(key, uploadId string, num int, data []byte) (etag string, e error)
+	//按序号顺序合并已上传的块，完成后对象才可见
+	CompleteMultipart(key, uploadId string, parts []Part) (e error)
+	AbortMultipart(key, uploadId string) (e error)
+}
+
+var coldStore IObjectStore
+
+//设置冷存储，为nil时所有任务都在节点之间传输
+func SetColdStore(s IObjectStore) {
+	coldStore = s
+}
+
+func GetColdStore() IObjectStore {
+	return coldStore
+}
+
+//文件在冷存储中的对象名
+func ColdKey(md5 string) string {
+	if len(md5) < 2 {
+		return "p2p/" + md5
+	}
+	return "p2p/" + fileIDDigest(md5)[:2] + "/" + md5
+}
+
+//文件是否在冷存储中
+func IsInColdStore(md5 string) (exist bool, e error) {
+	return WithSpan(nil).IsInColdStore(md5)
+}
+
+func (c Caller) IsInColdStore(md5 string) (exist bool, e error) {
+	span := c.parent.Child("p2p_storage.IsInColdStore")
+	defer span.SetAttr("md5", md5).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	if coldStore == nil {
+		return
+	}
+	info, e := coldStore.Head(ColdKey(md5))
+	return e == nil && info != nil, e
+}
+
+/*
+	决定扩散任务的传输方式
+
+	返回值：
+		tp: 文件不在冷存储中时为EXPAND_TRANS_TYPE_NODE；
+			p2p系统中的碎片不够拼回文件（IsAvailable为false）时为EXPAND_TRANS_TYPE_OSS，从冷存储获取；
+			否则按TRANS_NODE_CONFIG_KEY配置，1为EXPAND_TRANS_TYPE_BOTH，0为EXPAND_TRANS_TYPE_OSS
+*/
+func GetTransType(md5 string) (tp int8, e error) {
+	span := trace.Begin("p2p_storage.GetTransType")
+	defer span.SetAttr("md5", md5).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	tp = EXPAND_TRANS_TYPE_NODE
+	exist, e := WithSpan(span).IsInColdStore(md5)
+	if e != nil || !exist {
+		return
+	}
+	available, e := WithSpan(span).IsAvailable(md5)
+	if e != nil {
+		return
+	}
+	if !available {
+		return EXPAND_TRANS_TYPE_OSS, nil
+	}
+	transNode, e := ConfigMap.GetInt64Value(TRANS_NODE_CONFIG_KEY)
+	if e != nil {
+		return
+	}
+	if transNode == 0 {
+		return EXPAND_TRANS_TYPE_OSS, nil
+	}
+	return EXPAND_TRANS_TYPE_BOTH, nil
+}
+
+//设置任务的传输方式，出错时使用EXPAND_TRANS_TYPE_NODE
+func setTransType(exNode *ExpandNode) {
+	tp, e := GetTransType(exNode.MD5)
+	if e != nil {
+		logger.AppendObj(e, "setTransType-GetTransType error", exNode.MD5)
+		tp = EXPAND_TRANS_TYPE_NODE
+	}
+	exNode.TransType = tp
+}
+
+//对象存储中对象不存在的错误
+func ObjectNotFound(key string) error {
+	return service.NewError(service.ERR_OSS_FILE_DELETE, "object "+key+" not found")
+}
@@ -0,0 +1,69 @@
+package p2p_storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/oss"
+)
+
+//文件ID的对象名按摘要分散，不按多哈希前缀
+func TestColdKey(t *testing.T) {
+	const md5 = "0123456789abcdef0123456789abcdef"
+	id := p2p_storage.SHA256FileID([]byte("data"))
+	for _, c := range []struct{ key, want string }{
+		{md5, "p2p/01/" + md5},
+		{id, "p2p/" + id[4:6] + "/" + id},
+		{"a", "p2p/a"},
+	} {
+		if got := p2p_storage.ColdKey(c.key); got != c.want {
+			t.Errorf("ColdKey(%s) = %s, want %s", c.key, got, c.want)
+		}
+	}
+}
+
+//文件在冷存储中时按p2p系统中是否可用和trans_node配置决定传输方式
+func TestGetTransType(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	dir, e := ioutil.TempDir("", "p2p_storage")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	cold, e := oss.NewLocalStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	p2p_storage.SetColdStore(cold)
+	defer p2p_storage.SetColdStore(nil)
+
+	const local, coldOnly, both = "00000000000000000000000000000001", "00000000000000000000000000000002", "00000000000000000000000000000003"
+	for _, md5 := range []string{local, both} {
+		f.addFile(md5, nil)
+		f.sync(md5)
+	}
+	for _, md5 := range []string{coldOnly, both} {
+		if e = cold.Put(p2p_storage.ColdKey(md5), []byte(md5)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	cases := []struct {
+		name      string
+		md5       string
+		transNode int64
+		want      int8
+	}{
+		{"not in cold store", local, 1, p2p_storage.EXPAND_TRANS_TYPE_NODE},
+		{"not available in p2p", coldOnly, 1, p2p_storage.EXPAND_TRANS_TYPE_OSS},
+		{"in both", both, 1, p2p_storage.EXPAND_TRANS_TYPE_BOTH},
+		{"trans_node off", both, 0, p2p_storage.EXPAND_TRANS_TYPE_OSS},
+	}
+	for _, c := range cases {
+		p2p_storage.ConfigMap.ConfigValue.Set(p2p_storage.TRANS_NODE_CONFIG_KEY, c.transNode)
+		if tp, e := p2p_storage.GetTransType(c.md5); e != nil || tp != c.want {
+			t.Errorf("%s: GetTransType = %d %v, want %d", c.name, tp, e, c.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+/*
+p2p存储冷存储层（p2p_storage.IObjectStore）的实现：
+	LocalStore: 本地磁盘，用于测试和单机部署
+	S3Store: S3兼容的对象存储（AWS S3、MinIO、阿里云OSS的S3接口等），使用AWS Signature V4签名
+
+协调服务用p2p_storage.SetColdStore设置后，扩散任务按文件是否在冷存储中、p2p系统中是否可用决定传输方式，
+节点在agent.Config.Cold中设置同一个存储，添加文件时上传，任务为EXPAND_TRANS_TYPE_OSS时从冷存储获取源文件。
+*/
+package oss
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"yh_pkg/p2p_storage"
+)
+
+//分块上传的临时目录，不能作为对象名
+const UPLOAD_DIR = ".uploads"
+
+//Head缓存的ETag数量，超过时清空
+const ETAG_CACHE_SIZE = 100000
+
+type LocalStore struct {
+	dir string
+
+	lock  sync.Mutex
+	etags map[string]etagEntry //文件路径 -> 文件大小和修改时间没变时的ETag
+}
+
+type etagEntry struct {
+	size  int64
+	mtime int64 //纳秒
+	etag  string
+}
+
+var _ p2p_storage.IObjectStore = (*LocalStore)(nil)
+
+func NewLocalStore(dir string) (s *LocalStore, e error) {
+	if e = os.MkdirAll(filepath.Join(dir, UPLOAD_DIR), 0755); e != nil {
+		return
+	}
+	return &LocalStore{dir: dir, etags: make(map[string]etagEntry)}, nil
+}
+
+func (s *LocalStore) path(key string) (p string, e error) {
+	if key == "" || strings.HasPrefix(key, UPLOAD_DIR) {
+		return "", errors.New("invalid object key " + key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", errors.New("invalid object key " + key)
+		}
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//先写临时文件再改名，读取时不会看到写了一半的对象，临时文件名是唯一的，同时写同一个对象时后改名的生效
+func writeFile(p string, data []byte) (e error) {
+	if e = os.MkdirAll(filepath.Dir(p), 0755); e != nil {
+		return
+	}
+	f, e := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".tmp")
+	if e != nil {
+		return
+	}
+	tmp := f.Name()
+	defer func() {
+		if e != nil {
+			os.Remove(tmp)
+		}
+	}()
+	_, e = f.Write(data)
+	if err := f.Close(); e == nil {
+		e = err
+	}
+	if e != nil {
+		return
+	}
+	if e = os.Chmod(tmp, 0644); e != nil {
+		return
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s *LocalStore) Put(key string, data []byte) (e error) {
+	p, e := s.path(key)
+	if e != nil {
+		return
+	}
+	return writeFile(p, data)
+}
+
+func (s *LocalStore) Get(key string) (data []byte, e error) {
+	p, e := s.path(key)
+	if e != nil {
+		return
+	}
+	data, e = ioutil.ReadFile(p)
+	if os.IsNotExist(e) {
+		return nil, p2p_storage.ObjectNotFound(key)
+	}
+	return
+}
+
+func (s *LocalStore) GetRange(key string, offset, length int64) (data []byte, e error) {
+	p, e := s.path(key)
+	if e != nil {
+		return
+	}
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range %d-%d", offset, length)
+	}
+	f, e := os.Open(p)
+	if os.IsNotExist(e) {
+		return nil, p2p_storage.ObjectNotFound(key)
+	} else if e != nil {
+		return
+	}
+	defer f.Close()
+	fi, e := f.Stat()
+	if e != nil {
+		return
+	}
+	//超出文件的部分不返回
+	if offset >= fi.Size() {
+		return []byte{}, nil
+	}
+	if length > fi.Size()-offset {
+		length = fi.Size() - offset
+	}
+	data = make([]byte, length)
+	n, e := f.ReadAt(data, offset)
+	if e == io.EOF {
+		e = nil
+	}
+	return data[:n], e
+}
+
+func (s *LocalStore) Head(key string) (info *p2p_storage.ObjectInfo, e error) {
+	p, e := s.path(key)
+	if e != nil {
+		return
+	}
+	f, e := os.Open(p)
+	if os.IsNotExist(e) {
+		return nil, nil
+	} else if e != nil {
+		return
+	}
+	defer f.Close()
+	fi, e := f.Stat()
+	if e != nil {
+		return
+	}
+	etag, e := s.etag(p, f, fi)
+	if e != nil {
+		return
+	}
+	return &p2p_storage.ObjectInfo{Key: key, Size: fi.Size(), ETag: etag, Tm: fi.ModTime().Unix()}, nil
+}
+
+//文件的md5，文件大小和修改时间没变时使用缓存，避免每次都读整个文件
+func (s *LocalStore) etag(p string, f *os.File, fi os.FileInfo) (etag string, e error) {
+	s.lock.Lock()
+	c, ok := s.etags[p]
+	s.lock.Unlock()
+	if ok && c.size == fi.Size() && c.mtime == fi.ModTime().UnixNano() {
+		return c.etag, nil
+	}
+	h := md5.New()
+	if _, e = io.Copy(h, f); e != nil {
+		return
+	}
+	etag = hex.EncodeToString(h.Sum(nil))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.etags) >= ETAG_CACHE_SIZE {
+		s.etags = make(map[string]etagEntry)
+	}
+	s.etags[p] = etagEntry{fi.Size(), fi.ModTime().UnixNano(), etag}
+	return
+}
+
+func (s *LocalStore) Delete(key string) (e error) {
+	p, e := s.path(key)
+	if e != nil {
+		return
+	}
+	if e = os.Remove(p); os.IsNotExist(e) {
+		e = nil
+	}
+	return
+}
+
+func (s *LocalStore) uploadDir(uploadId string) (dir string, e error) {
+	if uploadId == "" || strings.ContainsAny(uploadId, "/\\.") {
+		return "", errors.New("invalid upload id " + uploadId)
+	}
+	dir = filepath.Join(s.dir, UPLOAD_DIR, uploadId)
+	if _, e = os.Stat(dir); os.IsNotExist(e) {
+		return "", errors.New("upload " + uploadId + " not found")
+	}
+	return
+}
+
+func (s *LocalStore) CreateMultipart(key string) (uploadId string, e error) {
+	if _, e = s.path(key); e != nil {
+		return
+	}
+	b := make([]byte, 16)
+	if _, e = rand.Read(b); e != nil {
+		return
+	}
+	uploadId = hex.EncodeToString(b)
+	return uploadId, os.Mkdir(filepath.Join(s.dir, UPLOAD_DIR, uploadId), 0755)
+}
+
+func (s *LocalStore) UploadPart(key, uploadId string, num int, data []byte) (etag string, e error) {
+	dir, e := s.uploadDir(uploadId)
+	if e != nil {
+		return
+	}
+	if num <= 0 {
+		return "", fmt.Errorf("invalid part number %d", num)
+	}
+	if e = writeFile(filepath.Join(dir, strconv.Itoa(num)), data); e != nil {
+		return
+	}
+	return md5Hex(data), nil
+}
+
+func (s *LocalStore) CompleteMultipart(key, uploadId string, parts []p2p_storage.Part) (e error) {
+	p, e := s.path(key)
+	if e != nil {
+		return
+	}
+	dir, e := s.uploadDir(uploadId)
+	if e != nil {
+		return
+	}
+	data := make([]byte, 0)
+	for i, part := range parts {
+		if i > 0 && part.Num <= parts[i-1].Num {
+			return errors.New("parts must be in ascending order")
+		}
+		b, e := ioutil.ReadFile(filepath.Join(dir, strconv.Itoa(part.Num)))
+		if e != nil {
+			return fmt.Errorf("read part %d error: %v", part.Num, e)
+		}
+		if md5Hex(b) != part.ETag {
+			return fmt.Errorf("etag of part %d mismatch", part.Num)
+		}
+		data = append(data, b...)
+	}
+	if e = writeFile(p, data); e != nil {
+		return
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *LocalStore) AbortMultipart(key, uploadId string) (e error) {
+	dir, e := s.uploadDir(uploadId)
+	if e != nil {
+		return
+	}
+	return os.RemoveAll(dir)
+}
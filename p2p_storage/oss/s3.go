@@ -0,0 +1,308 @@
+package oss
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+const (
+	S3_REQUEST_TIMEOUT = 60 * time.Second
+	S3_TIME_FORMAT     = "20060102T150405Z"
+	S3_DATE_FORMAT     = "20060102"
+)
+
+type S3Config struct {
+	Endpoint  string        //如http://127.0.0.1:9000，对象按路径方式访问：Endpoint/Bucket/key
+	Region    string        //签名使用的区域，默认us-east-1
+	Bucket    string        //存储桶，需要已经存在
+	AccessKey string
+	SecretKey string
+	Timeout   time.Duration //请求超时，默认S3_REQUEST_TIMEOUT
+}
+
+type S3Store struct {
+	conf   S3Config
+	client http.Client
+}
+
+var _ p2p_storage.IObjectStore = (*S3Store)(nil)
+
+func NewS3Store(conf S3Config) (s *S3Store, e error) {
+	if conf.Endpoint == "" || conf.Bucket == "" {
+		return nil, fmt.Errorf("endpoint and bucket are required")
+	}
+	if _, e = url.Parse(conf.Endpoint); e != nil {
+		return
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = S3_REQUEST_TIMEOUT
+	}
+	conf.Endpoint = strings.TrimRight(conf.Endpoint, "/")
+	return &S3Store{conf: conf, client: http.Client{Timeout: conf.Timeout}}, nil
+}
+
+/*
+	发送请求
+
+	参数：
+		query: url参数，可以为nil
+		header: 额外的请求头，参与签名
+		ok: 认为成功的状态码，其他状态码返回错误，404返回ERR_OSS_FILE_DELETE
+*/
+func (s *S3Store) do(method, key string, query url.Values, header map[string]string, body []byte, ok ...int) (resp *http.Response, data []byte, e error) {
+	u := s.conf.Endpoint + "/" + uriEncode(s.conf.Bucket, false) + "/" + uriEncode(key, true)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, e := http.NewRequest(method, u, bytes.NewReader(body))
+	if e != nil {
+		return
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), s.conf.Region, s.conf.AccessKey, s.conf.SecretKey, time.Now())
+	if resp, e = s.client.Do(req); e != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if data, e = ioutil.ReadAll(resp.Body); e != nil {
+		return
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return resp, nil, p2p_storage.ObjectNotFound(key)
+	}
+	return resp, nil, fmt.Errorf("s3 %s %s: %s %s", method, key, resp.Status, string(data))
+}
+
+func (s *S3Store) Put(key string, data []byte) (e error) {
+	_, _, e = s.do(http.MethodPut, key, nil, nil, data, http.StatusOK)
+	return
+}
+
+func (s *S3Store) Get(key string) (data []byte, e error) {
+	_, data, e = s.do(http.MethodGet, key, nil, nil, nil, http.StatusOK)
+	return
+}
+
+func (s *S3Store) GetRange(key string, offset, length int64) (data []byte, e error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range %d-%d", offset, length)
+	}
+	if length == 0 {
+		return []byte{}, nil
+	}
+	header := map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}
+	resp, data, e := s.do(http.MethodGet, key, nil, header, nil, http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable)
+	if e != nil {
+		return
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		//开始位置超出对象末尾
+		data = []byte{}
+	case http.StatusOK:
+		//不支持Range的服务返回整个对象
+		if offset >= int64(len(data)) {
+			data = []byte{}
+		} else if end := offset + length; end < int64(len(data)) {
+			data = data[offset:end]
+		} else {
+			data = data[offset:]
+		}
+	}
+	return
+}
+
+func (s *S3Store) Head(key string) (info *p2p_storage.ObjectInfo, e error) {
+	resp, _, e := s.do(http.MethodHead, key, nil, nil, nil, http.StatusOK)
+	if e != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			e = nil
+		}
+		return
+	}
+	info = &p2p_storage.ObjectInfo{Key: key, Size: resp.ContentLength, ETag: strings.Trim(resp.Header.Get("ETag"), `"`)}
+	if tm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.Tm = tm.Unix()
+	}
+	return
+}
+
+func (s *S3Store) Delete(key string) (e error) {
+	_, _, e = s.do(http.MethodDelete, key, nil, nil, nil, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+	return
+}
+
+func (s *S3Store) CreateMultipart(key string) (uploadId string, e error) {
+	_, data, e := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, http.StatusOK)
+	if e != nil {
+		return
+	}
+	var r struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if e = xml.Unmarshal(data, &r); e != nil {
+		return
+	}
+	if r.UploadId == "" {
+		return "", fmt.Errorf("s3 create multipart upload of %s: empty upload id", key)
+	}
+	return r.UploadId, nil
+}
+
+func (s *S3Store) UploadPart(key, uploadId string, num int, data []byte) (etag string, e error) {
+	q := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {uploadId}}
+	resp, _, e := s.do(http.MethodPut, key, q, nil, data, http.StatusOK)
+	if e != nil {
+		return
+	}
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+func (s *S3Store) CompleteMultipart(key, uploadId string, parts []p2p_storage.Part) (e error) {
+	req := completeMultipartUpload{Parts: make([]completePart, 0, len(parts))}
+	for _, p := range parts {
+		req.Parts = append(req.Parts, completePart{p.Num, `"` + p.ETag + `"`})
+	}
+	body, e := xml.Marshal(&req)
+	if e != nil {
+		return
+	}
+	_, data, e := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadId}}, nil, body, http.StatusOK)
+	if e != nil {
+		return
+	}
+	//S3在200响应中也可能返回错误
+	var r struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(data, &r) == nil && r.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 complete multipart upload of %s: %s %s", key, r.Code, r.Message)
+	}
+	return
+}
+
+func (s *S3Store) AbortMultipart(key, uploadId string) (e error) {
+	_, _, e = s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil, nil, http.StatusOK, http.StatusNoContent)
+	return
+}
+
+//按RFC 3986编码，除了非保留字符都编码，keepSlash为true时保留/
+func uriEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || keepSlash && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+/*
+	用AWS Signature V4签名请求，Host、Range和x-amz-*请求头参与签名
+
+	参数：
+		payloadHash: 请求体sha256的十六进制
+*/
+func signV4(req *http.Request, payloadHash, region, accessKey, secretKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(S3_TIME_FORMAT)
+	date := now.Format(S3_DATE_FORMAT)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	//参数按名称排序，名称和值都按RFC 3986编码，没有值的参数保留=
+	q := req.URL.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := q[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			params = append(params, uriEncode(k, false)+"="+uriEncode(v, false))
+		}
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{req.Method, path, strings.Join(params, "&"), canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
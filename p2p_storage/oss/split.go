@@ -0,0 +1,39 @@
+package oss
+
+import (
+	"yh_pkg/p2p_storage"
+)
+
+/*
+	上传对象，超过splitSize时分块上传，失败时取消已上传的块
+
+	参数：
+		splitSize: 分块大小，对应协调服务中的OSS_SPLIT_SIZE_CONFIG_KEY配置，不大于0时不分块
+*/
+func PutFile(s p2p_storage.IObjectStore, key string, data []byte, splitSize int64) (e error) {
+	if splitSize <= 0 || int64(len(data)) <= splitSize {
+		return s.Put(key, data)
+	}
+	uploadId, e := s.CreateMultipart(key)
+	if e != nil {
+		return
+	}
+	parts := make([]p2p_storage.Part, 0, int64(len(data))/splitSize+1)
+	for off := int64(0); off < int64(len(data)); off += splitSize {
+		end := off + splitSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		num := len(parts) + 1
+		etag, e := s.UploadPart(key, uploadId, num, data[off:end])
+		if e != nil {
+			s.AbortMultipart(key, uploadId)
+			return e
+		}
+		parts = append(parts, p2p_storage.Part{Num: num, ETag: etag})
+	}
+	if e = s.CompleteMultipart(key, uploadId, parts); e != nil {
+		s.AbortMultipart(key, uploadId)
+	}
+	return
+}
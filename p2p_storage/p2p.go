@@ -26,13 +26,46 @@ func incryRemainAddCnt() (cnt uint32) {
 }
 
 //新版逻辑独立添加文件逻辑，通过查找符合条件的节点，然后确定分组，然后生成任务，并返回
+//设置了命名空间存储时受DIRECT_TENANT的配额限制，见addDirectFile
+//文件已有策略时与AddP2PFileWithPolicy一样合并PRIORITY_NORMAL，其他调用方设置的低优先级不再使文件被淘汰
 func AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file bool) (task_id int64, e error) {
-	if len(md5) != 32 {
-		return 0, errors.New("md5 " + md5 + " is invalid")
+	return WithSpan(nil).AddP2PFile(md5, src_node, size, times, add_no_source_file)
+}
+
+func (c Caller) AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file bool) (task_id int64, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.AddP2PFile")
+	defer span.SetAttr("md5", md5).SetAttr("src_node", src_node).SetAttr("size", size).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	task_id, e = source.addDirectFile(md5, src_node, size, times, add_no_source_file, DURABILITY_STANDARD, PRIORITY_NORMAL)
+	if e != nil && !isFileAdded(e) {
+		return
+	}
+	if err := mergeFilePriority(md5, PRIORITY_NORMAL, true); err != nil {
+		return 0, err
+	}
+	return
+}
+
+//tier为耐久等级，新文件只放到满足耐久等级的分组；priority为优先级，要求节点可用率时放到节点更可靠的分组。
+//分组未就绪时，设置了延迟添加队列则进入队列，返回ERR_P2P_INGEST_QUEUED
+func (ds *DataSource) addP2PFile(md5, src_node string, size uint64, times int, add_no_source_file bool, tier, priority int) (task_id int64, e error) {
+	if md5, e = ResolveFileKey(md5); e != nil {
+		return
+	}
+	task_id, e = ds.tryAddP2PFile(md5, src_node, size, times, add_no_source_file, tier, priority)
+	if ingestStore != nil && isIngestDeferrable(e) {
+		p := &PendingIngest{MD5: md5, SrcNode: src_node, Size: size, Times: times, NoSource: add_no_source_file, Tier: tier, Priority: priority}
+		e = deferIngest(p, e)
 	}
+	return
+}
 
+//md5需要已经用ResolveFileKey转换
+func (ds *DataSource) tryAddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file bool, tier, priority int) (task_id int64, e error) {
 	//判断该文件是否已经存在
-	ok, file, e := dataSource.IsP2PFileExists(md5)
+	ok, file, e := ds.IsP2PFileExists(md5)
 	logger.AppendObj(e, "-AddP2PFile-IsP2PFileExists-:md5: ", md5, "-file: ", file, "ok: ", ok)
 	if e != nil {
 		return 0, e
@@ -46,7 +79,7 @@ func AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file
 				//如果是add_no_source_file==false,则表示有正常节点获取了该文件，则判断是否src_node为空，如果为空，则需要其存储ID设置为原始节点
 				if file.SrcNode == "" {
 					file.SrcNode = src_node
-					if e = dataSource.Raw.UpdateGroupFile(file.Group, file); e != nil {
+					if e = ds.Raw.UpdateGroupFile(file.Group, file); e != nil {
 						return
 					}
 				}
@@ -55,12 +88,12 @@ func AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file
 					return*/
 			}
 
-			group, e := dataSource.Raw.GetGroup(file.Group)
+			group, e := ds.Raw.GetGroup(file.Group)
 			if e != nil || group == nil {
 				return 0, errors.New("AddP2PFile-GetGroup error groupid: " + file.Group)
 			}
 
-			file, e = dataSource.Raw.GetGroupFile(file.Group, file.MD5)
+			file, e = ds.Raw.GetGroupFile(file.Group, file.MD5)
 			if e != nil {
 				return 0, e
 			}
@@ -92,11 +125,16 @@ func AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file
 	var node string
 	// 根据target_group 情况确定是否需要生成生成新的分组
 	if target_group == "" {
-		if size <= maxSize {
+		if needTierGroup(tier, priority) {
+			node, g, e = ds.getTierGroup(md5, tier, priority)
+			if e != nil {
+				return
+			}
+		} else if size <= maxSize {
 			if groupId != "" {
 				cnt := incryRemainAddCnt()
 				if cnt <= maxGroupAddFileNum {
-					g, e = dataSource.Raw.GetGroup(groupId)
+					g, e = ds.Raw.GetGroup(groupId)
 					if e != nil {
 						logger.AppendObj(e, "-AddP2PFile-groupId-is error-: ", src_node, g, target_group)
 						return 0, e
@@ -108,7 +146,7 @@ func AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file
 			}
 
 			if g == nil {
-				node, g, e = getAvailableNodeAndGroup(md5, false)
+				node, g, e = ds.getAvailableNodeAndGroup(md5, false)
 				if e != nil {
 					return
 				}
@@ -119,7 +157,7 @@ func AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file
 
 		} else {
 
-			node, g, e = getAvailableNodeAndGroup(md5, false)
+			node, g, e = ds.getAvailableNodeAndGroup(md5, false)
 			if e != nil {
 				return
 			}
@@ -127,14 +165,14 @@ func AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file
 		}
 
 	} else {
-		g, e = dataSource.Raw.GetGroup(target_group)
+		g, e = ds.Raw.GetGroup(target_group)
 		if e != nil {
 			logger.AppendObj(e, "-AddP2PFile-ExistTarGetGroup-is error-: ", src_node, g, target_group)
 			return 0, e
 		}
 
 		addFileCount := getGroupLimitCount(g.SafePieces, ADD_FILE_COUNT_PART)
-		nodeCount, e := dataSource.Raw.GetNodeCountByVerAndState(g.ID, g.FirstFinishVer, ONLINE)
+		nodeCount, e := ds.Raw.GetNodeCountByVerAndState(g.ID, g.FirstFinishVer, ONLINE)
 		if e != nil {
 			logger.AppendObj(e, "-AddP2PFile-GetNodeCountByVerAndState-error-groupid: "+g.ID)
 			return 0, e
@@ -142,21 +180,25 @@ func AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file
 
 		if int(nodeCount) < addFileCount {
 			logger.AppendObj(nil, "-AddP2PFile-group-firstver-node-count:", nodeCount, "group:", g.ID, "md5:", md5)
-			return 0, service.NewSimpleError(service.ERR_INTERNAL, "group online_num is less than safe_piece num")
+			return 0, errGroupNotReady
 		}
 		logger.AppendObj(e, "-AddP2PFile-ExistTarGetGroup-get exist group: md5:", md5, g, target_group)
+		if !DURABILITY_TIERS[tier].Match(g) {
+			//文件已经在分组中，不迁移
+			logger.AppendObj(nil, "-AddP2PFile-ExistTarGetGroup-tier mismatch: md5:", md5, g.ID, "tier:", tier)
+		}
 	}
 
 	//为获取到可用分组,需要创建分组
 	if g == nil || g.ID == "" {
 		logger.AppendObj(e, "-AddP2PFile-GetNodeGroupCount-g is null-: ", node)
-		groupCount, e := dataSource.Raw.GetNodeGroupCount(node)
+		groupCount, e := ds.Raw.GetNodeGroupCount(node)
 		if e != nil {
 			logger.AppendObj(e, "-AddP2PFile-GetNodeGroupCount-error-: ", node)
 			return 0, e
 		}
-		if groupCount != 0 { // 老节点 直接创建分组
-			g, e = createGroup(2, 0, node)
+		if groupCount != 0 || needTierGroup(tier, priority) { // 老节点或有耐久、优先级要求 直接创建分组
+			g, e = ds.createGroup(DURABILITY_TIERS[tier].GroupConfig, 0, node)
 			if e != nil {
 				logger.AppendObj(e, "-AddP2PFile-doGetAavialbeGroup-is error-: ", md5, node, g)
 				return 0, e
@@ -180,12 +222,12 @@ func AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file
 		file_src_node = ""
 	}
 	//获取到分组后，需要生成对应的扩散任务
-	if e = g.AddP2PFile(md5, size, file_src_node, fileVer); e != nil {
+	if e = g.AddP2PFile(ds, md5, size, file_src_node, fileVer); e != nil {
 		logger.AppendObj(e, "-AddP2PFile-GetP2PFile is error--: ", md5)
 		return
 	}
 	//生成扩散任务
-	exNodes, e := dataSource.Raw.GetValidExpandNodes(g.ID, md5)
+	exNodes, e := ds.Raw.GetValidExpandNodes(g.ID, md5)
 	if e != nil {
 		return task_id, e
 	}
@@ -200,7 +242,7 @@ func AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file
 		e = service.NewSimpleError(service.ERR_INTERNAL, "createExpand is error")
 		return
 	}
-	task_id, e = addOrUpdateP2PExpandNode(exNode)
+	task_id, e = ds.addOrUpdateP2PExpandNode(exNode)
 	logger.AppendObj(e, "-AddP2PFile-AddP2PFile is over--: ", md5, exNode, task_id)
 	if e != nil {
 		return
@@ -212,14 +254,14 @@ func AddP2PFile(md5, src_node string, size uint64, times int, add_no_source_file
 			file.SrcNode = src_node
 		}
 		file.LastAddTm = uint64(time.Now.Unix())
-		e = dataSource.Raw.UpdateGroupFile(file.Group, file)
+		e = ds.Raw.UpdateGroupFile(file.Group, file)
 		logger.AppendObj(e, "-AddP2PFile-UpdateGroupFile-md5:", file.MD5, "group:", file.Group, "src_node:", file.SrcNode)
 	}
 	return
 }
 
 //获取某节点可用分组，如果没有则根据情况创建
-func doGetAavialbeGroup(node string, create bool) (g *Group, e error) {
+func (ds *DataSource) doGetAavialbeGroup(node string, create bool) (g *Group, e error) {
 	//进入选择负载节点并获取该节点的可用分组逻辑
 	g, e = GetNodeAvailableGroup(node)
 	if e != nil {
@@ -233,14 +275,14 @@ func doGetAavialbeGroup(node string, create bool) (g *Group, e error) {
 		return
 	}
 	logger.AppendObj(nil, "doGetAavialbeGroup createGroup", node, create)
-	g, e = createGroup(2, 0, node)
+	g, e = ds.createGroup(2, 0, node)
 	return
 }
 
 /**
 获取可用节点，并获取可用组，如果没有这尝试更换节点
 */
-func getAvailableNodeAndGroup(md5 string, createGroup bool) (node string, g *Group, e error) {
+func (ds *DataSource) getAvailableNodeAndGroup(md5 string, createGroup bool) (node string, g *Group, e error) {
 	tryNum := 3
 	nodes, e := GetAvailableNode(tryNum)
 	logger.AppendObj(e, "-AddP2PFile-GetAvailableNode-new a node :md5: ", md5, "-node: ", node)
@@ -250,12 +292,12 @@ func getAvailableNodeAndGroup(md5 string, createGroup bool) (node string, g *Gro
 	}
 
 	if len(nodes) <= 0 {
-		e = service.NewSimpleError(service.ERR_INTERNAL, "not available node can use")
+		e = admissionError(md5)
 		return
 	}
 
 	for _, node = range nodes {
-		g, e = doGetAavialbeGroup(node, createGroup)
+		g, e = ds.doGetAavialbeGroup(node, createGroup)
 		if e != nil {
 			logger.AppendObj(e, "-AddP2PFile-doGetAavialbeGroup-is error-: ", md5, node, g)
 			return
@@ -271,13 +313,17 @@ func getAvailableNodeAndGroup(md5 string, createGroup bool) (node string, g *Gro
 
 //获取可以添加文件的节点(获取当前可以添加组的节点)
 func GetAvailableNode(num int) (node []string, e error) {
-	return dataSource.Raw.GetAvailableNode(GROUP_NODE_CAPACITY, time.Now.Unix()-NODE_VALID_TIME, time.Now.Unix()-NODE_VALID_AFTER_REGTM, NODE_EXPAND_MIN_ONLINE_CNT, num)
+	source, span := beginSpan(nil, "p2p_storage.GetAvailableNode")
+	defer span.End(&e)
+	return source.Raw.GetAvailableNode(GROUP_NODE_CAPACITY, time.Now.Unix()-NODE_VALID_TIME, time.Now.Unix()-NODE_VALID_AFTER_REGTM, NODE_EXPAND_MIN_ONLINE_CNT, num)
 }
 
 func GetNodeAvailableGroup(node string) (group *Group, e error) {
+	source, span := beginSpan(nil, "p2p_storage.GetNodeAvailableGroup")
+	defer span.End(&e)
 	logger.AppendObj(nil, "--GetNodeAvailableGroup--getNode: ", node)
 	//获取该节点的可用分组
-	groups, e := dataSource.Raw.GetNodeGroupDetail(node)
+	groups, e := source.Raw.GetNodeGroupDetail(node)
 	if e != nil || len(groups) == 0 {
 		logger.AppendObj(nil, "GetNodeAvailableGroup no group")
 		return
@@ -292,7 +338,7 @@ func GetNodeAvailableGroup(node string) (group *Group, e error) {
 		}
 
 		addFileCount := getGroupLimitCount(g.SafePieces, ADD_FILE_COUNT_PART)
-		nodeCount, e := dataSource.Raw.GetNodeCountByVerAndState(g.ID, g.FirstFinishVer, ONLINE)
+		nodeCount, e := source.Raw.GetNodeCountByVerAndState(g.ID, g.FirstFinishVer, ONLINE)
 		if e != nil {
 			logger.AppendObj(e, "GetNodeAvailableGroup GetNodeCountByVerAndState error groupid: "+g.ID)
 			continue
@@ -314,12 +360,14 @@ func GetNodeAvailableGroup(node string) (group *Group, e error) {
 
 //检测新加入节点数量并创建分组
 func CheckNewNodeAndCreateGroup(tar_node string) (group *Group, e error) {
-	nodes, e := dataSource.Raw.GetNewNodes(GROUP_NODE_CAPACITY, time.Now.Unix()-NODE_VALID_TIME, time.Now.Unix()-NODE_VALID_AFTER_REGTM, NODE_EXPAND_MIN_ONLINE_CNT)
+	source, span := beginSpan(nil, "p2p_storage.CheckNewNodeAndCreateGroup")
+	defer span.End(&e)
+	nodes, e := source.Raw.GetNewNodes(GROUP_NODE_CAPACITY, time.Now.Unix()-NODE_VALID_TIME, time.Now.Unix()-NODE_VALID_AFTER_REGTM, NODE_EXPAND_MIN_ONLINE_CNT)
 	if e != nil {
 		logger.AppendObj(e, "AddP2PFile-CheckNewNodeAndCreateGroup-GetNewNodes-is error-: ", tar_node)
 	}
 	if len(nodes) >= NEW_NODE_CREATE_GROUP_COUNT {
-		group, e = createGroup(2, 0, tar_node)
+		group, e = source.createGroup(2, 0, tar_node)
 		if e != nil {
 			logger.AppendObj(e, "AddP2PFile-CheckNewNodeAndCreateGroup-createGroup-is error-: ", tar_node)
 			return nil, e
@@ -333,16 +381,17 @@ func CheckNewNodeAndCreateGroup(tar_node string) (group *Group, e error) {
 }
 
 //添加或者修改扩散节点
-func addOrUpdateP2PExpandNode(exNode *ExpandNode) (task_id int64, e error) {
+func (ds *DataSource) addOrUpdateP2PExpandNode(exNode *ExpandNode) (task_id int64, e error) {
 	//检测是否存在任务
-	ex, e := dataSource.Raw.GetExpandNode(exNode.Group, exNode.Node, exNode.MD5)
+	ex, e := ds.Raw.GetExpandNode(exNode.Group, exNode.Node, exNode.MD5)
 	if e != nil {
 		return
 	}
 	if ex != nil {
 		logger.AppendObj(nil, "AddOrUpdateExpandNode--existExpand ", exNode.Group, "md5: ", exNode.MD5, "node: ", exNode.Node, ex.ID)
 	}
-	return dataSource.Raw.AddOrUpdateExpandNode(exNode)
+	setTransType(exNode)
+	return ds.Raw.AddOrUpdateExpandNode(exNode)
 }
 
 //
@@ -22,43 +22,146 @@ var P2pGetLockTimeOut int64 = 1 //所有使用同步锁的地方，超过该值
 
 func Init(ds IDataSource, lg *log.MLogger, open_check bool) (e error) {
 	logger = lg
-	dataSource = newDataSource(ds)
+	//包装后追踪每次调用，设置了trace的Exporter时生效
+	dataSource = newDataSource(&tracedSource{ds, nil})
 	ConfigMap = NewConfigSet()
+	keyStore, fileKeyStore, nsStore, policyStore = nil, nil, nil, nil
+	expandStateStore, fileIDStore, natStore, ingestStore = nil, nil, nil, nil
+	//AddP2PFile缓存的分组属于原来的数据源
+	groupId = ""
+	if SupportsStore(ds, (*INodeKeyStore)(nil)) {
+		keyStore = ds.(INodeKeyStore)
+	}
+	if SupportsStore(ds, (*IFileKeyStore)(nil)) {
+		fileKeyStore = ds.(IFileKeyStore)
+	}
+	if SupportsStore(ds, (*INamespaceStore)(nil)) {
+		nsStore = ds.(INamespaceStore)
+	}
+	if SupportsStore(ds, (*IPolicyStore)(nil)) {
+		policyStore = ds.(IPolicyStore)
+	}
+	if SupportsStore(ds, (*IExpandStateStore)(nil)) {
+		expandStateStore = ds.(IExpandStateStore)
+	}
+	if SupportsStore(ds, (*IFileIDStore)(nil)) {
+		fileIDStore = ds.(IFileIDStore)
+	}
+	if SupportsStore(ds, (*INATStore)(nil)) {
+		natStore = ds.(INATStore)
+	}
+	if SupportsStore(ds, (*IIngestStore)(nil)) {
+		ingestStore = ds.(IIngestStore)
+	}
+	scheduler = NewScheduler()
+	resetDurabilityCache()
 	rand.Seed(time.Now.Unix())
 	if open_check {
-		go checkTimeoutNodes()
-		go checkExpandTaskTimeout()
-		go checkDelLongTimeOutNode()
-		go updateNodeOnlineTime()
+		goBackground(checkTimeoutNodes)
+		goBackground(checkExpandTaskTimeout)
+		goBackground(checkDelLongTimeOutNode)
+		goBackground(updateNodeOnlineTime)
 		//go checkExpandGroup()
-		go clearNewAddGroupFileTimeOut()
-		go updateConfigMap()
+		goBackground(clearNewAddGroupFileTimeOut)
+		goBackground(updateConfigMap)
+		goBackground(checkExpiredFiles)
+		goBackground(checkNodeHistory)
+		goBackground(checkCapacity)
+		goBackground(checkPendingIngests)
 	}
 	return
 }
 
+/*
+	停止Init启动的检查并等待后台任务结束，之后可以重新Init。调用前需要停止接口的调用
+*/
+func Stop() {
+	close(stopped)
+	background.Wait()
+	stopped = make(chan struct{})
+}
+
 func AddNode(id string) (e error) {
-	exist, e := dataSource.Raw.IsNodeExist(id)
+	return WithSpan(nil).AddNode(id)
+}
+
+func (c Caller) AddNode(id string) (e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.AddNode")
+	defer span.SetAttr("id", id).End(&e)
+	exist, e := source.Raw.IsNodeExist(id)
 	if e != nil || exist {
 		return
 	}
-	return dataSource.Raw.AddNode(newNodeDetail(id))
+	return source.Raw.AddNode(newNodeDetail(id))
 }
 
 func DeleteNode(id string) (e error) {
-	groups, e := dataSource.Raw.GetNodeGroups(id)
+	source, span := beginSpan(nil, "p2p_storage.DeleteNode")
+	defer span.SetAttr("id", id).End(&e)
+	groups, e := source.Raw.GetNodeGroups(id)
 	if e != nil {
 		return
 	}
 
 	for _, group := range groups {
-		if e = dataSource.Raw.DeleteGroupNode(group.ID, id); e != nil {
+		if e = source.Raw.DeleteGroupNode(group.ID, id); e != nil {
 			return
 		}
-		e = group.ExpandNodesToPerfectSize(NODE_MAX_ACTIVE_GROUPS, "")
+		e = group.ExpandNodesToPerfectSize(source, NODE_MAX_ACTIVE_GROUPS, "")
 		logger.AppendObj(e, "--DeleteNode-DeleteGroupNode--", group.ID, id)
 	}
-	return dataSource.Raw.DeleteNode(id)
+	if e = source.Raw.DeleteNode(id); e != nil {
+		return
+	}
+	//节点删除后公钥同时失效
+	return WithSpan(span).RevokeNodeKey(id)
+}
+
+/*
+	把节点移出所在的所有分组，保留节点的注册信息，每移出一个分组后补充分组节点。
+	节点移出后分组在线节点少于SafePieces时跳过该分组，除非force为true。需要彻底下线时再调用DeleteNode。
+	节点先被标记为排空（见SetNodeDrained），之后不会被选入任何分组，恢复调度时调用SetNodeDrained(id, false)。
+
+	返回值：
+		drained: 已移出的分组
+		skipped: 在线节点不足而跳过的分组
+*/
+func DrainNode(id string, force bool) (drained, skipped []string, e error) {
+	source, span := beginSpan(nil, "p2p_storage.DrainNode")
+	defer span.SetAttr("id", id).End(&e)
+	if e = WithSpan(span).SetNodeDrained(id, true); e != nil {
+		return
+	}
+	groups, e := source.Raw.GetNodeGroups(id)
+	if e != nil {
+		return
+	}
+	states, e := source.Raw.GetNodeGroupState(id)
+	if e != nil {
+		return
+	}
+	for _, group := range groups {
+		if !force {
+			online, e := source.Raw.GetGroupOnlineNodesCount(group.ID)
+			if e != nil {
+				return drained, skipped, e
+			}
+			if states[group.ID].State == ONLINE && online > 0 {
+				online--
+			}
+			if online < group.SafePieces {
+				skipped = append(skipped, group.ID)
+				continue
+			}
+		}
+		if e = source.Raw.DeleteGroupNode(group.ID, id); e != nil {
+			return
+		}
+		drained = append(drained, group.ID)
+		e = group.ExpandNodesToPerfectSize(source, NODE_MAX_ACTIVE_GROUPS, "")
+		logger.AppendObj(e, "--DrainNode-DeleteGroupNode--", group.ID, id)
+	}
+	return drained, skipped, nil
 }
 
 /*func AddFile(md5 string, size uint64, src_node string) (e error) {
@@ -100,21 +203,46 @@ func DeleteNode(id string) (e error) {
 	return group.AddFile(md5, src_node, size)
 }*/
 
+//删除文件，文件还被对象引用时返回ERR_P2P_FILE_REFERENCED，需要通过DeleteObject删除，在保留期内时返回ERR_P2P_FILE_RETAINED
 func DeleteFile(md5 string) (e error) {
-	files, e := dataSource.Raw.GetFileGroups(md5, NORMAL)
+	return WithSpan(nil).DeleteFile(md5)
+}
+
+func (c Caller) DeleteFile(md5 string) (e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.DeleteFile")
+	defer span.SetAttr("md5", md5).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	if e = checkFileRetention(md5); e != nil {
+		return
+	}
+	if nsStore != nil {
+		return source.deleteDirectFile(md5)
+	}
+	return source.deleteFile(md5)
+}
+
+func (ds *DataSource) deleteFile(md5 string) (e error) {
+	files, e := ds.Raw.GetFileGroups(md5, NORMAL)
 	if e != nil {
 		return
 	}
 	for gid, file := range files {
-		group, e := dataSource.Raw.GetGroup(gid)
+		group, e := ds.Raw.GetGroup(gid)
 		if e != nil || group == nil {
 			return e
 		}
-		if e := group.DeleteFile(&file); e != nil {
+		if e := group.DeleteFile(ds, &file); e != nil {
 			return e
 		}
+		deleteExpandAttempt(gid, md5)
 	}
-	return
+	if e = deleteFilePolicy(md5); e != nil {
+		return
+	}
+	deleteFileIDBinding(md5)
+	return deleteFileKey(md5)
 }
 
 /*
@@ -128,6 +256,12 @@ func DeleteFile(md5 string) (e error) {
 	sources: 源文件所在的节点（都是在线的）
 */
 func Download(md5 string) (nodes []Peer, group *Group, sources []Peer, e error) {
+	return WithSpan(nil).Download(md5)
+}
+
+func (c Caller) Download(md5 string) (nodes []Peer, group *Group, sources []Peer, e error) {
+	span := c.parent.Child("p2p_storage.Download")
+	defer span.SetAttr("md5", md5).End(&e)
 	//如果所有用户的魔盒中都没有该文件了，则也从p2p系统删除
 	/*
 		count, e := dataSource.Raw.GetSourceFileCount(md5)
@@ -139,7 +273,7 @@ func Download(md5 string) (nodes []Peer, group *Group, sources []Peer, e error)
 			return
 		}
 	*/
-	return DownloadMore(md5, nil)
+	return WithSpan(span).DownloadMore(md5, nil)
 }
 
 /*
@@ -155,11 +289,30 @@ func Download(md5 string) (nodes []Peer, group *Group, sources []Peer, e error)
 	sources: 源文件所在的节点（都是在线的）
 */
 func DownloadMore(md5 string, usedGroups []string) (nodes []Peer, group *Group, sources []Peer, e error) {
-	nodes, group, e = getPeers(md5, usedGroups, false)
+	return WithSpan(nil).DownloadMore(md5, usedGroups)
+}
+
+func (c Caller) DownloadMore(md5 string, usedGroups []string) (nodes []Peer, group *Group, sources []Peer, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.DownloadMore")
+	defer span.SetAttr("md5", md5).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	nodes, group, e = source.getPeers(md5, usedGroups, false)
+	if e != nil {
+		return
+	}
+	sources, e = source.GetOnlineSourceFileNodes(md5, 5)
 	if e != nil {
 		return
 	}
-	sources, e = dataSource.GetOnlineSourceFileNodes(md5, 5)
+	//按NAT检测结果排序，容易连接的节点在前
+	for _, peers := range [][]Peer{nodes, sources} {
+		if _, e = applyVerifiedNATs(peers); e != nil {
+			return
+		}
+		sortPeersByNAT(peers)
+	}
 	return
 }
 
@@ -172,32 +325,38 @@ func DownloadMore(md5 string, usedGroups []string) (nodes []Peer, group *Group,
 返回值：
 */
 func GenPiece(gid, nid, md5 string) (e error) {
+	source, span := beginSpan(nil, "p2p_storage.GenPiece")
+	defer span.SetAttr("md5", md5).SetAttr("gid", gid).SetAttr("nid", nid).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
 	key := CHECKER_GEN_PIECETM_PRIFIX + gid + md5
 	//获取检测时间，并判断是否需要执行检测,间隔时间去检测周期的倍
-	if !checkCanRunService(key) {
+	if !source.checkCanRunService(key) {
 		//logger.AppendObj(nil, "GenPiece-contine, gid: ", gid, "md5:", md5)
 		return
 	}
 	//logger.AppendObj(nil, "GenPiece-ok, gid: ", gid, "md5:", md5)
-	if e = dataSource.Raw.SetAtomicGetLastCheckerTm(key, time.Now.Unix(), getCheckExpireTm(key)); e != nil {
+	if e = source.Raw.SetAtomicGetLastCheckerTm(key, time.Now.Unix(), getCheckExpireTm(key)); e != nil {
 		logger.Append("SetAtomicGetLastCheckerTm setTm error: "+e.Error(), log.ERROR)
 		return
 	}
 
 	//对节点版本分布进行控制, 为了避免不必要的扩散，节省流量
-	nodes, e := dataSource.GetNoFileNodes(gid, md5)
+	nodes, e := source.GetNoFileNodes(gid, md5)
 	if e != nil {
 		logger.AppendObj(e, "GenPiece---GetNoFileNodes---group:", gid, "md5:", md5)
 		return
 	}
-	group, e := dataSource.Raw.GetGroup(gid)
-	if e != nil || group == nil || len(nodes) <= int(float32(group.PerfectPieces-group.SafePieces)*0.1) {
+	group, e := source.Raw.GetGroup(gid)
+	//缺少碎片的节点数按文件优先级控制，优先级越高越早生成碎片
+	if e != nil || group == nil || len(nodes) <= genPieceThreshold(group, md5) {
 		logger.AppendObj(e, "GenPiece---node-count:", len(nodes), "gid", gid, "md5", md5, "node", nid)
 		return
 	}
 
 	//获取当前正在扩散的任务jww
-	exNodes, e := dataSource.Raw.GetValidExpandNodes(gid, md5)
+	exNodes, e := source.Raw.GetValidExpandNodes(gid, md5)
 	if e != nil {
 		return e
 	}
@@ -206,7 +365,7 @@ func GenPiece(gid, nid, md5 string) (e error) {
 		peers := make([]Peer, 0)
 
 		//首先找源节点
-		gfs, e := dataSource.Raw.GetFileByMd5AndState(md5, NORMAL)
+		gfs, e := source.Raw.GetFileByMd5AndState(md5, NORMAL)
 		if e != nil || len(gfs) <= 0 {
 			return e
 		}
@@ -217,7 +376,7 @@ func GenPiece(gid, nid, md5 string) (e error) {
 			}
 		}
 		if len(ids) > 0 {
-			if peers, e = dataSource.Raw.GetOnlinePeers(ids, time.Now.Unix()-NODE_VALID_TIME); e != nil {
+			if peers, e = source.Raw.GetOnlinePeers(ids, time.Now.Unix()-NODE_VALID_TIME); e != nil {
 				return e
 			}
 		}
@@ -225,7 +384,7 @@ func GenPiece(gid, nid, md5 string) (e error) {
 		//源节点不在线或没有源节点
 		if len(peers) <= 0 {
 			//获取资源所在节点并且在的线存储节点
-			peers, e = dataSource.GetOnlineSourceFileNodes(md5, int(MAX_EXPAND_NODE_NUM))
+			peers, e = source.GetOnlineSourceFileNodes(md5, int(MAX_EXPAND_NODE_NUM))
 			if e != nil {
 				return e
 			}
@@ -246,7 +405,7 @@ func GenPiece(gid, nid, md5 string) (e error) {
 				if e != nil {
 					return e
 				}*/
-				file, e := dataSource.Raw.GetGroupFile(gid, md5)
+				file, e := source.Raw.GetGroupFile(gid, md5)
 				if e != nil {
 					return e
 				}
@@ -254,7 +413,7 @@ func GenPiece(gid, nid, md5 string) (e error) {
 					return errors.New("file " + md5 + " not found in group " + gid)
 				}
 
-				level, e := GetExpandTaskLevel(gid, file.Ver)
+				level, e := fileTaskLevel(gid, md5, file.Ver)
 				if e != nil {
 					return e
 				}
@@ -289,18 +448,18 @@ func GenPiece(gid, nid, md5 string) (e error) {
 					*/
 				}
 				logger.AppendObj(nil, "GenPiece--gid-3", gid, "md5: ", md5, "nid: ", peer.ID, "level:", level)
-				return addOrUpdateExpandNode(createExpandNode(gid, peer.ID, md5, file.Size, level))
+				return source.addOrUpdateExpandNode(createExpandNode(gid, peer.ID, md5, file.Size, level))
 			}
 		}
 		//没有正在扩散的节点任务,并且没有在线的源节点
 		if !expanding {
-			available, e := IsAvailable(md5)
+			available, e := WithSpan(span).IsAvailable(md5)
 			if e != nil {
 				return e
 			}
 			if available {
 				if nid != "" {
-					file, e := dataSource.Raw.GetGroupFile(gid, md5)
+					file, e := source.Raw.GetGroupFile(gid, md5)
 					if e != nil {
 						return e
 					}
@@ -308,7 +467,7 @@ func GenPiece(gid, nid, md5 string) (e error) {
 						return errors.New("file " + md5 + " not found in group " + gid)
 					}
 
-					level, e := GetExpandTaskLevel(gid, file.Ver)
+					level, e := fileTaskLevel(gid, md5, file.Ver)
 					if e != nil {
 						return e
 					}
@@ -321,7 +480,7 @@ func GenPiece(gid, nid, md5 string) (e error) {
 						return e
 					}
 
-					node, e := dataSource.Raw.GetRandomGroupNode(gid)
+					node, e := source.Raw.GetRandomGroupNode(gid)
 					if e != nil {
 						return e
 					}
@@ -348,17 +507,17 @@ func GenPiece(gid, nid, md5 string) (e error) {
 						}
 						*/
 						logger.AppendObj(nil, "GenPiece--gid-randNode", gid, "md5: ", md5, "nid: ", node.Node, "level:", level)
-						return addOrUpdateExpandNode(createExpandNode(gid, node.Node, md5, file.Size, level))
+						return source.addOrUpdateExpandNode(createExpandNode(gid, node.Node, md5, file.Size, level))
 					}
 				}
 			} else {
 				logger.AppendObj(nil, "-GenPiece-source not online", md5, gid)
-				ids, e := dataSource.Raw.GetSourceFileNodes(md5, 1)
+				ids, e := source.Raw.GetSourceFileNodes(md5, 1)
 				if e != nil {
 					return e
 				}
 
-				file, e := dataSource.Raw.GetGroupFile(gid, md5)
+				file, e := source.Raw.GetGroupFile(gid, md5)
 				if e != nil {
 					return e
 				}
@@ -369,7 +528,7 @@ func GenPiece(gid, nid, md5 string) (e error) {
 					return e
 				}
 
-				level, e := GetExpandTaskLevel(gid, file.Ver)
+				level, e := fileTaskLevel(gid, md5, file.Ver)
 				if e != nil {
 					return e
 				}
@@ -385,7 +544,7 @@ func GenPiece(gid, nid, md5 string) (e error) {
 				}
 
 				logger.AppendObj(nil, "-GenPiece--gid-5-source not online add sourceTask", md5, gid, "sourceNode:", ids, level, levelConfig)
-				return addOrUpdateExpandNode(createExpandNode(gid, ids[0], md5, file.Size, level))
+				return source.addOrUpdateExpandNode(createExpandNode(gid, ids[0], md5, file.Size, level))
 
 			}
 		}
@@ -394,14 +553,27 @@ func GenPiece(gid, nid, md5 string) (e error) {
 }
 
 //添加或者修改扩散节点
-func addOrUpdateExpandNode(exNode *ExpandNode) (e error) {
+func (ds *DataSource) addOrUpdateExpandNode(exNode *ExpandNode) (e error) {
+	//失败过的任务检查重试次数和退避时间，并尽量换一个源节点
+	ok, e := ds.prepareExpandRetry(exNode)
+	if e != nil || !ok {
+		return
+	}
 	//检测是否存在任务
-	ex, e := dataSource.Raw.GetExpandNode(exNode.Group, exNode.Node, exNode.MD5)
+	ex, e := ds.Raw.GetExpandNode(exNode.Group, exNode.Node, exNode.MD5)
 	if e != nil {
 		return
 	}
 	if ex != nil {
 		logger.AppendObj(nil, "AddOrUpdateExpandNode--existExpand ", exNode.Group, "md5: ", exNode.MD5, "node: ", exNode.Node, ex.ID)
+		//超时的任务按失败处理
+		if isExpandTimeout(ex) {
+			recordExpandTransition(ex, EXPAND_STATE_FAILED, "timeout")
+			ex.State = EXPAND_STATE_FAILED
+		}
+		if e = checkExpandTransition(ex, EXPAND_STATE_INIT); e != nil {
+			return
+		}
 		//增加文件版本
 		if e = IncrGroupFileVer(exNode.Group, exNode.MD5); e != nil {
 			logger.Append("IncrGroupFileVer error: "+e.Error(), log.ERROR)
@@ -409,7 +581,13 @@ func addOrUpdateExpandNode(exNode *ExpandNode) (e error) {
 		}
 
 	}
-	_, e = dataSource.Raw.AddOrUpdateExpandNode(exNode)
+	setTransType(exNode)
+	if _, e = ds.Raw.AddOrUpdateExpandNode(exNode); e != nil {
+		return
+	}
+	if ex != nil {
+		recordExpandTransition(ex, EXPAND_STATE_INIT, "retry")
+	}
 	return
 }
 
@@ -422,36 +600,42 @@ func addOrUpdateExpandNode(exNode *ExpandNode) (e error) {
 		nodes: 需要碎片的节点ID
 */
 func GetExpandTaskById(id uint64) (nodes []string, file *GroupFile, group *Group, exNode *ExpandNode, e error) {
-	exNode, e = dataSource.Raw.GetExpandNodeById(id)
+	return WithSpan(nil).GetExpandTaskById(id)
+}
+
+func (c Caller) GetExpandTaskById(id uint64) (nodes []string, file *GroupFile, group *Group, exNode *ExpandNode, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.GetExpandTaskById")
+	defer span.SetAttr("id", id).End(&e)
+	exNode, e = source.Raw.GetExpandNodeById(id)
 	if e != nil {
 		return
 	}
 	if exNode == nil {
 		return nil, nil, nil, nil, errors.New(fmt.Sprintf("expand node [%v] not found", id))
 	}
-	if exNode.State != EXPAND_STATE_NOTIFIED {
-		return nil, nil, nil, nil, errors.New(fmt.Sprintf("invalid expand node state: %d", exNode.State))
+	if e = checkExpandTransition(exNode, EXPAND_STATE_STARTED); e != nil {
+		return nil, nil, nil, nil, e
 	}
 	if exNode.Timeout < time.Now.Unix() {
 		return nil, nil, nil, nil, errors.New("invalid expand timeout")
 	}
 
-	gid, nid, md5 := exNode.Group, exNode.Node, exNode.MD5
-	nodes, e = dataSource.GetNoFileNodes(gid, md5)
+	gid, md5 := exNode.Group, exNode.MD5
+	nodes, e = source.GetNoFileNodes(gid, md5)
 	if e != nil {
 		return nil, nil, nil, nil, e
 	}
-	if e = dataSource.UpdateExpandNodeState(gid, nid, md5, EXPAND_STATE_STARTED); e != nil {
+	if e = source.transitExpandNode(exNode, EXPAND_STATE_STARTED, "started"); e != nil {
 		return nil, nil, nil, nil, e
 	}
-	group, e = dataSource.Raw.GetGroup(gid)
+	group, e = source.Raw.GetGroup(gid)
 	if e != nil {
 		return nil, nil, nil, nil, e
 	}
 	if group == nil {
 		return nil, nil, nil, nil, errors.New("can't find group")
 	}
-	file, e = dataSource.Raw.GetGroupFile(gid, md5)
+	file, e = source.Raw.GetGroupFile(gid, md5)
 	if e != nil {
 		return nil, nil, nil, nil, e
 	}
@@ -473,28 +657,33 @@ func GetExpandTaskById(id uint64) (nodes []string, file *GroupFile, group *Group
 		nodes: 需要碎片的节点ID
 */
 func GetExpandTask(gid, nid, md5 string) (nodes []string, file *GroupFile, group *Group, e error) {
-	exNode, e := dataSource.Raw.GetExpandNode(gid, nid, md5)
+	source, span := beginSpan(nil, "p2p_storage.GetExpandTask")
+	defer span.SetAttr("md5", md5).SetAttr("gid", gid).SetAttr("nid", nid).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	exNode, e := source.Raw.GetExpandNode(gid, nid, md5)
 	if e != nil {
 		return
 	}
 	if exNode == nil {
 		return nil, nil, nil, errors.New(fmt.Sprintf("expand node [%v:%v:%v] not found", gid, nid, md5))
 	}
-	if exNode.State != EXPAND_STATE_NOTIFIED {
-		return nil, nil, nil, errors.New(fmt.Sprintf("invalid expand node state: %d", exNode.State))
+	if e = checkExpandTransition(exNode, EXPAND_STATE_STARTED); e != nil {
+		return nil, nil, nil, e
 	}
-	nodes, e = dataSource.GetNoFileNodes(gid, md5)
+	nodes, e = source.GetNoFileNodes(gid, md5)
 	if e != nil {
 		return nil, nil, nil, e
 	}
-	if e = dataSource.UpdateExpandNodeState(gid, nid, md5, EXPAND_STATE_STARTED); e != nil {
+	if e = source.transitExpandNode(exNode, EXPAND_STATE_STARTED, "started"); e != nil {
 		return nil, nil, nil, e
 	}
-	group, e = dataSource.Raw.GetGroup(gid)
+	group, e = source.Raw.GetGroup(gid)
 	if e != nil {
 		return nil, nil, nil, e
 	}
-	file, e = dataSource.Raw.GetGroupFile(gid, md5)
+	file, e = source.Raw.GetGroupFile(gid, md5)
 	if e != nil {
 		return nil, nil, nil, e
 	}
@@ -511,7 +700,13 @@ func GetExpandTask(gid, nid, md5 string) (nodes []string, file *GroupFile, group
 	返回值：
 */
 func ExpandFinished(id uint64, state int8) (e error) {
-	exNode, e := dataSource.Raw.GetExpandNodeById(id)
+	return WithSpan(nil).ExpandFinished(id, state)
+}
+
+func (c Caller) ExpandFinished(id uint64, state int8) (e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.ExpandFinished")
+	defer span.SetAttr("id", id).End(&e)
+	exNode, e := source.Raw.GetExpandNodeById(id)
 	if e != nil {
 		return e
 	}
@@ -519,23 +714,29 @@ func ExpandFinished(id uint64, state int8) (e error) {
 		logger.AppendObj(e, "ExpandFinished-  expand  is not found", id)
 		return errors.New(utils.ToString(id) + " not found")
 	}
+	scheduler.release(schedKey{id, false})
 	//logger.AppendObj(nil, "ExpandFinished--GetExpandNodeById: exNode", exNode.MD5, exNode.State, exNode.Timeout, time.Now.Unix())
+	to, reason := EXPAND_STATE_FAILED, "failed"
+	if state == int8(YES) {
+		to, reason = EXPAND_STATE_FINISHED, "finished"
+	} else if state != int8(NO) {
+		return service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("invalid state %d", state))
+	}
+	if e = checkExpandTransition(exNode, to); e != nil {
+		return
+	}
 	if exNode.IsFinished() {
 		//logger.AppendObj(nil, "ExpandFinished-  exnode is finished", id, exNode)
 		return errors.New("expand state is invalid")
 	}
-	gid := exNode.Group
 	md5 := exNode.MD5
-	nid := exNode.Node
 	switch state {
 	case int8(YES):
-		exNode.State = EXPAND_STATE_FINISHED
-		if e = dataSource.Raw.DeleteExpandNodeByMd5(exNode.MD5); e != nil {
+		if e = source.Raw.DeleteExpandNodeByMd5(exNode.MD5); e != nil {
 			logger.AppendObj(e, "ExpandFinished-  DeleteExpandNodeByMd5 is error", md5)
 			return e
 		}
 	case int8(NO):
-		exNode.State = EXPAND_STATE_FAILED
 		/*total, e := dataSource.Raw.GetExpandTaskTotalFailedTimes(gid, md5)
 		if e != nil {
 			logger.Append("GetExpandTaskTotalFailedTimes error: "+e.Error(), log.ERROR)
@@ -549,7 +750,7 @@ func ExpandFinished(id uint64, state int8) (e error) {
 		}
 		*/
 	}
-	return dataSource.UpdateExpandNodeState(gid, nid, md5, exNode.State)
+	return source.transitExpandNode(exNode, to, reason)
 }
 
 /*
@@ -561,31 +762,42 @@ func ExpandFinished(id uint64, state int8) (e error) {
 	返回值：
 */
 func P2PExpandFinished(id uint64, state int8) (e error) {
-	exNode, e := dataSource.Raw.GetExpandNodeById(id)
+	return WithSpan(nil).P2PExpandFinished(id, state)
+}
+
+func (c Caller) P2PExpandFinished(id uint64, state int8) (e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.P2PExpandFinished")
+	defer span.SetAttr("id", id).End(&e)
+	exNode, e := source.Raw.GetExpandNodeById(id)
 	if e != nil {
 		return e
 	}
 	if exNode == nil {
 		return errors.New(utils.ToString(id) + " not found")
 	}
+	scheduler.release(schedKey{id, false})
 	logger.AppendObj(nil, "ExpandFinished--GetExpandNodeById: exNode", exNode.MD5, exNode.State, exNode.Timeout, time.Now.Unix())
-	if exNode.State == EXPAND_STATE_FINISHED {
-		return errors.New("expand state is invalid")
+	to, reason := EXPAND_STATE_FAILED, "p2p failed"
+	if int8(YES) == state {
+		to, reason = EXPAND_STATE_FINISHED, "p2p finished"
+	}
+	if e = checkExpandTransition(exNode, to); e != nil {
+		return
 	}
 	if int8(YES) == state {
 		//判断当前实际扩散情况
 		var expandCount int
-		group, e := dataSource.Raw.GetGroup(exNode.Group)
+		group, e := source.Raw.GetGroup(exNode.Group)
 		if e != nil || group == nil {
 			return errors.New("GetGroup error groupid: " + exNode.Group)
 		}
 		expandCount = getGroupLimitCount(group.SafePieces, EXPAND_TASK_FINISH_COUNT_PART)
-		nodeCount, e := dataSource.Raw.GetNodeCountByVerAndState(exNode.Group, group.FirstFinishVer, ONLINE)
+		nodeCount, e := source.Raw.GetNodeCountByVerAndState(exNode.Group, group.FirstFinishVer, ONLINE)
 		if e != nil {
 			return errors.New("GetNodeCountByVerAndState error groupid: " + exNode.Group)
 		}
 
-		gf, e := dataSource.Raw.GetGroupFile(exNode.Group, exNode.MD5)
+		gf, e := source.Raw.GetGroupFile(exNode.Group, exNode.MD5)
 		if e != nil {
 			return e
 		}
@@ -593,16 +805,16 @@ func P2PExpandFinished(id uint64, state int8) (e error) {
 		if int(nodeCount) >= expandCount && gf.Type == GROUPFILE_TYPE_NEW_ADD {
 
 			//获取锁
-			if !dataSource.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, exNode.Group, P2pLockExpireSec, P2pGetLockTimeOut) {
+			if !source.Raw.GetLock(redis_db.CACHE_THUNDER_REQUEST_POOL, exNode.Group, P2pLockExpireSec, P2pGetLockTimeOut) {
 				e = service.NewSimpleError(service.ERR_PERMISSION_DENIED, "get lock is errror")
 				logger.AppendObj(e, "P2pLock-P2PExpandFinished has no lock", exNode.Group)
 				return e
 			}
 
-			e = doUpdateGroupFileTpAndVer(exNode.Group, exNode.MD5)
+			e = source.doUpdateGroupFileTpAndVer(exNode.Group, exNode.MD5)
 
 			//释放锁
-			if err := dataSource.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, exNode.Group); err != nil {
+			if err := source.Raw.UnLock(redis_db.CACHE_THUNDER_REQUEST_POOL, exNode.Group); err != nil {
 				logger.AppendObj(err, "P2pLock-P2PExpandFinished unlock is error", exNode.Group, exNode.MD5)
 			}
 
@@ -614,21 +826,22 @@ func P2PExpandFinished(id uint64, state int8) (e error) {
 		}
 	}
 
-	if e = dataSource.Raw.DeleteExpandNodeByMd5(exNode.MD5); e != nil {
+	if e = source.Raw.DeleteExpandNodeByMd5(exNode.MD5); e != nil {
 		logger.AppendObj(e, "ExpandFinished-  DeleteExpandNodeByMd5 is error", exNode)
 		return e
 	}
+	recordExpandTransition(exNode, to, reason)
 
 	return
 }
 
-func doUpdateGroupFileTpAndVer(gid, md5 string) (e error) {
-	ver, e := dataSource.Raw.AtomicIncrID(gid)
+func (ds *DataSource) doUpdateGroupFileTpAndVer(gid, md5 string) (e error) {
+	ver, e := ds.Raw.AtomicIncrID(gid)
 	if e != nil {
 		return e
 	}
 	//修改group_file 中tp和ver
-	return dataSource.Raw.UpdateGroupFileTpAndVer(gid, md5, ver)
+	return ds.Raw.UpdateGroupFileTpAndVer(gid, md5, ver)
 }
 
 /*
@@ -638,9 +851,33 @@ func doUpdateGroupFileTpAndVer(gid, md5 string) (e error) {
 返回值:
 	nodes: 可用的节点列表
 		   则认为下载失败。
+有NAT检测结果的节点按检测结果过滤，检测过的节点优先
 */
 func GetDelegates(num int) (peers []Peer, e error) {
-	return dataSource.Raw.GetUPNPAvailableNodes(num, time.Now.Unix()-NODE_VALID_TIME)
+	source, span := beginSpan(nil, "p2p_storage.GetDelegates")
+	defer span.End(&e)
+	if natStore == nil {
+		return source.Raw.GetUPNPAvailableNodes(num, time.Now.Unix()-NODE_VALID_TIME)
+	}
+	candidates, e := source.Raw.GetUPNPAvailableNodes(num*DELEGATE_CANDIDATE_RATIO, time.Now.Unix()-NODE_VALID_TIME)
+	if e != nil {
+		return
+	}
+	verified, e := applyVerifiedNATs(candidates)
+	if e != nil {
+		return
+	}
+	peers = make([]Peer, 0, num)
+	for _, p := range candidates {
+		if p.UPNPAvailable == int8(YES) {
+			peers = append(peers, p)
+		}
+	}
+	sortPeersByVerified(peers, verified)
+	if len(peers) > num {
+		peers = peers[:num]
+	}
+	return
 }
 
 /*
@@ -650,6 +887,12 @@ func GetDelegates(num int) (peers []Peer, e error) {
 		md5: 文件的md5
 */
 func IsAvailable(md5 string) (ok bool, e error) {
+	return WithSpan(nil).IsAvailable(md5)
+}
+
+func (c Caller) IsAvailable(md5 string) (ok bool, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.IsAvailable")
+	defer span.SetAttr("md5", md5).End(&e)
 	/*
 		nodes, _, e := getPeers(md5, nil, true)
 		if e != nil || len(nodes) == 0 {
@@ -659,7 +902,10 @@ func IsAvailable(md5 string) (ok bool, e error) {
 		}
 	*/
 
-	nodes, group, e := getPeers(md5, nil, false)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	nodes, group, e := source.getPeers(md5, nil, false)
 	if e != nil {
 		return
 	}
@@ -681,7 +927,7 @@ func IsAvailable(md5 string) (ok bool, e error) {
 
 	num := group.MinPieces - uint32(len(ex_nids))
 
-	nids, e := GetHasUnSafeFileNode(group.ID, md5, num, ex_nids)
+	nids, e := WithSpan(span).GetHasUnSafeFileNode(group.ID, md5, num, ex_nids)
 	if e != nil {
 		logger.AppendObj(e, "IsAvailable is error", md5, "ok_num ", len(nodes), "need_num: ", num)
 		return
@@ -701,7 +947,12 @@ func IsAvailable(md5 string) (ok bool, e error) {
 		md5: 文件的md5
 */
 func IsExists(md5 string) (exist bool, e error) {
-	return dataSource.IsFileExists(md5)
+	source, span := beginSpan(nil, "p2p_storage.IsExists")
+	defer span.SetAttr("md5", md5).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	return source.IsFileExists(md5)
 }
 
 /*
@@ -711,7 +962,28 @@ func IsExists(md5 string) (exist bool, e error) {
 		md5: 文件的md5
 */
 func IsExistsMore(md5s []string) (m map[string]bool, e error) {
-	return dataSource.IsMoreFileExists(md5s)
+	source, span := beginSpan(nil, "p2p_storage.IsExistsMore")
+	defer span.End(&e)
+	keys, origin, e := resolveFileKeys(md5s)
+	if e != nil {
+		return
+	}
+	exists, e := source.IsMoreFileExists(keys)
+	if e != nil {
+		return
+	}
+	//按请求中的标识返回
+	m = make(map[string]bool, len(exists))
+	for key, ok := range exists {
+		ids, found := origin[key]
+		if !found {
+			ids = []string{key}
+		}
+		for _, id := range ids {
+			m[id] = ok
+		}
+	}
+	return
 }
 
 /*
@@ -725,24 +997,35 @@ func IsExistsMore(md5s []string) (m map[string]bool, e error) {
 		files: 文件列表
 */
 func ListUpdatedFiles(gid string, ver uint64, num int, tp int) (files []GroupFile, e error) {
-	return dataSource.Raw.ListUpdatedFiles(gid, ver, num, tp)
+	return WithSpan(nil).ListUpdatedFiles(gid, ver, num, tp)
+}
+
+func (c Caller) ListUpdatedFiles(gid string, ver uint64, num int, tp int) (files []GroupFile, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.ListUpdatedFiles")
+	defer span.SetAttr("gid", gid).End(&e)
+	return source.Raw.ListUpdatedFiles(gid, ver, num, tp)
 }
 
 /*
 	节点是否有权下载此文件。节点所属的分组中必须含有此文件，或者节点自身就含有此文件。
 */
 func CanDownloadFile(nid, md5 string) (yes bool, e error) {
-	fgroups, e := dataSource.Raw.GetFileGroups(md5, NORMAL)
+	source, span := beginSpan(nil, "p2p_storage.CanDownloadFile")
+	defer span.SetAttr("md5", md5).SetAttr("nid", nid).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	fgroups, e := source.Raw.GetFileGroups(md5, NORMAL)
 	if e != nil {
 		return
 	}
-	ngroups, e := dataSource.Raw.GetNodeGroupState(nid)
+	ngroups, e := source.Raw.GetNodeGroupState(nid)
 	for gid, _ := range fgroups {
 		if _, yes = ngroups[gid]; yes {
 			return
 		}
 	}
-	yes, e = dataSource.Raw.IsNodeHasFile(nid, md5)
+	yes, e = source.Raw.IsNodeHasFile(nid, md5)
 	if e != nil {
 		return
 	}
@@ -761,14 +1044,16 @@ func CanDownloadFile(nid, md5 string) (yes bool, e error) {
 		exNodes: 需要此节点执行扩充任务的文件列表
 */
 func UpdateNode(node *Node, groupVersions map[string]uint64, tasks []uint64, is_super int) (groups []NodeGroupDetail, exNodes []ExpandNode, e error) {
-	detail, e := dataSource.Raw.GetNodeDetail(node.ID)
+	source, span := beginSpan(nil, "p2p_storage.UpdateNode")
+	defer span.End(&e)
+	detail, e := source.Raw.GetNodeDetail(node.ID)
 	if e != nil {
 		return nil, nil, errors.New("GetNodeDetail error: " + e.Error())
 	}
 	if detail == nil {
 		return nil, nil, errors.New("node " + node.ID + " not found")
 	}
-	groups, e = dataSource.Raw.GetNodeGroupDetail(node.ID)
+	groups, e = source.Raw.GetNodeGroupDetail(node.ID)
 	if e != nil {
 		return nil, nil, errors.New("GetNodeGroupDetail error: " + e.Error())
 	}
@@ -812,14 +1097,14 @@ func UpdateNode(node *Node, groupVersions map[string]uint64, tasks []uint64, is_
 					}
 
 					//更新，并比较ver，如果改变则修改last_update_tm
-					if e := dataSource.Raw.UpdateGroupNode(groups[idx].ID, &GroupNode{node.ID, ver, state, max_ver}, ver != groups[idx].NodeVer); e != nil {
+					if e := source.Raw.UpdateGroupNode(groups[idx].ID, &GroupNode{node.ID, ver, state, max_ver}, ver != groups[idx].NodeVer); e != nil {
 						return nil, nil, errors.New("UpdateGroupNode error: " + e.Error())
 					}
 
 					//先修改，在获取
 					if update_finish_ver {
 						//logger.AppendObj(e, "---DoUpdateGroupFirstExpandVer---", groups[idx].ID, ver, groups[idx].MaxVer, update_finish_ver)
-						if e = DoUpdateGroupFirstExpandVer(groups[idx].ID, groups[idx].FirstFinishVer); e != nil {
+						if e = WithSpan(span).DoUpdateGroupFirstExpandVer(groups[idx].ID, groups[idx].FirstFinishVer); e != nil {
 							return
 						}
 					}
@@ -829,14 +1114,14 @@ func UpdateNode(node *Node, groupVersions map[string]uint64, tasks []uint64, is_
 	}
 
 	for _, id := range tasks {
-		if e := dataSource.UpdateExpandNodeTimeout(id); e != nil {
+		if e := source.UpdateExpandNodeTimeout(id); e != nil {
 			logger.Append("UpdateExpandNodeTimout error: "+e.Error(), log.ERROR)
 		}
 	}
-	if e = detail.Update(node); e != nil {
+	if e = detail.Update(source, node); e != nil {
 		return nil, nil, errors.New("detail.Update error: " + e.Error())
 	}
-	exNodes, e = dataSource.FetchExpandTasks(node.ID, MAX_EXPAND_TASK_NUM)
+	exNodes, e = source.FetchExpandTasks(node.ID, MAX_EXPAND_TASK_NUM)
 	return
 }
 
@@ -852,10 +1137,16 @@ func UpdateNode(node *Node, groupVersions map[string]uint64, tasks []uint64, is_
 		exNodes: 需要此节点执行扩充任务的文件列表
 */
 func UpdateNode2(node *Node, groupVersions map[string]uint64, tasks []uint64, is_super int) (returnGroups []NodeGroupDetail, exNodes []ExpandNode, deleteGids []string, e error) {
+	return WithSpan(nil).UpdateNode2(node, groupVersions, tasks, is_super)
+}
+
+func (c Caller) UpdateNode2(node *Node, groupVersions map[string]uint64, tasks []uint64, is_super int) (returnGroups []NodeGroupDetail, exNodes []ExpandNode, deleteGids []string, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.UpdateNode2")
+	defer span.End(&e)
 	deleteGids = make([]string, 0, 1)
 	returnGroups = make([]NodeGroupDetail, 0, len(groupVersions))
 
-	detail, e := dataSource.Raw.GetNodeDetail(node.ID)
+	detail, e := source.Raw.GetNodeDetail(node.ID)
 	if e != nil {
 		return nil, nil, nil, errors.New("GetNodeDetail error: " + e.Error())
 	}
@@ -864,7 +1155,7 @@ func UpdateNode2(node *Node, groupVersions map[string]uint64, tasks []uint64, is
 	}
 
 	//获取节点现有组信息（可能有新的组）
-	groups, e := dataSource.Raw.GetNodeGroupDetail(node.ID)
+	groups, e := source.Raw.GetNodeGroupDetail(node.ID)
 	if e != nil {
 		return nil, nil, nil, errors.New("GetNodeGroupDetail error: " + e.Error())
 	}
@@ -922,14 +1213,14 @@ func UpdateNode2(node *Node, groupVersions map[string]uint64, tasks []uint64, is
 					}
 
 					//更新，并比较ver，如果改变则修改last_update_tm
-					if e := dataSource.Raw.UpdateGroupNode(groups[idx].ID, &GroupNode{node.ID, ver, state, maxVer}, ver != groups[idx].NodeVer); e != nil {
+					if e := source.Raw.UpdateGroupNode(groups[idx].ID, &GroupNode{node.ID, ver, state, maxVer}, ver != groups[idx].NodeVer); e != nil {
 						return nil, nil, nil, errors.New("UpdateGroupNode error: " + e.Error())
 					}
 
 					//先修改，在获取
 					if update_finish_ver {
 						//logger.AppendObj(e, "---DoUpdateGroupFirstExpandVer---", groups[idx].ID, ver, groups[idx].MaxVer, update_finish_ver)
-						if e = DoUpdateGroupFirstExpandVer(groups[idx].ID, groups[idx].FirstFinishVer); e != nil {
+						if e = WithSpan(span).DoUpdateGroupFirstExpandVer(groups[idx].ID, groups[idx].FirstFinishVer); e != nil {
 							return
 						}
 					}
@@ -943,11 +1234,11 @@ func UpdateNode2(node *Node, groupVersions map[string]uint64, tasks []uint64, is
 	}
 
 	for _, id := range tasks {
-		if e := dataSource.UpdateExpandNodeTimeout(id); e != nil {
+		if e := source.UpdateExpandNodeTimeout(id); e != nil {
 			logger.Append("UpdateExpandNodeTimout error: "+e.Error(), log.ERROR)
 		}
 	}
-	if e = detail.Update(node); e != nil {
+	if e = detail.Update(source, node); e != nil {
 		return nil, nil, nil, errors.New("detail.Update error: " + e.Error())
 	}
 
@@ -958,18 +1249,24 @@ func UpdateNode2(node *Node, groupVersions map[string]uint64, tasks []uint64, is
 		}
 	}
 
-	exNodes, e = dataSource.FetchExpandTasks(node.ID, MAX_EXPAND_TASK_NUM)
+	exNodes, e = source.FetchExpandTasks(node.ID, MAX_EXPAND_TASK_NUM)
 	return
 }
 
 //修改分组中完成首次扩散文件的版本号
 func DoUpdateGroupFirstExpandVer(gid string, old_finish_ver uint64) (e error) {
-	finish_ver, e := dataSource.Raw.GetGroupFirstFinishExpandVer(gid)
+	return WithSpan(nil).DoUpdateGroupFirstExpandVer(gid, old_finish_ver)
+}
+
+func (c Caller) DoUpdateGroupFirstExpandVer(gid string, old_finish_ver uint64) (e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.DoUpdateGroupFirstExpandVer")
+	defer span.SetAttr("gid", gid).End(&e)
+	finish_ver, e := source.Raw.GetGroupFirstFinishExpandVer(gid)
 	if e != nil {
 		return
 	}
 	if finish_ver > old_finish_ver {
-		e = dataSource.Raw.UpdateGroupFirstFinishVer(gid, finish_ver)
+		e = source.Raw.UpdateGroupFirstFinishVer(gid, finish_ver)
 		logger.AppendObj(e, "---DoUpdateGroupFirstExpandVer---", gid, " old:", old_finish_ver, " new: ", finish_ver)
 	}
 	return
@@ -980,7 +1277,16 @@ func DoUpdateGroupFirstExpandVer(gid string, old_finish_ver uint64) (e error) {
 	将会从p2p系统中删除，移入问题文件表
 */
 func InvalidFile(nid, gid, md5 string) (e error) {
-	file, e := dataSource.Raw.GetGroupFile(gid, md5)
+	return WithSpan(nil).InvalidFile(nid, gid, md5)
+}
+
+func (c Caller) InvalidFile(nid, gid, md5 string) (e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.InvalidFile")
+	defer span.SetAttr("md5", md5).SetAttr("gid", gid).SetAttr("nid", nid).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	file, e := source.Raw.GetGroupFile(gid, md5)
 	if e != nil {
 		return
 	}
@@ -988,50 +1294,62 @@ func InvalidFile(nid, gid, md5 string) (e error) {
 		return
 	}
 	if file.State == NORMAL {
-		group, e := dataSource.Raw.GetGroup(gid)
+		group, e := source.Raw.GetGroup(gid)
 		if e != nil {
 			return e
 		}
 		if group == nil {
 			return errors.New("group " + gid + " not found")
 		}
-		if e = group.DeleteFile(file); e != nil {
+		if e = group.DeleteFile(source, file); e != nil {
 			return e
 		}
 	}
-	if e = dataSource.Raw.AddToInvalidFile(nid, gid, md5, time.Now.Unix()); e != nil {
+	if e = source.Raw.AddToInvalidFile(nid, gid, md5, time.Now.Unix()); e != nil {
 		return
 	}
 	return
 }
 
 func ExpandGroupToPerfectSize(gid string) (e error) {
-	group, e := dataSource.Raw.GetGroup(gid)
+	source, span := beginSpan(nil, "p2p_storage.ExpandGroupToPerfectSize")
+	defer span.SetAttr("gid", gid).End(&e)
+	group, e := source.Raw.GetGroup(gid)
 	if e != nil {
 		return e
 	}
 	if group == nil {
 		return errors.New("group " + gid + " not found")
 	}
-	return group.ExpandNodesToPerfectSize(NODE_MAX_ACTIVE_GROUPS, "")
+	return group.ExpandNodesToPerfectSize(source, NODE_MAX_ACTIVE_GROUPS, "")
 }
 
 func UpdateChecksum(md5, checksum string) (e error) {
-	return dataSource.Raw.UpdateChecksum(md5, checksum)
+	source, span := beginSpan(nil, "p2p_storage.UpdateChecksum")
+	defer span.SetAttr("md5", md5).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	return source.Raw.UpdateChecksum(md5, checksum)
 }
 
 func GetChecksum(md5 string) (checksum string, e error) {
-	return dataSource.Raw.GetChecksum(md5)
+	source, span := beginSpan(nil, "p2p_storage.GetChecksum")
+	defer span.SetAttr("md5", md5).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	return source.Raw.GetChecksum(md5)
 }
 
-func getPeers(md5 string, usedGroups []string, skipNum bool) (nodes []Peer, group *Group, e error) {
+func (ds *DataSource) getPeers(md5 string, usedGroups []string, skipNum bool) (nodes []Peer, group *Group, e error) {
 	set := make(map[string]bool)
 	if usedGroups != nil {
 		for _, gid := range usedGroups {
 			set[gid] = true
 		}
 	}
-	gfiles, e := dataSource.Raw.GetFileGroups(md5, NORMAL)
+	gfiles, e := ds.Raw.GetFileGroups(md5, NORMAL)
 	if e != nil {
 		return
 	}
@@ -1039,11 +1357,11 @@ func getPeers(md5 string, usedGroups []string, skipNum bool) (nodes []Peer, grou
 		if _, ok := set[gid]; ok {
 			continue
 		}
-		group, e = dataSource.Raw.GetGroup(gid)
+		group, e = ds.Raw.GetGroup(gid)
 		if e != nil {
 			return
 		}
-		nodes, e = dataSource.Raw.GetFileNodes(gid, gfile.Ver)
+		nodes, e = ds.Raw.GetFileNodes(gid, gfile.Ver)
 		if e != nil {
 			return
 		}
@@ -1059,28 +1377,38 @@ func getPeers(md5 string, usedGroups []string, skipNum bool) (nodes []Peer, grou
 }
 
 func CreateGroup() (group *Group, e error) {
-	group, e = createGroup(-1, CalculateFileSize(1024*1024*1024), "")
+	source, span := beginSpan(nil, "p2p_storage.CreateGroup")
+	defer span.End(&e)
+	group, e = source.createGroup(-1, CalculateFileSize(1024*1024*1024), "")
 	return
 }
 
 //批量获取节点
 func GetNodesByIds(ids []string) (nodes []NodeDetail, e error) {
-	return dataSource.Raw.GetNodesByIds(ids)
+	source, span := beginSpan(nil, "p2p_storage.GetNodesByIds")
+	defer span.End(&e)
+	return source.Raw.GetNodesByIds(ids)
 }
 
 //添加节点任务
 func AddTaskNode(task_id uint64, nids []string) (e error) {
-	return dataSource.Raw.AddTaskNode(task_id, nids)
+	source, span := beginSpan(nil, "p2p_storage.AddTaskNode")
+	defer span.End(&e)
+	return source.Raw.AddTaskNode(task_id, nids)
 }
 
 //根据某任务删除某节点全部数据
 func DeleteTaskNodeByTask(id uint64) (e error) {
-	return dataSource.Raw.DeleteTaskNodeByTask(id)
+	source, span := beginSpan(nil, "p2p_storage.DeleteTaskNodeByTask")
+	defer span.SetAttr("id", id).End(&e)
+	return source.Raw.DeleteTaskNodeByTask(id)
 }
 
-//根据条件确定任务优先级
+//根据分组的丢失风险确定任务优先级，见DURABILITY_LEVEL_NINES
 func GetExpandTaskLevel(gid string, ver uint64) (level int8, e error) {
-	g, e := dataSource.Raw.GetGroup(gid)
+	source, span := beginSpan(nil, "p2p_storage.GetExpandTaskLevel")
+	defer span.SetAttr("gid", gid).End(&e)
+	g, e := source.Raw.GetGroup(gid)
 	if e != nil || g == nil {
 		return
 	}
@@ -1088,36 +1416,29 @@ func GetExpandTaskLevel(gid string, ver uint64) (level int8, e error) {
 	if ver <= g.FirstFinishVer {
 		//只要是首次扩散完成，全部设置1
 		level = 1
-		//需要判断是否处于危险状态,添加对应优先级
-		num, e := dataSource.Raw.GetNodeCountByVerAndState(gid, ver, ONLINE)
+		//按同步到该版本的在线节点的可用率估计丢失风险，风险越高优先级越高
+		d, e := source.cachedGroupDurability(g, ver, nil)
 		if e != nil {
 			return level, e
 		}
 
 		//任务优先级，数字越大优先级越高， 0-普通，1-首次扩散完成 2-易险 3-濒危 4-危险   5-极危 6-
-		if num >= 160 {
-			level = 1
-		} else if num < 160 && num >= 152 {
-			level = 2
-		} else if num < 152 && num >= 144 {
-			level = 3
-		} else if num < 144 && num >= 136 {
-			level = 4
-		} else if num < 136 && num >= 128 {
-			level = 5
-		} else {
-			level = 6
-		}
-		//logger.AppendObj(nil, "GenPiece--addLevel-group", gid, "ver: ", ver, "FirstFinishVer: ", g.FirstFinishVer, " has node num:  ", num, "level: ", level)
+		level = d.Level
+		//logger.AppendObj(nil, "GenPiece--addLevel-group", gid, "ver: ", ver, "FirstFinishVer: ", g.FirstFinishVer, " has node num:  ", d.Nodes, "nines: ", d.Nines, "level: ", level)
 	}
 	return
 }
 
 //根据某任务删除某节点全部数据
 func CheckFileOssExist(md5 string) (ossExist int, e error) {
+	source, span := beginSpan(nil, "p2p_storage.CheckFileOssExist")
+	defer span.SetAttr("md5", md5).End(&e)
 	ossExist = YES
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
 	//获取该md5的文件版本号，同时检测是否在组中完成首次扩散,首次扩散完成，则返回0，否则返回1
-	gfs, e := dataSource.Raw.GetFileByMd5AndState(md5, NORMAL)
+	gfs, e := source.Raw.GetFileByMd5AndState(md5, NORMAL)
 	if e != nil {
 		return
 	}
@@ -1127,7 +1448,7 @@ func CheckFileOssExist(md5 string) (ossExist int, e error) {
 	}
 
 	for _, gf := range gfs {
-		g, e := dataSource.Raw.GetGroup(gf.Group)
+		g, e := source.Raw.GetGroup(gf.Group)
 		if e != nil || g == nil || gf.IsNewAdd() {
 			continue
 		}
@@ -1141,12 +1462,31 @@ func CheckFileOssExist(md5 string) (ossExist int, e error) {
 	return
 }
 
+//获取节点的危险文件任务，取还没有结束的任务时只返回节点带宽预算内的任务
 func GetUnSafeExpandTasks(nid string, state int8, num int) (exNodes []UnSafeExpandNode, e error) {
-	return dataSource.Raw.GetUnSafeExpandTasks(nid, state, num)
+	return WithSpan(nil).GetUnSafeExpandTasks(nid, state, num)
+}
+
+func (c Caller) GetUnSafeExpandTasks(nid string, state int8, num int) (exNodes []UnSafeExpandNode, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.GetUnSafeExpandTasks")
+	defer span.SetAttr("nid", nid).End(&e)
+	if exNodes, e = source.Raw.GetUnSafeExpandTasks(nid, state, num); e != nil || state != UNSAFE_EXPAND_STATE_INIT {
+		return
+	}
+	return source.scheduleUnSafeTasks(nid, exNodes)
 }
 
 func GetHasUnSafeFileNode(gid, md5 string, num uint32, ex_nids []string) (nids []string, e error) {
-	return dataSource.Raw.GetHasUnSafeFileNode(gid, md5, num, ex_nids)
+	return WithSpan(nil).GetHasUnSafeFileNode(gid, md5, num, ex_nids)
+}
+
+func (c Caller) GetHasUnSafeFileNode(gid, md5 string, num uint32, ex_nids []string) (nids []string, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.GetHasUnSafeFileNode")
+	defer span.SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	return source.Raw.GetHasUnSafeFileNode(gid, md5, num, ex_nids)
 }
 
 /*
@@ -1158,11 +1498,18 @@ func GetHasUnSafeFileNode(gid, md5 string, num uint32, ex_nids []string) (nids [
 	返回值：
 */
 func UnSafeExpandFinished(id uint64, state int) (e error) {
+	return WithSpan(nil).UnSafeExpandFinished(id, state)
+}
+
+func (c Caller) UnSafeExpandFinished(id uint64, state int) (e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.UnSafeExpandFinished")
+	defer span.SetAttr("id", id).End(&e)
+	scheduler.release(schedKey{id, true})
 	expand_state := UNSAFE_EXPAND_STATE_INIT
 	if int(YES) == state {
 		expand_state = UNSAFE_EXPAND_STATE_FINISHED
 	}
-	return dataSource.Raw.UpdateUnSafeExpandNodeState(id, expand_state)
+	return source.Raw.UpdateUnSafeExpandNodeState(id, expand_state)
 }
 
 /*
@@ -1173,7 +1520,13 @@ func UnSafeExpandFinished(id uint64, state int) (e error) {
 	返回值：
 */
 func GetUnSafeExpandTaskById(id uint64) (exNode *UnSafeExpandNode, file *GroupFile, group *Group, e error) {
-	exNode, e = dataSource.Raw.GetUnSafeExpandNodeById(id)
+	return WithSpan(nil).GetUnSafeExpandTaskById(id)
+}
+
+func (c Caller) GetUnSafeExpandTaskById(id uint64) (exNode *UnSafeExpandNode, file *GroupFile, group *Group, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.GetUnSafeExpandTaskById")
+	defer span.SetAttr("id", id).End(&e)
+	exNode, e = source.Raw.GetUnSafeExpandNodeById(id)
 	if e != nil {
 		return
 	}
@@ -1186,11 +1539,11 @@ func GetUnSafeExpandTaskById(id uint64) (exNode *UnSafeExpandNode, file *GroupFi
 		return
 	}
 
-	group, e = dataSource.Raw.GetGroup(exNode.Group)
+	group, e = source.Raw.GetGroup(exNode.Group)
 	if e != nil {
 		return
 	}
-	file, e = dataSource.Raw.GetGroupFile(exNode.Group, exNode.MD5)
+	file, e = source.Raw.GetGroupFile(exNode.Group, exNode.MD5)
 	if e != nil {
 		return
 	}
@@ -1201,6 +1554,11 @@ func GetUnSafeExpandTaskById(id uint64) (exNode *UnSafeExpandNode, file *GroupFi
 	添加unsafe_expand_node
 */
 func AddOrUpdateUnSafeExpandNode(gid, md5 string, nodes []GroupNode) (e error) {
+	source, span := beginSpan(nil, "p2p_storage.AddOrUpdateUnSafeExpandNode")
+	defer span.SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
 	exNodes := make([]UnSafeExpandNode, 0, len(nodes))
 	tm := time.GetTimeStamp()
 	for _, v := range nodes {
@@ -1212,7 +1570,7 @@ func AddOrUpdateUnSafeExpandNode(gid, md5 string, nodes []GroupNode) (e error) {
 		n.State = int8(NO)
 		exNodes = append(exNodes, n)
 	}
-	e = dataSource.Raw.AddOrUpdateUnSafeExpandNodes(exNodes)
+	e = source.Raw.AddOrUpdateUnSafeExpandNodes(exNodes)
 	return
 }
 
@@ -1220,7 +1578,12 @@ func AddOrUpdateUnSafeExpandNode(gid, md5 string, nodes []GroupNode) (e error) {
 	添加unsafe_file
 */
 func AddOrUpdateUnSafeFile(gid, md5 string) (e error) {
-	e = dataSource.Raw.AddOrUpdateUnSafeFile(gid, md5)
+	source, span := beginSpan(nil, "p2p_storage.AddOrUpdateUnSafeFile")
+	defer span.SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	e = source.Raw.AddOrUpdateUnSafeFile(gid, md5)
 	return
 }
 
@@ -1228,40 +1591,63 @@ func AddOrUpdateUnSafeFile(gid, md5 string) (e error) {
 	删除危险文件
 */
 func DeleteUnSafeFile(gid, md5 string) (e error) {
-	return dataSource.Raw.DeleteUnSafeFile(gid, md5)
+	source, span := beginSpan(nil, "p2p_storage.DeleteUnSafeFile")
+	defer span.SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	return source.Raw.DeleteUnSafeFile(gid, md5)
 }
 
 /*
 	获取分组节点
 */
-func GetGroupNodes(gid string) ([]GroupNode, error) {
-	return dataSource.Raw.GetGroupNodes(gid)
+func GetGroupNodes(gid string) (nodes []GroupNode, e error) {
+	source, span := beginSpan(nil, "p2p_storage.GetGroupNodes")
+	defer span.SetAttr("gid", gid).End(&e)
+	return source.Raw.GetGroupNodes(gid)
 }
 
 /*
 	删除危险文件任务
 */
 func DeleteUnSafeFileExpandNode(gid, node, md5 string) (e error) {
-	return dataSource.Raw.DeleteUnSafeFileExpandNode(gid, node, md5)
+	source, span := beginSpan(nil, "p2p_storage.DeleteUnSafeFileExpandNode")
+	defer span.SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	return source.Raw.DeleteUnSafeFileExpandNode(gid, node, md5)
 }
 
 /*
 	删除危险文件任务
 */
 func GetUnSafeFileExpandNode() (expandNodes []UnSafeExpandNode, e error) {
-	return dataSource.Raw.GetUnSafeFileExpandNode()
+	source, span := beginSpan(nil, "p2p_storage.GetUnSafeFileExpandNode")
+	defer span.End(&e)
+	return source.Raw.GetUnSafeFileExpandNode()
 }
 
 func GetOnlineNodesByIds(ids []string, min_update_tm int64) (peers []Peer, e error) {
+	return WithSpan(nil).GetOnlineNodesByIds(ids, min_update_tm)
+}
+
+func (c Caller) GetOnlineNodesByIds(ids []string, min_update_tm int64) (peers []Peer, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.GetOnlineNodesByIds")
+	defer span.End(&e)
 	if len(ids) <= 0 {
 		return
 	}
-	return dataSource.GetOnlineNodesByIds(ids, min_update_tm)
+	return source.GetOnlineNodesByIds(ids, min_update_tm)
 }
 
 /*
 	重置重启节点的任务状态
 */
 func RestartInitExpandNodeState(node string) (e error) {
-	return dataSource.Raw.SetExpandNodeStateFailed(node)
+	source, span := beginSpan(nil, "p2p_storage.RestartInitExpandNodeState")
+	defer span.End(&e)
+	source.recordNodeExpandInterrupted(node, "node restart")
+	return source.Raw.SetExpandNodeStateFailed(node)
 }
@@ -0,0 +1,462 @@
+package p2pctl
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+	tm "yh_pkg/time"
+)
+
+type env struct {
+	ds p2p_storage.IDataSource
+	fs *flag.FlagSet
+}
+
+type command struct {
+	name  string
+	args  string
+	help  string
+	nargs int
+	//在解析参数前调用，用于定义命令的参数
+	run func(c *env) func(args []string) (*output, error)
+	//修改数据的命令，只读数据源上拒绝执行
+	write bool
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"nodes", "[-from nid] [-num n]", "list nodes", 0, cmdNodes, false},
+		{"node", "<nid>", "show node detail, groups and expand tasks", 1, cmdNode, false},
+		{"groups", "", "list groups", 0, cmdGroups, false},
+		{"group", "<gid>", "show group and its nodes", 1, cmdGroup, false},
+		{"files", "[-ver v] [-num n] [-new] <gid>", "list files in group after version v", 1, cmdFiles, false},
+		{"file", "<md5>", "show which nodes hold the file at which version", 1, cmdFile, false},
+		{"genpiece", "<gid> <nid> <md5>", "force node to regenerate its piece", 3, cmdGenPiece, true},
+		{"expand", "<gid>", "expand group nodes to PerfectPieces", 1, cmdExpand, true},
+		{"drain", "[-force] <nid>", "move node out of its groups, keep the node", 1, cmdDrain, true},
+		{"undrain", "<nid>", "allow drained node to join groups again", 1, cmdUndrain, true},
+		{"delete", "-yes <nid>", "delete node", 1, cmdDelete, true},
+		{"reset-tasks", "<nid>", "fail unfinished expand tasks of node so they are rescheduled", 1, cmdResetTasks, true},
+		{"reset-retry", "<gid> <md5>", "clear expand retry record so the file is retried at once", 2, cmdResetRetry, true},
+		{"config", "", "dump config map", 0, cmdConfig, false},
+		{"capacity", "", "show free space, forecast and warnings", 0, cmdCapacity, false},
+		{"ingest", "[-num n]", "show deferred ingest queue", 0, cmdIngest, false},
+	}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+//心跳时间在有效期内
+func nodeOnline(d *p2p_storage.NodeDetail) bool {
+	return d.UpdateTm/1e9 >= tm.Now.Unix()-p2p_storage.NODE_VALID_TIME
+}
+
+//节点详情中的UpdateTm、OnlineTm为纳秒
+func fmtNano(ns int64) string {
+	if ns <= 0 {
+		return "-"
+	}
+	return fmtUnix(ns / 1e9)
+}
+
+func fmtUnix(s int64) string {
+	if s <= 0 {
+		return "-"
+	}
+	return time.Unix(s, 0).Format(tm.TIME_LAYOUT_1)
+}
+
+func okOutput(msg string) *output {
+	return &output{v: map[string]interface{}{"ok": true, "msg": msg}, msg: msg}
+}
+
+func cmdNodes(c *env) func(args []string) (*output, error) {
+	from := c.fs.String("from", "", "list nodes after this id")
+	num := c.fs.Int("num", 100, "max nodes")
+	return func(args []string) (out *output, e error) {
+		ids := make([]string, 0, *num)
+		for begin := *from; len(ids) < *num; {
+			page, e := c.ds.GetAllNode(begin)
+			if e != nil {
+				return nil, e
+			}
+			if len(page) == 0 {
+				break
+			}
+			ids = append(ids, page...)
+			begin = page[len(page)-1]
+		}
+		if len(ids) > *num {
+			ids = ids[:*num]
+		}
+		nodes := make([]p2p_storage.NodeDetail, 0)
+		if len(ids) > 0 {
+			if nodes, e = c.ds.GetNodesByIds(ids); e != nil {
+				return
+			}
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+		out = &output{v: nodes, header: []string{"ID", "ADDR", "ONLINE", "UPDATE_TM", "LEFT_P2P_SPACE", "ACTIVE_GROUPS", "ONLINE_CNT", "WEIGHT"}}
+		for i := range nodes {
+			n := &nodes[i]
+			out.row(n.ID, fmt.Sprintf("%s:%d", n.IP, n.Port), nodeOnline(n), fmtNano(n.UpdateTm), n.LeftP2pSpace, n.ActiveGroups, n.OnlineCount, fmt.Sprintf("%.4f", n.Weight))
+		}
+		return
+	}
+}
+
+type nodeInfo struct {
+	Detail      *p2p_storage.NodeDetail       `json:"detail"`
+	Groups      []p2p_storage.NodeGroupDetail `json:"groups"`
+	NAT         *p2p_storage.NodeNAT          `json:"nat"`
+	ExpandTasks []p2p_storage.ExpandNode      `json:"expand_tasks"` //未结束的扩散任务
+}
+
+func cmdNode(c *env) func(args []string) (*output, error) {
+	return func(args []string) (out *output, e error) {
+		info := &nodeInfo{}
+		if info.Detail, e = c.ds.GetNodeDetail(args[0]); e != nil {
+			return
+		}
+		if info.Detail == nil || info.Detail.ID == "" {
+			return nil, service.NewError(service.ERR_NOT_FOUND, "node "+args[0]+" not found")
+		}
+		if info.Groups, e = c.ds.GetNodeGroupDetail(args[0]); e != nil {
+			return
+		}
+		if info.NAT, e = p2p_storage.GetNodeNAT(args[0]); e != nil {
+			return
+		}
+		info.ExpandTasks = make([]p2p_storage.ExpandNode, 0)
+		for _, state := range []int8{p2p_storage.EXPAND_STATE_INIT, p2p_storage.EXPAND_STATE_NOTIFIED, p2p_storage.EXPAND_STATE_STARTED} {
+			tasks, e := c.ds.GetExpandTasks(args[0], state, int(p2p_storage.MAX_NODE_EXPANDTASK_CNT))
+			if e != nil {
+				return nil, e
+			}
+			info.ExpandTasks = append(info.ExpandTasks, tasks...)
+		}
+		d := info.Detail
+		out = &output{v: info, header: []string{"GROUP", "STATE", "NODE_VER", "FILE_VER", "MAX_VER", "SIZE"}}
+		out.field("id", d.ID)
+		out.field("addr", fmt.Sprintf("%s:%d", d.IP, d.Port))
+		out.field("upnp", fmt.Sprintf("%s:%d available=%d nat=%d", d.UPNPIP, d.UPNPPort, d.UPNPAvailable, d.NATType))
+		out.field("online", nodeOnline(d))
+		out.field("drained", d.Drained)
+		out.field("update_tm", fmtNano(d.UpdateTm))
+		out.field("reg_tm", fmtUnix(d.RegTm))
+		out.field("space", fmt.Sprintf("total=%d left_p2p=%d percent=%d", d.TotalSpace, d.LeftP2pSpace, d.Percent))
+		out.field("active_groups", d.ActiveGroups)
+		out.field("online_cnt", d.OnlineCount)
+		out.field("weight", d.Weight)
+		out.field("speed", fmt.Sprintf("up=%d upload=%d download=%d", d.UpSpeed, d.Upload, d.Download))
+		out.field("relay", fmt.Sprintf("bytes=%d sessions=%d", d.RelayBytes, d.RelayCount))
+		if n := info.NAT; n != nil {
+			out.field("verified_nat", fmt.Sprintf("type=%d mapped=%s reachable=%v tm=%s", n.Type, n.Mapped, n.Reachable, fmtUnix(n.Tm)))
+		}
+		out.field("expand_tasks", len(info.ExpandTasks))
+		sort.Slice(info.Groups, func(i, j int) bool { return info.Groups[i].ID < info.Groups[j].ID })
+		for _, g := range info.Groups {
+			out.row(g.ID, g.State, g.NodeVer, g.FileVer, g.MaxVer, g.Size)
+		}
+		return
+	}
+}
+
+type groupInfo struct {
+	p2p_storage.Group
+	Nodes  int    `json:"nodes"`
+	Online uint32 `json:"online"`
+}
+
+func cmdGroups(c *env) func(args []string) (*output, error) {
+	return func(args []string) (out *output, e error) {
+		groups, e := c.ds.GetAllGroup()
+		if e != nil {
+			return
+		}
+		infos := make([]groupInfo, 0, len(groups))
+		for _, g := range groups {
+			info := groupInfo{Group: g}
+			nodes, e := c.ds.GetGroupNodes(g.ID)
+			if e != nil {
+				return nil, e
+			}
+			info.Nodes = len(nodes)
+			if info.Online, e = c.ds.GetGroupOnlineNodesCount(g.ID); e != nil {
+				return nil, e
+			}
+			infos = append(infos, info)
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+		out = &output{v: infos, header: []string{"ID", "SIZE", "FILE_SIZE", "PIECE_SIZE", "MIN", "SAFE", "PERFECT", "NODES", "ONLINE", "FIRST_FINISH_VER"}}
+		for _, g := range infos {
+			out.row(g.ID, g.Size, g.FileSize, g.PieceSize, g.MinPieces, g.SafePieces, g.PerfectPieces, g.Nodes, g.Online, g.FirstFinishVer)
+		}
+		return
+	}
+}
+
+type groupDetail struct {
+	Group *p2p_storage.Group      `json:"group"`
+	Nodes []p2p_storage.GroupNode `json:"nodes"`
+}
+
+func cmdGroup(c *env) func(args []string) (*output, error) {
+	return func(args []string) (out *output, e error) {
+		g := &groupDetail{}
+		if g.Group, e = c.ds.GetGroup(args[0]); e != nil {
+			return
+		}
+		if g.Group == nil {
+			return nil, service.NewError(service.ERR_NOT_FOUND, "group "+args[0]+" not found")
+		}
+		if g.Nodes, e = c.ds.GetGroupNodes(args[0]); e != nil {
+			return
+		}
+		sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Node < g.Nodes[j].Node })
+		out = &output{v: g, header: []string{"NODE", "STATE", "VER", "MAX_VER"}}
+		out.field("id", g.Group.ID)
+		out.field("size", g.Group.Size)
+		out.field("pieces", fmt.Sprintf("piece_size=%d min=%d safe=%d perfect=%d", g.Group.PieceSize, g.Group.MinPieces, g.Group.SafePieces, g.Group.PerfectPieces))
+		out.field("first_finish_ver", g.Group.FirstFinishVer)
+		out.field("deleted_ver", g.Group.DeletedVer)
+		for _, n := range g.Nodes {
+			out.row(n.Node, n.State, n.Ver, n.MaxVer)
+		}
+		return
+	}
+}
+
+func cmdFiles(c *env) func(args []string) (*output, error) {
+	ver := c.fs.Uint64("ver", 0, "list files after this version")
+	num := c.fs.Int("num", 100, "max files")
+	newAdd := c.fs.Bool("new", false, "list new added files instead of first expanded files")
+	return func(args []string) (out *output, e error) {
+		tp := p2p_storage.GROUPFILE_TYPE_SPRAND_FIRST
+		if *newAdd {
+			tp = p2p_storage.GROUPFILE_TYPE_NEW_ADD
+		}
+		files, e := c.ds.ListUpdatedFiles(args[0], *ver, *num, tp)
+		if e != nil {
+			return
+		}
+		out = &output{v: files, header: []string{"MD5", "SIZE", "VER", "STATE", "TYPE", "ADD_VER", "SRC_NODE"}}
+		for _, f := range files {
+			out.row(f.MD5, f.Size, f.Ver, f.State, f.Type, f.AddVer, f.SrcNode)
+		}
+		return
+	}
+}
+
+type fileNode struct {
+	p2p_storage.GroupNode
+	Has bool `json:"has"` //节点版本不小于文件版本
+}
+
+type fileGroup struct {
+	File  p2p_storage.GroupFile `json:"file"`
+	Nodes []fileNode            `json:"nodes"`
+}
+
+type fileInfo struct {
+	MD5     string      `json:"md5"`
+	Groups  []fileGroup `json:"groups"`
+	Sources []string    `json:"sources"` //拥有原始文件的节点
+}
+
+func cmdFile(c *env) func(args []string) (*output, error) {
+	return func(args []string) (out *output, e error) {
+		md5 := args[0]
+		files, e := c.ds.GetFileGroups(md5, p2p_storage.ALL)
+		if e != nil {
+			return
+		}
+		info := &fileInfo{MD5: md5, Groups: make([]fileGroup, 0, len(files))}
+		for gid, f := range files {
+			f.Group = gid
+			nodes, e := c.ds.GetGroupNodes(gid)
+			if e != nil {
+				return nil, e
+			}
+			sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+			fg := fileGroup{File: f, Nodes: make([]fileNode, 0, len(nodes))}
+			for _, n := range nodes {
+				fg.Nodes = append(fg.Nodes, fileNode{n, f.State == p2p_storage.NORMAL && f.Ver > 0 && n.Ver >= f.Ver})
+			}
+			info.Groups = append(info.Groups, fg)
+		}
+		if len(info.Groups) == 0 {
+			return nil, service.NewError(service.ERR_NOT_FOUND, "file "+md5+" not found")
+		}
+		sort.Slice(info.Groups, func(i, j int) bool { return info.Groups[i].File.Group < info.Groups[j].File.Group })
+		if info.Sources, e = c.ds.GetSourceFileNodes(md5, 100); e != nil {
+			return
+		}
+		out = &output{v: info, header: []string{"GROUP", "FILE_VER", "FILE_STATE", "NODE", "NODE_STATE", "NODE_VER", "HAS"}}
+		out.field("md5", md5)
+		out.field("sources", info.Sources)
+		for _, g := range info.Groups {
+			for _, n := range g.Nodes {
+				out.row(g.File.Group, g.File.Ver, g.File.State, n.Node, n.State, n.Ver, n.Has)
+			}
+		}
+		return
+	}
+}
+
+func cmdGenPiece(c *env) func(args []string) (*output, error) {
+	return func(args []string) (out *output, e error) {
+		if e = p2p_storage.GenPiece(args[0], args[1], args[2]); e != nil {
+			return
+		}
+		return okOutput(fmt.Sprintf("node %s will regenerate piece of %s in group %s", args[1], args[2], args[0])), nil
+	}
+}
+
+func cmdExpand(c *env) func(args []string) (*output, error) {
+	return func(args []string) (out *output, e error) {
+		if e = p2p_storage.ExpandGroupToPerfectSize(args[0]); e != nil {
+			return
+		}
+		return okOutput("group " + args[0] + " expanded"), nil
+	}
+}
+
+type drainResult struct {
+	Node    string   `json:"node"`
+	Drained []string `json:"drained"`
+	Skipped []string `json:"skipped"`
+}
+
+func cmdDrain(c *env) func(args []string) (*output, error) {
+	force := c.fs.Bool("force", false, "drain even if group online nodes drop below SafePieces")
+	return func(args []string) (out *output, e error) {
+		r := &drainResult{Node: args[0]}
+		if r.Drained, r.Skipped, e = p2p_storage.DrainNode(args[0], *force); e != nil {
+			return
+		}
+		out = &output{v: r}
+		out.field("node", r.Node)
+		out.field("drained", r.Drained)
+		out.field("skipped", r.Skipped)
+		return
+	}
+}
+
+func cmdUndrain(c *env) func(args []string) (*output, error) {
+	return func(args []string) (out *output, e error) {
+		if e = p2p_storage.SetNodeDrained(args[0], false); e != nil {
+			return
+		}
+		return okOutput("node " + args[0] + " can join groups again"), nil
+	}
+}
+
+func cmdDelete(c *env) func(args []string) (*output, error) {
+	yes := c.fs.Bool("yes", false, "confirm deleting")
+	return func(args []string) (out *output, e error) {
+		if !*yes {
+			return nil, service.NewError(service.ERR_INVALID_PARAM, "add -yes to delete node "+args[0])
+		}
+		exist, e := c.ds.IsNodeExist(args[0])
+		if e != nil {
+			return
+		}
+		if !exist {
+			return nil, service.NewError(service.ERR_NOT_FOUND, "node "+args[0]+" not found")
+		}
+		if e = p2p_storage.DeleteNode(args[0]); e != nil {
+			return
+		}
+		return okOutput("node " + args[0] + " deleted"), nil
+	}
+}
+
+func cmdResetTasks(c *env) func(args []string) (*output, error) {
+	return func(args []string) (out *output, e error) {
+		if e = p2p_storage.RestartInitExpandNodeState(args[0]); e != nil {
+			return
+		}
+		return okOutput("expand tasks of node " + args[0] + " reset"), nil
+	}
+}
+
+func cmdResetRetry(c *env) func(args []string) (*output, error) {
+	return func(args []string) (out *output, e error) {
+		if e = p2p_storage.ResetExpandAttempt(args[0], args[1]); e != nil {
+			return
+		}
+		return okOutput("expand retry of " + args[1] + " in group " + args[0] + " reset"), nil
+	}
+}
+
+func cmdConfig(c *env) func(args []string) (*output, error) {
+	return func(args []string) (out *output, e error) {
+		config := make(map[string]interface{})
+		e = p2p_storage.ConfigMap.ConfigValue.Iterate(func(k, v interface{}) error {
+			config[fmt.Sprint(k)] = v
+			return nil
+		})
+		if e != nil {
+			return
+		}
+		out = &output{v: config, header: []string{"KEY", "VALUE"}}
+		for _, k := range sortedKeys(config) {
+			out.row(k, config[k])
+		}
+		return
+	}
+}
+
+func cmdCapacity(c *env) func(args []string) (*output, error) {
+	return func(args []string) (out *output, e error) {
+		s, e := p2p_storage.GetCapacityStatus()
+		if e != nil {
+			return
+		}
+		out = &output{v: s}
+		out.field("nodes", fmt.Sprintf("online=%d available=%d", s.Nodes, s.AvailableNodes))
+		out.field("space", fmt.Sprintf("total=%d left=%d percent=%d", s.TotalSpace, s.LeftSpace, s.LeftPercent))
+		out.field("groups", fmt.Sprintf("file_size=%d left=%d need_new=%v", s.FileSize, s.GroupLeftSpace, s.NeedNewGroup))
+		out.field("forecast", fmt.Sprintf("rate=%d/h exhaust_hours=%d", s.Rate, s.ExhaustHours))
+		if s.Warning != "" {
+			out.field("warning", s.Warning)
+		}
+		return
+	}
+}
+
+func cmdIngest(c *env) func(args []string) (*output, error) {
+	num := c.fs.Int("num", 100, "max pending files")
+	return func(args []string) (out *output, e error) {
+		stats, e := p2p_storage.GetIngestStats()
+		if e != nil {
+			return
+		}
+		pending, e := p2p_storage.ListPendingIngests(0, *num)
+		if e != nil {
+			return
+		}
+		out = &output{v: map[string]interface{}{"stats": stats, "pending": pending}, header: []string{"TICKET", "MD5", "SRC_NODE", "ADD_TM", "TRIES", "NEXT_TM", "ERROR"}}
+		out.field("pending", stats.Pending)
+		if stats.OldestTm > 0 {
+			out.field("oldest", fmt.Sprintf("%s (%ds)", fmtUnix(stats.OldestTm), tm.Now.Unix()-stats.OldestTm))
+		}
+		for _, p := range pending {
+			out.row(p.Ticket, p.MD5, p.SrcNode, fmtUnix(p.AddTm), p.Tries, fmtUnix(p.NextTm), p.Error)
+		}
+		return
+	}
+}
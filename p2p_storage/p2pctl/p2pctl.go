@@ -0,0 +1,249 @@
+/*
+p2p_storage的运维命令行工具，代替直接操作redis。
+
+数据源由yaml配置文件指定，source为数据源类型，内置mem类型（从snapshot指定的备份文件恢复到内存，用于离线查看备份）。
+mem数据源是备份的副本，只能执行查看命令，drain、delete等修改数据的命令会被拒绝；read_only为true时其他数据源也一样。
+其他类型的数据源（redis、mysql等）由使用方在自己的main中用RegisterSource注册后调用Main，打开函数从Config中
+读取redis、mysql等配置：
+	func main() {
+		p2pctl.RegisterSource("redis", func(c *p2pctl.Config) (p2p_storage.IDataSource, error) { ... })
+		os.Exit(p2pctl.Main(os.Args[1:]))
+	}
+用法：
+	p2pctl [-c p2pctl.yaml] [-json] <命令> [参数]
+不带命令时列出所有命令。默认输出表格，-json时输出json。
+*/
+package p2pctl
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"yh_pkg/config/yaml"
+	"yh_pkg/log"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/backup"
+	"yh_pkg/p2p_storage/mem_source"
+	"yh_pkg/service"
+)
+
+const DEFAULT_CONFIG_FILE = "p2pctl.yaml"
+
+//配置文件
+type Config struct {
+	Source   string            `yaml:"source"`   //数据源类型
+	Snapshot string            `yaml:"snapshot"` //mem数据源恢复的备份文件
+	Redis    yaml.RedisType    `yaml:"redis"`
+	Mysql    yaml.MysqlType    `yaml:"mysql"`
+	LogLevel string            `yaml:"log_level"` //默认为error
+	ReadOnly bool              `yaml:"read_only"` //只允许查看命令，mem数据源总是只读
+	Extra    map[string]string `yaml:"extra"`     //自定义数据源的其他配置
+}
+
+type SourceOpener func(c *Config) (p2p_storage.IDataSource, error)
+
+var sources = map[string]SourceOpener{"mem": openMemSource}
+
+//注册数据源类型，同名时覆盖
+func RegisterSource(name string, open SourceOpener) {
+	sources[name] = open
+}
+
+func openMemSource(c *Config) (ds p2p_storage.IDataSource, e error) {
+	ms := mem_source.New()
+	if c.Snapshot == "" {
+		return ms, nil
+	}
+	f, e := os.Open(c.Snapshot)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	s, e := backup.Read(f)
+	if e != nil {
+		return
+	}
+	if e = backup.Restore(ms, s); e != nil {
+		return
+	}
+	return ms, nil
+}
+
+//按配置文件打开数据源
+func Open(path string) (ds p2p_storage.IDataSource, c *Config, e error) {
+	c = &Config{}
+	if e = yaml.Load(c, path); e != nil {
+		return
+	}
+	if c.Source == "" {
+		c.Source = "mem"
+	}
+	if c.Source == "mem" {
+		//修改的只是内存中的副本，不能报告成功
+		c.ReadOnly = true
+	}
+	open, ok := sources[c.Source]
+	if !ok {
+		return nil, nil, errors.New("unknown source " + c.Source)
+	}
+	ds, e = open(c)
+	return
+}
+
+/*
+	命令行入口
+
+	参数：
+		args: 不包括程序名的命令行参数
+	返回值：
+		code: 进程的退出码
+*/
+func Main(args []string) (code int) {
+	fs := flag.NewFlagSet("p2pctl", flag.ContinueOnError)
+	path := fs.String("c", DEFAULT_CONFIG_FILE, "config file")
+	if e := fs.Parse(args); e != nil {
+		return 2
+	}
+	ds, c, e := Open(*path)
+	if e != nil {
+		fmt.Fprintln(os.Stderr, "open source:", e)
+		return 1
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "error"
+	}
+	logger, e := log.NewMLogger("", 1000, c.LogLevel)
+	if e != nil {
+		fmt.Fprintln(os.Stderr, e)
+		return 1
+	}
+	if e = p2p_storage.Init(ds, logger, false); e != nil {
+		fmt.Fprintln(os.Stderr, "init:", e)
+		return 1
+	}
+	if e = runCommand(ds, fs.Args(), os.Stdout, c.ReadOnly); e != nil {
+		fmt.Fprintln(os.Stderr, e)
+		return 1
+	}
+	return 0
+}
+
+/*
+	执行一个命令，调用前需要用ds初始化p2p_storage
+
+	参数：
+		args: [-json] <命令> [参数]
+		w: 命令的输出
+*/
+func Run(ds p2p_storage.IDataSource, args []string, w io.Writer) (e error) {
+	return runCommand(ds, args, w, false)
+}
+
+//readOnly为true时拒绝修改数据的命令
+func runCommand(ds p2p_storage.IDataSource, args []string, w io.Writer, readOnly bool) (e error) {
+	fs := flag.NewFlagSet("p2pctl", flag.ContinueOnError)
+	fs.SetOutput(w)
+	asJSON := fs.Bool("json", false, "output json")
+	if e = fs.Parse(args); e != nil {
+		return
+	}
+	if fs.NArg() == 0 {
+		usage(w)
+		return
+	}
+	cmd := findCommand(fs.Arg(0))
+	if cmd == nil {
+		usage(w)
+		return errors.New("unknown command " + fs.Arg(0))
+	}
+	if cmd.write && readOnly {
+		return service.NewError(service.ERR_PERMISSION_DENIED, cmd.name+" modifies data, source is read only")
+	}
+	cfs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	cfs.SetOutput(w)
+	cfs.Usage = func() { fmt.Fprintf(w, "usage: p2pctl %s %s\n", cmd.name, cmd.args) }
+	run := cmd.run(&env{ds: ds, fs: cfs})
+	if e = cfs.Parse(fs.Args()[1:]); e != nil {
+		return
+	}
+	if cfs.NArg() != cmd.nargs {
+		cfs.Usage()
+		return fmt.Errorf("%s needs %d args", cmd.name, cmd.nargs)
+	}
+	out, e := run(cfs.Args())
+	if e != nil {
+		return
+	}
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out.v)
+	}
+	return out.print(w)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: p2pctl [-c config] [-json] <command> [args]")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.help)
+	}
+	tw.Flush()
+}
+
+//命令的结果，v用于json输出，其他用于表格输出
+type output struct {
+	v      interface{}
+	fields [][2]string //表格前的键值
+	header []string
+	rows   [][]string
+	msg    string
+}
+
+func (o *output) field(k string, v interface{}) {
+	o.fields = append(o.fields, [2]string{k, fmt.Sprint(v)})
+}
+
+func (o *output) row(cols ...interface{}) {
+	r := make([]string, len(cols))
+	for i, c := range cols {
+		r[i] = fmt.Sprint(c)
+	}
+	o.rows = append(o.rows, r)
+}
+
+func (o *output) print(w io.Writer) (e error) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, f := range o.fields {
+		fmt.Fprintf(tw, "%s:\t%s\n", f[0], f[1])
+	}
+	if len(o.fields) > 0 && o.header != nil {
+		fmt.Fprintln(tw)
+	}
+	if o.header != nil {
+		fmt.Fprintln(tw, strings.Join(o.header, "\t"))
+	}
+	for _, r := range o.rows {
+		fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+	if o.msg != "" {
+		fmt.Fprintln(tw, o.msg)
+	}
+	return tw.Flush()
+}
+
+//配置项按名称排序输出
+func sortedKeys(m map[string]interface{}) (keys []string) {
+	keys = make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
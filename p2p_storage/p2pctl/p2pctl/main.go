@@ -0,0 +1,11 @@
+//p2p_storage运维工具，只支持mem数据源，其他数据源见yh_pkg/p2p_storage/p2pctl
+package main
+
+import (
+	"os"
+	"yh_pkg/p2p_storage/p2pctl"
+)
+
+func main() {
+	os.Exit(p2pctl.Main(os.Args[1:]))
+}
@@ -0,0 +1,225 @@
+package p2pctl
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"yh_pkg/log"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/p2p_storage/backup"
+	"yh_pkg/p2p_storage/history"
+	"yh_pkg/p2p_storage/mem_source"
+	"yh_pkg/service"
+)
+
+//分组g1中n1、n2、n3在线，n4离线且版本较低
+func newSource(t *testing.T) *mem_source.MemSource {
+	ds := mem_source.New()
+	tm := time.Now()
+	for _, id := range []string{"n1", "n2", "n3", "n4"} {
+		n := &p2p_storage.NodeDetail{Peer: p2p_storage.Peer{ID: id, IP: "10.0.0.1"}, UpdateTm: tm.UnixNano(), RegTm: tm.Unix()}
+		if e := ds.AddNode(n); e != nil {
+			t.Fatal(e)
+		}
+	}
+	ds.AddGroup(&p2p_storage.Group{ID: "g1", Size: 30, PieceSize: 1024, MinPieces: 2, SafePieces: 3, PerfectPieces: 4, FirstFinishVer: 2})
+	ds.SetIncrID("g1", 2)
+	for _, id := range []string{"n1", "n2", "n3"} {
+		ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: id, Ver: 2, State: p2p_storage.ONLINE, MaxVer: 2})
+	}
+	ds.AddNodeToGroup("g1", &p2p_storage.GroupNode{Node: "n4", Ver: 1, State: p2p_storage.OFFLINE, MaxVer: 1})
+	ds.AddFileToGroup("g1", &p2p_storage.GroupFile{File: p2p_storage.File{MD5: "m1", Size: 10}, Ver: 1, State: p2p_storage.NORMAL})
+	ds.AddFileToGroup("g1", &p2p_storage.GroupFile{File: p2p_storage.File{MD5: "m2", Size: 20}, Ver: 2, State: p2p_storage.NORMAL})
+	return ds
+}
+
+func errCode(e error) uint {
+	if se, ok := e.(service.Error); ok {
+		return se.Code
+	}
+	return 0
+}
+
+func run(ds p2p_storage.IDataSource, args ...string) (string, error) {
+	var buf bytes.Buffer
+	e := Run(ds, args, &buf)
+	return buf.String(), e
+}
+
+func TestRun(t *testing.T) {
+	logger, e := log.NewMLogger("", 1000, "error")
+	if e != nil {
+		t.Fatal(e)
+	}
+	ds := newSource(t)
+	if e = p2p_storage.Init(ds, logger, false); e != nil {
+		t.Fatal(e)
+	}
+	defer p2p_storage.Stop()
+
+	out, e := run(ds, "nodes", "-from", "n1", "-num", "2")
+	if e != nil || !strings.Contains(out, "n2") || !strings.Contains(out, "n3") || strings.Contains(out, "n4") {
+		t.Errorf("nodes: %v\n%s", e, out)
+	}
+	if out, e = run(ds, "groups"); e != nil || !strings.Contains(out, "g1") {
+		t.Errorf("groups: %v\n%s", e, out)
+	}
+	if out, e = run(ds, "files", "-ver", "1", "g1"); e != nil || strings.Contains(out, "m1") || !strings.Contains(out, "m2") {
+		t.Errorf("files: %v\n%s", e, out)
+	}
+
+	//n4的版本低于m2的版本
+	if out, e = run(ds, "-json", "file", "m2"); e != nil {
+		t.Fatal(e)
+	}
+	var info fileInfo
+	if e = json.Unmarshal([]byte(out), &info); e != nil {
+		t.Fatal(e)
+	}
+	if len(info.Groups) != 1 || len(info.Groups[0].Nodes) != 4 || !info.Groups[0].Nodes[0].Has || info.Groups[0].Nodes[3].Has {
+		t.Errorf("file: %s", out)
+	}
+	if _, e = run(ds, "file", "none"); e == nil {
+		t.Error("file not found")
+	}
+	if _, e = run(ds, "node"); e == nil {
+		t.Error("missing arg")
+	}
+	if out, e = run(ds, "node", "n1"); e != nil || !strings.Contains(out, "g1") {
+		t.Errorf("node: %v\n%s", e, out)
+	}
+
+	//移出后在线节点少于SafePieces
+	var r drainResult
+	if out, e = run(ds, "-json", "drain", "n1"); e == nil {
+		e = json.Unmarshal([]byte(out), &r)
+	}
+	if e != nil || len(r.Drained) != 0 || len(r.Skipped) != 1 {
+		t.Errorf("drain: %v %s", e, out)
+	}
+	if out, e = run(ds, "drain", "-force", "n1"); e != nil {
+		t.Fatal(e)
+	}
+	if nodes, _ := ds.GetGroupNodes("g1"); len(nodes) != 3 {
+		t.Errorf("drain -force: %s", out)
+	}
+	if exist, _ := ds.IsNodeExist("n1"); !exist {
+		t.Error("drained node deleted")
+	}
+
+	if _, e = run(ds, "delete", "n4"); e == nil {
+		t.Error("delete without -yes")
+	}
+	if _, e = run(ds, "delete", "-yes", "n4"); e != nil {
+		t.Fatal(e)
+	}
+	if exist, _ := ds.IsNodeExist("n4"); exist {
+		t.Error("node not deleted")
+	}
+	if out, e = run(ds, "config"); e != nil || !strings.Contains(out, p2p_storage.NODE_HISTORY_DAYS_KEY) {
+		t.Errorf("config: %v\n%s", e, out)
+	}
+	if _, e = run(ds, "unknown"); e == nil {
+		t.Error("unknown command")
+	}
+}
+
+//n1剩余2个分组容量，最近两小时每小时减少1个分组容量
+func TestCapacity(t *testing.T) {
+	logger, e := log.NewMLogger("", 1000, "error")
+	if e != nil {
+		t.Fatal(e)
+	}
+	ds := newSource(t)
+	if e = p2p_storage.Init(ds, logger, false); e != nil {
+		t.Fatal(e)
+	}
+	defer p2p_storage.Stop()
+	n, e := ds.GetNodeDetail("n1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	n.TotalSpace, n.Percent, n.LeftP2pSpace = 10*p2p_storage.GROUP_NODE_CAPACITY, 100, int64(2*p2p_storage.GROUP_NODE_CAPACITY)
+	if e = ds.UpdateNode(n); e != nil {
+		t.Fatal(e)
+	}
+	store := history.NewMemStore()
+	p2p_storage.SetNodeHistoryStore(store)
+	defer p2p_storage.SetNodeHistoryStore(nil)
+	now := time.Now().Unix()
+	for i := int64(1); i <= 2; i++ {
+		s := &p2p_storage.NodeSample{Node: p2p_storage.CAPACITY_HISTORY_NODE, Tm: now - i*3600, Span: p2p_storage.NODE_HISTORY_RESOLUTION, Count: 1, LeftSpace: int64(uint64(2+i) * p2p_storage.GROUP_NODE_CAPACITY)}
+		store.AddNodeSample(s)
+	}
+
+	var s p2p_storage.CapacityStatus
+	out, e := run(ds, "-json", "capacity")
+	if e == nil {
+		e = json.Unmarshal([]byte(out), &s)
+	}
+	if e != nil || s.Nodes != 4 || s.AvailableNodes != 1 || s.LeftPercent != 20 || s.ExhaustHours != 2 || !strings.Contains(s.Warning, "run out") {
+		t.Errorf("capacity: %v %s", e, out)
+	}
+}
+
+//g1中n3离线后在线节点少于添加文件需要的数量，文件进入队列
+func TestIngest(t *testing.T) {
+	logger, e := log.NewMLogger("", 1000, "error")
+	if e != nil {
+		t.Fatal(e)
+	}
+	ds := newSource(t)
+	if e = p2p_storage.Init(ds, logger, false); e != nil {
+		t.Fatal(e)
+	}
+	defer p2p_storage.Stop()
+	md5 := "0123456789abcdef0123456789abcdef"
+	ds.AddFileToGroup("g1", &p2p_storage.GroupFile{File: p2p_storage.File{MD5: md5, Size: 10}, Ver: 3, State: p2p_storage.NORMAL})
+	ds.UpdateGroupNode("g1", &p2p_storage.GroupNode{Node: "n3", Ver: 2, State: p2p_storage.OFFLINE, MaxVer: 2}, false)
+
+	if _, e = p2p_storage.AddP2PFile(md5, "n1", 10, 0, false); errCode(e) != service.ERR_P2P_INGEST_QUEUED {
+		t.Fatalf("not queued: %v", e)
+	}
+	out, e := run(ds, "ingest")
+	if e != nil || !strings.Contains(out, md5) || !strings.Contains(out, "pending:  1") {
+		t.Errorf("ingest: %v\n%s", e, out)
+	}
+}
+
+//mem数据源从备份文件恢复
+func TestOpen(t *testing.T) {
+	dir, e := ioutil.TempDir("", "p2pctl")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	s, e := backup.Export(newSource(t))
+	if e != nil {
+		t.Fatal(e)
+	}
+	var buf bytes.Buffer
+	if e = backup.Write(&buf, s); e != nil {
+		t.Fatal(e)
+	}
+	snapshot := filepath.Join(dir, "backup.gz")
+	conf := filepath.Join(dir, "p2pctl.yaml")
+	ioutil.WriteFile(snapshot, buf.Bytes(), 0644)
+	ioutil.WriteFile(conf, []byte("source: mem\nsnapshot: "+snapshot+"\n"), 0644)
+	ds, _, e := Open(conf)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if g, e := ds.GetGroup("g1"); e != nil || g == nil || g.PerfectPieces != 4 {
+		t.Errorf("group not restored: %+v %v", g, e)
+	}
+
+	ioutil.WriteFile(conf, []byte("source: none\n"), 0644)
+	if _, _, e = Open(conf); e == nil {
+		t.Error("unknown source")
+	}
+}
@@ -0,0 +1,126 @@
+package p2p_storage
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"yh_pkg/algorithm/erasure"
+	"yh_pkg/service"
+	"yh_pkg/time"
+)
+
+/*
+	推送碎片的令牌。扩散时执行任务的节点把碎片PUT到分组中的其他节点，接收端只接受协调服务签发的令牌。
+	令牌绑定分组、文件、推送端、接收端和碎片序号，并带有碎片的字节数，用转发密钥签名（见SetRelayKey），
+	接收端用RelayPublicKey校验，不需要访问协调服务。
+*/
+const PIECE_TOKEN_VALID_TIME int64 = 600 //令牌的有效期（秒）
+
+//令牌的内容
+type PieceGrant struct {
+	Group  string `json:"group"`
+	MD5    string `json:"md5"`
+	Src    string `json:"src"`    //推送端节点ID
+	Dst    string `json:"dst"`    //接收端节点ID
+	Size   uint64 `json:"size"`   //原始文件大小
+	Pieces int    `json:"pieces"` //碎片总数，碎片序号小于它
+	Index  int    `json:"idx"`    //推送的碎片序号
+	Bytes  int64  `json:"bytes"`  //碎片的字节数
+	Expire int64  `json:"expire"` //过期时间（秒）
+}
+
+/*
+	为正在执行的扩散任务签发推送碎片的令牌，每个接收端一个
+
+	参数：
+		nid: 执行任务的节点ID，必须是任务的节点
+		id: 扩散任务ID，任务必须已经开始（GetExpandTaskById之后）且没有超时
+		pieces: 接收端节点ID -> 推送给它的碎片序号，接收端必须是分组中还没有该文件碎片的其他节点
+	返回值：
+		tokens: 接收端节点ID -> 令牌
+*/
+func IssuePieceTokens(nid string, id uint64, pieces map[string]int) (tokens map[string]string, e error) {
+	return WithSpan(nil).IssuePieceTokens(nid, id, pieces)
+}
+
+func (c Caller) IssuePieceTokens(nid string, id uint64, pieces map[string]int) (tokens map[string]string, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.IssuePieceTokens")
+	defer span.SetAttr("nid", nid).SetAttr("id", id).SetAttr("pieces", len(pieces)).End(&e)
+	if relayKey == nil {
+		return nil, service.NewError(service.ERR_INTERNAL, "relay key not set")
+	}
+	exNode, e := source.Raw.GetExpandNodeById(id)
+	if e != nil {
+		return
+	}
+	if exNode == nil || exNode.Node != nid {
+		return nil, service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("expand task %d of node %s not found", id, nid))
+	}
+	if exNode.State != EXPAND_STATE_STARTED || exNode.IsFinished() {
+		return nil, service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("expand task %d is not running", id))
+	}
+	group, e := source.Raw.GetGroup(exNode.Group)
+	if e != nil {
+		return
+	}
+	file, e := source.Raw.GetGroupFile(exNode.Group, exNode.MD5)
+	if e != nil {
+		return
+	}
+	if group == nil || file == nil {
+		return nil, errors.New("can't find group or file of expand task")
+	}
+	coder, e := erasure.New(int(group.MinPieces), int(group.PerfectPieces))
+	if e != nil {
+		return
+	}
+	nodes, e := source.GetNoFileNodes(exNode.Group, exNode.MD5)
+	if e != nil {
+		return
+	}
+	needs := make(map[string]bool, len(nodes))
+	for _, dst := range nodes {
+		needs[dst] = dst != nid
+	}
+	g := PieceGrant{Group: group.ID, MD5: file.MD5, Src: nid, Size: file.Size, Pieces: coder.TotalShards(),
+		Bytes: int64(coder.ShardSize(int(file.Size))), Expire: time.Now.Unix() + PIECE_TOKEN_VALID_TIME}
+	tokens = make(map[string]string, len(pieces))
+	for dst, idx := range pieces {
+		if !needs[dst] {
+			return nil, service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("node %s doesn't need piece of %s", dst, file.MD5))
+		}
+		if idx < 0 || idx >= g.Pieces {
+			return nil, service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("invalid piece index %d", idx))
+		}
+		g.Dst, g.Index = dst, idx
+		if tokens[dst], e = signGrant(GRANT_TYPE_PIECE, &g); e != nil {
+			return nil, e
+		}
+	}
+	return
+}
+
+/*
+	接收端校验推送碎片的令牌
+
+	参数：
+		pub: 协调服务的转发公钥
+		token: 令牌
+		dst: 接收端自己的ID
+		gid, md5, idx: 推送的碎片
+	返回值：
+		e: 签名错误、过期或者不是这个碎片的令牌时为ERR_P2P_PIECE_TOKEN_INVALID
+*/
+func VerifyPieceToken(pub ed25519.PublicKey, token, dst, gid, md5 string, idx int) (g *PieceGrant, e error) {
+	g = &PieceGrant{}
+	if e = openGrant(pub, GRANT_TYPE_PIECE, token, g, service.ERR_P2P_PIECE_TOKEN_INVALID); e != nil {
+		return nil, e
+	}
+	if g.Dst != dst || g.Group != gid || g.MD5 != md5 || g.Index != idx {
+		return nil, service.NewError(service.ERR_P2P_PIECE_TOKEN_INVALID, fmt.Sprintf("piece token is for %s %s/%s#%d", g.Dst, g.Group, g.MD5, g.Index))
+	}
+	if g.Expire < time.Now.Unix() {
+		return nil, service.NewError(service.ERR_P2P_PIECE_TOKEN_INVALID, "piece token expired")
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package p2p_storage_test
+
+import (
+	"strings"
+	"testing"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+)
+
+//推送碎片的令牌绑定接收端和碎片序号，与转发令牌不能互相替代
+func TestIssuePieceTokens(t *testing.T) {
+	f, pub := relayFixture(t)
+	f.setAvailable()
+	const md5 = "0123456789abcdef0123456789abcdef"
+	f.addFile(md5, nil)
+	f.sync(md5)
+	_, relayToken, e := p2p_storage.IssueRelayTokens("n04", "n01", "new", md5)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	//没有碎片的新节点，GenPiece为它创建扩散任务
+	f.addNode("new", GID)
+	f.ds.SetAtomicGetLastCheckerTm(p2p_storage.CHECKER_GEN_PIECETM_PRIFIX+GID+md5, 0, -1)
+	if e = p2p_storage.GenPiece(GID, "new", md5); e != nil {
+		t.Fatal(e)
+	}
+	tasks, e := f.ds.GetValidExpandNodes(GID, md5)
+	if e != nil || len(tasks) != 1 {
+		t.Fatalf("tasks = %+v %v", tasks, e)
+	}
+	task := tasks[0]
+	if _, e = p2p_storage.IssuePieceTokens(task.Node, task.ID, map[string]int{"new": 2}); errCode(e) != service.ERR_INVALID_PARAM {
+		t.Errorf("task not started: %v", e)
+	}
+	node := &p2p_storage.Node{Peer: p2p_storage.Peer{ID: task.Node}, TotalSpace: 100 * p2p_storage.GROUP_NODE_CAPACITY}
+	if _, _, _, e = p2p_storage.UpdateNode2(node, nil, nil, p2p_storage.YES); e != nil {
+		t.Fatal(e)
+	}
+	if _, _, _, _, e = p2p_storage.GetExpandTaskById(task.ID); e != nil {
+		t.Fatal(e)
+	}
+
+	for _, c := range []struct {
+		name   string
+		nid    string
+		pieces map[string]int
+	}{
+		{"other node", "none", map[string]int{"new": 2}},
+		{"node has piece", task.Node, map[string]int{"n00": 2}},
+		{"to itself", task.Node, map[string]int{task.Node: 2}},
+		{"negative index", task.Node, map[string]int{"new": -1}},
+		{"index out of range", task.Node, map[string]int{"new": NODE_NUM}},
+	} {
+		if _, e := p2p_storage.IssuePieceTokens(c.nid, task.ID, c.pieces); errCode(e) != service.ERR_INVALID_PARAM {
+			t.Errorf("%s: %v", c.name, e)
+		}
+	}
+	tokens, e := p2p_storage.IssuePieceTokens(task.Node, task.ID, map[string]int{"new": 2})
+	if e != nil || len(tokens) != 1 {
+		t.Fatalf("tokens = %v %v", tokens, e)
+	}
+	g, e := p2p_storage.VerifyPieceToken(pub, tokens["new"], "new", GID, md5, 2)
+	if e != nil || g.Src != task.Node || g.Index != 2 || g.Pieces != NODE_NUM || g.Bytes <= 0 {
+		t.Errorf("grant = %+v %v", g, e)
+	}
+	if _, e = p2p_storage.VerifyPieceToken(pub, tokens["new"], "new", GID, md5, 3); errCode(e) != service.ERR_P2P_PIECE_TOKEN_INVALID {
+		t.Errorf("token of another index: %v", e)
+	}
+	//签名时带有令牌的类型，不需要检查内容就失败
+	if _, e = p2p_storage.VerifyPieceToken(pub, relayToken, "new", GID, md5, 0); errCode(e) != service.ERR_P2P_PIECE_TOKEN_INVALID || !strings.Contains(e.Error(), "sign failed") {
+		t.Errorf("relay token as piece token: %v", e)
+	}
+	if _, e = p2p_storage.VerifyRelayToken(pub, tokens["new"], "n04"); errCode(e) != service.ERR_P2P_RELAY_TOKEN_INVALID || !strings.Contains(e.Error(), "sign failed") {
+		t.Errorf("piece token as relay token: %v", e)
+	}
+}
@@ -0,0 +1,397 @@
+package p2p_storage
+
+import (
+	"fmt"
+	"math/rand"
+	"yh_pkg/service"
+	"yh_pkg/time"
+	"yh_pkg/trace"
+)
+
+//耐久等级
+const (
+	DURABILITY_STANDARD = 0 //普通文件，可以放在任何分组
+	DURABILITY_HIGH     = 1 //重要文件，放在冗余度更高的分组
+)
+
+//每次处理的过期文件数量
+const EXPIRE_PAGE_SIZE = 1000
+
+//过期后不能删除（还被对象引用等）的文件或对象推迟多少秒再处理，在保留期内的推迟到保留截止时间
+const EXPIRE_RETRY_SEC = 3600
+
+//耐久等级对分组碎片配置的要求
+type DurabilityTier struct {
+	SafeRatio    float64 //SafePieces/MinPieces的最小值
+	PerfectRatio float64 //PerfectPieces/MinPieces的最小值
+	GroupConfig  int     //没有符合要求的分组时，用GROUP_CONFIG中的哪个配置创建分组
+}
+
+//下标为耐久等级
+var DURABILITY_TIERS []DurabilityTier = []DurabilityTier{{0, 0, 2}, {1.5, 2, 0}}
+
+//分组的碎片配置是否满足耐久等级
+func (t *DurabilityTier) Match(g *Group) bool {
+	if g.MinPieces == 0 {
+		return false
+	}
+	min := float64(g.MinPieces)
+	return float64(g.SafePieces) >= t.SafeRatio*min && float64(g.PerfectPieces) >= t.PerfectRatio*min
+}
+
+//文件或存储桶的生命周期策略，0表示没有限制
+type Policy struct {
+	TTL       int64 `json:"ttl"`       //添加后多少秒过期，过期后自动删除
+	Retention int64 `json:"retention"` //添加后多少秒内不能删除
+	Tier      int   `json:"tier"`      //耐久等级
+	Priority  int   `json:"priority"`  //优先级，见PRIORITY_CLASSES
+}
+
+func (p *Policy) check() (e error) {
+	if p.TTL < 0 || p.Retention < 0 || p.Tier < 0 || p.Tier >= len(DURABILITY_TIERS) {
+		return service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("invalid policy %+v", *p))
+	}
+	return checkPriority(p.Priority)
+}
+
+//计算过期时间和保留截止时间，过期时间不早于保留截止时间
+func (p *Policy) times(now int64) (expireTm, retainTm int64) {
+	if p.Retention > 0 {
+		retainTm = now + p.Retention
+	}
+	if p.TTL > 0 {
+		expireTm = now + p.TTL
+		if expireTm < retainTm {
+			expireTm = retainTm
+		}
+	}
+	return
+}
+
+//不带md5的文件的生命周期，对象的生命周期保存在Object中
+type FilePolicy struct {
+	MD5      string `json:"md5"`
+	Tier     int    `json:"tier"`
+	Priority int    `json:"priority"`
+	ExpireTm int64  `json:"expire_tm"` //过期时间，秒数，0表示不过期
+	RetainTm int64  `json:"retain_tm"` //保留截止时间，秒数
+}
+
+/*
+	生命周期策略存储，实现可以与IDataSource使用同一个数据库，IDataSource同时实现该接口时Init会自动使用。
+*/
+type IPolicyStore interface {
+	//不存在时返回nil,nil
+	GetFilePolicy(md5 string) (p *FilePolicy, e error)
+	SetFilePolicy(p *FilePolicy) (e error)
+	DeleteFilePolicy(md5 string) (e error)
+	/*
+		获取已经过期的文件
+
+		参数：
+			before: 返回ExpireTm不为0且不晚于before的文件，按ExpireTm升序
+			num: 最多返回的数量
+	*/
+	GetExpiredFiles(before int64, num int) (policies []FilePolicy, e error)
+
+	//不存在时返回nil,nil
+	GetBucketPolicy(tenant, bucket string) (p *Policy, e error)
+	SetBucketPolicy(tenant, bucket string, p *Policy) (e error)
+}
+
+var policyStore IPolicyStore
+
+//设置生命周期策略存储，为nil时不能设置策略
+func SetPolicyStore(ps IPolicyStore) {
+	policyStore = ps
+}
+
+func checkPolicyStore() (e error) {
+	if policyStore == nil {
+		return service.NewError(service.ERR_INTERNAL, "policy store not set")
+	}
+	return
+}
+
+//设置存储桶的策略，只影响之后添加的对象
+func SetBucketPolicy(tenant, bucket string, p *Policy) (e error) {
+	return WithSpan(nil).SetBucketPolicy(tenant, bucket, p)
+}
+
+func (c Caller) SetBucketPolicy(tenant, bucket string, p *Policy) (e error) {
+	defer c.parent.Child("p2p_storage.SetBucketPolicy").SetAttr("tenant", tenant).SetAttr("bucket", bucket).End(&e)
+	if e = checkPolicyStore(); e != nil {
+		return
+	}
+	if e = p.check(); e != nil {
+		return
+	}
+	return policyStore.SetBucketPolicy(tenant, bucket, p)
+}
+
+func GetBucketPolicy(tenant, bucket string) (p *Policy, e error) {
+	defer trace.Begin("p2p_storage.GetBucketPolicy").SetAttr("tenant", tenant).SetAttr("bucket", bucket).End(&e)
+	if policyStore == nil {
+		return
+	}
+	return policyStore.GetBucketPolicy(tenant, bucket)
+}
+
+func GetFilePolicy(md5 string) (p *FilePolicy, e error) {
+	return WithSpan(nil).GetFilePolicy(md5)
+}
+
+func (c Caller) GetFilePolicy(md5 string) (p *FilePolicy, e error) {
+	span := c.parent.Child("p2p_storage.GetFilePolicy")
+	defer span.SetAttr("md5", md5).End(&e)
+	if policyStore == nil {
+		return
+	}
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	return policyStore.GetFilePolicy(md5)
+}
+
+/*
+	带生命周期策略添加文件，按耐久等级选择分组，其他参数和返回值与AddP2PFile相同。
+	文件已有策略时合并：过期时间和保留截止时间取较晚的，耐久等级取较高的，优先级取修复更优先的。
+	文件已经存在但没有策略时，优先级按PRIORITY_NORMAL合并。文件已经在其他分组中时不会迁移。
+
+	参数：
+		policy: 为nil时与AddP2PFile相同
+*/
+func AddP2PFileWithPolicy(md5, src_node string, size uint64, times int, add_no_source_file bool, policy *Policy) (task_id int64, e error) {
+	return WithSpan(nil).AddP2PFileWithPolicy(md5, src_node, size, times, add_no_source_file, policy)
+}
+
+func (c Caller) AddP2PFileWithPolicy(md5, src_node string, size uint64, times int, add_no_source_file bool, policy *Policy) (task_id int64, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.AddP2PFileWithPolicy")
+	defer span.SetAttr("md5", md5).SetAttr("src_node", src_node).SetAttr("size", size).End(&e)
+	if policy == nil {
+		return WithSpan(span).AddP2PFile(md5, src_node, size, times, add_no_source_file)
+	}
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	if e = checkPolicyStore(); e != nil {
+		return
+	}
+	if e = policy.check(); e != nil {
+		return
+	}
+	task_id, e = source.addDirectFile(md5, src_node, size, times, add_no_source_file, policy.Tier, policy.Priority)
+	if e != nil && !isFileAdded(e) {
+		return
+	}
+	p := &FilePolicy{MD5: md5, Tier: policy.Tier, Priority: policy.Priority}
+	p.ExpireTm, p.RetainTm = policy.times(time.Now.Unix())
+	old, err := policyStore.GetFilePolicy(md5)
+	if err != nil {
+		return 0, err
+	}
+	if old != nil {
+		if old.ExpireTm == 0 || p.ExpireTm != 0 && old.ExpireTm > p.ExpireTm {
+			p.ExpireTm = old.ExpireTm
+		}
+		if old.RetainTm > p.RetainTm {
+			p.RetainTm = old.RetainTm
+		}
+		if old.Tier > p.Tier {
+			p.Tier = old.Tier
+		}
+		p.Priority = mergePriority(old.Priority, p.Priority)
+	} else if isFileAdded(e) {
+		//文件已经由没有策略的调用方添加，按PRIORITY_NORMAL合并
+		p.Priority = mergePriority(PRIORITY_NORMAL, p.Priority)
+	}
+	if err = policyStore.SetFilePolicy(p); err != nil {
+		return 0, err
+	}
+	return
+}
+
+//对象中没有设置的生命周期用存储桶的策略填充
+func fillObjectPolicy(obj *Object, now int64) (e error) {
+	p, e := GetBucketPolicy(obj.Tenant, obj.Bucket)
+	if e != nil || p == nil {
+		return
+	}
+	expireTm, retainTm := p.times(now)
+	if obj.ExpireTm == 0 {
+		obj.ExpireTm = expireTm
+	}
+	if obj.RetainTm == 0 {
+		obj.RetainTm = retainTm
+	}
+	if obj.Tier == DURABILITY_STANDARD {
+		obj.Tier = p.Tier
+	}
+	if obj.Priority == PRIORITY_NORMAL {
+		obj.Priority = p.Priority
+	}
+	if obj.ExpireTm != 0 && obj.ExpireTm < obj.RetainTm {
+		obj.ExpireTm = obj.RetainTm
+	}
+	return
+}
+
+//用策略设置对象的生命周期，调用AddP2PObject之前使用，没有设置的部分使用存储桶的策略
+func (obj *Object) SetPolicy(p *Policy) {
+	obj.ExpireTm, obj.RetainTm = p.times(time.Now.Unix())
+	obj.Tier = p.Tier
+	obj.Priority = p.Priority
+}
+
+func deleteFilePolicy(md5 string) (e error) {
+	if policyStore == nil {
+		return
+	}
+	return policyStore.DeleteFilePolicy(md5)
+}
+
+func retainedError(what string, retainTm int64) error {
+	return service.NewError(service.ERR_P2P_FILE_RETAINED, fmt.Sprintf("%s is retained until %d", what, retainTm))
+}
+
+//检查文件是否在保留期内
+func checkFileRetention(md5 string) (e error) {
+	p, e := GetFilePolicy(md5)
+	if e != nil || p == nil {
+		return
+	}
+	if p.RetainTm > time.Now.Unix() {
+		return retainedError("file "+md5, p.RetainTm)
+	}
+	return
+}
+
+/*
+	获取符合耐久等级、还有空间且在线节点足够的分组，没有时group为nil，由调用方用node创建分组。
+	优先级要求节点可用率时，只选择节点平均可用率不低于要求的分组中可用率最高的
+
+	返回值：
+		node: 创建分组时使用的节点
+*/
+func (ds *DataSource) getTierGroup(md5 string, tier, priority int) (node string, group *Group, e error) {
+	nodes, e := GetAvailableNode(1)
+	if e != nil {
+		return
+	}
+	if len(nodes) == 0 {
+		return "", nil, admissionError(md5)
+	}
+	node = nodes[0]
+	groups, e := ds.Raw.GetAllGroup()
+	if e != nil {
+		return
+	}
+	minAvail := PRIORITY_CLASSES[priority].MinAvailability
+	cache := make(map[string]float64)
+	useful := make([]Group, 0)
+	var best float64
+	for _, g := range groups {
+		if !DURABILITY_TIERS[tier].Match(&g) || g.Size >= GROUP_NODE_CAPACITY*uint64(g.MinPieces) {
+			continue
+		}
+		nodeCount, e := ds.Raw.GetNodeCountByVerAndState(g.ID, g.FirstFinishVer, ONLINE)
+		if e != nil {
+			logger.AppendObj(e, "getTierGroup GetNodeCountByVerAndState error groupid: "+g.ID)
+			continue
+		}
+		if int(nodeCount) < getGroupLimitCount(g.SafePieces, ADD_FILE_COUNT_PART) {
+			continue
+		}
+		if minAvail <= 0 {
+			useful = append(useful, g)
+			continue
+		}
+		d, e := ds.cachedGroupDurability(&g, g.FirstFinishVer, cache)
+		if e != nil {
+			logger.AppendObj(e, "getTierGroup groupDurability error groupid: "+g.ID)
+			continue
+		}
+		if d.Online >= minAvail && (group == nil || d.Online > best) {
+			c := g
+			group, best = &c, d.Online
+		}
+	}
+	if len(useful) > 0 {
+		group = &useful[rand.Intn(len(useful))]
+	}
+	logger.AppendObj(nil, "getTierGroup", md5, tier, priority, node, group)
+	return
+}
+
+//需要按耐久等级或优先级选择分组
+func needTierGroup(tier, priority int) bool {
+	return tier != DURABILITY_STANDARD || PRIORITY_CLASSES[priority].MinAvailability > 0
+}
+
+/*
+	删除过期的文件和对象。不能删除的（保留期内、文件还被对象引用等）推迟过期时间后再处理，
+	不会一直排在GetExpiredFiles和GetExpiredObjects的前面挡住后面的过期数据
+
+	返回值：
+		n: 删除的文件和对象数量
+*/
+func ExpireFiles(num int) (n int, e error) {
+	source, span := beginSpan(nil, "p2p_storage.ExpireFiles")
+	defer span.End(&e)
+	now := time.Now.Unix()
+	if policyStore != nil {
+		policies, e := policyStore.GetExpiredFiles(now, num)
+		if e != nil {
+			return n, e
+		}
+		for _, p := range policies {
+			if err := WithSpan(span).DeleteFile(p.MD5); err != nil {
+				logger.AppendObj(err, "ExpireFiles-DeleteFile error", p.MD5)
+				p.ExpireTm = expireRetryTm(p.RetainTm, now)
+				if err = policyStore.SetFilePolicy(&p); err != nil {
+					return n, err
+				}
+				continue
+			}
+			n++
+		}
+	}
+	if nsStore != nil {
+		objs, e := nsStore.GetExpiredObjects(now, num)
+		if e != nil {
+			return n, e
+		}
+		for _, obj := range objs {
+			if err := WithSpan(span).DeleteObject(obj.Tenant, obj.Bucket, obj.Key); err != nil {
+				logger.AppendObj(err, "ExpireFiles-DeleteObject error", obj.Tenant, obj.Bucket, obj.Key)
+				if err = source.delayObjectExpire(&obj, now); err != nil {
+					return n, err
+				}
+				continue
+			}
+			n++
+		}
+	}
+	return
+}
+
+func expireRetryTm(retainTm, now int64) int64 {
+	if retainTm > now {
+		return retainTm
+	}
+	return now + EXPIRE_RETRY_SEC
+}
+
+//推迟不能删除的对象的过期时间，对象已经被修改时不处理
+func (ds *DataSource) delayObjectExpire(obj *Object, now int64) (e error) {
+	if e = ds.lock(tenantLockKey(obj.Tenant)); e != nil {
+		return
+	}
+	defer ds.unlock(tenantLockKey(obj.Tenant))
+	cur, e := nsStore.GetObject(obj.Tenant, obj.Bucket, obj.Key)
+	if e != nil || cur == nil || cur.MD5 != obj.MD5 || cur.ExpireTm != obj.ExpireTm {
+		return
+	}
+	cur.ExpireTm = expireRetryTm(cur.RetainTm, now)
+	return nsStore.PutObject(cur)
+}
@@ -0,0 +1,96 @@
+package p2p_storage_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+)
+
+//DURABILITY_HIGH的文件只放到冗余度满足要求的分组，保留期内不能删除；存储桶的策略作用于对象
+func TestPolicy(t *testing.T) {
+	f := newFixture(t)
+	//冗余度不满足DURABILITY_HIGH的分组
+	f.ds.AddGroup(&p2p_storage.Group{ID: "g2", PieceSize: 1024, MinPieces: 4, SafePieces: 5, PerfectPieces: 6})
+	for i := 0; i < 6; i++ {
+		f.ds.AddNodeToGroup("g2", &p2p_storage.GroupNode{Node: fmt.Sprintf("n%02d", i), State: p2p_storage.ONLINE})
+	}
+	f.setAvailable()
+
+	const m1, m2 = "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+	for i := 0; i < 5; i++ {
+		f.addFile(m1, &p2p_storage.Policy{Retention: 3600, Tier: p2p_storage.DURABILITY_HIGH})
+	}
+	if files := f.groups(m1); len(files) != 1 || files[GID].MD5 != m1 {
+		t.Errorf("high durability file in groups %v", files)
+	}
+	if e := p2p_storage.DeleteFile(m1); errCode(e) != service.ERR_P2P_FILE_RETAINED {
+		t.Errorf("DeleteFile retained file: %v", e)
+	}
+
+	if e := p2p_storage.CreateBucket("t1", "tmp"); e != nil {
+		t.Fatal(e)
+	}
+	if e := p2p_storage.SetBucketPolicy("t1", "tmp", &p2p_storage.Policy{TTL: 7200, Retention: 3600}); e != nil {
+		t.Fatal(e)
+	}
+	f.addObject(&p2p_storage.Object{Tenant: "t1", Bucket: "tmp", Key: "a", MD5: m2, Size: 4096})
+	obj, _ := p2p_storage.GetObject("t1", "tmp", "a")
+	if obj == nil || obj.RetainTm == 0 || obj.ExpireTm < obj.RetainTm+3600 {
+		t.Fatalf("object policy %+v", obj)
+	}
+	if e := p2p_storage.DeleteObject("t1", "tmp", "a"); errCode(e) != service.ERR_P2P_FILE_RETAINED {
+		t.Errorf("DeleteObject retained object: %v", e)
+	}
+}
+
+//过期的文件和对象被删除，保留期内和还被引用的推迟处理，不会挡住后面过期的
+func TestExpireFiles(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	const m1, m2, m3 = "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210", "00112233445566778899aabbccddeeff"
+	now := time.Now().Unix()
+	f.addFile(m1, &p2p_storage.Policy{Retention: 3600})
+	f.addFile(m3, &p2p_storage.Policy{TTL: 3600})
+	f.ds.SetFilePolicy(&p2p_storage.FilePolicy{MD5: m3, ExpireTm: now - 1})
+	if e := p2p_storage.CreateBucket("t1", "tmp"); e != nil {
+		t.Fatal(e)
+	}
+	f.addObject(&p2p_storage.Object{Tenant: "t1", Bucket: "tmp", Key: "a", MD5: m2, Size: 4096})
+	obj, _ := p2p_storage.GetObject("t1", "tmp", "a")
+	obj.ExpireTm = now - 1
+	f.ds.PutObject(obj)
+	if n, e := p2p_storage.ExpireFiles(100); n != 2 || e != nil {
+		t.Errorf("ExpireFiles: %d %v", n, e)
+	}
+	if len(f.groups(m3)) > 0 || len(f.groups(m2)) > 0 || len(f.groups(m1)) == 0 {
+		t.Error("wrong files deleted by ExpireFiles")
+	}
+	if obj, _ = p2p_storage.GetObject("t1", "tmp", "a"); obj != nil {
+		t.Errorf("expired object not deleted: %+v", obj)
+	}
+
+	if e := p2p_storage.CreateBucket("t1", "keep"); e != nil {
+		t.Fatal(e)
+	}
+	f.addObject(&p2p_storage.Object{Tenant: "t1", Bucket: "keep", Key: "a", MD5: m3, Size: 4096})
+	f.addFile(m2, &p2p_storage.Policy{TTL: 3600})
+	f.ds.SetFilePolicy(&p2p_storage.FilePolicy{MD5: m3, ExpireTm: now - 2})
+	f.ds.SetFilePolicy(&p2p_storage.FilePolicy{MD5: m2, ExpireTm: now - 1})
+	retained, _ := p2p_storage.GetObject("t1", "keep", "a")
+	retained.ExpireTm, retained.RetainTm = now-2, now+60
+	f.ds.PutObject(retained)
+	if n, e := p2p_storage.ExpireFiles(1); n != 0 || e != nil {
+		t.Errorf("ExpireFiles blocked entries: %d %v", n, e)
+	}
+	if n, e := p2p_storage.ExpireFiles(1); n != 1 || e != nil || len(f.groups(m2)) > 0 || len(f.groups(m3)) == 0 {
+		t.Errorf("ExpireFiles after blocked entries: %d %v", n, e)
+	}
+	if p, _ := f.ds.GetFilePolicy(m3); p == nil || p.ExpireTm <= now {
+		t.Errorf("referenced file not rescheduled: %+v", p)
+	}
+	if obj, _ = p2p_storage.GetObject("t1", "keep", "a"); obj == nil || obj.ExpireTm != now+60 {
+		t.Errorf("retained object not rescheduled: %+v", obj)
+	}
+}
@@ -0,0 +1,250 @@
+package p2p_storage
+
+import (
+	"fmt"
+	"yh_pkg/service"
+	"yh_pkg/trace"
+)
+
+//文件的优先级，保存在FilePolicy中，没有策略的文件为PRIORITY_NORMAL
+const (
+	PRIORITY_NORMAL = 0 //普通文件
+	PRIORITY_HIGH   = 1 //不能重新生成的文件，例如用户上传的原图
+	PRIORITY_LOW    = 2 //可以重新生成的文件，例如缩略图
+)
+
+//优先级对放置、修复和淘汰的影响
+type PriorityClass struct {
+	Name            string
+	MinAvailability float64 //放置时分组节点的平均可用率下限，大于0时选择可用率最高的分组
+	LevelShift      int8    //扩散任务优先级的调整，越大越先修复，合并策略时取较大的
+	GenPieceRatio   float64 //GenPiece时缺少碎片的节点超过(PerfectPieces-SafePieces)的该比例才生成碎片
+	Evictable       bool    //分组空间不足时可以淘汰
+}
+
+//下标为优先级
+var PRIORITY_CLASSES []PriorityClass = []PriorityClass{
+	PRIORITY_NORMAL: {"normal", 0, 0, 0.1, false},
+	PRIORITY_HIGH:   {"high", 0.5, 1, 0, false},
+	PRIORITY_LOW:    {"low", 0, -1, 0.3, true},
+}
+
+func checkPriority(priority int) (e error) {
+	if priority < 0 || priority >= len(PRIORITY_CLASSES) {
+		return service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("invalid priority %d", priority))
+	}
+	return
+}
+
+//合并两个优先级，取修复更优先的
+func mergePriority(a, b int) int {
+	if PRIORITY_CLASSES[b].LevelShift > PRIORITY_CLASSES[a].LevelShift {
+		return b
+	}
+	return a
+}
+
+/*
+	按优先级列出文件的策略，用于淘汰低优先级的文件。
+	IPolicyStore同时实现该接口时才会淘汰文件。
+*/
+type IPriorityIndex interface {
+	/*
+		参数：
+			after: 返回md5大于after的文件，按md5升序
+			num: 最多返回的数量
+	*/
+	GetFilesByPriority(priority int, after string, num int) (policies []FilePolicy, e error)
+}
+
+//文件的优先级，没有策略时为PRIORITY_NORMAL
+func GetFilePriority(md5 string) (priority int, e error) {
+	span := trace.Begin("p2p_storage.GetFilePriority")
+	defer span.SetAttr("md5", md5).End(&e)
+	p, e := WithSpan(span).GetFilePolicy(md5)
+	if e != nil || p == nil || checkPriority(p.Priority) != nil {
+		return PRIORITY_NORMAL, e
+	}
+	return p.Priority, nil
+}
+
+/*
+	设置文件的优先级，与已有的优先级合并，取修复更优先的，没有策略的文件按PRIORITY_NORMAL合并。
+	同一个文件可能被多个调用方添加，只能提高不能降低，可以淘汰的优先级只能在添加文件时指定
+*/
+func SetFilePriority(md5 string, priority int) (e error) {
+	span := trace.Begin("p2p_storage.SetFilePriority")
+	defer span.SetAttr("md5", md5).End(&e)
+	if e = checkPolicyStore(); e != nil {
+		return
+	}
+	if e = checkPriority(priority); e != nil {
+		return
+	}
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	return mergeFilePriority(md5, priority, true)
+}
+
+/*
+	把添加方的优先级合并到文件的策略中，多个对象或调用方添加同一个文件时取修复更优先的，
+	所以文件只有在所有添加方都指定了可以淘汰的优先级时才会被淘汰。
+
+	参数：
+		existed: 文件在这次添加前已经存在，没有策略时按PRIORITY_NORMAL合并
+*/
+func mergeFilePriority(md5 string, priority int, existed bool) (e error) {
+	if policyStore == nil {
+		return
+	}
+	p, e := policyStore.GetFilePolicy(md5)
+	if e != nil {
+		return
+	}
+	if p == nil {
+		if existed {
+			priority = mergePriority(PRIORITY_NORMAL, priority)
+		}
+		if priority == PRIORITY_NORMAL {
+			return
+		}
+		p = &FilePolicy{MD5: md5, Priority: priority}
+	} else if merged := mergePriority(p.Priority, priority); merged != p.Priority {
+		p.Priority = merged
+	} else {
+		return
+	}
+	return policyStore.SetFilePolicy(p)
+}
+
+//按文件优先级调整扩散任务优先级，首次扩散的任务（0）不调整
+func fileTaskLevel(gid, md5 string, ver uint64) (level int8, e error) {
+	if level, e = GetExpandTaskLevel(gid, ver); e != nil || level == 0 {
+		return
+	}
+	priority, err := GetFilePriority(md5)
+	if err != nil {
+		logger.AppendObj(err, "fileTaskLevel-GetFilePriority error", md5)
+		return
+	}
+	level += PRIORITY_CLASSES[priority].LevelShift
+	if max := int8(len(DURABILITY_LEVEL_NINES) + 1); level > max {
+		level = max
+	}
+	if level < 1 {
+		level = 1
+	}
+	return
+}
+
+//GenPiece时缺少碎片的节点数需要超过的数量
+func genPieceThreshold(g *Group, md5 string) int {
+	priority, e := GetFilePriority(md5)
+	if e != nil {
+		logger.AppendObj(e, "genPieceThreshold-GetFilePriority error", md5)
+	}
+	return int(float64(g.PerfectPieces-g.SafePieces) * PRIORITY_CLASSES[priority].GenPieceRatio)
+}
+
+//分组已用空间的百分比
+func groupUsagePercent(g *Group) int64 {
+	capacity := GROUP_NODE_CAPACITY * uint64(g.MinPieces)
+	if capacity == 0 {
+		return 100
+	}
+	return int64(g.Size * 100 / capacity)
+}
+
+/*
+	分组已用空间超过evict_usage_percent时，淘汰其中可以淘汰的低优先级文件。
+	文件的优先级是所有添加方合并的结果（见mergeFilePriority），保留期内和被对象引用的文件不淘汰。
+
+	参数：
+		num: 最多淘汰的文件数
+	返回值：
+		n: 淘汰的文件数
+*/
+func EvictFiles(num int) (n int, e error) {
+	source, span := beginSpan(nil, "p2p_storage.EvictFiles")
+	defer span.End(&e)
+	if !SupportsStore(policyStore, (*IPriorityIndex)(nil)) {
+		return
+	}
+	index := policyStore.(IPriorityIndex)
+	limit := getConfigInt64(EVICT_USAGE_PERCENT_KEY, DEFAULT_EVICT_USAGE_PERCENT)
+	groups, e := source.Raw.GetAllGroup()
+	if e != nil {
+		return
+	}
+	full := make(map[string]bool)
+	for gid, g := range groups {
+		if groupUsagePercent(&g) >= limit {
+			full[gid] = true
+		}
+	}
+	if len(full) == 0 {
+		return
+	}
+	for priority, class := range PRIORITY_CLASSES {
+		if !class.Evictable {
+			continue
+		}
+		for after := ""; n < num && len(full) > 0; {
+			policies, e := index.GetFilesByPriority(priority, after, EXPIRE_PAGE_SIZE)
+			if e != nil {
+				return n, e
+			}
+			if len(policies) == 0 {
+				break
+			}
+			for _, p := range policies {
+				after = p.MD5
+				if n >= num {
+					break
+				}
+				evicted, err := source.evictFile(p.MD5, full, limit)
+				if err != nil {
+					logger.AppendObj(err, "EvictFiles-evictFile error", p.MD5)
+					continue
+				}
+				if evicted {
+					n++
+				}
+			}
+		}
+	}
+	return
+}
+
+//文件在空间不足的分组中时删除，删除后不再超过限制的分组从full中移除
+func (ds *DataSource) evictFile(md5 string, full map[string]bool, limit int64) (evicted bool, e error) {
+	//列出后可能有其他调用方添加了同一个文件，优先级已经提高
+	priority, e := GetFilePriority(md5)
+	if e != nil || !PRIORITY_CLASSES[priority].Evictable {
+		return
+	}
+	files, e := ds.Raw.GetFileGroups(md5, NORMAL)
+	if e != nil {
+		return
+	}
+	for gid := range files {
+		if full[gid] {
+			evicted = true
+			break
+		}
+	}
+	if !evicted {
+		return
+	}
+	if e = DeleteFile(md5); e != nil {
+		return false, e
+	}
+	logger.AppendObj(nil, "EvictFiles-evicted", md5)
+	for gid := range files {
+		if g, err := ds.Raw.GetGroup(gid); err == nil && g != nil && groupUsagePercent(g) < limit {
+			delete(full, gid)
+		}
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package p2p_storage_test
+
+import (
+	"fmt"
+	"testing"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+)
+
+//高优先级的文件放到风险低的分组，多次添加时合并为修复更优先的，存储桶的优先级作用于对象引用的文件
+func TestPriority(t *testing.T) {
+	f := newFixture(t)
+	//g2的节点较少且有两个节点经常离线
+	f.ds.AddGroup(&p2p_storage.Group{ID: "g2", PieceSize: 1024, MinPieces: 4, SafePieces: 5, PerfectPieces: 6})
+	for i := 0; i < 6; i++ {
+		f.ds.AddNodeToGroup("g2", &p2p_storage.GroupNode{Node: fmt.Sprintf("n%02d", i), State: p2p_storage.ONLINE})
+	}
+	f.setAvailable()
+	for _, id := range []string{"n03", "n04"} {
+		n, _ := f.ds.GetNodeDetail(id)
+		n.OnlineCount = 16
+		f.ds.UpdateNode(n)
+	}
+
+	const high = "0123456789abcdef0123456789abcdef"
+	f.addFile(high, &p2p_storage.Policy{Priority: p2p_storage.PRIORITY_HIGH})
+	if files := f.groups(high); len(files) != 1 || files[GID].MD5 != high {
+		t.Errorf("high priority file in groups %v", files)
+	}
+	for _, c := range []struct {
+		add, want int
+	}{
+		{p2p_storage.PRIORITY_LOW, p2p_storage.PRIORITY_HIGH},
+		{p2p_storage.PRIORITY_NORMAL, p2p_storage.PRIORITY_HIGH},
+		{p2p_storage.PRIORITY_HIGH, p2p_storage.PRIORITY_HIGH},
+	} {
+		f.addFile(high, &p2p_storage.Policy{Priority: c.add})
+		if p, e := p2p_storage.GetFilePriority(high); e != nil || p != c.want {
+			t.Errorf("priority after adding with %d: %d %v, want %d", c.add, p, e, c.want)
+		}
+	}
+	if _, e := p2p_storage.AddP2PFileWithPolicy("00112233445566778899aabbccddeeff", "n01", 4096, 0, false, &p2p_storage.Policy{Priority: 9}); errCode(e) != service.ERR_INVALID_PARAM {
+		t.Errorf("invalid priority: %v", e)
+	}
+
+	if e := p2p_storage.CreateBucket("t1", "thumbs"); e != nil {
+		t.Fatal(e)
+	}
+	if e := p2p_storage.SetBucketPolicy("t1", "thumbs", &p2p_storage.Policy{Priority: p2p_storage.PRIORITY_LOW}); e != nil {
+		t.Fatal(e)
+	}
+	const thumb = "99887766554433221100ffeeddccbbaa"
+	f.addObject(&p2p_storage.Object{Tenant: "t1", Bucket: "thumbs", Key: "a", MD5: thumb, Size: 4096})
+	if p, _ := p2p_storage.GetFilePriority(thumb); p != p2p_storage.PRIORITY_LOW {
+		t.Errorf("object file priority %d", p)
+	}
+}
+
+//分组空间不足时只淘汰所有添加方都允许淘汰、没有被引用的低优先级文件
+func TestEvictFiles(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	const high, low, normal = "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210", "00112233445566778899aabbccddeeff"
+	const thumb, shared = "99887766554433221100ffeeddccbbaa", "aabbccddeeff00112233445566778899"
+	f.addFile(high, &p2p_storage.Policy{Priority: p2p_storage.PRIORITY_HIGH})
+	f.addFile(low, &p2p_storage.Policy{Priority: p2p_storage.PRIORITY_LOW})
+	f.addFile(normal, &p2p_storage.Policy{Priority: p2p_storage.PRIORITY_NORMAL})
+	//被对象引用的文件
+	if e := p2p_storage.CreateBucket("t1", "thumbs"); e != nil {
+		t.Fatal(e)
+	}
+	if e := p2p_storage.SetBucketPolicy("t1", "thumbs", &p2p_storage.Policy{Priority: p2p_storage.PRIORITY_LOW}); e != nil {
+		t.Fatal(e)
+	}
+	f.addObject(&p2p_storage.Object{Tenant: "t1", Bucket: "thumbs", Key: "a", MD5: thumb, Size: 4096})
+	if p, _ := p2p_storage.GetFilePriority(thumb); p != p2p_storage.PRIORITY_LOW {
+		t.Errorf("object file priority %d", p)
+	}
+	//其他调用方直接添加或设置的优先级与已有的合并，不能降低
+	f.addFile(shared, &p2p_storage.Policy{Priority: p2p_storage.PRIORITY_LOW})
+	f.addFile(shared, nil)
+	if p, _ := p2p_storage.GetFilePriority(shared); p != p2p_storage.PRIORITY_NORMAL {
+		t.Errorf("shared file priority %d", p)
+	}
+	if e := p2p_storage.SetFilePriority(normal, p2p_storage.PRIORITY_LOW); e != nil {
+		t.Fatal(e)
+	}
+	if e := p2p_storage.SetFilePriority(high, p2p_storage.PRIORITY_NORMAL); e != nil {
+		t.Fatal(e)
+	}
+	if p, _ := p2p_storage.GetFilePriority(normal); p != p2p_storage.PRIORITY_NORMAL {
+		t.Errorf("SetFilePriority lowered normal file to %d", p)
+	}
+	if p, _ := p2p_storage.GetFilePriority(high); p != p2p_storage.PRIORITY_HIGH {
+		t.Errorf("SetFilePriority lowered high file to %d", p)
+	}
+
+	if n, e := p2p_storage.EvictFiles(10); n != 0 || e != nil {
+		t.Errorf("EvictFiles without space pressure: %d %v", n, e)
+	}
+	g, _ := f.ds.GetGroup(GID)
+	f.ds.UpdateGroupSize(g, int64(p2p_storage.GROUP_NODE_CAPACITY*uint64(g.MinPieces)*96/100))
+	if n, e := p2p_storage.EvictFiles(10); n != 1 || e != nil {
+		t.Errorf("EvictFiles: %d %v", n, e)
+	}
+	if len(f.groups(low)) != 0 || len(f.groups(normal)) == 0 || len(f.groups(high)) == 0 || len(f.groups(thumb)) == 0 || len(f.groups(shared)) == 0 {
+		t.Error("wrong files evicted")
+	}
+}
@@ -0,0 +1,167 @@
+package p2p_storage
+
+import (
+	"fmt"
+	"yh_pkg/service"
+)
+
+//规划读取范围时，除了拼回数据需要的MinPieces个节点外多返回的备用节点数
+const RANGE_SPARE_PEERS = 2
+
+/*
+	文件的一段在碎片中的位置。
+	碎片是系统码：第i个数据碎片（i<MinPieces）就是原始文件的[i*ShardSize, (i+1)*ShardSize)，
+	任意MinPieces个碎片在同一位置的内容可以拼回数据碎片在该位置的内容。
+*/
+type RangeStripe struct {
+	Shard       int    `json:"shard"`        //数据碎片的序号
+	ShardOffset uint64 `json:"shard_offset"` //在碎片中的开始位置
+	Offset      uint64 `json:"offset"`       //在原始文件中的开始位置
+	Length      uint64 `json:"length"`
+}
+
+//读取文件一段数据的计划
+type RangePlan struct {
+	MD5       string        `json:"md5"`
+	Group     *Group        `json:"group"`
+	Size      uint64        `json:"size"`       //原始文件大小
+	ShardSize uint64        `json:"shard_size"` //每个碎片的大小
+	Offset    uint64        `json:"offset"`     //读取范围，超过文件末尾的部分已经截掉
+	Length    uint64        `json:"length"`
+	Stripes   []RangeStripe `json:"stripes"`
+	//有碎片的节点，容易连接的在前，前MinPieces个是拼回数据最少需要的节点，之后是备用节点。
+	//协调服务不记录节点上碎片的序号，读取方需要向节点查询（见agent.RangeReader）
+	Peers []Peer `json:"peers"`
+}
+
+//与erasure.Coder.ShardSize一致
+func shardSize(size uint64, minPieces uint32) uint64 {
+	return (size + uint64(minPieces) - 1) / uint64(minPieces)
+}
+
+/*
+	把文件的[offset, offset+length)按数据碎片切分，每段不跨碎片，也不跨碎片中PieceSize对齐的块，
+	便于节点按块读取和缓存。
+
+	参数：
+		size: 原始文件大小
+		offset, length: 读取范围，需要已经截到文件大小以内
+*/
+func SplitRange(group *Group, size, offset, length uint64) (stripes []RangeStripe) {
+	stripes = make([]RangeStripe, 0)
+	if length == 0 || group.MinPieces == 0 {
+		return
+	}
+	shard := shardSize(size, group.MinPieces)
+	block := uint64(group.PieceSize)
+	if block == 0 || block > shard {
+		block = shard
+	}
+	for end := offset + length; offset < end; {
+		s := RangeStripe{Shard: int(offset / shard), ShardOffset: offset % shard, Offset: offset}
+		next := s.ShardOffset - s.ShardOffset%block + block
+		if next > shard {
+			next = shard
+		}
+		s.Length = next - s.ShardOffset
+		if offset+s.Length > end {
+			s.Length = end - offset
+		}
+		stripes = append(stripes, s)
+		offset += s.Length
+	}
+	return
+}
+
+/*
+	规划读取文件的一段，用于播放等只需要部分数据的场景，不需要下载整个文件。
+	读取方从计划中的节点读取失败后，把失败的节点放在exclude中重新规划；文件所在的分组去掉这些节点后
+	不足MinPieces个时换用文件所在的其他分组，都不足时返回第一个分组中剩下的节点。
+
+	参数：
+		md5: 文件的md5或文件ID
+		offset: 开始位置
+		length: 读取长度，超过文件末尾时截到文件末尾，为0时读到文件末尾
+		exclude: 不使用的节点ID，可以为nil
+	返回值：
+		plan: 覆盖读取范围的碎片段和最少的节点。文件不存在时为ERR_NOT_FOUND，offset超过文件大小时为ERR_INVALID_PARAM
+*/
+func PlanRange(md5 string, offset, length uint64, exclude []string) (plan *RangePlan, e error) {
+	return WithSpan(nil).PlanRange(md5, offset, length, exclude)
+}
+
+func (c Caller) PlanRange(md5 string, offset, length uint64, exclude []string) (plan *RangePlan, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.PlanRange")
+	defer span.SetAttr("md5", md5).End(&e)
+	if md5, e = WithSpan(span).ResolveFileKey(md5); e != nil {
+		return
+	}
+	nodes, group, e := rangePeers(md5, exclude)
+	if e != nil {
+		return
+	}
+	if group == nil {
+		return nil, service.NewError(service.ERR_NOT_FOUND, "file "+md5+" not found")
+	}
+	if group.MinPieces == 0 {
+		return nil, fmt.Errorf("invalid MinPieces of group %s", group.ID)
+	}
+	file, e := source.Raw.GetGroupFile(group.ID, md5)
+	if e != nil {
+		return
+	}
+	if file == nil {
+		return nil, service.NewError(service.ERR_NOT_FOUND, "file "+md5+" not found in group "+group.ID)
+	}
+	if offset > file.Size || (offset == file.Size && file.Size > 0) {
+		return nil, service.NewError(service.ERR_INVALID_PARAM, fmt.Sprintf("offset %d exceeds size %d of %s", offset, file.Size, md5))
+	}
+	if length == 0 || length > file.Size-offset {
+		length = file.Size - offset
+	}
+	if max := int(group.MinPieces) + RANGE_SPARE_PEERS; len(nodes) > max {
+		nodes = nodes[:max]
+	}
+	plan = &RangePlan{
+		MD5:       md5,
+		Group:     group,
+		Size:      file.Size,
+		ShardSize: shardSize(file.Size, group.MinPieces),
+		Offset:    offset,
+		Length:    length,
+		Stripes:   SplitRange(group, file.Size, offset, length),
+		Peers:     nodes,
+	}
+	return
+}
+
+//按分组查找去掉exclude后还有MinPieces个节点的分组，都不够时返回第一个分组
+func rangePeers(md5 string, exclude []string) (nodes []Peer, group *Group, e error) {
+	skip := make(map[string]bool, len(exclude))
+	for _, nid := range exclude {
+		skip[nid] = true
+	}
+	used := make([]string, 0)
+	for {
+		peers, g, _, err := DownloadMore(md5, used)
+		if err != nil {
+			return nil, nil, err
+		}
+		if g == nil {
+			return
+		}
+		left := make([]Peer, 0, len(peers))
+		for _, p := range peers {
+			if !skip[p.ID] {
+				left = append(left, p)
+			}
+		}
+		if group == nil {
+			nodes, group = left, g
+		}
+		if len(left) >= int(g.MinPieces) {
+			return left, g, nil
+		}
+		used = append(used, g.ID)
+	}
+}
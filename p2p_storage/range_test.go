@@ -0,0 +1,87 @@
+package p2p_storage_test
+
+import (
+	"testing"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+)
+
+//4096字节的文件在MinPieces为4的分组中每个碎片1024字节，读取范围按碎片切分并截到文件末尾
+func TestPlanRange(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	const md5 = "0123456789abcdef0123456789abcdef"
+	f.addFile(md5, nil)
+	f.sync(md5)
+	cases := []struct {
+		name           string
+		md5            string
+		offset, length uint64
+		want           uint64 //计划的读取长度
+		stripes        int
+		code           uint
+	}{
+		{"middle", md5, 1000, 3000, 3000, 4, service.ERR_NOERR},
+		{"to end", md5, 4000, 0, 96, 1, service.ERR_NOERR},
+		{"past end", md5, 3000, 5000, 1096, 2, service.ERR_NOERR},
+		{"offset at size", md5, 4096, 1, 0, 0, service.ERR_INVALID_PARAM},
+		{"unknown file", "fedcba9876543210fedcba9876543210", 0, 1, 0, 0, service.ERR_NOT_FOUND},
+	}
+	for _, c := range cases {
+		plan, e := p2p_storage.PlanRange(c.md5, c.offset, c.length, nil)
+		if errCode(e) != c.code {
+			t.Errorf("%s: %v, want code %d", c.name, e, c.code)
+			continue
+		}
+		if e != nil {
+			continue
+		}
+		if plan.Size != 4096 || plan.ShardSize != 1024 || plan.Length != c.want || len(plan.Stripes) != c.stripes || len(plan.Peers) != 4+p2p_storage.RANGE_SPARE_PEERS {
+			t.Errorf("%s: plan %+v", c.name, plan)
+			continue
+		}
+		//每段不跨碎片，连续覆盖读取范围
+		var length uint64
+		for _, s := range plan.Stripes {
+			if s.Offset != c.offset+length || s.Shard != int(s.Offset/1024) || s.ShardOffset != s.Offset%1024 || s.ShardOffset+s.Length > plan.ShardSize {
+				t.Errorf("%s: stripe %+v", c.name, s)
+			}
+			length += s.Length
+		}
+		if length != c.want {
+			t.Errorf("%s: stripes cover %d bytes, want %d", c.name, length, c.want)
+		}
+	}
+}
+
+//重新规划时不使用读取失败的节点，剩下的节点不够MinPieces时仍然返回剩下的节点
+func TestPlanRangeExclude(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	const md5 = "0123456789abcdef0123456789abcdef"
+	f.addFile(md5, nil)
+	f.sync(md5)
+	cases := []struct {
+		exclude []string
+		peers   int
+	}{
+		{[]string{"n00", "n01"}, 4 + p2p_storage.RANGE_SPARE_PEERS},
+		{[]string{"n00", "n01", "n02", "n03", "n04"}, 3},
+	}
+	for _, c := range cases {
+		plan, e := p2p_storage.PlanRange(md5, 0, 0, c.exclude)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if len(plan.Peers) != c.peers {
+			t.Errorf("exclude %v: %d peers, want %d", c.exclude, len(plan.Peers), c.peers)
+		}
+		for _, p := range plan.Peers {
+			for _, nid := range c.exclude {
+				if p.ID == nid {
+					t.Errorf("exclude %v: peer %s planned", c.exclude, nid)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package p2p_storage
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"yh_pkg/service"
+	"yh_pkg/time"
+)
+
+/*
+	代理转发的令牌。不能直接连接的两端通过GetDelegates得到的代理节点转发碎片，协调服务用转发密钥（Ed25519）
+	签发一对令牌，分别给提供端和获取端，代理节点用RelayPublicKey校验，不需要访问协调服务。
+	令牌绑定会话、代理节点和角色，带宽限制为delegate_min_speed配置。代理节点在会话结束后用获取端的令牌调用ReportRelay
+	汇报转发的字节数，记录到节点详情的RelayBytes、RelayCount。汇报的字节数不能超过带宽限制乘以会话时长，
+	会话时长不能超过令牌签发到汇报的时间，每个会话只统计一次，代理节点不能是转发的任何一端。
+*/
+const (
+	RELAY_ROLE_SRC int8 = 1 //提供数据的一端，与yh_pkg/net中的值一致
+	RELAY_ROLE_DST int8 = 2 //获取数据的一端
+)
+
+//用转发密钥签名的令牌的类型，签名时放在内容前面
+const (
+	GRANT_TYPE_RELAY = "relay" //代理转发的令牌
+	GRANT_TYPE_PIECE = "piece" //推送碎片的令牌
+)
+
+const (
+	RELAY_TOKEN_VALID_TIME  int64 = 300       //令牌的有效期（秒）
+	RELAY_REPORT_VALID_TIME int64 = 24 * 3600 //令牌过期后还可以汇报统计的时间（秒）
+	RELAY_SESSION_ID_BYTES        = 8
+	RELAY_MAX_REPORT_STATS        = 1000 //一次汇报的最大会话数
+	//不限制带宽的会话按该速度（字节/秒）限制汇报的字节数
+	RELAY_MAX_REPORT_RATE int64 = 100 * 1024 * 1024
+)
+
+//令牌的内容
+type RelayGrant struct {
+	Session  string `json:"session"`
+	Delegate string `json:"delegate"` //代理节点ID
+	Role     int8   `json:"role"`
+	Src      string `json:"src"`           //提供端节点ID
+	Dst      string `json:"dst"`           //获取端的ID，可以不是节点
+	MD5      string `json:"md5,omitempty"` //传输的文件
+	Rate     int64  `json:"rate"`          //带宽限制（字节/秒），0表示不限制
+	Expire   int64  `json:"expire"`        //过期时间（秒）
+}
+
+//代理节点汇报的会话统计
+type RelayStat struct {
+	Token string `json:"token"` //获取端的令牌
+	Bytes int64  `json:"bytes"` //双向转发的字节数
+	Ms    int64  `json:"ms"`    //会话时长（毫秒）
+}
+
+var relayKey ed25519.PrivateKey
+
+//设置签发转发令牌的密钥，没有设置时不能使用代理转发
+func SetRelayKey(key ed25519.PrivateKey) {
+	relayKey = key
+}
+
+//代理节点校验令牌使用的公钥，没有设置密钥时返回nil
+func RelayPublicKey() ed25519.PublicKey {
+	if relayKey == nil {
+		return nil
+	}
+	return relayKey.Public().(ed25519.PublicKey)
+}
+
+/*
+	签发一次转发的令牌，代理节点必须在线并且可以直接连接
+
+	参数：
+		delegate: 代理节点ID
+		src: 提供端节点ID
+		dst: 获取端ID
+		md5: 传输的文件，可以为空
+	返回值：
+		srcToken: 提供端的令牌，由获取端通过其他方式交给提供端
+		dstToken: 获取端的令牌
+		e: 代理节点是提供端或获取端时为ERR_INVALID_PARAM
+*/
+func IssueRelayTokens(delegate, src, dst, md5 string) (srcToken, dstToken string, e error) {
+	return WithSpan(nil).IssueRelayTokens(delegate, src, dst, md5)
+}
+
+func (c Caller) IssueRelayTokens(delegate, src, dst, md5 string) (srcToken, dstToken string, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.IssueRelayTokens")
+	defer span.SetAttr("md5", md5).SetAttr("delegate", delegate).End(&e)
+	if relayKey == nil {
+		return "", "", service.NewError(service.ERR_INTERNAL, "relay key not set")
+	}
+	if delegate == src || delegate == dst {
+		return "", "", service.NewError(service.ERR_INVALID_PARAM, "node "+delegate+" can not relay for itself")
+	}
+	peers, e := source.GetOnlineNodesByIds([]string{delegate}, time.Now.Unix()-NODE_VALID_TIME)
+	if e != nil {
+		return
+	}
+	if _, e = applyVerifiedNATs(peers); e != nil {
+		return
+	}
+	if len(peers) == 0 || peers[0].UPNPAvailable != int8(YES) {
+		return "", "", service.NewError(service.ERR_INVALID_PARAM, "node "+delegate+" is not an available delegate")
+	}
+	b := make([]byte, RELAY_SESSION_ID_BYTES)
+	if _, e = rand.Read(b); e != nil {
+		return
+	}
+	g := RelayGrant{Session: hex.EncodeToString(b), Delegate: delegate, Src: src, Dst: dst, MD5: md5,
+		Rate: getConfigInt64(DELEGATES_MIN_SPEED_CONFIG_KEY, DEFAULT_DELEGATES_NODE_SPEED), Expire: time.Now.Unix() + RELAY_TOKEN_VALID_TIME}
+	g.Role = RELAY_ROLE_SRC
+	if srcToken, e = signRelayGrant(&g); e != nil {
+		return
+	}
+	g.Role = RELAY_ROLE_DST
+	dstToken, e = signRelayGrant(&g)
+	return
+}
+
+func signRelayGrant(g *RelayGrant) (token string, e error) {
+	return signGrant(GRANT_TYPE_RELAY, g)
+}
+
+//令牌为base64url(json).base64url(签名)，签名的内容为类型、换行符和json，一种令牌不能当作另一种使用
+func signGrant(typ string, g interface{}) (token string, e error) {
+	b, e := json.Marshal(g)
+	if e != nil {
+		return
+	}
+	return base64.RawURLEncoding.EncodeToString(b) + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(relayKey, grantMessage(typ, b))), nil
+}
+
+func grantMessage(typ string, b []byte) []byte {
+	return append([]byte(typ+"\n"), b...)
+}
+
+//按类型typ校验签名并解析令牌的内容到g，失败时返回错误码为code的错误
+func openGrant(pub ed25519.PublicKey, typ, token string, g interface{}, code uint) (e error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 || len(pub) != ed25519.PublicKeySize {
+		return service.NewError(code, "invalid token")
+	}
+	b, err1 := base64.RawURLEncoding.DecodeString(token[:i])
+	sig, err2 := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err1 != nil || err2 != nil || !ed25519.Verify(pub, grantMessage(typ, b), sig) {
+		return service.NewError(code, "token sign failed")
+	}
+	if e = json.Unmarshal(b, g); e != nil {
+		return service.NewError(code, "invalid token: "+e.Error())
+	}
+	return
+}
+
+/*
+	代理节点校验令牌
+
+	参数：
+		pub: 协调服务的转发公钥
+		token: 令牌
+		delegate: 代理节点自己的ID
+	返回值：
+		e: 签名错误、过期或者不是签发给该代理节点时为ERR_P2P_RELAY_TOKEN_INVALID
+*/
+func VerifyRelayToken(pub ed25519.PublicKey, token, delegate string) (g *RelayGrant, e error) {
+	return verifyRelayToken(pub, token, delegate, time.Now.Unix())
+}
+
+//按now判断是否过期
+func verifyRelayToken(pub ed25519.PublicKey, token, delegate string, now int64) (g *RelayGrant, e error) {
+	g = &RelayGrant{}
+	if e = openGrant(pub, GRANT_TYPE_RELAY, token, g, service.ERR_P2P_RELAY_TOKEN_INVALID); e != nil {
+		return nil, e
+	}
+	if g.Delegate != delegate {
+		return nil, service.NewError(service.ERR_P2P_RELAY_TOKEN_INVALID, "relay token is for node "+g.Delegate+", not "+delegate)
+	}
+	if g.Expire < now {
+		return nil, service.NewError(service.ERR_P2P_RELAY_TOKEN_INVALID, "relay token of session "+g.Session+" expired")
+	}
+	return
+}
+
+/*
+	代理节点汇报转发的字节数，累加到节点详情。每个会话只统计一次，令牌校验失败的会话和代理节点自己是一端的会话跳过，
+	超过带宽限制乘以会话时长的字节数按上限统计。需要设置节点公钥存储，用于记录已经统计的会话。
+
+	参数：
+		nid: 代理节点ID
+		stats: 会话统计
+	返回值：
+		n: 统计的会话数
+*/
+func ReportRelay(nid string, stats []RelayStat) (n int, e error) {
+	return WithSpan(nil).ReportRelay(nid, stats)
+}
+
+func (c Caller) ReportRelay(nid string, stats []RelayStat) (n int, e error) {
+	source, span := beginSpan(c.parent, "p2p_storage.ReportRelay")
+	defer span.SetAttr("nid", nid).End(&e)
+	pub := RelayPublicKey()
+	if pub == nil {
+		return 0, service.NewError(service.ERR_INTERNAL, "relay key not set")
+	}
+	if keyStore == nil {
+		return 0, service.NewError(service.ERR_INTERNAL, "node key store not set")
+	}
+	if len(stats) > RELAY_MAX_REPORT_STATS {
+		return 0, service.NewError(service.ERR_INVALID_PARAM, "too many relay stats")
+	}
+	now := time.Now.Unix()
+	var bytes int64
+	for _, s := range stats {
+		g, err := verifyRelayToken(pub, s.Token, nid, now-RELAY_REPORT_VALID_TIME)
+		if err != nil || g.Role != RELAY_ROLE_DST || g.Src == nid || g.Dst == nid || s.Bytes < 0 || s.Ms < 0 {
+			logger.AppendObj(err, "ReportRelay skip session", nid, s.Bytes)
+			continue
+		}
+		ok, err := keyStore.UseNonce(nid, "relay:"+g.Session, g.Expire+RELAY_REPORT_VALID_TIME)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			continue
+		}
+		if max := relayBytesLimit(g, s.Ms, now); s.Bytes > max {
+			logger.AppendObj(nil, "ReportRelay bytes over limit", nid, g.Session, s.Bytes, max)
+			s.Bytes = max
+		}
+		bytes += s.Bytes
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	//与心跳更新节点详情互斥，见NodeDetail.Update
+	if e = source.lock(nodeLockKey(nid)); e != nil {
+		return 0, e
+	}
+	defer source.unlock(nodeLockKey(nid))
+	details, e := source.Raw.GetNodesByIds([]string{nid})
+	if e != nil {
+		return 0, e
+	}
+	if len(details) == 0 {
+		return 0, service.NewError(service.ERR_NOT_FOUND, "node "+nid+" not found")
+	}
+	details[0].RelayBytes += bytes
+	details[0].RelayCount += int64(n)
+	if e = source.Raw.UpdateNode(&details[0]); e != nil {
+		return 0, e
+	}
+	return
+}
+
+/*
+	会话最多可以转发的字节数：带宽限制乘以会话时长，加上限速的突发量（带宽的1/4，见yh_pkg/net中的转发服务）。
+	会话在令牌签发后才能开始，时长不超过签发到now的时间
+*/
+func relayBytesLimit(g *RelayGrant, ms int64, now int64) int64 {
+	if maxMs := (now - g.Expire + RELAY_TOKEN_VALID_TIME) * 1000; ms > maxMs {
+		ms = maxMs
+	}
+	if ms < 0 {
+		ms = 0
+	}
+	rate := g.Rate
+	if rate <= 0 {
+		rate = RELAY_MAX_REPORT_RATE
+	}
+	return rate*ms/1000 + rate/4
+}
@@ -0,0 +1,112 @@
+package p2p_storage_test
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/service"
+)
+
+//设置转发密钥，n04是可以直接连接的代理节点
+func relayFixture(t *testing.T) (f *fixture, pub ed25519.PublicKey) {
+	f = newFixture(t)
+	natHeartbeat(t)
+	pub, key, e := ed25519.GenerateKey(nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	p2p_storage.SetRelayKey(key)
+	t.Cleanup(func() { p2p_storage.SetRelayKey(nil) })
+	return
+}
+
+func TestIssueRelayTokens(t *testing.T) {
+	_, pub := relayFixture(t)
+	for _, c := range []struct {
+		name, delegate, src, dst string
+	}{
+		{"unreachable delegate", "n00", "n01", "client"},
+		{"unknown delegate", "none", "n01", "client"},
+		{"delegate is src", "n04", "n04", "client"},
+		{"delegate is dst", "n04", "n01", "n04"},
+	} {
+		if _, _, e := p2p_storage.IssueRelayTokens(c.delegate, c.src, c.dst, ""); errCode(e) != service.ERR_INVALID_PARAM {
+			t.Errorf("%s: %v", c.name, e)
+		}
+	}
+
+	const md5 = "0123456789abcdef0123456789abcdef"
+	srcToken, dstToken, e := p2p_storage.IssueRelayTokens("n04", "n01", "client", md5)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, c := range []struct {
+		token string
+		role  int8
+	}{
+		{srcToken, p2p_storage.RELAY_ROLE_SRC},
+		{dstToken, p2p_storage.RELAY_ROLE_DST},
+	} {
+		g, e := p2p_storage.VerifyRelayToken(pub, c.token, "n04")
+		if e != nil || g.Role != c.role || g.Src != "n01" || g.Dst != "client" || g.MD5 != md5 || g.Rate <= 0 {
+			t.Errorf("grant of role %d: %+v %v", c.role, g, e)
+		}
+	}
+	if _, e = p2p_storage.VerifyRelayToken(pub, dstToken, "n05"); errCode(e) != service.ERR_P2P_RELAY_TOKEN_INVALID {
+		t.Errorf("token for other delegate: %v", e)
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, e = p2p_storage.VerifyRelayToken(other, dstToken, "n04"); errCode(e) != service.ERR_P2P_RELAY_TOKEN_INVALID {
+		t.Errorf("token of other key: %v", e)
+	}
+}
+
+//每个会话只统计一次，只统计获取端的令牌，字节数不超过带宽限制乘以会话时长
+func TestReportRelay(t *testing.T) {
+	_, pub := relayFixture(t)
+	issue := func(delegate string) (srcToken, dstToken string) {
+		srcToken, dstToken, e := p2p_storage.IssueRelayTokens(delegate, "n01", "client", "")
+		if e != nil {
+			t.Fatal(e)
+		}
+		return
+	}
+	src, dst := issue("n04")
+	_, inflated := issue("n04")
+	_, forN05 := issue("n05")
+	g, e := p2p_storage.VerifyRelayToken(pub, inflated, "n04")
+	if e != nil {
+		t.Fatal(e)
+	}
+	cases := []struct {
+		name  string
+		stats []p2p_storage.RelayStat
+		n     int
+		min   int64 //累计的字节数范围
+		max   int64
+	}{
+		{"dst token", []p2p_storage.RelayStat{{Token: dst, Bytes: 100}}, 1, 100, 100},
+		{"same session again", []p2p_storage.RelayStat{{Token: dst, Bytes: 100}}, 0, 100, 100},
+		{"src token", []p2p_storage.RelayStat{{Token: src, Bytes: 100}}, 0, 100, 100},
+		{"token of other delegate", []p2p_storage.RelayStat{{Token: forN05, Bytes: 100}}, 0, 100, 100},
+		{"negative bytes", []p2p_storage.RelayStat{{Token: inflated, Bytes: -1}}, 0, 100, 100},
+		//会话刚签发，最多按一秒的带宽加突发量统计
+		{"inflated", []p2p_storage.RelayStat{{Token: inflated, Bytes: 1 << 40, Ms: 3600 * 1000}}, 1, 100 + g.Rate/4, 100 + g.Rate + g.Rate/4},
+	}
+	for _, c := range cases {
+		if n, e := p2p_storage.ReportRelay("n04", c.stats); n != c.n || e != nil {
+			t.Errorf("%s: %d %v, want %d", c.name, n, e, c.n)
+		}
+		details, e := p2p_storage.GetNodesByIds([]string{"n04"})
+		if e != nil || len(details) != 1 {
+			t.Fatal(details, e)
+		}
+		if d := details[0]; d.RelayBytes < c.min || d.RelayBytes > c.max {
+			t.Errorf("%s: relay bytes %d, want [%d, %d]", c.name, d.RelayBytes, c.min, c.max)
+		}
+	}
+	stats := make([]p2p_storage.RelayStat, p2p_storage.RELAY_MAX_REPORT_STATS+1)
+	if _, e = p2p_storage.ReportRelay("n04", stats); errCode(e) != service.ERR_INVALID_PARAM {
+		t.Errorf("too many stats: %v", e)
+	}
+}
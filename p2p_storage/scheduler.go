@@ -0,0 +1,261 @@
+package p2p_storage
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"yh_pkg/time"
+)
+
+const (
+	SCHED_CANDIDATE_FACTOR = 3    //每次从数据库取出的候选任务数是需要任务数的倍数
+	SCHED_INFLIGHT_SEC     = 300  //节点同时执行的任务字节数不超过这么多秒的可用带宽
+	SCHED_UNSAFE_TIMEOUT   = 1800 //危险文件任务分配后多久没有结束就不再计入执行中
+	SCHED_REPAIR_LEVEL     = 2    //优先级不低于这个值的扩散任务（易险及以上）按修复任务调度，可以使用全部预算
+)
+
+//已分配的任务，扩散任务和危险文件任务的ID可能相同
+type schedKey struct {
+	id     uint64
+	unsafe bool
+}
+
+type schedTask struct {
+	key      schedKey
+	node     string
+	group    string
+	bytes    uint64
+	deadline int64 //超过后不再计入执行中
+	index    int   //在schedExpiry中的下标
+}
+
+//按deadline排序的执行中任务，refresh只需要处理已经超时的
+type schedExpiry []*schedTask
+
+func (h schedExpiry) Len() int           { return len(h) }
+func (h schedExpiry) Less(i, j int) bool { return h[i].deadline < h[j].deadline }
+func (h schedExpiry) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *schedExpiry) Push(x interface{}) {
+	t := x.(*schedTask)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *schedExpiry) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return t
+}
+
+/*
+	带宽感知的任务调度：按节点汇报的UpSpeed、Upload和p2p_upspeed_limit配置计算节点的可用带宽，
+	记录每个节点执行中的任务字节数和本小时已分配的字节数，以及每个分组本小时已分配的字节数，
+	只在不超出预算时把任务分配给节点。任务按文件大小记账。
+
+	修复优先于普通扩散：普通扩散最多使用节点预算的sched_routine_percent，
+	危险文件任务和优先级不低于SCHED_REPAIR_LEVEL的扩散任务可以使用全部预算。
+	记账只在本进程中，多个协调服务进程时各自按自己分配的任务限制。
+	执行中的任务按key索引，并按节点累计字节数，分配和释放都不需要遍历所有任务。
+*/
+type Scheduler struct {
+	lock         sync.Mutex
+	hour         int64
+	tasks        map[schedKey]*schedTask //执行中的任务
+	expiry       schedExpiry             //执行中的任务，按超时时间排序
+	nodeInflight map[string]uint64       //节点执行中的任务字节数
+	nodeUsed     map[string]uint64       //节点本小时已分配的字节数
+	groupUsed    map[string]uint64       //分组本小时已分配的字节数
+}
+
+//节点的调度状态
+type NodeSchedStat struct {
+	Node          string `json:"node"`
+	Rate          int64  `json:"rate"`           //用于扩散的带宽，字节/秒
+	HourBudget    uint64 `json:"hour_budget"`    //每小时预算
+	HourUsed      uint64 `json:"hour_used"`      //本小时已分配
+	Inflight      uint64 `json:"inflight"`       //执行中的任务字节数
+	InflightLimit uint64 `json:"inflight_limit"` //执行中的任务字节数上限
+}
+
+var scheduler = NewScheduler()
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		tasks:        make(map[schedKey]*schedTask),
+		nodeInflight: make(map[string]uint64),
+		nodeUsed:     make(map[string]uint64),
+		groupUsed:    make(map[string]uint64),
+	}
+}
+
+//读取配置，没有初始化或配置错误时返回默认值
+func getConfigInt64(key string, def int64) int64 {
+	if ConfigMap == nil {
+		return def
+	}
+	v, e := ConfigMap.GetInt64Value(key)
+	if e != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+/*
+	节点用于扩散的带宽：上行带宽减去正在使用的上传速度，不超过p2p_upspeed_limit，再按sched_bandwidth_percent折算。
+	节点没有汇报上行带宽时按p2p_upspeed_limit计算。
+*/
+func nodeRate(detail *NodeDetail) (rate int64) {
+	limit := getConfigInt64(P2P_UPSPEED_LIMIT_KEY, DEFAULT_P2P_UPSPEED_LIMIT)
+	rate = limit
+	if detail.UpSpeed > 0 {
+		rate = detail.UpSpeed - detail.Upload
+		if rate > limit {
+			rate = limit
+		}
+	}
+	if rate < 0 {
+		rate = 0
+	}
+	return rate * getConfigInt64(SCHED_BANDWIDTH_PERCENT_KEY, DEFAULT_SCHED_BANDWIDTH_PERCENT) / 100
+}
+
+//进入新的小时后重新计算预算，并清理超时的任务，需要持有锁
+func (s *Scheduler) refresh() {
+	now := time.Now.Unix()
+	if hour := now / 3600; hour != s.hour {
+		s.hour = hour
+		s.nodeUsed = make(map[string]uint64)
+		s.groupUsed = make(map[string]uint64)
+	}
+	for len(s.expiry) > 0 && s.expiry[0].deadline < now {
+		s.remove(s.expiry[0])
+	}
+}
+
+//任务不再计入执行中，需要持有锁
+func (s *Scheduler) remove(t *schedTask) {
+	heap.Remove(&s.expiry, t.index)
+	delete(s.tasks, t.key)
+	if s.nodeInflight[t.node] -= t.bytes; s.nodeInflight[t.node] == 0 {
+		delete(s.nodeInflight, t.node)
+	}
+}
+
+func (s *Scheduler) inflight(nid string) (bytes uint64) {
+	return s.nodeInflight[nid]
+}
+
+func (s *Scheduler) stat(detail *NodeDetail) (stat NodeSchedStat) {
+	stat.Node = detail.ID
+	stat.Rate = nodeRate(detail)
+	stat.HourBudget = uint64(stat.Rate) * 3600
+	stat.HourUsed = s.nodeUsed[detail.ID]
+	stat.Inflight = s.inflight(detail.ID)
+	stat.InflightLimit = uint64(stat.Rate) * SCHED_INFLIGHT_SEC
+	return
+}
+
+/*
+	分配任务，超出预算时返回false
+
+	参数：
+		key: 已经分配过的任务直接返回true
+		repair: 是否是修复任务，为false时只能使用sched_routine_percent的预算
+*/
+func (s *Scheduler) admit(detail *NodeDetail, key schedKey, gid string, bytes uint64, deadline int64, repair bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refresh()
+	if _, ok := s.tasks[key]; ok {
+		return true
+	}
+	stat := s.stat(detail)
+	percent := uint64(100)
+	if !repair {
+		percent = uint64(getConfigInt64(SCHED_ROUTINE_PERCENT_KEY, DEFAULT_SCHED_ROUTINE_PERCENT))
+	}
+	//空闲的节点至少可以执行一个任务，大文件不会永远分配不出去
+	if stat.Inflight > 0 && (stat.Inflight+bytes)*100 > stat.InflightLimit*percent {
+		return false
+	}
+	if stat.HourUsed > 0 && (stat.HourUsed+bytes)*100 > stat.HourBudget*percent {
+		return false
+	}
+	if limit := uint64(getConfigInt64(SCHED_GROUP_HOUR_BYTES_KEY, DEFAULT_SCHED_GROUP_HOUR_BYTES)); limit > 0 && s.groupUsed[gid] > 0 && s.groupUsed[gid]+bytes > limit {
+		return false
+	}
+	t := &schedTask{key: key, node: detail.ID, group: gid, bytes: bytes, deadline: deadline}
+	s.tasks[key] = t
+	heap.Push(&s.expiry, t)
+	s.nodeInflight[detail.ID] += bytes
+	s.nodeUsed[detail.ID] += bytes
+	s.groupUsed[gid] += bytes
+	return true
+}
+
+//任务结束，不再计入执行中，本小时已分配的字节数不变
+func (s *Scheduler) release(key schedKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if t, ok := s.tasks[key]; ok {
+		s.remove(t)
+	}
+}
+
+//节点当前的调度状态
+func GetNodeSchedStat(nid string) (stat *NodeSchedStat, e error) {
+	source, span := beginSpan(nil, "p2p_storage.GetNodeSchedStat")
+	defer span.SetAttr("nid", nid).End(&e)
+	detail, e := source.Raw.GetNodeDetail(nid)
+	if e != nil || detail == nil {
+		return
+	}
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	scheduler.refresh()
+	st := scheduler.stat(detail)
+	return &st, nil
+}
+
+/*
+	按优先级排序候选任务：优先级高的在前，同优先级时小文件在前，单位带宽完成更多的修复
+*/
+func sortExpandTasks(exNodes []ExpandNode) {
+	sort.SliceStable(exNodes, func(i, j int) bool {
+		if exNodes[i].Level != exNodes[j].Level {
+			return exNodes[i].Level > exNodes[j].Level
+		}
+		return exNodes[i].Size < exNodes[j].Size
+	})
+}
+
+/*
+	从节点的危险文件任务中选出预算内的任务
+
+	参数：
+		tasks: 节点还没有结束的危险文件任务
+*/
+func (ds *DataSource) scheduleUnSafeTasks(nid string, tasks []UnSafeExpandNode) (admitted []UnSafeExpandNode, e error) {
+	detail, e := ds.Raw.GetNodeDetail(nid)
+	if e != nil || detail == nil {
+		return tasks, e
+	}
+	admitted = make([]UnSafeExpandNode, 0, len(tasks))
+	deadline := time.Now.Unix() + SCHED_UNSAFE_TIMEOUT
+	for _, t := range tasks {
+		var size uint64
+		if f, e := ds.Raw.GetGroupFile(t.Group, t.MD5); e == nil && f != nil {
+			size = f.Size
+		}
+		if scheduler.admit(detail, schedKey{t.ID, true}, t.Group, size, deadline, true) {
+			admitted = append(admitted, t)
+		}
+	}
+	return
+}
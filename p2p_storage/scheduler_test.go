@@ -0,0 +1,67 @@
+package p2p_storage_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"yh_pkg/p2p_storage"
+)
+
+//节点可用带宽1KB/s：执行中的任务不超过300KB，普通扩散只能用其中的70%，危险文件修复优先
+func TestScheduler(t *testing.T) {
+	f := newFixture(t)
+	const SIZE = 100 * 1024
+	node := &p2p_storage.Node{Peer: p2p_storage.Peer{ID: "sched"}, TotalSpace: 100 * p2p_storage.GROUP_NODE_CAPACITY, UpSpeed: 2048}
+	f.addNode(node.ID, "")
+	now := time.Now().Unix()
+	for i, level := range []int8{0, 0, 0, 0, 3} {
+		f.ds.AddOrUpdateExpandNode(&p2p_storage.ExpandNode{Group: GID, Node: node.ID, MD5: fmt.Sprintf("md5-%d", i),
+			State: p2p_storage.EXPAND_STATE_INIT, Tm: now, Timeout: now + 3600, Size: SIZE, Level: level})
+	}
+	fetch := func() (md5s []string) {
+		_, exNodes, _, e := p2p_storage.UpdateNode2(node, nil, nil, p2p_storage.YES)
+		if e != nil {
+			t.Fatal(e)
+		}
+		for _, exNode := range exNodes {
+			md5s = append(md5s, exNode.MD5)
+		}
+		return
+	}
+	if got := fmt.Sprint(fetch()); got != "[md5-4 md5-0]" {
+		t.Fatalf("first fetch = %s", got)
+	}
+	if stat, e := p2p_storage.GetNodeSchedStat(node.ID); e != nil || stat.Rate != 1024 || stat.Inflight != 2*SIZE {
+		t.Errorf("stat = %+v %v", stat, e)
+	}
+
+	//普通扩散超出预算时危险文件修复仍然可以分配
+	unsafeMD5 := "0123456789abcdef0123456789abcdef"
+	f.ds.AddFileToGroup(GID, &p2p_storage.GroupFile{File: p2p_storage.File{MD5: unsafeMD5, Size: SIZE}, State: p2p_storage.NORMAL})
+	if e := p2p_storage.AddOrUpdateUnSafeExpandNode(GID, unsafeMD5, []p2p_storage.GroupNode{{Node: node.ID}}); e != nil {
+		t.Fatal(e)
+	}
+	unsafe, e := p2p_storage.GetUnSafeExpandTasks(node.ID, p2p_storage.UNSAFE_EXPAND_STATE_INIT, 10)
+	if e != nil || len(unsafe) != 1 {
+		t.Fatalf("unsafe tasks = %v %v", unsafe, e)
+	}
+
+	//任务结束后释放预算
+	exNodes, _ := f.ds.GetExpandTasks(node.ID, p2p_storage.EXPAND_STATE_NOTIFIED, 10)
+	for _, exNode := range exNodes {
+		if exNode.MD5 == "md5-4" {
+			if e = p2p_storage.ExpandFinished(exNode.ID, int8(p2p_storage.YES)); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+	if got := fetch(); len(got) != 0 {
+		t.Errorf("fetch while unsafe task running = %v", got)
+	}
+	if e = p2p_storage.UnSafeExpandFinished(unsafe[0].ID, p2p_storage.YES); e != nil {
+		t.Fatal(e)
+	}
+	if got := fmt.Sprint(fetch()); got != "[md5-1]" {
+		t.Errorf("fetch after finished = %s", got)
+	}
+}
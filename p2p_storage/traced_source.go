@@ -0,0 +1,588 @@
+package p2p_storage
+
+import (
+	"yh_pkg/trace"
+)
+
+/*
+	追踪IDataSource的每次调用，Init时自动包装数据源，span名为"IDataSource.方法名"，父span为span。
+	没有设置trace的Exporter时每次调用只多一次原子读取。
+	IDataSource增加方法时需要同时在这里增加，没有增加的方法不追踪。
+*/
+type tracedSource struct {
+	IDataSource
+	span *trace.Span //调用所在接口的span，nil时每次调用是新的trace
+}
+
+/*
+	以调用方的span为父span调用接口，接口和接口中IDataSource调用的span与调用方属于同一个trace：
+		p2p_storage.WithSpan(trace.FromContext(req.GetRequest().Context())).GetGroupDurability(gid)
+	包中的同名函数相当于WithSpan(nil)，开始新的trace。
+	节点接口调用的和接口之间调用的函数都有对应的方法，其它接口的span没有父span。
+*/
+type Caller struct {
+	parent *trace.Span
+}
+
+func WithSpan(parent *trace.Span) Caller {
+	return Caller{parent}
+}
+
+/*
+	开始接口的span
+
+	参数：
+		parent: 调用方的span，nil时开始新的trace
+	返回值：
+		ds: IDataSource调用的span以s为父span的数据源，没有设置Exporter时为dataSource
+*/
+func beginSpan(parent *trace.Span, name string) (ds *DataSource, s *trace.Span) {
+	if s = parent.Child(name); s == nil {
+		return dataSource, nil
+	}
+	raw := dataSource.Raw
+	if t, ok := raw.(*tracedSource); ok {
+		raw = t.IDataSource
+	}
+	return newDataSource(&tracedSource{raw, s}), s
+}
+
+func (t *tracedSource) AtomicIncrID(key string) (id uint64, e error) {
+	defer t.span.Child("IDataSource.AtomicIncrID").End(&e)
+	return t.IDataSource.AtomicIncrID(key)
+}
+
+func (t *tracedSource) GetIncrID(key string) (id uint64, e error) {
+	defer t.span.Child("IDataSource.GetIncrID").End(&e)
+	return t.IDataSource.GetIncrID(key)
+}
+
+func (t *tracedSource) GetTimeoutNodeCheckedTime() (tm int64, e error) {
+	defer t.span.Child("IDataSource.GetTimeoutNodeCheckedTime").End(&e)
+	return t.IDataSource.GetTimeoutNodeCheckedTime()
+}
+
+func (t *tracedSource) UpdateTimeoutNodeCheckedTime(tm int64) (e error) {
+	defer t.span.Child("IDataSource.UpdateTimeoutNodeCheckedTime").End(&e)
+	return t.IDataSource.UpdateTimeoutNodeCheckedTime(tm)
+}
+
+func (t *tracedSource) GetFileGroups(md5 string, state int) (files map[string]GroupFile, e error) {
+	defer t.span.Child("IDataSource.GetFileGroups").SetAttr("md5", md5).End(&e)
+	return t.IDataSource.GetFileGroups(md5, state)
+}
+
+func (t *tracedSource) GetNewAddTimeOutGroupFile(tm int64, num int) (files []GroupFile, e error) {
+	defer t.span.Child("IDataSource.GetNewAddTimeOutGroupFile").End(&e)
+	return t.IDataSource.GetNewAddTimeOutGroupFile(tm, num)
+}
+
+func (t *tracedSource) GetSourceFileNodes(md5 string, num int) (ids []string, e error) {
+	defer t.span.Child("IDataSource.GetSourceFileNodes").SetAttr("md5", md5).End(&e)
+	return t.IDataSource.GetSourceFileNodes(md5, num)
+}
+
+func (t *tracedSource) IsNodeHasFile(nid string, md5 string) (yes bool, e error) {
+	defer t.span.Child("IDataSource.IsNodeHasFile").SetAttr("md5", md5).SetAttr("nid", nid).End(&e)
+	return t.IDataSource.IsNodeHasFile(nid, md5)
+}
+
+func (t *tracedSource) GetSourceFileCount(md5 string) (count int, e error) {
+	defer t.span.Child("IDataSource.GetSourceFileCount").SetAttr("md5", md5).End(&e)
+	return t.IDataSource.GetSourceFileCount(md5)
+}
+
+func (t *tracedSource) GetOnlinePeers(ids []string, timeout int64) (peers []Peer, e error) {
+	defer t.span.Child("IDataSource.GetOnlinePeers").End(&e)
+	return t.IDataSource.GetOnlinePeers(ids, timeout)
+}
+
+func (t *tracedSource) GetFileByMd5AndState(md5 string, state int) (files []GroupFile, e error) {
+	defer t.span.Child("IDataSource.GetFileByMd5AndState").SetAttr("md5", md5).End(&e)
+	return t.IDataSource.GetFileByMd5AndState(md5, state)
+}
+
+func (t *tracedSource) GetGroupFile(gid, md5 string) (file *GroupFile, e error) {
+	defer t.span.Child("IDataSource.GetGroupFile").SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetGroupFile(gid, md5)
+}
+
+func (t *tracedSource) ListUpdatedFiles(gid string, ver uint64, num int, tp int) (files []GroupFile, e error) {
+	defer t.span.Child("IDataSource.ListUpdatedFiles").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.ListUpdatedFiles(gid, ver, num, tp)
+}
+
+func (t *tracedSource) CalculateGroupSize(gid string) (e error) {
+	defer t.span.Child("IDataSource.CalculateGroupSize").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.CalculateGroupSize(gid)
+}
+
+func (t *tracedSource) GetFileGroupsCount(md5 string) (count int, e error) {
+	defer t.span.Child("IDataSource.GetFileGroupsCount").SetAttr("md5", md5).End(&e)
+	return t.IDataSource.GetFileGroupsCount(md5)
+}
+
+func (t *tracedSource) GetMoreFileGroupsCount(md5s []string) (m map[string]bool, e error) {
+	defer t.span.Child("IDataSource.GetMoreFileGroupsCount").End(&e)
+	return t.IDataSource.GetMoreFileGroupsCount(md5s)
+}
+
+func (t *tracedSource) AddFileToGroup(gid string, file *GroupFile) (e error) {
+	defer t.span.Child("IDataSource.AddFileToGroup").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.AddFileToGroup(gid, file)
+}
+
+func (t *tracedSource) UpdateGroupFile(gid string, file *GroupFile) (e error) {
+	defer t.span.Child("IDataSource.UpdateGroupFile").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.UpdateGroupFile(gid, file)
+}
+
+func (t *tracedSource) UpdateGroupFileTpAndVer(gid, md5 string, ver uint64) (e error) {
+	defer t.span.Child("IDataSource.UpdateGroupFileTpAndVer").SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	return t.IDataSource.UpdateGroupFileTpAndVer(gid, md5, ver)
+}
+
+func (t *tracedSource) DeleteGroupFile(gid string, md5 string) (e error) {
+	defer t.span.Child("IDataSource.DeleteGroupFile").SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	return t.IDataSource.DeleteGroupFile(gid, md5)
+}
+
+func (t *tracedSource) IncrFileVer(gid string, md5 string, ver uint64) (e error) {
+	defer t.span.Child("IDataSource.IncrFileVer").SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	return t.IDataSource.IncrFileVer(gid, md5, ver)
+}
+
+func (t *tracedSource) GetTimeoutNodes(from int64, to int64, num int) (nodes []NodeDetail, e error) {
+	defer t.span.Child("IDataSource.GetTimeoutNodes").End(&e)
+	return t.IDataSource.GetTimeoutNodes(from, to, num)
+}
+
+func (t *tracedSource) AddNode(node *NodeDetail) (e error) {
+	defer t.span.Child("IDataSource.AddNode").End(&e)
+	return t.IDataSource.AddNode(node)
+}
+
+func (t *tracedSource) DeleteNode(id string) (e error) {
+	defer t.span.Child("IDataSource.DeleteNode").SetAttr("id", id).End(&e)
+	return t.IDataSource.DeleteNode(id)
+}
+
+func (t *tracedSource) IsNodeExist(nid string) (exist bool, e error) {
+	defer t.span.Child("IDataSource.IsNodeExist").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.IsNodeExist(nid)
+}
+
+func (t *tracedSource) UpdateNode(node *NodeDetail) (e error) {
+	defer t.span.Child("IDataSource.UpdateNode").End(&e)
+	return t.IDataSource.UpdateNode(node)
+}
+
+func (t *tracedSource) UpdateNodeWeight(nid string, weight float64) (e error) {
+	defer t.span.Child("IDataSource.UpdateNodeWeight").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.UpdateNodeWeight(nid, weight)
+}
+
+func (t *tracedSource) GetAvailableNodes(groupCapacity uint64, updateTm, regTm int64, offset, num uint32, active_groups int8, online_cnt int) (nodes []string, e error) {
+	defer t.span.Child("IDataSource.GetAvailableNodes").End(&e)
+	return t.IDataSource.GetAvailableNodes(groupCapacity, updateTm, regTm, offset, num, active_groups, online_cnt)
+}
+
+func (t *tracedSource) GetAvailableNodesCount(groupCapacity uint64, updateTm, regTm int64, activ_groups int8, online_cnt int) (num uint32, e error) {
+	defer t.span.Child("IDataSource.GetAvailableNodesCount").End(&e)
+	return t.IDataSource.GetAvailableNodesCount(groupCapacity, updateTm, regTm, activ_groups, online_cnt)
+}
+
+func (t *tracedSource) GetAvailableNode(groupCapacity uint64, updateTm, regTm int64, online_cnt, num int) (nodes []string, e error) {
+	defer t.span.Child("IDataSource.GetAvailableNode").End(&e)
+	return t.IDataSource.GetAvailableNode(groupCapacity, updateTm, regTm, online_cnt, num)
+}
+
+func (t *tracedSource) GetAvailableGroup(fileSize uint32) (group *Group, e error) {
+	defer t.span.Child("IDataSource.GetAvailableGroup").End(&e)
+	return t.IDataSource.GetAvailableGroup(fileSize)
+}
+
+func (t *tracedSource) GetGroup(gid string) (group *Group, e error) {
+	defer t.span.Child("IDataSource.GetGroup").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetGroup(gid)
+}
+
+func (t *tracedSource) GetAllGroup() (groups map[string]Group, e error) {
+	defer t.span.Child("IDataSource.GetAllGroup").End(&e)
+	return t.IDataSource.GetAllGroup()
+}
+
+func (t *tracedSource) AddGroup(group *Group) (e error) {
+	defer t.span.Child("IDataSource.AddGroup").End(&e)
+	return t.IDataSource.AddGroup(group)
+}
+
+func (t *tracedSource) UpdateGroupSize(group *Group, filesize int64) (e error) {
+	defer t.span.Child("IDataSource.UpdateGroupSize").End(&e)
+	return t.IDataSource.UpdateGroupSize(group, filesize)
+}
+
+func (t *tracedSource) GetActiveGroupsCount(groupCapacity uint64) (groups map[uint32]uint32, e error) {
+	defer t.span.Child("IDataSource.GetActiveGroupsCount").End(&e)
+	return t.IDataSource.GetActiveGroupsCount(groupCapacity)
+}
+
+func (t *tracedSource) GetActiveGroupsLeftSpace(groupCapacity uint64) (groups map[uint32]uint64, e error) {
+	defer t.span.Child("IDataSource.GetActiveGroupsLeftSpace").End(&e)
+	return t.IDataSource.GetActiveGroupsLeftSpace(groupCapacity)
+}
+
+func (t *tracedSource) AddNodeToGroup(gid string, node *GroupNode) (e error) {
+	defer t.span.Child("IDataSource.AddNodeToGroup").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.AddNodeToGroup(gid, node)
+}
+
+func (t *tracedSource) UpdateGroupNode(gid string, node *GroupNode, isVerChange bool) (e error) {
+	defer t.span.Child("IDataSource.UpdateGroupNode").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.UpdateGroupNode(gid, node, isVerChange)
+}
+
+func (t *tracedSource) DeleteGroupNode(gid, nid string) (e error) {
+	defer t.span.Child("IDataSource.DeleteGroupNode").SetAttr("gid", gid).SetAttr("nid", nid).End(&e)
+	return t.IDataSource.DeleteGroupNode(gid, nid)
+}
+
+func (t *tracedSource) GetFileNodes(gid string, ver uint64) (nodes []Peer, e error) {
+	defer t.span.Child("IDataSource.GetFileNodes").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetFileNodes(gid, ver)
+}
+
+func (t *tracedSource) GetNoFileNodes(gid string, ver uint64) (nodes []string, e error) {
+	defer t.span.Child("IDataSource.GetNoFileNodes").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetNoFileNodes(gid, ver)
+}
+
+func (t *tracedSource) GetAllFileNodes(gid string) (nodes []string, e error) {
+	defer t.span.Child("IDataSource.GetAllFileNodes").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetAllFileNodes(gid)
+}
+
+func (t *tracedSource) GetGroupNodes(gid string) (nodes []GroupNode, e error) {
+	defer t.span.Child("IDataSource.GetGroupNodes").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetGroupNodes(gid)
+}
+
+func (t *tracedSource) GetRandomGroupNode(gid string) (node *GroupNode, e error) {
+	defer t.span.Child("IDataSource.GetRandomGroupNode").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetRandomGroupNode(gid)
+}
+
+func (t *tracedSource) GetNodeDetail(nid string) (detail *NodeDetail, e error) {
+	defer t.span.Child("IDataSource.GetNodeDetail").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.GetNodeDetail(nid)
+}
+
+func (t *tracedSource) GetNodeGroups(nid string) (groups []Group, e error) {
+	defer t.span.Child("IDataSource.GetNodeGroups").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.GetNodeGroups(nid)
+}
+
+func (t *tracedSource) GetRandomNodeGroup(nid string) (group Group, e error) {
+	defer t.span.Child("IDataSource.GetRandomNodeGroup").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.GetRandomNodeGroup(nid)
+}
+
+func (t *tracedSource) GetNodeGroupCount(nid string) (num uint32, e error) {
+	defer t.span.Child("IDataSource.GetNodeGroupCount").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.GetNodeGroupCount(nid)
+}
+
+func (t *tracedSource) GetNodeGroupDetail(nid string) (groups []NodeGroupDetail, e error) {
+	defer t.span.Child("IDataSource.GetNodeGroupDetail").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.GetNodeGroupDetail(nid)
+}
+
+func (t *tracedSource) GetNodeGroupState(nid string) (groups map[string]GroupNode, e error) {
+	defer t.span.Child("IDataSource.GetNodeGroupState").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.GetNodeGroupState(nid)
+}
+
+func (t *tracedSource) GetGroupOnlineNodesCount(gid string) (num uint32, e error) {
+	defer t.span.Child("IDataSource.GetGroupOnlineNodesCount").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetGroupOnlineNodesCount(gid)
+}
+
+func (t *tracedSource) GetUPNPAvailableNodes(num int, updateTm int64) (nodes []Peer, e error) {
+	defer t.span.Child("IDataSource.GetUPNPAvailableNodes").End(&e)
+	return t.IDataSource.GetUPNPAvailableNodes(num, updateTm)
+}
+
+func (t *tracedSource) AddToInvalidFile(nid, gid, md5 string, tm int64) (e error) {
+	defer t.span.Child("IDataSource.AddToInvalidFile").SetAttr("md5", md5).SetAttr("gid", gid).SetAttr("nid", nid).End(&e)
+	return t.IDataSource.AddToInvalidFile(nid, gid, md5, tm)
+}
+
+func (t *tracedSource) UpdateChecksum(md5, checksum string) (e error) {
+	defer t.span.Child("IDataSource.UpdateChecksum").SetAttr("md5", md5).End(&e)
+	return t.IDataSource.UpdateChecksum(md5, checksum)
+}
+
+func (t *tracedSource) GetChecksum(md5 string) (checksum string, e error) {
+	defer t.span.Child("IDataSource.GetChecksum").SetAttr("md5", md5).End(&e)
+	return t.IDataSource.GetChecksum(md5)
+}
+
+func (t *tracedSource) IncrementActiveGroups(nid string) (e error) {
+	defer t.span.Child("IDataSource.IncrementActiveGroups").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.IncrementActiveGroups(nid)
+}
+
+func (t *tracedSource) GetValidExpandNodes(gid, md5 string) (exNodes []ExpandNode, e error) {
+	defer t.span.Child("IDataSource.GetValidExpandNodes").SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetValidExpandNodes(gid, md5)
+}
+
+func (t *tracedSource) GetExpandNode(gid, nid, md5 string) (exNode *ExpandNode, e error) {
+	defer t.span.Child("IDataSource.GetExpandNode").SetAttr("md5", md5).SetAttr("gid", gid).SetAttr("nid", nid).End(&e)
+	return t.IDataSource.GetExpandNode(gid, nid, md5)
+}
+
+func (t *tracedSource) GetExpandNodeById(id uint64) (exNode *ExpandNode, e error) {
+	defer t.span.Child("IDataSource.GetExpandNodeById").SetAttr("id", id).End(&e)
+	return t.IDataSource.GetExpandNodeById(id)
+}
+
+func (t *tracedSource) GetExpandTasks(nid string, state int8, num int) (exNodes []ExpandNode, e error) {
+	defer t.span.Child("IDataSource.GetExpandTasks").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.GetExpandTasks(nid, state, num)
+}
+
+func (t *tracedSource) AddOrUpdateExpandNode(exNode *ExpandNode) (task_id int64, e error) {
+	defer t.span.Child("IDataSource.AddOrUpdateExpandNode").End(&e)
+	return t.IDataSource.AddOrUpdateExpandNode(exNode)
+}
+
+func (t *tracedSource) UpdateExpandNodeState(gid, nid, md5 string, state int8, timouet int64, increment_failed_times bool) (e error) {
+	defer t.span.Child("IDataSource.UpdateExpandNodeState").SetAttr("md5", md5).SetAttr("gid", gid).SetAttr("nid", nid).End(&e)
+	return t.IDataSource.UpdateExpandNodeState(gid, nid, md5, state, timouet, increment_failed_times)
+}
+
+func (t *tracedSource) UpdateExpandNodesState(nid string, state int8, timouet int64) (e error) {
+	defer t.span.Child("IDataSource.UpdateExpandNodesState").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.UpdateExpandNodesState(nid, state, timouet)
+}
+
+func (t *tracedSource) UpdateExpandNodeTimeout(id uint64, timouet int64) (e error) {
+	defer t.span.Child("IDataSource.UpdateExpandNodeTimeout").SetAttr("id", id).End(&e)
+	return t.IDataSource.UpdateExpandNodeTimeout(id, timouet)
+}
+
+func (t *tracedSource) DeleteExpandNode(gid, nid, md5 string) (e error) {
+	defer t.span.Child("IDataSource.DeleteExpandNode").SetAttr("md5", md5).SetAttr("gid", gid).SetAttr("nid", nid).End(&e)
+	return t.IDataSource.DeleteExpandNode(gid, nid, md5)
+}
+
+func (t *tracedSource) GetExpandTaskTotalFailedTimes(gid, md5 string) (times uint32, e error) {
+	defer t.span.Child("IDataSource.GetExpandTaskTotalFailedTimes").SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetExpandTaskTotalFailedTimes(gid, md5)
+}
+
+func (t *tracedSource) GetExpandTaskCount(node string) (cnt uint32, e error) {
+	defer t.span.Child("IDataSource.GetExpandTaskCount").End(&e)
+	return t.IDataSource.GetExpandTaskCount(node)
+}
+
+func (t *tracedSource) GetTimeoutExpandTaskCheckedTime() (tm, id int64, e error) {
+	defer t.span.Child("IDataSource.GetTimeoutExpandTaskCheckedTime").End(&e)
+	return t.IDataSource.GetTimeoutExpandTaskCheckedTime()
+}
+
+func (t *tracedSource) UpdateTimeoutExpandTaskCheckedTime(tm, id int64) (e error) {
+	defer t.span.Child("IDataSource.UpdateTimeoutExpandTaskCheckedTime").SetAttr("id", id).End(&e)
+	return t.IDataSource.UpdateTimeoutExpandTaskCheckedTime(tm, id)
+}
+
+func (t *tracedSource) GetTimeoutExpandTask(from int64, to int64, lastId int64, num int) (nodes []ExpandNode, e error) {
+	defer t.span.Child("IDataSource.GetTimeoutExpandTask").End(&e)
+	return t.IDataSource.GetTimeoutExpandTask(from, to, lastId, num)
+}
+
+func (t *tracedSource) GetNodesByIds(ids []string) (nodes []NodeDetail, e error) {
+	defer t.span.Child("IDataSource.GetNodesByIds").End(&e)
+	return t.IDataSource.GetNodesByIds(ids)
+}
+
+func (t *tracedSource) AddTaskNode(task_id uint64, nids []string) (e error) {
+	defer t.span.Child("IDataSource.AddTaskNode").End(&e)
+	return t.IDataSource.AddTaskNode(task_id, nids)
+}
+
+func (t *tracedSource) DeleteTaskNodeByTask(id uint64) (e error) {
+	defer t.span.Child("IDataSource.DeleteTaskNodeByTask").SetAttr("id", id).End(&e)
+	return t.IDataSource.DeleteTaskNodeByTask(id)
+}
+
+func (t *tracedSource) DeleteExpandNodeById(id uint64) (e error) {
+	defer t.span.Child("IDataSource.DeleteExpandNodeById").SetAttr("id", id).End(&e)
+	return t.IDataSource.DeleteExpandNodeById(id)
+}
+
+func (t *tracedSource) DeleteExpandNodeByMd5(md5 string) (e error) {
+	defer t.span.Child("IDataSource.DeleteExpandNodeByMd5").SetAttr("md5", md5).End(&e)
+	return t.IDataSource.DeleteExpandNodeByMd5(md5)
+}
+
+func (t *tracedSource) DeleteExpandNodeByTimeOut(tm uint64) (e error) {
+	defer t.span.Child("IDataSource.DeleteExpandNodeByTimeOut").End(&e)
+	return t.IDataSource.DeleteExpandNodeByTimeOut(tm)
+}
+
+func (t *tracedSource) GetGroupFileVer(gid, nid string) (ver uint64, e error) {
+	defer t.span.Child("IDataSource.GetGroupFileVer").SetAttr("gid", gid).SetAttr("nid", nid).End(&e)
+	return t.IDataSource.GetGroupFileVer(gid, nid)
+}
+
+func (t *tracedSource) GetGroupFileByVer(gid, nid string, ver uint64, num int) (files []GroupFile, e error) {
+	defer t.span.Child("IDataSource.GetGroupFileByVer").SetAttr("gid", gid).SetAttr("nid", nid).End(&e)
+	return t.IDataSource.GetGroupFileByVer(gid, nid, ver, num)
+}
+
+func (t *tracedSource) GetFileNodesCountByVer(gid string, ver uint64) (cnt uint32, e error) {
+	defer t.span.Child("IDataSource.GetFileNodesCountByVer").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetFileNodesCountByVer(gid, ver)
+}
+
+func (t *tracedSource) GetCanDelTimeoutNodes(tm uint64, num int) (nodes []string, e error) {
+	defer t.span.Child("IDataSource.GetCanDelTimeoutNodes").End(&e)
+	return t.IDataSource.GetCanDelTimeoutNodes(tm, num)
+}
+
+func (t *tracedSource) CheckIsFinishFirstExpand(gid string, ver uint64) (finish bool, e error) {
+	defer t.span.Child("IDataSource.CheckIsFinishFirstExpand").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.CheckIsFinishFirstExpand(gid, ver)
+}
+
+func (t *tracedSource) GetNodeCountByVerAndState(gid string, ver uint64, state int) (num uint32, e error) {
+	defer t.span.Child("IDataSource.GetNodeCountByVerAndState").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetNodeCountByVerAndState(gid, ver, state)
+}
+
+func (t *tracedSource) GetAtomicLastCheckerTm(key string) (tm int64, e error) {
+	defer t.span.Child("IDataSource.GetAtomicLastCheckerTm").End(&e)
+	return t.IDataSource.GetAtomicLastCheckerTm(key)
+}
+
+func (t *tracedSource) SetAtomicGetLastCheckerTm(key string, tm int64, expire_second int) (e error) {
+	defer t.span.Child("IDataSource.SetAtomicGetLastCheckerTm").End(&e)
+	return t.IDataSource.SetAtomicGetLastCheckerTm(key, tm, expire_second)
+}
+
+func (t *tracedSource) UpdateGroupFirstFinishVer(gid string, ver uint64) (e error) {
+	defer t.span.Child("IDataSource.UpdateGroupFirstFinishVer").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.UpdateGroupFirstFinishVer(gid, ver)
+}
+
+func (t *tracedSource) GetGroupFirstFinishExpandVer(gid string) (finish_ver uint64, e error) {
+	defer t.span.Child("IDataSource.GetGroupFirstFinishExpandVer").SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetGroupFirstFinishExpandVer(gid)
+}
+
+func (t *tracedSource) GetNodeOnlineTm(nids []string) (node_online_map map[string]int, e error) {
+	defer t.span.Child("IDataSource.GetNodeOnlineTm").End(&e)
+	return t.IDataSource.GetNodeOnlineTm(nids)
+}
+
+func (t *tracedSource) GetAllNode(begin string) (nodes []string, e error) {
+	defer t.span.Child("IDataSource.GetAllNode").End(&e)
+	return t.IDataSource.GetAllNode(begin)
+}
+
+func (t *tracedSource) UpdateNodeOnlineCnt(nodeMap map[string]int) (e error) {
+	defer t.span.Child("IDataSource.UpdateNodeOnlineCnt").End(&e)
+	return t.IDataSource.UpdateNodeOnlineCnt(nodeMap)
+}
+
+func (t *tracedSource) GetUnSafeExpandTasks(nid string, state int8, num int) (exNodes []UnSafeExpandNode, e error) {
+	defer t.span.Child("IDataSource.GetUnSafeExpandTasks").SetAttr("nid", nid).End(&e)
+	return t.IDataSource.GetUnSafeExpandTasks(nid, state, num)
+}
+
+func (t *tracedSource) UpdateUnSafeExpandNodeState(id uint64, state int) (e error) {
+	defer t.span.Child("IDataSource.UpdateUnSafeExpandNodeState").SetAttr("id", id).End(&e)
+	return t.IDataSource.UpdateUnSafeExpandNodeState(id, state)
+}
+
+func (t *tracedSource) GetUnSafeExpandNodeById(id uint64) (exNode *UnSafeExpandNode, e error) {
+	defer t.span.Child("IDataSource.GetUnSafeExpandNodeById").SetAttr("id", id).End(&e)
+	return t.IDataSource.GetUnSafeExpandNodeById(id)
+}
+
+func (t *tracedSource) AddOrUpdateUnSafeFile(gid, md5 string) (e error) {
+	defer t.span.Child("IDataSource.AddOrUpdateUnSafeFile").SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	return t.IDataSource.AddOrUpdateUnSafeFile(gid, md5)
+}
+
+func (t *tracedSource) AddOrUpdateUnSafeExpandNodes(exNodes []UnSafeExpandNode) (e error) {
+	defer t.span.Child("IDataSource.AddOrUpdateUnSafeExpandNodes").End(&e)
+	return t.IDataSource.AddOrUpdateUnSafeExpandNodes(exNodes)
+}
+
+func (t *tracedSource) DeleteUnSafeFile(gid, md5 string) (e error) {
+	defer t.span.Child("IDataSource.DeleteUnSafeFile").SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	return t.IDataSource.DeleteUnSafeFile(gid, md5)
+}
+
+func (t *tracedSource) DeleteUnSafeFileExpandNode(gid, node, md5 string) (e error) {
+	defer t.span.Child("IDataSource.DeleteUnSafeFileExpandNode").SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	return t.IDataSource.DeleteUnSafeFileExpandNode(gid, node, md5)
+}
+
+func (t *tracedSource) GetUnSafeFileExpandNode() (exNodes []UnSafeExpandNode, e error) {
+	defer t.span.Child("IDataSource.GetUnSafeFileExpandNode").End(&e)
+	return t.IDataSource.GetUnSafeFileExpandNode()
+}
+
+func (t *tracedSource) GetHasUnSafeFileNode(gid, md5 string, num uint32, ex_nids []string) (nids []string, e error) {
+	defer t.span.Child("IDataSource.GetHasUnSafeFileNode").SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	return t.IDataSource.GetHasUnSafeFileNode(gid, md5, num, ex_nids)
+}
+
+func (t *tracedSource) UpdateGroupFileStateAndAddVer(gid string, md5 string, state int, add_ver uint64) (e error) {
+	defer t.span.Child("IDataSource.UpdateGroupFileStateAndAddVer").SetAttr("md5", md5).SetAttr("gid", gid).End(&e)
+	return t.IDataSource.UpdateGroupFileStateAndAddVer(gid, md5, state, add_ver)
+}
+
+func (t *tracedSource) GetGroupNodeCountByState(state int) (countMap map[string]int, e error) {
+	defer t.span.Child("IDataSource.GetGroupNodeCountByState").End(&e)
+	return t.IDataSource.GetGroupNodeCountByState(state)
+}
+
+func (t *tracedSource) GetMapFromConfig(configMap map[interface{}]interface{}) (e error) {
+	defer t.span.Child("IDataSource.GetMapFromConfig").End(&e)
+	return t.IDataSource.GetMapFromConfig(configMap)
+}
+
+func (t *tracedSource) GetNodesAGZero(groupCapacity uint64, updateTm, regTm int64, active_groups int8, online_cnt int) (nodes map[string]bool, e error) {
+	defer t.span.Child("IDataSource.GetNodesAGZero").End(&e)
+	return t.IDataSource.GetNodesAGZero(groupCapacity, updateTm, regTm, active_groups, online_cnt)
+}
+
+func (t *tracedSource) GetNewNodes(groupCapacity uint64, updateTm, regTm int64, online_cnt int) (nodes map[string]bool, e error) {
+	defer t.span.Child("IDataSource.GetNewNodes").End(&e)
+	return t.IDataSource.GetNewNodes(groupCapacity, updateTm, regTm, online_cnt)
+}
+
+func (t *tracedSource) GetGroupNodesTaskProcessSlow(nowTm int64) (groupNodesMap map[string]GroupNode, e error) {
+	defer t.span.Child("IDataSource.GetGroupNodesTaskProcessSlow").End(&e)
+	return t.IDataSource.GetGroupNodesTaskProcessSlow(nowTm)
+}
+
+func (t *tracedSource) SetExpandNodeStateFailed(node string) (e error) {
+	defer t.span.Child("IDataSource.SetExpandNodeStateFailed").End(&e)
+	return t.IDataSource.SetExpandNodeStateFailed(node)
+}
+
+func (t *tracedSource) GetLock(db int, key string, expireSec int64, timeout int64) (getLock bool) {
+	defer t.span.Child("IDataSource.GetLock").End(nil)
+	return t.IDataSource.GetLock(db, key, expireSec, timeout)
+}
+
+func (t *tracedSource) UnLock(db int, key string) (e error) {
+	defer t.span.Child("IDataSource.UnLock").End(&e)
+	return t.IDataSource.UnLock(db, key)
+}
@@ -0,0 +1,49 @@
+package p2p_storage_test
+
+import (
+	"testing"
+	"yh_pkg/p2p_storage"
+	"yh_pkg/trace"
+)
+
+//接口的span以WithSpan传入的span为父span，接口之间的调用和IDataSource的调用都属于接口的span
+func TestTracedSource(t *testing.T) {
+	f := newFixture(t)
+	f.setAvailable()
+	f.addFile("0123456789abcdef0123456789abcdef", nil)
+	r := &trace.Recorder{}
+	trace.SetExporter(r)
+	defer trace.SetExporter(nil)
+
+	root := trace.Begin("request")
+	if _, e := p2p_storage.WithSpan(root).GetFileDurability("0123456789abcdef0123456789abcdef"); e != nil {
+		t.Fatal(e)
+	}
+	root.End(nil)
+	if _, e := p2p_storage.GetGroupDurability(GID); e != nil {
+		t.Fatal(e)
+	}
+	trace.SetExporter(nil)
+
+	spans := r.Spans()
+	find := func(name, parent string) *trace.Span {
+		for _, s := range spans {
+			if s.Name == name && s.ParentID == parent {
+				return s
+			}
+		}
+		t.Fatalf("span %s with parent %s not found", name, parent)
+		return nil
+	}
+	api := find("p2p_storage.GetFileDurability", root.SpanID)
+	find("p2p_storage.ResolveFileKey", api.SpanID)
+	find("IDataSource.GetFileByMd5AndState", api.SpanID)
+	//groupDurability中的调用
+	find("IDataSource.GetGroupNodes", api.SpanID)
+
+	//没有父span时开始新的trace
+	api = find("p2p_storage.GetGroupDurability", "")
+	if ds := find("IDataSource.GetGroup", api.SpanID); ds.TraceID != api.TraceID || api.TraceID == root.TraceID {
+		t.Errorf("api span %+v, data source span %+v", api, ds)
+	}
+}
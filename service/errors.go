@@ -72,6 +72,20 @@ const (
 	ERR_P2P_FILE_NOT_FOUND        = 300001 //文件不存在
 	ERR_P2P_TASK_OTHER_NODE_DOING = 300002 //任务其他节点正在完成
 	ERR_P2P_FILE_ALREADY_EXIST    = 300003 // 文件已经添加了
+	ERR_P2P_NODE_AUTH_FAILED      = 300004 //节点签名校验失败
+	ERR_P2P_NODE_KEY_EXIST        = 300005 //节点已登记了其他公钥
+	ERR_P2P_QUOTA_EXCEEDED        = 300006 //超出租户配额
+	ERR_P2P_FILE_REFERENCED       = 300007 //文件还被其他对象引用
+	ERR_P2P_FILE_RETAINED         = 300008 //文件在保留期内，不能删除
+	ERR_P2P_EXPAND_STATE_INVALID  = 300009 //扩散任务状态转换不合法
+	ERR_P2P_EXPAND_RETRY_EXCEEDED = 300010 //扩散任务失败次数超过上限
+	ERR_P2P_FILE_ID_CONFLICT      = 300011 //文件ID或md5已经对应其他文件
+	ERR_P2P_RELAY_TOKEN_INVALID   = 300012 //转发令牌无效或已过期
+	ERR_P2P_NO_CAPACITY           = 300013 //没有空间存放新文件
+	ERR_P2P_CAPACITY_RETRY        = 300014 //暂时没有空间，稍后重试
+	ERR_P2P_REDIRECT_COLD         = 300015 //没有空间，文件改为上传到冷存储
+	ERR_P2P_INGEST_QUEUED         = 300016 //分组未就绪，文件已进入延迟添加队列
+	ERR_P2P_PIECE_TOKEN_INVALID   = 300017 //推送碎片的令牌无效或已过期
 
 	//oss 相关错误码
 	ERR_OSS_FILE_DELETE    = 200001 // 文件被删除
@@ -19,6 +19,7 @@ import (
 	"reflect"
 	"strings"
 	"time"
+	"yh_pkg/trace"
 
 	"github.com/jiatower/go_lib/log"
 )
@@ -136,10 +137,25 @@ func (server *Server) writeBack(r *http.Request, w http.ResponseWriter, reqBody
 
 }
 
+/*
+	开始处理请求的span，父span从请求头trace.HEADER中取出，并放入请求的context，
+	模块方法中可以用trace.FromContext(req.GetRequest().Context())取得，作为子span的父span
+*/
+func startSpan(r *http.Request) (*http.Request, *trace.Span) {
+	ctx, span := trace.Start(trace.Extract(r.Context(), r.Header), "service"+r.URL.Path)
+	if span == nil {
+		return r, nil
+	}
+	span.SetKind(trace.KIND_SERVER).SetAttr("http.method", r.Method).SetAttr("http.remote_addr", r.RemoteAddr)
+	return r.WithContext(ctx), span
+}
+
 func (server *Server) secureHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now().UnixNano()
+	r, span := startSpan(r)
 	result := NewResult()
 	var err error
+	defer span.End(&err) //处理函数panic时net/http会恢复，也要结束span
 	s, e := server.conf.IsValidUser(r)
 	var body []byte
 
@@ -166,8 +182,10 @@ func (server *Server) secureHandler(w http.ResponseWriter, r *http.Request) {
 
 func (server *Server) nonSecureHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now().UnixNano()
+	r, span := startSpan(r)
 	result := NewResult()
 	var err error
+	defer span.End(&err) //处理函数panic时net/http会恢复，也要结束span
 
 	s := new(Session)
 	fields := strings.Split(r.URL.Path[1:], "/")
@@ -0,0 +1,95 @@
+package trace
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+//把span按JSON逐行写入文件，每行一个span
+type FileExporter struct {
+	lock sync.Mutex
+	f    *os.File
+	err  error //最后一次写入的错误
+}
+
+/*
+	创建写入文件的Exporter，文件已存在时追加
+
+	参数：
+		path: 文件路径
+*/
+func NewFileExporter(path string) (fe *FileExporter, e error) {
+	f, e := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if e != nil {
+		return
+	}
+	return &FileExporter{f: f}, nil
+}
+
+func (fe *FileExporter) Export(s *Span) {
+	b, e := json.Marshal(s)
+	if e != nil {
+		fe.lock.Lock()
+		fe.err = e
+		fe.lock.Unlock()
+		return
+	}
+	b = append(b, '\n')
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	if _, e = fe.f.Write(b); e != nil {
+		fe.err = e
+	}
+}
+
+//最后一次写入的错误，Export不返回错误，需要时用它检查
+func (fe *FileExporter) Err() error {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	return fe.err
+}
+
+func (fe *FileExporter) Close() error {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	return fe.f.Close()
+}
+
+//在内存中保存结束的span，用于测试和临时诊断
+type Recorder struct {
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func (r *Recorder) Export(s *Span) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+//按结束顺序返回已记录的span
+func (r *Recorder) Spans() []*Span {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]*Span(nil), r.spans...)
+}
+
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = nil
+}
+
+type multiExporter []Exporter
+
+func (m multiExporter) Export(s *Span) {
+	for _, e := range m {
+		e.Export(s)
+	}
+}
+
+//同时导出到多个Exporter，例如同时写文件和发送到collector
+func Multi(es ...Exporter) Exporter {
+	return multiExporter(es)
+}
@@ -0,0 +1,364 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	OTLP/HTTP的JSON格式（ExportTraceServiceRequest），只包含用到的字段。
+	trace ID和span ID为十六进制字符串，时间为纳秒的十进制字符串。
+*/
+type OTLPRequest struct {
+	ResourceSpans []OTLPResourceSpans `json:"resourceSpans"`
+}
+
+type OTLPResourceSpans struct {
+	Resource   OTLPResource     `json:"resource"`
+	ScopeSpans []OTLPScopeSpans `json:"scopeSpans"`
+}
+
+type OTLPResource struct {
+	Attributes []OTLPKeyValue `json:"attributes"`
+}
+
+type OTLPScopeSpans struct {
+	Scope OTLPScope  `json:"scope"`
+	Spans []OTLPSpan `json:"spans"`
+}
+
+type OTLPScope struct {
+	Name string `json:"name"`
+}
+
+type OTLPSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []OTLPKeyValue `json:"attributes,omitempty"`
+	Status            OTLPStatus     `json:"status"`
+}
+
+//Code: 0-未设置，1-成功，2-失败
+type OTLPStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type OTLPKeyValue struct {
+	Key   string       `json:"key"`
+	Value OTLPAnyValue `json:"value"`
+}
+
+//只有一个字段不为nil，整数按OTLP的要求为十进制字符串
+type OTLPAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+const (
+	OTLP_STATUS_ERROR = 2
+	OTLP_SCOPE        = "yh_pkg/trace"
+	OTLP_PATH         = "/v1/traces" //OTLP/HTTP的默认路径
+)
+
+func otlpValue(v interface{}) (av OTLPAnyValue) {
+	var i string
+	switch x := v.(type) {
+	case string:
+		av.StringValue = &x
+		return
+	case bool:
+		av.BoolValue = &x
+		return
+	case float32:
+		f := float64(x)
+		av.DoubleValue = &f
+		return
+	case float64:
+		av.DoubleValue = &x
+		return
+	case int:
+		i = strconv.FormatInt(int64(x), 10)
+	case int8:
+		i = strconv.FormatInt(int64(x), 10)
+	case int16:
+		i = strconv.FormatInt(int64(x), 10)
+	case int32:
+		i = strconv.FormatInt(int64(x), 10)
+	case int64:
+		i = strconv.FormatInt(x, 10)
+	case uint:
+		i = strconv.FormatUint(uint64(x), 10)
+	case uint8:
+		i = strconv.FormatUint(uint64(x), 10)
+	case uint16:
+		i = strconv.FormatUint(uint64(x), 10)
+	case uint32:
+		i = strconv.FormatUint(uint64(x), 10)
+	case uint64:
+		i = strconv.FormatUint(x, 10)
+	default:
+		s := fmt.Sprint(v)
+		av.StringValue = &s
+		return
+	}
+	av.IntValue = &i
+	return
+}
+
+func otlpAttributes(attrs map[string]interface{}) (kvs []OTLPKeyValue) {
+	for k, v := range attrs {
+		kvs = append(kvs, OTLPKeyValue{k, otlpValue(v)})
+	}
+	return
+}
+
+//把span转换为OTLP格式
+func ToOTLP(s *Span) (ts OTLPSpan) {
+	ts = OTLPSpan{
+		TraceID:           s.TraceID,
+		SpanID:            s.SpanID,
+		ParentSpanID:      s.ParentID,
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.StartTm, 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTm, 10),
+		Attributes:        otlpAttributes(s.Attrs),
+	}
+	if s.Error != "" {
+		ts.Status = OTLPStatus{OTLP_STATUS_ERROR, s.Error}
+	}
+	return
+}
+
+/*
+	生成一个服务的OTLP请求
+
+	参数：
+		service: 资源属性service.name
+*/
+func NewOTLPRequest(service string, spans []*Span) (req *OTLPRequest) {
+	ss := OTLPScopeSpans{Scope: OTLPScope{OTLP_SCOPE}, Spans: make([]OTLPSpan, 0, len(spans))}
+	for _, s := range spans {
+		ss.Spans = append(ss.Spans, ToOTLP(s))
+	}
+	rs := OTLPResourceSpans{Resource: OTLPResource{[]OTLPKeyValue{{"service.name", otlpValue(service)}}}, ScopeSpans: []OTLPScopeSpans{ss}}
+	return &OTLPRequest{[]OTLPResourceSpans{rs}}
+}
+
+//接收OTLP请求的collector
+type Collector interface {
+	Export(req *OTLPRequest) error
+}
+
+//通过OTLP/HTTP发送JSON的collector，例如URL为http://127.0.0.1:4318/v1/traces
+type HTTPCollector struct {
+	URL    string
+	Client *http.Client //nil时使用http.DefaultClient
+}
+
+func (hc *HTTPCollector) Export(req *OTLPRequest) (e error) {
+	data, e := json.Marshal(req)
+	if e != nil {
+		return
+	}
+	client := hc.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, e := client.Post(hc.URL, "application/json", bytes.NewReader(data))
+	if e != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("collector %s returns %d: %s", hc.URL, resp.StatusCode, body)
+	}
+	return
+}
+
+//在内存中保存收到的请求，作为本地的collector替身
+type MemCollector struct {
+	lock sync.Mutex
+	reqs []*OTLPRequest
+}
+
+func (mc *MemCollector) Export(req *OTLPRequest) error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.reqs = append(mc.reqs, req)
+	return nil
+}
+
+//收到的所有span
+func (mc *MemCollector) Spans() (spans []OTLPSpan) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	for _, req := range mc.reqs {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return
+}
+
+/*
+	把collector作为OTLP/HTTP服务，接收JSON格式的请求，与HTTPCollector配合可以在本地替代真实的collector：
+
+		http.Handle(trace.OTLP_PATH, trace.CollectorHandler(&trace.MemCollector{}))
+*/
+func CollectorHandler(c Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req OTLPRequest
+		if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+		if e := c.Export(&req); e != nil {
+			http.Error(w, e.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	})
+}
+
+const (
+	OTLP_MAX_PENDING_BATCHES = 100             //等待发送的span超过batch的倍数时丢弃新的span
+	OTLP_DEFAULT_INTERVAL    = 5 * time.Second //interval不大于0时定期发送的间隔
+)
+
+var ErrExporterClosed = errors.New("otlp exporter closed")
+
+//按批次把span发送到collector，发送在后台goroutine中进行，不阻塞End
+type OTLPExporter struct {
+	c       Collector
+	service string
+	batch   int
+
+	lock    sync.Mutex
+	spans   []*Span
+	dropped uint64
+	err     error //最后一次发送的错误
+	closed  bool
+	full    chan struct{}
+	done    chan struct{}
+}
+
+/*
+	创建发送到collector的Exporter，启动后台发送的goroutine
+
+	参数：
+		c: collector，本地测试时可以用MemCollector
+		service: 资源属性service.name
+		batch: 等待发送的span达到batch个时立即发送
+		interval: 定期发送的间隔，不到batch个也发送，不大于0时为OTLP_DEFAULT_INTERVAL
+*/
+func NewOTLPExporter(c Collector, service string, batch int, interval time.Duration) *OTLPExporter {
+	if batch <= 0 {
+		batch = 1
+	}
+	if interval <= 0 {
+		interval = OTLP_DEFAULT_INTERVAL
+	}
+	o := &OTLPExporter{c: c, service: service, batch: batch, full: make(chan struct{}, 1), done: make(chan struct{})}
+	go o.run(interval)
+	return o
+}
+
+func (o *OTLPExporter) Export(s *Span) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed || len(o.spans) >= o.batch*OTLP_MAX_PENDING_BATCHES {
+		o.dropped++
+		return
+	}
+	o.spans = append(o.spans, s)
+	if len(o.spans) >= o.batch {
+		select {
+		case o.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (o *OTLPExporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.full:
+		case <-o.done:
+			return
+		}
+		o.Flush()
+	}
+}
+
+//立即发送等待中的span
+func (o *OTLPExporter) Flush() (e error) {
+	o.lock.Lock()
+	spans := o.spans
+	o.spans = nil
+	o.lock.Unlock()
+	for len(spans) > 0 {
+		n := o.batch
+		if n > len(spans) {
+			n = len(spans)
+		}
+		if err := o.c.Export(NewOTLPRequest(o.service, spans[:n])); err != nil {
+			e = err
+		}
+		spans = spans[n:]
+	}
+	if e != nil {
+		o.lock.Lock()
+		o.err = e
+		o.lock.Unlock()
+	}
+	return
+}
+
+/*
+	最后一次发送的错误和因为等待发送的span过多而丢弃的span数
+*/
+func (o *OTLPExporter) Stats() (dropped uint64, e error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.dropped, o.err
+}
+
+//停止后台发送并发送剩余的span，之后Export的span被丢弃
+func (o *OTLPExporter) Close() (e error) {
+	o.lock.Lock()
+	if o.closed {
+		o.lock.Unlock()
+		return ErrExporterClosed
+	}
+	o.closed = true
+	o.lock.Unlock()
+	close(o.done)
+	return o.Flush()
+}
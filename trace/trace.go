@@ -0,0 +1,249 @@
+/*
+轻量的调用链追踪。
+
+span记录一次调用的开始结束时间、属性和错误，父span都显式传递，没有全局状态：
+	1. context：Start(ctx, name)从ctx中取父span，返回包含新span的ctx；
+	2. Span参数：parent.Child(name)以parent为父span；
+	3. HTTP头：Inject把span写入HEADER（W3C traceparent格式），Extract从请求头中取出远端的父span。
+没有context参数的接口用Span参数传递父span，例如p2p_storage.WithSpan。
+
+没有设置Exporter时不追踪，Begin、Child和Start返回nil，Span的方法都可以用nil调用，开销只有一次原子读取：
+
+	defer parent.Child("p2p_storage.AddP2PFile").SetAttr("md5", md5).End(&e)
+
+结束的span交给Exporter导出，见NewFileExporter和NewOTLPExporter。
+*/
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//传递父span的HTTP头
+const HEADER = "Traceparent"
+
+//span的类型，与OTLP的SpanKind一致
+const (
+	KIND_INTERNAL = 1 //进程内的调用
+	KIND_SERVER   = 2 //处理远端的请求
+	KIND_CLIENT   = 3 //向远端发送请求
+)
+
+type Span struct {
+	TraceID  string                 `json:"trace_id"`
+	SpanID   string                 `json:"span_id"`
+	ParentID string                 `json:"parent_id,omitempty"`
+	Name     string                 `json:"name"`
+	Kind     int                    `json:"kind"`
+	StartTm  int64                  `json:"start_tm"` //开始时间（纳秒）
+	EndTm    int64                  `json:"end_tm"`   //结束时间（纳秒）
+	Attrs    map[string]interface{} `json:"attrs,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+
+	remote bool //从HTTP头中取出的父span，只有ID
+	ended  int32
+}
+
+//结束的span的导出接口，Export在End所在的goroutine中调用，需要自己保证并发安全，不能阻塞太久
+type Exporter interface {
+	Export(s *Span)
+}
+
+type exporterHolder struct {
+	e Exporter
+}
+
+var exporter atomic.Value
+
+/*
+	设置导出span的Exporter，nil表示停止追踪
+*/
+func SetExporter(e Exporter) {
+	exporter.Store(exporterHolder{e})
+}
+
+func getExporter() Exporter {
+	h, _ := exporter.Load().(exporterHolder)
+	return h.e
+}
+
+//是否在追踪
+func Enabled() bool {
+	return getExporter() != nil
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//开始span，parent为nil时作为新的trace的根
+func newSpan(name string, parent *Span) (s *Span) {
+	s = &Span{SpanID: newID(8), Name: name, Kind: KIND_INTERNAL, StartTm: time.Now().UnixNano()}
+	if parent != nil {
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		s.TraceID = newID(16)
+	}
+	return
+}
+
+/*
+	开始新的trace的根span
+
+	返回值：
+		s: 没有设置Exporter时为nil
+*/
+func Begin(name string) (s *Span) {
+	if !Enabled() {
+		return nil
+	}
+	return newSpan(name, nil)
+}
+
+/*
+	以s为父span开始span，s为nil时与Begin相同
+
+	返回值：
+		c: 没有设置Exporter时为nil
+*/
+func (s *Span) Child(name string) (c *Span) {
+	if !Enabled() {
+		return nil
+	}
+	return newSpan(name, s)
+}
+
+/*
+	开始span，父span为ctx中的span（包括Extract取出的远端span），没有时与Begin相同
+
+	返回值：
+		nctx: 包含新span的ctx，没有设置Exporter时为ctx
+		s: 没有设置Exporter时为nil
+*/
+func Start(ctx context.Context, name string) (nctx context.Context, s *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+	s = newSpan(name, FromContext(ctx))
+	return NewContext(ctx, s), s
+}
+
+type contextKey struct{}
+
+//ctx中的span，没有时为nil
+func FromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(contextKey{}).(*Span)
+	return s
+}
+
+//把span放入ctx，s为nil时返回ctx
+func NewContext(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+//设置属性，返回s本身以便连续调用
+func (s *Span) SetAttr(key string, value interface{}) *Span {
+	if s == nil || s.remote {
+		return s
+	}
+	if s.Attrs == nil {
+		s.Attrs = make(map[string]interface{})
+	}
+	s.Attrs[key] = value
+	return s
+}
+
+//设置类型，返回s本身以便连续调用
+func (s *Span) SetKind(kind int) *Span {
+	if s != nil && !s.remote {
+		s.Kind = kind
+	}
+	return s
+}
+
+/*
+	结束span并导出，重复调用只有第一次有效
+
+	参数：
+		e: 函数的错误返回值的地址，*e不为nil时记录错误，可以为nil
+*/
+func (s *Span) End(e *error) {
+	if s == nil || s.remote || !atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		return
+	}
+	s.EndTm = time.Now().UnixNano()
+	if e != nil && *e != nil {
+		s.Error = (*e).Error()
+	}
+	if exp := getExporter(); exp != nil {
+		exp.Export(s)
+	}
+}
+
+//持续时间，没有结束时为0
+func (s *Span) Duration() time.Duration {
+	if s == nil || s.EndTm == 0 {
+		return 0
+	}
+	return time.Duration(s.EndTm - s.StartTm)
+}
+
+//W3C traceparent格式：版本-trace ID-span ID-标志
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+/*
+	解析traceparent
+
+	返回值：
+		s: 只有TraceID和SpanID的远端span，格式错误时为nil
+*/
+func ParseTraceParent(v string) (s *Span) {
+	fields := strings.Split(strings.TrimSpace(v), "-")
+	if len(fields) < 4 || len(fields[1]) != 32 || len(fields[2]) != 16 {
+		return nil
+	}
+	for _, f := range fields[1:3] {
+		if _, e := hex.DecodeString(f); e != nil || strings.Trim(f, "0") == "" {
+			return nil
+		}
+	}
+	return &Span{TraceID: strings.ToLower(fields[1]), SpanID: strings.ToLower(fields[2]), remote: true}
+}
+
+//把s写入HTTP头，s为nil时不写
+func Inject(s *Span, h http.Header) {
+	if s != nil {
+		h.Set(HEADER, s.TraceParent())
+	}
+}
+
+//从HTTP头中取出远端的父span放入ctx，没有或者没有设置Exporter时返回ctx
+func Extract(ctx context.Context, h http.Header) context.Context {
+	if !Enabled() {
+		return ctx
+	}
+	return NewContext(ctx, ParseTraceParent(h.Get(HEADER)))
+}
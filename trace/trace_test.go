@@ -0,0 +1,198 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func record() *Recorder {
+	r := &Recorder{}
+	SetExporter(r)
+	return r
+}
+
+func TestDisabled(t *testing.T) {
+	SetExporter(nil)
+	s := Begin("a").SetAttr("k", 1).SetKind(KIND_CLIENT)
+	if s != nil {
+		t.Fatal("span started without exporter")
+	}
+	e := errors.New("x")
+	s.End(&e)
+	ctx := context.Background()
+	if nctx, s := Start(ctx, "b"); nctx != ctx || s != nil {
+		t.Fatal("Start without exporter")
+	}
+}
+
+func TestNesting(t *testing.T) {
+	r := record()
+	defer SetExporter(nil)
+	root := Begin("root")
+	f := func(parent *Span) (e error) {
+		defer parent.Child("child").SetAttr("md5", "m1").End(&e)
+		return errors.New("child failed")
+	}
+	f(root)
+	//没有显式传递父span时是新的trace
+	other := Begin("other")
+	other.End(nil)
+	root.End(nil)
+	root.End(nil)
+	orphan := (*Span)(nil).Child("orphan")
+	orphan.End(nil)
+
+	spans := r.Spans()
+	if len(spans) != 4 {
+		t.Fatalf("%d spans, want 4", len(spans))
+	}
+	child := spans[0]
+	if child.Name != "child" || child.TraceID != root.TraceID || child.ParentID != root.SpanID {
+		t.Errorf("child %+v, root %+v", child, root)
+	}
+	if child.Error != "child failed" || child.Attrs["md5"] != "m1" || child.EndTm < child.StartTm {
+		t.Errorf("child %+v", child)
+	}
+	for _, s := range []*Span{other, orphan} {
+		if s.TraceID == root.TraceID || s.ParentID != "" {
+			t.Errorf("span without parent inherits %+v", s)
+		}
+	}
+	if root.ParentID != "" || root.Error != "" || root.Duration() <= 0 {
+		t.Errorf("root %+v", root)
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	record()
+	defer SetExporter(nil)
+	client := Begin("client").SetKind(KIND_CLIENT)
+	h := http.Header{}
+	Inject(client, h)
+	client.End(nil)
+
+	//服务端从请求头中取出父span
+	ctx, server := Start(Extract(context.Background(), h), "server")
+	if server.TraceID != client.TraceID || server.ParentID != client.SpanID {
+		t.Fatalf("server %+v, client %+v", server, client)
+	}
+	if FromContext(ctx) != server {
+		t.Fatal("span not in context")
+	}
+	_, s := Start(ctx, "handler")
+	if s.ParentID != server.SpanID {
+		t.Errorf("handler parent %s, want %s", s.ParentID, server.SpanID)
+	}
+	s.End(nil)
+	server.End(nil)
+
+	for _, v := range []string{"", "00-xyz", "00-00000000000000000000000000000000-0000000000000001-01", "00-" + client.TraceID + "-zz00000000000001-01"} {
+		if ParseTraceParent(v) != nil {
+			t.Errorf("ParseTraceParent(%q) should fail", v)
+		}
+	}
+	if p := ParseTraceParent(client.TraceParent()); p == nil || p.TraceID != client.TraceID || p.SpanID != client.SpanID {
+		t.Errorf("ParseTraceParent %+v", p)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, e := ioutil.TempDir("", "trace")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.log")
+	fe, e := NewFileExporter(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	SetExporter(fe)
+	defer SetExporter(nil)
+	s := Begin("a").SetAttr("size", 10)
+	Begin("b").End(nil)
+	s.End(nil)
+	if e = fe.Close(); e != nil || fe.Err() != nil {
+		t.Fatal(e, fe.Err())
+	}
+
+	f, e := os.Open(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer f.Close()
+	var names []string
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var got Span
+		if e = json.Unmarshal(sc.Bytes(), &got); e != nil {
+			t.Fatal(e)
+		}
+		names = append(names, got.Name)
+		if got.Name == "a" && (got.Attrs["size"] != float64(10) || got.SpanID != s.SpanID) {
+			t.Errorf("span a %+v", got)
+		}
+	}
+	if len(names) != 2 || names[0] != "b" || names[1] != "a" {
+		t.Errorf("spans %v", names)
+	}
+}
+
+func TestOTLP(t *testing.T) {
+	mc := &MemCollector{}
+	mux := http.NewServeMux()
+	mux.Handle(OTLP_PATH, CollectorHandler(mc))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	o := NewOTLPExporter(&HTTPCollector{URL: ts.URL + OTLP_PATH}, "p2p", 2, 0)
+	SetExporter(o)
+	defer SetExporter(nil)
+	for _, name := range []string{"a", "b", "c"} {
+		func() (e error) {
+			defer Begin(name).SetAttr("n", 1).SetAttr("ok", true).End(&e)
+			if name == "c" {
+				e = errors.New("failed")
+			}
+			return
+		}()
+	}
+	if e := o.Close(); e != nil {
+		t.Fatal(e)
+	}
+	if dropped, e := o.Stats(); dropped != 0 || e != nil {
+		t.Fatal(dropped, e)
+	}
+
+	spans := mc.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("%d spans, want 3", len(spans))
+	}
+	for _, s := range spans {
+		if len(s.TraceID) != 32 || len(s.SpanID) != 16 || s.StartTimeUnixNano == "" || len(s.Attributes) != 2 {
+			t.Errorf("span %+v", s)
+		}
+		for _, kv := range s.Attributes {
+			if kv.Key == "n" && (kv.Value.IntValue == nil || *kv.Value.IntValue != "1") {
+				t.Errorf("attribute %+v", kv)
+			}
+		}
+		if (s.Name == "c") != (s.Status.Code == OTLP_STATUS_ERROR) {
+			t.Errorf("span %s status %+v", s.Name, s.Status)
+		}
+	}
+
+	//collector返回错误
+	bad := NewOTLPExporter(&HTTPCollector{URL: ts.URL + "/none"}, "p2p", 10, 0)
+	bad.Export(&Span{Name: "x"})
+	if e := bad.Close(); e == nil {
+		t.Fatal("expect error from collector")
+	}
+}